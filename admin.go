@@ -0,0 +1,231 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/formats"
+)
+
+const (
+	// defaultRecordingsLimit is the number of recorded requests
+	// listed when the admin does not set a limit
+	defaultRecordingsLimit = 50
+
+	// maxRecordingsLimit is the maximum number of recorded
+	// requests listed at once
+	maxRecordingsLimit = 1000
+)
+
+// authorizeAdmin authenticates an admin API request and verifies its
+// body, and that the user is an admin. It writes an
+// error to the client and returns false when any check fails.
+func (a *autographer) authorizeAdmin(w http.ResponseWriter, r *http.Request) (userid string, body []byte, ok bool) {
+	body, read := a.readRequestBody(w, r)
+	if !read {
+		return
+	}
+	userid, err := a.authorize(r, body)
+	if err != nil {
+		authError(w, r, err)
+		return
+	}
+	auth, err := a.getAuthByID(userid)
+	if err != nil || !auth.Admin {
+		a.authorizationDenied(w, r, http.StatusUnauthorized, formats.ErrorCodeUnauthorized, userid, "", errors.New("user is not permitted to call this endpoint"))
+		return
+	}
+	a.exportAudit(r, userid)
+	a.securityEvent(r, formats.ExportedEvent{
+		Action:  formats.SecurityActionAdminAction,
+		UserID:  userid,
+		Message: r.Method + " " + r.URL.Path,
+	})
+	return userid, body, true
+}
+
+// writeAdminJSON writes an admin API response
+func writeAdminJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "failed to marshal response: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// recordingResponse returns the admin API form of a recorded request
+func recordingResponse(rec database.RecordedRequest) formats.RecordedRequest {
+	resp := formats.RecordedRequest{
+		ID:          rec.ID,
+		Ref:         rec.Ref,
+		RequestID:   rec.RequestID,
+		SignerID:    rec.SignerID,
+		UserID:      rec.UserID,
+		Endpoint:    rec.Endpoint,
+		InputHash:   rec.InputHash,
+		InputLength: rec.InputLength,
+		OutputHash:  rec.OutputHash,
+		Status:      rec.Status,
+		DurationMS:  rec.DurationMS,
+		CreatedAt:   rec.CreatedAt,
+	}
+	if rec.Options != "" && rec.Options != "null" {
+		resp.Options = json.RawMessage(rec.Options)
+	}
+	return resp
+}
+
+// getRecording returns the recorded request of the id in the request
+// path. It writes an error to the client and returns false when it
+// cannot be found.
+func (a *autographer) getRecording(w http.ResponseWriter, r *http.Request) (rec database.RecordedRequest, ok bool) {
+	if a.recorder == nil {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "request recording is not enabled")
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "invalid recording id: %v", err)
+		return
+	}
+	rec, err = a.recorder.GetRecordedRequest(r.Context(), id)
+	if err == database.ErrRecordingNotFound {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "recording %d not found", id)
+		return
+	}
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	return rec, true
+}
+
+// handleListRecordings returns the latest recorded requests of the
+// signer set in the "signer" query parameter
+func (a *autographer) handleListRecordings(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := a.authorizeAdmin(w, r); !ok {
+		return
+	}
+	if a.recorder == nil {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "request recording is not enabled")
+		return
+	}
+	signerID := r.URL.Query().Get("signer")
+	if signerID == "" {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "missing signer query parameter")
+		return
+	}
+	limit := defaultRecordingsLimit
+	if r.URL.Query().Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit < 1 || limit > maxRecordingsLimit {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "limit must be between 1 and %d", maxRecordingsLimit)
+			return
+		}
+	}
+	recs, err := a.recorder.ListRecordedRequests(r.Context(), signerID, limit)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	resp := make([]formats.RecordedRequest, len(recs))
+	for i, rec := range recs {
+		resp[i] = recordingResponse(rec)
+	}
+	writeAdminJSON(w, r, resp)
+}
+
+// handleGetRecording returns a recorded request
+func (a *autographer) handleGetRecording(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := a.authorizeAdmin(w, r); !ok {
+		return
+	}
+	rec, ok := a.getRecording(w, r)
+	if !ok {
+		return
+	}
+	writeAdminJSON(w, r, recordingResponse(rec))
+}
+
+// handleReplayRecording signs the input of a recorded request again
+// with its signer and options, and compares the output hash with the
+// recorded one
+func (a *autographer) handleReplayRecording(w http.ResponseWriter, r *http.Request) {
+	userid, body, ok := a.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+	rec, ok := a.getRecording(w, r)
+	if !ok {
+		return
+	}
+	var req formats.ReplayRequest
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "failed to parse request body: %v", err)
+		return
+	}
+	input, err := base64.StdEncoding.DecodeString(req.Input)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidInput, "%v", err)
+		return
+	}
+	if recordedInputHash(rec.Endpoint, input) != rec.InputHash {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidInput, "input does not match the recorded input hash")
+		return
+	}
+	var options interface{}
+	if rec.Options != "" {
+		err = json.Unmarshal([]byte(rec.Options), &options)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "failed to parse recorded options: %v", err)
+			return
+		}
+	}
+	requestedSigner, found := a.getSignerByID(rec.SignerID)
+	if !found {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "signer %q of the recording is not configured", rec.SignerID)
+		return
+	}
+	requestedSigner, err = resolveSigner(requestedSigner)
+	if err != nil {
+		httpError(w, r, http.StatusServiceUnavailable, formats.ErrorCodeSignerUnavailable, "%v", err)
+		return
+	}
+	ctx, cancel := a.requestContext(r)
+	defer cancel()
+	sigresp, outputHash, err := replaySignature(ctx, requestedSigner, rec.Endpoint, input, options)
+	if err != nil {
+		status, code := signingError(ctx, err)
+		httpError(w, r, status, code, "replay failed with error: %v", err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"rid":          getRequestID(r),
+		"recording_id": rec.ID,
+		"signer_id":    rec.SignerID,
+		"user_id":      userid,
+		"matches":      outputHash == rec.OutputHash,
+	}).Info("replayed recorded request")
+	writeAdminJSON(w, r, formats.ReplayResponse{
+		Recording:     recordingResponse(rec),
+		Signature:     sigresp,
+		OutputHash:    outputHash,
+		OutputMatches: outputHash == rec.OutputHash,
+	})
+}
@@ -0,0 +1,137 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/database"
+)
+
+// schemeAPIKey authenticates requests with a static API key sent as
+// a bearer token, for internal tooling that cannot sign hawk requests
+const schemeAPIKey = "apikey"
+
+// apiKeysConfig configures static API key authentication
+type apiKeysConfig struct {
+	// Database loads API keys and their signers from the
+	// api_keys table at startup, in addition to the keys of
+	// the authorizations
+	Database bool
+}
+
+// apiKeyStore lists the static API keys stored in the database
+type apiKeyStore interface {
+	ListAPIKeys(ctx context.Context) ([]database.APIKey, error)
+}
+
+// an apiKey is the SHA256 hash of the static API key of a user
+type apiKey struct {
+	userid string
+	hash   []byte
+}
+
+func init() {
+	registerAuthenticator(schemeAPIKey, func(a *autographer, conf authenticationConfig) (authenticator, error) {
+		if conf.APIKeys.Database {
+			if a.db == nil {
+				return nil, errors.New("loading api keys from the database requires a database")
+			}
+			err := a.loadAPIKeys(a.db)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &apiKeyAuthenticator{a}, nil
+	})
+}
+
+// parseAPIKeyHash returns the hash of an API key in hex
+func parseAPIKeyHash(hexHash string) ([]byte, error) {
+	hash, err := hex.DecodeString(hexHash)
+	if err != nil || len(hash) != sha256.Size {
+		return nil, errors.Errorf("api key hash must be %d hex encoded bytes of SHA256", sha256.Size)
+	}
+	return hash, nil
+}
+
+// addAPIKey adds the API key of an authorization
+func (a *autographer) addAPIKey(auth authorization) error {
+	hash, err := parseAPIKeyHash(auth.APIKeyHash)
+	if err != nil {
+		return err
+	}
+	for _, key := range a.apiKeys {
+		if subtle.ConstantTimeCompare(key.hash, hash) == 1 {
+			return errors.Errorf("api key is already used by authorization %q", key.userid)
+		}
+	}
+	a.apiKeys = append(a.apiKeys, apiKey{userid: auth.ID, hash: hash})
+	return nil
+}
+
+// loadAPIKeys adds authorizations for the API keys of a store, each
+// with the signers granted to the key
+func (a *autographer) loadAPIKeys(store apiKeyStore) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	keys, err := store.ListAPIKeys(ctx)
+	if err != nil {
+		return err
+	}
+	var auths []authorization
+	for _, key := range keys {
+		auths = append(auths, authorization{
+			ID:         key.ID,
+			APIKeyHash: key.KeyHash,
+			Signers:    key.Signers,
+		})
+	}
+	err = a.addAuthorizations(auths)
+	if err != nil {
+		return errors.Wrap(err, "failed to add api keys from the database")
+	}
+	log.Infof("loaded %d api keys from the database", len(keys))
+	return nil
+}
+
+// apiKeyAuthenticator authenticates requests with a static API key
+// in an "Authorization: Bearer" header
+type apiKeyAuthenticator struct {
+	a *autographer
+}
+
+func (k *apiKeyAuthenticator) scheme() string {
+	return schemeAPIKey
+}
+
+func (k *apiKeyAuthenticator) authenticate(r *http.Request) (string, func(body []byte) error, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(strings.ToLower(header), "bearer ") {
+		return "", nil, errNoCredentials
+	}
+	sum := sha256.Sum256([]byte(strings.TrimSpace(header[len("bearer "):])))
+	// compare with all the keys so the time doesn't depend on
+	// which one matches
+	userid := ""
+	for _, key := range k.a.apiKeys {
+		if subtle.ConstantTimeCompare(key.hash, sum[:]) == 1 {
+			userid = key.userid
+		}
+	}
+	if userid == "" {
+		return "", nil, errors.New("invalid api key")
+	}
+	return userid, nil, nil
+}
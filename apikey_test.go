@@ -0,0 +1,113 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+// memoryAPIKeyStore is an apiKeyStore with a fixed list of keys
+type memoryAPIKeyStore []database.APIKey
+
+func (m memoryAPIKeyStore) ListAPIKeys(ctx context.Context) ([]database.APIKey, error) {
+	return m, nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(10)
+	err := tmpag.addSigners([]signer.Configuration{conf.Signers[0], conf.Signers[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.addAuthorizations([]authorization{{
+		ID:         "cikey",
+		APIKeyHash: hashAPIKey("ci-secret-key"),
+		Signers:    []string{conf.Signers[0].ID},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.loadAPIKeys(memoryAPIKeyStore{{
+		ID:      "dbkey",
+		KeyHash: hashAPIKey("db-secret-key"),
+		Signers: []string{conf.Signers[1].ID},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.setAuthenticators(authenticationConfig{Schemes: []string{"hawk", "apikey"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(key, keyid string) *httptest.ResponseRecorder {
+		body, err := json.Marshal([]formats.SignatureRequest{{Input: "Y2FyaWJvdW1hdXJpY2UK", KeyID: keyid}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		tmpag.handleSignature(w, req)
+		return w
+	}
+
+	w := sign("ci-secret-key", conf.Signers[0].ID)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected api key request to be signed, got %d: %s", w.Code, w.Body.String())
+	}
+	w = sign("db-secret-key", conf.Signers[1].ID)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected database api key request to be signed, got %d: %s", w.Code, w.Body.String())
+	}
+	// each key can only use the signers granted to it
+	w = sign("ci-secret-key", conf.Signers[1].ID)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected api key to be refused a signer it isn't granted, got %d: %s", w.Code, w.Body.String())
+	}
+	w = sign("wrong-key", conf.Signers[0].ID)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected invalid api key to be rejected, got %d: %s", w.Code, w.Body.String())
+	}
+
+	for i, testcase := range []authorization{
+		{ID: "badhash", APIKeyHash: "ci-secret-key", Signers: []string{conf.Signers[0].ID}},
+		{ID: "duplicate", APIKeyHash: hashAPIKey("ci-secret-key"), Signers: []string{conf.Signers[0].ID}},
+	} {
+		err = tmpag.addAuthorizations([]authorization{testcase})
+		if err == nil {
+			t.Fatalf("testcase %d: expected invalid api key to be rejected", i)
+		}
+	}
+	err = newAutographer(1).setAuthenticators(authenticationConfig{
+		Schemes: []string{"apikey"},
+		APIKeys: apiKeysConfig{Database: true},
+	})
+	if err == nil {
+		t.Fatal("expected database api keys to require a database")
+	}
+}
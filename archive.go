@@ -0,0 +1,446 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+// maxArchiveEntries is the maximum number of files an archive
+// signing request can contain
+const maxArchiveEntries = 10000
+
+// archiveFormat is the container format of an archive
+type archiveFormat int
+
+const (
+	archiveFormatTar archiveFormat = iota
+	archiveFormatTarGzip
+	archiveFormatZip
+)
+
+// archiveEntry is a file, directory or link of an archive
+type archiveEntry struct {
+	name string
+	data []byte
+
+	// regular is true for regular files, which are the only
+	// entries that can be signed
+	regular bool
+
+	// sidecar is true for entries written by autograph, which
+	// must not be signed again
+	sidecar bool
+
+	// tarHeader or zipHeader hold the original entry metadata,
+	// depending on the archive format
+	tarHeader *tar.Header
+	zipHeader *zip.FileHeader
+}
+
+// readArchive detects the format of a tar, gzipped tar or zip archive
+// and returns its entries in order
+func readArchive(input []byte) (format archiveFormat, entries []*archiveEntry, err error) {
+	switch {
+	case bytes.HasPrefix(input, []byte("PK\x03\x04")):
+		format = archiveFormatZip
+		entries, err = readZipArchive(input)
+	case bytes.HasPrefix(input, []byte("\x1f\x8b")):
+		format = archiveFormatTarGzip
+		var gzr *gzip.Reader
+		gzr, err = gzip.NewReader(bytes.NewReader(input))
+		if err != nil {
+			return format, nil, errors.Wrap(err, "failed to read gzip stream")
+		}
+		defer gzr.Close()
+		entries, err = readTarArchive(gzr)
+	default:
+		format = archiveFormatTar
+		entries, err = readTarArchive(bytes.NewReader(input))
+	}
+	return
+}
+
+func readTarArchive(r io.Reader) (entries []*archiveEntry, err error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read tar entry")
+		}
+		if len(entries) >= maxArchiveEntries {
+			return nil, errors.Errorf("archive contains more than %d entries", maxArchiveEntries)
+		}
+		entry := &archiveEntry{
+			name:      hdr.Name,
+			regular:   hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA,
+			tarHeader: hdr,
+		}
+		if entry.regular {
+			entry.data, err = ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read tar entry %q", hdr.Name)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("archive is empty or not a tar, gzipped tar or zip archive")
+	}
+	return entries, nil
+}
+
+func readZipArchive(input []byte) (entries []*archiveEntry, err error) {
+	zr, err := zip.NewReader(bytes.NewReader(input), int64(len(input)))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read zip archive")
+	}
+	if len(zr.File) > maxArchiveEntries {
+		return nil, errors.Errorf("archive contains more than %d entries", maxArchiveEntries)
+	}
+	for _, f := range zr.File {
+		hdr := f.FileHeader
+		entry := &archiveEntry{
+			name:      f.Name,
+			regular:   f.Mode().IsRegular(),
+			zipHeader: &hdr,
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open zip entry %q", f.Name)
+		}
+		entry.data, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read zip entry %q", f.Name)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// newSidecarEntry returns a regular file entry to add next to source
+// in the archive with the same timestamp
+func newSidecarEntry(source *archiveEntry, name string, data []byte) *archiveEntry {
+	entry := &archiveEntry{
+		name:    name,
+		data:    data,
+		regular: true,
+		sidecar: true,
+	}
+	if source.tarHeader != nil {
+		entry.tarHeader = &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			ModTime:  source.tarHeader.ModTime,
+			Format:   source.tarHeader.Format,
+		}
+	}
+	if source.zipHeader != nil {
+		entry.zipHeader = &zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: source.zipHeader.Modified,
+		}
+	}
+	return entry
+}
+
+// writeArchive packs entries into an archive of the given format
+func writeArchive(format archiveFormat, entries []*archiveEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case archiveFormatZip:
+		zw := zip.NewWriter(&buf)
+		for _, entry := range entries {
+			hdr := *entry.zipHeader
+			fw, err := zw.CreateHeader(&hdr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to write zip entry %q", entry.name)
+			}
+			_, err = fw.Write(entry.data)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to write zip entry %q", entry.name)
+			}
+		}
+		err := zw.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to close zip archive")
+		}
+	case archiveFormatTar, archiveFormatTarGzip:
+		var w io.Writer = &buf
+		var gzw *gzip.Writer
+		if format == archiveFormatTarGzip {
+			gzw = gzip.NewWriter(&buf)
+			w = gzw
+		}
+		tw := tar.NewWriter(w)
+		for _, entry := range entries {
+			hdr := *entry.tarHeader
+			if entry.regular {
+				hdr.Size = int64(len(entry.data))
+			}
+			err := tw.WriteHeader(&hdr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to write tar header of %q", entry.name)
+			}
+			if entry.regular {
+				_, err = tw.Write(entry.data)
+				if err != nil {
+					return nil, errors.Wrapf(err, "failed to write tar entry %q", entry.name)
+				}
+			}
+		}
+		err := tw.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to close tar archive")
+		}
+		if gzw != nil {
+			err = gzw.Close()
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to close gzip stream")
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// matchArchiveManifest returns the index of the first manifest entry
+// whose pattern matches name, or -1 if none does
+func matchArchiveManifest(manifest []formats.ArchiveManifestEntry, name string) int {
+	for i, entry := range manifest {
+		if matched, _ := path.Match(entry.Path, name); matched {
+			return i
+		}
+	}
+	return -1
+}
+
+// handleArchiveSignature endpoint accepts a tar, gzipped tar or zip
+// archive and a manifest of signers to apply to its paths in a HAWK
+// authenticated POST request. It signs each matching file and returns
+// the repacked archive.
+func (a *autographer) handleArchiveSignature(w http.ResponseWriter, r *http.Request) {
+	rid := getRequestID(r)
+	starttime := getRequestStartTime(r)
+	userid, body, ok := a.authorizeRequestBody(w, r)
+	if !ok {
+		return
+	}
+	release, ok := a.admitRequest(w, r, userid)
+	if !ok {
+		return
+	}
+	defer release()
+	var req formats.ArchiveSignatureRequest
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "failed to parse request body: %v", err)
+		return
+	}
+	if req.Input == "" {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidInput, "missing input in archive signature request")
+		return
+	}
+	if len(req.Manifest) == 0 {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "missing manifest in archive signature request")
+		return
+	}
+	// look up all the signers before signing anything, such that
+	// a request for a signer the user cannot use fails early
+	signers := make([]signer.Signer, len(req.Manifest))
+	for i, entry := range req.Manifest {
+		_, err = path.Match(entry.Path, "")
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "invalid path pattern %q in manifest entry %d: %v", entry.Path, i, err)
+			return
+		}
+		signers[i], err = a.authBackend.getSignerForUser(userid, entry.KeyID)
+		if err != nil {
+			a.authorizationDenied(w, r, http.StatusUnauthorized, formats.ErrorCodeSignerNotPermitted, userid, entry.KeyID, err)
+			return
+		}
+		signers[i], err = resolveSigner(signers[i])
+		if err != nil {
+			httpError(w, r, http.StatusServiceUnavailable, formats.ErrorCodeSignerUnavailable, "%v", err)
+			return
+		}
+		_, isFileSigner := signers[i].(signer.FileSigner)
+		_, isDataSigner := signers[i].(signer.DataSigner)
+		if !isFileSigner && !isDataSigner {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeUnsupportedOperation, "signer %q does not implement file or data signing", entry.KeyID)
+			return
+		}
+	}
+	signerIDs := make([]string, len(signers))
+	for i, s := range signers {
+		signerIDs[i] = s.Config().ID
+	}
+	defer a.load.startSigning(signerIDs...)()
+	ctx, cancel := a.requestContext(r)
+	defer cancel()
+	ctx = a.withAddOnIDs(ctx, userid)
+	ctx = a.withMARChannels(ctx, userid)
+	input, releaseInput, err := decodeBase64Input(ctx, req.Input)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidInput, "%v", err)
+		return
+	}
+	defer releaseInput()
+	format, entries, err := readArchive(input)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidInput, "failed to read archive: %v", err)
+		return
+	}
+	byName := make(map[string]*archiveEntry, len(entries))
+	for _, entry := range entries {
+		byName[entry.name] = entry
+	}
+	// addSidecar writes data to a new entry, or replaces the data
+	// of an existing entry such as a stale detached signature
+	addSidecar := func(source *archiveEntry, name string, data []byte) {
+		if existing, ok := byName[name]; ok && existing.regular {
+			existing.data = data
+			existing.sidecar = true
+			return
+		}
+		sidecar := newSidecarEntry(source, name, data)
+		byName[name] = sidecar
+		entries = append(entries, sidecar)
+	}
+
+	ref := id()
+	var entryResps []formats.ArchiveEntryResponse
+	// entries grows as sidecars are added, but those are never signed
+	for i := 0; i < len(entries); i++ {
+		entry := entries[i]
+		if !entry.regular || entry.sidecar {
+			continue
+		}
+		idx := matchArchiveManifest(req.Manifest, entry.name)
+		if idx < 0 {
+			continue
+		}
+		conf := signers[idx].Config()
+		if !a.checkDenylist(w, r, userid, conf.ID, "/sign/archive", entry.data) {
+			return
+		}
+		options := req.Manifest[idx].Options
+		entryResp := formats.ArchiveEntryResponse{
+			Path:     entry.name,
+			SignerID: conf.ID,
+			Type:     conf.Type,
+			Mode:     conf.Mode,
+		}
+		inputHash := hashSHA256AsHex(entry.data)
+		var outputHash string
+		// prefer signing the file in place over adding a
+		// detached signature when the signer supports both
+		if fileSigner, ok := signers[idx].(signer.FileSigner); ok {
+			var (
+				signedfile []byte
+				artifacts  []signer.Artifact
+			)
+			if artifactsSigner, ok := signers[idx].(signer.ArtifactsFileSigner); ok {
+				signedfile, artifacts, err = artifactsSigner.SignFileArtifacts(ctx, entry.data, options)
+			} else {
+				signedfile, err = signer.SignFileContext(ctx, fileSigner, entry.data, options)
+			}
+			if err != nil {
+				a.recordUsage(conf.ID, userid, len(entry.data), true)
+				status, code := signingError(ctx, err)
+				a.signingRejected(r, code, userid, conf.ID, err)
+				a.recordSLO(r, conf.ID, code)
+				httpError(w, r, status, code, "signing %q failed with error: %v", entry.name, err)
+				return
+			}
+			a.recordUsage(conf.ID, userid, len(entry.data), false)
+			a.countKeySignature(conf, nil)
+			a.recordSLO(r, conf.ID, "")
+			a.registerArtifact(r, ref, conf.ID, userid, entry.name, nil, entry.data, signedfile)
+			entry.data = signedfile
+			outputHash = hashSHA256AsHex(signedfile)
+			entryResp.Outputs = append(entryResp.Outputs, entry.name)
+			for _, artifact := range artifacts {
+				name := entry.name + path.Ext(artifact.Name)
+				addSidecar(entry, name, artifact.Data)
+				entryResp.Outputs = append(entryResp.Outputs, name)
+			}
+		} else {
+			sig, err := signer.SignDataContext(ctx, signers[idx].(signer.DataSigner), entry.data, options)
+			if err != nil {
+				a.recordUsage(conf.ID, userid, len(entry.data), true)
+				status, code := signingError(ctx, err)
+				a.signingRejected(r, code, userid, conf.ID, err)
+				a.recordSLO(r, conf.ID, code)
+				httpError(w, r, status, code, "signing %q failed with error: %v", entry.name, err)
+				return
+			}
+			a.recordUsage(conf.ID, userid, len(entry.data), false)
+			a.countKeySignature(conf, sig)
+			a.recordSLO(r, conf.ID, "")
+			encodedsig, err := sig.Marshal()
+			if err != nil {
+				httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeSigningFailed, "encoding signature of %q failed with error: %v", entry.name, err)
+				return
+			}
+			outputHash = hashSHA256AsHex([]byte(encodedsig))
+			name := entry.name + ".sig"
+			addSidecar(entry, name, []byte(encodedsig))
+			entryResp.Outputs = append(entryResp.Outputs, name)
+		}
+		entryResps = append(entryResps, entryResp)
+		log.WithFields(log.Fields{
+			"rid":          rid,
+			"options":      options,
+			"mode":         conf.Mode,
+			"type":         conf.Type,
+			"signer_id":    conf.ID,
+			"archive_path": entry.name,
+			"input_hash":   inputHash,
+			"output_hash":  outputHash,
+			"user_id":      userid,
+			"t":            int32(time.Since(starttime) / time.Millisecond), //  request processing time in ms
+		}).Info("signing operation succeeded")
+		a.exportSignature(r, userid, conf.ID, ref, inputHash, outputHash, nil)
+	}
+	repacked, err := writeArchive(format, entries)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "failed to repack archive: %v", err)
+		return
+	}
+	respdata, err := json.Marshal(formats.ArchiveSignatureResponse{
+		Ref:        ref,
+		SignedFile: base64.StdEncoding.EncodeToString(repacked),
+		Entries:    entryResps,
+	})
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "failed to marshal response: %v", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(respdata)
+	log.WithFields(log.Fields{"rid": rid, "signed_entries": len(entryResps)}).Info("archive signing request completed successfully")
+}
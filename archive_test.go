@@ -0,0 +1,187 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/formats"
+)
+
+var testArchiveFiles = []struct {
+	name string
+	data string
+}{
+	{"README", "not signed by any manifest entry"},
+	{"dist/app.txt", "some release notes to sign"},
+	{"dist/app.txt.sig", "a stale signature"},
+}
+
+func makeTestTarGz(t *testing.T) []byte {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "dist/", Mode: 0755, ModTime: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range testArchiveFiles {
+		err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: f.name, Mode: 0644, Size: int64(len(f.data)), ModTime: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(f.data))
+	}
+	tw.Close()
+	gzw.Close()
+	return buf.Bytes()
+}
+
+func makeTestZip(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range testArchiveFiles {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(f.data))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func postArchiveSignatureRequest(t *testing.T, userid string, req formats.ArchiveSignatureRequest) *httptest.ResponseRecorder {
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpReq, err := http.NewRequest("POST", "http://foo.bar/sign/archive", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	auth, err := ag.getAuthByID(userid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpReq.Header.Set("Authorization", getAuthHeader(httpReq, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+	w := httptest.NewRecorder()
+	ag.handleArchiveSignature(w, httpReq)
+	return w
+}
+
+func TestArchiveSignature(t *testing.T) {
+	t.Parallel()
+
+	for _, testcase := range []struct {
+		name  string
+		input []byte
+	}{
+		{"tar.gz", makeTestTarGz(t)},
+		{"zip", makeTestZip(t)},
+	} {
+		w := postArchiveSignatureRequest(t, conf.Authorizations[0].ID, formats.ArchiveSignatureRequest{
+			Input: base64.StdEncoding.EncodeToString(testcase.input),
+			Manifest: []formats.ArchiveManifestEntry{
+				{Path: "dist/*.txt", KeyID: "appkey1"},
+			},
+		})
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s: failed with %d: %s", testcase.name, w.Code, w.Body.String())
+		}
+		var resp formats.ArchiveSignatureResponse
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Entries) != 1 || resp.Entries[0].Path != "dist/app.txt" || resp.Entries[0].SignerID != "appkey1" {
+			t.Fatalf("%s: expected dist/app.txt to be signed by appkey1, got %+v", testcase.name, resp.Entries)
+		}
+		if len(resp.Entries[0].Outputs) != 1 || resp.Entries[0].Outputs[0] != "dist/app.txt.sig" {
+			t.Fatalf("%s: expected a dist/app.txt.sig output, got %+v", testcase.name, resp.Entries[0].Outputs)
+		}
+		repacked, err := base64.StdEncoding.DecodeString(resp.SignedFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, entries, err := readArchive(repacked)
+		if err != nil {
+			t.Fatalf("%s: failed to read repacked archive: %v", testcase.name, err)
+		}
+		files := make(map[string]string)
+		for _, entry := range entries {
+			if _, ok := files[entry.name]; ok {
+				t.Fatalf("%s: duplicate entry %q in repacked archive", testcase.name, entry.name)
+			}
+			files[entry.name] = string(entry.data)
+		}
+		if files["README"] != testArchiveFiles[0].data || files["dist/app.txt"] != testArchiveFiles[1].data {
+			t.Fatalf("%s: expected unsigned files to be unchanged, got %+v", testcase.name, files)
+		}
+		err = verifyContentSignature(base64.StdEncoding.EncodeToString([]byte(files["dist/app.txt"])), "/sign/data",
+			files["dist/app.txt.sig"], ag.getSigners()[0].Config().PublicKey)
+		if err != nil {
+			t.Fatalf("%s: failed to verify the signature of dist/app.txt: %v", testcase.name, err)
+		}
+	}
+}
+
+func TestArchiveSignatureErrors(t *testing.T) {
+	t.Parallel()
+
+	input := base64.StdEncoding.EncodeToString(makeTestZip(t))
+	for i, testcase := range []struct {
+		userid         string
+		req            formats.ArchiveSignatureRequest
+		expectedStatus int
+		expectedCode   formats.ErrorCode
+	}{
+		{
+			conf.Authorizations[0].ID,
+			formats.ArchiveSignatureRequest{Input: input},
+			http.StatusBadRequest, formats.ErrorCodeInvalidRequest,
+		},
+		{
+			conf.Authorizations[0].ID,
+			formats.ArchiveSignatureRequest{Input: input, Manifest: []formats.ArchiveManifestEntry{{Path: "[", KeyID: "appkey1"}}},
+			http.StatusBadRequest, formats.ErrorCodeInvalidRequest,
+		},
+		{
+			// bob is not allowed to use appkey1
+			conf.Authorizations[1].ID,
+			formats.ArchiveSignatureRequest{Input: input, Manifest: []formats.ArchiveManifestEntry{{Path: "*", KeyID: "appkey1"}}},
+			http.StatusUnauthorized, formats.ErrorCodeSignerNotPermitted,
+		},
+		{
+			conf.Authorizations[0].ID,
+			formats.ArchiveSignatureRequest{Input: "bm90IGFuIGFyY2hpdmU=", Manifest: []formats.ArchiveManifestEntry{{Path: "*", KeyID: "appkey1"}}},
+			http.StatusBadRequest, formats.ErrorCodeInvalidInput,
+		},
+	} {
+		w := postArchiveSignatureRequest(t, testcase.userid, testcase.req)
+		if w.Code != testcase.expectedStatus {
+			t.Fatalf("test case %d expected status %d but got %d: %s", i, testcase.expectedStatus, w.Code, w.Body.String())
+		}
+		var errResp formats.ErrorResponse
+		err := json.Unmarshal(w.Body.Bytes(), &errResp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errResp.Code != testcase.expectedCode {
+			t.Fatalf("test case %d expected error code %q but got %q", i, testcase.expectedCode, errResp.Code)
+		}
+	}
+}
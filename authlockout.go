@@ -0,0 +1,379 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/formats"
+)
+
+const (
+	// defaultLockoutMaxFailures is the number of authentication
+	// failures before a lockout when the configuration does not
+	// set one
+	defaultLockoutMaxFailures = 5
+
+	// defaultLockoutDuration is how long the first lockout lasts
+	// when the configuration does not set a duration
+	defaultLockoutDuration = time.Second
+
+	// defaultMaxLockoutDuration is the longest lockout when the
+	// configuration does not set one
+	defaultMaxLockoutDuration = 15 * time.Minute
+
+	// defaultMaxBackoff is the longest delay of the attempts of a
+	// credential that fails from many addresses when the
+	// configuration does not set one
+	defaultMaxBackoff = 10 * time.Second
+
+	// maxTrackedAuthFailures bounds the number of credentials and
+	// addresses with failures kept in memory before the expired
+	// ones are dropped
+	maxTrackedAuthFailures = 100000
+)
+
+// authLockoutConfig configures the lockout of credentials and client
+// addresses after repeated authentication failures
+type authLockoutConfig struct {
+	Enabled bool
+
+	// MaxFailures is the number of consecutive failures of a
+	// credential or client address before it is locked out.
+	// Defaults to 5.
+	MaxFailures int
+
+	// Duration is how long the first lockout lasts. It doubles
+	// with each failure after it, up to MaxDuration. Defaults to
+	// 1s and 15m.
+	Duration    time.Duration
+	MaxDuration time.Duration
+
+	// MaxBackoff is the longest delay of the authentications of a
+	// credential after MaxFailures failures from any address. It
+	// should be shorter than the request timeout. Defaults to 10s.
+	MaxBackoff time.Duration
+
+	// ClientIPHeader is a header set by a trusted load balancer
+	// to the address of the client, like X-Forwarded-For, whose
+	// last address is used instead of the address of the peer
+	ClientIPHeader string
+}
+
+// errLockedOut is returned when a request comes from a credential or
+// client address that is locked out
+type errLockedOut struct {
+	retryAfter time.Duration
+}
+
+func (e *errLockedOut) Error() string {
+	return fmt.Sprintf("too many authentication failures, retry in %s", e.retryAfter)
+}
+
+// authFailures are the recent authentication failures of a
+// credential or client address
+type authFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// authLockout tracks authentication failures and locks out the
+// credentials and client addresses that fail repeatedly
+type authLockout struct {
+	sync.Mutex
+	conf     authLockoutConfig
+	failures map[string]*authFailures
+	now      func() time.Time
+	sleep    func(ctx context.Context, d time.Duration) error
+}
+
+// newAuthLockout returns an authLockout with the defaults of unset
+// configuration values
+func newAuthLockout(conf authLockoutConfig) (*authLockout, error) {
+	if conf.MaxFailures < 0 || conf.Duration < 0 || conf.MaxDuration < 0 || conf.MaxBackoff < 0 {
+		return nil, errors.New("authentication lockout settings must not be negative")
+	}
+	if conf.MaxFailures == 0 {
+		conf.MaxFailures = defaultLockoutMaxFailures
+	}
+	if conf.Duration == 0 {
+		conf.Duration = defaultLockoutDuration
+	}
+	if conf.MaxDuration == 0 {
+		conf.MaxDuration = defaultMaxLockoutDuration
+	}
+	if conf.MaxBackoff == 0 {
+		conf.MaxBackoff = defaultMaxBackoff
+	}
+	if conf.MaxDuration < conf.Duration {
+		return nil, errors.Errorf("maximum lockout duration %s is shorter than the lockout duration %s", conf.MaxDuration, conf.Duration)
+	}
+	return &authLockout{
+		conf:     conf,
+		failures: make(map[string]*authFailures),
+		now:      time.Now,
+		sleep:    sleepContext,
+	}, nil
+}
+
+// sleepContext waits for d, and returns the context error when ctx is
+// done first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// lockedOut returns how long the longest lockout of keys lasts
+func (l *authLockout) lockedOut(keys ...string) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	var longest time.Duration
+	for _, key := range keys {
+		if f, ok := l.failures[key]; ok && f.lockedUntil.After(now) && f.lockedUntil.Sub(now) > longest {
+			longest = f.lockedUntil.Sub(now)
+		}
+	}
+	return longest
+}
+
+// fail counts an authentication failure of keys, and returns the keys
+// it locks out and how long for
+func (l *authLockout) fail(keys ...string) (locked []string, duration time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	if len(l.failures) >= maxTrackedAuthFailures {
+		l.dropExpired(now)
+	}
+	for _, key := range keys {
+		f := l.countFailure(key, now)
+		if f.count < l.conf.MaxFailures {
+			continue
+		}
+		d := l.delay(f.count, l.conf.MaxDuration)
+		f.lockedUntil = now.Add(d)
+		locked = append(locked, key)
+		if d > duration {
+			duration = d
+		}
+	}
+	return locked, duration
+}
+
+// failBackoff counts an authentication failure of a key that is slowed
+// down by backoff instead of locked out
+func (l *authLockout) failBackoff(key string) {
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	if len(l.failures) >= maxTrackedAuthFailures {
+		l.dropExpired(now)
+	}
+	l.countFailure(key, now)
+}
+
+// countFailure increments the failures of a key. Callers must hold
+// the lock.
+func (l *authLockout) countFailure(key string, now time.Time) *authFailures {
+	f, ok := l.failures[key]
+	if !ok || now.Sub(f.last) > l.conf.MaxDuration {
+		// failures are forgotten after the longest lockout
+		f = new(authFailures)
+		l.failures[key] = f
+	}
+	f.count++
+	f.last = now
+	return f
+}
+
+// delay returns how long count failures lock out or slow down a key:
+// Duration after MaxFailures failures, doubling with each failure
+// after, up to max
+func (l *authLockout) delay(count int, max time.Duration) time.Duration {
+	exponent := count - l.conf.MaxFailures
+	if exponent >= 32 {
+		return max
+	}
+	return time.Duration(math.Min(float64(l.conf.Duration)*math.Pow(2, float64(exponent)), float64(max)))
+}
+
+// backoff returns how long to delay an authentication of a key that
+// failed MaxFailures times, or zero
+func (l *authLockout) backoff(key string) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	f, ok := l.failures[key]
+	if !ok || f.count < l.conf.MaxFailures || l.now().Sub(f.last) > l.conf.MaxDuration {
+		return 0
+	}
+	return l.delay(f.count, l.conf.MaxBackoff)
+}
+
+// succeed forgets the failures of keys that authenticated
+func (l *authLockout) succeed(keys ...string) {
+	l.Lock()
+	defer l.Unlock()
+	for _, key := range keys {
+		delete(l.failures, key)
+	}
+}
+
+// dropExpired removes the failures that are forgotten and not locked
+// out. Callers must hold the lock.
+func (l *authLockout) dropExpired(now time.Time) {
+	for key, f := range l.failures {
+		if now.Sub(f.last) > l.conf.MaxDuration && !f.lockedUntil.After(now) {
+			delete(l.failures, key)
+		}
+	}
+}
+
+// clientIP returns the address of the client of a request
+func (l *authLockout) clientIP(r *http.Request) string {
+	if l.conf.ClientIPHeader != "" {
+		addrs := strings.Split(r.Header.Get(l.conf.ClientIPHeader), ",")
+		if ip := strings.TrimSpace(addrs[len(addrs)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// lockoutKeys returns the keys failures of a request are counted
+// under: its client address, and the credential it claims from that
+// address, if any. The claimed credential isn't verified yet, so its
+// failures only lock it out of the address they come from, and nobody
+// can lock a user out by sending bad requests with their credential.
+func (l *authLockout) lockoutKeys(r *http.Request, credential string) []string {
+	ip := l.clientIP(r)
+	keys := []string{ipLockoutKey(ip)}
+	if credential != "" {
+		keys = append(keys, credentialLockoutKey(credential, ip))
+	}
+	return keys
+}
+
+// ipLockoutKey returns the key of the failures of a client address
+func ipLockoutKey(ip string) string {
+	return "ip:" + ip
+}
+
+// credentialLockoutKey returns the key of the failures of a credential
+// from a client address
+func credentialLockoutKey(credential, ip string) string {
+	return "credential:" + credential + "@" + ip
+}
+
+// credentialBackoffKey returns the key of the failures of a credential
+// from all addresses, which slow its authentications down instead of
+// locking it out, so guesses spread over many addresses are throttled
+// but nobody can lock a user out
+func credentialBackoffKey(credential string) string {
+	return "credential:" + credential
+}
+
+// enableAuthLockout locks out credentials and client addresses after
+// repeated authentication failures, when the configuration enables it
+func (a *autographer) enableAuthLockout(conf authLockoutConfig) (err error) {
+	if !conf.Enabled {
+		return nil
+	}
+	a.lockout, err = newAuthLockout(conf)
+	return err
+}
+
+// recordAuthFailure counts an authentication failure and exports
+// security events for it and the lockouts it causes
+func (a *autographer) recordAuthFailure(r *http.Request, credential string, authErr error) {
+	ip := a.lockout.clientIP(r)
+	locked, duration := a.lockout.fail(a.lockout.lockoutKeys(r, credential)...)
+	if credential != "" {
+		a.lockout.failBackoff(credentialBackoffKey(credential))
+	}
+	a.securityEvent(r, formats.ExportedEvent{
+		Action:  formats.SecurityActionAuthenticationFailed,
+		UserID:  credential,
+		Message: authErr.Error(),
+	})
+	if len(locked) == 0 {
+		return
+	}
+	log.WithFields(log.Fields{
+		"rid":        getRequestID(r),
+		"credential": credential,
+		"source_ip":  ip,
+		"locked":     locked,
+		"duration":   duration.String(),
+	}).Warn("locking out after repeated authentication failures")
+	if a.stats != nil {
+		sendStatsErr := a.stats.Incr("authentication_lockout", nil, 1.0)
+		if sendStatsErr != nil {
+			log.Warnf("Error sending authentication_lockout: %s", sendStatsErr)
+		}
+	}
+	a.securityEvent(r, formats.ExportedEvent{
+		Action:  formats.SecurityActionLockedOut,
+		UserID:  credential,
+		Message: fmt.Sprintf("%s locked out for %s", strings.Join(locked, " and "), duration),
+	})
+}
+
+// waitAuthBackoff delays the authentication of a credential that
+// failed repeatedly from any address, and returns the context error
+// when the request ends first
+func (a *autographer) waitAuthBackoff(r *http.Request, credential string) error {
+	if credential == "" {
+		return nil
+	}
+	delay := a.lockout.backoff(credentialBackoffKey(credential))
+	if delay == 0 {
+		return nil
+	}
+	log.WithFields(log.Fields{
+		"rid":        getRequestID(r),
+		"credential": credential,
+		"delay":      delay.String(),
+	}).Info("delaying authentication after repeated failures")
+	if a.stats != nil {
+		sendStatsErr := a.stats.Incr("authentication_backoff", nil, 1.0)
+		if sendStatsErr != nil {
+			log.Warnf("Error sending authentication_backoff: %s", sendStatsErr)
+		}
+	}
+	return a.lockout.sleep(r.Context(), delay)
+}
+
+// authError writes an authentication error to the client: a 429 with
+// a Retry-After header for lockouts, and a 401 otherwise
+func authError(w http.ResponseWriter, r *http.Request, err error) {
+	if lockedOut, ok := err.(*errLockedOut); ok {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(lockedOut.retryAfter.Seconds()))))
+		httpError(w, r, http.StatusTooManyRequests, formats.ErrorCodeLockedOut, "authorization verification failed: %v", err)
+		return
+	}
+	httpError(w, r, http.StatusUnauthorized, formats.ErrorCodeUnauthorized, "authorization verification failed: %v", err)
+}
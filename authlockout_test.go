@@ -0,0 +1,223 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+func TestAuthLockout(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(100)
+	tmpag.hawkMaxTimestampSkew = time.Hour
+	err := tmpag.addSigners([]signer.Configuration{conf.Signers[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := authorization{ID: "guesseduser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: []string{conf.Signers[0].ID}}
+	other := authorization{ID: "otheruser", Key: "a4ex0ztpcu9msw5h5flc7qfhsc7btg2tzb2s3hgf1gtx5vqhnh", Signers: []string{conf.Signers[0].ID}}
+	err = tmpag.addAuthorizations([]authorization{user, other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.enableAuthLockout(authLockoutConfig{
+		Enabled:        true,
+		MaxFailures:    3,
+		Duration:       time.Second,
+		MaxDuration:    time.Minute,
+		ClientIPHeader: "X-Forwarded-For",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	now := time.Now()
+	tmpag.lockout.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+	var delays []time.Duration
+	tmpag.lockout.sleep = func(ctx context.Context, d time.Duration) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delays = append(delays, d)
+		return nil
+	}
+	lastDelay := func() time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(delays) == 0 {
+			return 0
+		}
+		return delays[len(delays)-1]
+	}
+	sink := new(memorySink)
+	tmpag.addExporter(exporterConfig{Type: "memory", BatchSize: 100, FlushInterval: 10 * time.Millisecond}, sink)
+
+	body, err := json.Marshal([]formats.SignatureRequest{{Input: "Y2FyaWJvdW1hdXJpY2UK"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(auth authorization, key, clientIP string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", "10.0.0.1, "+clientIP)
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, key, sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		tmpag.handleSignature(w, req)
+		return w
+	}
+	lockedOut := func(w *httptest.ResponseRecorder) bool {
+		var errResp formats.ErrorResponse
+		err := json.Unmarshal(w.Body.Bytes(), &errResp)
+		return err == nil && w.Code == http.StatusTooManyRequests && errResp.Code == formats.ErrorCodeLockedOut && w.Header().Get("Retry-After") != ""
+	}
+
+	// guessing the key of a user locks out the credential from the
+	// address of the guesses
+	for i := 0; i < 3; i++ {
+		w := sign(user, "wrongkey", "192.0.2.1")
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: expected a 401, got %d: %s", i, w.Code, w.Body.String())
+		}
+	}
+	w := sign(user, user.Key, "192.0.2.1")
+	if !lockedOut(w) || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected the credential to be locked out, got %d %v: %s", w.Code, w.Header(), w.Body.String())
+	}
+	// but not from the other addresses, so bad requests claiming
+	// a credential don't lock its user out
+	w = sign(user, user.Key, "192.0.2.4")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the user to sign from another address, got %d: %s", w.Code, w.Body.String())
+	}
+	// the failures of the credential from all addresses slow its
+	// authentications down instead, doubling with each failure
+	if d := lastDelay(); d != time.Second {
+		t.Fatalf("expected the authentication of the credential to be delayed by 1s, got %s", d)
+	}
+	for i, ip := range []string{"192.0.2.2", "192.0.2.3", "192.0.2.5"} {
+		sign(user, "wrongkey", ip)
+		if w = sign(user, user.Key, "192.0.2.4"); w.Code != http.StatusCreated {
+			t.Fatalf("failure %d: expected failures from other addresses not to lock out the user, got %d: %s", i, w.Code, w.Body.String())
+		}
+		if expected := time.Second << uint(i+1); lastDelay() != expected {
+			t.Fatalf("failure %d: expected the authentication of the credential to be delayed by %s, got %s", i, expected, lastDelay())
+		}
+	}
+	// up to the maximum backoff
+	for i := 0; i < 10; i++ {
+		sign(user, "wrongkey", fmt.Sprintf("192.0.2.%d", 10+i))
+	}
+	sign(user, user.Key, "192.0.2.4")
+	if d := lastDelay(); d != defaultMaxBackoff {
+		t.Fatalf("expected the authentication of the credential to be delayed by %s, got %s", defaultMaxBackoff, d)
+	}
+
+	// the lockout doubles with each failure after it ends
+	advance(2 * time.Second)
+	w = sign(user, "wrongkey", "192.0.2.1")
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a 401 after the lockout, got %d: %s", w.Code, w.Body.String())
+	}
+	w = sign(user, user.Key, "192.0.2.1")
+	if !lockedOut(w) || w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("expected a longer lockout, got %d %v: %s", w.Code, w.Header(), w.Body.String())
+	}
+
+	// a successful authentication resets the failures of the
+	// credential from its address
+	for i := 0; i < 2; i++ {
+		sign(user, "wrongkey", "192.0.2.6")
+	}
+	w = sign(user, user.Key, "192.0.2.6")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the user to sign, got %d: %s", w.Code, w.Body.String())
+	}
+	tmpag.lockout.Lock()
+	_, ok := tmpag.lockout.failures[credentialLockoutKey(user.ID, "192.0.2.6")]
+	tmpag.lockout.Unlock()
+	if ok {
+		t.Fatal("expected the failures of the user to be reset")
+	}
+
+	// and of its address, so users behind a shared address aren't
+	// locked out by failures they aren't making
+	for i := 0; i < 2; i++ {
+		sign(authorization{ID: "nosuchuser"}, "wrongkey", "203.0.113.8")
+	}
+	if w = sign(other, other.Key, "203.0.113.8"); w.Code != http.StatusCreated {
+		t.Fatalf("expected the other user to sign, got %d: %s", w.Code, w.Body.String())
+	}
+	sign(authorization{ID: "nosuchuser2"}, "wrongkey", "203.0.113.8")
+	if w = sign(other, other.Key, "203.0.113.8"); w.Code != http.StatusCreated {
+		t.Fatalf("expected the failures of the address to be reset, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// guessing many credentials from one address locks out the
+	// address
+	for i := 0; i < 3; i++ {
+		sign(authorization{ID: "nosuchuser"}, "wrongkey", "198.51.100.7")
+	}
+	w = sign(other, other.Key, "198.51.100.7")
+	if !lockedOut(w) {
+		t.Fatalf("expected the address to be locked out, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var events []formats.ExportedEvent
+	for i := 0; ; i++ {
+		if i > 100 {
+			t.Fatalf("timed out waiting for security events, got %+v", events)
+		}
+		time.Sleep(10 * time.Millisecond)
+		events = sink.received()
+		locks := 0
+		for _, e := range events {
+			if e.Type == formats.EventTypeSecurity && e.Action == "authentication_locked_out" {
+				locks++
+			}
+		}
+		if locks == 3 {
+			break
+		}
+	}
+	first := events[0]
+	if first.Type != formats.EventTypeSecurity || first.Action != "authentication_failed" || first.UserID != user.ID || first.SourceIP != "192.0.2.1" {
+		t.Fatalf("unexpected security event %+v", first)
+	}
+
+	for i, testcase := range []authLockoutConfig{
+		{Enabled: true, MaxFailures: -1},
+		{Enabled: true, MaxBackoff: -time.Second},
+		{Enabled: true, Duration: time.Hour, MaxDuration: time.Minute},
+	} {
+		err = newAutographer(1).enableAuthLockout(testcase)
+		if err == nil {
+			t.Fatalf("testcase %d: expected invalid lockout configuration to be rejected", i)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/hawk"
+)
+
+const (
+	// schemeHawk authenticates requests with a hawk Authorization
+	// header and verifies their payload hash
+	schemeHawk = "hawk"
+
+	// schemeMTLS authenticates requests with a client certificate
+	// whose common name is the ID of an authorization
+	schemeMTLS = "mtls"
+)
+
+// errNoCredentials is returned by authenticators when a request has
+// no credentials of their scheme, so the next scheme is tried
+var errNoCredentials = errors.New("no credentials")
+
+// an authenticator verifies the credentials of requests with one
+// authentication scheme
+type authenticator interface {
+	// scheme returns the name of the authentication scheme
+	scheme() string
+
+	// authenticate verifies the credentials of a request before
+	// its body is read. It returns the ID of the user and a
+	// function that verifies the body, or errNoCredentials when
+	// the request has no credentials of the scheme.
+	authenticate(r *http.Request) (userid string, verifyBody func(body []byte) error, err error)
+}
+
+// authenticationConfig sets the authentication schemes of the API
+// listener
+type authenticationConfig struct {
+	// Schemes are the names of the authentication schemes
+	// requests can use, tried in order. Defaults to hawk.
+	Schemes []string
+
+	MTLS    mtlsConfig
+	APIKeys apiKeysConfig
+	Lockout authLockoutConfig
+}
+
+// mtlsConfig configures client certificate authentication
+type mtlsConfig struct {
+	// CACert is the path to the PEM certificate of the CA that
+	// issues client certificates
+	CACert string
+}
+
+// authenticatorFactory returns the authenticator of a scheme
+type authenticatorFactory func(a *autographer, conf authenticationConfig) (authenticator, error)
+
+// authenticatorFactories are the registered authentication schemes,
+// by name
+var authenticatorFactories = make(map[string]authenticatorFactory)
+
+// registerAuthenticator makes an authentication scheme available to
+// the configuration. It panics when the scheme is already registered.
+func registerAuthenticator(scheme string, factory authenticatorFactory) {
+	if _, ok := authenticatorFactories[scheme]; ok {
+		panic("authentication scheme " + scheme + " is already registered")
+	}
+	authenticatorFactories[scheme] = factory
+}
+
+func init() {
+	registerAuthenticator(schemeHawk, func(a *autographer, conf authenticationConfig) (authenticator, error) {
+		return &hawkAuthenticator{a}, nil
+	})
+	registerAuthenticator(schemeMTLS, func(a *autographer, conf authenticationConfig) (authenticator, error) {
+		if conf.MTLS.CACert == "" {
+			return nil, errors.New("mtls authentication requires a CA certificate")
+		}
+		return &mtlsAuthenticator{a}, nil
+	})
+}
+
+// usesScheme returns whether an authentication scheme is enabled
+func (c authenticationConfig) usesScheme(scheme string) bool {
+	for _, s := range c.Schemes {
+		if strings.ToLower(s) == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// setAuthenticators configures the authentication schemes of the
+// autographer, in order
+func (a *autographer) setAuthenticators(conf authenticationConfig) error {
+	schemes := conf.Schemes
+	if len(schemes) == 0 {
+		schemes = []string{schemeHawk}
+	}
+	var authenticators []authenticator
+	seen := make(map[string]bool)
+	for _, scheme := range schemes {
+		scheme = strings.ToLower(scheme)
+		factory, ok := authenticatorFactories[scheme]
+		if !ok {
+			var known []string
+			for name := range authenticatorFactories {
+				known = append(known, name)
+			}
+			sort.Strings(known)
+			return errors.Errorf("unknown authentication scheme %q, must be one of %s", scheme, strings.Join(known, ", "))
+		}
+		if seen[scheme] {
+			return errors.Errorf("authentication scheme %q is listed more than once", scheme)
+		}
+		seen[scheme] = true
+		auth, err := factory(a, conf)
+		if err != nil {
+			return errors.Wrapf(err, "failed to configure authentication scheme %q", scheme)
+		}
+		authenticators = append(authenticators, auth)
+	}
+	a.authenticators = authenticators
+	return nil
+}
+
+// a credentialClaimer is an authenticator that can tell which
+// credential a request claims before verifying it, so failures of the
+// credential are counted for lockouts
+type credentialClaimer interface {
+	claimedCredential(r *http.Request) string
+}
+
+// authenticate verifies the credentials of a request with the first
+// authentication scheme it has credentials for. It returns the ID of
+// the user and a function that verifies the body of the request.
+func (a *autographer) authenticate(r *http.Request) (userid string, verifyBody func(body []byte) error, err error) {
+	credential := a.claimedCredential(r)
+	if a.lockout != nil {
+		retryAfter := a.lockout.lockedOut(a.lockout.lockoutKeys(r, credential)...)
+		if retryAfter > 0 {
+			return "", nil, &errLockedOut{retryAfter: retryAfter}
+		}
+		err = a.waitAuthBackoff(r, credential)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	userid, verifyBody, err = a.authenticateSchemes(r)
+	if err != nil {
+		a.authenticationFailed(r, credential, err)
+		return userid, verifyBody, err
+	}
+	verify := verifyBody
+	verifyBody = func(body []byte) error {
+		err := verify(body)
+		if err != nil {
+			a.authenticationFailed(r, credential, err)
+		} else if a.lockout != nil {
+			ip := a.lockout.clientIP(r)
+			a.lockout.succeed(ipLockoutKey(ip), credentialLockoutKey(userid, ip))
+		}
+		return err
+	}
+	return userid, verifyBody, nil
+}
+
+// authenticationFailed counts an authentication failure for lockouts
+// when they are enabled, and sends a security event for it
+func (a *autographer) authenticationFailed(r *http.Request, credential string, err error) {
+	if a.lockout != nil {
+		a.recordAuthFailure(r, credential, err)
+		return
+	}
+	a.securityEvent(r, formats.ExportedEvent{
+		Action:  formats.SecurityActionAuthenticationFailed,
+		UserID:  credential,
+		Message: err.Error(),
+	})
+}
+
+// claimedCredential returns the credential a request claims, or an
+// empty string when its schemes can't tell
+func (a *autographer) claimedCredential(r *http.Request) string {
+	for _, auth := range a.authenticators {
+		if claimer, ok := auth.(credentialClaimer); ok {
+			if credential := claimer.claimedCredential(r); credential != "" {
+				return credential
+			}
+		}
+	}
+	return ""
+}
+
+// authenticateSchemes tries the authentication schemes in order
+func (a *autographer) authenticateSchemes(r *http.Request) (userid string, verifyBody func(body []byte) error, err error) {
+	var schemes []string
+	for _, auth := range a.authenticators {
+		userid, verifyBody, err = auth.authenticate(r)
+		if err == errNoCredentials {
+			schemes = append(schemes, auth.scheme())
+			continue
+		}
+		a.sendAuthenticationStats(auth.scheme(), err)
+		if err != nil {
+			return "", nil, err
+		}
+		if verifyBody == nil {
+			verifyBody = func(body []byte) error { return nil }
+		}
+		return userid, verifyBody, nil
+	}
+	if len(schemes) == 1 && schemes[0] == schemeHawk {
+		// keep the hawk error of servers that only use hawk
+		return "", nil, errors.New("missing Authorization header")
+	}
+	return "", nil, errors.Errorf("missing credentials, requests must authenticate with %s", strings.Join(schemes, " or "))
+}
+
+// sendAuthenticationStats counts the authentication attempts of a
+// scheme and whether they succeeded
+func (a *autographer) sendAuthenticationStats(scheme string, err error) {
+	if a.stats == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	sendStatsErr := a.stats.Incr("authentication", []string{"scheme:" + scheme, "result:" + result}, 1.0)
+	if sendStatsErr != nil {
+		log.Warnf("Error sending authentication: %s", sendStatsErr)
+	}
+}
+
+// hawkAuthenticator authenticates requests with hawk
+type hawkAuthenticator struct {
+	a *autographer
+}
+
+func (h *hawkAuthenticator) scheme() string {
+	return schemeHawk
+}
+
+func (h *hawkAuthenticator) authenticate(r *http.Request) (string, func(body []byte) error, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(strings.ToLower(header), "hawk ") {
+		return "", nil, errNoCredentials
+	}
+	auth, userid, err := h.a.authorizeHeader(r)
+	if err != nil {
+		if h.a.stats != nil {
+			sendStatsErr := h.a.stats.Timing("hawk.authorize_header_failed", time.Since(getRequestStartTime(r)), nil, 1.0)
+			if sendStatsErr != nil {
+				log.Warnf("Error sending hawk.authorize_header_failed: %s", sendStatsErr)
+			}
+		}
+		return "", nil, err
+	}
+	return userid, func(body []byte) error {
+		return h.a.authorizeBody(auth, r, body)
+	}, nil
+}
+
+// claimedCredential returns the user ID of the hawk header of a
+// request, before the header is verified
+func (h *hawkAuthenticator) claimedCredential(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(strings.ToLower(header), "hawk ") {
+		return ""
+	}
+	auth, err := hawk.ParseRequestHeader(header)
+	if err != nil {
+		return ""
+	}
+	return auth.Credentials.ID
+}
+
+// mtlsAuthenticator authenticates requests with the common name of
+// their verified client certificate
+type mtlsAuthenticator struct {
+	a *autographer
+}
+
+func (m *mtlsAuthenticator) scheme() string {
+	return schemeMTLS
+}
+
+func (m *mtlsAuthenticator) authenticate(r *http.Request) (string, func(body []byte) error, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", nil, errNoCredentials
+	}
+	userid := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	_, err := m.a.getAuthByID(userid)
+	if err != nil {
+		return "", nil, errors.Errorf("unknown client certificate user %q", userid)
+	}
+	return userid, nil, nil
+}
+
+// configureClientCertAuth asks API clients for a certificate issued
+// by the mtls CA, without requiring one from clients that use other
+// schemes
+func configureClientCertAuth(conf configuration, server *http.Server) error {
+	if !conf.hasTLS() {
+		return errors.New("mtls authentication requires a server TLS certificate and key")
+	}
+	pool, err := loadCertPool(conf.Server.Authentication.MTLS.CACert)
+	if err != nil {
+		return err
+	}
+	// keep the HTTP/2 settings of newServer
+	if server.TLSConfig == nil {
+		server.TLSConfig = &tls.Config{}
+	}
+	server.TLSConfig.ClientCAs = pool
+	server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
@@ -0,0 +1,137 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"go.mozilla.org/autograph/signer"
+)
+
+// testHeaderAuthenticator authenticates requests with the user ID in
+// a header, to test registering schemes
+type testHeaderAuthenticator struct{}
+
+func (testHeaderAuthenticator) scheme() string {
+	return "testheader"
+}
+
+func (testHeaderAuthenticator) authenticate(r *http.Request) (string, func(body []byte) error, error) {
+	userid := r.Header.Get("X-Test-User")
+	if userid == "" {
+		return "", nil, errNoCredentials
+	}
+	return userid, func(body []byte) error {
+		if len(body) == 0 {
+			return errors.New("empty body")
+		}
+		return nil
+	}, nil
+}
+
+func init() {
+	registerAuthenticator("testheader", func(a *autographer, conf authenticationConfig) (authenticator, error) {
+		return testHeaderAuthenticator{}, nil
+	})
+}
+
+func TestAuthenticationSchemes(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(10)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners([]signer.Configuration{conf.Signers[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hawkUser := authorization{ID: "hawkuser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: []string{conf.Signers[0].ID}}
+	certUser := authorization{ID: "certuser", Signers: []string{conf.Signers[0].ID}}
+	err = tmpag.addAuthorizations([]authorization{hawkUser, certUser})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.setAuthenticators(authenticationConfig{
+		Schemes: []string{"MTLS", "hawk", "testheader"},
+		MTLS:    mtlsConfig{CACert: "unused.pem"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`[{"input":"Y2FyaWJvdW1hdXJpY2UK"}]`)
+	newRequest := func(commonName string) *http.Request {
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if commonName != "" {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		return req
+	}
+
+	req := newRequest("")
+	req.Header.Set("Authorization", getAuthHeader(req, hawkUser.ID, hawkUser.Key, sha256.New, id(), "application/json", body))
+	userid, err := tmpag.authorize(req, body)
+	if err != nil || userid != hawkUser.ID {
+		t.Fatalf("expected hawk user to be authenticated, got %q: %v", userid, err)
+	}
+
+	userid, err = tmpag.authorize(newRequest(certUser.ID), body)
+	if err != nil || userid != certUser.ID {
+		t.Fatalf("expected client certificate user to be authenticated, got %q: %v", userid, err)
+	}
+	_, err = tmpag.authorize(newRequest("unknownuser"), body)
+	if err == nil {
+		t.Fatal("expected client certificate of unknown user to be rejected")
+	}
+
+	// users without a key cannot authenticate with hawk
+	req = newRequest("")
+	req.Header.Set("Authorization", getAuthHeader(req, certUser.ID, "", sha256.New, id(), "application/json", body))
+	_, err = tmpag.authorize(req, body)
+	if err == nil {
+		t.Fatal("expected hawk authorization of user without a key to be rejected")
+	}
+
+	// registered schemes verify the body
+	req = newRequest("")
+	req.Header.Set("X-Test-User", hawkUser.ID)
+	userid, err = tmpag.authorize(req, body)
+	if err != nil || userid != hawkUser.ID {
+		t.Fatalf("expected registered scheme to authenticate user, got %q: %v", userid, err)
+	}
+	_, err = tmpag.authorize(req, nil)
+	if err == nil {
+		t.Fatal("expected registered scheme to verify the body")
+	}
+
+	_, err = tmpag.authorize(newRequest(""), body)
+	if err == nil || err.Error() != "missing credentials, requests must authenticate with mtls or hawk or testheader" {
+		t.Fatalf("expected request without credentials to be rejected, got %v", err)
+	}
+
+	for i, testcase := range []authenticationConfig{
+		{Schemes: []string{"kerberos"}},
+		{Schemes: []string{"hawk", "Hawk"}},
+		{Schemes: []string{"mtls"}},
+	} {
+		err = newAutographer(1).setAuthenticators(testcase)
+		if err == nil {
+			t.Fatalf("testcase %d: expected invalid authentication schemes to be rejected", i)
+		}
+	}
+}
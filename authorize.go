@@ -10,6 +10,7 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -23,6 +24,57 @@ type authorization struct {
 	ID      string
 	Key     string
 	Signers []string
+
+	// MaxConcurrentRequests caps the number of requests the
+	// user can have in flight at once. Zero means unlimited.
+	MaxConcurrentRequests int
+
+	// Priority is the scheduling class of the requests of the
+	// user: "low", "normal" (default) or "high"
+	Priority string
+
+	// AddOnIDs limits the add-on IDs XPI signers sign for the
+	// user to the ones matching these patterns, like
+	// "*@mozilla.org". Empty means the user can sign any ID the
+	// signer allows.
+	AddOnIDs []string
+
+	// MARChannels limits the release channels MAR signers sign
+	// with for the user, like "nightly". Empty means the user can
+	// sign with the default key and any channel of the signer.
+	MARChannels []string
+
+	// Admin allows the user to call the admin API. Admin users
+	// don't need to be allowed to use any signer.
+	Admin bool
+
+	// APIKeyHash is the hex SHA256 hash of the static API key of
+	// the user, for the apikey authentication scheme
+	APIKeyHash string
+}
+
+const (
+	// hawkPayloadHashRequired rejects requests without a hawk
+	// payload hash, so a body modified between the client and
+	// autograph, for example by a load balancer, is detected
+	hawkPayloadHashRequired = "required"
+
+	// hawkPayloadHashOptional validates the payload hash of
+	// requests that have one and accepts requests without it
+	hawkPayloadHashOptional = "optional"
+)
+
+// parseHawkPayloadHash returns the payload hash enforcement of a
+// configuration, which defaults to required
+func parseHawkPayloadHash(mode string) (string, error) {
+	switch strings.ToLower(mode) {
+	case "", hawkPayloadHashRequired:
+		return hawkPayloadHashRequired, nil
+	case hawkPayloadHashOptional:
+		return hawkPayloadHashOptional, nil
+	default:
+		return "", errors.Errorf("invalid hawk payload hash enforcement %q, must be %q or %q", mode, hawkPayloadHashRequired, hawkPayloadHashOptional)
+	}
 }
 
 func abs(d time.Duration) time.Duration {
@@ -68,6 +120,20 @@ func (a *autographer) authorizeHeader(r *http.Request) (auth *hawk.Auth, userid
 	}
 	hawk.MaxTimestampSkew = a.hawkMaxTimestampSkew
 	err = auth.Valid()
+	if err == hawk.ErrInvalidMAC {
+		// users being rotated have a second valid key
+		authz, _ := a.getAuthByID(userid)
+		for _, key := range a.hawkKeysOf(authz) {
+			if key == auth.Credentials.Key {
+				continue
+			}
+			auth.Credentials.Key = key
+			err = auth.Valid()
+			if err != hawk.ErrInvalidMAC {
+				break
+			}
+		}
+	}
 	if a.stats != nil {
 		sendStatsErr := a.stats.Timing("hawk.validated", time.Since(getRequestStartTime(r)), nil, 1.0)
 		if sendStatsErr != nil {
@@ -86,8 +152,26 @@ func (a *autographer) authorizeHeader(r *http.Request) (auth *hawk.Auth, userid
 }
 
 // authorizeBody validates the body within the request and returns
-// an error which will be nil if the authorization is successful
+// an error which will be nil if the authorization is successful.
+// Requests without a payload hash are rejected unless the payload
+// hash is optional.
 func (a *autographer) authorizeBody(auth *hawk.Auth, r *http.Request, body []byte) (err error) {
+	if len(auth.Hash) == 0 {
+		if a.hawkPayloadHash != hawkPayloadHashOptional {
+			return fmt.Errorf("missing payload hash")
+		}
+		if a.stats != nil {
+			sendStatsErr := a.stats.Incr("hawk.payload_hash_missing", []string{"user:" + auth.Credentials.ID}, 1.0)
+			if sendStatsErr != nil {
+				log.Warnf("Error sending hawk.payload_hash_missing: %s", sendStatsErr)
+			}
+		}
+		log.WithFields(log.Fields{
+			"rid":     getRequestID(r),
+			"user_id": auth.Credentials.ID,
+		}).Warn("accepting request without a hawk payload hash")
+		return nil
+	}
 	payloadhash := auth.PayloadHash(r.Header.Get("Content-Type"))
 	payloadhash.Write(body)
 	if a.stats != nil {
@@ -102,13 +186,14 @@ func (a *autographer) authorizeBody(auth *hawk.Auth, r *http.Request, body []byt
 	return nil
 }
 
-// authorize combines authorizeHeader and authorizeBody into one function.
+// authorize authenticates a request and verifies its body with the
+// authentication schemes of the autographer
 func (a *autographer) authorize(r *http.Request, body []byte) (userid string, err error) {
-	auth, userid, err := a.authorizeHeader(r)
+	userid, verifyBody, err := a.authenticate(r)
 	if err != nil {
 		return userid, err
 	}
-	err = a.authorizeBody(auth, r, body)
+	err = verifyBody(body)
 	return userid, err
 }
 
@@ -117,10 +202,12 @@ func (a *autographer) authorize(r *http.Request, body []byte) (userid string, er
 // If not found, a function that returns an error is returned.
 func (a *autographer) lookupCred(id string) hawk.CredentialsLookupFunc {
 	auth, err := a.getAuthByID(id)
-	if err == nil {
-		// matching user found, return its token
+	keys := a.hawkKeysOf(auth)
+	// users without a key authenticate with other schemes
+	if err == nil && len(keys) > 0 {
+		// matching user found, return its oldest token
 		return func(creds *hawk.Credentials) error {
-			creds.Key = auth.Key
+			creds.Key = keys[0]
 			creds.Hash = sha256.New
 			return nil
 		}
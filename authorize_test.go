@@ -14,6 +14,8 @@ import (
 	"time"
 
 	"go.mozilla.org/hawk"
+
+	"go.mozilla.org/autograph/signer"
 )
 
 func TestMissingAuthorization(t *testing.T) {
@@ -77,6 +79,65 @@ func TestBadPayload(t *testing.T) {
 	}
 }
 
+func TestHawkPayloadHashEnforcement(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(10)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners([]signer.Configuration{conf.Signers[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := authorization{ID: "nohashuser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: []string{conf.Signers[0].ID}}
+	err = tmpag.addAuthorizations([]authorization{auth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`[{"input":"Y2FyaWJvdW1hdXJpY2UK"}]`)
+	authorize := func(withHash bool, payload []byte) error {
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if withHash {
+			req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", payload))
+		} else {
+			hawkAuth := hawk.NewRequestAuth(req, &hawk.Credentials{ID: auth.ID, Key: auth.Key, Hash: sha256.New}, 0)
+			req.Header.Set("Authorization", hawkAuth.RequestHeader())
+		}
+		_, err = tmpag.authorize(req, body)
+		return err
+	}
+
+	for _, mode := range []string{"", "Required", "optional"} {
+		tmpag.hawkPayloadHash, err = parseHawkPayloadHash(mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = authorize(false, nil)
+		if tmpag.hawkPayloadHash == hawkPayloadHashRequired && (err == nil || err.Error() != "missing payload hash") {
+			t.Fatalf("expected a request without payload hash to be rejected in mode %q, got %v", mode, err)
+		}
+		if tmpag.hawkPayloadHash == hawkPayloadHashOptional && err != nil {
+			t.Fatalf("expected a request without payload hash to be accepted in mode %q, got %v", mode, err)
+		}
+		err = authorize(true, body)
+		if err != nil {
+			t.Fatalf("expected a request with a valid payload hash to be accepted in mode %q, got %v", mode, err)
+		}
+		// a payload hash that is sent is always validated
+		err = authorize(true, []byte(`[{"input":"dGFtcGVyZWQK"}]`))
+		if err == nil || err.Error() != "payload validation failed" {
+			t.Fatalf("expected a tampered body to be rejected in mode %q, got %v", mode, err)
+		}
+	}
+	_, err = parseHawkPayloadHash("sometimes")
+	if err == nil {
+		t.Fatal("expected an invalid payload hash enforcement to be rejected")
+	}
+}
+
 func TestExpiredAuth(t *testing.T) {
 	t.Parallel()
 
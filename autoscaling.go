@@ -0,0 +1,170 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/formats"
+)
+
+// autoscalingStatsInterval is how often autoscaling signals are sent
+// to statsd
+const autoscalingStatsInterval = 10 * time.Second
+
+// autoscalingConfig configures the signals autograph exposes to
+// autoscalers
+type autoscalingConfig struct {
+	// SignerCapacity is the number of operations each signer can
+	// process at once, such as the sessions of its HSM partition,
+	// to compute its saturation. Signers without a capacity use
+	// the number of scheduler workers, and report no saturation
+	// when the scheduler is disabled.
+	SignerCapacity map[string]int
+}
+
+// loadTracker counts the signing requests in flight, in total and
+// per signer
+type loadTracker struct {
+	sync.Mutex
+	requests int
+	signers  map[string]int
+}
+
+func newLoadTracker() *loadTracker {
+	return &loadTracker{signers: make(map[string]int)}
+}
+
+// startRequest counts a signing request until the returned func is
+// called
+func (l *loadTracker) startRequest() func() {
+	l.Lock()
+	l.requests++
+	l.Unlock()
+	return func() {
+		l.Lock()
+		l.requests--
+		l.Unlock()
+	}
+}
+
+// startSigning counts an operation on each signer until the returned
+// func is called
+func (l *loadTracker) startSigning(signerIDs ...string) func() {
+	l.Lock()
+	for _, id := range signerIDs {
+		l.signers[id]++
+	}
+	l.Unlock()
+	return func() {
+		l.Lock()
+		defer l.Unlock()
+		for _, id := range signerIDs {
+			l.signers[id]--
+			if l.signers[id] <= 0 {
+				delete(l.signers, id)
+			}
+		}
+	}
+}
+
+// enableAutoscaling sets the capacity of signers
+func (a *autographer) enableAutoscaling(conf autoscalingConfig) error {
+	for id, capacity := range conf.SignerCapacity {
+		if _, found := a.getSignerByID(id); !found {
+			return errors.Errorf("cannot set the capacity of unknown signer %q", id)
+		}
+		if capacity <= 0 {
+			return errors.Errorf("capacity of signer %q must be positive", id)
+		}
+	}
+	a.signerCapacity = conf.SignerCapacity
+	if a.stats != nil {
+		go a.sendAutoscalingStats()
+	}
+	return nil
+}
+
+// autoscalingSignals returns the current load of the instance
+func (a *autographer) autoscalingSignals() formats.AutoscalingSignals {
+	var signals formats.AutoscalingSignals
+	if a.scheduler != nil {
+		var running int
+		running, signals.QueuedRequests = a.scheduler.load()
+		signals.Workers = a.scheduler.conf.Workers
+		signals.Utilization = float64(running+signals.QueuedRequests) / float64(signals.Workers)
+	}
+	a.load.Lock()
+	signals.InflightRequests = a.load.requests
+	inflight := make(map[string]int, len(a.load.signers))
+	for id, n := range a.load.signers {
+		inflight[id] = n
+	}
+	a.load.Unlock()
+
+	signals.Signers = make(map[string]formats.SignerLoad)
+	for _, s := range a.getSigners() {
+		id := s.Config().ID
+		load := formats.SignerLoad{
+			Inflight: inflight[id],
+			Capacity: a.signerCapacity[id],
+		}
+		if load.Capacity == 0 {
+			load.Capacity = signals.Workers
+		}
+		if load.Capacity > 0 {
+			load.Saturation = float64(load.Inflight) / float64(load.Capacity)
+		}
+		signals.Signers[id] = load
+	}
+	return signals
+}
+
+// handleAutoscaling returns the in-flight and queued signing requests
+// and the saturation of signers, for autoscalers to scale on signing
+// backlog
+func (a *autographer) handleAutoscaling(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpError(w, r, http.StatusMethodNotAllowed, formats.ErrorCodeInvalidMethod, "%s method not allowed; endpoint accepts GET only", r.Method)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.autoscalingSignals())
+}
+
+// sendAutoscalingStats sends the autoscaling signals to statsd every
+// autoscalingStatsInterval, for autoscalers that read metrics
+func (a *autographer) sendAutoscalingStats() {
+	for {
+		time.Sleep(autoscalingStatsInterval)
+		signals := a.autoscalingSignals()
+		err := a.stats.Gauge("autoscaling.inflight_requests", float64(signals.InflightRequests), nil, 1)
+		if err == nil {
+			err = a.stats.Gauge("autoscaling.queued_requests", float64(signals.QueuedRequests), nil, 1)
+		}
+		if err == nil && signals.Workers > 0 {
+			err = a.stats.Gauge("autoscaling.utilization", signals.Utilization, nil, 1)
+		}
+		for id, load := range signals.Signers {
+			if err != nil {
+				break
+			}
+			tags := []string{"signer:" + id}
+			err = a.stats.Gauge("autoscaling.signer_inflight", float64(load.Inflight), tags, 1)
+			if err == nil && load.Capacity > 0 {
+				err = a.stats.Gauge("autoscaling.signer_saturation", load.Saturation, tags, 1)
+			}
+		}
+		if err != nil {
+			log.Warnf("Error sending autoscaling stats: %s", err)
+		}
+	}
+}
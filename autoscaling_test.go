@@ -0,0 +1,126 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+func getAutoscalingSignals(t *testing.T, a *autographer) formats.AutoscalingSignals {
+	w := httptest.NewRecorder()
+	a.handleAutoscaling(w, httptest.NewRequest("GET", "http://foo.bar/__autoscaling__", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("autoscaling signals failed with %d: %s", w.Code, w.Body.String())
+	}
+	var signals formats.AutoscalingSignals
+	err := json.Unmarshal(w.Body.Bytes(), &signals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signals
+}
+
+func TestAutoscalingSignals(t *testing.T) {
+	t.Parallel()
+
+	signerID := conf.Signers[0].ID
+	tmpag := newAutographer(100)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners([]signer.Configuration{conf.Signers[0], conf.Signers[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := authorization{ID: "autoscaleduser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: []string{signerID}}
+	err = tmpag.addAuthorizations([]authorization{auth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.enableAutoscaling(autoscalingConfig{SignerCapacity: map[string]int{signerID: 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.scheduler = newScheduler(schedulerConfig{Workers: 2})
+	tmpag.faults = map[string]signerFaults{signerID: {Latency: 2 * time.Second}}
+
+	signals := getAutoscalingSignals(t, tmpag)
+	if signals.InflightRequests != 0 || signals.QueuedRequests != 0 || signals.Workers != 2 || signals.Utilization != 0 {
+		t.Fatalf("unexpected idle signals %+v", signals)
+	}
+
+	// a request held by the injected latency
+	body := []byte(`[{"input": "Y2FyaWJvdW1hdXJpY2UK", "keyid": "` + signerID + `"}]`)
+	req := httptest.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		tmpag.handleSignature(w, req)
+		done <- w.Code
+	}()
+	waitFor := func(cond func(formats.AutoscalingSignals) bool) {
+		for i := 0; ; i++ {
+			if i > 40 {
+				t.Fatalf("timed out waiting for signals, got %+v", signals)
+			}
+			signals = getAutoscalingSignals(t, tmpag)
+			if cond(signals) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor(func(s formats.AutoscalingSignals) bool {
+		return s.InflightRequests == 1 && s.Signers[signerID].Inflight == 1
+	})
+
+	// and one queued behind the two busy workers
+	err = tmpag.scheduler.acquire(context.Background(), priorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := make(chan error)
+	go func() {
+		queued <- tmpag.scheduler.acquire(context.Background(), priorityNormal)
+	}()
+	waitFor(func(s formats.AutoscalingSignals) bool { return s.QueuedRequests == 1 })
+	if signals.Utilization != 1.5 {
+		t.Fatalf("expected utilization 1.5 with 3 requests for 2 workers, got %f", signals.Utilization)
+	}
+	if load := signals.Signers[signerID]; load.Capacity != 4 || load.Saturation != 0.25 {
+		t.Fatalf("unexpected load of the busy signer %+v", load)
+	}
+	if load := signals.Signers[conf.Signers[1].ID]; load.Inflight != 0 || load.Capacity != 2 || load.Saturation != 0 {
+		t.Fatalf("unexpected load of the idle signer %+v", load)
+	}
+
+	if code := <-done; code != http.StatusCreated {
+		t.Fatalf("signing failed with %d", code)
+	}
+	tmpag.scheduler.release()
+	if err = <-queued; err != nil {
+		t.Fatal(err)
+	}
+	tmpag.scheduler.release()
+	signals = getAutoscalingSignals(t, tmpag)
+	if signals.InflightRequests != 0 || signals.QueuedRequests != 0 || signals.Signers[signerID].Inflight != 0 {
+		t.Fatalf("expected no load once requests completed, got %+v", signals)
+	}
+
+	err = tmpag.enableAutoscaling(autoscalingConfig{SignerCapacity: map[string]int{"unknown": 1}})
+	if err == nil {
+		t.Fatal("expected the capacity of an unknown signer to fail")
+	}
+}
@@ -0,0 +1,364 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/database"
+)
+
+const (
+	// backupVersion is the version of the backup archive format.
+	// Restores refuse archives of another version.
+	backupVersion = 1
+
+	backupManifestName         = "manifest.json"
+	backupEndEntitiesName      = "endentities.json"
+	backupRecordedRequestsName = "recorded_requests.json"
+	backupSignerConfigsName    = "signer_configs.json"
+
+	// backupTimeout bounds the database queries of a backup or
+	// restore
+	backupTimeout = 10 * time.Minute
+)
+
+// backupManifest is the first file of a backup archive, with the
+// SHA256 digests of the other files
+type backupManifest struct {
+	Version   int               `json:"version"`
+	CreatedAt time.Time         `json:"created_at"`
+	Files     map[string]string `json:"files"`
+}
+
+// backupEndEntity is an end-entity in a backup archive. It holds the
+// label and handle of the key in the HSM, never the key itself.
+type backupEndEntity struct {
+	Label        string     `json:"label"`
+	HSMHandle    int64      `json:"hsm_handle"`
+	SignerID     string     `json:"signer_id"`
+	IsCurrent    bool       `json:"is_current"`
+	X5U          string     `json:"x5u,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	RolledBackAt *time.Time `json:"rolled_back_at,omitempty"`
+}
+
+// backupRecordedRequest is a recorded request in a backup archive
+type backupRecordedRequest struct {
+	Ref         string    `json:"ref"`
+	RequestID   string    `json:"request_id"`
+	SignerID    string    `json:"signer_id"`
+	UserID      string    `json:"user_id"`
+	Endpoint    string    `json:"endpoint"`
+	InputHash   string    `json:"input_hash"`
+	InputLength int       `json:"input_length"`
+	Options     string    `json:"options"`
+	OutputHash  string    `json:"output_hash"`
+	Status      int       `json:"status"`
+	DurationMS  int       `json:"duration_ms"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// backupSignerConfig is the last seen configuration of a signer in a
+// backup archive, whose secrets are fingerprints
+type backupSignerConfig struct {
+	SignerID  string            `json:"signer_id"`
+	Fields    map[string]string `json:"fields"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// writeBackupArchive writes the signer state of the database as a
+// gzipped tar archive of JSON files
+func writeBackupArchive(w io.Writer, data database.BackupData, now time.Time) error {
+	var (
+		endEntities      = []backupEndEntity{}
+		recordedRequests = []backupRecordedRequest{}
+		signerConfigs    = []backupSignerConfig{}
+	)
+	for _, ee := range data.EndEntities {
+		endEntities = append(endEntities, backupEndEntity(ee))
+	}
+	for _, rec := range data.RecordedRequests {
+		recordedRequests = append(recordedRequests, backupRecordedRequest{
+			Ref:         rec.Ref,
+			RequestID:   rec.RequestID,
+			SignerID:    rec.SignerID,
+			UserID:      rec.UserID,
+			Endpoint:    rec.Endpoint,
+			InputHash:   rec.InputHash,
+			InputLength: rec.InputLength,
+			Options:     rec.Options,
+			OutputHash:  rec.OutputHash,
+			Status:      rec.Status,
+			DurationMS:  rec.DurationMS,
+			CreatedAt:   rec.CreatedAt,
+		})
+	}
+	for _, c := range data.SignerConfigs {
+		signerConfigs = append(signerConfigs, backupSignerConfig(c))
+	}
+	files := []struct {
+		name string
+		v    interface{}
+	}{
+		{backupEndEntitiesName, endEntities},
+		{backupRecordedRequestsName, recordedRequests},
+		{backupSignerConfigsName, signerConfigs},
+	}
+	manifest := backupManifest{
+		Version:   backupVersion,
+		CreatedAt: now.UTC(),
+		Files:     make(map[string]string),
+	}
+	contents := make([][]byte, len(files))
+	for i, f := range files {
+		content, err := json.MarshalIndent(f.v, "", "  ")
+		if err != nil {
+			return errors.Wrapf(err, "failed to marshal %s", f.name)
+		}
+		sum := sha256.Sum256(content)
+		manifest.Files[f.name] = hex.EncodeToString(sum[:])
+		contents[i] = content
+	}
+	manifestContent, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal backup manifest")
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	writeFile := func(name string, content []byte) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(content)),
+			ModTime: manifest.CreatedAt,
+		})
+		if err == nil {
+			_, err = tw.Write(content)
+		}
+		return errors.Wrapf(err, "failed to write %s to backup archive", name)
+	}
+	err = writeFile(backupManifestName, manifestContent)
+	if err != nil {
+		return err
+	}
+	for i, f := range files {
+		err = writeFile(f.name, contents[i])
+		if err != nil {
+			return err
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to close backup archive")
+	}
+	return errors.Wrap(gz.Close(), "failed to close backup archive")
+}
+
+// readBackupArchive reads a backup archive, and checks its version and
+// the digests of its files
+func readBackupArchive(r io.Reader) (manifest backupManifest, data database.BackupData, err error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return manifest, data, errors.Wrap(err, "failed to read backup archive")
+	}
+	tr := tar.NewReader(gz)
+	contents := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, data, errors.Wrap(err, "failed to read backup archive")
+		}
+		if _, ok := contents[hdr.Name]; ok {
+			return manifest, data, errors.Errorf("backup archive has %s twice", hdr.Name)
+		}
+		contents[hdr.Name], err = ioutil.ReadAll(tr)
+		if err != nil {
+			return manifest, data, errors.Wrapf(err, "failed to read %s from backup archive", hdr.Name)
+		}
+	}
+	manifestContent, ok := contents[backupManifestName]
+	if !ok {
+		return manifest, data, errors.Errorf("backup archive has no %s", backupManifestName)
+	}
+	err = json.Unmarshal(manifestContent, &manifest)
+	if err != nil {
+		return manifest, data, errors.Wrap(err, "failed to parse backup manifest")
+	}
+	if manifest.Version != backupVersion {
+		return manifest, data, errors.Errorf("unsupported backup archive version %d, this autograph restores version %d", manifest.Version, backupVersion)
+	}
+	var (
+		endEntities      []backupEndEntity
+		recordedRequests []backupRecordedRequest
+		signerConfigs    []backupSignerConfig
+	)
+	for name, v := range map[string]interface{}{
+		backupEndEntitiesName:      &endEntities,
+		backupRecordedRequestsName: &recordedRequests,
+		backupSignerConfigsName:    &signerConfigs,
+	} {
+		content, ok := contents[name]
+		if !ok {
+			return manifest, data, errors.Errorf("backup archive has no %s", name)
+		}
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != manifest.Files[name] {
+			return manifest, data, errors.Errorf("digest of %s doesn't match the backup manifest", name)
+		}
+		err = json.Unmarshal(content, v)
+		if err != nil {
+			return manifest, data, errors.Wrapf(err, "failed to parse %s", name)
+		}
+	}
+	for _, ee := range endEntities {
+		data.EndEntities = append(data.EndEntities, database.EndEntity(ee))
+	}
+	for _, rec := range recordedRequests {
+		data.RecordedRequests = append(data.RecordedRequests, database.RecordedRequest{
+			Ref:         rec.Ref,
+			RequestID:   rec.RequestID,
+			SignerID:    rec.SignerID,
+			UserID:      rec.UserID,
+			Endpoint:    rec.Endpoint,
+			InputHash:   rec.InputHash,
+			InputLength: rec.InputLength,
+			Options:     rec.Options,
+			OutputHash:  rec.OutputHash,
+			Status:      rec.Status,
+			DurationMS:  rec.DurationMS,
+			CreatedAt:   rec.CreatedAt,
+		})
+	}
+	for _, c := range signerConfigs {
+		data.SignerConfigs = append(data.SignerConfigs, database.SignerConfig(c))
+	}
+	return manifest, data, nil
+}
+
+// connectBackupDatabase loads the configuration file of a backup or
+// restore command and connects to its database
+func connectBackupDatabase(cfgFile string) (*database.Handler, error) {
+	var conf configuration
+	err := conf.loadFromFile(cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Database.Name == "" {
+		return nil, errors.Errorf("configuration %s has no database to back up or restore", cfgFile)
+	}
+	return database.Connect(conf.Database)
+}
+
+// runBackup implements `autograph backup`, which writes the signer
+// state of the database to a backup archive
+func runBackup(args []string) error {
+	var (
+		cfgFile, output string
+		fset            = flag.NewFlagSet("backup", flag.ContinueOnError)
+	)
+	fset.StringVar(&cfgFile, "c", "autograph.yaml", "Path to configuration file")
+	fset.StringVar(&output, "o", "", "Path of the backup archive to write")
+	err := fset.Parse(args)
+	if err != nil {
+		return err
+	}
+	if output == "" {
+		return errors.New("missing path of the backup archive, set it with -o")
+	}
+	db, err := connectBackupDatabase(cfgFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), backupTimeout)
+	defer cancel()
+	data, err := db.Backup(ctx)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	err = writeBackupArchive(&buf, data, time.Now())
+	if err != nil {
+		return err
+	}
+	// the archive is only written once complete, and isn't
+	// readable by other users since it has the HSM labels
+	err = ioutil.WriteFile(output, buf.Bytes(), 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to write backup archive")
+	}
+	log.Infof("backed up %d end-entities, %d recorded requests and %d signer configurations to %s",
+		len(data.EndEntities), len(data.RecordedRequests), len(data.SignerConfigs), output)
+	return nil
+}
+
+// runRestore implements `autograph restore`, which inserts the signer
+// state of a backup archive in the database
+func runRestore(args []string) error {
+	var (
+		cfgFile, input string
+		dryRun         bool
+		fset           = flag.NewFlagSet("restore", flag.ContinueOnError)
+	)
+	fset.StringVar(&cfgFile, "c", "autograph.yaml", "Path to configuration file")
+	fset.StringVar(&input, "i", "", "Path of the backup archive to restore")
+	fset.BoolVar(&dryRun, "dry-run", false, "Check the backup archive without restoring it")
+	err := fset.Parse(args)
+	if err != nil {
+		return err
+	}
+	if input == "" {
+		return errors.New("missing path of the backup archive, set it with -i")
+	}
+	f, err := os.Open(input)
+	if err != nil {
+		return errors.Wrap(err, "failed to open backup archive")
+	}
+	defer f.Close()
+	manifest, data, err := readBackupArchive(f)
+	if err != nil {
+		return err
+	}
+	summary := fmt.Sprintf("%d end-entities, %d recorded requests and %d signer configurations backed up at %s",
+		len(data.EndEntities), len(data.RecordedRequests), len(data.SignerConfigs), manifest.CreatedAt.Format(time.RFC3339))
+	if dryRun {
+		log.Infof("backup archive %s is valid, with %s", input, summary)
+		return nil
+	}
+	db, err := connectBackupDatabase(cfgFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), backupTimeout)
+	defer cancel()
+	counts, err := db.Restore(ctx, data)
+	if err != nil {
+		return err
+	}
+	log.Infof("restored %d end-entities, %d recorded requests and %d signer configurations of the %s",
+		counts.EndEntities, counts.RecordedRequests, counts.SignerConfigs, summary)
+	return nil
+}
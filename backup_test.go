@@ -0,0 +1,133 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/database"
+)
+
+func TestBackupArchive(t *testing.T) {
+	t.Parallel()
+
+	created := time.Date(2020, 9, 1, 12, 0, 0, 0, time.UTC)
+	rolledBack := created.Add(time.Hour)
+	data := database.BackupData{
+		EndEntities: []database.EndEntity{
+			{Label: "normandy-1", HSMHandle: 42, SignerID: "normandy", X5U: "https://cdn.example.net/1.chain", CreatedAt: created, RolledBackAt: &rolledBack},
+			{Label: "normandy-2", HSMHandle: 43, SignerID: "normandy", IsCurrent: true, CreatedAt: created},
+		},
+		RecordedRequests: []database.RecordedRequest{
+			{Ref: "1dh3a7ncpd7q71rm08k0ttbbc1", SignerID: "normandy", UserID: "alice", Endpoint: "/sign/data", Options: "null", Status: 201, CreatedAt: created},
+		},
+		SignerConfigs: []database.SignerConfig{
+			{SignerID: "normandy", Fields: map[string]string{"type": "contentsignaturepki", "issuerprivkey": "sha256:abcd"}, UpdatedAt: created},
+		},
+	}
+	var buf bytes.Buffer
+	err := writeBackupArchive(&buf, data, created)
+	if err != nil {
+		t.Fatalf("failed to write backup archive: %v", err)
+	}
+	archive := buf.Bytes()
+	manifest, restored, err := readBackupArchive(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("failed to read backup archive: %v", err)
+	}
+	if manifest.Version != backupVersion || !manifest.CreatedAt.Equal(created) {
+		t.Fatalf("unexpected backup manifest %+v", manifest)
+	}
+	if !reflect.DeepEqual(restored, data) {
+		t.Fatalf("expected restored data to match the backup\n got: %+v\nwant: %+v", restored, data)
+	}
+
+	// rewrite the archive with a file modified or removed
+	rewrite := func(modify func(name string, content []byte) []byte) []byte {
+		gz, err := gzip.NewReader(bytes.NewReader(archive))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(gz)
+		var out bytes.Buffer
+		gzOut := gzip.NewWriter(&out)
+		tw := tar.NewWriter(gzOut)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content = modify(hdr.Name, content)
+			if content == nil {
+				continue
+			}
+			hdr.Size = int64(len(content))
+			tw.WriteHeader(hdr)
+			tw.Write(content)
+		}
+		tw.Close()
+		gzOut.Close()
+		return out.Bytes()
+	}
+	for i, testcase := range []struct {
+		archive []byte
+		err     string
+	}{
+		{[]byte("not an archive"), "failed to read backup archive"},
+		{rewrite(func(name string, content []byte) []byte {
+			if name == backupManifestName {
+				return bytes.Replace(content, []byte(`"version": 1`), []byte(`"version": 2`), 1)
+			}
+			return content
+		}), "unsupported backup archive version 2"},
+		{rewrite(func(name string, content []byte) []byte {
+			if name == backupEndEntitiesName {
+				return bytes.Replace(content, []byte(`"is_current": true`), []byte(`"is_current": false`), 1)
+			}
+			return content
+		}), "digest of endentities.json doesn't match"},
+		{rewrite(func(name string, content []byte) []byte {
+			if name == backupSignerConfigsName {
+				return nil
+			}
+			return content
+		}), "backup archive has no signer_configs.json"},
+		{rewrite(func(name string, content []byte) []byte {
+			if name == backupManifestName {
+				return nil
+			}
+			return content
+		}), "backup archive has no manifest.json"},
+	} {
+		_, _, err = readBackupArchive(bytes.NewReader(testcase.archive))
+		if err == nil || !strings.Contains(err.Error(), testcase.err) {
+			t.Errorf("testcase %d: expected error containing %q, got: %v", i, testcase.err, err)
+		}
+	}
+}
+
+func TestBackupCommandArguments(t *testing.T) {
+	t.Parallel()
+
+	err := runBackup([]string{"-c", "autograph.yaml"})
+	if err == nil || !strings.Contains(err.Error(), "set it with -o") {
+		t.Fatalf("expected backup without an output to fail, got: %v", err)
+	}
+	err = runRestore([]string{"-c", "autograph.yaml"})
+	if err == nil || !strings.Contains(err.Error(), "set it with -i") {
+		t.Fatalf("expected restore without an input to fail, got: %v", err)
+	}
+}
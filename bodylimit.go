@@ -0,0 +1,76 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"go.mozilla.org/autograph/formats"
+)
+
+// defaultMaxBodySize is the maximum size in bytes of a request body
+// when the server does not configure one. Seriously, what are you
+// trying to sign?
+const defaultMaxBodySize = 1048576000
+
+// setBodySizeLimits configures the global and per-endpoint maximum
+// sizes of request bodies
+func (a *autographer) setBodySizeLimits(maxBodySize int64, endpointMaxBodySizes map[string]int64) error {
+	if maxBodySize < 0 {
+		return errors.Errorf("invalid negative maximum body size %d", maxBodySize)
+	}
+	for endpoint, size := range endpointMaxBodySizes {
+		if size <= 0 {
+			return errors.Errorf("invalid maximum body size %d for endpoint %q", size, endpoint)
+		}
+	}
+	a.maxBodySize = maxBodySize
+	a.endpointBodySizes = endpointMaxBodySizes
+	return nil
+}
+
+// bodySizeLimit returns the maximum size in bytes of the body of
+// requests to an endpoint
+func (a *autographer) bodySizeLimit(endpoint string) int64 {
+	if size, ok := a.endpointBodySizes[endpoint]; ok {
+		return size
+	}
+	if a.maxBodySize > 0 {
+		return a.maxBodySize
+	}
+	return defaultMaxBodySize
+}
+
+// readRequestBody reads the body of a request up to the size limit of
+// its endpoint. It writes a 413 to the client and returns false when
+// the body is larger, without reading more than the limit.
+func (a *autographer) readRequestBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if r.Body == nil {
+		return nil, true
+	}
+	limit := a.bodySizeLimit(r.URL.Path)
+	if r.ContentLength > limit {
+		httpError(w, r, http.StatusRequestEntityTooLarge, formats.ErrorCodeRequestTooLarge, "request body of %d bytes exceeds the maximum size of %d bytes", r.ContentLength, limit)
+		return nil, false
+	}
+	if !a.admitRequestMemory(w, r) {
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		// the reader returns an error after reading limit
+		// bytes of a larger body
+		if int64(len(body)) >= limit {
+			httpError(w, r, http.StatusRequestEntityTooLarge, formats.ErrorCodeRequestTooLarge, "request body exceeds the maximum size of %d bytes", limit)
+			return nil, false
+		}
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "failed to read request body: %s", err)
+		return nil, false
+	}
+	return body, true
+}
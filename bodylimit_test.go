@@ -0,0 +1,107 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+func TestRequestBodySizeLimits(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(100)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.setBodySizeLimits(2048, map[string]int64{"/sign/hash": 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.addSigners([]signer.Configuration{conf.Signers[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := authorization{
+		ID:      "limitsuser",
+		Key:     "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+		Signers: []string{conf.Signers[0].ID},
+	}
+	err = tmpag.addAuthorizations([]authorization{auth})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(endpoint, input string, chunked bool) *httptest.ResponseRecorder {
+		body, err := json.Marshal([]formats.SignatureRequest{{Input: input}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar"+endpoint, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunked {
+			// hide the length of the body like a chunked request
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			req.ContentLength = -1
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		tmpag.handleSignature(w, req)
+		return w
+	}
+	tooLarge := func(w *httptest.ResponseRecorder) bool {
+		var errResp formats.ErrorResponse
+		err := json.Unmarshal(w.Body.Bytes(), &errResp)
+		return err == nil && w.Code == http.StatusRequestEntityTooLarge && errResp.Code == formats.ErrorCodeRequestTooLarge
+	}
+
+	w := sign("/sign/data", "Y2FyaWJvdW1hdXJpY2UK", false)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected a small request to be signed, got %d: %s", w.Code, w.Body.String())
+	}
+	large := strings.Repeat("A", 4096)
+	for _, chunked := range []bool{false, true} {
+		w = sign("/sign/data", large, chunked)
+		if !tooLarge(w) {
+			t.Fatalf("expected a 413 for a large request (chunked %t), got %d: %s", chunked, w.Code, w.Body.String())
+		}
+	}
+
+	// the endpoint limit overrides the global one
+	w = sign("/sign/hash", strings.Repeat("A", 200), true)
+	if !tooLarge(w) {
+		t.Fatalf("expected a 413 for a hash request over the endpoint limit, got %d: %s", w.Code, w.Body.String())
+	}
+	if tmpag.bodySizeLimit("/sign/file") != 2048 || tmpag.bodySizeLimit("/sign/hash") != 100 {
+		t.Fatal("expected the configured body size limits")
+	}
+	if newAutographer(1).bodySizeLimit("/sign/data") != defaultMaxBodySize {
+		t.Fatal("expected the default body size limit")
+	}
+
+	for i, testcase := range []struct {
+		global    int64
+		endpoints map[string]int64
+	}{
+		{-1, nil},
+		{0, map[string]int64{"/sign/file": 0}},
+	} {
+		err = newAutographer(1).setBodySizeLimits(testcase.global, testcase.endpoints)
+		if err == nil {
+			t.Fatalf("testcase %d: expected invalid body size limits to be rejected", i)
+		}
+	}
+}
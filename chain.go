@@ -0,0 +1,138 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mozilla.org/pkcs7"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+const (
+	// chainFormatPEM returns a chain as concatenated PEM
+	// certificates, like the x5u of content signatures
+	chainFormatPEM = "pem"
+
+	// chainFormatPKCS7 returns a chain as a DER PKCS#7 certs-only
+	// structure, a SignedData without content or signers
+	chainFormatPKCS7 = "pkcs7"
+)
+
+// signerCertificateChain returns the certificate chain of a signer,
+// end-entity first: the current chain of signers that rotate their
+// certificates, like contentsignaturepki, and otherwise the
+// certificates of the signer configuration
+func signerCertificateChain(s signer.Signer) ([]*x509.Certificate, error) {
+	if chainer, ok := s.(signer.CertificateChainer); ok {
+		return chainer.CertificateChain(), nil
+	}
+	var certs []*x509.Certificate
+	rest := []byte(s.Config().Certificate)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse certificate of signer configuration")
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// handleGetChain returns the certificate chain of a signer the user is
+// allowed to use, as PEM certificates or, with ?format=pkcs7, a
+// PKCS#7 certs-only structure
+func (a *autographer) handleGetChain(w http.ResponseWriter, r *http.Request) {
+	body, read := a.readRequestBody(w, r)
+	if !read {
+		return
+	}
+	userid, err := a.authorize(r, body)
+	if err != nil {
+		authError(w, r, err)
+		return
+	}
+	signerID := mux.Vars(r)["id"]
+	s, err := a.authBackend.getSignerForUser(userid, signerID)
+	if err != nil {
+		a.authorizationDenied(w, r, http.StatusUnauthorized, formats.ErrorCodeSignerNotPermitted, userid, signerID, err)
+		return
+	}
+	s, err = resolveSigner(s)
+	if err != nil {
+		httpError(w, r, http.StatusServiceUnavailable, formats.ErrorCodeSignerUnavailable, "%v", err)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = chainFormatPEM
+	}
+	if format != chainFormatPEM && format != chainFormatPKCS7 {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "unknown chain format %q, must be %q or %q", format, chainFormatPEM, chainFormatPKCS7)
+		return
+	}
+	certs, err := signerCertificateChain(s)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	if len(certs) == 0 {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "signer %q has no certificate chain", signerID)
+		return
+	}
+	var (
+		out         bytes.Buffer
+		contentType string
+	)
+	switch format {
+	case chainFormatPEM:
+		for _, cert := range certs {
+			err = pem.Encode(&out, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+			if err != nil {
+				httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "failed to encode chain: %v", err)
+				return
+			}
+		}
+		contentType = "application/x-pem-file"
+	case chainFormatPKCS7:
+		var der []byte
+		for _, cert := range certs {
+			der = append(der, cert.Raw...)
+		}
+		p7, err := pkcs7.DegenerateCertificate(der)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "failed to encode chain: %v", err)
+			return
+		}
+		out.Write(p7)
+		contentType = "application/pkcs7-mime; smime-type=certs-only"
+	}
+	log.WithFields(log.Fields{
+		"rid":       getRequestID(r),
+		"signer_id": signerID,
+		"user_id":   userid,
+		"format":    format,
+		"certs":     len(certs),
+	}).Info("returned certificate chain of signer")
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out.Bytes())
+}
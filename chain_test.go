@@ -0,0 +1,142 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mozilla.org/pkcs7"
+
+	"go.mozilla.org/autograph/signer"
+)
+
+func TestGetChain(t *testing.T) {
+	t.Parallel()
+
+	var signerConfs []signer.Configuration
+	for _, s := range conf.Signers {
+		if s.ID == "normandy" || s.ID == "appkey1" || s.ID == "testapp-android" {
+			signerConfs = append(signerConfs, s)
+		}
+	}
+	tmpag := newAutographer(10)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners(signerConfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := authorization{ID: "chainuser", Key: "v2xy5pqm8zbdw7nkc0g4rfj3h6slt9aeuq1oi5mw8kcz0nbx7p", Signers: []string{"normandy", "appkey1", "testapp-android"}}
+	other := authorization{ID: "chainother", Key: "k3fw9rj0xqtz2ycm6bnd8pv4hls7eug1ao5ik9wr2mxt6czq0j", Signers: []string{"appkey1"}}
+	err = tmpag.addAuthorizations([]authorization{user, other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	getChain := func(auth authorization, signerID, format string) *httptest.ResponseRecorder {
+		url := "http://foo.bar/signer/" + signerID + "/chain"
+		if format != "" {
+			url += "?format=" + format
+		}
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", []byte("")))
+		w := httptest.NewRecorder()
+		tmpag.handleGetChain(w, mux.SetURLVars(req, map[string]string{"id": signerID}))
+		return w
+	}
+
+	for i, testcase := range []struct {
+		auth     authorization
+		signerID string
+		format   string
+		status   int
+	}{
+		{other, "normandy", "", http.StatusUnauthorized},
+		{user, "unknown", "", http.StatusUnauthorized},
+		{user, "normandy", "der", http.StatusBadRequest},
+		{user, "appkey1", "", http.StatusNotFound},
+	} {
+		w := getChain(testcase.auth, testcase.signerID, testcase.format)
+		if w.Code != testcase.status {
+			t.Errorf("testcase %d: expected status %d but got %d: %s", i, testcase.status, w.Code, w.Body.String())
+		}
+	}
+
+	s, _ := tmpag.getSignerByID("normandy")
+	expected := s.(signer.CertificateChainer).CertificateChain()
+	if len(expected) != 3 {
+		t.Fatalf("expected normandy to have a chain of 3 certificates but got %d", len(expected))
+	}
+
+	w := getChain(user, "normandy", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "application/x-pem-file" {
+		t.Errorf("unexpected content type %q", w.Header().Get("Content-Type"))
+	}
+	var certs []*x509.Certificate
+	rest := w.Body.Bytes()
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+	}
+	assertSameChain(t, certs, expected)
+
+	w = getChain(user, "normandy", "pkcs7")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	p7, err := pkcs7.Parse(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("failed to parse pkcs7 chain: %v", err)
+	}
+	assertSameChain(t, p7.Certificates, expected)
+
+	// signers without rotating end-entities return the certificate
+	// of their configuration
+	w = getChain(user, "testapp-android", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	block, _ := pem.Decode(w.Body.Bytes())
+	if block == nil {
+		t.Fatalf("expected a PEM certificate but got %q", w.Body.String())
+	}
+	s, _ = tmpag.getSignerByID("testapp-android")
+	confBlock, _ := pem.Decode([]byte(s.Config().Certificate))
+	if !bytes.Equal(block.Bytes, confBlock.Bytes) {
+		t.Error("returned certificate differs from the signer configuration")
+	}
+}
+
+func assertSameChain(t *testing.T, certs, expected []*x509.Certificate) {
+	if len(certs) != len(expected) {
+		t.Fatalf("expected %d certificates but got %d", len(expected), len(certs))
+	}
+	for i := range certs {
+		if !bytes.Equal(certs[i].Raw, expected[i].Raw) {
+			t.Errorf("certificate %d %q differs from the expected %q", i, certs[i].Subject.CommonName, expected[i].Subject.CommonName)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+// makeChecksumsManifest returns a canonical SHA256SUMS manifest in
+// the format of sha256sum: one line per file with the lowercase hex
+// digest, two spaces and the file name, sorted by file name
+func makeChecksumsManifest(files []formats.ChecksumsFile) (string, error) {
+	if len(files) == 0 {
+		return "", errors.New("no files to list in manifest")
+	}
+	if len(files) > maxArchiveEntries {
+		return "", errors.Errorf("manifest cannot list more than %d files", maxArchiveEntries)
+	}
+	sorted := make([]formats.ChecksumsFile, len(files))
+	copy(sorted, files)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	var manifest strings.Builder
+	for i, f := range sorted {
+		if f.Name == "" || strings.ContainsAny(f.Name, "\r\n\\") {
+			return "", errors.Errorf("invalid file name %q", f.Name)
+		}
+		if i > 0 && sorted[i-1].Name == f.Name {
+			return "", errors.Errorf("duplicate file name %q", f.Name)
+		}
+		digest, err := hex.DecodeString(f.SHA256)
+		if err != nil || len(digest) != sha256.Size {
+			return "", errors.Errorf("invalid sha256 digest %q for file %q", f.SHA256, f.Name)
+		}
+		fmt.Fprintf(&manifest, "%x  %s\n", digest, f.Name)
+	}
+	return manifest.String(), nil
+}
+
+// checksumsFilesFromArchive returns the names and digests of the
+// regular files of a tar, gzipped tar or zip archive
+func checksumsFilesFromArchive(input []byte) (files []formats.ChecksumsFile, err error) {
+	_, entries, err := readArchive(input)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.regular {
+			continue
+		}
+		digest := sha256.Sum256(entry.data)
+		files = append(files, formats.ChecksumsFile{
+			Name:   entry.name,
+			SHA256: hex.EncodeToString(digest[:]),
+		})
+	}
+	return files, nil
+}
+
+// handleChecksumsSignature endpoint accepts a list of files and their
+// digests, or an archive, in a HAWK authenticated POST request. It
+// returns a SHA256SUMS manifest of the files signed by each of the
+// requested data signers.
+func (a *autographer) handleChecksumsSignature(w http.ResponseWriter, r *http.Request) {
+	rid := getRequestID(r)
+	starttime := getRequestStartTime(r)
+	userid, body, ok := a.authorizeRequestBody(w, r)
+	if !ok {
+		return
+	}
+	release, ok := a.admitRequest(w, r, userid)
+	if !ok {
+		return
+	}
+	defer release()
+	var req formats.ChecksumsSignatureRequest
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "failed to parse request body: %v", err)
+		return
+	}
+	if len(req.KeyIDs) == 0 {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "missing keyids in checksums signature request")
+		return
+	}
+	if (len(req.Files) == 0) == (req.Input == "") {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidInput, "checksums signature request must have exactly one of files or input")
+		return
+	}
+	signers := make([]signer.DataSigner, len(req.KeyIDs))
+	signerIDs := make([]string, len(req.KeyIDs))
+	for i, keyid := range req.KeyIDs {
+		requestedSigner, err := a.authBackend.getSignerForUser(userid, keyid)
+		if err != nil {
+			a.authorizationDenied(w, r, http.StatusUnauthorized, formats.ErrorCodeSignerNotPermitted, userid, keyid, err)
+			return
+		}
+		requestedSigner, err = resolveSigner(requestedSigner)
+		if err != nil {
+			httpError(w, r, http.StatusServiceUnavailable, formats.ErrorCodeSignerUnavailable, "%v", err)
+			return
+		}
+		signers[i], ok = requestedSigner.(signer.DataSigner)
+		if !ok {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeUnsupportedOperation, "signer %q does not implement data signing", keyid)
+			return
+		}
+		signerIDs[i] = requestedSigner.Config().ID
+	}
+	defer a.load.startSigning(signerIDs...)()
+	files := req.Files
+	if req.Input != "" {
+		input, releaseInput, err := decodeBase64Input(r.Context(), req.Input)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidInput, "%v", err)
+			return
+		}
+		defer releaseInput()
+		files, err = checksumsFilesFromArchive(input)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidInput, "failed to read archive: %v", err)
+			return
+		}
+	}
+	manifest, err := makeChecksumsManifest(files)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidInput, "failed to make manifest: %v", err)
+		return
+	}
+
+	ctx, cancel := a.requestContext(r)
+	defer cancel()
+	ctx = a.withMARChannels(ctx, userid)
+	resp := formats.ChecksumsSignatureResponse{
+		Ref:        id(),
+		Manifest:   manifest,
+		Signatures: make([]formats.SignatureResponse, len(signers)),
+	}
+	for i, dataSigner := range signers {
+		conf := dataSigner.(signer.Signer).Config()
+		sig, err := signer.SignDataContext(ctx, dataSigner, []byte(manifest), dataSigner.GetDefaultOptions())
+		if err != nil {
+			a.recordUsage(conf.ID, userid, len(manifest), true)
+			status, code := signingError(ctx, err)
+			a.signingRejected(r, code, userid, conf.ID, err)
+			a.recordSLO(r, conf.ID, code)
+			httpError(w, r, status, code, "signing failed with error: %v", err)
+			return
+		}
+		encodedsig, err := sig.Marshal()
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeSigningFailed, "encoding failed with error: %v", err)
+			return
+		}
+		resp.Signatures[i] = formats.SignatureResponse{
+			Ref:        id(),
+			Type:       conf.Type,
+			Mode:       conf.Mode,
+			SignerID:   conf.ID,
+			PublicKey:  conf.PublicKey,
+			Signature:  encodedsig,
+			X5U:        conf.X5U,
+			SignerOpts: conf.SignerOpts,
+		}
+		log.WithFields(log.Fields{
+			"rid":         rid,
+			"mode":        conf.Mode,
+			"ref":         resp.Signatures[i].Ref,
+			"type":        conf.Type,
+			"signer_id":   conf.ID,
+			"input_hash":  hashSHA256AsHex([]byte(manifest)),
+			"output_hash": hashSHA256AsHex([]byte(encodedsig)),
+			"files":       len(files),
+			"user_id":     userid,
+			"t":           int32(time.Since(starttime) / time.Millisecond), //  request processing time in ms
+		}).Info("signing operation succeeded")
+		a.exportSignature(r, userid, conf.ID, resp.Signatures[i].Ref, hashSHA256AsHex([]byte(manifest)), hashSHA256AsHex([]byte(encodedsig)), nil)
+		a.recordUsage(conf.ID, userid, len(manifest), false)
+		a.countKeySignature(conf, sig)
+		a.recordSLO(r, conf.ID, "")
+	}
+	respdata, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "failed to marshal response: %v", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(respdata)
+	log.WithFields(log.Fields{"rid": rid}).Info("checksums signing request completed successfully")
+}
@@ -0,0 +1,101 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mozilla.org/autograph/formats"
+)
+
+func TestMakeChecksumsManifest(t *testing.T) {
+	t.Parallel()
+
+	manifest, err := makeChecksumsManifest([]formats.ChecksumsFile{
+		{Name: "linux-x86_64/firefox.tar.bz2", SHA256: "A1B2C3D4E5F60718293A4B5C6D7E8F90A1B2C3D4E5F60718293A4B5C6D7E8F90"},
+		{Name: "mac/Firefox.dmg", SHA256: "0000000000000000000000000000000000000000000000000000000000000000"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90  linux-x86_64/firefox.tar.bz2\n" +
+		"0000000000000000000000000000000000000000000000000000000000000000  mac/Firefox.dmg\n"
+	if manifest != expected {
+		t.Fatalf("unexpected manifest:\n%s\nexpected:\n%s", manifest, expected)
+	}
+
+	for i, files := range [][]formats.ChecksumsFile{
+		nil,
+		{{Name: "a", SHA256: "abcd"}},
+		{{Name: "a\nb", SHA256: strings.Repeat("0", 64)}},
+		{{Name: "a", SHA256: strings.Repeat("0", 64)}, {Name: "a", SHA256: strings.Repeat("1", 64)}},
+	} {
+		_, err = makeChecksumsManifest(files)
+		if err == nil {
+			t.Fatalf("test case %d: expected invalid files to fail", i)
+		}
+	}
+}
+
+func TestChecksumsSignature(t *testing.T) {
+	t.Parallel()
+
+	for _, req := range []formats.ChecksumsSignatureRequest{
+		{
+			Files: []formats.ChecksumsFile{
+				{Name: "dist/app.txt", SHA256: hashSHA256AsHex([]byte(testArchiveFiles[1].data))},
+			},
+			KeyIDs: []string{"appkey1", "randompgp"},
+		},
+		{
+			Input:  base64.StdEncoding.EncodeToString(makeTestZip(t)),
+			KeyIDs: []string{"appkey1", "randompgp"},
+		},
+	} {
+		body, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpReq, err := http.NewRequest("POST", "http://foo.bar/sign/checksums", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		auth, err := ag.getAuthByID(conf.Authorizations[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpReq.Header.Set("Authorization", getAuthHeader(httpReq, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		ag.handleChecksumsSignature(w, httpReq)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("failed with %d: %s", w.Code, w.Body.String())
+		}
+		var resp formats.ChecksumsSignatureResponse
+		err = json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedLine := strings.ToLower(hashSHA256AsHex([]byte(testArchiveFiles[1].data))) + "  dist/app.txt\n"
+		if !strings.Contains(resp.Manifest, expectedLine) {
+			t.Fatalf("expected manifest to list dist/app.txt, got:\n%s", resp.Manifest)
+		}
+		if len(resp.Signatures) != 2 || resp.Signatures[1].SignerID != "randompgp" || resp.Signatures[1].Signature == "" {
+			t.Fatalf("expected content and pgp signatures, got %+v", resp.Signatures)
+		}
+		err = verifyContentSignature(base64.StdEncoding.EncodeToString([]byte(resp.Manifest)), "/sign/data",
+			resp.Signatures[0].Signature, resp.Signatures[0].PublicKey)
+		if err != nil {
+			t.Fatalf("failed to verify the content signature of the manifest: %v", err)
+		}
+	}
+}
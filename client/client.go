@@ -0,0 +1,339 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package client is a Go client of the autograph signing API. It
+// authenticates requests with Hawk, retries them on retriable errors
+// and verifies the signatures returned for each signer type.
+//
+//	c, err := client.New("https://autograph.example.net", "alice", "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu")
+//	resp, err := c.SignData(ctx, "appkey1", data, nil)
+//	err = client.VerifyData(data, *resp, nil)
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/hawk"
+
+	"go.mozilla.org/autograph/formats"
+)
+
+// Signing endpoints of the autograph API
+const (
+	EndpointData = "/sign/data"
+	EndpointHash = "/sign/hash"
+	EndpointFile = "/sign/file"
+)
+
+const (
+	// DefaultMaxRetries is the number of times a request is retried
+	// after a retriable error
+	DefaultMaxRetries = 3
+
+	// DefaultRetryBackoff is the delay before the first retry,
+	// doubled after each attempt
+	DefaultRetryBackoff = 500 * time.Millisecond
+
+	// maxRetryAfter caps the delay a server can ask for in a
+	// Retry-After header
+	maxRetryAfter = time.Minute
+)
+
+// Client sends signing requests to an autograph server
+type Client struct {
+	// URL is the base URL of the autograph server
+	URL string
+
+	// ID and Key are the Hawk credentials of the client
+	ID  string
+	Key string
+
+	// HTTPClient sends the requests, http.DefaultClient when nil
+	HTTPClient *http.Client
+
+	// MaxRetries is the number of times a request is retried after
+	// a retriable error, zero disables retries
+	MaxRetries int
+
+	// RetryBackoff is the delay before the first retry, doubled
+	// after each attempt unless the server sends a Retry-After
+	// header
+	RetryBackoff time.Duration
+
+	// CompressRequests gzips request bodies, which autograph
+	// decompresses before checking their Hawk payload hash.
+	// Responses are decompressed by the transport of HTTPClient.
+	CompressRequests bool
+
+	// ResponseKey is the public key of the /response-signing-key
+	// endpoint of servers that sign their responses. When set,
+	// successful responses without a valid signature are refused.
+	ResponseKey crypto.PublicKey
+
+	// OnSignedResponse is called with the body and signature of
+	// verified responses, for instance to keep them as proof for
+	// downstream systems that signatures came from autograph
+	OnSignedResponse func(endpoint string, body []byte, signature string)
+}
+
+// New returns a client of the autograph server at baseURL that
+// authenticates with Hawk credentials id and key
+func New(baseURL, id, key string) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "client: failed to parse autograph url")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.Errorf("client: autograph url %q must use http or https", baseURL)
+	}
+	if id == "" || key == "" {
+		return nil, errors.New("client: missing hawk credentials")
+	}
+	return &Client{
+		URL:          strings.TrimSuffix(baseURL, "/"),
+		ID:           id,
+		Key:          key,
+		MaxRetries:   DefaultMaxRetries,
+		RetryBackoff: DefaultRetryBackoff,
+	}, nil
+}
+
+// Error is returned when autograph rejects a request
+type Error struct {
+	StatusCode int
+	formats.ErrorResponse
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("autograph returned %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("autograph returned %d %s: %s (request %s)", e.StatusCode, e.Code, e.Message, e.RequestID)
+}
+
+// retriable tells whether sending the same request again may succeed
+func (e *Error) retriable() bool {
+	if e.Retriable {
+		return true
+	}
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// SignData signs data with the signer keyid, or the default signer of
+// the client when keyid is empty
+func (c *Client) SignData(ctx context.Context, keyid string, data []byte, options interface{}) (*formats.SignatureResponse, error) {
+	return c.signOne(ctx, EndpointData, formats.SignatureRequest{
+		Input:   base64.StdEncoding.EncodeToString(data),
+		KeyID:   keyid,
+		Options: options,
+	})
+}
+
+// SignDataWithNonce signs data bound to a nonce picked by the client,
+// for protocols that need proof the signature was made after the nonce
+// was picked. Verify the response with VerifyData and the nonce in
+// VerifyOptions.
+func (c *Client) SignDataWithNonce(ctx context.Context, keyid string, data, nonce []byte, options interface{}) (*formats.SignatureResponse, error) {
+	return c.signOne(ctx, EndpointData, formats.SignatureRequest{
+		Input:   base64.StdEncoding.EncodeToString(data),
+		KeyID:   keyid,
+		Options: options,
+		Nonce:   base64.StdEncoding.EncodeToString(nonce),
+	})
+}
+
+// SignHash signs a digest with the signer keyid
+func (c *Client) SignHash(ctx context.Context, keyid string, digest []byte, options interface{}) (*formats.SignatureResponse, error) {
+	return c.signOne(ctx, EndpointHash, formats.SignatureRequest{
+		Input:   base64.StdEncoding.EncodeToString(digest),
+		KeyID:   keyid,
+		Options: options,
+	})
+}
+
+// SignFile signs a file with the signer keyid. The signed file is in
+// the SignedFile field of the response.
+func (c *Client) SignFile(ctx context.Context, keyid string, file []byte, options interface{}) (*formats.SignatureResponse, error) {
+	return c.signOne(ctx, EndpointFile, formats.SignatureRequest{
+		Input:   base64.StdEncoding.EncodeToString(file),
+		KeyID:   keyid,
+		Options: options,
+	})
+}
+
+func (c *Client) signOne(ctx context.Context, endpoint string, req formats.SignatureRequest) (*formats.SignatureResponse, error) {
+	resps, err := c.Sign(ctx, endpoint, []formats.SignatureRequest{req})
+	if err != nil {
+		return nil, err
+	}
+	if len(resps) != 1 {
+		return nil, errors.Errorf("client: expected 1 signature response, got %d", len(resps))
+	}
+	return &resps[0], nil
+}
+
+// Sign sends a batch of signature requests with base64 encoded inputs
+// to one of the signing endpoints and returns the responses in the
+// same order
+func (c *Client) Sign(ctx context.Context, endpoint string, requests []formats.SignatureRequest) ([]formats.SignatureResponse, error) {
+	body, err := json.Marshal(requests)
+	if err != nil {
+		return nil, errors.Wrap(err, "client: failed to marshal signature requests")
+	}
+	var resps []formats.SignatureResponse
+	err = c.Do(ctx, http.MethodPost, endpoint, body, &resps)
+	if err != nil {
+		return nil, err
+	}
+	if len(resps) != len(requests) {
+		return nil, errors.Errorf("client: sent %d signature requests but got %d responses", len(requests), len(resps))
+	}
+	return resps, nil
+}
+
+// Do sends a JSON body to an endpoint of the autograph API and decodes
+// the JSON response into result. It retries requests that fail with
+// a network error or a retriable autograph error.
+func (c *Client) Do(ctx context.Context, method, endpoint string, body []byte, result interface{}) error {
+	backoff := c.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := c.do(ctx, method, endpoint, body, result)
+		if err == nil {
+			return nil
+		}
+		if attempt >= c.MaxRetries || ctx.Err() != nil {
+			return err
+		}
+		if apiErr, ok := err.(*Error); ok && !apiErr.retriable() {
+			return err
+		}
+		delay := backoff
+		if retryAfter > 0 {
+			delay = retryAfter
+		}
+		backoff *= 2
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// do sends a single request and returns the delay the server asked
+// for in a Retry-After header
+func (c *Client) do(ctx context.Context, method, endpoint string, body []byte, result interface{}) (time.Duration, error) {
+	sentBody := body
+	if c.CompressRequests {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(body)
+		err := gz.Close()
+		if err != nil {
+			return 0, errors.Wrap(err, "client: failed to compress request")
+		}
+		sentBody = buf.Bytes()
+	}
+	req, err := http.NewRequest(method, c.URL+endpoint, bytes.NewReader(sentBody))
+	if err != nil {
+		return 0, errors.Wrap(err, "client: failed to create request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if c.CompressRequests {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	// each attempt gets a new hawk nonce and timestamp
+	req.Header.Set("Authorization", c.authHeader(req, body))
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, errors.Wrapf(err, "client: failed to send request to %s", endpoint)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, errors.Wrapf(err, "client: failed to read response of %s", endpoint)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		if json.Unmarshal(respBody, &apiErr.ErrorResponse) != nil {
+			apiErr.ErrorResponse = formats.ErrorResponse{Message: strings.TrimSpace(string(respBody))}
+		}
+		return parseRetryAfter(resp.Header.Get("Retry-After")), apiErr
+	}
+	if c.ResponseKey != nil {
+		signature := resp.Header.Get(formats.HeaderResponseSignature)
+		if signature == "" {
+			return 0, errors.Errorf("client: response of %s is not signed", endpoint)
+		}
+		err = VerifyResponseSignature(signature, respBody, c.ResponseKey)
+		if err != nil {
+			return 0, errors.Wrapf(err, "client: failed to verify response of %s", endpoint)
+		}
+		if c.OnSignedResponse != nil {
+			c.OnSignedResponse(endpoint, respBody, signature)
+		}
+	}
+	if result == nil {
+		return 0, nil
+	}
+	err = json.Unmarshal(respBody, result)
+	if err != nil {
+		return 0, errors.Wrapf(err, "client: failed to parse response of %s", endpoint)
+	}
+	return 0, nil
+}
+
+// authHeader returns a hawk authorization header with a hash of the
+// request payload
+func (c *Client) authHeader(req *http.Request, body []byte) string {
+	auth := hawk.NewRequestAuth(req,
+		&hawk.Credentials{
+			ID:   c.ID,
+			Key:  c.Key,
+			Hash: sha256.New,
+		},
+		0)
+	payloadhash := auth.PayloadHash(req.Header.Get("Content-Type"))
+	payloadhash.Write(body)
+	auth.SetHash(payloadhash)
+	return auth.RequestHeader()
+}
+
+// parseRetryAfter returns the delay of a Retry-After header in
+// seconds, or zero when it is missing or invalid
+func parseRetryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	delay := time.Duration(seconds) * time.Second
+	if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+	return delay
+}
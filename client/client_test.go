@@ -0,0 +1,526 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/hawk"
+	margo "go.mozilla.org/mar"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/autograph/signer/contentsignature"
+	"go.mozilla.org/autograph/signer/mar"
+	"go.mozilla.org/autograph/signer/pgp"
+)
+
+const (
+	testID  = "alice"
+	testKey = "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu"
+)
+
+// fakeAutograph checks the hawk authorization of signing requests and
+// signs them with local signers. Its first failures requests fail with
+// failStatus.
+type fakeAutograph struct {
+	sync.Mutex
+	t          *testing.T
+	signers    map[string]signer.Signer
+	requests   int
+	compressed int
+	failures   int
+	failStatus int
+	retriable  bool
+}
+
+func (f *fakeAutograph) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	f.requests++
+	fail := f.requests <= f.failures
+	f.Unlock()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		f.t.Error(err)
+		f.writeError(w, http.StatusInternalServerError, formats.ErrorCodeInvalidRequest, false)
+		return
+	}
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		f.Lock()
+		f.compressed++
+		f.Unlock()
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err == nil {
+			body, err = ioutil.ReadAll(gz)
+		}
+		if err != nil {
+			f.writeError(w, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, false)
+			return
+		}
+	}
+	auth, err := hawk.NewAuthFromRequest(r, func(creds *hawk.Credentials) error {
+		if creds.ID != testID {
+			return errors.New("unknown hawk id")
+		}
+		creds.Key = testKey
+		creds.Hash = sha256.New
+		return nil
+	}, nil)
+	if err != nil {
+		f.writeError(w, http.StatusUnauthorized, formats.ErrorCodeUnauthorized, false)
+		return
+	}
+	if auth.Valid() != nil {
+		f.writeError(w, http.StatusUnauthorized, formats.ErrorCodeUnauthorized, false)
+		return
+	}
+	payloadhash := auth.PayloadHash(r.Header.Get("Content-Type"))
+	payloadhash.Write(body)
+	if !auth.ValidHash(payloadhash) {
+		f.writeError(w, http.StatusUnauthorized, formats.ErrorCodeUnauthorized, false)
+		return
+	}
+	if fail {
+		w.Header().Set("Retry-After", "0")
+		f.writeError(w, f.failStatus, formats.ErrorCodeSignerUnavailable, f.retriable)
+		return
+	}
+
+	var sigreqs []formats.SignatureRequest
+	err = json.Unmarshal(body, &sigreqs)
+	if err != nil {
+		f.writeError(w, http.StatusBadRequest, formats.ErrorCodeInvalidInput, false)
+		return
+	}
+	sigresps := make([]formats.SignatureResponse, len(sigreqs))
+	for i, sigreq := range sigreqs {
+		s, ok := f.signers[sigreq.KeyID]
+		if !ok {
+			f.writeError(w, http.StatusBadRequest, formats.ErrorCodeSignerNotPermitted, false)
+			return
+		}
+		input, err := base64.StdEncoding.DecodeString(sigreq.Input)
+		if err != nil {
+			f.t.Error(err)
+			f.writeError(w, http.StatusInternalServerError, formats.ErrorCodeSigningFailed, false)
+			return
+		}
+		if sigreq.Nonce != "" {
+			nonce, _ := base64.StdEncoding.DecodeString(sigreq.Nonce)
+			input, err = signer.NonceBoundInput(nonce, input)
+			if err != nil {
+				f.writeError(w, http.StatusBadRequest, formats.ErrorCodeInvalidInput, false)
+				return
+			}
+		}
+		var sig signer.Signature
+		if r.URL.Path == EndpointHash {
+			sig, err = s.(signer.HashSigner).SignHash(input, sigreq.Options)
+		} else {
+			sig, err = s.(signer.DataSigner).SignData(input, sigreq.Options)
+		}
+		if err != nil {
+			f.writeError(w, http.StatusInternalServerError, formats.ErrorCodeSigningFailed, false)
+			return
+		}
+		sigstr, err := sig.Marshal()
+		if err != nil {
+			f.t.Error(err)
+			f.writeError(w, http.StatusInternalServerError, formats.ErrorCodeSigningFailed, false)
+			return
+		}
+		sigresps[i] = formats.SignatureResponse{
+			Type:      s.Config().Type,
+			SignerID:  s.Config().ID,
+			PublicKey: s.Config().PublicKey,
+			Signature: sigstr,
+			Nonce:     sigreq.Nonce,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sigresps)
+}
+
+func (f *fakeAutograph) writeError(w http.ResponseWriter, status int, code formats.ErrorCode, retriable bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(formats.ErrorResponse{
+		Code:      code,
+		Message:   "request failed",
+		Retriable: retriable,
+		RequestID: "req-1",
+	})
+}
+
+func newTestSigners(t *testing.T) map[string]signer.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+
+	cs, err := contentsignature.New(signer.Configuration{ID: "appkey1", Type: contentsignature.Type, PrivateKey: ecKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms, err := mar.New(signer.Configuration{ID: "testmar", Type: mar.Type, PrivateKey: ecKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entity, err := openpgp.NewEntity("autograph test", "", "test@example.net", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = entity.SerializePrivate(w, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	ps, err := pgp.New(signer.Configuration{ID: "pgpsubkey", Type: pgp.Type, PrivateKey: armored.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]signer.Signer{
+		cs.ID: cs,
+		ms.ID: ms,
+		ps.ID: ps,
+	}
+}
+
+func newTestClient(t *testing.T, f *fakeAutograph) (*Client, func()) {
+	srv := httptest.NewServer(f)
+	c, err := New(srv.URL+"/", testID, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RetryBackoff = time.Millisecond
+	return c, srv.Close
+}
+
+func TestSignAndVerify(t *testing.T) {
+	t.Parallel()
+
+	c, stop := newTestClient(t, &fakeAutograph{t: t, signers: newTestSigners(t)})
+	defer stop()
+	ctx := context.Background()
+	data := []byte("foobarbaz1234abcd")
+
+	for _, keyid := range []string{"appkey1", "testmar", "pgpsubkey"} {
+		resp, err := c.SignData(ctx, keyid, data, nil)
+		if err != nil {
+			t.Fatalf("%s: failed to sign data: %v", keyid, err)
+		}
+		err = VerifyData(data, *resp, nil)
+		if err != nil {
+			t.Fatalf("%s: failed to verify data signature: %v", keyid, err)
+		}
+		err = VerifyData([]byte("tampered"), *resp, nil)
+		if err == nil {
+			t.Fatalf("%s: expected the signature of other data to fail verification", keyid)
+		}
+	}
+
+	digest := sha512.Sum384(data)
+	resp, err := c.SignHash(ctx, "appkey1", digest[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = VerifyHash(digest[:], *resp, nil)
+	if err != nil {
+		t.Fatalf("failed to verify hash signature: %v", err)
+	}
+	otherDigest := sha1.Sum(data)
+	err = VerifyHash(otherDigest[:], *resp, nil)
+	if err == nil {
+		t.Fatal("expected the signature of another hash to fail verification")
+	}
+}
+
+func TestSignDataWithNonce(t *testing.T) {
+	t.Parallel()
+
+	c, stop := newTestClient(t, &fakeAutograph{t: t, signers: newTestSigners(t)})
+	defer stop()
+	data := []byte("foobarbaz1234abcd")
+	nonce := []byte("0123456789abcdef")
+	resp, err := c.SignDataWithNonce(context.Background(), "appkey1", data, nonce, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data with a nonce: %v", err)
+	}
+	err = VerifyData(data, *resp, &VerifyOptions{Nonce: nonce})
+	if err != nil {
+		t.Fatalf("failed to verify nonce bound signature: %v", err)
+	}
+	err = VerifyData(data, *resp, &VerifyOptions{Nonce: []byte("fedcba9876543210")})
+	if err == nil || !strings.Contains(err.Error(), "does not match the request nonce") {
+		t.Fatalf("expected verification with another nonce to fail, got %v", err)
+	}
+	resp.Nonce = ""
+	err = VerifyData(data, *resp, nil)
+	if err == nil {
+		t.Fatal("expected verification without the nonce to fail")
+	}
+}
+
+func TestCompressRequests(t *testing.T) {
+	t.Parallel()
+
+	f := &fakeAutograph{t: t, signers: newTestSigners(t)}
+	c, stop := newTestClient(t, f)
+	defer stop()
+	c.CompressRequests = true
+	data := []byte("foobarbaz1234abcd")
+	resp, err := c.SignData(context.Background(), "appkey1", data, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data with a compressed request: %v", err)
+	}
+	err = VerifyData(data, *resp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.compressed != 1 {
+		t.Fatalf("expected 1 compressed request, got %d", f.compressed)
+	}
+}
+
+// signingHandler signs the responses of h with an ES256 detached JWS
+type signingHandler struct {
+	h   http.Handler
+	key *ecdsa.PrivateKey
+}
+
+func (s signingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := httptest.NewRecorder()
+	s.h.ServeHTTP(rec, r)
+	protected := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256","kid":"test"}`))
+	digest := sha256.Sum256([]byte(protected + "." + base64.RawURLEncoding.EncodeToString(rec.Body.Bytes())))
+	r1, s1, err := ecdsa.Sign(rand.Reader, s.key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	sig := make([]byte, 64)
+	copy(sig[32-len(r1.Bytes()):32], r1.Bytes())
+	copy(sig[64-len(s1.Bytes()):], s1.Bytes())
+	w.Header().Set(formats.HeaderResponseSignature, protected+".."+base64.RawURLEncoding.EncodeToString(sig))
+	w.WriteHeader(rec.Code)
+	w.Write(rec.Body.Bytes())
+}
+
+func TestResponseSignatures(t *testing.T) {
+	t.Parallel()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeAutograph{t: t, signers: newTestSigners(t)}
+	srv := httptest.NewServer(signingHandler{f, key})
+	defer srv.Close()
+	c, err := New(srv.URL, testID, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.MaxRetries = 0
+	c.ResponseKey = &key.PublicKey
+	var proofs int
+	c.OnSignedResponse = func(endpoint string, body []byte, signature string) {
+		proofs++
+		err := VerifyResponseSignature(signature, body, &key.PublicKey)
+		if endpoint != EndpointData || err != nil {
+			t.Errorf("unexpected signed response of %s: %v", endpoint, err)
+		}
+	}
+	_, err = c.SignData(context.Background(), "appkey1", []byte("foobarbaz1234abcd"), nil)
+	if err != nil {
+		t.Fatalf("failed to sign data with a signed response: %v", err)
+	}
+	if proofs != 1 {
+		t.Fatalf("expected 1 signed response, got %d", proofs)
+	}
+
+	c.ResponseKey = &otherKey.PublicKey
+	_, err = c.SignData(context.Background(), "appkey1", []byte("foobarbaz1234abcd"), nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid response signature") {
+		t.Fatalf("expected response signed by another key to be refused, got %v", err)
+	}
+	unsigned, stop := newTestClient(t, f)
+	defer stop()
+	unsigned.MaxRetries = 0
+	unsigned.ResponseKey = &key.PublicKey
+	_, err = unsigned.SignData(context.Background(), "appkey1", []byte("foobarbaz1234abcd"), nil)
+	if err == nil || !strings.Contains(err.Error(), "is not signed") {
+		t.Fatalf("expected unsigned response to be refused, got %v", err)
+	}
+}
+
+func TestVerifyUnsupported(t *testing.T) {
+	t.Parallel()
+
+	err := VerifyFile(formats.SignatureResponse{Type: contentsignature.Type}, nil)
+	if errors.Cause(err) != ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+	err = VerifyHash(nil, formats.SignatureResponse{Type: pgp.Type}, nil)
+	if errors.Cause(err) != ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	t.Parallel()
+
+	signers := newTestSigners(t)
+	for i, testcase := range []struct {
+		failures   int
+		failStatus int
+		retriable  bool
+		requests   int
+		ok         bool
+	}{
+		// retriable errors are retried until the request succeeds
+		{failures: 2, failStatus: http.StatusServiceUnavailable, requests: 3, ok: true},
+		{failures: 1, failStatus: http.StatusInternalServerError, retriable: true, requests: 2, ok: true},
+		// or the client runs out of retries
+		{failures: 10, failStatus: http.StatusTooManyRequests, requests: DefaultMaxRetries + 1},
+		// other errors are not retried
+		{failures: 1, failStatus: http.StatusBadRequest, requests: 1},
+	} {
+		f := &fakeAutograph{
+			t:          t,
+			signers:    signers,
+			failures:   testcase.failures,
+			failStatus: testcase.failStatus,
+			retriable:  testcase.retriable,
+		}
+		c, stop := newTestClient(t, f)
+		_, err := c.SignData(context.Background(), "appkey1", []byte("foobarbaz1234abcd"), nil)
+		stop()
+		if testcase.ok && err != nil {
+			t.Fatalf("testcase %d: expected the request to succeed after retries, got %v", i, err)
+		}
+		if !testcase.ok {
+			apiErr, ok := err.(*Error)
+			if !ok || apiErr.StatusCode != testcase.failStatus || apiErr.RequestID != "req-1" {
+				t.Fatalf("testcase %d: expected a %d autograph error, got %v", i, testcase.failStatus, err)
+			}
+		}
+		if f.requests != testcase.requests {
+			t.Fatalf("testcase %d: expected %d requests, got %d", i, testcase.requests, f.requests)
+		}
+	}
+}
+
+func TestBadCredentials(t *testing.T) {
+	t.Parallel()
+
+	c, stop := newTestClient(t, &fakeAutograph{t: t, signers: newTestSigners(t)})
+	defer stop()
+	c.Key = "wrong"
+	_, err := c.SignData(context.Background(), "appkey1", []byte("foobarbaz1234abcd"), nil)
+	apiErr, ok := err.(*Error)
+	if !ok || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Code != formats.ErrorCodeUnauthorized {
+		t.Fatalf("expected an authorization error, got %v", err)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	t.Parallel()
+
+	for i, testcase := range []struct{ url, id, key string }{
+		{"ftp://autograph.example.net", testID, testKey},
+		{"://", testID, testKey},
+		{"https://autograph.example.net", "", testKey},
+		{"https://autograph.example.net", testID, ""},
+	} {
+		_, err := New(testcase.url, testcase.id, testcase.key)
+		if err == nil {
+			t.Fatalf("testcase %d: expected client initialization to fail", i)
+		}
+	}
+}
+
+func TestSignMARFileByHash(t *testing.T) {
+	t.Parallel()
+
+	signers := newTestSigners(t)
+	c, stop := newTestClient(t, &fakeAutograph{t: t, signers: signers})
+	defer stop()
+
+	unsigned := margo.New()
+	err := unsigned.AddContent([]byte("update manifest"), "update.manifest", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned.AddProductInfo("autograph test")
+	file, err := unsigned.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := parsePublicKey(signers["testmar"].Config().PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedFile, err := c.SignMARFileByHash(context.Background(), "testmar", file, pubKey)
+	if err != nil {
+		t.Fatalf("failed to sign mar file by hash: %v", err)
+	}
+	var signedMar margo.File
+	err = margo.Unmarshal(signedFile, &signedMar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = signedMar.VerifySignature(pubKey)
+	if err != nil {
+		t.Fatalf("failed to verify signed mar: %v", err)
+	}
+
+	// the signature header must match the key of the signer
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.SignMARFileByHash(context.Background(), "testmar", file, otherKey.Public())
+	if err == nil {
+		t.Fatal("expected signing with the wrong public key to fail")
+	}
+}
@@ -0,0 +1,105 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+
+	"github.com/pkg/errors"
+	margo "go.mozilla.org/mar"
+
+	"go.mozilla.org/autograph/signer/apk"
+	"go.mozilla.org/autograph/signer/mar"
+)
+
+// SignMARFileByHash signs a MAR file without uploading it. It hashes
+// the signable block of the file locally, has the signer keyid sign
+// the hash on /sign/hash and embeds the signature in the file.
+//
+// pubKey is the public key of the signer, which sets the size and
+// algorithm of the signature header that is part of the signed data.
+func (c *Client) SignMARFileByHash(ctx context.Context, keyid string, file []byte, pubKey crypto.PublicKey) ([]byte, error) {
+	marFile, hashed, err := mar.PrepareHash(file, pubKey)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.SignHash(ctx, keyid, hashed, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Type != mar.Type {
+		return nil, errors.Errorf("client: signer %q is of type %q, not %q", resp.SignerID, resp.Type, mar.Type)
+	}
+	err = checkPublicKey(resp.PublicKey, pubKey)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(resp.Signature)
+	if err != nil {
+		return nil, errors.Wrap(err, "client: failed to decode mar signature")
+	}
+	signedFile, err := mar.EmbedSignature(marFile, sig)
+	if err != nil {
+		return nil, err
+	}
+	var signedMar margo.File
+	err = margo.Unmarshal(signedFile, &signedMar)
+	if err != nil {
+		return nil, errors.Wrap(err, "client: failed to parse signed mar file")
+	}
+	err = signedMar.VerifySignature(pubKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "client: failed to verify signed mar file")
+	}
+	return signedFile, nil
+}
+
+// SignAPKFileByHash signs an APK with JAR signing (v1) without
+// uploading it. It computes the JAR manifest and signature file
+// locally, has the signer keyid sign the signature file on
+// /sign/data and inserts the detached PKCS#7 signature in the APK.
+func (c *Client) SignAPKFileByHash(ctx context.Context, keyid string, file []byte, options apk.Options) ([]byte, error) {
+	manifest, sigfile, err := apk.PrepareJAR(file)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.SignData(ctx, keyid, sigfile, options)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Type != apk.Type {
+		return nil, errors.Errorf("client: signer %q is of type %q, not %q", resp.SignerID, resp.Type, apk.Type)
+	}
+	sig, err := apk.Unmarshal(resp.Signature, sigfile)
+	if err != nil {
+		return nil, errors.Wrap(err, "client: failed to parse apk signature")
+	}
+	err = sig.Verify()
+	if err != nil {
+		return nil, errors.Wrap(err, "client: failed to verify apk signature")
+	}
+	return apk.AssembleJAR(file, manifest, sigfile, sig.Data, options)
+}
+
+// checkPublicKey returns an error when the base64 public key of a
+// signature response isn't the expected one
+func checkPublicKey(b64Key string, expected crypto.PublicKey) error {
+	keyBytes, err := base64.StdEncoding.DecodeString(b64Key)
+	if err != nil {
+		return errors.Wrap(err, "client: failed to decode public key")
+	}
+	expectedBytes, err := x509.MarshalPKIXPublicKey(expected)
+	if err != nil {
+		return errors.Wrap(err, "client: failed to marshal expected public key")
+	}
+	if !bytes.Equal(keyBytes, expectedBytes) {
+		return errors.New("client: signer public key does not match the expected public key")
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// VerifyResponseSignature verifies the detached JWS of an autograph
+// response body sent in the X-Autograph-Response-Signature header,
+// with the public key returned by the /response-signing-key endpoint
+func VerifyResponseSignature(signature string, body []byte, key crypto.PublicKey) error {
+	parts := strings.Split(signature, ".")
+	if len(parts) != 3 || parts[1] != "" {
+		return errors.New("client: response signature is not a detached JWS")
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errors.Wrap(err, "client: failed to decode response signature header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	err = json.Unmarshal(rawHeader, &header)
+	if err != nil {
+		return errors.Wrap(err, "client: failed to parse response signature header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.Wrap(err, "client: failed to decode response signature")
+	}
+	var hash crypto.Hash
+	switch header.Alg {
+	case "ES256", "RS256":
+		hash = crypto.SHA256
+	case "ES384":
+		hash = crypto.SHA384
+	case "ES512":
+		hash = crypto.SHA512
+	default:
+		return errors.Errorf("client: unsupported response signature algorithm %q", header.Alg)
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + base64.RawURLEncoding.EncodeToString(body)))
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *ecdsa.PublicKey:
+		size := (pub.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(header.Alg, "ES") || len(sig) != 2*size {
+			return errors.Errorf("client: response signature algorithm %q does not match the ECDSA key", header.Alg)
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("client: invalid response signature")
+		}
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return errors.Errorf("client: response signature algorithm %q does not match the RSA key", header.Alg)
+		}
+		err = rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		if err != nil {
+			return errors.New("client: invalid response signature")
+		}
+	default:
+		return errors.Errorf("client: unsupported response signing key type %T", key)
+	}
+	return nil
+}
@@ -0,0 +1,434 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package client
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	margo "go.mozilla.org/mar"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/openpgp"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/autograph/signer/apk"
+	"go.mozilla.org/autograph/signer/contentsignature"
+	"go.mozilla.org/autograph/signer/contentsignaturepki"
+	"go.mozilla.org/autograph/signer/genericrsa"
+	"go.mozilla.org/autograph/signer/gpg2"
+	"go.mozilla.org/autograph/signer/macos"
+	"go.mozilla.org/autograph/signer/mar"
+	"go.mozilla.org/autograph/signer/nullsigner"
+	"go.mozilla.org/autograph/signer/pgp"
+	"go.mozilla.org/autograph/signer/rsapss"
+	"go.mozilla.org/autograph/signer/sigstore"
+	"go.mozilla.org/autograph/signer/threshold"
+	"go.mozilla.org/autograph/signer/xpi"
+)
+
+// ErrUnsupported is returned when the client cannot verify signatures
+// of a signer type on an endpoint
+var ErrUnsupported = errors.New("client: verification is not supported for this signer type and endpoint")
+
+// VerifyOptions are the parameters of signature verification that
+// are not in signature responses
+type VerifyOptions struct {
+	// Roots are the trusted roots of xpi signatures. When nil,
+	// the signatures are checked but not their chain.
+	Roots *x509.CertPool
+
+	// XPI are the options the xpi file was signed with
+	XPI xpi.Options
+
+	// MARSigAlg is the algorithm mar data and hashes were signed
+	// with, the default algorithm of the signer key when zero
+	MARSigAlg uint32
+
+	// SigstoreRoots are the trusted Fulcio roots of sigstore
+	// bundles. When nil, the bundles are checked but not their
+	// certificate chain.
+	SigstoreRoots *x509.CertPool
+
+	// MacOSRoots are the trusted roots of macos disk images and
+	// installer packages. When nil, the signatures are checked but
+	// not their chain.
+	MacOSRoots *x509.CertPool
+
+	// ContentSignatureRoots are the trusted roots of the x5u
+	// chains of content signatures. When nil, the signatures are
+	// checked with the end-entity of the chain but not the chain.
+	ContentSignatureRoots *x509.CertPool
+
+	// Nonce is the nonce data was signed with by
+	// SignDataWithNonce. When set, the response must echo it.
+	Nonce []byte
+}
+
+// RootSetOptions returns verification options that pin the chains of
+// xpi, sigstore, macos and content signatures to a root set, like the
+// roots of the environment the signatures were made in
+func RootSetOptions(roots *signer.RootSet) *VerifyOptions {
+	return &VerifyOptions{
+		Roots:                 roots.Pool(),
+		SigstoreRoots:         roots.Pool(),
+		MacOSRoots:            roots.Pool(),
+		ContentSignatureRoots: roots.Pool(),
+	}
+}
+
+// VerifyData verifies the signature of data returned by the
+// /sign/data endpoint
+func VerifyData(data []byte, resp formats.SignatureResponse, opts *VerifyOptions) error {
+	if opts == nil {
+		opts = new(VerifyOptions)
+	}
+	var err error
+	if opts.Nonce != nil || resp.Nonce != "" {
+		// the signature covers the nonce bound data
+		nonce, err := base64.StdEncoding.DecodeString(resp.Nonce)
+		if err != nil {
+			return errors.Wrap(err, "client: failed to decode response nonce")
+		}
+		if opts.Nonce != nil && !bytes.Equal(nonce, opts.Nonce) {
+			return errors.New("client: response nonce does not match the request nonce")
+		}
+		data, err = signer.NonceBoundInput(nonce, data)
+		if err != nil {
+			return errors.Wrap(err, "client: invalid response nonce")
+		}
+	}
+	switch resp.Type {
+	case contentsignature.Type:
+		var pubKey *ecdsa.PublicKey
+		pubKey, err = parseECDSAPublicKey(resp.PublicKey)
+		if err != nil {
+			return err
+		}
+		var sig *contentsignature.ContentSignature
+		sig, err = contentsignature.Unmarshal(resp.Signature)
+		if err != nil {
+			return errors.Wrap(err, "client: failed to parse content signature")
+		}
+		if !sig.VerifyData(data, pubKey) {
+			err = errors.New("ecdsa signature verification failed")
+		}
+	case contentsignaturepki.Type:
+		var pubKey crypto.PublicKey
+		pubKey, err = contentSignaturePKIKey(resp, opts)
+		if err != nil {
+			return err
+		}
+		var sig *contentsignaturepki.ContentSignature
+		sig, err = contentsignaturepki.Unmarshal(resp.Signature)
+		if err != nil {
+			return errors.Wrap(err, "client: failed to parse content signature")
+		}
+		if !sig.VerifyData(data, pubKey) {
+			err = errors.Errorf("%s signature verification failed", keyAlgorithm(pubKey))
+		}
+	case xpi.Type:
+		var sig *xpi.Signature
+		sig, err = xpi.Unmarshal(resp.Signature, data)
+		if err != nil {
+			return errors.Wrap(err, "client: failed to parse xpi signature")
+		}
+		err = sig.VerifyWithChain(opts.Roots)
+	case apk.Type:
+		var sig *apk.Signature
+		sig, err = apk.Unmarshal(resp.Signature, data)
+		if err != nil {
+			return errors.Wrap(err, "client: failed to parse apk signature")
+		}
+		err = sig.Verify()
+	case mar.Type:
+		err = verifyMAR(data, false, resp, opts.MARSigAlg)
+	case genericrsa.Type:
+		err = genericrsa.VerifyGenericRsaSignatureResponse(data, resp)
+	case rsapss.Type:
+		digest := sha1.Sum(data)
+		err = rsapss.VerifySignatureFromB64(base64.StdEncoding.EncodeToString(digest[:]), resp.Signature, resp.PublicKey)
+	case pgp.Type, gpg2.Type:
+		err = verifyPGP(data, resp)
+	case threshold.Type:
+		err = threshold.VerifyData(data, resp.Signature, resp.PublicKey)
+	case nullsigner.Type:
+		err = nullsigner.VerifySignature(resp.SignerID, data, resp.Signature)
+	case sigstore.Type:
+		err = sigstore.VerifyData(data, resp.Signature, opts.SigstoreRoots)
+	default:
+		return errors.Wrapf(ErrUnsupported, "%s signer %q on %s", resp.Type, resp.SignerID, EndpointData)
+	}
+	return errors.Wrapf(err, "client: failed to verify %s data signature of signer %q", resp.Type, resp.SignerID)
+}
+
+// VerifyHash verifies the signature of a digest returned by the
+// /sign/hash endpoint
+func VerifyHash(digest []byte, resp formats.SignatureResponse, opts *VerifyOptions) error {
+	if opts == nil {
+		opts = new(VerifyOptions)
+	}
+	var err error
+	switch resp.Type {
+	case contentsignature.Type:
+		var pubKey *ecdsa.PublicKey
+		pubKey, err = parseECDSAPublicKey(resp.PublicKey)
+		if err != nil {
+			return err
+		}
+		var sig *contentsignature.ContentSignature
+		sig, err = contentsignature.Unmarshal(resp.Signature)
+		if err != nil {
+			return errors.Wrap(err, "client: failed to parse content signature")
+		}
+		if !sig.VerifyHash(digest, pubKey) {
+			err = errors.New("ecdsa signature verification failed")
+		}
+	case contentsignaturepki.Type:
+		var key crypto.PublicKey
+		key, err = contentSignaturePKIKey(resp, opts)
+		if err != nil {
+			return err
+		}
+		// ed25519 content signatures are made on the templated
+		// data, which the hash endpoint doesn't return
+		pubKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.Errorf("client: x5u end-entity has a %T public key, only ecdsa content signatures verify on a hash", key)
+		}
+		var sig *contentsignaturepki.ContentSignature
+		sig, err = contentsignaturepki.Unmarshal(resp.Signature)
+		if err != nil {
+			return errors.Wrap(err, "client: failed to parse content signature")
+		}
+		if !sig.VerifyHash(digest, pubKey) {
+			err = errors.New("ecdsa signature verification failed")
+		}
+	case mar.Type:
+		err = verifyMAR(digest, true, resp, opts.MARSigAlg)
+	case rsapss.Type:
+		err = rsapss.VerifySignatureFromB64(base64.StdEncoding.EncodeToString(digest), resp.Signature, resp.PublicKey)
+	case threshold.Type:
+		err = threshold.VerifySignature(digest, resp.Signature, resp.PublicKey)
+	case nullsigner.Type:
+		err = nullsigner.VerifySignature(resp.SignerID, digest, resp.Signature)
+	case sigstore.Type:
+		err = sigstore.VerifyHash(digest, resp.Signature, opts.SigstoreRoots)
+	default:
+		return errors.Wrapf(ErrUnsupported, "%s signer %q on %s", resp.Type, resp.SignerID, EndpointHash)
+	}
+	return errors.Wrapf(err, "client: failed to verify %s hash signature of signer %q", resp.Type, resp.SignerID)
+}
+
+// VerifyFile verifies the signed file returned by the /sign/file
+// endpoint
+func VerifyFile(resp formats.SignatureResponse, opts *VerifyOptions) error {
+	if opts == nil {
+		opts = new(VerifyOptions)
+	}
+	signedFile, err := base64.StdEncoding.DecodeString(resp.SignedFile)
+	if err != nil {
+		return errors.Wrap(err, "client: failed to decode signed file")
+	}
+	switch resp.Type {
+	case xpi.Type:
+		err = xpi.VerifySignedFile(signedFile, opts.Roots, opts.XPI)
+	case apk.Type:
+		err = verifyAPKFile(signedFile)
+	case mar.Type:
+		var marFile margo.File
+		err = margo.Unmarshal(signedFile, &marFile)
+		if err != nil {
+			return errors.Wrap(err, "client: failed to parse signed mar file")
+		}
+		var pubKey crypto.PublicKey
+		pubKey, err = parsePublicKey(resp.PublicKey)
+		if err != nil {
+			return err
+		}
+		err = marFile.VerifySignature(pubKey)
+	case macos.Type:
+		err = macos.VerifySignedFile(signedFile, resp.Mode, opts.MacOSRoots)
+	default:
+		return errors.Wrapf(ErrUnsupported, "%s signer %q on %s", resp.Type, resp.SignerID, EndpointFile)
+	}
+	return errors.Wrapf(err, "client: failed to verify %s signed file of signer %q", resp.Type, resp.SignerID)
+}
+
+// contentSignaturePKIKey returns the public key of the end-entity of
+// the x5u chain of a content signature response, once the chain is
+// checked against the content signature roots when they are set
+func contentSignaturePKIKey(resp formats.SignatureResponse, opts *VerifyOptions) (crypto.PublicKey, error) {
+	certs, err := contentsignaturepki.GetX5U(resp.X5U)
+	if err != nil {
+		return nil, errors.Wrap(err, "client: failed to get x5u chain")
+	}
+	if len(certs) < 1 {
+		return nil, errors.New("client: no certificate found in x5u")
+	}
+	if opts.ContentSignatureRoots != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err = certs[0].Verify(x509.VerifyOptions{
+			Roots:         opts.ContentSignatureRoots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "client: x5u chain does not chain to the content signature roots")
+		}
+	}
+	switch certs[0].PublicKey.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, errors.Errorf("client: x5u end-entity has a %T public key, not ecdsa or ed25519", certs[0].PublicKey)
+	}
+	return certs[0].PublicKey, nil
+}
+
+// keyAlgorithm returns the name of the signature algorithm of a content
+// signature public key
+func keyAlgorithm(pubKey crypto.PublicKey) string {
+	if _, ok := pubKey.(ed25519.PublicKey); ok {
+		return "ed25519"
+	}
+	return "ecdsa"
+}
+
+// parsePublicKey parses a base64 DER encoded PKIX public key
+func parsePublicKey(b64Key string) (crypto.PublicKey, error) {
+	keyBytes, err := base64.StdEncoding.DecodeString(b64Key)
+	if err != nil {
+		return nil, errors.Wrap(err, "client: failed to decode public key")
+	}
+	pubKey, err := x509.ParsePKIXPublicKey(keyBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "client: failed to parse public key")
+	}
+	return pubKey, nil
+}
+
+func parseECDSAPublicKey(b64Key string) (*ecdsa.PublicKey, error) {
+	pubKey, err := parsePublicKey(b64Key)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := pubKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("client: expected an ecdsa public key, got %T", pubKey)
+	}
+	return ecKey, nil
+}
+
+// verifyMAR verifies a mar signature of data, or of a hash of the
+// signable block of a mar file, with sigalg or the algorithm the mar
+// signer picks for its key when sigalg is zero
+func verifyMAR(input []byte, isHash bool, resp formats.SignatureResponse, sigalg uint32) error {
+	pubKey, err := parsePublicKey(resp.PublicKey)
+	if err != nil {
+		return err
+	}
+	if sigalg == 0 {
+		switch key := pubKey.(type) {
+		case *rsa.PublicKey:
+			sigalg = margo.SigAlgRsaPkcs1Sha384
+		case *ecdsa.PublicKey:
+			switch key.Params().Name {
+			case elliptic.P256().Params().Name:
+				sigalg = margo.SigAlgEcdsaP256Sha256
+			case elliptic.P384().Params().Name:
+				sigalg = margo.SigAlgEcdsaP384Sha384
+			default:
+				return errors.Errorf("client: unsupported mar elliptic curve %q", key.Params().Name)
+			}
+		default:
+			return errors.Errorf("client: unsupported mar public key type %T", pubKey)
+		}
+	}
+	sig, err := base64.StdEncoding.DecodeString(resp.Signature)
+	if err != nil {
+		return errors.Wrap(err, "client: failed to decode mar signature")
+	}
+	if !isHash {
+		return margo.VerifySignature(input, sig, sigalg, pubKey)
+	}
+	_, hashAlg, err := margo.Hash(nil, sigalg)
+	if err != nil {
+		return err
+	}
+	return margo.VerifyHashSignature(sig, input, hashAlg, pubKey)
+}
+
+// verifyPGP verifies an armored detached signature with the armored
+// public key of a pgp or gpg2 signer
+func verifyPGP(data []byte, resp formats.SignatureResponse) error {
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(resp.PublicKey))
+	if err != nil {
+		return errors.Wrap(err, "client: failed to read armored public key")
+	}
+	_, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(data), strings.NewReader(resp.Signature))
+	return err
+}
+
+// verifyAPKFile verifies the JAR signature of a signed APK
+func verifyAPKFile(signedAPK []byte) error {
+	r, err := zip.NewReader(bytes.NewReader(signedAPK), int64(len(signedAPK)))
+	if err != nil {
+		return errors.Wrap(err, "client: failed to read signed apk")
+	}
+	var (
+		sigstr  string
+		sigdata []byte
+	)
+	for _, f := range r.File {
+		switch f.Name {
+		case "META-INF/SIGNATURE.SF":
+			sigdata, err = readZipFile(f)
+			if err != nil {
+				return err
+			}
+		case "META-INF/SIGNATURE.RSA", "META-INF/SIGNATURE.DSA", "META-INF/SIGNATURE.EC":
+			var rawsig []byte
+			rawsig, err = readZipFile(f)
+			if err != nil {
+				return err
+			}
+			sigstr = base64.StdEncoding.EncodeToString(rawsig)
+		}
+	}
+	if sigstr == "" || sigdata == nil {
+		return errors.New("client: signed apk has no META-INF/SIGNATURE files")
+	}
+	sig, err := apk.Unmarshal(sigstr, sigdata)
+	if err != nil {
+		return errors.Wrap(err, "client: failed to parse apk signature")
+	}
+	return sig.Verify()
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, errors.Wrapf(err, "client: failed to open %s", f.Name)
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "client: failed to read %s", f.Name)
+	}
+	return data, nil
+}
@@ -0,0 +1,139 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+// defaultMaxDecompressedBodySize is the maximum size in bytes of a
+// decompressed request body when the server does not configure one,
+// the same as the maximum size of an uncompressed body
+const defaultMaxDecompressedBodySize = defaultMaxBodySize
+
+// decodeRequestBody returns the body of a request decoded from its
+// gzip or brotli Content-Encoding. It writes an error to the client
+// and returns false when the encoding is unsupported, the body is
+// invalid or it decompresses to more than the configured maximum.
+func (a *autographer) decodeRequestBody(w http.ResponseWriter, r *http.Request, body []byte) ([]byte, bool) {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == signer.EncodingIdentity {
+		return body, true
+	}
+	maxSize := a.decompressLimit
+	if maxSize <= 0 {
+		maxSize = defaultMaxDecompressedBodySize
+	}
+	decoded, err := signer.Decompress(body, encoding, maxSize)
+	switch errors.Cause(err) {
+	case nil:
+		return decoded, true
+	case signer.ErrDecompressedTooLarge:
+		httpError(w, r, http.StatusRequestEntityTooLarge, formats.ErrorCodeRequestTooLarge, "request body decompresses to more than %d bytes", maxSize)
+	default:
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "failed to decode %s request body: %v", encoding, err)
+	}
+	return nil, false
+}
+
+// acceptsGzip returns whether an Accept-Encoding header accepts gzip,
+// listed explicitly or with a wildcard, with a non-zero quality
+func acceptsGzip(acceptEncoding string) bool {
+	wildcard := false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding != signer.EncodingGzip && coding != "*" {
+			continue
+		}
+		accepted := true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[len("q="):], 64)
+				accepted = err == nil && q > 0
+			}
+		}
+		if coding == signer.EncodingGzip {
+			return accepted
+		}
+		wildcard = accepted
+	}
+	return wildcard
+}
+
+// gzipResponseWriter compresses the body written by a handler
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	h := g.Header()
+	// bodyless responses and bodies encoded by the handler are
+	// sent as is
+	if status != http.StatusNoContent && status != http.StatusNotModified && h.Get("Content-Encoding") == "" {
+		h.Set("Content-Encoding", signer.EncodingGzip)
+		h.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz == nil {
+		return g.ResponseWriter.Write(data)
+	}
+	return g.gz.Write(data)
+}
+
+// Flush sends the data compressed so far to the client
+func (g *gzipResponseWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipResponseWriter) close() {
+	if g.gz != nil {
+		g.gz.Close()
+	}
+}
+
+// compressResponses is a middleware that gzips the responses of
+// clients that send an Accept-Encoding header accepting gzip
+func compressResponses() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			gw := &gzipResponseWriter{ResponseWriter: w}
+			defer gw.close()
+			h.ServeHTTP(gw, r)
+		})
+	}
+}
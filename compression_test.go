@@ -0,0 +1,156 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gz.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCompressedRequestsAndResponses(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(100)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	tmpag.decompressLimit = 4096
+	err := tmpag.addSigners([]signer.Configuration{conf.Signers[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := authorization{
+		ID:      "gzipuser",
+		Key:     "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+		Signers: []string{conf.Signers[0].ID},
+	}
+	err = tmpag.addAuthorizations([]authorization{auth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := compressResponses()(http.HandlerFunc(tmpag.handleSignature))
+
+	sign := func(body, sentBody []byte, encoding, acceptEncoding string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(sentBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", encoding)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		// the payload hash covers the decompressed body
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	body, err := json.Marshal([]formats.SignatureRequest{{Input: "Y2FyaWJvdW1hdXJpY2UK"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sign(body, gzipBytes(t, body), "gzip", "br;q=1.0, gzip;q=0.8")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected a gzip request to be signed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("expected a gzip response, got headers %v", w.Header())
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	respBody, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resps []formats.SignatureResponse
+	err = json.Unmarshal(respBody, &resps)
+	if err != nil || len(resps) != 1 {
+		t.Fatalf("failed to parse the decompressed response %q: %v", respBody, err)
+	}
+	err = verifyContentSignature("Y2FyaWJvdW1hdXJpY2UK", "/sign/data", resps[0].Signature, resps[0].PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// clients that don't accept gzip get uncompressed responses
+	w = sign(body, gzipBytes(t, body), "gzip", "gzip;q=0")
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("expected an uncompressed response, got %d %v", w.Code, w.Header())
+	}
+
+	// the payload hash of the compressed body is rejected
+	compressed := gzipBytes(t, body)
+	w = sign(compressed, compressed, "gzip", "")
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a hash of the compressed body to be rejected, got %d", w.Code)
+	}
+
+	// bodies that decompress beyond the limit are rejected
+	largeBody, err := json.Marshal([]formats.SignatureRequest{{Input: strings.Repeat("A", 8192)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = sign(largeBody, gzipBytes(t, largeBody), "gzip", "")
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected a decompression bomb to be rejected, got %d: %s", w.Code, w.Body.String())
+	}
+	w = sign(body, body, "gzip", "")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected an invalid gzip body to be rejected, got %d", w.Code)
+	}
+	w = sign(body, body, "compress", "")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected an unsupported encoding to be rejected, got %d", w.Code)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	t.Parallel()
+
+	for _, testcase := range []struct {
+		header   string
+		expected bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, GZIP", true},
+		{"br;q=1.0, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.000", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"*, gzip;q=0", false},
+		{"identity", false},
+	} {
+		if acceptsGzip(testcase.header) != testcase.expected {
+			t.Fatalf("expected acceptsGzip(%q) to be %t", testcase.header, testcase.expected)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"go.mozilla.org/autograph/formats"
+)
+
+// userLimiter caps the number of requests each user can have in
+// flight at once, so one client cannot take all the signing capacity
+type userLimiter struct {
+	sync.Mutex
+	limits   map[string]int
+	inflight map[string]int
+}
+
+func newUserLimiter() *userLimiter {
+	return &userLimiter{
+		limits:   make(map[string]int),
+		inflight: make(map[string]int),
+	}
+}
+
+// setLimit caps the in-flight requests of a user. A limit of zero
+// means unlimited.
+func (l *userLimiter) setLimit(userid string, limit int) {
+	l.Lock()
+	defer l.Unlock()
+	if limit <= 0 {
+		delete(l.limits, userid)
+		return
+	}
+	l.limits[userid] = limit
+}
+
+// acquire reserves an in-flight slot for a user and returns false
+// when the user already reached their limit
+func (l *userLimiter) acquire(userid string) bool {
+	l.Lock()
+	defer l.Unlock()
+	limit, ok := l.limits[userid]
+	if ok && l.inflight[userid] >= limit {
+		return false
+	}
+	l.inflight[userid]++
+	return true
+}
+
+// release frees an in-flight slot reserved by acquire
+func (l *userLimiter) release(userid string) {
+	l.Lock()
+	defer l.Unlock()
+	l.inflight[userid]--
+	if l.inflight[userid] <= 0 {
+		delete(l.inflight, userid)
+	}
+}
+
+// acquireUserSlot reserves an in-flight request slot for an
+// authenticated user. It writes a 429 error to the client and returns
+// false when the user has too many requests in flight, otherwise
+// callers must call the returned release func when they are done.
+func (a *autographer) acquireUserSlot(w http.ResponseWriter, r *http.Request, userid string) (release func(), ok bool) {
+	if !a.userLimits.acquire(userid) {
+		if a.stats != nil {
+			sendStatsErr := a.stats.Incr("user_concurrency_limited", []string{"user:" + userid}, 1.0)
+			if sendStatsErr != nil {
+				log.Warnf("Error sending user_concurrency_limited: %s", sendStatsErr)
+			}
+		}
+		w.Header().Set("Retry-After", "1")
+		httpError(w, r, http.StatusTooManyRequests, formats.ErrorCodeTooManyRequests,
+			"user %q has too many requests in flight", userid)
+		return nil, false
+	}
+	return func() { a.userLimits.release(userid) }, true
+}
@@ -0,0 +1,87 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+func TestUserConcurrencyLimit(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(100)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners([]signer.Configuration{conf.Signers[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := authorization{
+		ID:                    "limiteduser",
+		Key:                   "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+		Signers:               []string{conf.Signers[0].ID},
+		MaxConcurrentRequests: 1,
+	}
+	err = tmpag.addAuthorizations([]authorization{auth})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func() *httptest.ResponseRecorder {
+		body, err := json.Marshal([]formats.SignatureRequest{{Input: "Y2FyaWJvdW1hdXJpY2UK"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		tmpag.handleSignature(w, req)
+		return w
+	}
+
+	// hold the only slot of the user as if a request was in flight
+	if !tmpag.userLimits.acquire(auth.ID) {
+		t.Fatal("expected to acquire the first slot")
+	}
+	w := sign()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429 but got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("expected a Retry-After header")
+	}
+	var errResp formats.ErrorResponse
+	err = json.Unmarshal(w.Body.Bytes(), &errResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errResp.Code != formats.ErrorCodeTooManyRequests || !errResp.Retriable {
+		t.Fatalf("expected a retriable %q error, got %+v", formats.ErrorCodeTooManyRequests, errResp)
+	}
+
+	tmpag.userLimits.release(auth.ID)
+	w = sign()
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected request to pass once the slot is released, got %d: %s", w.Code, w.Body.String())
+	}
+	tmpag.userLimits.Lock()
+	inflight := tmpag.userLimits.inflight[auth.ID]
+	tmpag.userLimits.Unlock()
+	if inflight != 0 {
+		t.Fatalf("expected the slot to be released after the request, got %d in flight", inflight)
+	}
+}
@@ -0,0 +1,259 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+// configAuditConfig enables the audit of signer configuration changes
+type configAuditConfig struct {
+	// Enabled compares the signer configuration with the one seen
+	// by the last instance that started, and sends an audit event
+	// for each signer added, removed or changed
+	Enabled bool
+}
+
+// signerConfigStore stores the last seen configuration of each signer.
+// It is implemented by the database handler.
+type signerConfigStore interface {
+	ListSignerConfigs(ctx context.Context) ([]database.SignerConfig, error)
+	SaveSignerConfigs(ctx context.Context, configs []database.SignerConfig, removed []string) error
+}
+
+// secretFieldNames are substrings of the names of configuration fields
+// whose values are replaced by their fingerprint
+var secretFieldNames = []string{"priv", "passphrase", "password", "secret"}
+
+// enableConfigAudit audits the changes of the configuration of signers
+// against the database, when the configuration enables it
+func (a *autographer) enableConfigAudit(conf configAuditConfig, role string, signerConfs []signer.Configuration) error {
+	if !conf.Enabled {
+		return nil
+	}
+	if a.db == nil {
+		return errors.New("the signer configuration audit requires a database")
+	}
+	if role == roleFrontend {
+		return errors.New("the signer configuration audit runs on workers, frontends have no signers")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return a.auditSignerConfigs(ctx, a.db, signerConfs)
+}
+
+// auditSignerConfigs compares the configuration of signers with the
+// last one saved in the store, sends an audit event for each signer
+// added, removed or changed, then saves the new configuration
+func (a *autographer) auditSignerConfigs(ctx context.Context, store signerConfigStore, confs []signer.Configuration) error {
+	saved, err := store.ListSignerConfigs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to load signer configurations")
+	}
+	previous := make(map[string]map[string]string)
+	for _, c := range saved {
+		previous[c.SignerID] = c.Fields
+	}
+	current := make(map[string]map[string]string)
+	var configs []database.SignerConfig
+	for _, conf := range confs {
+		fields := flattenSignerConfig(conf)
+		current[conf.ID] = fields
+		configs = append(configs, database.SignerConfig{SignerID: conf.ID, Fields: fields})
+	}
+	changes := diffSignerConfigs(previous, current)
+	var removed []string
+	for _, signerID := range sortedKeys(changes) {
+		change := changes[signerID]
+		if change.Change == "removed" {
+			removed = append(removed, signerID)
+		}
+		a.signerConfigChanged(signerID, change)
+	}
+	if len(changes) == 0 {
+		log.Infof("signer configuration unchanged since the last start")
+	}
+	err = store.SaveSignerConfigs(ctx, configs, removed)
+	if err != nil {
+		return errors.Wrap(err, "failed to save signer configurations")
+	}
+	return nil
+}
+
+// signerConfigChanged logs the change of the configuration of a signer
+// and sends it as an audit event
+func (a *autographer) signerConfigChanged(signerID string, change formats.SignerConfigChange) {
+	var fields []string
+	for _, f := range change.Fields {
+		fields = append(fields, f.Field)
+	}
+	message := fmt.Sprintf("signer %s", change.Change)
+	if len(fields) > 0 {
+		message += ": " + strings.Join(fields, ", ")
+	}
+	log.WithFields(log.Fields{
+		"signer_id": signerID,
+		"change":    change.Change,
+		"fields":    change.Fields,
+	}).Warn("signer configuration changed")
+	a.exportEvent(formats.ExportedEvent{
+		Type:         formats.EventTypeAudit,
+		SignerID:     signerID,
+		Action:       formats.AuditActionSignerConfigChanged,
+		Message:      message,
+		ConfigChange: &change,
+	})
+}
+
+// diffSignerConfigs returns the changes between two sets of flattened
+// signer configurations, indexed by signer ID
+func diffSignerConfigs(previous, current map[string]map[string]string) map[string]formats.SignerConfigChange {
+	changes := make(map[string]formats.SignerConfigChange)
+	for signerID, fields := range current {
+		old, ok := previous[signerID]
+		if !ok {
+			changes[signerID] = formats.SignerConfigChange{Change: "added", Fields: diffFields(nil, fields)}
+			continue
+		}
+		diff := diffFields(old, fields)
+		if len(diff) > 0 {
+			changes[signerID] = formats.SignerConfigChange{Change: "changed", Fields: diff}
+		}
+	}
+	for signerID, fields := range previous {
+		if _, ok := current[signerID]; !ok {
+			changes[signerID] = formats.SignerConfigChange{Change: "removed", Fields: diffFields(fields, nil)}
+		}
+	}
+	return changes
+}
+
+// diffFields returns the fields that differ between two flattened
+// configurations, sorted by name
+func diffFields(old, current map[string]string) (diff []formats.ConfigFieldChange) {
+	names := make(map[string]bool)
+	for name := range old {
+		names[name] = true
+	}
+	for name := range current {
+		names[name] = true
+	}
+	for _, name := range sortedKeys(names) {
+		if old[name] != current[name] {
+			diff = append(diff, formats.ConfigFieldChange{Field: name, Old: old[name], New: current[name]})
+		}
+	}
+	return diff
+}
+
+// flattenSignerConfig returns the fields of a signer configuration set
+// to a non-zero value, named by their yaml path like "x5u" or
+// "channels.0.name". Secrets are replaced by their fingerprint.
+func flattenSignerConfig(conf signer.Configuration) map[string]string {
+	fields := make(map[string]string)
+	flattenValue("", reflect.ValueOf(conf), fields)
+	return fields
+}
+
+// flattenValue adds the non-zero fields of v under prefix to fields
+func flattenValue(prefix string, v reflect.Value, fields map[string]string) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			flattenValue(prefix, v.Elem(), fields)
+		}
+		return
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			break
+		}
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name := configFieldName(field)
+			if name == "" {
+				continue
+			}
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			flattenValue(name, v.Field(i), fields)
+		}
+		return
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			break
+		}
+		for i := 0; i < v.Len(); i++ {
+			flattenValue(fmt.Sprintf("%s.%d", prefix, i), v.Index(i), fields)
+		}
+		return
+	case reflect.Map:
+		keys := v.MapKeys()
+		for _, key := range keys {
+			flattenValue(fmt.Sprintf("%s.%v", prefix, key.Interface()), v.MapIndex(key), fields)
+		}
+		return
+	case reflect.Func, reflect.Chan:
+		return
+	}
+	if reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface()) {
+		return
+	}
+	value := fmt.Sprint(v.Interface())
+	if isSecretField(prefix) {
+		sum := sha256.Sum256([]byte(value))
+		value = "sha256:" + hex.EncodeToString(sum[:8])
+	}
+	fields[prefix] = value
+}
+
+// configFieldName returns the yaml name of an exported configuration
+// field, or an empty string for fields that aren't configured, like
+// the database handler of signers
+func configFieldName(field reflect.StructField) string {
+	if field.PkgPath != "" || field.Tag.Get("json") == "-" {
+		return ""
+	}
+	if name := strings.Split(field.Tag.Get("yaml"), ",")[0]; name != "" {
+		return name
+	}
+	return strings.ToLower(field.Name)
+}
+
+// isSecretField returns whether the last element of a field path names
+// a secret
+func isSecretField(path string) bool {
+	name := path[strings.LastIndex(path, ".")+1:]
+	for _, secret := range secretFieldNames {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the keys of a map with string keys in order
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -29,7 +29,13 @@ func addToContext(r *http.Request, key contextKey, value interface{}) *http.Requ
 
 // getRequestID retrieves an ID from the request context, or returns "-" is none is found
 func getRequestID(r *http.Request) string {
-	val, ok := r.Context().Value(contextKeyRequestID).(string)
+	return requestIDFromContext(r.Context())
+}
+
+// requestIDFromContext retrieves a request ID from a context derived
+// from the request context, or returns "-" is none is found
+func requestIDFromContext(ctx context.Context) string {
+	val, ok := ctx.Value(contextKeyRequestID).(string)
 	if ok {
 		return val
 	}
@@ -0,0 +1,48 @@
+package database // import "go.mozilla.org/autograph/database"
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrAddOnVersionNotFound is returned when a signer has never
+	// signed an add-on ID
+	ErrAddOnVersionNotFound = errors.New("no signed version found for add-on")
+)
+
+// GetSignedAddOnVersion returns the highest version of an add-on ID
+// signed by a signer
+func (db *Handler) GetSignedAddOnVersion(ctx context.Context, signerID, addonID string) (version string, err error) {
+	err = db.traced(ctx, func(q queryer) error {
+		return q.QueryRowContext(ctx, `SELECT version FROM signed_addon_versions
+				WHERE signer_id=$1 AND addon_id=$2`,
+			signerID, addonID).Scan(&version)
+	})
+	if err == sql.ErrNoRows {
+		return "", ErrAddOnVersionNotFound
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get signed add-on version from database")
+	}
+	return version, nil
+}
+
+// SetSignedAddOnVersion records the highest version of an add-on ID
+// signed by a signer. Callers are responsible for only recording
+// versions higher than the current one.
+func (db *Handler) SetSignedAddOnVersion(ctx context.Context, signerID, addonID, version string) error {
+	err := db.traced(ctx, func(q queryer) error {
+		_, err := q.ExecContext(ctx, `INSERT INTO signed_addon_versions(signer_id, addon_id, version)
+				VALUES ($1, $2, $3)
+				ON CONFLICT (signer_id, addon_id) DO UPDATE SET version=EXCLUDED.version, signed_at=NOW()`,
+			signerID, addonID, version)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to set signed add-on version in database")
+	}
+	return nil
+}
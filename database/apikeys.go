@@ -0,0 +1,34 @@
+package database // import "go.mozilla.org/autograph/database"
+
+import (
+	"context"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// APIKey is a static API key and the signers it can use
+type APIKey struct {
+	ID string
+	// KeyHash is the lowercase hex SHA256 hash of the key
+	KeyHash string
+	Signers []string
+}
+
+// ListAPIKeys returns the static API keys
+func (db *Handler) ListAPIKeys(ctx context.Context) (keys []APIKey, err error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, key_hash, signers FROM api_keys ORDER BY id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list api keys from database")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k APIKey
+		err = rows.Scan(&k.ID, &k.KeyHash, pq.Array(&k.Signers))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read api key from database")
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,89 @@
+package database // import "go.mozilla.org/autograph/database"
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SignedArtifact is the registry record of a file signed by autograph
+type SignedArtifact struct {
+	ID       int64
+	Ref      string
+	SignerID string
+	UserID   string
+	// Name is the artifact name supplied by the client, or the
+	// path of the file in a signed archive
+	Name string
+	// InputDigest and OutputDigest are the lowercase hex SHA256
+	// digests of the unsigned and signed files
+	InputDigest  string
+	OutputDigest string
+	CreatedAt    time.Time
+	// Metadata is the metadata the client attached to the
+	// signature request
+	Metadata map[string]string
+}
+
+// InsertSignedArtifact adds a signed file to the registry
+func (db *Handler) InsertSignedArtifact(ctx context.Context, a SignedArtifact) error {
+	err := db.traced(ctx, func(q queryer) error {
+		metadata, err := json.Marshal(a.Metadata)
+		if err != nil {
+			return err
+		}
+		if a.Metadata == nil {
+			metadata = []byte("{}")
+		}
+		_, err = q.ExecContext(ctx, `INSERT INTO signed_artifacts(ref, signer_id, user_id, name,
+				input_digest, output_digest, metadata)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			a.Ref, a.SignerID, a.UserID, a.Name, a.InputDigest, a.OutputDigest, string(metadata))
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to insert signed artifact in database")
+	}
+	return nil
+}
+
+// FindSignedArtifacts returns the latest signed files whose input or
+// output digest is digest, or whose name is name. Empty arguments are
+// ignored, but at least one must be set.
+func (db *Handler) FindSignedArtifacts(ctx context.Context, digest, name string, limit int) (artifacts []SignedArtifact, err error) {
+	if digest == "" && name == "" {
+		return nil, errors.New("a digest or a name is required to find signed artifacts")
+	}
+	rows, err := db.QueryContext(ctx, `SELECT id, ref, signer_id, user_id, name, input_digest,
+				output_digest, created_at, metadata
+				FROM signed_artifacts
+				WHERE ($1 = '' OR input_digest=$1 OR output_digest=$1)
+				AND ($2 = '' OR name=$2)
+				ORDER BY created_at DESC LIMIT $3`, digest, name, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find signed artifacts in database")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			a        SignedArtifact
+			metadata string
+		)
+		err = rows.Scan(&a.ID, &a.Ref, &a.SignerID, &a.UserID, &a.Name, &a.InputDigest,
+			&a.OutputDigest, &a.CreatedAt, &metadata)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read signed artifact from database")
+		}
+		err = json.Unmarshal([]byte(metadata), &a.Metadata)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse metadata of signed artifact %q", a.Ref)
+		}
+		if len(a.Metadata) == 0 {
+			a.Metadata = nil
+		}
+		artifacts = append(artifacts, a)
+	}
+	return artifacts, rows.Err()
+}
@@ -0,0 +1,184 @@
+package database // import "go.mozilla.org/autograph/database"
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EndEntity is a row of the endentities table: the label and HSM
+// handle of an end-entity key, never the key itself
+type EndEntity struct {
+	Label        string
+	HSMHandle    int64
+	SignerID     string
+	IsCurrent    bool
+	X5U          string
+	CreatedAt    time.Time
+	RolledBackAt *time.Time
+}
+
+// BackupData is the signer state of the database that is backed up
+// for disaster recovery: end-entities, recorded requests and the
+// last seen signer configurations, whose secrets are fingerprints
+type BackupData struct {
+	EndEntities      []EndEntity
+	RecordedRequests []RecordedRequest
+	SignerConfigs    []SignerConfig
+}
+
+// RestoreCounts are the rows a restore inserted or updated in each
+// table. Rows already in the database are skipped.
+type RestoreCounts struct {
+	EndEntities      int64
+	RecordedRequests int64
+	SignerConfigs    int64
+}
+
+// Backup reads the signer state of the database in a single read-only
+// transaction, so it is consistent while instances keep writing
+func (db *Handler) Backup(ctx context.Context) (data BackupData, err error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return data, errors.Wrap(err, "failed to begin backup transaction")
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT label, hsm_handle, signer_id, is_current, COALESCE(x5u, ''),
+				created_at, rolled_back_at
+				FROM endentities ORDER BY id`)
+	if err != nil {
+		return data, errors.Wrap(err, "failed to back up end-entities")
+	}
+	for rows.Next() {
+		var ee EndEntity
+		err = rows.Scan(&ee.Label, &ee.HSMHandle, &ee.SignerID, &ee.IsCurrent, &ee.X5U, &ee.CreatedAt, &ee.RolledBackAt)
+		if err != nil {
+			rows.Close()
+			return data, errors.Wrap(err, "failed to read end-entity from database")
+		}
+		data.EndEntities = append(data.EndEntities, ee)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return data, errors.Wrap(err, "failed to back up end-entities")
+	}
+
+	rows, err = tx.QueryContext(ctx, `SELECT id, ref, request_id, signer_id, user_id, endpoint, input_hash,
+				input_length, options, output_hash, status, duration_ms, created_at
+				FROM recorded_requests ORDER BY id`)
+	if err != nil {
+		return data, errors.Wrap(err, "failed to back up recorded requests")
+	}
+	for rows.Next() {
+		var rec RecordedRequest
+		err = rows.Scan(&rec.ID, &rec.Ref, &rec.RequestID, &rec.SignerID, &rec.UserID, &rec.Endpoint, &rec.InputHash,
+			&rec.InputLength, &rec.Options, &rec.OutputHash, &rec.Status, &rec.DurationMS, &rec.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return data, errors.Wrap(err, "failed to read recorded request from database")
+		}
+		data.RecordedRequests = append(data.RecordedRequests, rec)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return data, errors.Wrap(err, "failed to back up recorded requests")
+	}
+
+	rows, err = tx.QueryContext(ctx, `SELECT signer_id, fields, updated_at
+				FROM signer_configs ORDER BY signer_id`)
+	if err != nil {
+		return data, errors.Wrap(err, "failed to back up signer configurations")
+	}
+	for rows.Next() {
+		var (
+			c      SignerConfig
+			fields string
+		)
+		err = rows.Scan(&c.SignerID, &fields, &c.UpdatedAt)
+		if err != nil {
+			rows.Close()
+			return data, errors.Wrap(err, "failed to read signer configuration from database")
+		}
+		err = json.Unmarshal([]byte(fields), &c.Fields)
+		if err != nil {
+			rows.Close()
+			return data, errors.Wrapf(err, "failed to parse configuration of signer %q from database", c.SignerID)
+		}
+		data.SignerConfigs = append(data.SignerConfigs, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return data, errors.Wrap(err, "failed to back up signer configurations")
+	}
+	return data, nil
+}
+
+// Restore inserts backed up signer state in the database in a single
+// transaction, keeping the original creation times. End-entities and
+// recorded requests already in the database, matched by their label
+// and ref, are skipped, so restoring a backup twice is harmless, and
+// signer configurations are replaced by the backed up ones.
+func (db *Handler) Restore(ctx context.Context, data BackupData) (counts RestoreCounts, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return counts, errors.Wrap(err, "failed to begin restore transaction")
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	for _, ee := range data.EndEntities {
+		var x5u interface{}
+		if ee.X5U != "" {
+			x5u = ee.X5U
+		}
+		res, err := tx.ExecContext(ctx, `INSERT INTO endentities(label, hsm_handle, signer_id, is_current, x5u,
+				created_at, rolled_back_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)
+				ON CONFLICT (label) DO NOTHING`,
+			ee.Label, ee.HSMHandle, ee.SignerID, ee.IsCurrent, x5u, ee.CreatedAt, ee.RolledBackAt)
+		if err != nil {
+			return counts, errors.Wrapf(err, "failed to restore end-entity %q", ee.Label)
+		}
+		n, _ := res.RowsAffected()
+		counts.EndEntities += n
+	}
+	for _, rec := range data.RecordedRequests {
+		res, err := tx.ExecContext(ctx, `INSERT INTO recorded_requests(ref, request_id, signer_id, user_id,
+				endpoint, input_hash, input_length, options, output_hash, status, duration_ms, created_at)
+				SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12
+				WHERE NOT EXISTS (SELECT 1 FROM recorded_requests WHERE ref=$1)`,
+			rec.Ref, rec.RequestID, rec.SignerID, rec.UserID, rec.Endpoint, rec.InputHash,
+			rec.InputLength, rec.Options, rec.OutputHash, rec.Status, rec.DurationMS, rec.CreatedAt)
+		if err != nil {
+			return counts, errors.Wrapf(err, "failed to restore recorded request %q", rec.Ref)
+		}
+		n, _ := res.RowsAffected()
+		counts.RecordedRequests += n
+	}
+	for _, c := range data.SignerConfigs {
+		fields, err := json.Marshal(c.Fields)
+		if err != nil {
+			return counts, errors.Wrapf(err, "failed to marshal configuration of signer %q", c.SignerID)
+		}
+		res, err := tx.ExecContext(ctx, `INSERT INTO signer_configs(signer_id, fields, updated_at)
+				VALUES ($1, $2, $3)
+				ON CONFLICT (signer_id) DO UPDATE SET fields=EXCLUDED.fields, updated_at=EXCLUDED.updated_at`,
+			c.SignerID, string(fields), c.UpdatedAt)
+		if err != nil {
+			return counts, errors.Wrapf(err, "failed to restore configuration of signer %q", c.SignerID)
+		}
+		n, _ := res.RowsAffected()
+		counts.SignerConfigs += n
+	}
+	err = tx.Commit()
+	if err != nil {
+		return counts, errors.Wrap(err, "failed to commit restore transaction")
+	}
+	return counts, nil
+}
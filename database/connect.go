@@ -9,7 +9,6 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"go.mozilla.org/mozlogrus"
 
 	// lib/pq is the postgres driver
 	_ "github.com/lib/pq"
@@ -17,14 +16,17 @@ import (
 	"github.com/pkg/errors"
 )
 
-func init() {
-	// initialize the logger
-	mozlogrus.Enable("autograph")
-}
-
 // Handler handles a database connection
 type Handler struct {
 	*sql.DB
+
+	// applicationName is the name database sessions report, and
+	// the prefix of the names of traced requests
+	applicationName string
+
+	// traceQueries runs the queries of traced requests in a
+	// transaction that reports the trace in its application name
+	traceQueries bool
 }
 
 // Transaction owns a sql transaction
@@ -44,11 +46,22 @@ type Config struct {
 	MaxOpenConns        int
 	MaxIdleConns        int
 	MonitorPollInterval time.Duration
+
+	// ApplicationName is the application_name of database
+	// sessions, "autograph" by default. Transactions of signing
+	// requests report it with the request and trace IDs, like
+	// "autograph:<request id>:<trace id>", and so do the other
+	// queries of signing requests when TraceQueries is set.
+	ApplicationName string
+	TraceQueries    bool
 }
 
 // Connect creates a database connection and returns a handler
 func Connect(config Config) (*Handler, error) {
 	var dsn string
+	if config.ApplicationName == "" {
+		config.ApplicationName = defaultApplicationName
+	}
 	if os.Getenv("AUTOGRAPH_DB_DSN") != "" {
 		dsn = os.Getenv("AUTOGRAPH_DB_DSN")
 	} else {
@@ -56,8 +69,9 @@ func Connect(config Config) (*Handler, error) {
 		if config.SSLMode == "" {
 			config.SSLMode = "disable"
 		}
-		dsn = fmt.Sprintf("postgres://%s@%s/%s?sslmode=%s&sslrootcert=%s",
-			userPass.String(), config.Host, config.Name, config.SSLMode, config.SSLRootCert)
+		dsn = fmt.Sprintf("postgres://%s@%s/%s?sslmode=%s&sslrootcert=%s&application_name=%s",
+			userPass.String(), config.Host, config.Name, config.SSLMode, config.SSLRootCert,
+			url.QueryEscape(config.ApplicationName))
 	}
 	dbfd, err := sql.Open("postgres", dsn)
 	if err != nil {
@@ -69,7 +83,11 @@ func Connect(config Config) (*Handler, error) {
 	if config.MaxIdleConns > 0 {
 		dbfd.SetMaxIdleConns(config.MaxIdleConns)
 	}
-	h := &Handler{dbfd}
+	h := &Handler{
+		DB:              dbfd,
+		applicationName: config.ApplicationName,
+		traceQueries:    config.TraceQueries,
+	}
 	dbCheckCtx, dbCancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer dbCancel()
 	err = h.CheckConnectionContext(dbCheckCtx)
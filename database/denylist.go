@@ -0,0 +1,72 @@
+package database // import "go.mozilla.org/autograph/database"
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrDeniedDigestNotFound is returned when a digest is not in
+	// the denylist of a signer
+	ErrDeniedDigestNotFound = errors.New("digest not found in signer denylist")
+)
+
+// DeniedDigest is the digest of an input a signer must never sign
+type DeniedDigest struct {
+	SignerID string
+	// Digest is the lowercase hex digest of the denied input
+	Digest    string
+	Reason    string
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+// ListDeniedDigests returns the denied digests of all signers
+func (db *Handler) ListDeniedDigests(ctx context.Context) (digests []DeniedDigest, err error) {
+	rows, err := db.QueryContext(ctx, `SELECT signer_id, digest, reason, created_by, created_at
+				FROM denied_digests ORDER BY created_at`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list denied digests from database")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d DeniedDigest
+		err = rows.Scan(&d.SignerID, &d.Digest, &d.Reason, &d.CreatedBy, &d.CreatedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read denied digest from database")
+		}
+		digests = append(digests, d)
+	}
+	return digests, rows.Err()
+}
+
+// InsertDeniedDigest adds a digest to the denylist of a signer, or
+// updates its reason when it is already denied
+func (db *Handler) InsertDeniedDigest(ctx context.Context, d DeniedDigest) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO denied_digests(signer_id, digest, reason, created_by)
+				VALUES ($1, $2, $3, $4)
+				ON CONFLICT (signer_id, digest) DO UPDATE SET reason=EXCLUDED.reason`,
+		d.SignerID, d.Digest, d.Reason, d.CreatedBy)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert denied digest in database")
+	}
+	return nil
+}
+
+// DeleteDeniedDigest removes a digest from the denylist of a signer
+func (db *Handler) DeleteDeniedDigest(ctx context.Context, signerID, digest string) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM denied_digests WHERE signer_id=$1 AND digest=$2", signerID, digest)
+	if err != nil {
+		return errors.Wrap(err, "failed to delete denied digest from database")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "failed to delete denied digest from database")
+	}
+	if n == 0 {
+		return ErrDeniedDigestNotFound
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package database // import "go.mozilla.org/autograph/database"
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrHawkKeyNotFound is returned when a user doesn't have a
+	// hawk key with an ID
+	ErrHawkKeyNotFound = errors.New("hawk key not found")
+)
+
+// HawkKey is a hawk secret of a user, added by a key rotation. Users
+// with keys in the database don't use the key of their configuration.
+type HawkKey struct {
+	UserID string
+	// KeyID is the hex fingerprint of the key
+	KeyID     string
+	Key       string
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+// ListHawkKeys returns the hawk keys of all users
+func (db *Handler) ListHawkKeys(ctx context.Context) (keys []HawkKey, err error) {
+	rows, err := db.QueryContext(ctx, `SELECT user_id, key_id, key, created_by, created_at
+				FROM hawk_keys ORDER BY created_at`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list hawk keys from database")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k HawkKey
+		err = rows.Scan(&k.UserID, &k.KeyID, &k.Key, &k.CreatedBy, &k.CreatedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read hawk key from database")
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// InsertHawkKeys adds hawk keys in a single transaction
+func (db *Handler) InsertHawkKeys(ctx context.Context, keys []HawkKey) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction to insert hawk keys")
+	}
+	for _, k := range keys {
+		_, err = tx.ExecContext(ctx, `INSERT INTO hawk_keys(user_id, key_id, key, created_by)
+				VALUES ($1, $2, $3, $4)`,
+			k.UserID, k.KeyID, k.Key, k.CreatedBy)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "failed to insert hawk key in database")
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit hawk keys in database")
+	}
+	return nil
+}
+
+// DeleteHawkKey removes a hawk key of a user
+func (db *Handler) DeleteHawkKey(ctx context.Context, userID, keyID string) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM hawk_keys WHERE user_id=$1 AND key_id=$2", userID, keyID)
+	if err != nil {
+		return errors.Wrap(err, "failed to delete hawk key from database")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "failed to delete hawk key from database")
+	}
+	if n == 0 {
+		return ErrHawkKeyNotFound
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package database // import "go.mozilla.org/autograph/database"
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// KeyCounter counts the signatures made with a key, by its HSM label,
+// since it was created, for key lifetime policies
+type KeyCounter struct {
+	Label      string
+	SignerID   string
+	Signatures int64
+	UpdatedAt  time.Time
+}
+
+// AddKeySignatures adds counts of signatures to the counters of their
+// keys in a single transaction, and returns the counters with their
+// new totals
+func (db *Handler) AddKeySignatures(ctx context.Context, counts []KeyCounter) (totals []KeyCounter, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction to add key signatures")
+	}
+	for _, c := range counts {
+		err = tx.QueryRowContext(ctx, `INSERT INTO key_signatures(label, signer_id, signatures)
+				VALUES ($1, $2, $3)
+				ON CONFLICT (label, signer_id) DO UPDATE SET
+					signatures=key_signatures.signatures+EXCLUDED.signatures,
+					updated_at=NOW()
+				RETURNING signatures, updated_at`,
+			c.Label, c.SignerID, c.Signatures).Scan(&c.Signatures, &c.UpdatedAt)
+		if err != nil {
+			tx.Rollback()
+			return nil, errors.Wrap(err, "failed to add key signatures in database")
+		}
+		totals = append(totals, c)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to commit key signatures in database")
+	}
+	return totals, nil
+}
+
+// ListKeyCounters returns the signature counters of keys, optionally of
+// a single signer, ordered by signer and label
+func (db *Handler) ListKeyCounters(ctx context.Context, signerID string) (counters []KeyCounter, err error) {
+	rows, err := db.QueryContext(ctx, `SELECT label, signer_id, signatures, updated_at
+				FROM key_signatures
+				WHERE $1 = '' OR signer_id = $1
+				ORDER BY signer_id, label`,
+		signerID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list key signatures from database")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c KeyCounter
+		err = rows.Scan(&c.Label, &c.SignerID, &c.Signatures, &c.UpdatedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read key signatures from database")
+		}
+		counters = append(counters, c)
+	}
+	return counters, rows.Err()
+}
@@ -1,6 +1,7 @@
 package database // import "go.mozilla.org/autograph/database"
 
 import (
+	"context"
 	"database/sql"
 	"time"
 
@@ -10,6 +11,10 @@ import (
 var (
 	// ErrNoSuitableEEFound is returned when no suitable key is found in database
 	ErrNoSuitableEEFound = errors.New("no suitable key found in database")
+
+	// ErrNoPreviousEE is returned when a signer has no end-entity to
+	// roll back to in database
+	ErrNoPreviousEE = errors.New("no previous end-entity found in database")
 )
 
 // BeginEndEntityOperations creates a database transaction that locks the endentities table,
@@ -19,21 +24,34 @@ var (
 // what we want in the case of key generation. Being slow and blocking is OK, risking two
 // key generation the happen in parallel is not.
 func (db *Handler) BeginEndEntityOperations() (*Transaction, error) {
+	return db.BeginEndEntityOperationsContext(context.Background())
+}
+
+// BeginEndEntityOperationsContext is like BeginEndEntityOperations but
+// gives up waiting for the lock when the context is done. The
+// transaction is bound to the context and is rolled back if the
+// context is done before it is committed.
+func (db *Handler) BeginEndEntityOperationsContext(ctx context.Context) (*Transaction, error) {
 	// if a db is present, first create a db transaction to lock the row for update
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		err = errors.Wrap(err, "failed to create transaction")
 		return nil, err
 	}
+	err = db.setTraceApplicationName(ctx, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 	// lock the table
-	_, err = tx.Exec("LOCK TABLE endentities_lock IN ACCESS EXCLUSIVE MODE")
+	_, err = tx.ExecContext(ctx, "LOCK TABLE endentities_lock IN ACCESS EXCLUSIVE MODE")
 	if err != nil {
 		err = errors.Wrap(err, "failed to lock endentities table")
 		tx.Rollback()
 		return nil, err
 	}
 	var id uint64
-	err = tx.QueryRow(`INSERT INTO endentities_lock(is_locked)
+	err = tx.QueryRowContext(ctx, `INSERT INTO endentities_lock(is_locked)
 				VALUES ($1) RETURNING id`,
 		true).Scan(&id)
 	if err != nil {
@@ -47,9 +65,15 @@ func (db *Handler) BeginEndEntityOperations() (*Transaction, error) {
 // GetLabelOfLatestEE returns the label of the latest end-entity for the specified signer
 // that is no older than a given duration
 func (db *Handler) GetLabelOfLatestEE(signerID string, youngerThan time.Duration) (label, x5u string, err error) {
+	return db.GetLabelOfLatestEEContext(context.Background(), signerID, youngerThan)
+}
+
+// GetLabelOfLatestEEContext is like GetLabelOfLatestEE but aborts the
+// query when the context is done
+func (db *Handler) GetLabelOfLatestEEContext(ctx context.Context, signerID string, youngerThan time.Duration) (label, x5u string, err error) {
 	var nullableX5U sql.NullString
 	maxAge := time.Now().Add(-youngerThan)
-	err = db.QueryRow(`SELECT label, x5u FROM endentities
+	err = db.QueryRowContext(ctx, `SELECT label, x5u FROM endentities
 				WHERE is_current=TRUE AND signer_id=$1 AND created_at > $2
 				ORDER BY created_at DESC LIMIT 1`,
 		signerID, maxAge).Scan(&label, &nullableX5U)
@@ -86,6 +110,45 @@ func (tx *Transaction) InsertEE(x5u, label, signerID string, hsmHandle uint) (er
 	return nil
 }
 
+// GetPreviousEE uses an existing transaction to return the label and
+// x5u of the latest end-entity of a signer created before the one
+// labeled currentLabel, skipping end-entities that were rolled back
+func (tx *Transaction) GetPreviousEE(ctx context.Context, signerID, currentLabel string) (label, x5u string, err error) {
+	var nullableX5U sql.NullString
+	err = tx.QueryRowContext(ctx, `SELECT label, x5u FROM endentities
+				WHERE signer_id=$1 AND label!=$2 AND rolled_back_at IS NULL
+				AND created_at < (SELECT created_at FROM endentities WHERE label=$2)
+				ORDER BY created_at DESC LIMIT 1`,
+		signerID, currentLabel).Scan(&label, &nullableX5U)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", "", ErrNoPreviousEE
+		}
+		return "", "", errors.Wrap(err, "failed to find previous end-entity in database")
+	}
+	if nullableX5U.Valid {
+		x5u = nullableX5U.String
+	}
+	return
+}
+
+// RollbackEE uses an existing transaction to mark the end-entity
+// labeled fromLabel as rolled back, and the one labeled toLabel as the
+// current end-entity of the signer
+func (tx *Transaction) RollbackEE(ctx context.Context, signerID, fromLabel, toLabel string) error {
+	_, err := tx.ExecContext(ctx, "UPDATE endentities SET is_current=FALSE, rolled_back_at=NOW() WHERE signer_id=$1 AND label=$2",
+		signerID, fromLabel)
+	if err != nil {
+		return errors.Wrap(err, "failed to mark end-entity as rolled back in database")
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE endentities SET is_current=(label=$2) WHERE signer_id=$1",
+		signerID, toLabel)
+	if err != nil {
+		return errors.Wrap(err, "failed to update is_current status of keys in database")
+	}
+	return nil
+}
+
 // End commits a transaction
 func (tx *Transaction) End() error {
 	_, err := tx.Exec("UPDATE endentities_lock SET is_locked=FALSE, freed_at=NOW() WHERE id=$1", tx.ID)
@@ -102,3 +165,47 @@ func (tx *Transaction) End() error {
 	}
 	return nil
 }
+
+// ErrSignerLocked is returned when another instance holds the lock of
+// a signer
+var ErrSignerLocked = errors.New("signer is locked by another instance")
+
+// SignerLock is the lock of a signer that runs on a single instance
+type SignerLock struct {
+	conn *sql.Conn
+	key  string
+}
+
+// LockSigner takes the lock of a signer that must run on a single
+// instance, or returns ErrSignerLocked when another instance holds it.
+// The lock is a session advisory lock held by a dedicated connection,
+// so it is released by Release, when the instance exits or when the
+// connection drops.
+func (db *Handler) LockSigner(ctx context.Context, signerID string) (*SignerLock, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get a connection to lock signer")
+	}
+	l := &SignerLock{conn: conn, key: "signer:" + signerID}
+	var locked bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", l.key).Scan(&locked)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to lock signer")
+	}
+	if !locked {
+		conn.Close()
+		return nil, ErrSignerLocked
+	}
+	return l, nil
+}
+
+// Release releases the lock of a signer and closes its connection
+func (l *SignerLock) Release() error {
+	_, err := l.conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", l.key)
+	closeErr := l.conn.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to unlock signer")
+	}
+	return closeErr
+}
@@ -3,6 +3,7 @@
 package database
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"sync"
@@ -95,3 +96,36 @@ func waitAndMakeEE(j int, db *Handler, wg *sync.WaitGroup, t *testing.T, signerI
 	}
 	return label
 }
+
+func TestLockSigner(t *testing.T) {
+	db, err := Connect(Config{
+		Name:                "autograph",
+		User:                "myautographdbuser",
+		Password:            "myautographdbpassword",
+		Host:                "127.0.0.1:5432",
+		MonitorPollInterval: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	signerID := fmt.Sprintf("database_unit_testing_%d", time.Now().UnixNano())
+	lock, err := db.LockSigner(context.Background(), signerID)
+	if err != nil {
+		t.Fatalf("failed to lock signer: %v", err)
+	}
+	_, err = db.LockSigner(context.Background(), signerID)
+	if err != ErrSignerLocked {
+		t.Fatalf("expected a second lock of the signer to fail with %v, got %v", ErrSignerLocked, err)
+	}
+	err = lock.Release()
+	if err != nil {
+		t.Fatalf("failed to release signer lock: %v", err)
+	}
+	lock, err = db.LockSigner(context.Background(), signerID)
+	if err != nil {
+		t.Fatalf("expected the released signer to lock again, got %v", err)
+	}
+	lock.Release()
+}
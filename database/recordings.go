@@ -0,0 +1,99 @@
+package database // import "go.mozilla.org/autograph/database"
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrRecordingNotFound is returned when no recorded request has
+	// the requested id
+	ErrRecordingNotFound = errors.New("recorded request not found in database")
+)
+
+// RecordedRequest is a sanitized signing request and its outcome,
+// recorded to debug signature mismatches. It holds hashes and
+// options, never inputs, signatures or key material.
+type RecordedRequest struct {
+	ID          int64
+	Ref         string
+	RequestID   string
+	SignerID    string
+	UserID      string
+	Endpoint    string
+	InputHash   string
+	InputLength int
+	// Options is the JSON encoded signing options of the request
+	Options    string
+	OutputHash string
+	Status     int
+	DurationMS int
+	CreatedAt  time.Time
+}
+
+// InsertRecordedRequest stores a recorded request and returns its id
+func (db *Handler) InsertRecordedRequest(ctx context.Context, rec RecordedRequest) (id int64, err error) {
+	err = db.traced(ctx, func(q queryer) error {
+		return q.QueryRowContext(ctx, `INSERT INTO recorded_requests(ref, request_id, signer_id, user_id,
+				endpoint, input_hash, input_length, options, output_hash, status, duration_ms)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`,
+			rec.Ref, rec.RequestID, rec.SignerID, rec.UserID, rec.Endpoint, rec.InputHash,
+			rec.InputLength, rec.Options, rec.OutputHash, rec.Status, rec.DurationMS).Scan(&id)
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to insert recorded request in database")
+	}
+	return id, nil
+}
+
+// GetRecordedRequest returns the recorded request with the given id
+func (db *Handler) GetRecordedRequest(ctx context.Context, id int64) (rec RecordedRequest, err error) {
+	err = db.QueryRowContext(ctx, `SELECT id, ref, request_id, signer_id, user_id, endpoint, input_hash,
+				input_length, options, output_hash, status, duration_ms, created_at
+				FROM recorded_requests WHERE id=$1`, id).Scan(
+		&rec.ID, &rec.Ref, &rec.RequestID, &rec.SignerID, &rec.UserID, &rec.Endpoint, &rec.InputHash,
+		&rec.InputLength, &rec.Options, &rec.OutputHash, &rec.Status, &rec.DurationMS, &rec.CreatedAt)
+	if err == sql.ErrNoRows {
+		return rec, ErrRecordingNotFound
+	}
+	if err != nil {
+		return rec, errors.Wrap(err, "failed to get recorded request from database")
+	}
+	return rec, nil
+}
+
+// ListRecordedRequests returns the latest requests recorded for a
+// signer, newest first
+func (db *Handler) ListRecordedRequests(ctx context.Context, signerID string, limit int) (recs []RecordedRequest, err error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, ref, request_id, signer_id, user_id, endpoint, input_hash,
+				input_length, options, output_hash, status, duration_ms, created_at
+				FROM recorded_requests WHERE signer_id=$1
+				ORDER BY created_at DESC LIMIT $2`, signerID, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list recorded requests from database")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rec RecordedRequest
+		err = rows.Scan(&rec.ID, &rec.Ref, &rec.RequestID, &rec.SignerID, &rec.UserID, &rec.Endpoint, &rec.InputHash,
+			&rec.InputLength, &rec.Options, &rec.OutputHash, &rec.Status, &rec.DurationMS, &rec.CreatedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read recorded request from database")
+		}
+		recs = append(recs, rec)
+	}
+	return recs, rows.Err()
+}
+
+// DeleteRecordedRequestsBefore deletes the requests recorded before a
+// time and returns how many were deleted
+func (db *Handler) DeleteRecordedRequestsBefore(ctx context.Context, before time.Time) (int64, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM recorded_requests WHERE created_at < $1", before)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to delete recorded requests from database")
+	}
+	return res.RowsAffected()
+}
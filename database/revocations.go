@@ -0,0 +1,72 @@
+package database // import "go.mozilla.org/autograph/database"
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Revocation marks a signature autograph issued as revoked, by the
+// reference of its response or the digest of its input or output
+type Revocation struct {
+	ID int64
+	// Ref is the reference of the revoked signature response, or
+	// empty when it is revoked by digest
+	Ref string
+	// Digest is the lowercase hex digest of the revoked input or
+	// signed file, or empty when it is revoked by reference
+	Digest    string
+	Reason    string
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+// InsertRevocation adds a revocation and returns it with its ID and
+// creation time
+func (db *Handler) InsertRevocation(ctx context.Context, r Revocation) (Revocation, error) {
+	err := db.QueryRowContext(ctx, `INSERT INTO revocations(ref, digest, reason, created_by)
+				VALUES ($1, $2, $3, $4)
+				RETURNING id, created_at`,
+		r.Ref, r.Digest, r.Reason, r.CreatedBy).Scan(&r.ID, &r.CreatedAt)
+	if err != nil {
+		return r, errors.Wrap(err, "failed to insert revocation in database")
+	}
+	return r, nil
+}
+
+// FindRevocations returns the revocations of the signature with the
+// reference ref, or of the inputs or files with the digest digest.
+// Empty arguments are ignored, but at least one must be set.
+func (db *Handler) FindRevocations(ctx context.Context, ref, digest string) ([]Revocation, error) {
+	if ref == "" && digest == "" {
+		return nil, errors.New("a reference or a digest is required to find revocations")
+	}
+	return db.queryRevocations(ctx, `SELECT id, ref, digest, reason, created_by, created_at
+				FROM revocations
+				WHERE ($1 <> '' AND ref=$1) OR ($2 <> '' AND digest=$2)
+				ORDER BY created_at DESC`, ref, digest)
+}
+
+// ListRevocations returns the latest revocations
+func (db *Handler) ListRevocations(ctx context.Context, limit int) ([]Revocation, error) {
+	return db.queryRevocations(ctx, `SELECT id, ref, digest, reason, created_by, created_at
+				FROM revocations ORDER BY created_at DESC LIMIT $1`, limit)
+}
+
+func (db *Handler) queryRevocations(ctx context.Context, query string, args ...interface{}) (revocations []Revocation, err error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find revocations in database")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r Revocation
+		err = rows.Scan(&r.ID, &r.Ref, &r.Digest, &r.Reason, &r.CreatedBy, &r.CreatedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read revocation from database")
+		}
+		revocations = append(revocations, r)
+	}
+	return revocations, rows.Err()
+}
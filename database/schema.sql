@@ -1,27 +1,146 @@
-CREATE ROLE myautographdbuser;
-ALTER ROLE myautographdbuser WITH NOSUPERUSER INHERIT NOCREATEROLE NOCREATEDB LOGIN PASSWORD 'myautographdbpassword';
-
-CREATE TABLE endentities(
-      id          SERIAL PRIMARY KEY,
-      label       VARCHAR NOT NULL,
-      hsm_handle  BIGINT NOT NULL,
-      signer_id   VARCHAR NOT NULL,
-      is_current  BOOLEAN NOT NULL,
-      x5u         VARCHAR NULL,
-      created_at  TIMESTAMP WITH TIME ZONE DEFAULT NOW()
-);
-CREATE INDEX endentities_latest_idx ON endentities(label, signer_id, is_current);
-ALTER TABLE endentities ADD CONSTRAINT endentities_unique_label UNIQUE (label);
-GRANT SELECT, INSERT ON endentities TO myautographdbuser;
-GRANT UPDATE (is_current) ON endentities TO myautographdbuser;
-GRANT USAGE ON endentities_id_seq TO myautographdbuser;
-
-CREATE TABLE endentities_lock(
-      id          SERIAL PRIMARY KEY,
-      is_locked   BOOLEAN NOT NULL,
-      created_at  TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
-      freed_at    TIMESTAMP WITH TIME ZONE
-
-);
-GRANT SELECT, INSERT, UPDATE ON endentities_lock TO myautographdbuser;
-GRANT USAGE ON endentities_lock_id_seq TO myautographdbuser;
+CREATE ROLE myautographdbuser;
+ALTER ROLE myautographdbuser WITH NOSUPERUSER INHERIT NOCREATEROLE NOCREATEDB LOGIN PASSWORD 'myautographdbpassword';
+
+CREATE TABLE endentities(
+      id          SERIAL PRIMARY KEY,
+      label       VARCHAR NOT NULL,
+      hsm_handle  BIGINT NOT NULL,
+      signer_id   VARCHAR NOT NULL,
+      is_current  BOOLEAN NOT NULL,
+      x5u         VARCHAR NULL,
+      created_at  TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+      rolled_back_at TIMESTAMP WITH TIME ZONE NULL
+);
+CREATE INDEX endentities_latest_idx ON endentities(label, signer_id, is_current);
+ALTER TABLE endentities ADD CONSTRAINT endentities_unique_label UNIQUE (label);
+GRANT SELECT, INSERT ON endentities TO myautographdbuser;
+GRANT UPDATE (is_current, rolled_back_at) ON endentities TO myautographdbuser;
+GRANT USAGE ON endentities_id_seq TO myautographdbuser;
+
+CREATE TABLE endentities_lock(
+      id          SERIAL PRIMARY KEY,
+      is_locked   BOOLEAN NOT NULL,
+      created_at  TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+      freed_at    TIMESTAMP WITH TIME ZONE
+
+);
+GRANT SELECT, INSERT, UPDATE ON endentities_lock TO myautographdbuser;
+GRANT USAGE ON endentities_lock_id_seq TO myautographdbuser;
+
+CREATE TABLE recorded_requests(
+      id            SERIAL PRIMARY KEY,
+      ref           VARCHAR NOT NULL,
+      request_id    VARCHAR NOT NULL,
+      signer_id     VARCHAR NOT NULL,
+      user_id       VARCHAR NOT NULL,
+      endpoint      VARCHAR NOT NULL,
+      input_hash    VARCHAR NOT NULL,
+      input_length  INTEGER NOT NULL,
+      options       VARCHAR NOT NULL,
+      output_hash   VARCHAR NOT NULL,
+      status        INTEGER NOT NULL,
+      duration_ms   INTEGER NOT NULL,
+      created_at    TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+CREATE INDEX recorded_requests_signer_idx ON recorded_requests(signer_id, created_at);
+GRANT SELECT, INSERT, DELETE ON recorded_requests TO myautographdbuser;
+GRANT USAGE ON recorded_requests_id_seq TO myautographdbuser;
+
+CREATE TABLE denied_digests(
+      signer_id   VARCHAR NOT NULL,
+      digest      VARCHAR NOT NULL,
+      reason      VARCHAR NOT NULL,
+      created_by  VARCHAR NOT NULL,
+      created_at  TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+      PRIMARY KEY (signer_id, digest)
+);
+GRANT SELECT, INSERT, DELETE ON denied_digests TO myautographdbuser;
+GRANT UPDATE (reason) ON denied_digests TO myautographdbuser;
+
+CREATE TABLE signed_addon_versions(
+      signer_id   VARCHAR NOT NULL,
+      addon_id    VARCHAR NOT NULL,
+      version     VARCHAR NOT NULL,
+      signed_at   TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+      PRIMARY KEY (signer_id, addon_id)
+);
+GRANT SELECT, INSERT ON signed_addon_versions TO myautographdbuser;
+GRANT UPDATE (version, signed_at) ON signed_addon_versions TO myautographdbuser;
+
+CREATE TABLE signed_artifacts(
+      id             SERIAL PRIMARY KEY,
+      ref            VARCHAR NOT NULL,
+      signer_id      VARCHAR NOT NULL,
+      user_id        VARCHAR NOT NULL,
+      name           VARCHAR NOT NULL,
+      input_digest   VARCHAR NOT NULL,
+      output_digest  VARCHAR NOT NULL,
+      created_at     TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+      metadata       JSONB NOT NULL DEFAULT '{}'
+);
+CREATE INDEX signed_artifacts_input_digest_idx ON signed_artifacts(input_digest);
+CREATE INDEX signed_artifacts_output_digest_idx ON signed_artifacts(output_digest);
+CREATE INDEX signed_artifacts_name_idx ON signed_artifacts(name);
+GRANT SELECT, INSERT ON signed_artifacts TO myautographdbuser;
+GRANT USAGE ON signed_artifacts_id_seq TO myautographdbuser;
+
+CREATE TABLE revocations(
+      id          SERIAL PRIMARY KEY,
+      ref         VARCHAR NOT NULL,
+      digest      VARCHAR NOT NULL,
+      reason      VARCHAR NOT NULL,
+      created_by  VARCHAR NOT NULL,
+      created_at  TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+      CHECK (ref <> '' OR digest <> '')
+);
+CREATE INDEX revocations_ref_idx ON revocations(ref);
+CREATE INDEX revocations_digest_idx ON revocations(digest);
+GRANT SELECT, INSERT ON revocations TO myautographdbuser;
+GRANT USAGE ON revocations_id_seq TO myautographdbuser;
+
+CREATE TABLE api_keys(
+      id          VARCHAR PRIMARY KEY,
+      key_hash    VARCHAR NOT NULL UNIQUE,
+      signers     VARCHAR[] NOT NULL,
+      created_at  TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+GRANT SELECT ON api_keys TO myautographdbuser;
+
+CREATE TABLE hawk_keys(
+      user_id     VARCHAR NOT NULL,
+      key_id      VARCHAR NOT NULL,
+      key         VARCHAR NOT NULL,
+      created_by  VARCHAR NOT NULL,
+      created_at  TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+      PRIMARY KEY (user_id, key_id)
+);
+GRANT SELECT, INSERT, DELETE ON hawk_keys TO myautographdbuser;
+
+CREATE TABLE usage_daily(
+      day           DATE NOT NULL,
+      signer_id     VARCHAR NOT NULL,
+      user_id       VARCHAR NOT NULL,
+      signatures    BIGINT NOT NULL,
+      errors        BIGINT NOT NULL,
+      bytes_signed  BIGINT NOT NULL,
+      PRIMARY KEY (day, signer_id, user_id)
+);
+GRANT SELECT, INSERT ON usage_daily TO myautographdbuser;
+GRANT UPDATE (signatures, errors, bytes_signed) ON usage_daily TO myautographdbuser;
+
+CREATE TABLE key_signatures(
+      label       VARCHAR NOT NULL,
+      signer_id   VARCHAR NOT NULL,
+      signatures  BIGINT NOT NULL,
+      updated_at  TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+      PRIMARY KEY (label, signer_id)
+);
+GRANT SELECT, INSERT ON key_signatures TO myautographdbuser;
+GRANT UPDATE (signatures, updated_at) ON key_signatures TO myautographdbuser;
+
+CREATE TABLE signer_configs(
+      signer_id   VARCHAR PRIMARY KEY,
+      fields      VARCHAR NOT NULL,
+      updated_at  TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+GRANT SELECT, INSERT, UPDATE, DELETE ON signer_configs TO myautographdbuser;
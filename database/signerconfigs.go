@@ -0,0 +1,80 @@
+package database // import "go.mozilla.org/autograph/database"
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SignerConfig is the last configuration of a signer seen by an
+// autograph instance, as a map of field names to values where secrets
+// are replaced by their fingerprints
+type SignerConfig struct {
+	SignerID  string
+	Fields    map[string]string
+	UpdatedAt time.Time
+}
+
+// ListSignerConfigs returns the last seen configurations of all signers
+func (db *Handler) ListSignerConfigs(ctx context.Context) (configs []SignerConfig, err error) {
+	rows, err := db.QueryContext(ctx, `SELECT signer_id, fields, updated_at
+				FROM signer_configs ORDER BY signer_id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list signer configurations from database")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			c      SignerConfig
+			fields string
+		)
+		err = rows.Scan(&c.SignerID, &fields, &c.UpdatedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read signer configuration from database")
+		}
+		err = json.Unmarshal([]byte(fields), &c.Fields)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse configuration of signer %q from database", c.SignerID)
+		}
+		configs = append(configs, c)
+	}
+	return configs, rows.Err()
+}
+
+// SaveSignerConfigs stores the configurations of signers and removes
+// the configurations of the removed signer IDs in a single transaction
+func (db *Handler) SaveSignerConfigs(ctx context.Context, configs []SignerConfig, removed []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction to save signer configurations")
+	}
+	for _, c := range configs {
+		fields, err := json.Marshal(c.Fields)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "failed to marshal configuration of signer %q", c.SignerID)
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO signer_configs(signer_id, fields)
+				VALUES ($1, $2)
+				ON CONFLICT (signer_id) DO UPDATE SET fields=EXCLUDED.fields, updated_at=NOW()`,
+			c.SignerID, string(fields))
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "failed to save signer configuration in database")
+		}
+	}
+	for _, signerID := range removed {
+		_, err = tx.ExecContext(ctx, "DELETE FROM signer_configs WHERE signer_id=$1", signerID)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "failed to delete signer configuration from database")
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit signer configurations in database")
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package database // import "go.mozilla.org/autograph/database"
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+
+	"go.mozilla.org/autograph/trace"
+)
+
+// defaultApplicationName is the application_name of database sessions
+// when the configuration does not set one
+const defaultApplicationName = "autograph"
+
+// queryer runs queries on a database or in a transaction
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// setTraceApplicationName sets the application name of a transaction
+// to the trace of the request of the context, if any, so the sessions
+// of pg_stat_activity and the database logs can be matched to
+// autograph requests
+func (db *Handler) setTraceApplicationName(ctx context.Context, tx *sql.Tx) error {
+	t, ok := trace.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "SELECT set_config('application_name', $1, true)", t.ApplicationName(db.applicationName))
+	if err != nil {
+		return errors.Wrap(err, "failed to set application name of transaction")
+	}
+	return nil
+}
+
+// traced runs queries in a transaction whose application name is the
+// trace of the request of the context when TraceQueries is set, and on
+// the database otherwise
+func (db *Handler) traced(ctx context.Context, queries func(q queryer) error) error {
+	if _, ok := trace.FromContext(ctx); !ok || !db.traceQueries {
+		return queries(db.DB)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = db.setTraceApplicationName(ctx, tx)
+	if err == nil {
+		err = queries(tx)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
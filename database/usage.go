@@ -0,0 +1,72 @@
+package database // import "go.mozilla.org/autograph/database"
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Usage counts the signing operations of a user with a signer on a
+// day, for usage reports
+type Usage struct {
+	// Day is the UTC day of the operations, at midnight
+	Day         time.Time
+	SignerID    string
+	UserID      string
+	Signatures  int64
+	Errors      int64
+	BytesSigned int64
+}
+
+// AddUsage adds counts of signing operations to the daily usage, in a
+// single transaction
+func (db *Handler) AddUsage(ctx context.Context, usage []Usage) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction to add usage")
+	}
+	for _, u := range usage {
+		_, err = tx.ExecContext(ctx, `INSERT INTO usage_daily(day, signer_id, user_id, signatures, errors, bytes_signed)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				ON CONFLICT (day, signer_id, user_id) DO UPDATE SET
+					signatures=usage_daily.signatures+EXCLUDED.signatures,
+					errors=usage_daily.errors+EXCLUDED.errors,
+					bytes_signed=usage_daily.bytes_signed+EXCLUDED.bytes_signed`,
+			u.Day, u.SignerID, u.UserID, u.Signatures, u.Errors, u.BytesSigned)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "failed to add usage in database")
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit usage in database")
+	}
+	return nil
+}
+
+// ListUsage returns the daily usage from the day of from until the day
+// before to, optionally of a single signer or user
+func (db *Handler) ListUsage(ctx context.Context, from, to time.Time, signerID, userID string) (usage []Usage, err error) {
+	rows, err := db.QueryContext(ctx, `SELECT day, signer_id, user_id, signatures, errors, bytes_signed
+				FROM usage_daily
+				WHERE day >= $1 AND day < $2
+				AND ($3 = '' OR signer_id = $3)
+				AND ($4 = '' OR user_id = $4)
+				ORDER BY day, signer_id, user_id`,
+		from, to, signerID, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list usage from database")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u Usage
+		err = rows.Scan(&u.Day, &u.SignerID, &u.UserID, &u.Signatures, &u.Errors, &u.BytesSigned)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read usage from database")
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
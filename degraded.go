@@ -0,0 +1,98 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/signer"
+)
+
+// defaultSignerRetryInterval is how often degraded signers retry
+// their initialization when signerinit.retryinterval is not set
+const defaultSignerRetryInterval = time.Minute
+
+// degradedSigner stands in for a signer that failed to initialize at
+// startup when signerinit.allowdegraded is set. Its initialization is
+// retried in the background until it succeeds, and requests to it
+// fail in the meantime.
+type degradedSigner struct {
+	conf signer.Configuration
+
+	mu  sync.RWMutex
+	s   signer.Signer
+	err error
+}
+
+// newDegradedSigner returns a degradedSigner for a signer that failed
+// to initialize with err
+func newDegradedSigner(conf signer.Configuration, err error) *degradedSigner {
+	return &degradedSigner{
+		conf: conf,
+		err:  err,
+	}
+}
+
+// get returns the signer once it recovered, or the error of its last
+// initialization attempt
+func (d *degradedSigner) get() (signer.Signer, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.s != nil {
+		return d.s, nil
+	}
+	return nil, errors.Wrapf(d.err, "signer %q is degraded", d.conf.ID)
+}
+
+// initialized returns the signer once it recovered, or nil
+func (d *degradedSigner) initialized() signer.Signer {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.s
+}
+
+// Config returns the configuration of the recovered signer, or the
+// configuration the signer is retried with
+func (d *degradedSigner) Config() signer.Configuration {
+	if s := d.initialized(); s != nil {
+		return s.Config()
+	}
+	return d.conf
+}
+
+// retry calls init every interval until the signer initializes
+func (d *degradedSigner) retry(init func(signer.Configuration) (signer.Signer, error), interval time.Duration) {
+	for attempt := 1; ; attempt++ {
+		time.Sleep(interval)
+		s, err := init(d.conf)
+		if err == nil && s == nil {
+			err = fmt.Errorf("signer %q was skipped during initialization", d.conf.ID)
+		}
+		d.mu.Lock()
+		d.s, d.err = s, err
+		d.mu.Unlock()
+		if err == nil {
+			log.Infof("degraded signer %q recovered after %d retries", d.conf.ID, attempt)
+			return
+		}
+		log.Errorf("degraded signer %q failed to initialize on retry %d: %v", d.conf.ID, attempt, err)
+	}
+}
+
+// getDegradedSigners returns the IDs of signers that failed to
+// initialize and haven't recovered yet
+func (a *autographer) getDegradedSigners() (ids []string) {
+	for _, s := range a.getSigners() {
+		if d, ok := s.(*degradedSigner); ok && d.initialized() == nil {
+			ids = append(ids, d.conf.ID)
+		}
+	}
+	return ids
+}
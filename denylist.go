@@ -0,0 +1,292 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/formats"
+)
+
+// defaultDenylistRefreshInterval is how often denylists are reloaded
+// from the database when the configuration does not set an interval
+const defaultDenylistRefreshInterval = time.Minute
+
+// denylistConfig enables the per-signer denylists of input digests
+type denylistConfig struct {
+	Enabled bool
+
+	// RefreshInterval is how often denylists are reloaded from
+	// the database, to pick up changes made through other
+	// autograph instances
+	RefreshInterval time.Duration
+}
+
+// denylistStore stores the denied digests of signers. It is
+// implemented by the database handler.
+type denylistStore interface {
+	ListDeniedDigests(ctx context.Context) ([]database.DeniedDigest, error)
+	InsertDeniedDigest(ctx context.Context, d database.DeniedDigest) error
+	DeleteDeniedDigest(ctx context.Context, signerID, digest string) error
+}
+
+// denylist keeps the denied digests of each signer in memory
+type denylist struct {
+	sync.RWMutex
+	store denylistStore
+	// digests maps signer IDs to their denied digests
+	digests map[string]map[string]database.DeniedDigest
+}
+
+func newDenylist(store denylistStore) *denylist {
+	return &denylist{
+		store:   store,
+		digests: make(map[string]map[string]database.DeniedDigest),
+	}
+}
+
+// refresh reloads the denied digests from the store
+func (d *denylist) refresh(ctx context.Context) error {
+	list, err := d.store.ListDeniedDigests(ctx)
+	if err != nil {
+		return err
+	}
+	digests := make(map[string]map[string]database.DeniedDigest)
+	for _, dd := range list {
+		if digests[dd.SignerID] == nil {
+			digests[dd.SignerID] = make(map[string]database.DeniedDigest)
+		}
+		digests[dd.SignerID][dd.Digest] = dd
+	}
+	d.Lock()
+	d.digests = digests
+	d.Unlock()
+	return nil
+}
+
+// refreshEvery reloads the denied digests at an interval, forever
+func (d *denylist) refreshEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := d.refresh(ctx)
+		cancel()
+		if err != nil {
+			log.Errorf("failed to refresh signer denylists: %v", err)
+		}
+	}
+}
+
+// denied returns the denylist entry of an input for a signer, if any.
+// Hashes signed by the hash endpoint are looked up as is, and other
+// inputs by their SHA256 digest.
+func (d *denylist) denied(signerID, endpoint string, input []byte) (database.DeniedDigest, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	digests := d.digests[signerID]
+	if len(digests) == 0 {
+		return database.DeniedDigest{}, false
+	}
+	var digest string
+	if endpoint == "/sign/hash" {
+		digest = hex.EncodeToString(input)
+	} else {
+		sum := sha256.Sum256(input)
+		digest = hex.EncodeToString(sum[:])
+	}
+	dd, ok := digests[digest]
+	return dd, ok
+}
+
+// entries returns the denied digests of a signer
+func (d *denylist) entries(signerID string) []database.DeniedDigest {
+	d.RLock()
+	defer d.RUnlock()
+	var list []database.DeniedDigest
+	for _, dd := range d.digests[signerID] {
+		list = append(list, dd)
+	}
+	return list
+}
+
+// enableDenylist denies the digests listed in the database, when the
+// configuration enables it
+func (a *autographer) enableDenylist(conf denylistConfig) error {
+	if !conf.Enabled {
+		return nil
+	}
+	if a.db == nil {
+		return errors.New("signer denylists require a database")
+	}
+	return a.initDenylist(a.db, conf)
+}
+
+// initDenylist loads the denylists from the store and keeps them up
+// to date
+func (a *autographer) initDenylist(store denylistStore, conf denylistConfig) error {
+	a.denylist = newDenylist(store)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := a.denylist.refresh(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to load signer denylists")
+	}
+	if conf.RefreshInterval <= 0 {
+		conf.RefreshInterval = defaultDenylistRefreshInterval
+	}
+	go a.denylist.refreshEvery(conf.RefreshInterval)
+	return nil
+}
+
+// checkDenylist writes an error to the client and returns false when
+// the input of a signing request of a user is denied for the signer
+func (a *autographer) checkDenylist(w http.ResponseWriter, r *http.Request, userid, signerID, endpoint string, input []byte) bool {
+	if a.denylist == nil {
+		return true
+	}
+	dd, denied := a.denylist.denied(signerID, endpoint, input)
+	if !denied {
+		return true
+	}
+	err := errors.Errorf("input with digest %s is denied for signer %q: %s", dd.Digest, signerID, dd.Reason)
+	a.signingRejected(r, formats.ErrorCodeInputDenied, userid, signerID, err)
+	httpError(w, r, http.StatusForbidden, formats.ErrorCodeInputDenied, "%v", err)
+	return false
+}
+
+// parseDigest returns the lowercase form of a hex encoded digest of 20
+// to 64 bytes, or an error
+func parseDigest(digest string) (string, error) {
+	digest = strings.ToLower(digest)
+	raw, err := hex.DecodeString(digest)
+	if err != nil || len(raw) < 20 || len(raw) > 64 {
+		return "", errors.Errorf("invalid digest %q, must be 20 to 64 hex encoded bytes", digest)
+	}
+	return digest, nil
+}
+
+// deniedDigestResponse returns the admin API form of a denied digest
+func deniedDigestResponse(dd database.DeniedDigest) formats.DeniedDigest {
+	return formats.DeniedDigest{
+		Digest:    dd.Digest,
+		Reason:    dd.Reason,
+		CreatedBy: dd.CreatedBy,
+		CreatedAt: dd.CreatedAt,
+	}
+}
+
+// handleDenylist lists the denied digests of a signer on GET, and
+// adds a digest to its denylist on POST
+func (a *autographer) handleDenylist(w http.ResponseWriter, r *http.Request) {
+	userid, body, ok := a.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+	if a.denylist == nil {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "signer denylists are not enabled")
+		return
+	}
+	signerID := mux.Vars(r)["id"]
+	if _, found := a.getSignerByID(signerID); !found {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "signer %q not found", signerID)
+		return
+	}
+	if r.Method == http.MethodGet {
+		resp := []formats.DeniedDigest{}
+		for _, dd := range a.denylist.entries(signerID) {
+			resp = append(resp, deniedDigestResponse(dd))
+		}
+		writeAdminJSON(w, r, resp)
+		return
+	}
+	var req formats.DeniedDigest
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "failed to parse request body: %v", err)
+		return
+	}
+	req.Digest, err = parseDigest(req.Digest)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "%v", err)
+		return
+	}
+	if req.Reason == "" {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "missing reason for denying digest")
+		return
+	}
+	err = a.denylist.store.InsertDeniedDigest(r.Context(), database.DeniedDigest{
+		SignerID:  signerID,
+		Digest:    req.Digest,
+		Reason:    req.Reason,
+		CreatedBy: userid,
+	})
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	err = a.denylist.refresh(r.Context())
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"rid":       getRequestID(r),
+		"signer_id": signerID,
+		"digest":    req.Digest,
+		"user_id":   userid,
+	}).Warn("added digest to signer denylist")
+	writeAdminJSON(w, r, req)
+}
+
+// handleDeleteDenylistDigest removes a digest from the denylist of a
+// signer
+func (a *autographer) handleDeleteDenylistDigest(w http.ResponseWriter, r *http.Request) {
+	userid, _, ok := a.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+	if a.denylist == nil {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "signer denylists are not enabled")
+		return
+	}
+	signerID := mux.Vars(r)["id"]
+	digest, err := parseDigest(mux.Vars(r)["digest"])
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "%v", err)
+		return
+	}
+	err = a.denylist.store.DeleteDeniedDigest(r.Context(), signerID, digest)
+	if err == database.ErrDeniedDigestNotFound {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "digest %s is not denied for signer %q", digest, signerID)
+		return
+	}
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	err = a.denylist.refresh(r.Context())
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"rid":       getRequestID(r),
+		"signer_id": signerID,
+		"digest":    digest,
+		"user_id":   userid,
+	}).Warn("removed digest from signer denylist")
+	w.WriteHeader(http.StatusNoContent)
+}
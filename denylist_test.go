@@ -0,0 +1,149 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+// memoryDenylistStore is a denylistStore that keeps denied digests
+// in memory
+type memoryDenylistStore struct {
+	sync.Mutex
+	digests []database.DeniedDigest
+}
+
+func (m *memoryDenylistStore) ListDeniedDigests(ctx context.Context) ([]database.DeniedDigest, error) {
+	m.Lock()
+	defer m.Unlock()
+	return append([]database.DeniedDigest(nil), m.digests...), nil
+}
+
+func (m *memoryDenylistStore) InsertDeniedDigest(ctx context.Context, d database.DeniedDigest) error {
+	m.Lock()
+	defer m.Unlock()
+	d.CreatedAt = time.Now()
+	m.digests = append(m.digests, d)
+	return nil
+}
+
+func (m *memoryDenylistStore) DeleteDeniedDigest(ctx context.Context, signerID, digest string) error {
+	m.Lock()
+	defer m.Unlock()
+	for i, d := range m.digests {
+		if d.SignerID == signerID && d.Digest == digest {
+			m.digests = append(m.digests[:i], m.digests[i+1:]...)
+			return nil
+		}
+	}
+	return database.ErrDeniedDigestNotFound
+}
+
+func TestSignerDenylist(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(100)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners([]signer.Configuration{conf.Signers[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerID := conf.Signers[0].ID
+	user := authorization{ID: "denieduser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: []string{signerID}}
+	admin := authorization{ID: "denyadmin", Key: "a4ex0ztpcu9msw5h5flc7qfhsc7btg2tzb2s3hgf1gtx5vqhnh", Admin: true}
+	err = tmpag.addAuthorizations([]authorization{user, admin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.denylist = newDenylist(new(memoryDenylistStore))
+
+	newRequest := func(method, url string, auth authorization, body []byte) *http.Request {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+		return mux.SetURLVars(req, map[string]string{"id": signerID})
+	}
+	input := []byte("a withdrawn add-on")
+	sign := func() *httptest.ResponseRecorder {
+		body, err := json.Marshal([]formats.SignatureRequest{{Input: base64.StdEncoding.EncodeToString(input)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		tmpag.handleSignature(w, newRequest("POST", "http://foo.bar/sign/data", user, body))
+		return w
+	}
+	digest := sha256.Sum256(input)
+
+	body, err := json.Marshal(formats.DeniedDigest{Digest: hex.EncodeToString(digest[:]), Reason: "withdrawn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	tmpag.handleDenylist(w, newRequest("POST", "http://foo.bar/admin/signers/"+signerID+"/denylist", user, body))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected non-admin user to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	tmpag.handleDenylist(w, newRequest("POST", "http://foo.bar/admin/signers/"+signerID+"/denylist", admin, body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("adding digest to denylist failed with %d: %s", w.Code, w.Body.String())
+	}
+
+	w = sign()
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected denied input to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+	var errResp formats.ErrorResponse
+	err = json.Unmarshal(w.Body.Bytes(), &errResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errResp.Code != formats.ErrorCodeInputDenied {
+		t.Fatalf("expected error code %q, got %q", formats.ErrorCodeInputDenied, errResp.Code)
+	}
+
+	w = httptest.NewRecorder()
+	tmpag.handleDenylist(w, newRequest("GET", "http://foo.bar/admin/signers/"+signerID+"/denylist", admin, nil))
+	var list []formats.DeniedDigest
+	err = json.Unmarshal(w.Body.Bytes(), &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].CreatedBy != admin.ID || list[0].Reason != "withdrawn" {
+		t.Fatalf("unexpected denylist: %s", w.Body.String())
+	}
+
+	req := newRequest("DELETE", "http://foo.bar/admin/signers/"+signerID+"/denylist/"+hex.EncodeToString(digest[:]), admin, nil)
+	req = mux.SetURLVars(req, map[string]string{"id": signerID, "digest": hex.EncodeToString(digest[:])})
+	w = httptest.NewRecorder()
+	tmpag.handleDeleteDenylistDigest(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("removing digest from denylist failed with %d: %s", w.Code, w.Body.String())
+	}
+	w = sign()
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected input to be signed once removed from the denylist, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,210 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/autograph/signer/contentsignaturepki"
+)
+
+// endEntityRotationCheckInterval is how often signers are checked for
+// end-entities due for a scheduled rotation
+const endEntityRotationCheckInterval = time.Minute
+
+// endEntityRotator is implemented by signers that rotate their
+// end-entity on a schedule, like the contentsignaturepki signers with
+// a rotation interval
+type endEntityRotator interface {
+	RotationDue() time.Time
+	RotateIfDue(ctx context.Context) (rotated bool, err error)
+	EndEntity() (label, x5u string)
+}
+
+// rotateDueEndEntities rotates the end-entities of the signers that are
+// due for a scheduled rotation. Standby instances don't rotate, they
+// sync the end-entities the primary rotated to.
+func (a *autographer) rotateDueEndEntities(ctx context.Context) {
+	if a.isStandby() {
+		return
+	}
+	for _, s := range a.getSigners() {
+		if d, ok := s.(deferredSigner); ok {
+			// lazy signers check their end-entity when they are
+			// initialized
+			s = d.initialized()
+		}
+		rotator, ok := s.(endEntityRotator)
+		if !ok || rotator.RotationDue().IsZero() {
+			continue
+		}
+		signerID := s.Config().ID
+		rotated, err := rotator.RotateIfDue(ctx)
+		result := "success"
+		if err != nil {
+			result = "failed"
+			log.WithFields(log.Fields{"signer_id": signerID}).Errorf("failed to rotate end-entity on schedule: %v", err)
+		} else if !rotated {
+			continue
+		}
+		if a.stats != nil {
+			sendStatsErr := a.stats.Incr("scheduled_endentity_rotation", []string{"signer:" + signerID, "result:" + result}, 1.0)
+			if sendStatsErr != nil {
+				log.Warnf("Error sending scheduled_endentity_rotation: %s", sendStatsErr)
+			}
+		}
+		if err != nil {
+			continue
+		}
+		label, x5u := rotator.EndEntity()
+		log.WithFields(log.Fields{
+			"signer_id": signerID,
+			"label":     label,
+			"x5u":       x5u,
+		}).Warn("rotated end-entity of signer on schedule")
+		if reverifier, ok := s.(signatureReverifier); ok {
+			a.reverifyAfterRotation(signerID, reverifier)
+		}
+	}
+}
+
+// startEndEntityRotation checks for end-entities due for a scheduled
+// rotation in the background when a signer has a rotation interval,
+// until stopEndEntityRotation is called on shutdown
+func (a *autographer) startEndEntityRotation(signerConfs []signer.Configuration, interval time.Duration) {
+	for _, signerConf := range signerConfs {
+		if signerConf.RotationInterval > 0 {
+			ctx, cancel := context.WithCancel(context.Background())
+			a.stopEndEntityRotation = cancel
+			go a.rotateEndEntitiesEvery(ctx, interval)
+			return
+		}
+	}
+}
+
+// rotateEndEntitiesEvery checks for end-entities due for a scheduled
+// rotation at an interval, until ctx is done. Failed rotations are
+// retried at the next check, while the certificate of the current
+// end-entity is still valid for the rotation overlap.
+func (a *autographer) rotateEndEntitiesEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkCtx, cancel := context.WithTimeout(ctx, interval)
+			a.rotateDueEndEntities(checkCtx)
+			cancel()
+		}
+	}
+}
+
+// handleRotateEndEntity makes a new end-entity and chain for a
+// contentsignaturepki signer and switches to it, holding the same
+// end-entity lock as startup, so a suspected end-entity key exposure
+// can be handled without redeploying
+func (a *autographer) handleRotateEndEntity(w http.ResponseWriter, r *http.Request) {
+	userid, _, ok := a.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+	signerID := mux.Vars(r)["id"]
+	s, found := a.getSignerByID(signerID)
+	if !found {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "signer %q not found", signerID)
+		return
+	}
+	s, err := resolveSigner(s)
+	if err != nil {
+		httpError(w, r, http.StatusServiceUnavailable, formats.ErrorCodeSignerUnavailable, "%v", err)
+		return
+	}
+	pkiSigner, ok := s.(*contentsignaturepki.ContentSigner)
+	if !ok {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeUnsupportedOperation, "signer %q of type %q has no end-entity to rotate", signerID, s.Config().Type)
+		return
+	}
+	err = pkiSigner.Rotate(r.Context())
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	label, x5u := pkiSigner.EndEntity()
+	log.WithFields(log.Fields{
+		"rid":       getRequestID(r),
+		"signer_id": signerID,
+		"label":     label,
+		"x5u":       x5u,
+		"user_id":   userid,
+	}).Warn("rotated end-entity of signer")
+	a.keyRotated(r, userid, signerID, fmt.Sprintf("rotated to end-entity %s", label))
+	a.reverifyAfterRotation(signerID, pkiSigner)
+	writeAdminJSON(w, r, formats.EndEntity{
+		SignerID: signerID,
+		Label:    label,
+		X5U:      x5u,
+	})
+}
+
+// handleRollbackEndEntity switches a contentsignaturepki signer back
+// to the end-entity it used before the current one, when a rotation
+// turns out to have published a bad chain, without restarting
+func (a *autographer) handleRollbackEndEntity(w http.ResponseWriter, r *http.Request) {
+	userid, _, ok := a.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+	signerID := mux.Vars(r)["id"]
+	s, found := a.getSignerByID(signerID)
+	if !found {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "signer %q not found", signerID)
+		return
+	}
+	s, err := resolveSigner(s)
+	if err != nil {
+		httpError(w, r, http.StatusServiceUnavailable, formats.ErrorCodeSignerUnavailable, "%v", err)
+		return
+	}
+	pkiSigner, ok := s.(*contentsignaturepki.ContentSigner)
+	if !ok {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeUnsupportedOperation, "signer %q of type %q has no end-entity to roll back", signerID, s.Config().Type)
+		return
+	}
+	label, x5u, err := pkiSigner.Rollback(r.Context())
+	if err != nil {
+		if errors.Cause(err) == database.ErrNoPreviousEE {
+			httpError(w, r, http.StatusConflict, formats.ErrorCodeInvalidRequest, "%v", err)
+			return
+		}
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"rid":       getRequestID(r),
+		"signer_id": signerID,
+		"label":     label,
+		"x5u":       x5u,
+		"user_id":   userid,
+	}).Warn("rolled back end-entity of signer")
+	a.keyRotated(r, userid, signerID, fmt.Sprintf("rolled back to end-entity %s", label))
+	a.reverifyAfterRotation(signerID, pkiSigner)
+	writeAdminJSON(w, r, formats.EndEntity{
+		SignerID: signerID,
+		Label:    label,
+		X5U:      x5u,
+	})
+}
@@ -0,0 +1,245 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/autograph/signer/contentsignaturepki"
+)
+
+func TestRollbackEndEntity(t *testing.T) {
+	t.Parallel()
+
+	var signerConfs []signer.Configuration
+	for _, s := range conf.Signers {
+		if s.ID == "normandy" || s.ID == "appkey1" {
+			// rotations made within the same second need
+			// distinct labels and chain names
+			s.EELabelTemplate = "{{.SignerID}}-{{.Random}}"
+			s.ChainNameTemplate = "{{.CommonName}}-{{.Serial}}.chain"
+			signerConfs = append(signerConfs, s)
+		}
+	}
+	tmpag := newAutographer(10)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners(signerConfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := authorization{ID: "eeuser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: []string{"normandy"}}
+	admin := authorization{ID: "eeadmin", Key: "a4ex0ztpcu9msw5h5flc7qfhsc7btg2tzb2s3hgf1gtx5vqhnh", Admin: true}
+	err = tmpag.addAuthorizations([]authorization{user, admin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rollback := func(auth authorization, signerID string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "http://foo.bar/admin/signers/"+signerID+"/rollback", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", []byte("")))
+		w := httptest.NewRecorder()
+		tmpag.handleRollbackEndEntity(w, mux.SetURLVars(req, map[string]string{"id": signerID}))
+		return w
+	}
+	s, _ := tmpag.getSignerByID("normandy")
+	pkiSigner := s.(*contentsignaturepki.ContentSigner)
+	initialX5U := pkiSigner.Config().X5U
+
+	for i, testcase := range []struct {
+		auth     authorization
+		signerID string
+		status   int
+	}{
+		{user, "normandy", http.StatusUnauthorized},
+		{admin, "unknown", http.StatusNotFound},
+		{admin, "appkey1", http.StatusBadRequest},
+		{admin, "normandy", http.StatusConflict},
+	} {
+		w := rollback(testcase.auth, testcase.signerID)
+		if w.Code != testcase.status {
+			t.Errorf("testcase %d: expected status %d but got %d: %s", i, testcase.status, w.Code, w.Body.String())
+		}
+	}
+
+	err = pkiSigner.Rotate(context.Background())
+	if err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	if pkiSigner.Config().X5U == initialX5U {
+		t.Fatal("expected rotation to change the x5u")
+	}
+	w := rollback(admin, "normandy")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d: %s", w.Code, w.Body.String())
+	}
+	var ee formats.EndEntity
+	err = json.Unmarshal(w.Body.Bytes(), &ee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ee.SignerID != "normandy" || ee.X5U != initialX5U || pkiSigner.Config().X5U != initialX5U {
+		t.Fatalf("expected rollback to x5u %q, got %+v", initialX5U, ee)
+	}
+}
+
+func TestRotateEndEntity(t *testing.T) {
+	t.Parallel()
+
+	var signerConfs []signer.Configuration
+	for _, s := range conf.Signers {
+		if s.ID == "normandy" || s.ID == "appkey1" {
+			s.EELabelTemplate = "{{.SignerID}}-{{.Random}}"
+			s.ChainNameTemplate = "{{.CommonName}}-{{.Serial}}.chain"
+			signerConfs = append(signerConfs, s)
+		}
+	}
+	tmpag := newAutographer(10)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners(signerConfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := authorization{ID: "rotateuser", Key: "q7c8w0ztpcu9msw5h5flc7qfhsc7btg2tzb2s3hgf1gtx5vqhn", Signers: []string{"normandy"}}
+	admin := authorization{ID: "rotateadmin", Key: "m2fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfh", Admin: true}
+	err = tmpag.addAuthorizations([]authorization{user, admin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotate := func(auth authorization, signerID string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "http://foo.bar/admin/signers/"+signerID+"/rotate", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", []byte("")))
+		w := httptest.NewRecorder()
+		tmpag.handleRotateEndEntity(w, mux.SetURLVars(req, map[string]string{"id": signerID}))
+		return w
+	}
+	s, _ := tmpag.getSignerByID("normandy")
+	pkiSigner := s.(*contentsignaturepki.ContentSigner)
+	initialX5U := pkiSigner.Config().X5U
+
+	for i, testcase := range []struct {
+		auth     authorization
+		signerID string
+		status   int
+	}{
+		{user, "normandy", http.StatusUnauthorized},
+		{admin, "unknown", http.StatusNotFound},
+		{admin, "appkey1", http.StatusBadRequest},
+	} {
+		w := rotate(testcase.auth, testcase.signerID)
+		if w.Code != testcase.status {
+			t.Errorf("testcase %d: expected status %d but got %d: %s", i, testcase.status, w.Code, w.Body.String())
+		}
+	}
+	if pkiSigner.Config().X5U != initialX5U {
+		t.Fatal("expected failed rotations to leave the x5u unchanged")
+	}
+
+	w := rotate(admin, "normandy")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d: %s", w.Code, w.Body.String())
+	}
+	var ee formats.EndEntity
+	err = json.Unmarshal(w.Body.Bytes(), &ee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	label, x5u := pkiSigner.EndEntity()
+	if ee.SignerID != "normandy" || ee.X5U == initialX5U || ee.X5U != x5u || ee.Label != label {
+		t.Fatalf("expected rotation away from x5u %q to the current end-entity, got %+v", initialX5U, ee)
+	}
+}
+
+func TestScheduledEndEntityRotation(t *testing.T) {
+	t.Parallel()
+
+	var signerConfs []signer.Configuration
+	for _, s := range conf.Signers {
+		if s.ID == "normandy" || s.ID == "appkey1" {
+			s.EELabelTemplate = "{{.SignerID}}-{{.Random}}"
+			s.ChainNameTemplate = "{{.CommonName}}-{{.Serial}}.chain"
+			// the end-entity is due as soon as it is made
+			s.RotationInterval = time.Nanosecond
+			signerConfs = append(signerConfs, s)
+		}
+	}
+	tmpag := newAutographer(1)
+	err := tmpag.addSigners(signerConfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := tmpag.getSignerByID("normandy")
+	pkiSigner := s.(*contentsignaturepki.ContentSigner)
+	initialLabel, initialX5U := pkiSigner.EndEntity()
+
+	// standby instances sync the rotations of the primary instead
+	tmpag.standingBy = 1
+	tmpag.rotateDueEndEntities(context.Background())
+	if label, _ := pkiSigner.EndEntity(); label != initialLabel {
+		t.Fatalf("expected a standby instance not to rotate, got end-entity %q", label)
+	}
+	tmpag.standingBy = 0
+
+	tmpag.rotateDueEndEntities(context.Background())
+	label, x5u := pkiSigner.EndEntity()
+	if label == initialLabel || x5u == initialX5U {
+		t.Fatalf("expected the end-entity to rotate on schedule, still %q", label)
+	}
+	certs, err := contentsignaturepki.GetX5U(x5u)
+	if err != nil {
+		t.Fatalf("failed to get x5u of the rotated end-entity: %v", err)
+	}
+	if certs[0].NotAfter.Before(time.Now().Add(time.Hour)) {
+		t.Fatalf("expected a new certificate, got one expiring at %s", certs[0].NotAfter)
+	}
+}
+
+func TestStartEndEntityRotation(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(1)
+	tmpag.startEndEntityRotation(conf.Signers, time.Hour)
+	if tmpag.stopEndEntityRotation != nil {
+		t.Fatal("expected no end-entity rotation without a signer rotation interval")
+	}
+
+	signerConfs := append([]signer.Configuration(nil), conf.Signers...)
+	signerConfs[0].RotationInterval = time.Hour
+	tmpag.startEndEntityRotation(signerConfs, time.Hour)
+	if tmpag.stopEndEntityRotation == nil {
+		t.Fatal("expected end-entity rotation to start with a signer rotation interval")
+	}
+	tmpag.stopEndEntityRotation()
+
+	// the rotation loop returns once stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		tmpag.rotateEndEntitiesEvery(ctx, time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the end-entity rotation to stop")
+	}
+}
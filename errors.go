@@ -7,6 +7,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -14,19 +15,30 @@ import (
 	"net/http"
 
 	log "github.com/sirupsen/logrus"
+	"go.mozilla.org/autograph/formats"
 )
 
 // ErrAuthNotFound is for when autographer.getAuthByID doesn't find an auth
 var ErrAuthNotFound = errors.New("authorization not found")
 
-func httpError(w http.ResponseWriter, r *http.Request, errorCode int, errorMessage string, args ...interface{}) {
+// httpError logs an error and writes it to the client as a JSON
+// formats.ErrorResponse with the given HTTP status and error code
+func httpError(w http.ResponseWriter, r *http.Request, errorCode int, code formats.ErrorCode, errorMessage string, args ...interface{}) {
 	rid := getRequestID(r)
 	log.WithFields(log.Fields{
-		"code": errorCode,
-		"rid":  rid,
+		"code":       errorCode,
+		"error_code": code,
+		"rid":        rid,
 	}).Errorf(errorMessage, args...)
-	msg := fmt.Sprintf(errorMessage, args...)
-	msg += "\r\nrequest-id: " + rid
+	body, err := json.Marshal(formats.ErrorResponse{
+		Code:      code,
+		Message:   fmt.Sprintf(errorMessage, args...),
+		Retriable: code.Retriable(),
+		RequestID: rid,
+	})
+	if err != nil {
+		log.Errorf("failed to marshal error response: %v", err)
+	}
 	// when nginx is in front of go, nginx requires that the entire
 	// request body is read before writing a response.
 	// https://github.com/golang/go/issues/15789
@@ -34,6 +46,9 @@ func httpError(w http.ResponseWriter, r *http.Request, errorCode int, errorMessa
 		io.Copy(ioutil.Discard, r.Body)
 		r.Body.Close()
 	}
-	http.Error(w, msg, errorCode)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(errorCode)
+	w.Write(body)
 	return
 }
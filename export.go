@@ -0,0 +1,253 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/formats"
+)
+
+const (
+	// defaultExportBufferSize is the number of events an exporter
+	// queues when the configuration does not set a buffer size
+	defaultExportBufferSize = 10000
+
+	// defaultExportBatchSize is the number of events an exporter
+	// sends at once when the configuration does not set a batch
+	// size
+	defaultExportBatchSize = 100
+
+	// defaultExportFlushInterval is how long an exporter waits to
+	// fill a batch when the configuration does not set an interval
+	defaultExportFlushInterval = time.Second
+
+	// exportSendTimeout is how long sending a batch can take
+	exportSendTimeout = 10 * time.Second
+)
+
+// exporterConfig configures an exporter of signing and audit events
+// to an external sink. Type is one of "http", "syslog", "kinesis",
+// "firehose" or "kafka", and each type uses a subset of the other
+// fields.
+type exporterConfig struct {
+	Type string
+
+	// URL is the endpoint of http sinks, and the base URL of the
+	// Kafka REST proxy of kafka sinks
+	URL string
+
+	// Headers are added to the requests of http and kafka sinks,
+	// for example to set an authorization token
+	Headers map[string]string
+
+	// Network, Address and Tag configure syslog sinks. Events are
+	// sent to the local syslog daemon when Address is empty.
+	Network string
+	Address string
+	Tag     string
+
+	// Stream is the name of the Kinesis stream or Firehose
+	// delivery stream, and Region its AWS region
+	Stream string
+	Region string
+
+	// Topic is the Kafka topic of kafka sinks
+	Topic string
+
+	// BufferSize is the number of events queued for the sink.
+	// Events are dropped when the queue is full, so a slow sink
+	// never blocks signing.
+	BufferSize int
+
+	// BatchSize is the maximum number of events sent at once
+	BatchSize int
+
+	// FlushInterval is how long the exporter waits to fill a
+	// batch before sending it
+	FlushInterval time.Duration
+}
+
+// eventSink sends batches of JSON encoded events to an external system
+type eventSink interface {
+	send(ctx context.Context, events []exportedEvent) error
+}
+
+// exportedEvent is an event with its JSON encoding
+type exportedEvent struct {
+	formats.ExportedEvent
+	data []byte
+}
+
+// eventExporter queues events and sends them in batches to a sink in
+// the background
+type eventExporter struct {
+	conf   exporterConfig
+	sink   eventSink
+	events chan exportedEvent
+	a      *autographer
+}
+
+// newEventSink returns the sink of an exporter configuration
+func newEventSink(conf exporterConfig) (eventSink, error) {
+	switch conf.Type {
+	case "http":
+		return newHTTPSink(conf)
+	case "syslog":
+		return newSyslogSink(conf)
+	case "kinesis":
+		return newKinesisSink(conf)
+	case "firehose":
+		return newFirehoseSink(conf)
+	case "kafka":
+		return newKafkaSink(conf)
+	}
+	return nil, errors.Errorf("unknown exporter type %q, must be one of http, syslog, kinesis, firehose or kafka", conf.Type)
+}
+
+// addExporters starts an exporter for each configuration
+func (a *autographer) addExporters(confs []exporterConfig) error {
+	for i, conf := range confs {
+		sink, err := newEventSink(conf)
+		if err != nil {
+			return errors.Wrapf(err, "failed to configure exporter %d", i)
+		}
+		a.addExporter(conf, sink)
+		log.Infof("exporting signing and audit events to %s sink", conf.Type)
+	}
+	return nil
+}
+
+// addExporter starts exporting events to a sink
+func (a *autographer) addExporter(conf exporterConfig, sink eventSink) *eventExporter {
+	e := a.newEventExporter(conf, sink)
+	a.exporters = append(a.exporters, e)
+	return e
+}
+
+// newEventExporter starts an exporter that sends the events it queues
+// to a sink
+func (a *autographer) newEventExporter(conf exporterConfig, sink eventSink) *eventExporter {
+	if conf.BufferSize <= 0 {
+		conf.BufferSize = defaultExportBufferSize
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = defaultExportBatchSize
+	}
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = defaultExportFlushInterval
+	}
+	e := &eventExporter{
+		conf:   conf,
+		sink:   sink,
+		events: make(chan exportedEvent, conf.BufferSize),
+		a:      a,
+	}
+	go e.run()
+	return e
+}
+
+// run sends batches of queued events, forever
+func (e *eventExporter) run() {
+	for {
+		batch := []exportedEvent{<-e.events}
+		timer := time.NewTimer(e.conf.FlushInterval)
+	fill:
+		for len(batch) < e.conf.BatchSize {
+			select {
+			case event := <-e.events:
+				batch = append(batch, event)
+			case <-timer.C:
+				break fill
+			}
+		}
+		timer.Stop()
+		ctx, cancel := context.WithTimeout(context.Background(), exportSendTimeout)
+		err := e.sink.send(ctx, batch)
+		cancel()
+		if err != nil {
+			log.Errorf("failed to export %d events to %s sink: %v", len(batch), e.conf.Type, err)
+			e.count("export.failed", len(batch))
+			continue
+		}
+		e.count("export.sent", len(batch))
+	}
+}
+
+// count sends a statsd counter tagged with the sink type
+func (e *eventExporter) count(name string, n int) {
+	if e.a.stats == nil {
+		return
+	}
+	err := e.a.stats.Count(name, int64(n), []string{"sink:" + e.conf.Type}, 1.0)
+	if err != nil {
+		log.Warnf("Error sending %s: %s", name, err)
+	}
+}
+
+// queue adds an event to the queue of the exporter, or drops it when
+// the queue is full
+func (e *eventExporter) queue(event exportedEvent) {
+	select {
+	case e.events <- event:
+	default:
+		log.Warnf("dropping %s event for %s sink: queue is full", event.Type, e.conf.Type)
+		e.count("export.dropped", 1)
+	}
+}
+
+// exportEvent queues an event on every exporter
+func (a *autographer) exportEvent(event formats.ExportedEvent) {
+	queueEvent(a.exporters, event)
+}
+
+// queueEvent queues an event on a list of exporters
+func queueEvent(exporters []*eventExporter, event formats.ExportedEvent) {
+	if len(exporters) == 0 {
+		return
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("failed to marshal %s event: %v", event.Type, err)
+		return
+	}
+	for _, e := range exporters {
+		e.queue(exportedEvent{ExportedEvent: event, data: data})
+	}
+}
+
+// exportSignature exports the event of a successful signing operation
+func (a *autographer) exportSignature(r *http.Request, userid, signerID, ref, inputHash, outputHash string, metadata map[string]string) {
+	a.exportEvent(formats.ExportedEvent{
+		Type:       formats.EventTypeSignature,
+		RequestID:  getRequestID(r),
+		UserID:     userid,
+		SignerID:   signerID,
+		Endpoint:   r.URL.Path,
+		Ref:        ref,
+		InputHash:  inputHash,
+		OutputHash: outputHash,
+		Metadata:   metadata,
+	})
+}
+
+// exportAudit exports the event of an authorized admin API request
+func (a *autographer) exportAudit(r *http.Request, userid string) {
+	a.exportEvent(formats.ExportedEvent{
+		Type:      formats.EventTypeAudit,
+		RequestID: getRequestID(r),
+		UserID:    userid,
+		Action:    r.Method + " " + r.URL.Path,
+	})
+}
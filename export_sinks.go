@@ -0,0 +1,229 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/pkg/errors"
+)
+
+// postEvents posts a body to a sink URL and checks the response status
+func postEvents(ctx context.Context, client *http.Client, url, contentType string, headers map[string]string, body io.Reader) error {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.Errorf("sink returned status %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
+
+// httpSink posts batches of events as newline delimited JSON
+type httpSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newHTTPSink(conf exporterConfig) (*httpSink, error) {
+	if _, err := url.ParseRequestURI(conf.URL); err != nil {
+		return nil, errors.Wrap(err, "invalid http sink url")
+	}
+	return &httpSink{url: conf.URL, headers: conf.Headers, client: &http.Client{}}, nil
+}
+
+func (s *httpSink) send(ctx context.Context, events []exportedEvent) error {
+	var body bytes.Buffer
+	for _, event := range events {
+		body.Write(event.data)
+		body.WriteByte('\n')
+	}
+	return postEvents(ctx, s.client, s.url, "application/x-ndjson", s.headers, &body)
+}
+
+// kafkaSink produces events to a Kafka topic through a Kafka REST
+// proxy, keyed by signer ID so the events of a signer stay in order
+type kafkaSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newKafkaSink(conf exporterConfig) (*kafkaSink, error) {
+	if conf.Topic == "" {
+		return nil, errors.New("missing kafka sink topic")
+	}
+	u, err := url.ParseRequestURI(conf.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid kafka sink url")
+	}
+	u.Path = path.Join(u.Path, "topics", conf.Topic)
+	return &kafkaSink{url: u.String(), headers: conf.Headers, client: &http.Client{}}, nil
+}
+
+func (s *kafkaSink) send(ctx context.Context, events []exportedEvent) error {
+	type kafkaRecord struct {
+		Key   string          `json:"key,omitempty"`
+		Value json.RawMessage `json:"value"`
+	}
+	var records struct {
+		Records []kafkaRecord `json:"records"`
+	}
+	for _, event := range events {
+		records.Records = append(records.Records, kafkaRecord{Key: event.SignerID, Value: event.data})
+	}
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	return postEvents(ctx, s.client, s.url, "application/vnd.kafka.json.v2+json", s.headers, bytes.NewReader(body))
+}
+
+// syslogSink writes each event as a syslog message
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink(conf exporterConfig) (*syslogSink, error) {
+	tag := conf.Tag
+	if tag == "" {
+		tag = "autograph"
+	}
+	w, err := syslog.Dial(conf.Network, conf.Address, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to syslog")
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) send(ctx context.Context, events []exportedEvent) error {
+	for _, event := range events {
+		err := s.w.Info(string(event.data))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxAWSBatchSize is the maximum number of records of the Kinesis
+// PutRecords and Firehose PutRecordBatch operations
+const maxAWSBatchSize = 500
+
+// newAWSSession returns an AWS session for the region of a sink, or
+// the region of the environment when it is empty
+func newAWSSession(region string) (*session.Session, error) {
+	conf := aws.NewConfig()
+	if region != "" {
+		conf = conf.WithRegion(region)
+	}
+	return session.NewSession(conf)
+}
+
+// kinesisSink puts events in a Kinesis stream, partitioned by signer
+// ID so the events of a signer stay in order
+type kinesisSink struct {
+	stream string
+	client *kinesis.Kinesis
+}
+
+func newKinesisSink(conf exporterConfig) (*kinesisSink, error) {
+	if conf.Stream == "" {
+		return nil, errors.New("missing kinesis sink stream")
+	}
+	if conf.BatchSize > maxAWSBatchSize {
+		return nil, errors.Errorf("kinesis sink batch size must not exceed %d", maxAWSBatchSize)
+	}
+	sess, err := newAWSSession(conf.Region)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create AWS session")
+	}
+	return &kinesisSink{stream: conf.Stream, client: kinesis.New(sess)}, nil
+}
+
+func (s *kinesisSink) send(ctx context.Context, events []exportedEvent) error {
+	input := &kinesis.PutRecordsInput{StreamName: aws.String(s.stream)}
+	for _, event := range events {
+		key := event.SignerID
+		if key == "" {
+			key = event.Type
+		}
+		input.Records = append(input.Records, &kinesis.PutRecordsRequestEntry{
+			Data:         event.data,
+			PartitionKey: aws.String(key),
+		})
+	}
+	out, err := s.client.PutRecordsWithContext(ctx, input)
+	if err != nil {
+		return err
+	}
+	if aws.Int64Value(out.FailedRecordCount) > 0 {
+		return errors.Errorf("kinesis failed to put %d records", aws.Int64Value(out.FailedRecordCount))
+	}
+	return nil
+}
+
+// firehoseSink puts newline terminated events in a Firehose delivery
+// stream
+type firehoseSink struct {
+	stream string
+	client *firehose.Firehose
+}
+
+func newFirehoseSink(conf exporterConfig) (*firehoseSink, error) {
+	if conf.Stream == "" {
+		return nil, errors.New("missing firehose sink stream")
+	}
+	if conf.BatchSize > maxAWSBatchSize {
+		return nil, errors.Errorf("firehose sink batch size must not exceed %d", maxAWSBatchSize)
+	}
+	sess, err := newAWSSession(conf.Region)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create AWS session")
+	}
+	return &firehoseSink{stream: conf.Stream, client: firehose.New(sess)}, nil
+}
+
+func (s *firehoseSink) send(ctx context.Context, events []exportedEvent) error {
+	input := &firehose.PutRecordBatchInput{DeliveryStreamName: aws.String(s.stream)}
+	for _, event := range events {
+		input.Records = append(input.Records, &firehose.Record{
+			Data: append(append([]byte{}, event.data...), '\n'),
+		})
+	}
+	out, err := s.client.PutRecordBatchWithContext(ctx, input)
+	if err != nil {
+		return err
+	}
+	if aws.Int64Value(out.FailedPutCount) > 0 {
+		return errors.Errorf("firehose failed to put %d records", aws.Int64Value(out.FailedPutCount))
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+// memorySink is an eventSink that keeps events in memory
+type memorySink struct {
+	sync.Mutex
+	events  []formats.ExportedEvent
+	batches int
+}
+
+func (m *memorySink) send(ctx context.Context, events []exportedEvent) error {
+	m.Lock()
+	defer m.Unlock()
+	m.batches++
+	for _, event := range events {
+		var decoded formats.ExportedEvent
+		err := json.Unmarshal(event.data, &decoded)
+		if err != nil {
+			return err
+		}
+		m.events = append(m.events, decoded)
+	}
+	return nil
+}
+
+func (m *memorySink) received() []formats.ExportedEvent {
+	m.Lock()
+	defer m.Unlock()
+	return append([]formats.ExportedEvent(nil), m.events...)
+}
+
+func TestExportSigningAndAuditEvents(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(100)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners([]signer.Configuration{conf.Signers[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := authorization{ID: "exporteduser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: []string{conf.Signers[0].ID}}
+	admin := authorization{ID: "exportadmin", Key: "a4ex0ztpcu9msw5h5flc7qfhsc7btg2tzb2s3hgf1gtx5vqhnh", Admin: true}
+	err = tmpag.addAuthorizations([]authorization{user, admin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := new(memorySink)
+	tmpag.addExporter(exporterConfig{Type: "memory", BatchSize: 2, FlushInterval: 10 * time.Millisecond}, sink)
+
+	newRequest := func(method, url string, auth authorization, body []byte) *http.Request {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+		return req
+	}
+
+	input := []byte("some data to export")
+	body, err := json.Marshal([]formats.SignatureRequest{{Input: base64.StdEncoding.EncodeToString(input), KeyID: conf.Signers[0].ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	tmpag.handleSignature(w, newRequest("POST", "http://foo.bar/sign/data", user, body))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("signing failed with %d: %s", w.Code, w.Body.String())
+	}
+	var sigresps []formats.SignatureResponse
+	err = json.Unmarshal(w.Body.Bytes(), &sigresps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	tmpag.handleListRecordings(w, newRequest("GET", "http://foo.bar/admin/recordings?signer=foo", admin, nil))
+
+	var events []formats.ExportedEvent
+	for i := 0; len(events) < 2; i++ {
+		if i > 100 {
+			t.Fatalf("timed out waiting for events, got %+v", events)
+		}
+		time.Sleep(10 * time.Millisecond)
+		events = sink.received()
+	}
+	sig, audit := events[0], events[1]
+	if sig.Type != formats.EventTypeSignature || sig.UserID != user.ID || sig.SignerID != conf.Signers[0].ID ||
+		sig.Endpoint != "/sign/data" || sig.Ref != sigresps[0].Ref || sig.InputHash != hashSHA256AsHex(input) ||
+		sig.OutputHash != hashSHA256AsHex([]byte(sigresps[0].Signature)) || sig.Timestamp.IsZero() {
+		t.Fatalf("unexpected signature event %+v", sig)
+	}
+	if audit.Type != formats.EventTypeAudit || audit.UserID != admin.ID || audit.Action != "GET /admin/recordings" {
+		t.Fatalf("unexpected audit event %+v", audit)
+	}
+}
+
+// blockingSink is an eventSink that blocks until it is released
+type blockingSink struct {
+	release chan struct{}
+}
+
+func (b *blockingSink) send(ctx context.Context, events []exportedEvent) error {
+	<-b.release
+	return nil
+}
+
+func TestExporterDropsEventsWhenFull(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(1)
+	sink := &blockingSink{release: make(chan struct{})}
+	defer close(sink.release)
+	e := tmpag.addExporter(exporterConfig{Type: "blocking", BufferSize: 2, BatchSize: 1, FlushInterval: time.Millisecond}, sink)
+	done := make(chan struct{})
+	go func() {
+		// the first event is held by the blocked sink, the next
+		// two fill the queue and the others are dropped
+		for i := 0; i < 10; i++ {
+			tmpag.exportEvent(formats.ExportedEvent{Type: formats.EventTypeAudit})
+			time.Sleep(time.Millisecond)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("exporting events blocked on a full queue")
+	}
+	if len(e.events) != 2 {
+		t.Fatalf("expected a full queue of 2 events, got %d", len(e.events))
+	}
+}
+
+func TestHTTPAndKafkaSinks(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu       sync.Mutex
+		requests = make(map[string]*http.Request)
+		bodies   = make(map[string][]byte)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		requests[r.URL.Path] = r
+		bodies[r.URL.Path] = body
+		mu.Unlock()
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	events := []exportedEvent{
+		{ExportedEvent: formats.ExportedEvent{SignerID: "a"}, data: []byte(`{"signer_id":"a"}`)},
+		{ExportedEvent: formats.ExportedEvent{SignerID: "b"}, data: []byte(`{"signer_id":"b"}`)},
+	}
+	headers := map[string]string{"Authorization": "Bearer foo"}
+
+	httpSink, err := newEventSink(exporterConfig{Type: "http", URL: srv.URL + "/ingest", Headers: headers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = httpSink.send(context.Background(), events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests["/ingest"].Header.Get("Content-Type") != "application/x-ndjson" || requests["/ingest"].Header.Get("Authorization") != "Bearer foo" {
+		t.Fatalf("unexpected http sink headers %v", requests["/ingest"].Header)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(bodies["/ingest"]))
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 2 || lines[0] != `{"signer_id":"a"}` || lines[1] != `{"signer_id":"b"}` {
+		t.Fatalf("unexpected http sink body %q", bodies["/ingest"])
+	}
+
+	kafkaSink, err := newEventSink(exporterConfig{Type: "kafka", URL: srv.URL + "/rest", Topic: "autograph", Headers: headers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kafkaSink.send(context.Background(), events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests["/rest/topics/autograph"].Header.Get("Content-Type") != "application/vnd.kafka.json.v2+json" {
+		t.Fatalf("unexpected kafka sink headers %v", requests["/rest/topics/autograph"].Header)
+	}
+	expected := `{"records":[{"key":"a","value":{"signer_id":"a"}},{"key":"b","value":{"signer_id":"b"}}]}`
+	if string(bodies["/rest/topics/autograph"]) != expected {
+		t.Fatalf("expected kafka sink body %s, got %s", expected, bodies["/rest/topics/autograph"])
+	}
+
+	failingSink, err := newEventSink(exporterConfig{Type: "http", URL: srv.URL + "/fail"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = failingSink.send(context.Background(), events)
+	if err == nil {
+		t.Fatal("expected an error from a sink returning a 502")
+	}
+}
+
+func TestNewEventSinkErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, conf := range []exporterConfig{
+		{Type: "carrier-pigeon"},
+		{Type: "http", URL: "not a url"},
+		{Type: "kafka", URL: "http://localhost:8082"},
+		{Type: "kinesis"},
+		{Type: "kinesis", Stream: "events", BatchSize: 1000},
+		{Type: "firehose"},
+	} {
+		_, err := newEventSink(conf)
+		if err == nil {
+			t.Fatalf("expected exporter configuration %+v to fail", conf)
+		}
+	}
+}
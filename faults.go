@@ -0,0 +1,115 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mozilla.org/autograph/formats"
+)
+
+// faultInjectionEnv must be set to 1 for autograph to start with
+// fault injection enabled, so a configuration copied from a test
+// environment cannot enable it in production by accident
+const faultInjectionEnv = "AUTOGRAPH_FAULT_INJECTION"
+
+// faultInjectedHeader is set on responses affected by fault injection
+const faultInjectedHeader = "X-Autograph-Fault-Injected"
+
+// faultInjectionConfig configures the faults injected in signing
+// requests, so clients can test their retry logic. It must never be
+// enabled in production.
+type faultInjectionConfig struct {
+	Enabled bool
+
+	// Signers maps signer IDs to the faults injected in the
+	// requests they process
+	Signers map[string]signerFaults
+}
+
+// signerFaults are the faults injected in the requests of a signer
+type signerFaults struct {
+	// Latency is added before signing
+	Latency time.Duration
+
+	// ErrorRate is the fraction of requests, between 0 and 1,
+	// that fail with ErrorStatus
+	ErrorRate float64
+
+	// ErrorStatus is the status of injected errors: 500, 503
+	// (the default) or 504
+	ErrorStatus int
+
+	// TruncateRate is the fraction of requests, between 0 and 1,
+	// whose response body is cut in half
+	TruncateRate float64
+}
+
+// enableFaultInjection validates a fault injection configuration and
+// enables it, when the configuration enables it
+func (a *autographer) enableFaultInjection(conf faultInjectionConfig) error {
+	if !conf.Enabled {
+		return nil
+	}
+	if os.Getenv(faultInjectionEnv) != "1" {
+		return errors.Errorf("fault injection is configured but %s is not set to 1", faultInjectionEnv)
+	}
+	for id, faults := range conf.Signers {
+		if faults.ErrorRate < 0 || faults.ErrorRate > 1 || faults.TruncateRate < 0 || faults.TruncateRate > 1 {
+			return errors.Errorf("fault rates of signer %q must be between 0 and 1", id)
+		}
+		switch faults.ErrorStatus {
+		case 0:
+			faults.ErrorStatus = http.StatusServiceUnavailable
+			conf.Signers[id] = faults
+		case http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		default:
+			return errors.Errorf("fault error status of signer %q must be 500, 503 or 504", id)
+		}
+		log.Warnf("fault injection enabled for signer %q: %+v", id, faults)
+	}
+	a.faults = conf.Signers
+	return nil
+}
+
+// injectFaults adds the latency and errors configured for a signer to
+// a signing request. It writes an error to the client and returns false
+// when the request must fail, and returns true in truncate when the
+// response must be truncated.
+func (a *autographer) injectFaults(ctx context.Context, w http.ResponseWriter, r *http.Request, signerID string) (truncate, ok bool) {
+	faults, found := a.faults[signerID]
+	if !found {
+		return false, true
+	}
+	if faults.Latency > 0 {
+		select {
+		case <-time.After(faults.Latency):
+		case <-ctx.Done():
+		}
+	}
+	if rand.Float64() < faults.ErrorRate {
+		code := formats.ErrorCodeHSMUnavailable
+		switch faults.ErrorStatus {
+		case http.StatusInternalServerError:
+			code = formats.ErrorCodeSigningFailed
+		case http.StatusGatewayTimeout:
+			code = formats.ErrorCodeTimeout
+		}
+		w.Header().Set(faultInjectedHeader, "error")
+		httpError(w, r, faults.ErrorStatus, code, "injected fault for signer %q", signerID)
+		return false, false
+	}
+	if rand.Float64() < faults.TruncateRate {
+		w.Header().Set(faultInjectedHeader, "truncate")
+		return true, true
+	}
+	return false, true
+}
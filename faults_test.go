@@ -0,0 +1,95 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+func TestFaultInjection(t *testing.T) {
+	tmpag := newAutographer(100)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners([]signer.Configuration{conf.Signers[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := authorization{
+		ID:      "faultuser",
+		Key:     "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+		Signers: []string{conf.Signers[0].ID},
+	}
+	err = tmpag.addAuthorizations([]authorization{auth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func() *httptest.ResponseRecorder {
+		body, err := json.Marshal([]formats.SignatureRequest{{Input: "Y2FyaWJvdW1hdXJpY2UK"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		tmpag.handleSignature(w, req)
+		return w
+	}
+
+	faultConf := faultInjectionConfig{
+		Enabled: true,
+		Signers: map[string]signerFaults{
+			conf.Signers[0].ID: {Latency: 50 * time.Millisecond, ErrorRate: 1},
+		},
+	}
+	err = tmpag.enableFaultInjection(faultConf)
+	if err == nil {
+		t.Fatalf("expected fault injection to require %s", faultInjectionEnv)
+	}
+	os.Setenv(faultInjectionEnv, "1")
+	defer os.Unsetenv(faultInjectionEnv)
+	err = tmpag.enableFaultInjection(faultInjectionConfig{
+		Enabled: true,
+		Signers: map[string]signerFaults{conf.Signers[0].ID: {ErrorStatus: http.StatusTeapot}},
+	})
+	if err == nil {
+		t.Fatal("expected unsupported error status to fail")
+	}
+	err = tmpag.enableFaultInjection(faultConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	w := sign()
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("expected latency to be injected, request took %s", time.Since(start))
+	}
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get(faultInjectedHeader) != "error" {
+		t.Fatalf("expected an injected 503 error, got %d: %s", w.Code, w.Body.String())
+	}
+
+	tmpag.faults[conf.Signers[0].ID] = signerFaults{TruncateRate: 1}
+	w = sign()
+	if w.Code != http.StatusCreated || w.Header().Get(faultInjectedHeader) != "truncate" {
+		t.Fatalf("expected a truncated response, got %d: %s", w.Code, w.Body.String())
+	}
+	var sigresps []formats.SignatureResponse
+	if json.Unmarshal(w.Body.Bytes(), &sigresps) == nil {
+		t.Fatalf("expected truncated response to be invalid JSON, got %s", w.Body.String())
+	}
+}
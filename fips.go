@@ -0,0 +1,135 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+
+	"github.com/pkg/errors"
+
+	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/autograph/signer/apk"
+	"go.mozilla.org/autograph/signer/apk2"
+	"go.mozilla.org/autograph/signer/gpg2"
+	"go.mozilla.org/autograph/signer/nullsigner"
+	"go.mozilla.org/autograph/signer/pgp"
+	"go.mozilla.org/autograph/signer/plugin"
+	"go.mozilla.org/autograph/signer/rsapss"
+	"go.mozilla.org/autograph/signer/threshold"
+	"go.mozilla.org/autograph/signer/xpi"
+)
+
+// fipsBuild is set to true in fips_boring.go when autograph is built
+// against a FIPS 140 validated crypto module with
+// GOEXPERIMENT=boringcrypto
+var fipsBuild = false
+
+// fipsMinRSAKeySize is the smallest RSA modulus, in bits, FIPS 186-4
+// allows for generating signatures
+const fipsMinRSAKeySize = 2048
+
+// fipsStatus is reported by the __version__ endpoint
+type fipsStatus struct {
+	// Enabled is true when the `fips` config option is set and
+	// non-compliant signers are rejected
+	Enabled bool `json:"enabled"`
+
+	// ValidatedModule is true when the binary was built against a
+	// FIPS 140 validated crypto module
+	ValidatedModule bool `json:"validated_module"`
+}
+
+// fipsDisallowedSignerTypes maps signer types that cannot operate in
+// FIPS mode to the reason why
+var fipsDisallowedSignerTypes = map[string]string{
+	apk.Type:        "v1 JAR signatures use SHA1 digests",
+	apk2.Type:       "signing shells out to apksigner which is not a validated module",
+	gpg2.Type:       "signing shells out to gpg which is not a validated module",
+	nullsigner.Type: "signatures are fake and made without a key",
+	pgp.Type:        "golang.org/x/crypto/openpgp is not a validated module",
+	plugin.Type:     "signing runs in an external process which is not a validated module",
+	rsapss.Type:     "signatures are computed over SHA1 digests",
+	xpi.Type:        "PKCS7 signatures cover SHA1 JAR manifests",
+}
+
+// checkFIPSCompliance returns an error when a signer uses a type,
+// hash or key that isn't approved for FIPS 186-4 signature generation
+func checkFIPSCompliance(s signer.Signer) error {
+	conf := s.Config()
+	err := checkFIPSConfiguration(conf)
+	if err != nil {
+		return err
+	}
+	if conf.PublicKey == "" {
+		return nil
+	}
+	if conf.Type == threshold.Type {
+		set, err := threshold.ParsePublicKeySet(conf.PublicKey)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse public key set of signer %q", conf.ID)
+		}
+		for _, key := range set.Keys {
+			err = checkFIPSPublicKey(conf.ID, key.PublicKey)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	pubBytes, err := base64.StdEncoding.DecodeString(conf.PublicKey)
+	if err != nil {
+		// some signers (e.g. pgp) store armored keys, but
+		// those were rejected by type above
+		return errors.Wrapf(err, "failed to decode public key of signer %q", conf.ID)
+	}
+	return checkFIPSPublicKey(conf.ID, pubBytes)
+}
+
+// checkFIPSConfiguration returns an error when the configuration of a
+// signer sets a type or hash that isn't approved for FIPS 186-4
+// signature generation. It doesn't need the signer to be initialized,
+// so lazy and degraded signers are checked at startup too.
+func checkFIPSConfiguration(conf signer.Configuration) error {
+	if reason, disallowed := fipsDisallowedSignerTypes[conf.Type]; disallowed {
+		return errors.Errorf("signer %q of type %q is not permitted in FIPS mode: %s", conf.ID, conf.Type, reason)
+	}
+	switch conf.Hash {
+	case "", "sha256", "sha384", "sha512":
+	default:
+		return errors.Errorf("signer %q uses hash %q which is not permitted in FIPS mode", conf.ID, conf.Hash)
+	}
+	return nil
+}
+
+// checkFIPSPublicKey returns an error when a DER encoded public key of
+// a signer isn't approved for FIPS 186-4 signature generation
+func checkFIPSPublicKey(signerID string, pubBytes []byte) error {
+	pub, err := x509.ParsePKIXPublicKey(pubBytes)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse public key of signer %q", signerID)
+	}
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < fipsMinRSAKeySize {
+			return errors.Errorf("signer %q uses a %d bits RSA key, FIPS mode requires at least %d bits",
+				signerID, key.N.BitLen(), fipsMinRSAKeySize)
+		}
+	case *ecdsa.PublicKey:
+		switch key.Params().Name {
+		case "P-256", "P-384", "P-521":
+		default:
+			return errors.Errorf("signer %q uses curve %q which is not permitted in FIPS mode", signerID, key.Params().Name)
+		}
+	case *dsa.PublicKey:
+		return errors.Errorf("signer %q uses a DSA key which is not permitted in FIPS mode", signerID)
+	default:
+		return errors.Errorf("signer %q uses unsupported key type %T in FIPS mode", signerID, pub)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build boringcrypto
+// +build boringcrypto
+
+package main
+
+import (
+	// restrict TLS to FIPS approved settings
+	_ "crypto/tls/fipsonly"
+)
+
+func init() {
+	fipsBuild = true
+}
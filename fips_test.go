@@ -0,0 +1,85 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/signer"
+)
+
+func TestFIPSCompliance(t *testing.T) {
+	t.Parallel()
+
+	var TESTCASES = []struct {
+		signerID  string
+		compliant bool
+	}{
+		{"appkey1", true},
+		{"appkey2", true},
+		{"normandy", true},
+		{"webextensions-rsa", false},
+		{"testapp-android-legacy", false},
+		{"randompgp", false},
+		{"dummyrsapss", false},
+		{"dummyrsa", true},
+		{"testauthenticode", false},
+		{"dummythreshold", true},
+		{"dummynull", false},
+	}
+	for _, testcase := range TESTCASES {
+		var found bool
+		for _, s := range ag.getSigners() {
+			if s.Config().ID != testcase.signerID {
+				continue
+			}
+			found = true
+			err := checkFIPSCompliance(s)
+			if testcase.compliant && err != nil {
+				t.Fatalf("expected signer %q to be FIPS compliant, got: %v", testcase.signerID, err)
+			}
+			if !testcase.compliant && err == nil {
+				t.Fatalf("expected signer %q to be rejected in FIPS mode", testcase.signerID)
+			}
+		}
+		if !found {
+			t.Fatalf("signer %q not found in test configuration", testcase.signerID)
+		}
+	}
+}
+
+func TestFIPSRejectsLazyAndDegradedSigners(t *testing.T) {
+	t.Parallel()
+
+	var pgpConf signer.Configuration
+	for _, signerConf := range conf.Signers {
+		if signerConf.ID == "randompgp" {
+			pgpConf = signerConf
+		}
+	}
+	lazyConf := pgpConf
+	lazyConf.Lazy = true
+	brokenConf := pgpConf
+	brokenConf.PrivateKey = "not a key"
+	for _, testcase := range []struct {
+		name          string
+		conf          signer.Configuration
+		allowDegraded bool
+	}{
+		{"lazy", lazyConf, false},
+		{"degraded", brokenConf, true},
+	} {
+		tmpag := newAutographer(1)
+		tmpag.fips = true
+		tmpag.signerInit.AllowDegraded = testcase.allowDegraded
+		tmpag.signerInit.RetryInterval = time.Hour
+		err := tmpag.addSigners([]signer.Configuration{testcase.conf})
+		if err == nil || !strings.Contains(err.Error(), "not permitted in FIPS mode") {
+			t.Fatalf("expected the %s pgp signer to be refused in FIPS mode, got %v", testcase.name, err)
+		}
+	}
+}
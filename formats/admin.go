@@ -0,0 +1,175 @@
+package formats
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// RecordedRequest is returned by the admin API with a sanitized
+// signing request recorded for debugging. It holds the hashes of the
+// input and output, never the input or key material.
+type RecordedRequest struct {
+	ID          int64           `json:"id"`
+	Ref         string          `json:"ref"`
+	RequestID   string          `json:"request_id"`
+	SignerID    string          `json:"signer_id"`
+	UserID      string          `json:"user_id"`
+	Endpoint    string          `json:"endpoint"`
+	InputHash   string          `json:"input_hash"`
+	InputLength int             `json:"input_length"`
+	Options     json.RawMessage `json:"options,omitempty"`
+	OutputHash  string          `json:"output_hash"`
+	Status      int             `json:"status"`
+	DurationMS  int             `json:"duration_ms"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// DeniedDigest is the digest of an input a signer must never sign,
+// sent by an admin to add it to the denylist of a signer. Hashes
+// signed by the /sign/hash endpoint are denied by their hex value, and
+// other inputs by the hex value of their SHA256 digest.
+type DeniedDigest struct {
+	Digest    string    `json:"digest"`
+	Reason    string    `json:"reason"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+}
+
+// ReplayRequest is sent by an admin to sign the input of a recorded
+// request again with its signer and options. The input must match
+// the recorded input hash.
+type ReplayRequest struct {
+	Input string `json:"input"`
+}
+
+// ReplayResponse is returned to an admin with the new signature of a
+// replayed request. OutputMatches tells whether the output hash is the
+// same as the recorded one, which is only expected of signers that
+// make deterministic signatures.
+type ReplayResponse struct {
+	Recording     RecordedRequest   `json:"recording"`
+	Signature     SignatureResponse `json:"signature"`
+	OutputHash    string            `json:"output_hash"`
+	OutputMatches bool              `json:"output_matches"`
+}
+
+// SignedArtifact is returned by the admin API with the registry record
+// of a signed file. Digests are lowercase hex SHA256 digests.
+type SignedArtifact struct {
+	Ref          string    `json:"ref"`
+	SignerID     string    `json:"signer_id"`
+	UserID       string    `json:"user_id"`
+	Name         string    `json:"name,omitempty"`
+	InputDigest  string    `json:"input_digest"`
+	OutputDigest string    `json:"output_digest"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	// Metadata is the metadata the client attached to the
+	// signature request
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Revocation is sent by an admin to revoke a signature by the ref of
+// its response or the lowercase hex digest of its input or signed
+// file, and returned with the revocations of a signature
+type Revocation struct {
+	Ref       string    `json:"ref,omitempty"`
+	Digest    string    `json:"digest,omitempty"`
+	Reason    string    `json:"reason"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+}
+
+// RevocationStatus is returned to clients that check whether a
+// signature was revoked, with the revocations that match it
+type RevocationStatus struct {
+	Revoked     bool         `json:"revoked"`
+	Revocations []Revocation `json:"revocations"`
+}
+
+// HawkKey is returned by the admin API with a hawk key of a user. The
+// key itself is only returned when it is created.
+type HawkKey struct {
+	ID        string    `json:"id"`
+	Key       string    `json:"key,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+}
+
+// UsageReport is returned by the admin API with the signing operations
+// of a user with a signer on a UTC day, formatted as 2006-01-02.
+// ErrorRate is the share of operations that failed.
+type UsageReport struct {
+	Day         string  `json:"day"`
+	SignerID    string  `json:"signer_id"`
+	UserID      string  `json:"user_id"`
+	Signatures  int64   `json:"signatures"`
+	Errors      int64   `json:"errors"`
+	BytesSigned int64   `json:"bytes_signed"`
+	ErrorRate   float64 `json:"error_rate"`
+}
+
+// KeyCounter is returned by the admin API with the number of signatures
+// made with a key, by its HSM label, since it was created.
+// MaxSignatures is the signature limit of the keys of the signer, or 0
+// without limit.
+type KeyCounter struct {
+	Label         string    `json:"label"`
+	SignerID      string    `json:"signer_id"`
+	Signatures    int64     `json:"signatures"`
+	MaxSignatures int64     `json:"max_signatures,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// PGPKeyRequest is sent by an admin to generate an OpenPGP key for a
+// pgp signer. Lifetime is a duration like "8760h", and the key never
+// expires without it. Publish submits the public key to the
+// keyservers and web key directory of the signer.
+type PGPKeyRequest struct {
+	Name     string `json:"name"`
+	Comment  string `json:"comment,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Curve    string `json:"curve,omitempty"`
+	Lifetime string `json:"lifetime,omitempty"`
+	Publish  bool   `json:"publish,omitempty"`
+}
+
+// PGPKey is returned by the admin API with a generated OpenPGP key.
+// PrivateKey is the label of the key in the HSM when OnHSM is true,
+// and otherwise the armored private key. PublishError is set when
+// the key was generated but publishing it failed after PublishedTo.
+type PGPKey struct {
+	SignerID     string    `json:"signer_id"`
+	Fingerprint  string    `json:"fingerprint"`
+	KeyID        string    `json:"keyid"`
+	CreatedAt    time.Time `json:"created_at"`
+	PublicKey    string    `json:"public_key"`
+	PrivateKey   string    `json:"private_key"`
+	OnHSM        bool      `json:"on_hsm"`
+	PublishedTo  []string  `json:"published_to,omitempty"`
+	PublishError string    `json:"publish_error,omitempty"`
+}
+
+// EndEntity is returned by the admin API with the end-entity a
+// content signature signer signs with after an end-entity operation
+type EndEntity struct {
+	SignerID string `json:"signer_id"`
+	Label    string `json:"label"`
+	X5U      string `json:"x5u"`
+}
+
+// Promotion is returned by the admin API when a standby instance is
+// promoted to serve signing requests, with the end-entities of its
+// content signature signers after their last sync
+type Promotion struct {
+	PromotedAt  time.Time   `json:"promoted_at"`
+	EndEntities []EndEntity `json:"end_entities"`
+}
+
+// LoggingConfig is returned by the admin API with the log format and
+// level of an instance, and sent by an admin to change them. Format is
+// one of mozlog, json or text, and Level a logrus level like debug.
+type LoggingConfig struct {
+	Format string `json:"format,omitempty"`
+	Level  string `json:"level,omitempty"`
+}
@@ -0,0 +1,32 @@
+package formats
+
+// AutoscalingSignals is returned by the /__autoscaling__ endpoint for
+// autoscalers to scale instances on signing backlog rather than CPU
+type AutoscalingSignals struct {
+	// InflightRequests is the number of signing requests being
+	// processed
+	InflightRequests int `json:"inflight_requests"`
+
+	// QueuedRequests is the number of signing requests waiting
+	// for a scheduler worker
+	QueuedRequests int `json:"queued_requests"`
+
+	// Workers is the number of scheduler workers, and Utilization
+	// the ratio of running and queued requests to workers, above
+	// 1 when requests are queued. Both are omitted when the
+	// scheduler is disabled.
+	Workers     int     `json:"workers,omitempty"`
+	Utilization float64 `json:"utilization,omitempty"`
+
+	// Signers is the load of each signer by ID
+	Signers map[string]SignerLoad `json:"signers"`
+}
+
+// SignerLoad is the number of signing operations in flight on a
+// signer and, when its capacity is known, its saturation: the ratio of
+// in-flight operations to capacity
+type SignerLoad struct {
+	Inflight   int     `json:"inflight"`
+	Capacity   int     `json:"capacity,omitempty"`
+	Saturation float64 `json:"saturation,omitempty"`
+}
@@ -0,0 +1,120 @@
+package formats
+
+// ErrorCode is a stable machine-readable identifier of the reason a
+// request failed. Clients should branch on it rather than on the
+// error message, which is meant for humans and may change.
+type ErrorCode string
+
+const (
+	// ErrorCodeInvalidMethod is returned when an endpoint is called
+	// with an unsupported HTTP method
+	ErrorCodeInvalidMethod ErrorCode = "AUTOGRAPH_INVALID_METHOD"
+
+	// ErrorCodeUnauthorized is returned when the request
+	// authorization header or payload hash fails to verify
+	ErrorCodeUnauthorized ErrorCode = "AUTOGRAPH_UNAUTHORIZED"
+
+	// ErrorCodeSignerNotPermitted is returned when the requested
+	// signer doesn't exist or the user isn't allowed to use it
+	ErrorCodeSignerNotPermitted ErrorCode = "AUTOGRAPH_SIGNER_NOT_PERMITTED"
+
+	// ErrorCodeInvalidContentType is returned when the request
+	// content type isn't application/json
+	ErrorCodeInvalidContentType ErrorCode = "AUTOGRAPH_INVALID_CONTENT_TYPE"
+
+	// ErrorCodeInvalidRequest is returned when the request body
+	// cannot be read or parsed
+	ErrorCodeInvalidRequest ErrorCode = "AUTOGRAPH_INVALID_REQUEST"
+
+	// ErrorCodeRequestTooLarge is returned when the request body
+	// exceeds the maximum size
+	ErrorCodeRequestTooLarge ErrorCode = "AUTOGRAPH_REQUEST_TOO_LARGE"
+
+	// ErrorCodeInvalidInput is returned when the input of a
+	// signature request is missing or isn't valid base64
+	ErrorCodeInvalidInput ErrorCode = "AUTOGRAPH_INVALID_INPUT"
+
+	// ErrorCodeInputTooShort is returned when a signer refuses to
+	// sign an input that is too short
+	ErrorCodeInputTooShort ErrorCode = "AUTOGRAPH_INPUT_TOO_SHORT"
+
+	// ErrorCodeInputDenied is returned when the digest of the
+	// input is in the denylist of the signer, or a signer
+	// inspection refused to sign it
+	ErrorCodeInputDenied ErrorCode = "AUTOGRAPH_INPUT_DENIED"
+
+	// ErrorCodeMalformedInput is returned when a file signer
+	// rejects an input that isn't a well-formed file of the format
+	// it signs
+	ErrorCodeMalformedInput ErrorCode = "AUTOGRAPH_MALFORMED_INPUT"
+
+	// ErrorCodeUnsupportedOperation is returned when the requested
+	// signer doesn't implement hash, data or file signing
+	ErrorCodeUnsupportedOperation ErrorCode = "AUTOGRAPH_UNSUPPORTED_OPERATION"
+
+	// ErrorCodeSignerUnavailable is returned when a lazy or
+	// degraded signer failed to initialize, or when too few key
+	// shares of a threshold signer are available
+	ErrorCodeSignerUnavailable ErrorCode = "AUTOGRAPH_SIGNER_UNAVAILABLE"
+
+	// ErrorCodeSigningFailed is returned when a signer fails to
+	// sign or encode a signature
+	ErrorCodeSigningFailed ErrorCode = "AUTOGRAPH_SIGNING_FAILED"
+
+	// ErrorCodeHSMUnavailable is returned when the HSM fails to
+	// perform an operation
+	ErrorCodeHSMUnavailable ErrorCode = "AUTOGRAPH_HSM_UNAVAILABLE"
+
+	// ErrorCodeTimeout is returned when the request deadline passed
+	// before signing completed
+	ErrorCodeTimeout ErrorCode = "AUTOGRAPH_TIMEOUT"
+
+	// ErrorCodeCanceled is returned when the client canceled the
+	// request before signing completed
+	ErrorCodeCanceled ErrorCode = "AUTOGRAPH_CANCELED"
+
+	// ErrorCodeNotFound is returned when a requested resource
+	// doesn't exist
+	ErrorCodeNotFound ErrorCode = "AUTOGRAPH_NOT_FOUND"
+
+	// ErrorCodeTooManyRequests is returned when the user already
+	// has as many requests in flight as they are allowed
+	ErrorCodeTooManyRequests ErrorCode = "AUTOGRAPH_TOO_MANY_REQUESTS"
+
+	// ErrorCodeOverloaded is returned when a request is shed
+	// because too many requests are waiting to be processed
+	ErrorCodeOverloaded ErrorCode = "AUTOGRAPH_OVERLOADED"
+
+	// ErrorCodeLockedOut is returned when a credential or client
+	// address is locked out after repeated authentication
+	// failures
+	ErrorCodeLockedOut ErrorCode = "AUTOGRAPH_LOCKED_OUT"
+
+	// ErrorCodeRequestRejected is returned when a hook of the
+	// deployment rejects a signing request
+	ErrorCodeRequestRejected ErrorCode = "AUTOGRAPH_REQUEST_REJECTED"
+
+	// ErrorCodeInternal is returned for server errors that don't
+	// have a more specific code
+	ErrorCodeInternal ErrorCode = "AUTOGRAPH_INTERNAL_ERROR"
+)
+
+// Retriable returns true when a request that failed with the error
+// code may succeed if sent again unmodified
+func (c ErrorCode) Retriable() bool {
+	switch c {
+	case ErrorCodeHSMUnavailable, ErrorCodeTimeout, ErrorCodeCanceled, ErrorCodeTooManyRequests, ErrorCodeOverloaded:
+		return true
+	default:
+		return false
+	}
+}
+
+// ErrorResponse is returned by autograph to a client in the body of
+// a failed request
+type ErrorResponse struct {
+	Code      ErrorCode `json:"code"`
+	Message   string    `json:"message"`
+	Retriable bool      `json:"retriable"`
+	RequestID string    `json:"request_id"`
+}
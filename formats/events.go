@@ -0,0 +1,138 @@
+package formats
+
+import "time"
+
+const (
+	// EventTypeSignature is the type of the events exported for
+	// each signing operation
+	EventTypeSignature = "signature"
+
+	// EventTypeAudit is the type of the events exported for each
+	// admin API request
+	EventTypeAudit = "audit"
+
+	// EventTypeSecurity is the type of the events of the security
+	// event log, with one of the SecurityAction actions
+	EventTypeSecurity = "security"
+
+	// EventTypeUsage is the type of the events exported every day
+	// with the usage of each signer by each user the day before
+	EventTypeUsage = "usage"
+
+	// EventTypeRevocation is the type of the events exported when
+	// an admin revokes a signature
+	EventTypeRevocation = "revocation"
+
+	// EventTypeKeyLimit is the type of the events exported when a
+	// key reaches the alert threshold or the limit of signatures
+	// of its signer
+	EventTypeKeyLimit = "key_limit"
+)
+
+// AuditActionSignerConfigChanged is the action of the audit events of
+// signers added, removed or changed in the configuration since the
+// last instance started
+const AuditActionSignerConfigChanged = "signer_config_changed"
+
+// SecurityEventSchemaVersion is the version of the schema of security
+// events. Fields are only added to a version, and it changes when
+// fields are removed or their meaning changes.
+const SecurityEventSchemaVersion = 1
+
+// The actions of security events
+const (
+	// SecurityActionAuthenticationFailed is a request whose
+	// credentials failed verification
+	SecurityActionAuthenticationFailed = "authentication_failed"
+
+	// SecurityActionLockedOut is a credential or client address
+	// locked out after repeated authentication failures
+	SecurityActionLockedOut = "authentication_locked_out"
+
+	// SecurityActionAuthorizationDenied is an authenticated user
+	// or frontend that isn't allowed to use a signer or endpoint
+	SecurityActionAuthorizationDenied = "authorization_denied"
+
+	// SecurityActionPolicyRejected is a signing request refused by
+	// a denylist or signer policy
+	SecurityActionPolicyRejected = "policy_rejected"
+
+	// SecurityActionAdminAction is an authorized admin API request
+	SecurityActionAdminAction = "admin_action"
+
+	// SecurityActionKeyRotated is a key or credential added or
+	// retired by an admin
+	SecurityActionKeyRotated = "key_rotated"
+)
+
+// ExportedEvent is the JSON format of the signing and audit events
+// autograph streams to external sinks such as SIEM pipelines
+type ExportedEvent struct {
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	RequestID string    `json:"request_id,omitempty"`
+	UserID    string    `json:"user_id,omitempty"`
+
+	// SignerID, Endpoint, Ref, InputHash and OutputHash are set
+	// on signature events, with the hashes of the signing logs
+	SignerID   string `json:"signer_id,omitempty"`
+	Endpoint   string `json:"endpoint,omitempty"`
+	Ref        string `json:"ref,omitempty"`
+	InputHash  string `json:"input_hash,omitempty"`
+	OutputHash string `json:"output_hash,omitempty"`
+
+	// Metadata is set on signature events to the metadata the
+	// client attached to the signature request
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Digest and Reason are set on revocation events to the
+	// revoked digest, if any, and why the signature was revoked.
+	// Ref is set when the signature was revoked by reference.
+	Digest string `json:"digest,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	// Action is set on audit events to the method and path of the
+	// admin API request, like "POST /admin/signers/foo/denylist",
+	// and on security events to what happened, like
+	// "authentication_failed"
+	Action string `json:"action,omitempty"`
+
+	// SourceIP and Message are set on security events to the
+	// address of the client and a description of the event.
+	// Security events of requests also set RequestID, Endpoint,
+	// and SignerID when the event concerns a signer.
+	SourceIP string `json:"source_ip,omitempty"`
+	Message  string `json:"message,omitempty"`
+
+	// SchemaVersion is set on security events to
+	// SecurityEventSchemaVersion
+	SchemaVersion int `json:"schema_version,omitempty"`
+
+	// Usage is set on usage events
+	Usage *UsageReport `json:"usage,omitempty"`
+
+	// KeyCounter is set on key limit events, with Message
+	// describing the limit reached
+	KeyCounter *KeyCounter `json:"key_counter,omitempty"`
+
+	// ConfigChange is set on the audit events of signer
+	// configuration changes
+	ConfigChange *SignerConfigChange `json:"config_change,omitempty"`
+}
+
+// SignerConfigChange is the difference between the configuration of a
+// signer and the last one seen. Change is "added", "removed" or
+// "changed", and Fields lists the fields that differ. Secrets like
+// private keys are compared by their fingerprints.
+type SignerConfigChange struct {
+	Change string              `json:"change"`
+	Fields []ConfigFieldChange `json:"fields,omitempty"`
+}
+
+// ConfigFieldChange is a field of a signer configuration that was
+// set, unset or changed
+type ConfigFieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
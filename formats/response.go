@@ -0,0 +1,18 @@
+package formats
+
+// HeaderResponseSignature is the header of autograph responses holding
+// a detached JWS of the response body, when response signing is enabled
+const HeaderResponseSignature = "X-Autograph-Response-Signature"
+
+// ResponseSigningKey is returned by the /response-signing-key
+// endpoint with the public key verifying the signatures of responses
+type ResponseSigningKey struct {
+	// KeyID is the kid of the JWS header of signed responses
+	KeyID string `json:"kid"`
+
+	// Algorithm is the JWS algorithm of the key, like ES256
+	Algorithm string `json:"alg"`
+
+	// PublicKey is the base64 DER PKIX public key
+	PublicKey string `json:"public_key"`
+}
@@ -1,12 +1,41 @@
 package formats
 
+import "time"
+
+// SignatureResponseSchemaVersion is the version of the format of
+// SignatureResponse. It is incremented when fields are removed or
+// change meaning.
+const SignatureResponseSchemaVersion = 1
+
 // SignatureRequest is sent by a client to request a signature on input data
 type SignatureRequest struct {
 	Input   string `json:"input"`
 	KeyID   string `json:"keyid,omitempty"`
 	Options interface{}
+
+	// ArtifactName is an optional name of the signed file, like a
+	// release file name, stored in the signed artifact registry
+	ArtifactName string `json:"artifact_name,omitempty"`
+
+	// Nonce is an optional base64 challenge of the client that
+	// /sign/data binds the signature to, see
+	// signer.NonceBoundInput
+	Nonce string `json:"nonce,omitempty"`
+
+	// Metadata is optional opaque data of the client, like the
+	// build ID or VCS revision of the artifact, recorded with the
+	// signature and echoed in the response
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Encoding is an optional extra encoding of the signature to
+	// return, like SignatureEncodingWebCrypto
+	Encoding string `json:"encoding,omitempty"`
 }
 
+// SignatureEncodingWebCrypto requests content signatures in the
+// format of the browser WebCrypto API, in SignatureResponse.WebCrypto
+const SignatureEncodingWebCrypto = "webcrypto"
+
 // SignatureResponse is returned by autograph to a client with
 // a signature computed on input data
 type SignatureResponse struct {
@@ -19,4 +48,158 @@ type SignatureResponse struct {
 	SignedFile string      `json:"signed_file,omitempty"`
 	X5U        string      `json:"x5u,omitempty"`
 	SignerOpts interface{} `json:"signer_opts,omitempty"`
+	Artifacts  []Artifact  `json:"artifacts,omitempty"`
+
+	// Nonce echoes the nonce of the request the signature is
+	// bound to
+	Nonce string `json:"nonce,omitempty"`
+
+	// Metadata echoes the metadata of the request
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// WebCrypto is the signature in the format of the browser
+	// WebCrypto API, when the request asked for it
+	WebCrypto *WebCryptoSignature `json:"webcrypto,omitempty"`
+}
+
+// WebCryptoSignature is a signature that the verify function of the
+// browser WebCrypto API takes as is. WebCrypto hashes the data itself,
+// so clients verify the signature on DataPrefix followed by the data.
+type WebCryptoSignature struct {
+	// Signature is the base64 encoded raw r||s ECDSA signature
+	Signature string `json:"signature"`
+
+	// PublicKey is the base64 encoded DER SubjectPublicKeyInfo
+	// to import with the "spki" format of importKey
+	PublicKey string `json:"public_key"`
+
+	Algorithm WebCryptoAlgorithm `json:"algorithm"`
+
+	// DataPrefix is the base64 encoded template the signer
+	// prepends to the data before signing it
+	DataPrefix string `json:"data_prefix"`
+}
+
+// WebCryptoAlgorithm holds the parameters of the WebCrypto API to
+// import the public key and verify the signature with
+type WebCryptoAlgorithm struct {
+	Name       string `json:"name"`
+	NamedCurve string `json:"namedCurve"`
+	Hash       string `json:"hash"`
+}
+
+// SignatureStreamEvent is a line of a batch signature response
+// streamed as NDJSON, or the data of a server-sent event, sent as soon
+// as the signature request at Index completes. Either Response or
+// Error is set, and an error ends the stream.
+type SignatureStreamEvent struct {
+	Index    int                `json:"index"`
+	Response *SignatureResponse `json:"response,omitempty"`
+	Error    *ErrorResponse     `json:"error,omitempty"`
+}
+
+// Artifact is a named output returned alongside a signed file, such
+// as a detached signature or an APK v4 .idsig file
+type Artifact struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Data        string `json:"data"`
+}
+
+// ArchiveSignatureRequest is sent by a client to sign the files of a
+// tar, gzipped tar or zip archive in a single request
+type ArchiveSignatureRequest struct {
+	// Input is the base64 encoded archive
+	Input string `json:"input"`
+
+	// Manifest maps archive paths to the signer to use. Each
+	// archive file is signed by the first entry whose path
+	// pattern matches it. Files that match no entry are copied
+	// unchanged.
+	Manifest []ArchiveManifestEntry `json:"manifest"`
+}
+
+// ArchiveManifestEntry assigns a signer to archive paths matching a
+// pattern in the syntax of path.Match, e.g. "bin/*.apk"
+type ArchiveManifestEntry struct {
+	Path    string      `json:"path"`
+	KeyID   string      `json:"keyid"`
+	Options interface{} `json:"options,omitempty"`
+}
+
+// ArchiveSignatureResponse is returned by autograph to a client with
+// the repacked archive and a description of each signed file
+type ArchiveSignatureResponse struct {
+	Ref        string                 `json:"ref"`
+	SignedFile string                 `json:"signed_file"`
+	Entries    []ArchiveEntryResponse `json:"entries"`
+}
+
+// ArchiveEntryResponse describes how an archive file was signed.
+// Outputs lists the archive paths written for it: the signed file
+// for file signers, detached signatures for data signers and any
+// sidecar artifacts.
+type ArchiveEntryResponse struct {
+	Path     string   `json:"path"`
+	SignerID string   `json:"signer_id"`
+	Type     string   `json:"type"`
+	Mode     string   `json:"mode"`
+	Outputs  []string `json:"outputs"`
+}
+
+// ChecksumsSignatureRequest is sent by a client to generate and sign
+// a SHA256SUMS manifest of release files. Files are either listed
+// with their digests or read from a base64 encoded archive.
+type ChecksumsSignatureRequest struct {
+	Files  []ChecksumsFile `json:"files,omitempty"`
+	Input  string          `json:"input,omitempty"`
+	KeyIDs []string        `json:"keyids"`
+}
+
+// ChecksumsFile is the name and hex encoded SHA256 digest of a file
+type ChecksumsFile struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+}
+
+// ChecksumsSignatureResponse is returned by autograph to a client
+// with the SHA256SUMS manifest and its signatures
+type ChecksumsSignatureResponse struct {
+	Ref        string              `json:"ref"`
+	Manifest   string              `json:"manifest"`
+	Signatures []SignatureResponse `json:"signatures"`
+}
+
+// VerificationRequest is sent by a client to verify the signatures of
+// a signed file, optionally against the certificate of a signer or the
+// roots of an environment
+type VerificationRequest struct {
+	Input string `json:"input"`
+	KeyID string `json:"keyid,omitempty"`
+
+	// Roots is the name of a configured root set, like "prod",
+	// the signer certificates of the file must be anchored in
+	Roots string `json:"roots,omitempty"`
+}
+
+// VerificationResponse is returned by autograph with the result of
+// the verification of a signed file
+type VerificationResponse struct {
+	Ref          string               `json:"ref"`
+	Valid        bool                 `json:"valid"`
+	Error        string               `json:"error,omitempty"`
+	Schemes      []string             `json:"schemes,omitempty"`
+	Certificates []CertificateSummary `json:"certificates,omitempty"`
+	SignerID     string               `json:"signer_id,omitempty"`
+	Roots        string               `json:"roots,omitempty"`
+}
+
+// CertificateSummary describes a certificate that signed a file
+type CertificateSummary struct {
+	Subject      string    `json:"subject"`
+	Issuer       string    `json:"issuer"`
+	SerialNumber string    `json:"serial_number"`
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+	SHA256       string    `json:"sha256"`
 }
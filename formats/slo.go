@@ -0,0 +1,41 @@
+package formats
+
+// SignerSLO is returned by the /__slo__ endpoint with the objectives
+// of a signer and how much of their error budget it used over each
+// rolling window
+type SignerSLO struct {
+	SignerID string `json:"signer_id"`
+
+	// AvailabilityTarget is the share of signing operations that
+	// must not fail with a server error, like 0.999
+	AvailabilityTarget float64 `json:"availability_target"`
+
+	// LatencyThreshold is the duration, like "500ms", successful
+	// operations must complete in, and LatencyTarget the share of
+	// them that must
+	LatencyThreshold string  `json:"latency_threshold"`
+	LatencyTarget    float64 `json:"latency_target"`
+
+	Windows []SLOWindow `json:"windows"`
+}
+
+// SLOWindow is the compliance of a signer with its objectives over a
+// rolling window, like "1h". The budget remaining is the share of the
+// errors or slow operations the objective allows in the window that
+// are left, and is negative once the objective is missed. The burn
+// rate is how fast the budget is used: above 1, the budget runs out
+// before the end of the window.
+type SLOWindow struct {
+	Window     string `json:"window"`
+	Operations int64  `json:"operations"`
+	Errors     int64  `json:"errors"`
+	Slow       int64  `json:"slow"`
+
+	Availability                float64 `json:"availability"`
+	AvailabilityBudgetRemaining float64 `json:"availability_budget_remaining"`
+	AvailabilityBurnRate        float64 `json:"availability_burn_rate"`
+
+	LatencyCompliance      float64 `json:"latency_compliance"`
+	LatencyBudgetRemaining float64 `json:"latency_budget_remaining"`
+	LatencyBurnRate        float64 `json:"latency_burn_rate"`
+}
@@ -0,0 +1,72 @@
+package formats
+
+import "encoding/json"
+
+const (
+	// WorkerOperationHash signs a hash like the /sign/hash endpoint
+	WorkerOperationHash = "hash"
+
+	// WorkerOperationData signs data like the /sign/data endpoint
+	WorkerOperationData = "data"
+
+	// WorkerOperationFile signs a file like the /sign/file endpoint
+	WorkerOperationFile = "file"
+)
+
+// WorkerSigner describes a signer of a signing worker to the
+// frontends of a split deployment, which serve the API without
+// access to keys
+type WorkerSigner struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Mode       string          `json:"mode,omitempty"`
+	Hash       string          `json:"hash,omitempty"`
+	PublicKey  string          `json:"public_key,omitempty"`
+	X5U        string          `json:"x5u,omitempty"`
+	SignerOpts json.RawMessage `json:"signer_opts,omitempty"`
+
+	// HashSigning, DataSigning and FileSigning are the
+	// operations the signer supports
+	HashSigning bool `json:"hash_signing"`
+	DataSigning bool `json:"data_signing"`
+	FileSigning bool `json:"file_signing"`
+
+	// TestFile is the file the monitor signs with signers that
+	// only sign files
+	TestFile []byte `json:"test_file,omitempty"`
+}
+
+// WorkerSignRequest is sent by a frontend to a signing worker to sign
+// an input with one of its signers
+type WorkerSignRequest struct {
+	// RequestID is the ID of the frontend request, for logging
+	RequestID string `json:"request_id,omitempty"`
+
+	SignerID  string          `json:"signer_id"`
+	Operation string          `json:"operation"`
+	Input     []byte          `json:"input"`
+	Options   json.RawMessage `json:"options,omitempty"`
+
+	// DefaultOptions signs with the default options of the
+	// signer instead of Options
+	DefaultOptions bool `json:"default_options,omitempty"`
+
+	// AllowedAddOnIDs limits the add-on IDs XPI signers sign to
+	// the ones the frontend user is allowed to sign
+	AllowedAddOnIDs []string `json:"allowed_addon_ids,omitempty"`
+
+	// AllowedChannels limits the release channels MAR signers
+	// sign with to the ones the frontend user is allowed
+	AllowedChannels []string `json:"allowed_channels,omitempty"`
+}
+
+// WorkerSignResponse is returned by a signing worker with the
+// marshaled signature or the signed file and its artifacts. X5U is
+// the current certificate chain URL of the signer, which changes when
+// signers rotate their end-entity.
+type WorkerSignResponse struct {
+	Signature  string     `json:"signature,omitempty"`
+	SignedFile []byte     `json:"signed_file,omitempty"`
+	Artifacts  []Artifact `json:"artifacts,omitempty"`
+	X5U        string     `json:"x5u,omitempty"`
+}
@@ -18,9 +18,14 @@ import (
 	"path"
 	"time"
 
+	"github.com/miekg/pkcs11"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/hooks"
 	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/autograph/signer/mar"
+	"go.mozilla.org/autograph/signer/xpi"
 )
 
 // heartbeatConfig configures the heartbeat handler. It sets timeouts
@@ -31,6 +36,11 @@ type heartbeatConfig struct {
 	HSMCheckTimeout time.Duration
 	DBCheckTimeout  time.Duration
 
+	// X5UCheckInterval is how often the chains of signers are
+	// downloaded again from their x5u and checked, and the invalid
+	// ones reported by the heartbeat. Zero disables the checks.
+	X5UCheckInterval time.Duration
+
 	// hsmSignerConf is the signer conf to use to check
 	// HSM connectivity (set to the first signer with an HSM label
 	// in initHSM) when it is non-nil
@@ -45,42 +55,35 @@ func hashSHA256AsHex(toHash []byte) string {
 	return fmt.Sprintf("%X", h.Sum(nil))
 }
 
-// handleSignature endpoint accepts a list of signature requests in a HAWK authenticated POST request
-// and calls the signers to generate signature responses.
-func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
-	rid := getRequestID(r)
+// authorizeRequestBody authenticates a POST request, reads its JSON
+// body and verifies it, like the hawk payload hash. It writes
+// an error to the client and returns false when any check fails.
+func (a *autographer) authorizeRequestBody(w http.ResponseWriter, r *http.Request) (userid string, body []byte, ok bool) {
 	starttime := getRequestStartTime(r)
-	auth, userid, err := a.authorizeHeader(r)
+	userid, verifyBody, err := a.authenticate(r)
 	if err != nil {
-		if a.stats != nil {
-			sendStatsErr := a.stats.Timing("hawk.authorize_header_failed", time.Since(starttime), nil, 1.0)
-			if sendStatsErr != nil {
-				log.Warnf("Error sending hawk.authorize_header_failed: %s", sendStatsErr)
-			}
-		}
-		httpError(w, r, http.StatusUnauthorized, "authorization verification failed: %v", err)
+		authError(w, r, err)
 		return
 	}
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		httpError(w, r, http.StatusBadRequest, "failed to read request body: %s", err)
+	body, read := a.readRequestBody(w, r)
+	if !read {
 		return
 	}
 	if r.Header.Get("Content-Type") != "application/json" {
-		httpError(w, r, http.StatusBadRequest, "invalid content type, expected application/json")
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidContentType, "invalid content type, expected application/json")
 		return
 	}
 	if len(body) < 10 {
 		// it's impossible to have a valid request body smaller than 10 bytes
-		httpError(w, r, http.StatusBadRequest, "empty or invalid request request body")
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "empty or invalid request request body")
 		return
 	}
-	if len(body) > 1048576000 {
-		// the max body size is hardcoded to 1GB. Seriously, what are you trying to sign?
-		httpError(w, r, http.StatusBadRequest, "request exceeds max size of 1GB")
+	// the hawk payload hash covers the decoded JSON body
+	body, read = a.decodeRequestBody(w, r, body)
+	if !read {
 		return
 	}
-	err = a.authorizeBody(auth, r, body)
+	err = verifyBody(body)
 	if a.stats != nil {
 		sendStatsErr := a.stats.Timing("authorize_finished", time.Since(starttime), nil, 1.0)
 		if sendStatsErr != nil {
@@ -88,11 +91,57 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if err != nil {
-		httpError(w, r, http.StatusUnauthorized, "authorization verification failed: %v", err)
+		authError(w, r, err)
+		return
+	}
+	return userid, body, true
+}
+
+// requestContext returns the context of a request bounded by the
+// configured request timeout, if any
+func (a *autographer) requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if a.requestTimeout > 0 {
+		return context.WithTimeout(r.Context(), a.requestTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// withAddOnIDs limits the add-on IDs XPI signers sign in a request
+// context to the ones the user is allowed to sign, if restricted
+func (a *autographer) withAddOnIDs(ctx context.Context, userid string) context.Context {
+	auth, err := a.getAuthByID(userid)
+	if err != nil || len(auth.AddOnIDs) == 0 {
+		return ctx
+	}
+	return xpi.WithAllowedIDs(ctx, auth.AddOnIDs)
+}
+
+// withMARChannels limits the release channels MAR signers sign with in
+// a request context to the ones the user is allowed, if restricted
+func (a *autographer) withMARChannels(ctx context.Context, userid string) context.Context {
+	auth, err := a.getAuthByID(userid)
+	if err != nil || len(auth.MARChannels) == 0 {
+		return ctx
+	}
+	return mar.WithAllowedChannels(ctx, auth.MARChannels)
+}
+
+// handleSignature endpoint accepts a list of signature requests in a HAWK authenticated POST request
+// and calls the signers to generate signature responses.
+func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
+	rid := getRequestID(r)
+	starttime := getRequestStartTime(r)
+	userid, body, ok := a.authorizeRequestBody(w, r)
+	if !ok {
+		return
+	}
+	release, ok := a.admitRequest(w, r, userid)
+	if !ok {
 		return
 	}
+	defer release()
 	var sigreqs []formats.SignatureRequest
-	err = json.Unmarshal(body, &sigreqs)
+	err := json.Unmarshal(body, &sigreqs)
 	if a.stats != nil {
 		sendStatsErr := a.stats.Timing("body_unmarshaled", time.Since(starttime), nil, 1.0)
 		if sendStatsErr != nil {
@@ -100,44 +149,127 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if err != nil {
-		httpError(w, r, http.StatusBadRequest, "failed to parse request body: %v", err)
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "failed to parse request body: %v", err)
 		return
 	}
+	preValidate := hooks.Event{Stage: hooks.PreValidate, UserID: userid, SignatureRequests: sigreqs}
+	if !a.runSignHooks(r.Context(), w, r, &preValidate) {
+		return
+	}
+	sigreqs = preValidate.SignatureRequests
 	for i, sigreq := range sigreqs {
 		if sigreq.Input == "" {
-			httpError(w, r, http.StatusBadRequest, fmt.Sprintf("missing input in signature request %d", i))
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidInput, "missing input in signature request %d", i)
+			return
+		}
+		err = validateMetadata(sigreq.Metadata)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "invalid metadata in signature request %d: %v", i, err)
+			return
+		}
+		if sigreq.Encoding != "" {
+			if sigreq.Encoding != formats.SignatureEncodingWebCrypto {
+				httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "unknown encoding %q in signature request %d", sigreq.Encoding, i)
+				return
+			}
+			// WebCrypto hashes the data itself, so it can't
+			// verify signatures of hashes
+			if r.URL.RequestURI() != "/sign/data" {
+				httpError(w, r, http.StatusBadRequest, formats.ErrorCodeUnsupportedOperation, "encodings are only supported by /sign/data")
+				return
+			}
 		}
 	}
 	if a.debug {
 		fmt.Printf("signature request\n-----------------\n%s\n", body)
 	}
+	ctx, cancel := a.requestContext(r)
+	defer cancel()
+	ctx = a.withAddOnIDs(ctx, userid)
+	ctx = a.withMARChannels(ctx, userid)
+	// clients that accept NDJSON or server-sent events get each
+	// response as soon as it completes
+	var stream *resultStream
+	if contentType := streamContentType(r); contentType != "" {
+		stream = newResultStream(w, contentType)
+		w = stream
+	}
+	truncateResponse := false
 	sigresps := make([]formats.SignatureResponse, len(sigreqs))
 	// Each signature requested in the http request body is processed individually.
 	// For each, a signer is looked up, and used to compute a raw signature
 	// the signature is then encoded appropriately, and added to the response slice
 	for i, sigreq := range sigreqs {
+		if stream != nil {
+			stream.index = i
+		}
 		var (
 			input                 []byte
 			sig                   signer.Signature
 			signedfile            []byte
 			inputHash, outputHash string
+			releaseInput          func()
 		)
 
-		// Decode the base64 input data
-		input, err = base64.StdEncoding.DecodeString(sigreq.Input)
+		// Decode the base64 input data into a pooled buffer,
+		// reused once the signature request is processed
+		input, releaseInput, err = decodeBase64Input(ctx, sigreq.Input)
 		if err != nil {
-			httpError(w, r, http.StatusBadRequest, "%v", err)
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidInput, "%v", err)
 			return
 		}
+		defer releaseInput()
 
 		// returns an error if the signer is not found or if
 		// the user is not allowed to use this signer
 		requestedSigner, err := a.authBackend.getSignerForUser(userid, sigreq.KeyID)
 		if err != nil {
-			httpError(w, r, http.StatusUnauthorized, "%v", err)
+			a.authorizationDenied(w, r, http.StatusUnauthorized, formats.ErrorCodeSignerNotPermitted, userid, sigreq.KeyID, err)
+			return
+		}
+		requestedSigner, err = resolveSigner(requestedSigner)
+		if err != nil {
+			httpError(w, r, http.StatusServiceUnavailable, formats.ErrorCodeSignerUnavailable, "%v", err)
 			return
 		}
 		requestedSignerConfig := requestedSigner.Config()
+		if !a.checkDenylist(w, r, userid, requestedSignerConfig.ID, r.URL.RequestURI(), input) {
+			return
+		}
+		// counted until the request completes
+		defer a.load.startSigning(requestedSignerConfig.ID)()
+		truncate, ok := a.injectFaults(ctx, w, r, requestedSignerConfig.ID)
+		if !ok {
+			return
+		}
+		truncateResponse = truncateResponse || truncate
+		signedInput := input
+		if sigreq.Nonce != "" {
+			if r.URL.RequestURI() != "/sign/data" {
+				httpError(w, r, http.StatusBadRequest, formats.ErrorCodeUnsupportedOperation, "nonces are only supported by /sign/data")
+				return
+			}
+			nonce, err := base64.StdEncoding.DecodeString(sigreq.Nonce)
+			if err != nil {
+				httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidInput, "failed to decode nonce: %v", err)
+				return
+			}
+			signedInput, err = signer.NonceBoundInput(nonce, input)
+			if err != nil {
+				httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidInput, "%v", err)
+				return
+			}
+		}
+		if !a.runSignHooks(ctx, w, r, &hooks.Event{
+			Stage:             hooks.PreSign,
+			UserID:            userid,
+			SignatureRequests: sigreqs,
+			Index:             i,
+			SignerID:          requestedSignerConfig.ID,
+			Input:             input,
+		}) {
+			return
+		}
 		sigresps[i] = formats.SignatureResponse{
 			Ref:        id(),
 			Type:       requestedSignerConfig.Type,
@@ -147,23 +279,29 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 			SignedFile: base64.StdEncoding.EncodeToString(signedfile),
 			X5U:        requestedSignerConfig.X5U,
 			SignerOpts: requestedSignerConfig.SignerOpts,
+			Nonce:      sigreq.Nonce,
+			Metadata:   sigreq.Metadata,
 		}
 		// Make sure the signer implements the right interface, then sign the data
 		switch r.URL.RequestURI() {
 		case "/sign/hash":
 			hashSigner, ok := requestedSigner.(signer.HashSigner)
 			if !ok {
-				httpError(w, r, http.StatusBadRequest, "requested signer does not implement hash signing")
+				httpError(w, r, http.StatusBadRequest, formats.ErrorCodeUnsupportedOperation, "requested signer does not implement hash signing")
 				return
 			}
-			sig, err = hashSigner.SignHash(input, sigreq.Options)
+			sig, err = signer.SignHashContext(ctx, hashSigner, input, sigreq.Options)
 			if err != nil {
-				httpError(w, r, http.StatusInternalServerError, "signing failed with error: %v", err)
+				a.recordUsage(requestedSignerConfig.ID, userid, len(input), true)
+				status, code := signingError(ctx, err)
+				a.signingRejected(r, code, userid, requestedSignerConfig.ID, err)
+				a.recordSLO(r, requestedSignerConfig.ID, code)
+				httpError(w, r, status, code, "signing failed with error: %v", err)
 				return
 			}
 			sigresps[i].Signature, err = sig.(signer.Signature).Marshal()
 			if err != nil {
-				httpError(w, r, http.StatusInternalServerError, "encoding failed with error: %v", err)
+				httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeSigningFailed, "encoding failed with error: %v", err)
 				return
 			}
 			// the input is already a hash just convert it to hex
@@ -172,37 +310,76 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 		case "/sign/data":
 			dataSigner, ok := requestedSigner.(signer.DataSigner)
 			if !ok {
-				httpError(w, r, http.StatusBadRequest, "requested signer does not implement data signing")
+				httpError(w, r, http.StatusBadRequest, formats.ErrorCodeUnsupportedOperation, "requested signer does not implement data signing")
 				return
 			}
-			sig, err = dataSigner.SignData(input, sigreq.Options)
+			sig, err = signer.SignDataContext(ctx, dataSigner, signedInput, sigreq.Options)
 			if err != nil {
-				httpError(w, r, http.StatusInternalServerError, "signing failed with error: %v", err)
+				a.recordUsage(requestedSignerConfig.ID, userid, len(input), true)
+				status, code := signingError(ctx, err)
+				a.signingRejected(r, code, userid, requestedSignerConfig.ID, err)
+				a.recordSLO(r, requestedSignerConfig.ID, code)
+				httpError(w, r, status, code, "signing failed with error: %v", err)
 				return
 			}
 			sigresps[i].Signature, err = sig.(signer.Signature).Marshal()
 			if err != nil {
-				httpError(w, r, http.StatusInternalServerError, "encoding failed with error: %v", err)
+				httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeSigningFailed, "encoding failed with error: %v", err)
 				return
 			}
+			if sigreq.Encoding == formats.SignatureEncodingWebCrypto {
+				sigresps[i].WebCrypto, err = encodeWebCrypto(sig)
+				if err != nil {
+					httpError(w, r, http.StatusBadRequest, formats.ErrorCodeUnsupportedOperation, "%v", err)
+					return
+				}
+			}
 			// calculate a hash of the input to store in the signing logs
 			inputHash = hashSHA256AsHex(input)
 			outputHash = hashSHA256AsHex([]byte(sigresps[i].Signature))
 		case "/sign/file":
 			fileSigner, ok := requestedSigner.(signer.FileSigner)
 			if !ok {
-				httpError(w, r, http.StatusBadRequest, "requested signer does not implement file signing")
+				httpError(w, r, http.StatusBadRequest, formats.ErrorCodeUnsupportedOperation, "requested signer does not implement file signing")
 				return
 			}
-			signedfile, err = fileSigner.SignFile(input, sigreq.Options)
+			var artifacts []signer.Artifact
+			if artifactsSigner, ok := requestedSigner.(signer.ArtifactsFileSigner); ok {
+				signedfile, artifacts, err = artifactsSigner.SignFileArtifacts(ctx, input, sigreq.Options)
+			} else {
+				signedfile, err = signer.SignFileContext(ctx, fileSigner, input, sigreq.Options)
+			}
 			if err != nil {
-				httpError(w, r, http.StatusInternalServerError, "signing failed with error: %v", err)
+				a.recordUsage(requestedSignerConfig.ID, userid, len(input), true)
+				status, code := signingError(ctx, err)
+				a.signingRejected(r, code, userid, requestedSignerConfig.ID, err)
+				a.recordSLO(r, requestedSignerConfig.ID, code)
+				httpError(w, r, status, code, "signing failed with error: %v", err)
 				return
 			}
 			sigresps[i].SignedFile = base64.StdEncoding.EncodeToString(signedfile)
+			for _, artifact := range artifacts {
+				sigresps[i].Artifacts = append(sigresps[i].Artifacts, formats.Artifact{
+					Name:        artifact.Name,
+					ContentType: artifact.ContentType,
+					Data:        base64.StdEncoding.EncodeToString(artifact.Data),
+				})
+			}
 			// calculate a hash of the input to store in the signing logs
 			inputHash = hashSHA256AsHex(input)
 			outputHash = hashSHA256AsHex(signedfile)
+			a.registerArtifact(r, sigresps[i].Ref, sigresps[i].SignerID, userid, sigreq.ArtifactName, sigreq.Metadata, input, signedfile)
+		}
+		if keyer, ok := requestedSigner.(signer.OptionsPublicKeyer); ok {
+			// the options selected the key that signed
+			sigresps[i].PublicKey, err = keyer.PublicKeyForOptions(sigreq.Options)
+			if err != nil {
+				httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeSigningFailed, "failed to get public key: %v", err)
+				return
+			}
+		}
+		if sigresps[i].WebCrypto != nil {
+			sigresps[i].WebCrypto.PublicKey = sigresps[i].PublicKey
 		}
 		log.WithFields(log.Fields{
 			"rid":         rid,
@@ -214,27 +391,133 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 			"input_hash":  inputHash,
 			"output_hash": outputHash,
 			"user_id":     userid,
+			"metadata":    sigreq.Metadata,
 			"t":           int32(time.Since(starttime) / time.Millisecond), //  request processing time in ms
 		}).Info("signing operation succeeded")
+		a.exportSignature(r, userid, sigresps[i].SignerID, sigresps[i].Ref, inputHash, outputHash, sigreq.Metadata)
+		a.recordUsage(sigresps[i].SignerID, userid, len(input), false)
+		a.countKeySignature(requestedSignerConfig, sig)
+		a.recordSLO(r, sigresps[i].SignerID, "")
+		// recordings are replayed without the nonce, so they
+		// hold the nonce bound input the signer signed
+		a.recordSignatureRequest(r, userid, sigreq, sigresps[i], signedInput, signedfile)
+		if !a.runSignHooks(ctx, w, r, &hooks.Event{
+			Stage:             hooks.PostSign,
+			UserID:            userid,
+			SignatureRequests: sigreqs,
+			Index:             i,
+			SignerID:          sigresps[i].SignerID,
+			Input:             input,
+			SignatureResponse: &sigresps[i],
+		}) {
+			return
+		}
+		// the next signature request reuses the input buffer
+		releaseInput()
+		if stream != nil {
+			err = stream.writeResponse(i, &sigresps[i], truncate)
+			if err != nil {
+				log.WithFields(log.Fields{"rid": rid}).Errorf("failed to stream signature response: %v", err)
+				return
+			}
+			// the client has the response, don't hold it
+			// until the batch completes
+			sigresps[i] = formats.SignatureResponse{}
+		}
+	}
+	if stream != nil {
+		// an empty batch streams no events
+		stream.start()
+		log.WithFields(log.Fields{"rid": rid}).Info("signing request completed successfully")
+		return
 	}
 	respdata, err := json.Marshal(sigresps)
 	if err != nil {
-		httpError(w, r, http.StatusInternalServerError, "signing failed with error: %v", err)
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "signing failed with error: %v", err)
 		return
 	}
 	if a.debug {
 		fmt.Printf("signature response\n------------------\n%s\n", respdata)
 	}
+	if truncateResponse {
+		respdata = respdata[:len(respdata)/2]
+	}
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	w.Write(respdata)
 	log.WithFields(log.Fields{"rid": rid}).Info("signing request completed successfully")
 }
 
+// encodeWebCrypto returns a signature in the format of the browser
+// WebCrypto API, without its public key, or an error when the signer
+// makes signatures WebCrypto can't verify
+func encodeWebCrypto(sig signer.Signature) (*formats.WebCryptoSignature, error) {
+	wcSig, ok := sig.(signer.WebCryptoSignature)
+	if !ok {
+		return nil, errors.New("requested signer does not support the webcrypto encoding")
+	}
+	enc, err := wcSig.WebCrypto()
+	if err != nil {
+		return nil, err
+	}
+	return &formats.WebCryptoSignature{
+		Signature: base64.StdEncoding.EncodeToString(enc.Signature),
+		Algorithm: formats.WebCryptoAlgorithm{
+			Name:       enc.Algorithm.Name,
+			NamedCurve: enc.Algorithm.NamedCurve,
+			Hash:       enc.Algorithm.Hash,
+		},
+		DataPrefix: base64.StdEncoding.EncodeToString(enc.DataPrefix),
+	}, nil
+}
+
+// signingError returns the HTTP status and error code of a failed
+// signing operation: 504 when the request deadline passed, 503 when
+// the client canceled the request, the HSM failed or temporary storage
+// is full, 400 when the
+// signer rejected the input or options or the input file is malformed, 403 when a signer inspection
+// refused to sign it or the user isn't allowed the options, 413 when compressed input expands past the signer limit
+// and 500 otherwise
+func signingError(ctx context.Context, err error) (int, formats.ErrorCode) {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return http.StatusGatewayTimeout, formats.ErrorCodeTimeout
+	case context.Canceled:
+		return http.StatusServiceUnavailable, formats.ErrorCodeCanceled
+	}
+	switch e := errors.Cause(err).(type) {
+	case pkcs11.Error:
+		return http.StatusServiceUnavailable, formats.ErrorCodeHSMUnavailable
+	case *workerError:
+		return e.status, e.resp.Code
+	}
+	switch errors.Cause(err) {
+	case signer.ErrInputTooShort:
+		return http.StatusBadRequest, formats.ErrorCodeInputTooShort
+	case signer.ErrInvalidHashLength, signer.ErrInvalidEncoding:
+		return http.StatusBadRequest, formats.ErrorCodeInvalidInput
+	case signer.ErrMalformedInput:
+		return http.StatusBadRequest, formats.ErrorCodeMalformedInput
+	case signer.ErrInputRejected:
+		return http.StatusForbidden, formats.ErrorCodeInputDenied
+	case signer.ErrThresholdNotMet:
+		return http.StatusServiceUnavailable, formats.ErrorCodeSignerUnavailable
+	case signer.ErrTempStorageFull:
+		return http.StatusServiceUnavailable, formats.ErrorCodeOverloaded
+	case signer.ErrInvalidOptions:
+		return http.StatusBadRequest, formats.ErrorCodeInvalidRequest
+	case signer.ErrOptionNotPermitted:
+		return http.StatusForbidden, formats.ErrorCodeSignerNotPermitted
+	case signer.ErrDecompressedTooLarge:
+		return http.StatusRequestEntityTooLarge, formats.ErrorCodeRequestTooLarge
+	}
+	return http.StatusInternalServerError, formats.ErrorCodeSigningFailed
+}
+
 // handleLBHeartbeat returns a simple message indicating that the API is alive and well
 func handleLBHeartbeat(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
-		httpError(w, r, http.StatusMethodNotAllowed, "%s method not allowed; endpoint accepts GET only", r.Method)
+		httpError(w, r, http.StatusMethodNotAllowed, formats.ErrorCodeInvalidMethod, "%s method not allowed; endpoint accepts GET only", r.Method)
 		return
 	}
 	w.Write([]byte("ohai"))
@@ -245,16 +528,18 @@ func handleLBHeartbeat(w http.ResponseWriter, r *http.Request) {
 // aren't. Currently it only checks whether the HSM is accessible.
 func (a *autographer) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
-		httpError(w, r, http.StatusMethodNotAllowed, "%s method not allowed; endpoint accepts GET only", r.Method)
+		httpError(w, r, http.StatusMethodNotAllowed, formats.ErrorCodeInvalidMethod, "%s method not allowed; endpoint accepts GET only", r.Method)
 		return
 	}
 	if a.heartbeatConf == nil {
-		httpError(w, r, http.StatusInternalServerError, "Missing heartbeat config")
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "Missing heartbeat config")
 		return
 	}
 	var (
-		// a map of backing service name to up or down/inaccessible status
-		result         = map[string]bool{}
+		// a map of backing service name to up or down/inaccessible
+		// status, and of degradedSigners to the IDs of signers that
+		// failed to initialize
+		result         = map[string]interface{}{}
 		status         = http.StatusOK
 		requestContext = r.Context()
 		rid            = getRequestID(r)
@@ -295,6 +580,31 @@ func (a *autographer) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// check the RNG of the HSM returns random bytes when the HSM is
+	// accessible, since signers draw their nonces and keys from it
+	if accessible, _ := result["hsmAccessible"].(bool); accessible {
+		var (
+			err           error
+			hsmSignerConf = a.heartbeatConf.hsmSignerConf
+			rngResult     = make(chan error, 1)
+		)
+		go func() {
+			rngResult <- hsmSignerConf.CheckHSMRand()
+		}()
+		select {
+		case <-time.After(a.heartbeatConf.HSMCheckTimeout):
+			err = fmt.Errorf("Checking HSM RNG for signer %s timed out", hsmSignerConf.ID)
+		case err = <-rngResult:
+		}
+		if err == nil {
+			result["hsmRNGResponsive"] = true
+		} else {
+			log.Errorf("error checking HSM RNG for signer %s: %s", hsmSignerConf.ID, err)
+			result["hsmRNGResponsive"] = false
+			status = http.StatusInternalServerError
+		}
+	}
+
 	// check the database connection and return its status, but
 	// don't fail the heartbeat since we only care about DB
 	// connectivity on server start
@@ -316,10 +626,35 @@ func (a *autographer) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// check that frontends can reach at least one worker
+	if a.workers != nil {
+		workerCheckCtx, workerCancel := context.WithTimeout(requestContext, a.heartbeatConf.HSMCheckTimeout)
+		defer workerCancel()
+		available := a.workers.available(workerCheckCtx)
+		result["workersAvailable"] = available
+		if available == 0 {
+			log.Errorf("heartbeat found no available worker")
+			status = http.StatusInternalServerError
+		}
+	}
+
+	// report signers that failed to initialize, but don't fail the
+	// heartbeat since the other signers are still serving requests
+	if degraded := a.getDegradedSigners(); len(degraded) > 0 {
+		log.Errorf("heartbeat found degraded signers: %v", degraded)
+		result["degradedSigners"] = degraded
+	}
+
+	// report signers whose published chain was overwritten or
+	// corrupted, but don't fail the heartbeat since they still sign
+	if invalid := a.getInvalidX5Us(); len(invalid) > 0 {
+		result["invalidX5Us"] = invalid
+	}
+
 	respdata, err := json.Marshal(result)
 	if err != nil {
 		log.Errorf("heartbeat failed to marshal JSON with error: %s", err)
-		httpError(w, r, http.StatusInternalServerError, "error marshaling response JSON")
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "error marshaling response JSON")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -327,27 +662,41 @@ func (a *autographer) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 	w.Write(respdata)
 }
 
-func handleVersion(w http.ResponseWriter, r *http.Request) {
+// handleVersion returns the version.json file written at build time
+// along with the go version, enabled signer types, data format
+// versions and FIPS status of the running instance
+func (a *autographer) handleVersion(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
-		httpError(w, r, http.StatusMethodNotAllowed, "%s method not allowed; endpoint accepts GET only", r.Method)
+		httpError(w, r, http.StatusMethodNotAllowed, formats.ErrorCodeInvalidMethod, "%s method not allowed; endpoint accepts GET only", r.Method)
 		return
 	}
 	dir, err := os.Getwd()
 	if err != nil {
-		httpError(w, r, http.StatusInternalServerError, "Could not get CWD")
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "Could not get CWD")
 		return
 	}
 	filename := path.Clean(dir + string(os.PathSeparator) + "version.json")
-	f, err := os.Open(filename)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "version.json file not found")
+		return
+	}
+	var version map[string]interface{}
+	err = json.Unmarshal(data, &version)
 	if err != nil {
-		httpError(w, r, http.StatusNotFound, "version.json file not found")
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "failed to parse version.json")
 		return
 	}
-	stat, err := f.Stat()
+	rv := a.getRuntimeVersion()
+	version["go_version"] = rv.GoVersion
+	version["signer_types"] = rv.SignerTypes
+	version["schema_versions"] = rv.SchemaVersions
+	version["fips"] = rv.FIPS
+	respdata, err := json.Marshal(version)
 	if err != nil {
-		httpError(w, r, http.StatusInternalServerError, "stat failed on version.json")
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "error marshaling response JSON")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	http.ServeContent(w, r, "version.json", stat.ModTime(), f)
+	w.Write(respdata)
 }
@@ -9,6 +9,7 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/sha256"
 	"crypto/sha512"
@@ -20,6 +21,7 @@ import (
 	"hash"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -28,6 +30,7 @@ import (
 
 	"go.mozilla.org/autograph/database"
 	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
 	"go.mozilla.org/autograph/signer/apk"
 	"go.mozilla.org/autograph/signer/contentsignature"
 	"go.mozilla.org/autograph/signer/mar"
@@ -436,9 +439,9 @@ func TestHeartbeat(t *testing.T) {
 		expectedBody       string
 	}{
 		{"returns 200 for GET", `GET`, http.StatusOK, "{}"},
-		{"returns 405 for POST", `POST`, http.StatusMethodNotAllowed, "POST method not allowed; endpoint accepts GET only\r\nrequest-id: -\n"},
-		{"returns 405 for PUT", `PUT`, http.StatusMethodNotAllowed, "PUT method not allowed; endpoint accepts GET only\r\nrequest-id: -\n"},
-		{"returns 405 for HEAD", `HEAD`, http.StatusMethodNotAllowed, "HEAD method not allowed; endpoint accepts GET only\r\nrequest-id: -\n"},
+		{"returns 405 for POST", `POST`, http.StatusMethodNotAllowed, `{"code":"AUTOGRAPH_INVALID_METHOD","message":"POST method not allowed; endpoint accepts GET only","retriable":false,"request_id":"-"}`},
+		{"returns 405 for PUT", `PUT`, http.StatusMethodNotAllowed, `{"code":"AUTOGRAPH_INVALID_METHOD","message":"PUT method not allowed; endpoint accepts GET only","retriable":false,"request_id":"-"}`},
+		{"returns 405 for HEAD", `HEAD`, http.StatusMethodNotAllowed, `{"code":"AUTOGRAPH_INVALID_METHOD","message":"HEAD method not allowed; endpoint accepts GET only","retriable":false,"request_id":"-"}`},
 	}
 	for _, testcase := range TESTCASES {
 		checkHeartbeatReturnsExpectedStatusAndBody(t, testcase.name, testcase.method, testcase.expectedHTTPStatus, []byte((testcase.expectedBody)))
@@ -464,7 +467,7 @@ func TestHeartbeatChecksHSMStatusFailsWhenNotConfigured(t *testing.T) {
 	ag.heartbeatConf = nil
 
 	expectedStatus := http.StatusInternalServerError
-	expectedBody := []byte("Missing heartbeat config\r\nrequest-id: -\n")
+	expectedBody := []byte(`{"code":"AUTOGRAPH_INTERNAL_ERROR","message":"Missing heartbeat config","retriable":false,"request_id":"-"}`)
 	checkHeartbeatReturnsExpectedStatusAndBody(t, "returns 500 for GET without heartbeat config HSM", `GET`, expectedStatus, expectedBody)
 }
 
@@ -525,7 +528,7 @@ func TestVersion(t *testing.T) {
 			t.Fatal(err)
 		}
 		w := httptest.NewRecorder()
-		handleVersion(w, req)
+		ag.handleVersion(w, req)
 		if w.Code != testcase.expect {
 			t.Fatalf("test case %d failed with code %d but %d was expected",
 				i, w.Code, testcase.expect)
@@ -626,6 +629,173 @@ func TestSignerAuthorized(t *testing.T) {
 	}
 }
 
+func TestSignDataWithNonce(t *testing.T) {
+	t.Parallel()
+
+	auth := conf.Authorizations[0]
+	nonce := []byte("0123456789abcdef")
+	input := []byte("foobarbaz1234abcd")
+	sign := func(endpoint string, sigreq formats.SignatureRequest) *httptest.ResponseRecorder {
+		body, err := json.Marshal([]formats.SignatureRequest{sigreq})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar"+endpoint, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		ag.handleSignature(w, req)
+		return w
+	}
+
+	w := sign("/sign/data", formats.SignatureRequest{
+		Input: base64.StdEncoding.EncodeToString(input),
+		KeyID: auth.Signers[0],
+		Nonce: base64.StdEncoding.EncodeToString(nonce),
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("failed to sign data with a nonce: %d %s", w.Code, w.Body.String())
+	}
+	var responses []formats.SignatureResponse
+	err := json.Unmarshal(w.Body.Bytes(), &responses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responses[0].Nonce != base64.StdEncoding.EncodeToString(nonce) {
+		t.Fatalf("expected the nonce to be echoed, got %q", responses[0].Nonce)
+	}
+	bound, err := signer.NonceBoundInput(nonce, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(bound, []byte("Autograph-Nonce:30313233343536373839616263646566\x00")) {
+		t.Fatalf("unexpected nonce bound input %q", bound)
+	}
+	err = verifyContentSignature(base64.StdEncoding.EncodeToString(bound), "/sign/data", responses[0].Signature, responses[0].PublicKey)
+	if err != nil {
+		t.Fatalf("failed to verify signature of the nonce bound input: %v", err)
+	}
+	err = verifyContentSignature(base64.StdEncoding.EncodeToString(input), "/sign/data", responses[0].Signature, responses[0].PublicKey)
+	if err == nil {
+		t.Fatal("expected the signature not to cover the input without the nonce")
+	}
+
+	for i, tc := range []struct {
+		endpoint string
+		nonce    string
+		err      string
+	}{
+		{"/sign/data", "c2hvcnQ=", "nonce must be between 8 and 64 bytes"},
+		{"/sign/data", "not base64!", "failed to decode nonce"},
+		{"/sign/hash", base64.StdEncoding.EncodeToString(nonce), "nonces are only supported by /sign/data"},
+	} {
+		w = sign(tc.endpoint, formats.SignatureRequest{
+			Input: "y0hdfsN8tHlCG82JLywb4d2U+VGWWry8dzwIC3Hk6j32mryUHxUel9SWM5TWkk0d",
+			KeyID: auth.Signers[0],
+			Nonce: tc.nonce,
+		})
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tc.err) {
+			t.Fatalf("testcase %d: expected 400 with %q, got %d %s", i, tc.err, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestSignDataWebCrypto(t *testing.T) {
+	t.Parallel()
+
+	auth := conf.Authorizations[0]
+	input := []byte("foobarbaz1234abcd")
+	sign := func(endpoint string, sigreq formats.SignatureRequest) *httptest.ResponseRecorder {
+		body, err := json.Marshal([]formats.SignatureRequest{sigreq})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar"+endpoint, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		ag.handleSignature(w, req)
+		return w
+	}
+
+	for _, keyid := range []string{"appkey1", "normandy"} {
+		w := sign("/sign/data", formats.SignatureRequest{
+			Input:    base64.StdEncoding.EncodeToString(input),
+			KeyID:    keyid,
+			Encoding: formats.SignatureEncodingWebCrypto,
+		})
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s: failed to sign data: %d %s", keyid, w.Code, w.Body.String())
+		}
+		var responses []formats.SignatureResponse
+		err := json.Unmarshal(w.Body.Bytes(), &responses)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wc := responses[0].WebCrypto
+		if wc == nil {
+			t.Fatalf("%s: missing webcrypto signature in %s", keyid, w.Body.String())
+		}
+		if wc.Algorithm != (formats.WebCryptoAlgorithm{Name: "ECDSA", NamedCurve: "P-384", Hash: "SHA-384"}) {
+			t.Fatalf("%s: unexpected algorithm %+v", keyid, wc.Algorithm)
+		}
+		if wc.PublicKey != responses[0].PublicKey {
+			t.Fatalf("%s: expected public key %q, got %q", keyid, responses[0].PublicKey, wc.PublicKey)
+		}
+		// verify like crypto.subtle.verify does, on the raw
+		// signature and the prefixed data
+		der, err := base64.StdEncoding.DecodeString(wc.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs, err := base64.StdEncoding.DecodeString(wc.Signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefix, err := base64.StdEncoding.DecodeString(wc.DataPrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rs) != 96 || string(prefix) != "Content-Signature:\x00" {
+			t.Fatalf("%s: unexpected signature length %d or prefix %q", keyid, len(rs), prefix)
+		}
+		digest := sha512.Sum384(append(prefix, input...))
+		if !ecdsa.Verify(pub.(*ecdsa.PublicKey), digest[:], new(big.Int).SetBytes(rs[:48]), new(big.Int).SetBytes(rs[48:])) {
+			t.Fatalf("%s: webcrypto signature does not verify", keyid)
+		}
+	}
+
+	for i, tc := range []struct {
+		endpoint string
+		keyid    string
+		encoding string
+		err      string
+	}{
+		{"/sign/data", "appkey1", "der", "unknown encoding"},
+		{"/sign/hash", "appkey1", formats.SignatureEncodingWebCrypto, "encodings are only supported by /sign/data"},
+		{"/sign/data", "dummyrsa", formats.SignatureEncodingWebCrypto, "does not support the webcrypto encoding"},
+	} {
+		w := sign(tc.endpoint, formats.SignatureRequest{
+			Input:    "y0hdfsN8tHlCG82JLywb4d2U+VGWWry8dzwIC3Hk6j32mryUHxUel9SWM5TWkk0d",
+			KeyID:    tc.keyid,
+			Encoding: tc.encoding,
+		})
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tc.err) {
+			t.Fatalf("testcase %d: expected 400 with %q, got %d %s", i, tc.err, w.Code, w.Body.String())
+		}
+	}
+}
+
 // verify that user `bob` is not allowed to sign with `appkey1`
 func TestSignerUnauthorized(t *testing.T) {
 	t.Parallel()
@@ -666,6 +836,266 @@ func TestSignerUnauthorized(t *testing.T) {
 	}
 }
 
+func TestSignatureCanceledRequest(t *testing.T) {
+	t.Parallel()
+
+	var TESTCASES = []formats.SignatureRequest{
+		formats.SignatureRequest{
+			Input: "Y2FyaWJvdXZpbmRpZXV4Cg==",
+			KeyID: conf.Authorizations[0].Signers[0],
+		},
+	}
+	userid := conf.Authorizations[0].ID
+	body, err := json.Marshal(TESTCASES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	auth, err := ag.getAuthByID(userid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authheader := getAuthHeader(req, auth.ID, auth.Key,
+		sha256.New, id(), "application/json", body)
+	req.Header.Set("Authorization", authheader)
+	w := httptest.NewRecorder()
+	ag.handleSignature(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected canceled request to fail with %d but got %d: %s", http.StatusServiceUnavailable, w.Code, w.Body.String())
+	}
+}
+
+func TestSignatureErrorCodes(t *testing.T) {
+	t.Parallel()
+
+	var TESTCASES = []struct {
+		endpoint       string
+		keyID          string
+		input          string
+		expectedStatus int
+		expectedCode   formats.ErrorCode
+	}{
+		// "foo" is shorter than the 10 bytes content signature minimum
+		{"/sign/data", "appkey1", "Zm9v", http.StatusBadRequest, formats.ErrorCodeInputTooShort},
+		{"/sign/hash", "appkey1", "Zm9v", http.StatusBadRequest, formats.ErrorCodeInvalidInput},
+		{"/sign/data", "appkey1", "not base64!", http.StatusBadRequest, formats.ErrorCodeInvalidInput},
+		{"/sign/file", "appkey1", "Zm9vYmFyYmF6YmFy", http.StatusBadRequest, formats.ErrorCodeUnsupportedOperation},
+		// file signers reject inputs that aren't ZIP archives or MARs
+		{"/sign/file", "webextensions-rsa", "Zm9vYmFyYmF6YmFy", http.StatusBadRequest, formats.ErrorCodeMalformedInput},
+		{"/sign/file", "testapp-android", "Zm9vYmFyYmF6YmFy", http.StatusBadRequest, formats.ErrorCodeMalformedInput},
+		{"/sign/file", "testmar", "Zm9vYmFyYmF6YmFy", http.StatusBadRequest, formats.ErrorCodeMalformedInput},
+	}
+	userid := conf.Authorizations[0].ID
+	for i, testcase := range TESTCASES {
+		body, err := json.Marshal([]formats.SignatureRequest{
+			formats.SignatureRequest{
+				Input: testcase.input,
+				KeyID: testcase.keyID,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar"+testcase.endpoint, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		auth, err := ag.getAuthByID(userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authheader := getAuthHeader(req, auth.ID, auth.Key,
+			sha256.New, id(), "application/json", body)
+		req.Header.Set("Authorization", authheader)
+		w := httptest.NewRecorder()
+		ag.handleSignature(w, req)
+		if w.Code != testcase.expectedStatus {
+			t.Fatalf("test case %d expected status %d but got %d: %s", i, testcase.expectedStatus, w.Code, w.Body.String())
+		}
+		if w.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("test case %d expected a JSON error but got content type %q", i, w.Header().Get("Content-Type"))
+		}
+		var errResp formats.ErrorResponse
+		err = json.Unmarshal(w.Body.Bytes(), &errResp)
+		if err != nil {
+			t.Fatalf("test case %d failed to parse error response: %v", i, err)
+		}
+		if errResp.Code != testcase.expectedCode {
+			t.Fatalf("test case %d expected error code %q but got %q", i, testcase.expectedCode, errResp.Code)
+		}
+		if errResp.Message == "" || errResp.RequestID == "" {
+			t.Fatalf("test case %d expected an error message and request ID, got %+v", i, errResp)
+		}
+	}
+}
+
+func TestSignAddOnIDAllowlist(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(1)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	for _, s := range conf.Signers {
+		if s.ID == "webextensions-rsa" {
+			err := tmpag.addSigners([]signer.Configuration{s})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	user := authorization{
+		ID:       "addonsuser",
+		Key:      "w5ohr0gnv4s1x8c8lhfdf8u1cxbxiqkpb0zxywvd6nn9fy2a9s",
+		Signers:  []string{"webextensions-rsa"},
+		AddOnIDs: []string{"*@allowed.example.net"},
+	}
+	err := tmpag.addAuthorizations([]authorization{user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.addAuthorizations([]authorization{{ID: "badpattern", Key: "foo", Signers: user.Signers, AddOnIDs: []string{"["}}})
+	if err == nil {
+		t.Fatal("expected an invalid add-on ID pattern to fail")
+	}
+
+	for i, testcase := range []struct {
+		addonID        string
+		expectedStatus int
+	}{
+		{"test@allowed.example.net", http.StatusCreated},
+		{"test@example.net", http.StatusForbidden},
+	} {
+		body, err := json.Marshal([]formats.SignatureRequest{
+			formats.SignatureRequest{
+				Input:   "U2lnbmF0dXJlLVZlcnNpb246IDEuMApNRDUtRGlnZXN0LU1hbmlmZXN0OiA3d3RFNTF2bW00NlZQRmEvNkF0NWZ3PT0KU0hBMS1EaWdlc3QtTWFuaWZlc3Q6IEZMZEFIZHQvVjdFVHozK0JMUUtHcFFBenoyRT0KCg==",
+				KeyID:   "webextensions-rsa",
+				Options: map[string]string{"id": testcase.addonID},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, user.ID, user.Key, sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		tmpag.handleSignature(w, req)
+		if w.Code != testcase.expectedStatus {
+			t.Fatalf("test case %d expected status %d but got %d: %s", i, testcase.expectedStatus, w.Code, w.Body.String())
+		}
+		if w.Code != http.StatusForbidden {
+			continue
+		}
+		var errResp formats.ErrorResponse
+		err = json.Unmarshal(w.Body.Bytes(), &errResp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errResp.Code != formats.ErrorCodeInputDenied {
+			t.Fatalf("test case %d expected error code %q but got %q", i, formats.ErrorCodeInputDenied, errResp.Code)
+		}
+	}
+}
+
+func TestSignMARChannels(t *testing.T) {
+	t.Parallel()
+
+	channelConf := signer.Configuration{ID: "testmarchannels", Type: mar.Type}
+	var nightlyPublicKey string
+	for _, s := range conf.Signers {
+		switch s.ID {
+		case "testmar":
+			channelConf.PrivateKey = s.PrivateKey
+		case "testmarecdsa":
+			channelConf.MARChannels = []signer.MARChannel{{Name: "nightly", PrivateKey: s.PrivateKey}}
+			nightly, err := mar.New(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nightlyPublicKey = nightly.PublicKey
+		}
+	}
+	tmpag := newAutographer(1)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners([]signer.Configuration{channelConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := authorization{
+		ID:          "nightlyuser",
+		Key:         "w5ohr0gnv4s1x8c8lhfdf8u1cxbxiqkpb0zxywvd6nn9fy2a9s",
+		Signers:     []string{channelConf.ID},
+		MARChannels: []string{"nightly"},
+	}
+	err = tmpag.addAuthorizations([]authorization{user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.addAuthorizations([]authorization{{ID: "badchannel", Key: "foo", Signers: user.Signers, MARChannels: []string{"night ly"}}})
+	if err == nil {
+		t.Fatal("expected an invalid channel name to fail")
+	}
+
+	for i, testcase := range []struct {
+		options        interface{}
+		expectedStatus int
+		expectedCode   formats.ErrorCode
+	}{
+		{map[string]string{"channel": "nightly"}, http.StatusCreated, ""},
+		{nil, http.StatusForbidden, formats.ErrorCodeSignerNotPermitted},
+		{map[string]string{"channel": "release"}, http.StatusForbidden, formats.ErrorCodeSignerNotPermitted},
+	} {
+		body, err := json.Marshal([]formats.SignatureRequest{{
+			Input:   "Y2FyaWJvdW1hdXJpY2UK",
+			KeyID:   channelConf.ID,
+			Options: testcase.options,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, user.ID, user.Key, sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		tmpag.handleSignature(w, req)
+		if w.Code != testcase.expectedStatus {
+			t.Fatalf("test case %d expected status %d but got %d: %s", i, testcase.expectedStatus, w.Code, w.Body.String())
+		}
+		if w.Code == http.StatusCreated {
+			var responses []formats.SignatureResponse
+			err = json.Unmarshal(w.Body.Bytes(), &responses)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if responses[0].PublicKey != nightlyPublicKey {
+				t.Fatalf("test case %d expected the public key of the nightly channel, got %q", i, responses[0].PublicKey)
+			}
+			continue
+		}
+		var errResp formats.ErrorResponse
+		err = json.Unmarshal(w.Body.Bytes(), &errResp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errResp.Code != testcase.expectedCode {
+			t.Fatalf("test case %d expected error code %q but got %q", i, testcase.expectedCode, errResp.Code)
+		}
+	}
+}
+
 func TestContentType(t *testing.T) {
 	t.Parallel()
 
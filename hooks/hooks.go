@@ -0,0 +1,153 @@
+// Package hooks lets builds of autograph run their own logic around
+// signing requests, like adding response headers, billing clients or
+// sending custom metrics, without modifying the signing handlers.
+//
+// Hooks are registered from the init function of a package the build
+// imports for its side effects, and run for the /sign/data, /sign/file
+// and /sign/hash endpoints at three stages:
+//
+//   - PreValidate, once per request after it is authenticated and its
+//     body parsed, before the signature requests are validated
+//   - PreSign, for each signature request after its signer is
+//     authorized, before signing
+//   - PostSign, for each signature request after signing, before the
+//     response is written
+//
+// Hooks of a stage run in registration order, and the first one that
+// returns an error fails the request.
+package hooks // import "go.mozilla.org/autograph/hooks"
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"go.mozilla.org/autograph/formats"
+)
+
+// Stage is the point of a signing request where hooks run
+type Stage string
+
+const (
+	// PreValidate hooks run after the request is authenticated
+	// and its body parsed
+	PreValidate Stage = "pre-validate"
+
+	// PreSign hooks run before each signing operation
+	PreSign Stage = "pre-sign"
+
+	// PostSign hooks run after each signing operation
+	PostSign Stage = "post-sign"
+)
+
+// Event describes a signing request to hooks
+type Event struct {
+	Stage Stage
+
+	// HTTPRequest is the request, whose body was already read
+	HTTPRequest *http.Request
+
+	// ResponseHeader are the headers of the response, which
+	// hooks can add to
+	ResponseHeader http.Header
+
+	// UserID is the authenticated user making the request
+	UserID string
+
+	// SignatureRequests are the signature requests in the body of
+	// the request. PreValidate hooks can modify them.
+	SignatureRequests []formats.SignatureRequest
+
+	// Index is the position of the signature request of PreSign
+	// and PostSign hooks in SignatureRequests
+	Index int
+
+	// SignerID and Input are the signer and the decoded input of
+	// the signature request of PreSign and PostSign hooks. Input
+	// is reused by later requests, so hooks copy it to keep it.
+	SignerID string
+	Input    []byte
+
+	// SignatureResponse is the response to the signature request
+	// of PostSign hooks
+	SignatureResponse *formats.SignatureResponse
+}
+
+// Hook runs custom logic at a stage of signing requests. An error
+// fails the request: with the status and message of a Rejection, or
+// as an internal error otherwise.
+type Hook func(ctx context.Context, event *Event) error
+
+// Rejection is returned by hooks to reject a request with a status
+// and a message for the client
+type Rejection struct {
+	Status  int
+	Message string
+}
+
+func (r *Rejection) Error() string {
+	return r.Message
+}
+
+// Reject returns a Rejection with a status and a formatted message
+func Reject(status int, format string, args ...interface{}) error {
+	return &Rejection{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+type namedHook struct {
+	name string
+	hook Hook
+}
+
+var (
+	hooksMu sync.RWMutex
+	hooks   = make(map[Stage][]namedHook)
+)
+
+// Register adds a named hook to a stage of signing requests. It panics
+// when the stage is unknown, the hook is nil or a hook with the same
+// name is already registered for the stage.
+func Register(stage Stage, name string, hook Hook) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	switch stage {
+	case PreValidate, PreSign, PostSign:
+	default:
+		panic(fmt.Sprintf("hooks: Register with unknown stage %q", stage))
+	}
+	if hook == nil {
+		panic(fmt.Sprintf("hooks: Register of %q with a nil hook", name))
+	}
+	for _, h := range hooks[stage] {
+		if h.name == name {
+			panic(fmt.Sprintf("hooks: Register called twice for %q at stage %q", name, stage))
+		}
+	}
+	hooks[stage] = append(hooks[stage], namedHook{name, hook})
+}
+
+// Registered returns the names of the hooks of a stage in order
+func Registered(stage Stage) (names []string) {
+	hooksMu.RLock()
+	defer hooksMu.RUnlock()
+	for _, h := range hooks[stage] {
+		names = append(names, h.name)
+	}
+	return names
+}
+
+// Run runs the hooks of the stage of an event in order, and returns
+// the error of the first hook that fails with the name of the hook
+func Run(ctx context.Context, event *Event) (name string, err error) {
+	hooksMu.RLock()
+	stageHooks := hooks[event.Stage]
+	hooksMu.RUnlock()
+	for _, h := range stageHooks {
+		err = h.hook(ctx, event)
+		if err != nil {
+			return h.name, err
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,77 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// ran are the hooks that ran for TestRun, global like the hooks
+var ran []string
+
+func TestRun(t *testing.T) {
+	ran = nil
+	record := func(name string, err error) Hook {
+		return func(ctx context.Context, event *Event) error {
+			if event.UserID == "testrun" {
+				ran = append(ran, name)
+				return err
+			}
+			return nil
+		}
+	}
+	if len(Registered(PreSign)) == 0 {
+		Register(PreSign, "first", record("first", nil))
+		Register(PreSign, "second", record("second", errors.New("failed")))
+		Register(PreSign, "third", record("third", nil))
+	}
+	if !reflect.DeepEqual(Registered(PreSign), []string{"first", "second", "third"}) {
+		t.Fatalf("expected hooks in registration order, got %q", Registered(PreSign))
+	}
+
+	name, err := Run(context.Background(), &Event{Stage: PreSign, UserID: "testrun"})
+	if name != "second" || err == nil || err.Error() != "failed" {
+		t.Fatalf("expected hook second to fail, got %q: %v", name, err)
+	}
+	if !reflect.DeepEqual(ran, []string{"first", "second"}) {
+		t.Fatalf("expected hooks to stop at the first failure, ran %q", ran)
+	}
+	name, err = Run(context.Background(), &Event{Stage: PostSign, UserID: "testrun"})
+	if name != "" || err != nil {
+		t.Fatalf("expected stage without hooks to succeed, got %q: %v", name, err)
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	hook := func(ctx context.Context, event *Event) error { return nil }
+	if len(Registered(PostSign)) == 0 {
+		Register(PostSign, "dup", hook)
+	}
+	for i, testcase := range []struct {
+		stage Stage
+		name  string
+		hook  Hook
+	}{
+		{Stage("pre-flight"), "foo", hook},
+		{PreValidate, "nil", nil},
+		{PostSign, "dup", hook},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("testcase %d: expected Register to panic", i)
+				}
+			}()
+			Register(testcase.stage, testcase.name, testcase.hook)
+		}()
+	}
+}
+
+func TestReject(t *testing.T) {
+	err := Reject(402, "quota of %s exceeded", "alice")
+	rejection, ok := err.(*Rejection)
+	if !ok || rejection.Status != 402 || rejection.Error() != "quota of alice exceeded" {
+		t.Fatalf("unexpected rejection %#v", err)
+	}
+}
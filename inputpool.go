@@ -0,0 +1,64 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"sync"
+)
+
+// maxPooledInputSize is the capacity of the largest input buffers kept
+// in the pool, so a burst of huge files doesn't pin their memory
+const maxPooledInputSize = 128 << 20
+
+// inputBuffers holds the *bytes.Buffer that base64 inputs of signing
+// requests are decoded into, so bursts of large APK or MAR files reuse
+// them instead of allocating new ones for the garbage collector
+var inputBuffers = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// decodeBase64Input streams a base64 input into a buffer of the pool,
+// without the copy of the encoded input base64.DecodeString makes, and
+// returns the decoded input with a function that returns the buffer
+// to the pool once the request is done with the input. Calling it
+// more than once is harmless, so callers can release the buffer early
+// and still defer the release for their error paths. The buffer
+// isn't reused when ctx is done, since a signer may still be reading
+// the input of a request that was canceled or timed out.
+//
+// The input is capped to its length, so signers that append to it
+// make a copy instead of writing to the buffer.
+func decodeBase64Input(ctx context.Context, s string) (input []byte, release func(), err error) {
+	buf := inputBuffers.Get().(*bytes.Buffer)
+	release = func() {
+		if buf == nil || ctx.Err() != nil || buf.Cap() > maxPooledInputSize {
+			return
+		}
+		buf.Reset()
+		inputBuffers.Put(buf)
+		buf = nil
+	}
+	// grow past the decoded length so ReadFrom never reallocates
+	// the buffer to make room for a read that returns EOF
+	buf.Grow(base64.StdEncoding.DecodedLen(len(s)) + bytes.MinRead)
+	_, err = buf.ReadFrom(base64.NewDecoder(base64.StdEncoding, strings.NewReader(s)))
+	if err != nil {
+		release()
+		// the decoder reports truncated inputs as an unexpected
+		// EOF, decode again for the offset of the invalid data
+		if _, decodeErr := base64.StdEncoding.DecodeString(s); decodeErr != nil {
+			err = decodeErr
+		}
+		return nil, nil, err
+	}
+	input = buf.Bytes()
+	return input[:len(input):len(input)], release, nil
+}
@@ -0,0 +1,106 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+)
+
+func TestDecodeBase64Input(t *testing.T) {
+	t.Parallel()
+
+	large := make([]byte, 1<<20)
+	_, err := rand.Read(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, encoded := range []string{
+		"",
+		"Zm9vYmFy",
+		"Zm9v\nYmFy\n",
+		base64.StdEncoding.EncodeToString(large),
+		"Zm9vYmF",
+		"Zm9v$mFy",
+		"Zm9vYmFy====",
+	} {
+		want, wantErr := base64.StdEncoding.DecodeString(encoded)
+		input, release, err := decodeBase64Input(context.Background(), encoded)
+		if wantErr != nil {
+			if err == nil || err.Error() != wantErr.Error() {
+				t.Errorf("testcase %d: expected error %q, got: %v", i, wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("testcase %d: failed to decode input: %v", i, err)
+			continue
+		}
+		if !bytes.Equal(input, want) {
+			t.Errorf("testcase %d: decoded input doesn't match base64.DecodeString", i)
+		}
+		if cap(input) != len(input) {
+			t.Errorf("testcase %d: expected input to be capped to its length %d, got capacity %d", i, len(input), cap(input))
+		}
+		release()
+	}
+}
+
+func TestDecodeBase64InputCanceled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	input, release, err := decodeBase64Input(ctx, "Zm9vYmFy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	release()
+	// a buffer of a canceled request isn't reused, so decoding more
+	// inputs never overwrites the input a signer may still read
+	for i := 0; i < 10; i++ {
+		_, next, err := decodeBase64Input(context.Background(), "YmFyYmF6")
+		if err != nil {
+			t.Fatal(err)
+		}
+		next()
+	}
+	if string(input) != "foobar" {
+		t.Fatalf("expected input of canceled request to be kept, got %q", input)
+	}
+}
+
+func BenchmarkDecodeBase64Input(b *testing.B) {
+	data := make([]byte, 8<<20)
+	_, err := rand.Read(data)
+	if err != nil {
+		b.Fatal(err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	b.Run("DecodeString", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			_, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			_, release, err := decodeBase64Input(context.Background(), encoded)
+			if err != nil {
+				b.Fatal(err)
+			}
+			release()
+		}
+	})
+}
@@ -0,0 +1,265 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+const (
+	// defaultKeyCountersFlushInterval is how often key signature
+	// counts are written to the database when the configuration
+	// does not set an interval
+	defaultKeyCountersFlushInterval = time.Minute
+
+	// defaultKeyLimitAlertThreshold is the share of the signature
+	// limit of a key after which an alert fires
+	defaultKeyLimitAlertThreshold = 0.9
+)
+
+// keyCountersConfig enables the signature counters of HSM keys
+type keyCountersConfig struct {
+	Enabled bool
+
+	// FlushInterval is how often the counts of an instance are
+	// added to the database. Defaults to 1m.
+	FlushInterval time.Duration
+
+	// MaxSignatures is the number of signatures after which the
+	// keys of a signer should be retired, by signer ID
+	MaxSignatures map[string]int64
+
+	// AlertThreshold is the share of MaxSignatures after which a
+	// key raises an alert, between 0 and 1. Defaults to 0.9.
+	AlertThreshold float64
+}
+
+// keyCounterStore stores the signature counters of keys. It is
+// implemented by the database handler.
+type keyCounterStore interface {
+	AddKeySignatures(ctx context.Context, counts []database.KeyCounter) ([]database.KeyCounter, error)
+	ListKeyCounters(ctx context.Context, signerID string) ([]database.KeyCounter, error)
+}
+
+// keyCounterKey identifies a key of a signer
+type keyCounterKey struct {
+	label    string
+	signerID string
+}
+
+// keyCounterRecorder counts signatures by key in memory and adds them
+// to the store periodically, so signing doesn't wait on the database
+type keyCounterRecorder struct {
+	sync.Mutex
+	store  keyCounterStore
+	conf   keyCountersConfig
+	counts map[keyCounterKey]int64
+
+	// added is called with the new total of each counter the
+	// flush added signatures to
+	added func(total database.KeyCounter, previous int64)
+}
+
+// record counts a signature made with a key
+func (k *keyCounterRecorder) record(signerID, label string) {
+	k.Lock()
+	defer k.Unlock()
+	k.counts[keyCounterKey{label: label, signerID: signerID}]++
+}
+
+// flush adds the counts to the store. They are kept in memory for the
+// next flush when the store fails.
+func (k *keyCounterRecorder) flush(ctx context.Context) error {
+	k.Lock()
+	counts := k.counts
+	k.counts = make(map[keyCounterKey]int64)
+	k.Unlock()
+	if len(counts) == 0 {
+		return nil
+	}
+	var batch []database.KeyCounter
+	for key, n := range counts {
+		batch = append(batch, database.KeyCounter{Label: key.label, SignerID: key.signerID, Signatures: n})
+	}
+	totals, err := k.store.AddKeySignatures(ctx, batch)
+	if err != nil {
+		k.Lock()
+		defer k.Unlock()
+		for key, n := range counts {
+			k.counts[key] += n
+		}
+		return err
+	}
+	if k.added != nil {
+		for i, total := range totals {
+			k.added(total, total.Signatures-batch[i].Signatures)
+		}
+	}
+	return nil
+}
+
+// flushEvery adds the counts to the store at an interval, forever
+func (k *keyCounterRecorder) flushEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := k.flush(ctx)
+		cancel()
+		if err != nil {
+			log.Errorf("failed to flush key signature counts: %v", err)
+		}
+	}
+}
+
+// enableKeyCounters counts signatures by key in the database, when the
+// configuration enables it
+func (a *autographer) enableKeyCounters(conf keyCountersConfig) error {
+	if !conf.Enabled {
+		return nil
+	}
+	if a.db == nil {
+		return errors.New("key counters require a database")
+	}
+	return a.initKeyCounters(a.db, conf)
+}
+
+// initKeyCounters counts signatures by key and alerts when keys near
+// or reach the signature limit of their signer
+func (a *autographer) initKeyCounters(store keyCounterStore, conf keyCountersConfig) error {
+	if conf.AlertThreshold == 0 {
+		conf.AlertThreshold = defaultKeyLimitAlertThreshold
+	}
+	if conf.AlertThreshold < 0 || conf.AlertThreshold > 1 {
+		return errors.Errorf("key counters alert threshold must be between 0 and 1, got %g", conf.AlertThreshold)
+	}
+	for signerID, max := range conf.MaxSignatures {
+		if max <= 0 {
+			return errors.Errorf("max signatures of signer %q must be positive, got %d", signerID, max)
+		}
+	}
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = defaultKeyCountersFlushInterval
+	}
+	a.keyCounters = &keyCounterRecorder{
+		store:  store,
+		conf:   conf,
+		counts: make(map[keyCounterKey]int64),
+		added:  a.checkKeyLimit,
+	}
+	go a.keyCounters.flushEvery(conf.FlushInterval)
+	return nil
+}
+
+// signatureKeyLabel returns the HSM label of the key that made a
+// signature, or an empty string when the key isn't in the HSM
+func signatureKeyLabel(conf signer.Configuration, sig signer.Signature) string {
+	if labeler, ok := sig.(signer.KeyLabeler); ok && labeler.KeyLabel() != "" {
+		return labeler.KeyLabel()
+	}
+	if conf.PrivateKey == "" || conf.PrivateKeyHasPEMPrefix() {
+		return ""
+	}
+	return conf.PrivateKey
+}
+
+// countKeySignature counts a signature made by a signer when key
+// counters are enabled. sig is nil for signed files.
+func (a *autographer) countKeySignature(conf signer.Configuration, sig signer.Signature) {
+	if a.keyCounters == nil {
+		return
+	}
+	label := signatureKeyLabel(conf, sig)
+	if label == "" {
+		return
+	}
+	a.keyCounters.record(conf.ID, label)
+}
+
+// checkKeyLimit alerts when the signatures of a key cross the alert
+// threshold or the limit of its signer. Counters are added to
+// atomically, so a single flush of all instances crosses each of them.
+func (a *autographer) checkKeyLimit(total database.KeyCounter, previous int64) {
+	max := a.keyCounters.conf.MaxSignatures[total.SignerID]
+	if max <= 0 {
+		return
+	}
+	threshold := int64(float64(max) * a.keyCounters.conf.AlertThreshold)
+	var level, msg string
+	switch {
+	case previous < max && total.Signatures >= max:
+		level = "exceeded"
+		msg = fmt.Sprintf("key %q of signer %q made %d signatures, reaching its limit of %d: it should be retired", total.Label, total.SignerID, total.Signatures, max)
+		log.WithFields(log.Fields{"signer_id": total.SignerID, "label": total.Label, "signatures": total.Signatures}).Error(msg)
+	case previous < threshold && total.Signatures >= threshold:
+		level = "warning"
+		msg = fmt.Sprintf("key %q of signer %q made %d signatures, nearing its limit of %d", total.Label, total.SignerID, total.Signatures, max)
+		log.WithFields(log.Fields{"signer_id": total.SignerID, "label": total.Label, "signatures": total.Signatures}).Warn(msg)
+	default:
+		return
+	}
+	counter := keyCounterReport(total, max)
+	a.exportEvent(formats.ExportedEvent{
+		Type:       formats.EventTypeKeyLimit,
+		SignerID:   total.SignerID,
+		Message:    msg,
+		KeyCounter: &counter,
+	})
+	if a.stats != nil {
+		sendStatsErr := a.stats.Incr("key_signature_limit", []string{"signer:" + total.SignerID, "label:" + total.Label, "level:" + level}, 1.0)
+		if sendStatsErr != nil {
+			log.Warnf("Error sending key_signature_limit: %s", sendStatsErr)
+		}
+	}
+}
+
+// keyCounterReport returns the admin API form of a key counter
+func keyCounterReport(c database.KeyCounter, max int64) formats.KeyCounter {
+	return formats.KeyCounter{
+		Label:         c.Label,
+		SignerID:      c.SignerID,
+		Signatures:    c.Signatures,
+		MaxSignatures: max,
+		UpdatedAt:     c.UpdatedAt,
+	}
+}
+
+// handleKeyCounters returns the signature counters of keys, of a
+// single signer with the signer parameter
+func (a *autographer) handleKeyCounters(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := a.authorizeAdmin(w, r); !ok {
+		return
+	}
+	if a.keyCounters == nil {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "key counters are not enabled")
+		return
+	}
+	// include the signatures of this instance that weren't
+	// flushed yet
+	err := a.keyCounters.flush(r.Context())
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	counters, err := a.keyCounters.store.ListKeyCounters(r.Context(), r.URL.Query().Get("signer"))
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	resp := []formats.KeyCounter{}
+	for _, c := range counters {
+		resp = append(resp, keyCounterReport(c, a.keyCounters.conf.MaxSignatures[c.SignerID]))
+	}
+	writeAdminJSON(w, r, resp)
+}
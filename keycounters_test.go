@@ -0,0 +1,214 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/autograph/signer/contentsignaturepki"
+)
+
+// memoryKeyCounterStore is a keyCounterStore that keeps counters in
+// memory
+type memoryKeyCounterStore struct {
+	sync.Mutex
+	counters []database.KeyCounter
+	fail     bool
+}
+
+func (m *memoryKeyCounterStore) AddKeySignatures(ctx context.Context, counts []database.KeyCounter) ([]database.KeyCounter, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.fail {
+		return nil, fmt.Errorf("database is unavailable")
+	}
+	var totals []database.KeyCounter
+	for _, c := range counts {
+		added := false
+		for i := range m.counters {
+			if m.counters[i].Label == c.Label && m.counters[i].SignerID == c.SignerID {
+				m.counters[i].Signatures += c.Signatures
+				totals = append(totals, m.counters[i])
+				added = true
+			}
+		}
+		if !added {
+			m.counters = append(m.counters, c)
+			totals = append(totals, c)
+		}
+	}
+	return totals, nil
+}
+
+func (m *memoryKeyCounterStore) ListKeyCounters(ctx context.Context, signerID string) ([]database.KeyCounter, error) {
+	m.Lock()
+	defer m.Unlock()
+	var counters []database.KeyCounter
+	for _, c := range m.counters {
+		if signerID == "" || c.SignerID == signerID {
+			counters = append(counters, c)
+		}
+	}
+	return counters, nil
+}
+
+func TestKeyCounters(t *testing.T) {
+	t.Parallel()
+
+	var signerConfs []signer.Configuration
+	for _, s := range conf.Signers {
+		if s.ID == "normandy" || s.ID == "appkey1" {
+			signerConfs = append(signerConfs, s)
+		}
+	}
+	tmpag := newAutographer(10)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners(signerConfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := authorization{ID: "countinguser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: []string{"normandy", "appkey1"}}
+	admin := authorization{ID: "countingadmin", Key: "a4ex0ztpcu9msw5h5flc7qfhsc7btg2tzb2s3hgf1gtx5vqhnh", Admin: true}
+	err = tmpag.addAuthorizations([]authorization{user, admin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := new(memorySink)
+	tmpag.addExporter(exporterConfig{Type: "memory", BatchSize: 1, FlushInterval: 10 * time.Millisecond}, sink)
+
+	newRequest := func(method, url string, auth authorization, body []byte) *http.Request {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+		return req
+	}
+	sign := func(signerID string, n int) {
+		var sigreqs []formats.SignatureRequest
+		for i := 0; i < n; i++ {
+			sigreqs = append(sigreqs, formats.SignatureRequest{Input: "Y2FyaWJvdW1hdXJpY2UK", KeyID: signerID})
+		}
+		body, err := json.Marshal(sigreqs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		tmpag.handleSignature(w, newRequest("POST", "http://foo.bar/sign/data", user, body))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("signing failed with %d: %s", w.Code, w.Body.String())
+		}
+	}
+	list := func(query string) (int, []formats.KeyCounter) {
+		w := httptest.NewRecorder()
+		tmpag.handleKeyCounters(w, newRequest("GET", "http://foo.bar/admin/keycounters"+query, admin, nil))
+		var counters []formats.KeyCounter
+		if w.Code == http.StatusOK {
+			err := json.Unmarshal(w.Body.Bytes(), &counters)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, counters
+	}
+
+	if code, _ := list(""); code != http.StatusNotFound {
+		t.Fatalf("expected key counters to be disabled, got %d", code)
+	}
+	for i, testcase := range []keyCountersConfig{
+		{AlertThreshold: 1.5},
+		{MaxSignatures: map[string]int64{"normandy": 0}},
+	} {
+		err = newAutographer(1).initKeyCounters(new(memoryKeyCounterStore), testcase)
+		if err == nil {
+			t.Fatalf("testcase %d: expected invalid key counters configuration to be rejected", i)
+		}
+	}
+	store := new(memoryKeyCounterStore)
+	err = tmpag.initKeyCounters(store, keyCountersConfig{
+		FlushInterval:  time.Hour,
+		MaxSignatures:  map[string]int64{"normandy": 4},
+		AlertThreshold: 0.5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := tmpag.getSignerByID("normandy")
+	label, _ := s.(*contentsignaturepki.ContentSigner).EndEntity()
+
+	// appkey1 signs with a key from the configuration, which isn't
+	// counted
+	sign("appkey1", 1)
+	sign("normandy", 1)
+
+	// failed flushes keep the counts for the next one
+	store.fail = true
+	if code, _ := list(""); code != http.StatusInternalServerError {
+		t.Fatalf("expected a failed flush to return a 500, got %d", code)
+	}
+	store.fail = false
+	sign("normandy", 1)
+
+	code, counters := list("?signer=normandy")
+	if code != http.StatusOK {
+		t.Fatalf("expected key counters, got %d", code)
+	}
+	if len(counters) != 1 || counters[0].Label != label || counters[0].SignerID != "normandy" ||
+		counters[0].Signatures != 2 || counters[0].MaxSignatures != 4 {
+		t.Fatalf("unexpected key counters %+v", counters)
+	}
+	if _, counters = list("?signer=appkey1"); len(counters) != 0 {
+		t.Fatalf("expected no counters for appkey1, got %+v", counters)
+	}
+
+	// crossing the limit alerts once, and signing continues
+	sign("normandy", 3)
+	if _, counters = list(""); len(counters) != 1 || counters[0].Signatures != 5 {
+		t.Fatalf("unexpected key counters %+v", counters)
+	}
+	sign("normandy", 1)
+	if _, counters = list(""); counters[0].Signatures != 6 {
+		t.Fatalf("unexpected key counters %+v", counters)
+	}
+
+	var alerts []formats.ExportedEvent
+	for i := 0; ; i++ {
+		if i > 100 {
+			t.Fatalf("timed out waiting for key limit events, got %+v", alerts)
+		}
+		time.Sleep(10 * time.Millisecond)
+		alerts = nil
+		for _, e := range sink.received() {
+			if e.Type == formats.EventTypeKeyLimit {
+				alerts = append(alerts, e)
+			}
+		}
+		if len(alerts) >= 2 {
+			break
+		}
+	}
+	if len(alerts) != 2 {
+		t.Fatalf("expected 2 key limit events, got %+v", alerts)
+	}
+	if alerts[0].KeyCounter == nil || alerts[0].KeyCounter.Signatures != 2 || alerts[0].SignerID != "normandy" {
+		t.Fatalf("unexpected warning event %+v", alerts[0])
+	}
+	if alerts[1].KeyCounter == nil || alerts[1].KeyCounter.Signatures != 5 || alerts[1].KeyCounter.Label != label {
+		t.Fatalf("unexpected limit event %+v", alerts[1])
+	}
+}
@@ -0,0 +1,434 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/formats"
+)
+
+const (
+	// defaultHawkKeyRefreshInterval is how often rotated hawk keys
+	// are reloaded from the database when the configuration does
+	// not set an interval
+	defaultHawkKeyRefreshInterval = 10 * time.Second
+
+	// maxHawkKeyRefreshInterval bounds how long a key retired
+	// through an instance stays valid on the others
+	maxHawkKeyRefreshInterval = time.Minute
+
+	// maxHawkKeys is the number of valid hawk keys a user can
+	// have at once: the current one and the one it is rotated to
+	maxHawkKeys = 2
+
+	// configKeyCreator is the creator of the key of the
+	// configuration, which the database records without its secret
+	// when a user is first rotated
+	configKeyCreator = "configuration"
+
+	// hawkKeyCipherPrefix starts the hawk keys the database stores
+	// encrypted with the key rotation encryption key
+	hawkKeyCipherPrefix = "aes256gcm:"
+)
+
+// keyRotationConfig enables the admin API to rotate the hawk keys of
+// users without a synchronized change of clients
+type keyRotationConfig struct {
+	Enabled bool
+
+	// RefreshInterval is how often rotated keys are reloaded from
+	// the database, to pick up rotations made through other
+	// autograph instances. Defaults to 10s, and can't be longer
+	// than a minute since retired keys stay valid on the other
+	// instances until they reload.
+	RefreshInterval time.Duration
+
+	// EncryptionKey is the hex encoded AES-256 key the rotated
+	// keys are encrypted with in the database
+	EncryptionKey string
+}
+
+// hawkKeyStore stores the hawk keys of rotated users. It is
+// implemented by the database handler.
+type hawkKeyStore interface {
+	ListHawkKeys(ctx context.Context) ([]database.HawkKey, error)
+	InsertHawkKeys(ctx context.Context, keys []database.HawkKey) error
+	DeleteHawkKey(ctx context.Context, userID, keyID string) error
+}
+
+// hawkKeys keeps the hawk keys of rotated users in memory
+type hawkKeys struct {
+	sync.RWMutex
+	store hawkKeyStore
+	// aead encrypts the keys in the store
+	aead cipher.AEAD
+	// keys maps the IDs of rotated users to their keys, oldest
+	// first. The secrets of keys that failed to decrypt are empty,
+	// so they count as keys of the user but never authenticate.
+	keys map[string][]database.HawkKey
+}
+
+func newHawkKeys(store hawkKeyStore, aead cipher.AEAD) *hawkKeys {
+	return &hawkKeys{
+		store: store,
+		aead:  aead,
+		keys:  make(map[string][]database.HawkKey),
+	}
+}
+
+// newHawkKeyCipher returns the AEAD that encrypts rotated hawk keys
+// with a hex encoded AES-256 key
+func newHawkKeyCipher(hexKey string) (cipher.AEAD, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("the key rotation encryption key must be the hex encoding of 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to make key rotation cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+// hawkKeyAdditionalData binds an encrypted key to its user and ID, so
+// it can't be moved to another row of the database
+func hawkKeyAdditionalData(k database.HawkKey) []byte {
+	return []byte(k.UserID + "\x00" + k.KeyID)
+}
+
+// seal returns a key with its secret encrypted for the store
+func (h *hawkKeys) seal(k database.HawkKey) (database.HawkKey, error) {
+	nonce := make([]byte, h.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return k, errors.Wrap(err, "failed to generate hawk key nonce")
+	}
+	sealed := h.aead.Seal(nonce, nonce, []byte(k.Key), hawkKeyAdditionalData(k))
+	k.Key = hawkKeyCipherPrefix + base64.StdEncoding.EncodeToString(sealed)
+	return k, nil
+}
+
+// open returns a key of the store with its secret decrypted. The key
+// of the configuration is stored without secret and returned as is.
+func (h *hawkKeys) open(k database.HawkKey) (database.HawkKey, error) {
+	if k.Key == "" && k.CreatedBy == configKeyCreator {
+		return k, nil
+	}
+	if !strings.HasPrefix(k.Key, hawkKeyCipherPrefix) {
+		return k, errors.Errorf("hawk key %q of user %q is not encrypted", k.KeyID, k.UserID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(k.Key, hawkKeyCipherPrefix))
+	if err != nil || len(sealed) < h.aead.NonceSize() {
+		return k, errors.Errorf("hawk key %q of user %q is not a valid encrypted key", k.KeyID, k.UserID)
+	}
+	nonce, ciphertext := sealed[:h.aead.NonceSize()], sealed[h.aead.NonceSize():]
+	secret, err := h.aead.Open(nil, nonce, ciphertext, hawkKeyAdditionalData(k))
+	if err != nil {
+		return k, errors.Errorf("failed to decrypt hawk key %q of user %q, is the encryption key right?", k.KeyID, k.UserID)
+	}
+	k.Key = string(secret)
+	return k, nil
+}
+
+// refresh reloads the hawk keys from the store, and returns the
+// number of keys that failed to decrypt. Those are logged and kept
+// without their secret, so their users are still rotated and don't
+// fall back to the key of their authorization.
+func (h *hawkKeys) refresh(ctx context.Context) (unreadable int, err error) {
+	list, err := h.store.ListHawkKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+	keys := make(map[string][]database.HawkKey)
+	for _, k := range list {
+		opened, err := h.open(k)
+		if err != nil {
+			log.Errorf("hawk key can't authenticate: %v", err)
+			unreadable++
+			opened = k
+			opened.Key = ""
+		}
+		keys[k.UserID] = append(keys[k.UserID], opened)
+	}
+	h.Lock()
+	h.keys = keys
+	h.Unlock()
+	return unreadable, nil
+}
+
+// refreshEvery reloads the hawk keys at an interval, forever
+func (h *hawkKeys) refreshEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		_, err := h.refresh(ctx)
+		cancel()
+		if err != nil {
+			log.Errorf("failed to refresh hawk keys: %v", err)
+		}
+	}
+}
+
+// forUser returns the keys of a user, or nil when the user was never
+// rotated
+func (h *hawkKeys) forUser(userid string) []database.HawkKey {
+	h.RLock()
+	defer h.RUnlock()
+	return append([]database.HawkKey(nil), h.keys[userid]...)
+}
+
+// enableKeyRotation authenticates users with the hawk keys rotated in
+// the database, when the configuration enables it
+func (a *autographer) enableKeyRotation(conf keyRotationConfig) error {
+	if !conf.Enabled {
+		return nil
+	}
+	if a.db == nil {
+		return errors.New("hawk key rotation requires a database")
+	}
+	return a.initKeyRotation(a.db, conf)
+}
+
+// initKeyRotation loads the rotated hawk keys from the store and
+// keeps them up to date. It fails when a key doesn't decrypt, which
+// usually means the encryption key is wrong.
+func (a *autographer) initKeyRotation(store hawkKeyStore, conf keyRotationConfig) error {
+	if conf.RefreshInterval <= 0 {
+		conf.RefreshInterval = defaultHawkKeyRefreshInterval
+	}
+	if conf.RefreshInterval > maxHawkKeyRefreshInterval {
+		return errors.Errorf("hawk key refresh interval %s is longer than %s, retired keys would stay valid for too long", conf.RefreshInterval, maxHawkKeyRefreshInterval)
+	}
+	aead, err := newHawkKeyCipher(conf.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	a.hawkKeys = newHawkKeys(store, aead)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	unreadable, err := a.hawkKeys.refresh(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to load hawk keys")
+	}
+	if unreadable > 0 {
+		return errors.Errorf("failed to decrypt %d hawk keys", unreadable)
+	}
+	go a.hawkKeys.refreshEvery(conf.RefreshInterval)
+	return nil
+}
+
+// hawkKeyID returns the fingerprint that identifies a hawk key in the
+// admin API without revealing it
+func hawkKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// hawkKeysOf returns the valid hawk keys of a user, oldest first: the
+// keys of its rotations, or the key of its authorization when it was
+// never rotated. A rotated user whose keys don't decrypt has none.
+func (a *autographer) hawkKeysOf(auth authorization) []string {
+	if a.hawkKeys != nil {
+		if rotated := a.hawkKeys.forUser(auth.ID); len(rotated) > 0 {
+			var keys []string
+			for _, k := range rotated {
+				switch {
+				case k.Key != "":
+					keys = append(keys, k.Key)
+				case k.CreatedBy == configKeyCreator && auth.Key != "" && k.KeyID == hawkKeyID(auth.Key):
+					// the key of the configuration, until
+					// it is retired
+					keys = append(keys, auth.Key)
+				}
+			}
+			return keys
+		}
+	}
+	if auth.Key == "" {
+		return nil
+	}
+	return []string{auth.Key}
+}
+
+// currentHawkKeys returns the keys of a user as stored by a rotation.
+// Users that were never rotated have the key of their authorization.
+func (a *autographer) currentHawkKeys(auth authorization) []database.HawkKey {
+	if keys := a.hawkKeys.forUser(auth.ID); len(keys) > 0 {
+		return keys
+	}
+	if auth.Key == "" {
+		return nil
+	}
+	return []database.HawkKey{{
+		UserID:    auth.ID,
+		KeyID:     hawkKeyID(auth.Key),
+		CreatedBy: configKeyCreator,
+	}}
+}
+
+// hawkKeyResponse returns the admin API form of a hawk key
+func hawkKeyResponse(k database.HawkKey) formats.HawkKey {
+	return formats.HawkKey{
+		ID:        k.KeyID,
+		CreatedBy: k.CreatedBy,
+		CreatedAt: k.CreatedAt,
+	}
+}
+
+// authorizationForKeys returns the authorization of the user of a
+// key rotation request, or writes an error to the client
+func (a *autographer) authorizationForKeys(w http.ResponseWriter, r *http.Request) (authorization, bool) {
+	if a.hawkKeys == nil {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "hawk key rotation is not enabled")
+		return authorization{}, false
+	}
+	userID := mux.Vars(r)["id"]
+	auth, err := a.getAuthByID(userID)
+	if err != nil {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "authorization %q not found", userID)
+		return authorization{}, false
+	}
+	return auth, true
+}
+
+// handleHawkKeys lists the hawk keys of a user on GET, and adds a new
+// key the user can switch to on POST
+func (a *autographer) handleHawkKeys(w http.ResponseWriter, r *http.Request) {
+	adminID, _, ok := a.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+	auth, ok := a.authorizationForKeys(w, r)
+	if !ok {
+		return
+	}
+	current := a.currentHawkKeys(auth)
+	if r.Method == http.MethodGet {
+		resp := []formats.HawkKey{}
+		for _, k := range current {
+			resp = append(resp, hawkKeyResponse(k))
+		}
+		writeAdminJSON(w, r, resp)
+		return
+	}
+	if len(current) >= maxHawkKeys {
+		httpError(w, r, http.StatusConflict, formats.ErrorCodeInvalidRequest,
+			"authorization %q already has %d hawk keys, retire one before adding another", auth.ID, len(current))
+		return
+	}
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "failed to generate hawk key: %v", err)
+		return
+	}
+	newKey := database.HawkKey{
+		UserID:    auth.ID,
+		Key:       hex.EncodeToString(secret),
+		CreatedBy: adminID,
+	}
+	newKey.KeyID = hawkKeyID(newKey.Key)
+	var inserted []database.HawkKey
+	if len(a.hawkKeys.forUser(auth.ID)) == 0 {
+		// the key of the configuration stays valid until it
+		// is retired, and is recorded without its secret
+		inserted = append(inserted, current...)
+	}
+	sealed, err := a.hawkKeys.seal(newKey)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	inserted = append(inserted, sealed)
+	err = a.hawkKeys.store.InsertHawkKeys(r.Context(), inserted)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	_, err = a.hawkKeys.refresh(r.Context())
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"rid":     getRequestID(r),
+		"user_id": adminID,
+		"auth_id": auth.ID,
+		"key_id":  newKey.KeyID,
+	}).Warn("added hawk key")
+	a.keyRotated(r, adminID, "", fmt.Sprintf("added hawk key %q of authorization %q", newKey.KeyID, auth.ID))
+	resp := hawkKeyResponse(newKey)
+	resp.Key = newKey.Key
+	resp.CreatedAt = time.Now().UTC()
+	writeAdminJSON(w, r, resp)
+}
+
+// handleDeleteHawkKey retires a hawk key of a user, who must have
+// another key
+func (a *autographer) handleDeleteHawkKey(w http.ResponseWriter, r *http.Request) {
+	adminID, _, ok := a.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+	auth, ok := a.authorizationForKeys(w, r)
+	if !ok {
+		return
+	}
+	keyID := mux.Vars(r)["keyid"]
+	current := a.currentHawkKeys(auth)
+	found := false
+	for _, k := range current {
+		if k.KeyID == keyID {
+			found = true
+		}
+	}
+	if !found {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "authorization %q has no hawk key %q", auth.ID, keyID)
+		return
+	}
+	if len(current) < 2 {
+		httpError(w, r, http.StatusConflict, formats.ErrorCodeInvalidRequest,
+			"cannot retire the only hawk key of authorization %q, add a new key first", auth.ID)
+		return
+	}
+	err := a.hawkKeys.store.DeleteHawkKey(r.Context(), auth.ID, keyID)
+	if err == database.ErrHawkKeyNotFound {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "authorization %q has no hawk key %q", auth.ID, keyID)
+		return
+	}
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	_, err = a.hawkKeys.refresh(r.Context())
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"rid":     getRequestID(r),
+		"user_id": adminID,
+		"auth_id": auth.ID,
+		"key_id":  keyID,
+	}).Warn("retired hawk key")
+	a.keyRotated(r, adminID, "", fmt.Sprintf("retired hawk key %q of authorization %q", keyID, auth.ID))
+	w.WriteHeader(http.StatusNoContent)
+}
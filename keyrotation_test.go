@@ -0,0 +1,256 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+// memoryHawkKeyStore is a hawkKeyStore that keeps keys in memory
+type memoryHawkKeyStore struct {
+	sync.Mutex
+	keys []database.HawkKey
+}
+
+func (m *memoryHawkKeyStore) ListHawkKeys(ctx context.Context) ([]database.HawkKey, error) {
+	m.Lock()
+	defer m.Unlock()
+	return append([]database.HawkKey(nil), m.keys...), nil
+}
+
+func (m *memoryHawkKeyStore) InsertHawkKeys(ctx context.Context, keys []database.HawkKey) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, k := range keys {
+		k.CreatedAt = time.Now()
+		m.keys = append(m.keys, k)
+	}
+	return nil
+}
+
+func (m *memoryHawkKeyStore) DeleteHawkKey(ctx context.Context, userID, keyID string) error {
+	m.Lock()
+	defer m.Unlock()
+	for i, k := range m.keys {
+		if k.UserID == userID && k.KeyID == keyID {
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			return nil
+		}
+	}
+	return database.ErrHawkKeyNotFound
+}
+
+func TestHawkKeyRotation(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(100)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners([]signer.Configuration{conf.Signers[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := authorization{ID: "rotateduser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: []string{conf.Signers[0].ID}}
+	admin := authorization{ID: "rotationadmin", Key: "a4ex0ztpcu9msw5h5flc7qfhsc7btg2tzb2s3hgf1gtx5vqhnh", Admin: true}
+	err = tmpag.addAuthorizations([]authorization{user, admin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newRequest := func(method, url, key string, auth authorization, body []byte) *http.Request {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, key, sha256.New, id(), "application/json", body))
+		return req
+	}
+	keysRequest := func(method, keyID string) *httptest.ResponseRecorder {
+		url := "http://foo.bar/admin/authorizations/" + user.ID + "/keys"
+		vars := map[string]string{"id": user.ID}
+		if keyID != "" {
+			url += "/" + keyID
+			vars["keyid"] = keyID
+		}
+		req := mux.SetURLVars(newRequest(method, url, admin.Key, admin, nil), vars)
+		w := httptest.NewRecorder()
+		if method == http.MethodDelete {
+			tmpag.handleDeleteHawkKey(w, req)
+		} else {
+			tmpag.handleHawkKeys(w, req)
+		}
+		return w
+	}
+	sign := func(key string) int {
+		body, err := json.Marshal([]formats.SignatureRequest{{Input: "Y2FyaWJvdW1hdXJpY2UK"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		tmpag.handleSignature(w, newRequest("POST", "http://foo.bar/sign/data", key, user, body))
+		return w.Code
+	}
+
+	if w := keysRequest(http.MethodPost, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected key rotation to be disabled, got %d: %s", w.Code, w.Body.String())
+	}
+	aead, err := newHawkKeyCipher("5c2bfa3d0e4f5d3fe2d0b6a1c04da8e4e8b1c3c9a6f4f1a35c5ae6e3a2c1d4b7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := new(memoryHawkKeyStore)
+	tmpag.hawkKeys = newHawkKeys(store, aead)
+
+	w := keysRequest(http.MethodPost, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("adding a hawk key failed with %d: %s", w.Code, w.Body.String())
+	}
+	var newKey formats.HawkKey
+	err = json.Unmarshal(w.Body.Bytes(), &newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newKey.Key == "" || newKey.ID != hawkKeyID(newKey.Key) || newKey.CreatedBy != admin.ID {
+		t.Fatalf("unexpected new hawk key %+v", newKey)
+	}
+	// the database holds no hawk key in clear
+	stored, _ := store.ListHawkKeys(context.Background())
+	if len(stored) != 2 || stored[0].Key != "" || stored[0].CreatedBy != configKeyCreator {
+		t.Fatalf("expected the configuration key to be stored without its secret, got %+v", stored)
+	}
+	if !strings.HasPrefix(stored[1].Key, hawkKeyCipherPrefix) || strings.Contains(stored[1].Key, newKey.Key) {
+		t.Fatalf("expected the new key to be stored encrypted, got %q", stored[1].Key)
+	}
+	// a key moved to another user doesn't decrypt
+	moved := stored[1]
+	moved.UserID = admin.ID
+	if _, err = tmpag.hawkKeys.open(moved); err == nil {
+		t.Fatal("expected a hawk key moved to another user to fail decryption")
+	}
+	// both keys are valid during the rotation
+	if code := sign(user.Key); code != http.StatusCreated {
+		t.Fatalf("expected the old key to stay valid, got %d", code)
+	}
+	if code := sign(newKey.Key); code != http.StatusCreated {
+		t.Fatalf("expected the new key to be valid, got %d", code)
+	}
+
+	w = keysRequest(http.MethodGet, "")
+	var keys []formats.HawkKey
+	err = json.Unmarshal(w.Body.Bytes(), &keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].ID != hawkKeyID(user.Key) || keys[0].CreatedBy != configKeyCreator || keys[1].ID != newKey.ID || keys[0].Key != "" || keys[1].Key != "" {
+		t.Fatalf("unexpected hawk keys: %s", w.Body.String())
+	}
+	if w = keysRequest(http.MethodPost, ""); w.Code != http.StatusConflict {
+		t.Fatalf("expected a third key to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w = keysRequest(http.MethodDelete, hawkKeyID(user.Key)); w.Code != http.StatusNoContent {
+		t.Fatalf("retiring the old key failed with %d: %s", w.Code, w.Body.String())
+	}
+	if code := sign(user.Key); code != http.StatusUnauthorized {
+		t.Fatalf("expected the retired key to be refused, got %d", code)
+	}
+	if code := sign(newKey.Key); code != http.StatusCreated {
+		t.Fatalf("expected the new key to stay valid, got %d", code)
+	}
+	if w = keysRequest(http.MethodDelete, newKey.ID); w.Code != http.StatusConflict {
+		t.Fatalf("expected retiring the only key to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+	if w = keysRequest(http.MethodDelete, "0123456789abcdef"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected an unknown key to be not found, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestEnableKeyRotationConfig(t *testing.T) {
+	t.Parallel()
+
+	validKey := "5c2bfa3d0e4f5d3fe2d0b6a1c04da8e4e8b1c3c9a6f4f1a35c5ae6e3a2c1d4b7"
+	for _, testcase := range []struct {
+		conf  keyRotationConfig
+		valid bool
+	}{
+		{keyRotationConfig{Enabled: true, EncryptionKey: validKey}, true},
+		{keyRotationConfig{Enabled: true, EncryptionKey: validKey, RefreshInterval: 30 * time.Second}, true},
+		{keyRotationConfig{Enabled: true, EncryptionKey: validKey, RefreshInterval: time.Hour}, false},
+		{keyRotationConfig{Enabled: true}, false},
+		{keyRotationConfig{Enabled: true, EncryptionKey: "abcd"}, false},
+	} {
+		tmpag := newAutographer(1)
+		err := tmpag.initKeyRotation(new(memoryHawkKeyStore), testcase.conf)
+		if testcase.valid && err != nil {
+			t.Fatalf("expected %+v to be valid, got %v", testcase.conf, err)
+		}
+		if !testcase.valid && err == nil {
+			t.Fatalf("expected %+v to be refused", testcase.conf)
+		}
+	}
+}
+
+func TestHawkKeysFailClosed(t *testing.T) {
+	t.Parallel()
+
+	encryptionKey := "5c2bfa3d0e4f5d3fe2d0b6a1c04da8e4e8b1c3c9a6f4f1a35c5ae6e3a2c1d4b7"
+	otherAEAD, err := newHawkKeyCipher(strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := authorization{ID: "rotateduser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu"}
+
+	// the user was rotated to a key encrypted with another
+	// encryption key, and its configuration key was retired
+	sealed, err := newHawkKeys(nil, otherAEAD).seal(database.HawkKey{
+		UserID:    user.ID,
+		KeyID:     hawkKeyID("newkey"),
+		Key:       "newkey",
+		CreatedBy: "rotationadmin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &memoryHawkKeyStore{keys: []database.HawkKey{sealed}}
+
+	tmpag := newAutographer(1)
+	err = tmpag.initKeyRotation(store, keyRotationConfig{Enabled: true, EncryptionKey: encryptionKey})
+	if err == nil {
+		t.Fatal("expected key rotation to fail to start with a key that doesn't decrypt")
+	}
+
+	// a refresh that can't decrypt the key keeps the user rotated
+	// instead of reviving the retired configuration key
+	aead, err := newHawkKeyCipher(encryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.hawkKeys = newHawkKeys(store, aead)
+	unreadable, err := tmpag.hawkKeys.refresh(context.Background())
+	if err != nil || unreadable != 1 {
+		t.Fatalf("expected 1 unreadable key, got %d: %v", unreadable, err)
+	}
+	if keys := tmpag.hawkKeysOf(user); len(keys) != 0 {
+		t.Fatalf("expected a user whose keys don't decrypt to have no keys, got %q", keys)
+	}
+	if keys := tmpag.currentHawkKeys(user); len(keys) != 1 || keys[0].KeyID != sealed.KeyID || keys[0].Key != "" {
+		t.Fatalf("expected the unreadable key to be listed without its secret, got %+v", keys)
+	}
+}
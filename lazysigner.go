@@ -0,0 +1,105 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/signer"
+)
+
+// lazySigner stands in for a signer configured with `lazy: true`,
+// whose initialization is deferred from startup to its first use or
+// to the background warmup. A signer that fails to initialize keeps
+// returning the same error until autograph restarts.
+type lazySigner struct {
+	conf signer.Configuration
+	init func(signer.Configuration) (signer.Signer, error)
+
+	once sync.Once
+	done chan struct{}
+	s    signer.Signer
+	err  error
+}
+
+// newLazySigner returns a lazySigner that calls init with conf on
+// first use
+func newLazySigner(conf signer.Configuration, init func(signer.Configuration) (signer.Signer, error)) *lazySigner {
+	return &lazySigner{
+		conf: conf,
+		init: init,
+		done: make(chan struct{}),
+	}
+}
+
+// get initializes the signer if it hasn't been yet and returns it
+func (l *lazySigner) get() (signer.Signer, error) {
+	l.once.Do(func() {
+		defer close(l.done)
+		log.Infof("initializing lazy signer %q", l.conf.ID)
+		l.s, l.err = l.init(l.conf)
+		if l.err == nil && l.s == nil {
+			l.err = fmt.Errorf("signer %q was skipped during initialization", l.conf.ID)
+		}
+		if l.err != nil {
+			log.Errorf("failed to initialize lazy signer %q: %v", l.conf.ID, l.err)
+		}
+	})
+	return l.s, l.err
+}
+
+// initialized returns the signer if it was initialized successfully,
+// without initializing it
+func (l *lazySigner) initialized() signer.Signer {
+	select {
+	case <-l.done:
+		return l.s
+	default:
+		return nil
+	}
+}
+
+// Config returns the configuration of the initialized signer, or the
+// configuration the signer will be initialized with
+func (l *lazySigner) Config() signer.Configuration {
+	if s := l.initialized(); s != nil {
+		return s.Config()
+	}
+	return l.conf
+}
+
+// deferredSigner is implemented by lazySigner and degradedSigner,
+// which stand in for a signer that is initialized after startup
+type deferredSigner interface {
+	signer.Signer
+
+	// get returns the signer, or an error if it isn't available
+	get() (signer.Signer, error)
+
+	// initialized returns the signer if it is available, or nil
+	initialized() signer.Signer
+}
+
+// resolveSigner returns the signer a deferredSigner stands in for,
+// initializing lazy signers if needed, or s itself for other signers
+func resolveSigner(s signer.Signer) (signer.Signer, error) {
+	if d, ok := s.(deferredSigner); ok {
+		return d.get()
+	}
+	return s, nil
+}
+
+// warmupSigners initializes lazy signers in the background, so they
+// are ready before their first request without blocking startup
+func (a *autographer) warmupSigners() {
+	for _, s := range a.getSigners() {
+		if l, ok := s.(*lazySigner); ok {
+			l.get()
+		}
+	}
+}
@@ -0,0 +1,382 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// serviceAccountDir holds the token, CA certificate and
+	// namespace Kubernetes mounts in pods
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	defaultLeaseName          = "autograph"
+	defaultLeaseDuration      = 15 * time.Second
+	defaultLeaseRenewInterval = 5 * time.Second
+
+	// leaseTimeFormat is the format of the MicroTime fields of
+	// leases
+	leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// errLeaseNotFound is returned when the lease doesn't exist yet
+var errLeaseNotFound = errors.New("lease not found")
+
+// errLeaseConflict is returned when another instance updated the
+// lease first
+var errLeaseConflict = errors.New("lease was updated by another instance")
+
+// leaderElectionConfig elects a leader among the autograph instances
+// of a Kubernetes deployment with a coordination.k8s.io Lease, so
+// background jobs run on a single instance at a time
+type leaderElectionConfig struct {
+	Enabled bool
+
+	// LeaseName is the name of the lease, "autograph" by default
+	LeaseName string
+
+	// Namespace is the namespace of the lease, the namespace of
+	// the pod by default
+	Namespace string
+
+	// Identity identifies this instance in the lease, the
+	// hostname (the pod name) by default
+	Identity string
+
+	// LeaseDuration is how long the lease is held without being
+	// renewed, 15s by default. RenewInterval is how often the
+	// leader renews it and other instances try to acquire it,
+	// 5s by default.
+	LeaseDuration time.Duration
+	RenewInterval time.Duration
+
+	// APIServer is the URL of the Kubernetes API. It defaults to
+	// the in-cluster API server, with the token and CA
+	// certificate of the pod service account.
+	APIServer string
+	TokenFile string
+	CACert    string
+}
+
+// k8sLease is a coordination.k8s.io/v1 Lease
+type k8sLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace,omitempty"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+// expired returns true when the holder of the lease didn't renew it
+// in time
+func (l *k8sLease) expired(now time.Time) bool {
+	if l.Spec.HolderIdentity == "" {
+		return true
+	}
+	renewed, err := time.Parse(time.RFC3339Nano, l.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second).Before(now)
+}
+
+// leaderElector acquires and renews a Kubernetes lease to make its
+// instance the leader
+type leaderElector struct {
+	conf      leaderElectionConfig
+	client    *http.Client
+	leaseURL  string
+	tokenFile string
+	leader    int32
+}
+
+// enableLeaderElection runs background jobs on the elected leader only,
+// when the configuration enables it
+func (a *autographer) enableLeaderElection(conf leaderElectionConfig) (err error) {
+	if !conf.Enabled {
+		return nil
+	}
+	a.leader, err = newLeaderElector(conf)
+	if err != nil {
+		return err
+	}
+	go a.leader.run(context.Background())
+	return nil
+}
+
+// newLeaderElector returns a leader elector for the configuration,
+// using the service account of the pod for in-cluster configurations
+func newLeaderElector(conf leaderElectionConfig) (*leaderElector, error) {
+	if conf.LeaseName == "" {
+		conf.LeaseName = defaultLeaseName
+	}
+	if conf.LeaseDuration <= 0 {
+		conf.LeaseDuration = defaultLeaseDuration
+	}
+	if conf.RenewInterval <= 0 {
+		conf.RenewInterval = defaultLeaseRenewInterval
+	}
+	if conf.RenewInterval >= conf.LeaseDuration {
+		return nil, errors.Errorf("lease renew interval %s must be shorter than the lease duration %s", conf.RenewInterval, conf.LeaseDuration)
+	}
+	if conf.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("leader election requires running in Kubernetes or an API server URL")
+		}
+		conf.APIServer = "https://" + host + ":" + port
+		if conf.TokenFile == "" {
+			conf.TokenFile = serviceAccountDir + "/token"
+		}
+		if conf.CACert == "" {
+			conf.CACert = serviceAccountDir + "/ca.crt"
+		}
+	}
+	if conf.Namespace == "" {
+		ns, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the namespace of the lease")
+		}
+		conf.Namespace = strings.TrimSpace(string(ns))
+	}
+	if conf.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get the identity of the instance")
+		}
+		conf.Identity = hostname
+	}
+	transport := &http.Transport{}
+	if conf.CACert != "" {
+		pool, err := loadCertPool(conf.CACert)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &leaderElector{
+		conf:      conf,
+		client:    &http.Client{Transport: transport, Timeout: conf.RenewInterval},
+		leaseURL:  fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", strings.TrimRight(conf.APIServer, "/"), conf.Namespace),
+		tokenFile: conf.TokenFile,
+	}, nil
+}
+
+// isLeader returns true when the instance holds the lease
+func (e *leaderElector) isLeader() bool {
+	return atomic.LoadInt32(&e.leader) == 1
+}
+
+// setLeader records and logs leadership changes
+func (e *leaderElector) setLeader(leader bool) {
+	var v int32
+	if leader {
+		v = 1
+	}
+	if atomic.SwapInt32(&e.leader, v) != v {
+		if leader {
+			log.Infof("%s became the leader with lease %s/%s", e.conf.Identity, e.conf.Namespace, e.conf.LeaseName)
+		} else {
+			log.Infof("%s is no longer the leader", e.conf.Identity)
+		}
+	}
+}
+
+// run acquires and renews the lease every renew interval until ctx is
+// done, then releases it so another instance takes over right away
+func (e *leaderElector) run(ctx context.Context) {
+	for {
+		acquired, err := e.tryAcquireOrRenew(ctx, time.Now())
+		if err != nil {
+			log.Errorf("failed to acquire or renew lease %s/%s: %v", e.conf.Namespace, e.conf.LeaseName, err)
+		}
+		// step down on errors, the lease might be lost
+		e.setLeader(acquired)
+		select {
+		case <-ctx.Done():
+			e.release()
+			return
+		case <-time.After(e.conf.RenewInterval):
+		}
+	}
+}
+
+// tryAcquireOrRenew renews the lease when the instance holds it, and
+// acquires it when it expired or doesn't exist. It returns true when
+// the instance holds the lease.
+func (e *leaderElector) tryAcquireOrRenew(ctx context.Context, now time.Time) (bool, error) {
+	lease, err := e.getLease(ctx)
+	if err == errLeaseNotFound {
+		lease = &k8sLease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+		lease.Metadata.Name = e.conf.LeaseName
+		lease.Metadata.Namespace = e.conf.Namespace
+		e.hold(lease, now)
+		err = e.writeLease(ctx, http.MethodPost, e.leaseURL, lease)
+		if err == errLeaseConflict {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	if lease.Spec.HolderIdentity != e.conf.Identity && !lease.expired(now) {
+		return false, nil
+	}
+	e.hold(lease, now)
+	err = e.writeLease(ctx, http.MethodPut, e.leaseURL+"/"+e.conf.LeaseName, lease)
+	if err == errLeaseConflict {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// hold sets the instance as the holder of the lease until now plus the
+// lease duration
+func (e *leaderElector) hold(lease *k8sLease, now time.Time) {
+	if lease.Spec.HolderIdentity != e.conf.Identity {
+		if lease.Spec.HolderIdentity != "" || lease.Spec.AcquireTime != "" {
+			lease.Spec.LeaseTransitions++
+		}
+		lease.Spec.HolderIdentity = e.conf.Identity
+		lease.Spec.AcquireTime = now.UTC().Format(leaseTimeFormat)
+	}
+	lease.Spec.RenewTime = now.UTC().Format(leaseTimeFormat)
+	lease.Spec.LeaseDurationSeconds = int((e.conf.LeaseDuration + time.Second - 1) / time.Second)
+}
+
+// release gives up the lease when the instance holds it
+func (e *leaderElector) release() {
+	if !e.isLeader() {
+		return
+	}
+	e.setLeader(false)
+	ctx, cancel := context.WithTimeout(context.Background(), e.conf.RenewInterval)
+	defer cancel()
+	lease, err := e.getLease(ctx)
+	if err != nil || lease.Spec.HolderIdentity != e.conf.Identity {
+		return
+	}
+	lease.Spec.HolderIdentity = ""
+	err = e.writeLease(ctx, http.MethodPut, e.leaseURL+"/"+e.conf.LeaseName, lease)
+	if err != nil {
+		log.Errorf("failed to release lease %s/%s: %v", e.conf.Namespace, e.conf.LeaseName, err)
+	}
+}
+
+// do sends a request to the API server with the service account token
+func (e *leaderElector) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if e.tokenFile != "" {
+		// bound service account tokens are rotated, read the
+		// current one
+		token, err := ioutil.ReadFile(e.tokenFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read service account token")
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	return e.client.Do(req.WithContext(ctx))
+}
+
+func (e *leaderElector) getLease(ctx context.Context) (*k8sLease, error) {
+	resp, err := e.do(ctx, http.MethodGet, e.leaseURL+"/"+e.conf.LeaseName, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errLeaseNotFound
+	default:
+		data, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.Errorf("API server returned status %d: %s", resp.StatusCode, data)
+	}
+	var lease k8sLease
+	err = json.NewDecoder(resp.Body).Decode(&lease)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse lease")
+	}
+	return &lease, nil
+}
+
+// writeLease creates or updates a lease. Updates fail with
+// errLeaseConflict when the resource version of the lease changed.
+func (e *leaderElector) writeLease(ctx context.Context, method, url string, lease *k8sLease) error {
+	body, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	resp, err := e.do(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return nil
+	case http.StatusConflict:
+		return errLeaseConflict
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	return errors.Errorf("API server returned status %d: %s", resp.StatusCode, data)
+}
+
+// isLeader returns true when the instance runs the background jobs of
+// the deployment: when it holds the lease, or when leader election is
+// disabled
+func (a *autographer) isLeader() bool {
+	return a.leader == nil || a.leader.isLeader()
+}
+
+// startBackgroundJob runs job every interval on the leader
+func (a *autographer) startBackgroundJob(name string, interval time.Duration, job func(ctx context.Context) error) {
+	log.Infof("running background job %q every %s", name, interval)
+	go func() {
+		for {
+			time.Sleep(interval)
+			if !a.isLeader() {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := job(ctx)
+			cancel()
+			if err != nil {
+				log.Errorf("background job %q failed: %v", name, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,261 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLeaseAPI serves the lease endpoints of the Kubernetes API with
+// resource version checks
+type fakeLeaseAPI struct {
+	sync.Mutex
+	lease   *k8sLease
+	version int
+	tokens  []string
+}
+
+func (f *fakeLeaseAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.tokens = append(f.tokens, r.Header.Get("Authorization"))
+	const path = "/apis/coordination.k8s.io/v1/namespaces/autograph/leases"
+	var lease k8sLease
+	if r.Method != http.MethodGet {
+		err := json.NewDecoder(r.Body).Decode(&lease)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == path+"/autograph":
+		if f.lease == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(f.lease)
+	case r.Method == http.MethodPost && r.URL.Path == path:
+		if f.lease != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.store(&lease)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && r.URL.Path == path+"/autograph":
+		if f.lease == nil || lease.Metadata.ResourceVersion != f.lease.Metadata.ResourceVersion {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.store(&lease)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeLeaseAPI) store(lease *k8sLease) {
+	f.version++
+	lease.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.lease = lease
+}
+
+func (f *fakeLeaseAPI) holder() string {
+	f.Lock()
+	defer f.Unlock()
+	if f.lease == nil {
+		return ""
+	}
+	return f.lease.Spec.HolderIdentity
+}
+
+func newTestElector(t *testing.T, url, identity, tokenFile string) *leaderElector {
+	e, err := newLeaderElector(leaderElectionConfig{
+		Enabled:       true,
+		Namespace:     "autograph",
+		Identity:      identity,
+		LeaseDuration: 10 * time.Second,
+		RenewInterval: time.Second,
+		APIServer:     url,
+		TokenFile:     tokenFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestLeaderElection(t *testing.T) {
+	t.Parallel()
+
+	api := new(fakeLeaseAPI)
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	tokenFile, err := ioutil.TempFile("", "autograph-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tokenFile.Name())
+	_, err = tokenFile.WriteString("pod-token\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenFile.Close()
+
+	ctx := context.Background()
+	a := newTestElector(t, srv.URL, "autograph-a", tokenFile.Name())
+	b := newTestElector(t, srv.URL, "autograph-b", "")
+	now := time.Now()
+
+	acquired, err := a.tryAcquireOrRenew(ctx, now)
+	if err != nil || !acquired {
+		t.Fatalf("expected a to acquire the new lease, got %t %v", acquired, err)
+	}
+	api.Lock()
+	token := api.tokens[0]
+	api.Unlock()
+	if token != "Bearer pod-token" {
+		t.Fatalf("expected the service account token, got %q", token)
+	}
+	acquired, err = b.tryAcquireOrRenew(ctx, now.Add(time.Second))
+	if err != nil || acquired {
+		t.Fatalf("expected b not to acquire the lease held by a, got %t %v", acquired, err)
+	}
+	acquired, err = a.tryAcquireOrRenew(ctx, now.Add(5*time.Second))
+	if err != nil || !acquired {
+		t.Fatalf("expected a to renew its lease, got %t %v", acquired, err)
+	}
+
+	// b takes over once a stops renewing the lease
+	acquired, err = b.tryAcquireOrRenew(ctx, now.Add(14*time.Second))
+	if err != nil || acquired {
+		t.Fatalf("expected b not to acquire the renewed lease, got %t %v", acquired, err)
+	}
+	acquired, err = b.tryAcquireOrRenew(ctx, now.Add(16*time.Second))
+	if err != nil || !acquired || api.holder() != "autograph-b" {
+		t.Fatalf("expected b to acquire the expired lease, got %t %v", acquired, err)
+	}
+	api.Lock()
+	transitions := api.lease.Spec.LeaseTransitions
+	api.Unlock()
+	if transitions != 1 {
+		t.Fatalf("expected 1 lease transition, got %d", transitions)
+	}
+	acquired, err = a.tryAcquireOrRenew(ctx, now.Add(17*time.Second))
+	if err != nil || acquired {
+		t.Fatalf("expected a to lose the lease, got %t %v", acquired, err)
+	}
+
+	// a takes over right away when b releases the lease
+	b.setLeader(true)
+	b.release()
+	if b.isLeader() || api.holder() != "" {
+		t.Fatalf("expected b to release the lease, holder is %q", api.holder())
+	}
+	acquired, err = a.tryAcquireOrRenew(ctx, now.Add(18*time.Second))
+	if err != nil || !acquired {
+		t.Fatalf("expected a to acquire the released lease, got %t %v", acquired, err)
+	}
+}
+
+func TestLeaderElectionConflict(t *testing.T) {
+	t.Parallel()
+
+	api := new(fakeLeaseAPI)
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	a := newTestElector(t, srv.URL, "autograph-a", "")
+
+	// another instance updates the lease between our read and write
+	lease, err := a.getLease(context.Background())
+	if err != errLeaseNotFound {
+		t.Fatalf("expected missing lease, got %v %v", lease, err)
+	}
+	expired := new(k8sLease)
+	expired.Spec.HolderIdentity = "autograph-b"
+	expired.Spec.LeaseDurationSeconds = 1
+	expired.Spec.RenewTime = time.Now().Add(-time.Minute).UTC().Format(leaseTimeFormat)
+	api.Lock()
+	api.store(expired)
+	api.Unlock()
+	lease, err = a.getLease(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lease.expired(time.Now()) {
+		t.Fatal("expected the lease of b to be expired")
+	}
+	api.Lock()
+	api.store(&k8sLease{})
+	api.Unlock()
+	a.hold(lease, time.Now())
+	err = a.writeLease(context.Background(), http.MethodPut, a.leaseURL+"/autograph", lease)
+	if err != errLeaseConflict {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+}
+
+func TestBackgroundJobsRunOnLeader(t *testing.T) {
+	t.Parallel()
+
+	api := new(fakeLeaseAPI)
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	tmpag := newAutographer(1)
+	var (
+		mu   sync.Mutex
+		runs int
+	)
+	tmpag.leader = newTestElector(t, srv.URL, "autograph-a", "")
+	tmpag.startBackgroundJob("test", 10*time.Millisecond, func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		runs++
+		return nil
+	})
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if runs != 0 {
+		t.Fatalf("expected the job not to run before the instance is the leader, ran %d times", runs)
+	}
+	mu.Unlock()
+
+	tmpag.leader.setLeader(true)
+	for i := 0; ; i++ {
+		if i > 100 {
+			t.Fatal("timed out waiting for the job to run on the leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		ran := runs > 0
+		mu.Unlock()
+		if ran {
+			break
+		}
+	}
+}
+
+func TestNewLeaderElectorErrors(t *testing.T) {
+	t.Parallel()
+
+	for i, conf := range []leaderElectionConfig{
+		{Namespace: "autograph", Identity: "a", APIServer: "http://localhost", LeaseDuration: time.Second, RenewInterval: time.Second},
+		{Namespace: "autograph", Identity: "a", APIServer: "http://localhost", CACert: "/does/not/exist"},
+	} {
+		_, err := newLeaderElector(conf)
+		if err == nil {
+			t.Fatalf("testcase %d: expected leader elector initialization to fail", i)
+		}
+	}
+}
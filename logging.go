@@ -1,16 +1,129 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"go.mozilla.org/mozlogrus"
+
+	"go.mozilla.org/autograph/formats"
+)
+
+const (
+	// logFormatMozlog writes logs in the mozlog JSON format, the default
+	logFormatMozlog = "mozlog"
+
+	// logFormatJSON writes logs in the logrus JSON format
+	logFormatJSON = "json"
+
+	// logFormatText writes logs as plain text
+	logFormatText = "text"
 )
 
+// loggingConfig sets the format of the logs, one of mozlog (default),
+// json or text, and the minimum level of the entries that are logged
+type loggingConfig struct {
+	Format string
+	Level  string
+}
+
+// logFormat is the format the logger is configured with
+var logFormat struct {
+	sync.Mutex
+	name string
+}
+
 func init() {
 	// initialize the logger
-	mozlogrus.Enable("autograph")
+	err := configureLogging(loggingConfig{Format: logFormatMozlog})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// configureLogging sets the format and level of the standard logger.
+// An empty format or level leaves the current one in place.
+func configureLogging(conf loggingConfig) error {
+	var formatter log.Formatter
+	switch conf.Format {
+	case "":
+	case logFormatMozlog:
+		formatter = &mozlogrus.MozLogFormatter{LoggerName: "autograph", Type: "app.log"}
+	case logFormatJSON:
+		formatter = &log.JSONFormatter{}
+	case logFormatText:
+		formatter = &log.TextFormatter{}
+	default:
+		return errors.Errorf("unknown log format %q, must be one of mozlog, json or text", conf.Format)
+	}
+	var (
+		level log.Level
+		err   error
+	)
+	if conf.Level != "" {
+		level, err = log.ParseLevel(conf.Level)
+		if err != nil {
+			return errors.Wrap(err, "failed to parse log level")
+		}
+	}
+	logFormat.Lock()
+	defer logFormat.Unlock()
+	if formatter != nil {
+		log.SetFormatter(formatter)
+		log.SetOutput(os.Stdout)
+		logFormat.name = conf.Format
+	}
+	if conf.Level != "" {
+		log.SetLevel(level)
+	}
+	return nil
+}
+
+// currentLogging returns the format and level the logger is configured with
+func currentLogging() formats.LoggingConfig {
+	logFormat.Lock()
+	defer logFormat.Unlock()
+	return formats.LoggingConfig{
+		Format: logFormat.name,
+		Level:  log.GetLevel().String(),
+	}
+}
+
+// handleLogging returns the log format and level on GET, and changes
+// them on PUT with the format and level set in the request body
+func (a *autographer) handleLogging(w http.ResponseWriter, r *http.Request) {
+	userid, body, ok := a.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodPut {
+		var req formats.LoggingConfig
+		err := json.Unmarshal(body, &req)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "failed to parse logging configuration: %v", err)
+			return
+		}
+		if req.Format == "" && req.Level == "" {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "missing log format or level")
+			return
+		}
+		err = configureLogging(loggingConfig{Format: req.Format, Level: req.Level})
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "%v", err)
+			return
+		}
+		log.WithFields(log.Fields{
+			"user_id": userid,
+			"format":  req.Format,
+			"level":   req.Level,
+		}).Warn("logging configuration changed")
+	}
+	writeAdminJSON(w, r, currentLogging())
 }
 
 // logRequest is a middleware that writes details about each HTTP request processed
@@ -0,0 +1,116 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+func TestConfigureLogging(t *testing.T) {
+	initial := currentLogging()
+	defer configureLogging(loggingConfig{Format: initial.Format, Level: initial.Level})
+
+	err := configureLogging(loggingConfig{Format: "json", Level: "warning"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := log.StandardLogger().Formatter.(*log.JSONFormatter); !ok {
+		t.Fatalf("expected the json formatter, got %T", log.StandardLogger().Formatter)
+	}
+	if log.GetLevel() != log.WarnLevel {
+		t.Fatalf("expected warning level, got %s", log.GetLevel())
+	}
+	// an empty format or level keeps the current one
+	err = configureLogging(loggingConfig{Level: "debug"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current := currentLogging(); current.Format != "json" || current.Level != "debug" {
+		t.Fatalf("expected json format at debug level, got %+v", current)
+	}
+
+	for _, conf := range []loggingConfig{
+		{Format: "xml"},
+		{Level: "loud"},
+	} {
+		err = configureLogging(conf)
+		if err == nil {
+			t.Fatalf("expected logging configuration %+v to fail", conf)
+		}
+	}
+	if current := currentLogging(); current.Format != "json" || current.Level != "debug" {
+		t.Fatalf("expected invalid configurations to leave logging unchanged, got %+v", current)
+	}
+}
+
+func TestHandleLogging(t *testing.T) {
+	initial := currentLogging()
+	defer configureLogging(loggingConfig{Format: initial.Format, Level: initial.Level})
+
+	tmpag := newAutographer(10)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners([]signer.Configuration{conf.Signers[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := authorization{ID: "loguser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: []string{conf.Signers[0].ID}}
+	admin := authorization{ID: "logadmin", Key: "a4ex0ztpcu9msw5h5flc7qfhsc7btg2tzb2s3hgf1gtx5vqhnh", Admin: true}
+	err = tmpag.addAuthorizations([]authorization{user, admin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRequest := func(method string, auth authorization, body []byte) *http.Request {
+		req, err := http.NewRequest(method, "http://foo.bar/admin/logging", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+		return req
+	}
+
+	body := []byte(`{"format":"text","level":"error"}`)
+	w := httptest.NewRecorder()
+	tmpag.handleLogging(w, newRequest("PUT", user, body))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected non-admin user to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	tmpag.handleLogging(w, newRequest("PUT", admin, body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("changing logging failed with %d: %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	tmpag.handleLogging(w, newRequest("GET", admin, nil))
+	var current formats.LoggingConfig
+	err = json.Unmarshal(w.Body.Bytes(), &current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Format != "text" || current.Level != "error" {
+		t.Fatalf("expected text format at error level, got %+v", current)
+	}
+
+	for _, body := range []string{`{}`, `{"level":"loud"}`, `not json`} {
+		w = httptest.NewRecorder()
+		tmpag.handleLogging(w, newRequest("PUT", admin, []byte(body)))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), string(formats.ErrorCodeInvalidRequest)) {
+			t.Fatalf("expected %q to be rejected, got %d: %s", body, w.Code, w.Body.String())
+		}
+	}
+}
@@ -9,6 +9,7 @@ package main
 //go:generate ./version.sh
 
 import (
+	"context"
 	"crypto/sha256"
 	"flag"
 	"fmt"
@@ -30,16 +31,9 @@ import (
 	"github.com/mozilla-services/yaml"
 
 	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/hooks"
 	"go.mozilla.org/autograph/signer"
-	"go.mozilla.org/autograph/signer/apk"
-	"go.mozilla.org/autograph/signer/apk2"
-	"go.mozilla.org/autograph/signer/contentsignature"
-	"go.mozilla.org/autograph/signer/contentsignaturepki"
-	"go.mozilla.org/autograph/signer/genericrsa"
-	"go.mozilla.org/autograph/signer/gpg2"
 	"go.mozilla.org/autograph/signer/mar"
-	"go.mozilla.org/autograph/signer/pgp"
-	"go.mozilla.org/autograph/signer/rsapss"
 	"go.mozilla.org/autograph/signer/xpi"
 
 	"go.mozilla.org/sops"
@@ -57,6 +51,47 @@ type configuration struct {
 		IdleTimeout    time.Duration
 		ReadTimeout    time.Duration
 		WriteTimeout   time.Duration
+
+		// ReadHeaderTimeout and MaxHeaderBytes bound how
+		// long and how much a client can send before its
+		// request headers are parsed
+		ReadHeaderTimeout time.Duration
+		MaxHeaderBytes    int
+
+		// TLSCert and TLSKey are paths to a PEM certificate
+		// and key to serve the API over TLS instead of
+		// cleartext
+		TLSCert string
+		TLSKey  string
+
+		HTTP2 http2Config
+
+		// Authentication sets the schemes API clients can
+		// authenticate with. Defaults to hawk.
+		Authentication authenticationConfig
+
+		// RequestTimeout is the deadline for processing a
+		// signing request. Signers that support it abort
+		// backend work (HSM, subprocesses, uploads) when it
+		// passes or when the client goes away.
+		RequestTimeout time.Duration
+
+		// DrainDelay is how long autograph keeps serving
+		// requests while failing readiness after receiving a
+		// termination signal, so load balancers stop sending
+		// it requests before it shuts down
+		DrainDelay time.Duration
+
+		// MaxDecompressedBodySize is the maximum size in
+		// bytes of a gzip or brotli encoded request body once
+		// decompressed, 1GB by default
+		MaxDecompressedBodySize int64
+
+		// MaxBodySize is the maximum size in bytes of request
+		// bodies, 1GB by default, and EndpointMaxBodySizes
+		// overrides it for endpoints by path, like /sign/hash
+		MaxBodySize          int64
+		EndpointMaxBodySizes map[string]int64
 	}
 	Statsd struct {
 		Addr      string
@@ -64,12 +99,47 @@ type configuration struct {
 		Buflen    int
 	}
 	HSM                   crypto11.PKCS11Config
+	HSMProfile            string
+	HSMBatching           signer.HSMBatchConfig
+	HSMKeyGen             signer.HSMKeyGenConfig
+	TempStorage           signer.TempStorageConfig
 	Database              database.Config
 	Signers               []signer.Configuration
 	Authorizations        []authorization
 	Monitoring            authorization
 	Heartbeat             heartbeatConfig
+	SignerInit            signerInitConfig
+	Scheduler             schedulerConfig
+	FaultInjection        faultInjectionConfig
+	Recording             recordingConfig
+	Denylist              denylistConfig
+	KeyRotation           keyRotationConfig
+	ConfigAudit           configAuditConfig
+	Usage                 usageConfig
+	KeyCounters           keyCountersConfig
+	ArtifactRegistry      artifactRegistryConfig
+	Revocations           revocationsConfig
+	RootSets              []rootSetConfig
+	RotationCheck         rotationCheckConfig
+	Exporters             []exporterConfig
+	SplitRole             splitRoleConfig
+	LeaderElection        leaderElectionConfig
+	Autoscaling           autoscalingConfig
+	ResponseSigning       responseSigningConfig
+	Logging               loggingConfig
+	SecurityLog           securityLogConfig
+	SLO                   sloConfig
+	Standby               standbyConfig
+	Resources             resourcesConfig
 	HawkTimestampValidity string
+
+	// HawkPayloadHash is "required" (default) to reject requests
+	// without a hawk payload hash, or "optional" to accept them
+	HawkPayloadHash string
+
+	// FIPS rejects signers that use algorithms or keys that
+	// aren't approved by FIPS 186-4
+	FIPS bool
 }
 
 // An autographer is a running instance of an autograph service,
@@ -80,8 +150,59 @@ type autographer struct {
 	nonces               *lru.Cache
 	debug                bool
 	heartbeatConf        *heartbeatConfig
+	x5uChecks            *x5uChecks
 	authBackend          authBackend
+	authenticators       []authenticator
+	apiKeys              []apiKey
+	lockout              *authLockout
+	hawkKeys             *hawkKeys
+	usage                *usageRecorder
+	keyCounters          *keyCounterRecorder
 	hawkMaxTimestampSkew time.Duration
+	hawkPayloadHash      string
+	fips                 bool
+	requestTimeout       time.Duration
+	decompressLimit      int64
+	maxBodySize          int64
+	endpointBodySizes    map[string]int64
+	signerInit           signerInitConfig
+	userLimits           *userLimiter
+	scheduler            *scheduler
+	faults               map[string]signerFaults
+	recorder             requestRecorder
+	recordedSigners      map[string]bool
+	denylist             *denylist
+	registry             artifactRegistry
+	revocations          revocationStore
+	rootSets             map[string]*signer.RootSet
+	rotationCheck        rotationCheckConfig
+	exporters            []*eventExporter
+	securityLog          *securityLog
+	securityExporters    []*eventExporter
+	workers              *workerPool
+	allowedFrontends     map[string]bool
+	leader               *leaderElector
+	load                 *loadTracker
+	signerCapacity       map[string]int
+	slo                  *sloTracker
+	responseSigner       *responseSigner
+	standby              *standby
+	memory               *memoryAdmission
+
+	// cleanupTempStorage removes the temporary files of the
+	// process on shutdown
+	cleanupTempStorage func() error
+
+	// stopEndEntityRotation stops the scheduled rotation of
+	// end-entities on shutdown, when it was started
+	stopEndEntityRotation context.CancelFunc
+
+	// ready and draining are set atomically to 1 once signers
+	// are initialized and when shutting down, and standingBy
+	// until a standby instance is promoted
+	ready      int32
+	draining   int32
+	standingBy int32
 }
 
 func main() {
@@ -90,6 +211,24 @@ func main() {
 	if len(args) > 0 {
 		args = os.Args[1:]
 	}
+	// 'autograph backup' and 'autograph restore' manage the signer
+	// state of the database instead of serving the API
+	if len(args) > 0 {
+		var command func([]string) error
+		switch args[0] {
+		case "backup":
+			command = runBackup
+		case "restore":
+			command = runRestore
+		}
+		if command != nil {
+			err := command(args[1:])
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
 	run(parseArgsAndLoadConfig(args))
 }
 
@@ -134,6 +273,14 @@ func parseArgsAndLoadConfig(args []string) (conf configuration, listen string, d
 	if err != nil {
 		log.Fatal(err)
 	}
+	// the level set on the command line overrides the configured one
+	if logLevel != "" {
+		conf.Logging.Level = logLevel
+	}
+	err = configureLogging(conf.Logging)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	confListen := strings.Split(conf.Server.Listen, ":")
 	if len(confListen) > 1 && port != "" && port != confListen[1] {
@@ -156,12 +303,30 @@ func run(conf configuration, listen string, debug bool) {
 	ag = newAutographer(conf.Server.NonceCacheSize)
 	ag.heartbeatConf = &conf.Heartbeat
 
+	// size the runtime to the limits of the container before
+	// signers start allocating
+	ag.memory, err = configureResources(conf.Resources, cgroupRoot)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if conf.Database.Name != "" {
 		// ignore the monitor close chan since it will stop
 		// when the app is stopped
 		_ = ag.addDB(conf.Database)
 	}
 
+	err = validateSplitRole(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// signers write their temporary files to the managed storage
+	err = signer.ConfigureTempStorage(conf.TempStorage)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// initialize the hsm if a configuration is defined
 	if conf.HSM.Path != "" {
 		ag.initHSM(conf)
@@ -172,9 +337,21 @@ func run(conf configuration, listen string, debug bool) {
 		if err != nil {
 			log.Fatal(err)
 		}
+		go ag.sendTempStorageStats()
+	}
+
+	if conf.FIPS {
+		ag.enableFIPS()
+	}
+
+	// elect the leader before background jobs start
+	err = ag.enableLeaderElection(conf.LeaderElection)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	err = ag.addSigners(conf.Signers)
+	ag.signerInit = conf.SignerInit
+	err = ag.enableSplitRole(conf.SplitRole, conf.Signers)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -186,6 +363,7 @@ func run(conf configuration, listen string, debug bool) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	ag.enableX5UChecks(conf.Heartbeat.X5UCheckInterval)
 	if conf.HawkTimestampValidity != "" {
 		ag.hawkMaxTimestampSkew, err = time.ParseDuration(conf.HawkTimestampValidity)
 		if err != nil {
@@ -195,21 +373,153 @@ func run(conf configuration, listen string, debug bool) {
 		ag.hawkMaxTimestampSkew = time.Minute
 	}
 	log.Infof("setting hawk timestamp skew to %s", ag.hawkMaxTimestampSkew)
+	ag.hawkPayloadHash, err = parseHawkPayloadHash(conf.HawkPayloadHash)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("hawk payload hashes are %s", ag.hawkPayloadHash)
+	err = ag.setAuthenticators(conf.Server.Authentication)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ag.enableAuthLockout(conf.Server.Authentication.Lockout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ag.requestTimeout = conf.Server.RequestTimeout
+	ag.decompressLimit = conf.Server.MaxDecompressedBodySize
+	err = ag.setBodySizeLimits(conf.Server.MaxBodySize, conf.Server.EndpointMaxBodySizes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ag.enableScheduler(conf.Scheduler)
+	err = ag.enableRecording(conf.Recording)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ag.enableDenylist(conf.Denylist)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ag.enableStandby(conf.Standby, conf.SplitRole.Role)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// rotate the end-entities of signers with a rotation interval
+	// before their certificates expire
+	ag.startEndEntityRotation(conf.Signers, endEntityRotationCheckInterval)
+	err = ag.enableKeyRotation(conf.KeyRotation)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ag.enableUsage(conf.Usage)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ag.enableKeyCounters(conf.KeyCounters)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ag.enableArtifactRegistry(conf.ArtifactRegistry)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ag.rotationCheck = conf.RotationCheck
+	err = ag.addRootSets(conf.RootSets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ag.enableRevocations(conf.Revocations)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ag.enableAutoscaling(conf.Autoscaling)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ag.enableSLO(conf.SLO)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ag.enableResponseSigning(conf.ResponseSigning)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ag.addExporters(conf.Exporters)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ag.enableSecurityLog(conf.SecurityLog)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ag.enableConfigAudit(conf.ConfigAudit, conf.SplitRole.Role, conf.Signers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ag.enableFaultInjection(conf.FaultInjection)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	if debug {
 		ag.enableDebug()
 	}
 
-	ag.startCleanupHandler()
+	if conf.SignerInit.Warmup {
+		go func() {
+			ag.warmupSigners()
+			ag.setReady()
+		}()
+	} else {
+		ag.setReady()
+	}
+
+	for _, stage := range []hooks.Stage{hooks.PreValidate, hooks.PreSign, hooks.PostSign} {
+		if names := hooks.Registered(stage); len(names) > 0 {
+			log.Infof("running %s hooks registered by the build: %s", stage, strings.Join(names, ", "))
+		}
+	}
 
 	router := mux.NewRouter().StrictSlash(true)
 	router.HandleFunc("/__heartbeat__", ag.handleHeartbeat).Methods("GET")
 	router.HandleFunc("/__lbheartbeat__", handleLBHeartbeat).Methods("GET")
-	router.HandleFunc("/__version__", handleVersion).Methods("GET")
-	router.HandleFunc("/__monitor__", ag.handleMonitor).Methods("GET")
-	router.HandleFunc("/sign/file", ag.handleSignature).Methods("POST")
-	router.HandleFunc("/sign/data", ag.handleSignature).Methods("POST")
-	router.HandleFunc("/sign/hash", ag.handleSignature).Methods("POST")
+	router.HandleFunc("/__ready__", ag.handleReadiness).Methods("GET")
+	router.HandleFunc("/__autoscaling__", ag.handleAutoscaling).Methods("GET")
+	router.HandleFunc("/__slo__", ag.handleSLO).Methods("GET")
+	router.HandleFunc("/__version__", ag.handleVersion).Methods("GET")
+	router.HandleFunc("/response-signing-key", ag.handleResponseSigningKey).Methods("GET")
+	if conf.SplitRole.Role == roleWorker {
+		// workers only sign the operations of frontends
+		router.HandleFunc("/internal/signers", ag.handleWorkerSigners).Methods("GET")
+		router.HandleFunc("/internal/sign", ag.handleWorkerSign).Methods("POST")
+	} else {
+		router.HandleFunc("/__monitor__", ag.handleMonitor).Methods("GET")
+		router.HandleFunc("/sign/file", ag.handleSignature).Methods("POST")
+		router.HandleFunc("/sign/data", ag.handleSignature).Methods("POST")
+		router.HandleFunc("/sign/hash", ag.handleSignature).Methods("POST")
+		router.HandleFunc("/sign/archive", ag.handleArchiveSignature).Methods("POST")
+		router.HandleFunc("/sign/checksums", ag.handleChecksumsSignature).Methods("POST")
+		router.HandleFunc("/verify", ag.handleVerify).Methods("POST")
+		router.HandleFunc("/signer/{id}/chain", ag.handleGetChain).Methods("GET")
+		router.HandleFunc("/admin/recordings", ag.handleListRecordings).Methods("GET")
+		router.HandleFunc("/admin/recordings/{id:[0-9]+}", ag.handleGetRecording).Methods("GET")
+		router.HandleFunc("/admin/recordings/{id:[0-9]+}/replay", ag.handleReplayRecording).Methods("POST")
+		router.HandleFunc("/admin/signers/{id}/denylist", ag.handleDenylist).Methods("GET", "POST")
+		router.HandleFunc("/admin/signers/{id}/denylist/{digest}", ag.handleDeleteDenylistDigest).Methods("DELETE")
+		router.HandleFunc("/admin/signers/{id}/pgpkeys", ag.handleGeneratePGPKey).Methods("POST")
+		router.HandleFunc("/admin/signers/{id}/rotate", ag.handleRotateEndEntity).Methods("POST")
+		router.HandleFunc("/admin/signers/{id}/rollback", ag.handleRollbackEndEntity).Methods("POST")
+		router.HandleFunc("/admin/artifacts", ag.handleFindArtifacts).Methods("GET")
+		router.HandleFunc("/admin/revocations", ag.handleRevocations).Methods("GET", "POST")
+		router.HandleFunc("/revocations/status", ag.handleRevocationStatus).Methods("GET")
+		router.HandleFunc("/admin/authorizations/{id}/keys", ag.handleHawkKeys).Methods("GET", "POST")
+		router.HandleFunc("/admin/authorizations/{id}/keys/{keyid}", ag.handleDeleteHawkKey).Methods("DELETE")
+		router.HandleFunc("/admin/usage", ag.handleUsage).Methods("GET")
+		router.HandleFunc("/admin/keycounters", ag.handleKeyCounters).Methods("GET")
+		router.HandleFunc("/admin/logging", ag.handleLogging).Methods("GET", "PUT")
+		router.HandleFunc("/admin/standby/promote", ag.handlePromoteStandby).Methods("POST")
+	}
 	if os.Getenv("AUTOGRAPH_PROFILE") == "1" {
 		err = setRuntimeConfig()
 		if err != nil {
@@ -219,21 +529,35 @@ func run(conf configuration, listen string, debug bool) {
 		log.Infof("enabled HTTP perf profiler")
 	}
 
-	server := &http.Server{
-		IdleTimeout:  conf.Server.IdleTimeout,
-		ReadTimeout:  conf.Server.ReadTimeout,
-		WriteTimeout: conf.Server.WriteTimeout,
-		Addr:         listen,
-		Handler: handleMiddlewares(
-			router,
-			setRequestID(),
-			setRequestStartTime(),
-			setResponseHeaders(),
-			logRequest(),
-		),
+	server, err := newServer(conf, listen, handleMiddlewares(
+		router,
+		setRequestID(),
+		setRequestStartTime(),
+		setResponseHeaders(),
+		logRequest(),
+		compressResponses(),
+		signResponses(ag.responseSigner),
+	))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if conf.SplitRole.Role == roleWorker {
+		err = configureWorkerTLS(conf, server)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if conf.Server.Authentication.usesScheme(schemeMTLS) {
+		err = configureClientCertAuth(conf, server)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	ag.startCleanupHandler(server, conf.Server.DrainDelay)
+	err = listenAndServe(conf, server)
+	if err == http.ErrServerClosed {
+		// wait for the cleanup handler to exit
+		select {}
 	}
-	log.Infof("starting autograph on %s with timeouts: idle %s read %s write %s", listen, conf.Server.IdleTimeout, conf.Server.ReadTimeout, conf.Server.WriteTimeout)
-	err = server.ListenAndServe()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -283,6 +607,10 @@ func newAutographer(cachesize int) (a *autographer) {
 	var err error
 	a = new(autographer)
 	a.authBackend = newInMemoryAuthBackend()
+	a.authenticators = []authenticator{&hawkAuthenticator{a}}
+	a.userLimits = newUserLimiter()
+	a.load = newLoadTracker()
+	a.cleanupTempStorage = signer.CleanupTempStorage
 	a.nonces, err = lru.New(cachesize)
 	if err != nil {
 		log.Fatal(err)
@@ -302,6 +630,15 @@ func (a *autographer) disableDebug() {
 	return
 }
 
+// enableFIPS restricts signers to FIPS approved algorithms
+func (a *autographer) enableFIPS() {
+	a.fips = true
+	if !fipsBuild {
+		log.Warnf("FIPS mode is enabled but autograph was not built against a validated crypto module")
+	}
+	log.Infof("FIPS mode enabled")
+}
+
 // getAuthByID returns an authorization if it exists or nil. Call
 // addAuthorizations and addMonitoring first
 func (a *autographer) getAuthByID(id string) (authorization, error) {
@@ -309,24 +646,16 @@ func (a *autographer) getAuthByID(id string) (authorization, error) {
 }
 
 // startCleanupHandler sets up a chan to catch int, kill, term
-// signals and run signer AtExit functions
-func (a *autographer) startCleanupHandler() {
+// signals, drain and shut down the server and run signer AtExit
+// functions
+func (a *autographer) startCleanupHandler(server *http.Server, drainDelay time.Duration) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM)
 
 	go func() {
 		sig := <-c
 		log.Infof("main: received signal %s; cleaning up signers", sig)
-		for _, s := range a.getSigners() {
-			statefulSigner, ok := s.(signer.StatefulSigner)
-			if !ok {
-				continue
-			}
-			err := statefulSigner.AtExit()
-			if err != nil {
-				log.Errorf("main: error in signer %s AtExit fn: %s", s.Config().ID, err)
-			}
-		}
+		a.shutdown(server, drainDelay)
 		os.Exit(0)
 	}()
 }
@@ -352,6 +681,14 @@ func (a *autographer) addDB(dbConf database.Config) chan bool {
 
 // initHSM sets up the HSM and notifies signers it is available
 func (a *autographer) initHSM(conf configuration) {
+	if conf.HSMProfile != "" {
+		profile, err := signer.GetHSMProfile(conf.HSMProfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		profile.Apply(&conf.HSM, &conf.HSMKeyGen)
+		log.Infof("using the %s hsm profile with up to %d sessions", profile.Name, conf.HSM.MaxSessions)
+	}
 	tmpCtx, err := crypto11.Configure(&conf.HSM)
 	if err != nil {
 		log.Fatal(err)
@@ -369,12 +706,22 @@ func (a *autographer) initHSM(conf configuration) {
 				a.heartbeatConf.hsmSignerConf = &signerConf
 			}
 		}
+		// look up the keys of all signers now rather than on
+		// first use
+		n := signer.PrewarmHSMKeys(conf.Signers)
+		log.Infof("cached %d HSM key handles", n)
+
+		signer.ConfigureHSMBatching(conf.HSMBatching)
+		err = signer.ConfigureHSMKeyGen(conf.HSMKeyGen)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 }
 
 // addSigners initializes each signer specified in the configuration by parsing
 // and loading their private keys. The signers are then copied over to the
-// autographer handler.
+// autographer handler in configuration order.
 func (a *autographer) addSigners(signerConfs []signer.Configuration) error {
 	sids := make(map[string]bool)
 	for _, signerConf := range signerConfs {
@@ -391,79 +738,15 @@ func (a *autographer) addSigners(signerConfs []signer.Configuration) error {
 			return fmt.Errorf("'monitor' is a reserved signer name and cannot be used in configuration")
 		}
 		sids[signerConf.ID] = true
-		var (
-			s           signer.Signer
-			statsClient *signer.StatsClient
-			err         error
-		)
-		if a.stats != nil {
-			statsClient, err = signer.NewStatsClient(signerConf, a.stats)
-			if statsClient == nil || err != nil {
-				return errors.Wrapf(err, "failed to add signer stats client %q or got back nil statsClient", signerConf.ID)
-			}
-		}
-		// give the database handler to the signer configuration
-		if a.db != nil {
-			signerConf.DB = a.db
-		}
-		switch signerConf.Type {
-		case contentsignature.Type:
-			s, err = contentsignature.New(signerConf)
-			if err != nil {
-				return errors.Wrapf(err, "failed to add signer %q", signerConf.ID)
-			}
-		case contentsignaturepki.Type:
-			s, err = contentsignaturepki.New(signerConf)
-			if err != nil {
-				return errors.Wrapf(err, "failed to add signer %q", signerConf.ID)
-			}
-		case xpi.Type:
-			s, err = xpi.New(signerConf, statsClient)
-			if err != nil {
-				return errors.Wrapf(err, "failed to add signer %q", signerConf.ID)
-			}
-		case apk.Type:
-			s, err = apk.New(signerConf)
-			if err != nil {
-				return errors.Wrapf(err, "failed to add signer %q", signerConf.ID)
-			}
-		case apk2.Type:
-			s, err = apk2.New(signerConf)
-			if err != nil {
-				return errors.Wrapf(err, "failed to add signer %q", signerConf.ID)
-			}
-		case mar.Type:
-			s, err = mar.New(signerConf)
-			if err != nil && strings.HasPrefix(err.Error(), "mar: failed to parse private key: no suitable key found") {
-				log.Infof("Skipping signer %q from HSM", signerConf.ID)
-				continue
-			} else if err != nil {
-				return errors.Wrapf(err, "failed to add signer %q", signerConf.ID)
-			}
-		case pgp.Type:
-			s, err = pgp.New(signerConf)
-			if err != nil {
-				return errors.Wrapf(err, "failed to add signer %q", signerConf.ID)
-			}
-		case gpg2.Type:
-			s, err = gpg2.New(signerConf)
-			if err != nil {
-				return errors.Wrapf(err, "failed to add signer %q", signerConf.ID)
-			}
-		case genericrsa.Type:
-			s, err = genericrsa.New(signerConf)
-			if err != nil {
-				return errors.Wrapf(err, "failed to add signer %q", signerConf.ID)
-			}
-		case rsapss.Type:
-			s, err = rsapss.New(signerConf)
-			if err != nil {
-				return errors.Wrapf(err, "failed to add signer %q", signerConf.ID)
-			}
-		default:
-			return fmt.Errorf("unknown signer type %q", signerConf.Type)
+	}
+	signers, err := a.initSigners(signerConfs)
+	if err != nil {
+		return err
+	}
+	for _, s := range signers {
+		if s != nil {
+			a.addSigner(s)
 		}
-		a.addSigner(s)
 	}
 	return nil
 }
@@ -482,10 +765,29 @@ func (a *autographer) addMonitoring(auth authorization) (err error) {
 // stores them into the autographer handler as a map indexed by user id, for fast lookup.
 func (a *autographer) addAuthorizations(auths []authorization) (err error) {
 	for _, auth := range auths {
+		_, err = parsePriority(auth.Priority)
+		if err != nil {
+			return errors.Wrapf(err, "invalid priority for authorization %q", auth.ID)
+		}
+		err = xpi.ValidateIDPatterns(auth.AddOnIDs)
+		if err != nil {
+			return errors.Wrapf(err, "invalid add-on IDs for authorization %q", auth.ID)
+		}
+		err = mar.ValidateChannelNames(auth.MARChannels)
+		if err != nil {
+			return errors.Wrapf(err, "invalid MAR channels for authorization %q", auth.ID)
+		}
 		err = a.authBackend.addAuth(&auth)
 		if err != nil {
 			return
 		}
+		if auth.APIKeyHash != "" {
+			err = a.addAPIKey(auth)
+			if err != nil {
+				return errors.Wrapf(err, "invalid api key for authorization %q", auth.ID)
+			}
+		}
+		a.userLimits.setLimit(auth.ID, auth.MaxConcurrentRequests)
 	}
 	return
 }
@@ -495,6 +797,16 @@ func (a *autographer) getSigners() []signer.Signer {
 	return a.authBackend.getSigners()
 }
 
+// getSignerByID returns the configured signer with the given ID
+func (a *autographer) getSignerByID(signerID string) (signer.Signer, bool) {
+	for _, s := range a.getSigners() {
+		if s.Config().ID == signerID {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
 // addSigner adds a configured signer
 func (a *autographer) addSigner(signer signer.Signer) {
 	a.authBackend.addSigner(signer)
@@ -0,0 +1,17 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build go1.19
+// +build go1.19
+
+package main
+
+import "runtime/debug"
+
+// setGoMemoryLimit sets the soft memory limit of the Go runtime, which
+// collects garbage more often as the heap gets close to it
+func setGoMemoryLimit(limit int64) bool {
+	debug.SetMemoryLimit(limit)
+	return true
+}
@@ -0,0 +1,14 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !go1.19
+// +build !go1.19
+
+package main
+
+// setGoMemoryLimit is a no-op before Go 1.19, which added soft memory
+// limits to the runtime
+func setGoMemoryLimit(limit int64) bool {
+	return false
+}
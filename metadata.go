@@ -0,0 +1,52 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxMetadataEntries is the maximum number of metadata keys
+	// of a signature request
+	maxMetadataEntries = 16
+
+	// maxMetadataValueLength is the maximum length in bytes of a
+	// metadata value
+	maxMetadataValueLength = 256
+)
+
+// metadataKeyRegexp matches the keys of the metadata of a signature
+// request, like "build_id" or "vcs.revision"
+var metadataKeyRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+
+// validateMetadata checks the metadata a client attached to a signature
+// request is small enough to log and store with each signature. Values
+// are opaque to autograph but must be printable UTF-8.
+func validateMetadata(metadata map[string]string) error {
+	if len(metadata) > maxMetadataEntries {
+		return errors.Errorf("%d keys exceed the maximum of %d", len(metadata), maxMetadataEntries)
+	}
+	for key, value := range metadata {
+		if !metadataKeyRegexp.MatchString(key) {
+			return errors.Errorf("key %q must be 1 to 64 letters, digits, dots, dashes and underscores", key)
+		}
+		if len(value) > maxMetadataValueLength {
+			return errors.Errorf("value of %q is longer than %d bytes", key, maxMetadataValueLength)
+		}
+		if !utf8.ValidString(value) {
+			return errors.Errorf("value of %q is not valid UTF-8", key)
+		}
+		for _, c := range value {
+			if c < 0x20 || c == 0x7f {
+				return errors.Errorf("value of %q contains control characters", key)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mozilla.org/autograph/formats"
+)
+
+func TestValidateMetadata(t *testing.T) {
+	t.Parallel()
+
+	tooMany := make(map[string]string)
+	for i := 0; i <= maxMetadataEntries; i++ {
+		tooMany[fmt.Sprintf("key%d", i)] = "value"
+	}
+	for i, testcase := range []struct {
+		metadata map[string]string
+		valid    bool
+	}{
+		{nil, true},
+		{map[string]string{"build_id": "20200611150405", "vcs.revision": "4e8f2b1", "ticket": "BUG-1234"}, true},
+		{map[string]string{"description": "nightly build — été"}, true},
+		{tooMany, false},
+		{map[string]string{"": "empty key"}, false},
+		{map[string]string{"build id": "space in key"}, false},
+		{map[string]string{strings.Repeat("k", 65): "long key"}, false},
+		{map[string]string{"build_id": strings.Repeat("v", maxMetadataValueLength+1)}, false},
+		{map[string]string{"build_id": "line\nbreak"}, false},
+		{map[string]string{"build_id": "\xff"}, false},
+	} {
+		err := validateMetadata(testcase.metadata)
+		if testcase.valid && err != nil {
+			t.Errorf("testcase %d: expected metadata to be valid, got: %v", i, err)
+		}
+		if !testcase.valid && err == nil {
+			t.Errorf("testcase %d: expected metadata to be invalid", i)
+		}
+	}
+}
+
+func TestSignatureRequestMetadata(t *testing.T) {
+	t.Parallel()
+
+	auth := conf.Authorizations[0]
+	sign := func(metadata map[string]string) *httptest.ResponseRecorder {
+		body, err := json.Marshal([]formats.SignatureRequest{{
+			Input:    base64.StdEncoding.EncodeToString([]byte("foobarbaz1234abcd")),
+			KeyID:    "appkey1",
+			Metadata: metadata,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		ag.handleSignature(w, req)
+		return w
+	}
+
+	w := sign(map[string]string{"build_id": "20200611150405"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("signing failed with %d: %s", w.Code, w.Body.String())
+	}
+	var sigresps []formats.SignatureResponse
+	err := json.Unmarshal(w.Body.Bytes(), &sigresps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sigresps) != 1 || sigresps[0].Metadata["build_id"] != "20200611150405" {
+		t.Fatalf("expected response to echo the metadata, got %s", w.Body.String())
+	}
+
+	w = sign(map[string]string{"build id": "20200611150405"})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), string(formats.ErrorCodeInvalidRequest)) {
+		t.Fatalf("expected invalid metadata to be rejected, got %d: %s", w.Code, w.Body.String())
+	}
+}
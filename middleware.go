@@ -4,6 +4,8 @@ import (
 	"math/rand"
 	"net/http"
 	"time"
+
+	"go.mozilla.org/autograph/trace"
 )
 
 // Middleware wraps an http.Handler with additional functionality
@@ -23,17 +25,27 @@ func setResponseHeaders() Middleware {
 
 // setRequestID is a middleware the generates a random ID for each request processed
 // by the HTTP server. The request ID is added to the request context and used to
-// track various information and correlate logs.
+// track various information and correlate logs. A valid X-Request-Id header of the
+// client is used instead, and the request ID and traceparent header are added to the
+// trace of the context, which outbound requests propagate.
 func setRequestID() Middleware {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			rid := make([]rune, 16)
-			letters := []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
-			for i := range rid {
-				rid[i] = letters[rand.Intn(len(letters))]
+			rid := r.Header.Get(trace.HeaderRequestID)
+			if !trace.ValidRequestID(rid) {
+				ridRunes := make([]rune, 16)
+				letters := []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
+				for i := range ridRunes {
+					ridRunes[i] = letters[rand.Intn(len(letters))]
+				}
+				rid = string(ridRunes)
 			}
-
-			h.ServeHTTP(w, addToContext(r, contextKeyRequestID, string(rid)))
+			t := trace.Trace{RequestID: rid}
+			if traceparent := r.Header.Get(trace.HeaderTraceparent); trace.ValidTraceparent(traceparent) {
+				t.Traceparent = traceparent
+			}
+			r = addToContext(r, contextKeyRequestID, rid)
+			h.ServeHTTP(w, r.WithContext(trace.NewContext(r.Context(), t)))
 		})
 	}
 }
@@ -0,0 +1,51 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.mozilla.org/autograph/trace"
+)
+
+func TestSetRequestID(t *testing.T) {
+	t.Parallel()
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	for i, testcase := range []struct {
+		requestID, traceparent    string
+		keepsID, keepsTraceparent bool
+	}{
+		{"client-request-1", traceparent, true, true},
+		{"", traceparent, false, true},
+		{"not a valid id", "not a traceparent", false, false},
+	} {
+		var rid string
+		var tr trace.Trace
+		var ok bool
+		handler := handleMiddlewares(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rid = getRequestID(r)
+			tr, ok = trace.FromContext(r.Context())
+		}), setRequestID())
+		req := httptest.NewRequest("GET", "http://foo.bar/__heartbeat__", nil)
+		if testcase.requestID != "" {
+			req.Header.Set(trace.HeaderRequestID, testcase.requestID)
+		}
+		req.Header.Set(trace.HeaderTraceparent, testcase.traceparent)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if !ok || tr.RequestID != rid || rid == "" {
+			t.Fatalf("testcase %d: expected the request id %q in the trace of the context, got %+v", i, rid, tr)
+		}
+		if (rid == testcase.requestID) != testcase.keepsID {
+			t.Fatalf("testcase %d: unexpected request id %q for client request id %q", i, rid, testcase.requestID)
+		}
+		if (tr.Traceparent == testcase.traceparent) != testcase.keepsTraceparent || (!testcase.keepsTraceparent && tr.Traceparent != "") {
+			t.Fatalf("testcase %d: unexpected traceparent %q", i, tr.Traceparent)
+		}
+	}
+}
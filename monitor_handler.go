@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
 	"go.mozilla.org/autograph/formats"
@@ -24,11 +25,11 @@ func (a *autographer) handleMonitor(w http.ResponseWriter, r *http.Request) {
 	starttime := time.Now()
 	userid, err := a.authorize(r, []byte(""))
 	if err != nil {
-		httpError(w, r, http.StatusUnauthorized, "authorization verification failed: %v", err)
+		authError(w, r, err)
 		return
 	}
 	if userid != monitorAuthID {
-		httpError(w, r, http.StatusUnauthorized, "user is not permitted to call this endpoint")
+		a.authorizationDenied(w, r, http.StatusUnauthorized, formats.ErrorCodeUnauthorized, userid, "", errors.New("user is not permitted to call this endpoint"))
 		return
 	}
 
@@ -42,12 +43,18 @@ func (a *autographer) handleMonitor(w http.ResponseWriter, r *http.Request) {
 		go func(i int, s signer.Signer) {
 			defer wg.Done()
 
+			s, err := resolveSigner(s)
+			if err != nil {
+				sigerrstrs[i] = fmt.Sprintf("signer initialization failed with error: %v", err)
+				return
+			}
+
 			// First try the DataSigner interface. If the signer doesn't
 			// implement it, try the FileSigner interface. If that's still
 			// not implemented, return an error.
 			if _, ok := s.(signer.DataSigner); ok {
 				// sign with data set to the base64 of the string 'AUTOGRAPH MONITORING'
-				sig, err := s.(signer.DataSigner).SignData(MonitoringInputData, s.(signer.DataSigner).GetDefaultOptions())
+				sig, err := signer.SignDataContext(r.Context(), s.(signer.DataSigner), MonitoringInputData, s.(signer.DataSigner).GetDefaultOptions())
 				if err != nil {
 					sigerrstrs[i] = fmt.Sprintf("signing failed with error: %v", err)
 					return
@@ -80,7 +87,7 @@ func (a *autographer) handleMonitor(w http.ResponseWriter, r *http.Request) {
 					sigerrstrs[i] = fmt.Sprintf("signer %q implements FileSigner but not the TestFileGetter interface", s.Config().ID)
 					return
 				}
-				output, err := s.(signer.FileSigner).SignFile(s.(signer.TestFileGetter).GetTestFile(), s.(signer.FileSigner).GetDefaultOptions())
+				output, err := signer.SignFileContext(r.Context(), s.(signer.FileSigner), s.(signer.TestFileGetter).GetTestFile(), s.(signer.FileSigner).GetDefaultOptions())
 				if err != nil {
 					sigerrstrs[i] = fmt.Sprintf("signing failed with error: %v", err)
 					return
@@ -107,14 +114,14 @@ func (a *autographer) handleMonitor(w http.ResponseWriter, r *http.Request) {
 	wg.Wait()
 	for _, errstr := range sigerrstrs {
 		if errstr != "" {
-			httpError(w, r, http.StatusInternalServerError, errstr)
+			httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeSigningFailed, errstr)
 			return
 		}
 	}
 
 	respdata, err := json.Marshal(sigresps)
 	if err != nil {
-		httpError(w, r, http.StatusInternalServerError, "signing failed with error: %v", err)
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeSigningFailed, "signing failed with error: %v", err)
 		return
 	}
 	if a.debug {
@@ -19,8 +19,10 @@ import (
 	"go.mozilla.org/autograph/signer/genericrsa"
 	"go.mozilla.org/autograph/signer/gpg2"
 	"go.mozilla.org/autograph/signer/mar"
+	"go.mozilla.org/autograph/signer/nullsigner"
 	"go.mozilla.org/autograph/signer/pgp"
 	"go.mozilla.org/autograph/signer/rsapss"
+	"go.mozilla.org/autograph/signer/threshold"
 	"go.mozilla.org/autograph/signer/xpi"
 	margo "go.mozilla.org/mar"
 )
@@ -79,6 +81,11 @@ func TestMonitorPass(t *testing.T) {
 			err = verifyRsapssSignature(response.Signature, response.PublicKey)
 		case genericrsa.Type:
 			err = genericrsa.VerifyGenericRsaSignatureResponse(MonitoringInputData, response)
+		case threshold.Type:
+			digest := sha256.Sum256(MonitoringInputData)
+			err = threshold.VerifySignature(digest[:], response.Signature, response.PublicKey)
+		case nullsigner.Type:
+			err = nullsigner.VerifySignature(response.SignerID, MonitoringInputData, response.Signature)
 		case pgp.Type, gpg2.Type:
 			// we don't verify pgp signatures. I don't feel good about this, but the openpgp
 			// package is very much a pain to deal with and requires putting the public key
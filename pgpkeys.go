@@ -0,0 +1,101 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer/pgp"
+)
+
+// handleGeneratePGPKey generates an OpenPGP key for a pgp signer, on
+// the HSM when the signer has one, and publishes its public key when
+// the admin asks to. The signer keeps its current key until its
+// configuration is updated with the new one.
+func (a *autographer) handleGeneratePGPKey(w http.ResponseWriter, r *http.Request) {
+	userid, body, ok := a.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+	signerID := mux.Vars(r)["id"]
+	s, found := a.getSignerByID(signerID)
+	if !found {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "signer %q not found", signerID)
+		return
+	}
+	s, err := resolveSigner(s)
+	if err != nil {
+		httpError(w, r, http.StatusServiceUnavailable, formats.ErrorCodeSignerUnavailable, "%v", err)
+		return
+	}
+	pgpSigner, ok := s.(*pgp.PGPSigner)
+	if !ok {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeUnsupportedOperation, "signer %q of type %q does not generate pgp keys", signerID, s.Config().Type)
+		return
+	}
+	var req formats.PGPKeyRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "failed to parse request body: %v", err)
+		return
+	}
+	keyReq := pgp.KeyRequest{
+		Name:    req.Name,
+		Comment: req.Comment,
+		Email:   req.Email,
+		Curve:   req.Curve,
+	}
+	if req.Lifetime != "" {
+		keyReq.Lifetime, err = time.ParseDuration(req.Lifetime)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "invalid key lifetime: %v", err)
+			return
+		}
+	}
+	err = keyReq.Validate()
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "%v", err)
+		return
+	}
+	key, err := pgpSigner.GenerateKey(keyReq)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	resp := formats.PGPKey{
+		SignerID:    signerID,
+		Fingerprint: key.Fingerprint,
+		KeyID:       key.KeyID,
+		CreatedAt:   key.CreatedAt,
+		PublicKey:   key.PublicKey,
+		PrivateKey:  key.PrivateKey,
+		OnHSM:       key.OnHSM,
+	}
+	if req.Publish {
+		// the key exists even if publishing it fails, so the
+		// error is returned with the key rather than instead of it
+		resp.PublishedTo, err = pgpSigner.PublishKey(r.Context(), key)
+		if err != nil {
+			resp.PublishError = err.Error()
+		}
+	}
+	log.WithFields(log.Fields{
+		"rid":          getRequestID(r),
+		"signer_id":    signerID,
+		"fingerprint":  key.Fingerprint,
+		"on_hsm":       key.OnHSM,
+		"published_to": resp.PublishedTo,
+		"user_id":      userid,
+	}).Warn("generated pgp key for signer")
+	a.keyRotated(r, userid, signerID, fmt.Sprintf("generated pgp key %s", key.Fingerprint))
+	writeAdminJSON(w, r, resp)
+}
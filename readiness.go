@@ -0,0 +1,123 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+// shutdownTimeout is how long in-flight requests have to complete
+// when autograph shuts down, a variable for tests
+var shutdownTimeout = 30 * time.Second
+
+// setReady marks the instance ready to serve signing requests once its
+// signers are initialized
+func (a *autographer) setReady() {
+	atomic.StoreInt32(&a.ready, 1)
+	log.Infof("autograph is ready")
+}
+
+// readiness returns whether the instance should receive signing
+// requests, and why not when it shouldn't
+func (a *autographer) readiness() (bool, string) {
+	if atomic.LoadInt32(&a.draining) == 1 {
+		return false, "draining"
+	}
+	if atomic.LoadInt32(&a.ready) == 0 {
+		return false, "initializing signers"
+	}
+	if a.isStandby() {
+		return false, "standby"
+	}
+	return true, ""
+}
+
+// handleReadiness returns 200 when the instance is ready to serve
+// signing requests, and 503 before its signers are initialized and
+// while it drains on shutdown. Unlike /__lbheartbeat__, which only
+// tells the process is alive, it is meant for readiness probes.
+func (a *autographer) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpError(w, r, http.StatusMethodNotAllowed, formats.ErrorCodeInvalidMethod, "%s method not allowed; endpoint accepts GET only", r.Method)
+		return
+	}
+	ready, reason := a.readiness()
+	result := map[string]interface{}{
+		"ready": ready,
+	}
+	if reason != "" {
+		result["reason"] = reason
+	}
+	if a.leader != nil {
+		result["leader"] = a.leader.isLeader()
+	}
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// shutdown fails readiness for drainDelay so load balancers stop
+// sending requests to the instance, waits for in-flight requests,
+// gives up leadership and runs the AtExit functions of signers, which
+// zeroize their keys. When requests are still in flight after
+// shutdownTimeout, the keys are zeroized anyway but the temporary files
+// are left for the next start to recover, since the requests may still
+// be writing them.
+func (a *autographer) shutdown(server *http.Server, drainDelay time.Duration) {
+	atomic.StoreInt32(&a.draining, 1)
+	if a.stopEndEntityRotation != nil {
+		a.stopEndEntityRotation()
+	}
+	if drainDelay > 0 {
+		log.Infof("draining for %s before shutting down", drainDelay)
+		time.Sleep(drainDelay)
+	}
+	drained := true
+	if server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err := server.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			log.Errorf("main: failed to wait for in-flight requests, skipping temporary files removal: %v", err)
+			drained = false
+		}
+	}
+	if a.leader != nil {
+		a.leader.release()
+	}
+	for _, s := range a.getSigners() {
+		if d, ok := s.(deferredSigner); ok {
+			s = d.initialized()
+		}
+		statefulSigner, ok := s.(signer.StatefulSigner)
+		if !ok {
+			continue
+		}
+		err := statefulSigner.AtExit()
+		if err != nil {
+			log.Errorf("main: error in signer %s AtExit fn: %s", s.Config().ID, err)
+		}
+	}
+	if !drained {
+		return
+	}
+	err := a.cleanupTempStorage()
+	if err != nil {
+		log.Errorf("main: failed to remove temporary files: %v", err)
+	}
+}
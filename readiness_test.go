@@ -0,0 +1,109 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/signer"
+)
+
+func TestReadiness(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(1)
+	// shutting down removes the temporary storage of the autographer,
+	// which must not be the one other tests sign with
+	tempDir, err := ioutil.TempDir("", "autograph-readiness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	tmpag.cleanupTempStorage = func() error {
+		return os.RemoveAll(tempDir)
+	}
+	check := func(expectedStatus int, expectedReason string) {
+		w := httptest.NewRecorder()
+		tmpag.handleReadiness(w, httptest.NewRequest("GET", "http://foo.bar/__ready__", nil))
+		if w.Code != expectedStatus {
+			t.Fatalf("expected readiness status %d, got %d: %s", expectedStatus, w.Code, w.Body.String())
+		}
+		var result map[string]interface{}
+		err := json.Unmarshal(w.Body.Bytes(), &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reason, _ := result["reason"].(string)
+		if result["ready"] != (expectedStatus == http.StatusOK) || reason != expectedReason {
+			t.Fatalf("unexpected readiness %+v", result)
+		}
+	}
+	check(http.StatusServiceUnavailable, "initializing signers")
+	tmpag.setReady()
+	check(http.StatusOK, "")
+
+	// the liveness heartbeat keeps passing while draining
+	tmpag.shutdown(nil, 0)
+	check(http.StatusServiceUnavailable, "draining")
+	if _, err := os.Stat(tempDir); !os.IsNotExist(err) {
+		t.Fatalf("expected shutdown to remove the temporary storage, got %v", err)
+	}
+	w := httptest.NewRecorder()
+	handleLBHeartbeat(w, httptest.NewRequest("GET", "http://foo.bar/__lbheartbeat__", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected lbheartbeat to pass while draining, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	tmpag.handleReadiness(w, httptest.NewRequest("POST", "http://foo.bar/__ready__", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected POST to fail with 405, got %d", w.Code)
+	}
+}
+
+func TestShutdownLeavesInFlightRequests(t *testing.T) {
+	tmpag := newAutographer(1)
+	err := tmpag.addSigners([]signer.Configuration{conf.Signers[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanedUp := false
+	tmpag.cleanupTempStorage = func() error {
+		cleanedUp = true
+		return nil
+	}
+	defer func(timeout time.Duration) { shutdownTimeout = timeout }(shutdownTimeout)
+	shutdownTimeout = 10 * time.Millisecond
+
+	// a request that is still signing when the shutdown times out
+	release := make(chan struct{})
+	started := make(chan struct{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	server.Start()
+	defer server.Close()
+	defer close(release)
+	go http.Get(server.URL)
+	<-started
+
+	tmpag.shutdown(server.Config, 0)
+	if cleanedUp {
+		t.Fatal("expected shutdown to leave the temporary files of in-flight requests")
+	}
+	// the keys are zeroized even though requests did not drain
+	dataSigner := tmpag.getSigners()[0].(signer.DataSigner)
+	_, err = dataSigner.SignData([]byte("foo"), dataSigner.GetDefaultOptions())
+	if err == nil {
+		t.Fatal("expected the signer keys to be zeroized")
+	}
+}
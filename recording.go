@@ -0,0 +1,223 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+const (
+	// recordingTimeout is how long storing a recorded request
+	// can take
+	recordingTimeout = 5 * time.Second
+
+	// recordingJanitorInterval is how often recorded requests
+	// older than the retention are deleted
+	recordingJanitorInterval = time.Hour
+)
+
+// recordingConfig lists the signers whose requests are recorded in
+// the database to debug signature mismatches
+type recordingConfig struct {
+	Signers []string
+
+	// Retention is how long recordings are kept. They are kept
+	// forever when it is zero.
+	Retention time.Duration
+}
+
+// recordingPruner deletes old recorded requests. It is implemented
+// by the database handler.
+type recordingPruner interface {
+	DeleteRecordedRequestsBefore(ctx context.Context, before time.Time) (int64, error)
+}
+
+// requestRecorder stores and retrieves recorded requests. It is
+// implemented by the database handler.
+type requestRecorder interface {
+	InsertRecordedRequest(ctx context.Context, rec database.RecordedRequest) (int64, error)
+	GetRecordedRequest(ctx context.Context, id int64) (database.RecordedRequest, error)
+	ListRecordedRequests(ctx context.Context, signerID string, limit int) ([]database.RecordedRequest, error)
+}
+
+// enableRecording records the requests of the signers of the
+// configuration in the database, and prunes them after the retention
+func (a *autographer) enableRecording(conf recordingConfig) error {
+	if len(conf.Signers) == 0 && conf.Retention <= 0 {
+		return nil
+	}
+	if a.db == nil {
+		return errors.New("request recording requires a database")
+	}
+	if len(conf.Signers) > 0 {
+		err := a.initRecording(a.db, conf.Signers)
+		if err != nil {
+			return err
+		}
+	}
+	if conf.Retention > 0 {
+		a.startRecordingJanitor(a.db, conf.Retention)
+	}
+	return nil
+}
+
+// initRecording records the successful requests of the listed
+// signers with the recorder
+func (a *autographer) initRecording(recorder requestRecorder, signerIDs []string) error {
+	a.recordedSigners = make(map[string]bool)
+	for _, id := range signerIDs {
+		if _, found := a.getSignerByID(id); !found {
+			return errors.Errorf("cannot record requests of unknown signer %q", id)
+		}
+		a.recordedSigners[id] = true
+		log.Warnf("recording requests of signer %q for debugging", id)
+	}
+	a.recorder = recorder
+	return nil
+}
+
+// startRecordingJanitor deletes recorded requests older than the
+// retention in the background, on the leader only
+func (a *autographer) startRecordingJanitor(pruner recordingPruner, retention time.Duration) {
+	a.startBackgroundJob("recording janitor", recordingJanitorInterval, func(ctx context.Context) error {
+		return pruneRecordings(ctx, pruner, retention)
+	})
+}
+
+// pruneRecordings deletes recorded requests older than the retention
+func pruneRecordings(ctx context.Context, pruner recordingPruner, retention time.Duration) error {
+	n, err := pruner.DeleteRecordedRequestsBefore(ctx, time.Now().Add(-retention))
+	if err != nil {
+		return err
+	}
+	log.Infof("deleted %d recorded requests older than %s", n, retention)
+	return nil
+}
+
+// recordRequest stores a sanitized signing request in the background
+// when its signer is recorded
+func (a *autographer) recordRequest(rec database.RecordedRequest) {
+	if a.recorder == nil || !a.recordedSigners[rec.SignerID] {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), recordingTimeout)
+		defer cancel()
+		_, err := a.recorder.InsertRecordedRequest(ctx, rec)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"rid":       rec.RequestID,
+				"signer_id": rec.SignerID,
+			}).Warnf("failed to record request: %v", err)
+		}
+	}()
+}
+
+// recordedInputHash returns the recorded hash of the input of a
+// signing endpoint: the hex input itself for hash signing, like in the
+// signing logs, and its SHA256 otherwise
+func recordedInputHash(endpoint string, input []byte) string {
+	if endpoint == "/sign/hash" {
+		return fmt.Sprintf("%X", input)
+	}
+	return hashSHA256AsHex(input)
+}
+
+// replaySignature signs input with a signer for a signing endpoint
+// and returns the signature and its recorded output hash: the SHA256
+// of the signed file for file signing, and of the encoded signature
+// otherwise
+func replaySignature(ctx context.Context, s signer.Signer, endpoint string, input []byte, options interface{}) (sigresp formats.SignatureResponse, outputHash string, err error) {
+	conf := s.Config()
+	sigresp = formats.SignatureResponse{
+		Ref:        id(),
+		Type:       conf.Type,
+		Mode:       conf.Mode,
+		SignerID:   conf.ID,
+		PublicKey:  conf.PublicKey,
+		X5U:        conf.X5U,
+		SignerOpts: conf.SignerOpts,
+	}
+	var sig signer.Signature
+	switch endpoint {
+	case "/sign/hash":
+		hashSigner, ok := s.(signer.HashSigner)
+		if !ok {
+			return sigresp, "", errors.Errorf("signer %q does not implement hash signing", conf.ID)
+		}
+		sig, err = signer.SignHashContext(ctx, hashSigner, input, options)
+	case "/sign/data":
+		dataSigner, ok := s.(signer.DataSigner)
+		if !ok {
+			return sigresp, "", errors.Errorf("signer %q does not implement data signing", conf.ID)
+		}
+		sig, err = signer.SignDataContext(ctx, dataSigner, input, options)
+	case "/sign/file":
+		fileSigner, ok := s.(signer.FileSigner)
+		if !ok {
+			return sigresp, "", errors.Errorf("signer %q does not implement file signing", conf.ID)
+		}
+		var signedfile []byte
+		signedfile, err = signer.SignFileContext(ctx, fileSigner, input, options)
+		if err != nil {
+			return sigresp, "", err
+		}
+		sigresp.SignedFile = base64.StdEncoding.EncodeToString(signedfile)
+		return sigresp, hashSHA256AsHex(signedfile), nil
+	default:
+		return sigresp, "", errors.Errorf("cannot replay requests of endpoint %q", endpoint)
+	}
+	if err != nil {
+		return sigresp, "", err
+	}
+	sigresp.Signature, err = sig.Marshal()
+	if err != nil {
+		return sigresp, "", errors.Wrap(err, "failed to encode signature")
+	}
+	return sigresp, hashSHA256AsHex([]byte(sigresp.Signature)), nil
+}
+
+// recordSignatureRequest records a successful signature of the
+// signature handler when its signer is recorded
+func (a *autographer) recordSignatureRequest(r *http.Request, userid string, sigreq formats.SignatureRequest, sigresp formats.SignatureResponse, input, signedfile []byte) {
+	if a.recorder == nil || !a.recordedSigners[sigresp.SignerID] {
+		return
+	}
+	endpoint := r.URL.RequestURI()
+	options, err := json.Marshal(sigreq.Options)
+	if err != nil {
+		log.Warnf("failed to marshal options of recorded request: %v", err)
+		return
+	}
+	outputHash := hashSHA256AsHex([]byte(sigresp.Signature))
+	if endpoint == "/sign/file" {
+		outputHash = hashSHA256AsHex(signedfile)
+	}
+	a.recordRequest(database.RecordedRequest{
+		Ref:         sigresp.Ref,
+		RequestID:   getRequestID(r),
+		SignerID:    sigresp.SignerID,
+		UserID:      userid,
+		Endpoint:    endpoint,
+		InputHash:   recordedInputHash(endpoint, input),
+		InputLength: len(input),
+		Options:     string(options),
+		OutputHash:  outputHash,
+		Status:      http.StatusCreated,
+		DurationMS:  int(time.Since(getRequestStartTime(r)) / time.Millisecond),
+	})
+}
@@ -0,0 +1,209 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+// memoryRecorder is a requestRecorder that keeps recorded requests
+// in memory
+type memoryRecorder struct {
+	sync.Mutex
+	recs []database.RecordedRequest
+}
+
+func (m *memoryRecorder) InsertRecordedRequest(ctx context.Context, rec database.RecordedRequest) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	rec.ID = int64(len(m.recs) + 1)
+	rec.CreatedAt = time.Now()
+	m.recs = append(m.recs, rec)
+	return rec.ID, nil
+}
+
+func (m *memoryRecorder) GetRecordedRequest(ctx context.Context, id int64) (database.RecordedRequest, error) {
+	m.Lock()
+	defer m.Unlock()
+	if id < 1 || id > int64(len(m.recs)) {
+		return database.RecordedRequest{}, database.ErrRecordingNotFound
+	}
+	return m.recs[id-1], nil
+}
+
+func (m *memoryRecorder) DeleteRecordedRequestsBefore(ctx context.Context, before time.Time) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	var (
+		kept []database.RecordedRequest
+		n    int64
+	)
+	for _, rec := range m.recs {
+		if rec.CreatedAt.Before(before) {
+			n++
+			continue
+		}
+		kept = append(kept, rec)
+	}
+	m.recs = kept
+	return n, nil
+}
+
+func (m *memoryRecorder) ListRecordedRequests(ctx context.Context, signerID string, limit int) (recs []database.RecordedRequest, err error) {
+	m.Lock()
+	defer m.Unlock()
+	for i := len(m.recs) - 1; i >= 0 && len(recs) < limit; i-- {
+		if m.recs[i].SignerID == signerID {
+			recs = append(recs, m.recs[i])
+		}
+	}
+	return recs, nil
+}
+
+func (m *memoryRecorder) count() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.recs)
+}
+
+func TestRecordAndReplayRequests(t *testing.T) {
+	t.Parallel()
+
+	var signerConf signer.Configuration
+	for _, s := range conf.Signers {
+		if s.ID == "testauthenticode" {
+			signerConf = s
+		}
+	}
+	tmpag := newAutographer(100)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners([]signer.Configuration{signerConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := authorization{ID: "recordeduser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: []string{signerConf.ID}}
+	admin := authorization{ID: "adminuser", Key: "a4ex0ztpcu9msw5h5flc7qfhsc7btg2tzb2s3hgf1gtx5vqhnh", Admin: true}
+	err = tmpag.addAuthorizations([]authorization{user, admin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := new(memoryRecorder)
+	err = tmpag.initRecording(recorder, []string{signerConf.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newRequest := func(method, url string, auth authorization, body []byte) *http.Request {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+		return req
+	}
+
+	input := []byte("some data to record")
+	body, err := json.Marshal([]formats.SignatureRequest{{Input: base64.StdEncoding.EncodeToString(input), KeyID: signerConf.ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	tmpag.handleSignature(w, newRequest("POST", "http://foo.bar/sign/data", user, body))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("signing failed with %d: %s", w.Code, w.Body.String())
+	}
+	for i := 0; recorder.count() == 0; i++ {
+		if i > 100 {
+			t.Fatal("timed out waiting for the request to be recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// only admins can list recordings
+	w = httptest.NewRecorder()
+	tmpag.handleListRecordings(w, newRequest("GET", "http://foo.bar/admin/recordings?signer="+signerConf.ID, user, nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected non-admin user to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	tmpag.handleListRecordings(w, newRequest("GET", "http://foo.bar/admin/recordings?signer="+signerConf.ID, admin, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("listing recordings failed with %d: %s", w.Code, w.Body.String())
+	}
+	var recs []formats.RecordedRequest
+	err = json.Unmarshal(w.Body.Bytes(), &recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].UserID != user.ID || recs[0].Endpoint != "/sign/data" ||
+		recs[0].InputHash != hashSHA256AsHex(input) || recs[0].InputLength != len(input) {
+		t.Fatalf("unexpected recordings: %+v", recs)
+	}
+	if bytes.Contains(w.Body.Bytes(), input) || bytes.Contains(w.Body.Bytes(), []byte(base64.StdEncoding.EncodeToString(input))) {
+		t.Fatal("recordings must not contain the input")
+	}
+
+	replay := func(input []byte) *httptest.ResponseRecorder {
+		body, err := json.Marshal(formats.ReplayRequest{Input: base64.StdEncoding.EncodeToString(input)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		url := fmt.Sprintf("http://foo.bar/admin/recordings/%d/replay", recs[0].ID)
+		req := mux.SetURLVars(newRequest("POST", url, admin, body), map[string]string{"id": fmt.Sprint(recs[0].ID)})
+		w := httptest.NewRecorder()
+		tmpag.handleReplayRecording(w, req)
+		return w
+	}
+	w = replay([]byte("some other data"))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected replay with a different input to fail, got %d: %s", w.Code, w.Body.String())
+	}
+	w = replay(input)
+	if w.Code != http.StatusOK {
+		t.Fatalf("replay failed with %d: %s", w.Code, w.Body.String())
+	}
+	var replayResp formats.ReplayResponse
+	err = json.Unmarshal(w.Body.Bytes(), &replayResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pkcs1v15 signatures are deterministic
+	if !replayResp.OutputMatches || replayResp.OutputHash != recs[0].OutputHash {
+		t.Fatalf("expected replayed signature to match the recording, got %+v", replayResp)
+	}
+}
+
+func TestPruneRecordings(t *testing.T) {
+	t.Parallel()
+
+	recorder := new(memoryRecorder)
+	for _, age := range []time.Duration{48 * time.Hour, 25 * time.Hour, time.Hour} {
+		recorder.recs = append(recorder.recs, database.RecordedRequest{SignerID: "appkey1", CreatedAt: time.Now().Add(-age)})
+	}
+	err := pruneRecordings(context.Background(), recorder, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.recs) != 1 || time.Since(recorder.recs[0].CreatedAt) > 2*time.Hour {
+		t.Fatalf("expected only the recent recording to be kept, got %+v", recorder.recs)
+	}
+}
@@ -0,0 +1,157 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/formats"
+)
+
+const (
+	// registryTimeout is how long storing a signed artifact can take
+	registryTimeout = 5 * time.Second
+
+	// maxArtifactNameLength is the maximum length of the artifact
+	// names clients supply. Longer names are truncated.
+	maxArtifactNameLength = 255
+
+	// defaultArtifactsLimit is the number of signed artifacts
+	// returned when the admin does not set a limit
+	defaultArtifactsLimit = 100
+
+	// maxArtifactsLimit is the maximum number of signed artifacts
+	// returned at once
+	maxArtifactsLimit = 1000
+)
+
+// artifactRegistryConfig enables the registry of signed files
+type artifactRegistryConfig struct {
+	Enabled bool
+}
+
+// artifactRegistry stores and finds signed files. It is implemented by
+// the database handler.
+type artifactRegistry interface {
+	InsertSignedArtifact(ctx context.Context, a database.SignedArtifact) error
+	FindSignedArtifacts(ctx context.Context, digest, name string, limit int) ([]database.SignedArtifact, error)
+}
+
+// enableArtifactRegistry registers signed files in the database, when
+// the configuration enables it
+func (a *autographer) enableArtifactRegistry(conf artifactRegistryConfig) error {
+	if !conf.Enabled {
+		return nil
+	}
+	if a.db == nil {
+		return errors.New("the signed artifact registry requires a database")
+	}
+	a.registry = a.db
+	log.Infof("registering signed files in the database")
+	return nil
+}
+
+// sha256Hex returns the lowercase hex SHA256 digest of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// registerArtifact stores a signed file in the registry in the
+// background
+func (a *autographer) registerArtifact(r *http.Request, ref, signerID, userid, name string, metadata map[string]string, input, signedfile []byte) {
+	if a.registry == nil {
+		return
+	}
+	if len(name) > maxArtifactNameLength {
+		name = name[:maxArtifactNameLength]
+	}
+	artifact := database.SignedArtifact{
+		Ref:          ref,
+		SignerID:     signerID,
+		UserID:       userid,
+		Name:         name,
+		InputDigest:  sha256Hex(input),
+		OutputDigest: sha256Hex(signedfile),
+		Metadata:     metadata,
+	}
+	rid := getRequestID(r)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+		defer cancel()
+		err := a.registry.InsertSignedArtifact(ctx, artifact)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"rid":           rid,
+				"signer_id":     artifact.SignerID,
+				"output_digest": artifact.OutputDigest,
+			}).Errorf("failed to register signed artifact: %v", err)
+		}
+	}()
+}
+
+// handleFindArtifacts returns the signed files whose input or output
+// digest is the "digest" query parameter, or whose name is the "name"
+// query parameter
+func (a *autographer) handleFindArtifacts(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := a.authorizeAdmin(w, r); !ok {
+		return
+	}
+	if a.registry == nil {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "signed artifact registry is not enabled")
+		return
+	}
+	digest := strings.ToLower(r.URL.Query().Get("digest"))
+	name := r.URL.Query().Get("name")
+	if digest == "" && name == "" {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "missing digest or name query parameter")
+		return
+	}
+	if digest != "" {
+		raw, err := hex.DecodeString(digest)
+		if err != nil || len(raw) != sha256.Size {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "digest must be a hex encoded SHA256 digest")
+			return
+		}
+	}
+	limit := defaultArtifactsLimit
+	if r.URL.Query().Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit < 1 || limit > maxArtifactsLimit {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "limit must be between 1 and %d", maxArtifactsLimit)
+			return
+		}
+	}
+	artifacts, err := a.registry.FindSignedArtifacts(r.Context(), digest, name, limit)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	resp := make([]formats.SignedArtifact, len(artifacts))
+	for i, artifact := range artifacts {
+		resp[i] = formats.SignedArtifact{
+			Ref:          artifact.Ref,
+			SignerID:     artifact.SignerID,
+			UserID:       artifact.UserID,
+			Name:         artifact.Name,
+			InputDigest:  artifact.InputDigest,
+			OutputDigest: artifact.OutputDigest,
+			CreatedAt:    artifact.CreatedAt,
+			Metadata:     artifact.Metadata,
+		}
+	}
+	writeAdminJSON(w, r, resp)
+}
@@ -0,0 +1,170 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+// memoryRegistry is an artifactRegistry that keeps signed artifacts
+// in memory
+type memoryRegistry struct {
+	sync.Mutex
+	artifacts []database.SignedArtifact
+}
+
+func (m *memoryRegistry) InsertSignedArtifact(ctx context.Context, a database.SignedArtifact) error {
+	m.Lock()
+	defer m.Unlock()
+	a.ID = int64(len(m.artifacts) + 1)
+	a.CreatedAt = time.Now()
+	m.artifacts = append(m.artifacts, a)
+	return nil
+}
+
+func (m *memoryRegistry) FindSignedArtifacts(ctx context.Context, digest, name string, limit int) (artifacts []database.SignedArtifact, err error) {
+	m.Lock()
+	defer m.Unlock()
+	for i := len(m.artifacts) - 1; i >= 0 && len(artifacts) < limit; i-- {
+		a := m.artifacts[i]
+		if (digest == "" || a.InputDigest == digest || a.OutputDigest == digest) && (name == "" || a.Name == name) {
+			artifacts = append(artifacts, a)
+		}
+	}
+	return artifacts, nil
+}
+
+func (m *memoryRegistry) count() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.artifacts)
+}
+
+func TestSignedArtifactRegistry(t *testing.T) {
+	t.Parallel()
+
+	var signerConf signer.Configuration
+	for _, s := range conf.Signers {
+		if s.ID == "testmar" {
+			signerConf = s
+		}
+	}
+	tmpag := newAutographer(100)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners([]signer.Configuration{signerConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := authorization{ID: "registryuser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: []string{signerConf.ID}}
+	admin := authorization{ID: "registryadmin", Key: "a4ex0ztpcu9msw5h5flc7qfhsc7btg2tzb2s3hgf1gtx5vqhnh", Admin: true}
+	err = tmpag.addAuthorizations([]authorization{user, admin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := new(memoryRegistry)
+	tmpag.registry = registry
+
+	newRequest := func(method, url string, auth authorization, body []byte) *http.Request {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+		return req
+	}
+
+	// the base64 of miniMarB from the mar signer unit tests
+	b64Input := "TUFSMQAAAX0AAAAAAAABlgAAAAIAAAACAAABACDExrLgT1Lc1TbLUiKbIVxQl60L6ATvYe6L6JwewAbVSjhEUCGMQ0OK1TmKi18GGijNxaf/uU7Lm/RTyvm0VL7gcODm/pogDmRttf+rc2UfX7nthPxCgB/oOj7fXqDwYpiBPNSSHMIATUb7fnRRHqVTdqhkQZ2RqQsyKL7O6D/bN62EHmVTnn5LbYqYnDLhp+bEVGPo9ETsUpSk7XlFq3v96blLi4Iazm4LyPUXtQmixNwe6OOGpS+ZqobGAtooe7nPPC0Q/kqqKKQmcwCyTP/+lD1Vk7JXbDyGzYj9f9Cloq8PH7gyxOmNvwfHxMU95Jw/ExdFUDdK6QW7UPRTx7AAAAADAAAAQMSHgnYz95K8msSv6YA6IWRfT99ig0W74KDl0QvM0Ti+BRvI7FSmjjt4QOfVHRDko31NuVa2sUCo/PibauLI7GwAAAAAYWFhYWFhYWFhYWFhYWFhYWFhYWFhAAAAFQAAAWgAAAAVAAACWC9mb28vYmFyAA=="
+	input, err := base64.StdEncoding.DecodeString(b64Input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := map[string]string{"build_id": "20200611150405", "vcs.revision": "4e8f2b1"}
+	body, err := json.Marshal([]formats.SignatureRequest{{Input: b64Input, KeyID: signerConf.ID, ArtifactName: "update.mar", Metadata: metadata}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	tmpag.handleSignature(w, newRequest("POST", "http://foo.bar/sign/file", user, body))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("signing failed with %d: %s", w.Code, w.Body.String())
+	}
+	var sigresps []formats.SignatureResponse
+	err = json.Unmarshal(w.Body.Bytes(), &sigresps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sigresps[0].Metadata, metadata) {
+		t.Fatalf("expected response to echo the metadata, got %v", sigresps[0].Metadata)
+	}
+	signedfile, err := base64.StdEncoding.DecodeString(sigresps[0].SignedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; registry.count() == 0; i++ {
+		if i > 100 {
+			t.Fatal("timed out waiting for the artifact to be registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	find := func(auth authorization, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		tmpag.handleFindArtifacts(w, newRequest("GET", "http://foo.bar/admin/artifacts?"+query, auth, nil))
+		return w
+	}
+	// only admins can look up artifacts
+	if w := find(user, "name=update.mar"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected non-admin user to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, query := range []string{
+		"name=update.mar",
+		"digest=" + sha256Hex(input),
+		// digests are matched case insensitively, like the upper
+		// case hashes of the signing logs
+		"digest=" + strings.ToUpper(sha256Hex(signedfile)),
+	} {
+		w := find(admin, query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("finding artifacts by %q failed with %d: %s", query, w.Code, w.Body.String())
+		}
+		var artifacts []formats.SignedArtifact
+		err = json.Unmarshal(w.Body.Bytes(), &artifacts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(artifacts) != 1 || artifacts[0].Ref != sigresps[0].Ref || artifacts[0].SignerID != signerConf.ID ||
+			artifacts[0].UserID != user.ID || artifacts[0].Name != "update.mar" ||
+			artifacts[0].InputDigest != sha256Hex(input) || artifacts[0].OutputDigest != sha256Hex(signedfile) ||
+			!reflect.DeepEqual(artifacts[0].Metadata, metadata) {
+			t.Fatalf("unexpected artifacts found by %q: %+v", query, artifacts)
+		}
+	}
+
+	if w := find(admin, "name=other.mar"); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Fatalf("expected no artifacts, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, query := range []string{"", "digest=foo", "name=update.mar&limit=0"} {
+		if w := find(admin, query); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected query %q to fail with 400, got %d: %s", query, w.Code, w.Body.String())
+		}
+	}
+}
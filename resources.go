@@ -0,0 +1,325 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/formats"
+)
+
+const (
+	// cgroupRoot is where the cgroup of the container is mounted
+	cgroupRoot = "/sys/fs/cgroup"
+
+	// cgroupV1Unlimited is the smallest memory limit cgroups v1
+	// report when a cgroup has no limit, the largest page aligned
+	// int64
+	cgroupV1Unlimited = 1 << 62
+
+	// defaultMemoryLimitRatio is the fraction of the memory limit
+	// the Go runtime and admission control use by default
+	defaultMemoryLimitRatio = 0.9
+
+	// defaultLargeRequestSize is the body size in bytes from which
+	// requests go through memory admission control by default
+	defaultLargeRequestSize = 10 << 20
+
+	// defaultRequestMemoryFactor is the memory a large request is
+	// expected to use by default as a multiple of its body size:
+	// the body, the decoded input, the signed output and its
+	// encoding in the response
+	defaultRequestMemoryFactor = 4
+)
+
+// resourcesConfig configures how autograph adapts to the CPU and
+// memory limits of its container
+type resourcesConfig struct {
+	// DisableLimitDetection stops autograph from reading the CPU
+	// and memory limits of its cgroup
+	DisableLimitDetection bool
+
+	// MemoryLimit is the memory limit in bytes of the instance.
+	// It takes precedence over the limit of the cgroup.
+	MemoryLimit int64
+
+	// MemoryLimitRatio is the fraction of the memory limit used
+	// as the Go memory limit and by admission control, leaving
+	// the rest to the HSM library and signer subprocesses. 0.9
+	// by default.
+	MemoryLimitRatio float64
+
+	// LargeRequestSize is the body size in bytes from which
+	// requests are only admitted when the instance has the memory
+	// to process them, 10MB by default
+	LargeRequestSize int64
+
+	// RequestMemoryFactor is the memory a large request is
+	// expected to use as a multiple of its body size, 4 by default
+	RequestMemoryFactor float64
+}
+
+// containerLimits are the CPU and memory limits of a cgroup, zero
+// when the cgroup has no limit
+type containerLimits struct {
+	CPUs   float64
+	Memory int64
+}
+
+// readCgroupLimits reads the CPU quota and memory limit of the cgroup
+// mounted at root, in the cgroups v2 or v1 hierarchy. Missing files
+// are not an error, autograph may not run in a container.
+func readCgroupLimits(root string) (limits containerLimits, err error) {
+	readFile := func(name string) (string, bool, error) {
+		data, err := ioutil.ReadFile(filepath.Join(root, name))
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, errors.Wrapf(err, "failed to read cgroup file %q", name)
+		}
+		return strings.TrimSpace(string(data)), true, nil
+	}
+	parseInt := func(name, value string) (int64, error) {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to parse cgroup file %q", name)
+		}
+		return n, nil
+	}
+
+	// cgroups v2: "$MAX $PERIOD" with "max" for no quota
+	cpuMax, found, err := readFile("cpu.max")
+	if err != nil {
+		return limits, err
+	}
+	if found {
+		fields := strings.Fields(cpuMax)
+		if len(fields) != 2 {
+			return limits, errors.Errorf("invalid cgroup file %q: %q", "cpu.max", cpuMax)
+		}
+		if fields[0] != "max" {
+			quota, err := parseInt("cpu.max", fields[0])
+			if err != nil {
+				return limits, err
+			}
+			period, err := parseInt("cpu.max", fields[1])
+			if err != nil {
+				return limits, err
+			}
+			if period > 0 {
+				limits.CPUs = float64(quota) / float64(period)
+			}
+		}
+	} else {
+		// cgroups v1: a quota of -1 is no quota
+		quota, found, err := readFile("cpu/cpu.cfs_quota_us")
+		if err != nil {
+			return limits, err
+		}
+		period, periodFound, err := readFile("cpu/cpu.cfs_period_us")
+		if err != nil {
+			return limits, err
+		}
+		if found && periodFound {
+			q, err := parseInt("cpu/cpu.cfs_quota_us", quota)
+			if err != nil {
+				return limits, err
+			}
+			p, err := parseInt("cpu/cpu.cfs_period_us", period)
+			if err != nil {
+				return limits, err
+			}
+			if q > 0 && p > 0 {
+				limits.CPUs = float64(q) / float64(p)
+			}
+		}
+	}
+
+	memoryMax, found, err := readFile("memory.max")
+	if err != nil {
+		return limits, err
+	}
+	if found {
+		if memoryMax != "max" {
+			limits.Memory, err = parseInt("memory.max", memoryMax)
+			if err != nil {
+				return limits, err
+			}
+		}
+		return limits, nil
+	}
+	memoryMax, found, err = readFile("memory/memory.limit_in_bytes")
+	if err != nil {
+		return limits, err
+	}
+	if found {
+		limit, err := parseInt("memory/memory.limit_in_bytes", memoryMax)
+		if err != nil {
+			return limits, err
+		}
+		if limit < cgroupV1Unlimited {
+			limits.Memory = limit
+		}
+	}
+	return limits, nil
+}
+
+// configureResources sets GOMAXPROCS and the Go memory limit from the
+// limits of the container, unless they are set in the environment, and
+// returns the admission control of large requests when the instance
+// has a memory limit
+func configureResources(conf resourcesConfig, root string) (*memoryAdmission, error) {
+	if conf.MemoryLimit < 0 {
+		return nil, errors.Errorf("invalid negative memory limit %d", conf.MemoryLimit)
+	}
+	if conf.MemoryLimitRatio == 0 {
+		conf.MemoryLimitRatio = defaultMemoryLimitRatio
+	}
+	if conf.MemoryLimitRatio < 0 || conf.MemoryLimitRatio > 1 {
+		return nil, errors.Errorf("memory limit ratio must be between 0 and 1, got %g", conf.MemoryLimitRatio)
+	}
+	if conf.LargeRequestSize == 0 {
+		conf.LargeRequestSize = defaultLargeRequestSize
+	}
+	if conf.RequestMemoryFactor == 0 {
+		conf.RequestMemoryFactor = defaultRequestMemoryFactor
+	}
+	if conf.LargeRequestSize < 0 || conf.RequestMemoryFactor < 0 {
+		return nil, errors.New("large request size and request memory factor must be positive")
+	}
+
+	var (
+		limits containerLimits
+		err    error
+	)
+	if !conf.DisableLimitDetection {
+		limits, err = readCgroupLimits(root)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if limits.CPUs > 0 {
+		procs := int(math.Ceil(limits.CPUs))
+		if _, ok := os.LookupEnv("GOMAXPROCS"); ok {
+			log.Infof("keeping GOMAXPROCS %d from the environment, the container has %g CPUs", runtime.GOMAXPROCS(0), limits.CPUs)
+		} else if procs < runtime.NumCPU() {
+			runtime.GOMAXPROCS(procs)
+			log.Infof("set GOMAXPROCS to %d for the %g CPUs of the container", procs, limits.CPUs)
+		}
+	}
+
+	memoryLimit := limits.Memory
+	if conf.MemoryLimit > 0 {
+		memoryLimit = conf.MemoryLimit
+	}
+	if memoryLimit == 0 {
+		return nil, nil
+	}
+	limit := int64(float64(memoryLimit) * conf.MemoryLimitRatio)
+	if _, ok := os.LookupEnv("GOMEMLIMIT"); ok {
+		log.Infof("keeping GOMEMLIMIT from the environment, the instance has %d bytes of memory", memoryLimit)
+	} else if setGoMemoryLimit(limit) {
+		log.Infof("set the Go memory limit to %d bytes of the %d bytes of the instance", limit, memoryLimit)
+	} else {
+		log.Warnf("cannot set the Go memory limit with %s, only admission control uses the %d bytes memory limit", runtime.Version(), limit)
+	}
+	log.Infof("admitting requests larger than %d bytes when they fit in the %d bytes memory limit", conf.LargeRequestSize, limit)
+	return &memoryAdmission{
+		limit:            limit,
+		largeRequestSize: conf.LargeRequestSize,
+		factor:           conf.RequestMemoryFactor,
+		usage:            processMemoryUsage,
+	}, nil
+}
+
+// processMemoryUsage returns the memory the Go runtime holds from the
+// system, which is what the Go memory limit applies to
+func processMemoryUsage() int64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return int64(stats.Sys - stats.HeapReleased)
+}
+
+// memoryAdmission admits large requests while the memory they are
+// expected to use fits in the memory limit, instead of letting a burst
+// of them get the instance OOM killed in the middle of signatures
+type memoryAdmission struct {
+	sync.Mutex
+	limit            int64
+	largeRequestSize int64
+	factor           float64
+
+	// reserved is the memory of admitted large requests, which
+	// usage doesn't include until they read their body
+	reserved int64
+	usage    func() int64
+}
+
+// admit reserves the memory of a request with a body of size bytes. It
+// returns false when the memory doesn't fit in the limit, otherwise the
+// reservation lasts until the returned func is called.
+func (m *memoryAdmission) admit(size int64) (release func(), ok bool) {
+	if size < m.largeRequestSize {
+		return func() {}, true
+	}
+	need := int64(float64(size) * m.factor)
+	m.Lock()
+	defer m.Unlock()
+	if m.usage()+m.reserved+need > m.limit {
+		return nil, false
+	}
+	m.reserved += need
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.Lock()
+			m.reserved -= need
+			m.Unlock()
+		})
+	}, true
+}
+
+// admitRequestMemory reserves memory for a large request until it is
+// served. It writes a 503 to the client and returns false when the
+// instance doesn't have the memory for the request.
+func (a *autographer) admitRequestMemory(w http.ResponseWriter, r *http.Request) bool {
+	if a.memory == nil || r.ContentLength < a.memory.largeRequestSize {
+		return true
+	}
+	release, ok := a.memory.admit(r.ContentLength)
+	if !ok {
+		log.WithFields(log.Fields{
+			"rid":  getRequestID(r),
+			"size": r.ContentLength,
+		}).Warn("rejecting large request without enough memory headroom")
+		if a.stats != nil {
+			sendStatsErr := a.stats.Incr("memory_admission_rejected", nil, 1.0)
+			if sendStatsErr != nil {
+				log.Warnf("Error sending memory_admission_rejected: %s", sendStatsErr)
+			}
+		}
+		w.Header().Set("Retry-After", "5")
+		httpError(w, r, http.StatusServiceUnavailable, formats.ErrorCodeOverloaded, "not enough memory to process a request body of %d bytes", r.ContentLength)
+		return false
+	}
+	// the server cancels the context of a request once it is served
+	go func() {
+		<-r.Context().Done()
+		release()
+	}()
+	return true
+}
@@ -0,0 +1,179 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadCgroupLimits(t *testing.T) {
+	t.Parallel()
+
+	for i, testcase := range []struct {
+		files  map[string]string
+		limits containerLimits
+		err    bool
+	}{
+		{nil, containerLimits{}, false},
+		{map[string]string{"cpu.max": "max 100000\n", "memory.max": "max\n"}, containerLimits{}, false},
+		{map[string]string{"cpu.max": "150000 100000\n", "memory.max": "536870912\n"}, containerLimits{CPUs: 1.5, Memory: 536870912}, false},
+		{map[string]string{
+			"cpu/cpu.cfs_quota_us":         "200000\n",
+			"cpu/cpu.cfs_period_us":        "100000\n",
+			"memory/memory.limit_in_bytes": "1073741824\n",
+		}, containerLimits{CPUs: 2, Memory: 1073741824}, false},
+		{map[string]string{
+			"cpu/cpu.cfs_quota_us":         "-1\n",
+			"cpu/cpu.cfs_period_us":        "100000\n",
+			"memory/memory.limit_in_bytes": "9223372036854771712\n",
+		}, containerLimits{}, false},
+		{map[string]string{"cpu.max": "150000\n"}, containerLimits{}, true},
+		{map[string]string{"memory.max": "lots\n"}, containerLimits{}, true},
+	} {
+		root, err := ioutil.TempDir("", "autograph-cgroup")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		for name, content := range testcase.files {
+			path := filepath.Join(root, name)
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ioutil.WriteFile(path, []byte(content), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		limits, err := readCgroupLimits(root)
+		if testcase.err {
+			if err == nil {
+				t.Errorf("testcase %d: expected invalid cgroup files to fail", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("testcase %d: failed to read cgroup limits: %v", i, err)
+			continue
+		}
+		if limits != testcase.limits {
+			t.Errorf("testcase %d: expected limits %+v, got %+v", i, testcase.limits, limits)
+		}
+	}
+}
+
+func TestConfigureResources(t *testing.T) {
+	memory, err := configureResources(resourcesConfig{DisableLimitDetection: true}, "/nonexistent")
+	if err != nil || memory != nil {
+		t.Fatalf("expected no admission control without a memory limit, got %+v %v", memory, err)
+	}
+	_, err = configureResources(resourcesConfig{MemoryLimitRatio: 1.5}, "/nonexistent")
+	if err == nil {
+		t.Fatal("expected a memory limit ratio above 1 to fail")
+	}
+	// GOMEMLIMIT keeps the configured limit from changing the
+	// memory limit of the test binary
+	if _, ok := os.LookupEnv("GOMEMLIMIT"); !ok {
+		os.Setenv("GOMEMLIMIT", "off")
+		defer os.Unsetenv("GOMEMLIMIT")
+	}
+	memory, err = configureResources(resourcesConfig{DisableLimitDetection: true, MemoryLimit: 1000, MemoryLimitRatio: 0.5}, "/nonexistent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memory.limit != 500 || memory.largeRequestSize != defaultLargeRequestSize || memory.factor != defaultRequestMemoryFactor {
+		t.Fatalf("unexpected admission control %+v", memory)
+	}
+}
+
+func TestMemoryAdmission(t *testing.T) {
+	t.Parallel()
+
+	usage := int64(600)
+	m := &memoryAdmission{
+		limit:            1000,
+		largeRequestSize: 10,
+		factor:           2,
+		usage:            func() int64 { return usage },
+	}
+	release, ok := m.admit(5)
+	if !ok {
+		t.Fatal("expected small request to be admitted")
+	}
+	release()
+	release, ok = m.admit(150)
+	if !ok {
+		t.Fatal("expected large request that fits in the memory limit to be admitted")
+	}
+	_, ok = m.admit(100)
+	if ok {
+		t.Fatal("expected large request not to fit next to the memory reserved by another one")
+	}
+	release()
+	release()
+	if m.reserved != 0 {
+		t.Fatalf("expected releasing twice to free the reservation once, got %d reserved", m.reserved)
+	}
+	_, ok = m.admit(100)
+	if !ok {
+		t.Fatal("expected large request to be admitted once the reservation was released")
+	}
+}
+
+func TestLargeRequestRejectedWithoutMemory(t *testing.T) {
+	t.Parallel()
+
+	ag := newAutographer(1)
+	ag.memory = &memoryAdmission{
+		limit:            1000,
+		largeRequestSize: 100,
+		factor:           4,
+		usage:            func() int64 { return 500 },
+	}
+	read := func(ctx context.Context, size int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://foo.bar/sign/file", bytes.NewReader(make([]byte, size))).WithContext(ctx)
+		w := httptest.NewRecorder()
+		ag.readRequestBody(w, req)
+		return w
+	}
+	w := read(context.Background(), 50)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected small request to be read, got %d: %s", w.Code, w.Body.String())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w = read(ctx, 100)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected large request that fits in memory to be read, got %d: %s", w.Code, w.Body.String())
+	}
+	w = read(context.Background(), 100)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected large request without memory headroom to be rejected, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// the reservation is released once the first request is served
+	cancel()
+	for i := 0; i < 100; i++ {
+		ag.memory.Lock()
+		reserved := ag.memory.reserved
+		ag.memory.Unlock()
+		if reserved == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w = read(context.Background(), 100)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected large request to be read once memory is released, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,217 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+// responseSigningConfig is the service key autograph signs its API
+// responses with, so clients can prove to downstream systems that
+// a response came from autograph
+type responseSigningConfig struct {
+	// KeyID is the kid of the JWS header of signed responses
+	KeyID string
+
+	// PrivateKey is a PEM ECDSA or RSA private key. Responses are
+	// not signed when it is empty.
+	PrivateKey string
+}
+
+// responseSigner signs response bodies with detached JWS
+type responseSigner struct {
+	keyID string
+	alg   string
+	hash  crypto.Hash
+	key   crypto.Signer
+
+	// publicKey is the base64 DER of the public key
+	publicKey string
+}
+
+// enableResponseSigning signs API responses with the service key of the
+// configuration, when it sets one
+func (a *autographer) enableResponseSigning(conf responseSigningConfig) (err error) {
+	if conf.PrivateKey == "" {
+		return nil
+	}
+	a.responseSigner, err = newResponseSigner(conf)
+	if err != nil {
+		return err
+	}
+	log.Infof("signing responses with %s key %q", a.responseSigner.alg, a.responseSigner.keyID)
+	return nil
+}
+
+// newResponseSigner parses the service key of conf and picks the JWS
+// algorithm matching it
+func newResponseSigner(conf responseSigningConfig) (*responseSigner, error) {
+	if conf.KeyID == "" {
+		return nil, errors.New("response signing requires a key ID")
+	}
+	key, err := signer.ParsePrivateKey([]byte(conf.PrivateKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse response signing key")
+	}
+	rs := &responseSigner{keyID: conf.KeyID}
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			rs.alg, rs.hash = "ES256", crypto.SHA256
+		case elliptic.P384():
+			rs.alg, rs.hash = "ES384", crypto.SHA384
+		case elliptic.P521():
+			rs.alg, rs.hash = "ES512", crypto.SHA512
+		default:
+			return nil, errors.Errorf("unsupported response signing curve %q", k.Params().Name)
+		}
+		rs.key = k
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, errors.Errorf("response signing RSA keys must be at least 2048 bits, got %d", k.N.BitLen())
+		}
+		rs.alg, rs.hash = "RS256", crypto.SHA256
+		rs.key = k
+	default:
+		return nil, errors.Errorf("unsupported response signing key type %T", key)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(rs.key.Public())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal response signing public key")
+	}
+	rs.publicKey = base64.StdEncoding.EncodeToString(pubDER)
+	return rs, nil
+}
+
+// sign returns a detached compact JWS of body, the protected header
+// and signature separated by two dots
+func (rs *responseSigner) sign(body []byte) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": rs.alg,
+		"kid": rs.keyID,
+	})
+	if err != nil {
+		return "", err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(header)
+	h := rs.hash.New()
+	h.Write([]byte(protected + "." + base64.RawURLEncoding.EncodeToString(body)))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	switch key := rs.key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			return "", err
+		}
+		// JWS ECDSA signatures are the fixed size concatenation
+		// of r and s
+		size := (key.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(sig[size-len(rBytes):size], rBytes)
+		copy(sig[2*size-len(sBytes):], sBytes)
+	default:
+		sig, err = rs.key.Sign(rand.Reader, digest, rs.hash)
+		if err != nil {
+			return "", err
+		}
+	}
+	return protected + ".." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// signedResponseWriter buffers the response of a handler until it
+// can be signed
+type signedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (s *signedResponseWriter) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+}
+
+func (s *signedResponseWriter) Write(data []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.body.Write(data)
+}
+
+// signResponses is a middleware that signs the bodies of responses
+// with the service key of rs and sends the signature in the
+// X-Autograph-Response-Signature header. It runs after
+// compressResponses so the signature covers the uncompressed body.
+func signResponses(rs *responseSigner) Middleware {
+	return func(h http.Handler) http.Handler {
+		if rs == nil {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				h.ServeHTTP(w, r)
+				return
+			}
+			sw := &signedResponseWriter{ResponseWriter: w}
+			h.ServeHTTP(sw, r)
+			if sw.status == 0 {
+				sw.status = http.StatusOK
+			}
+			sig, err := rs.sign(sw.body.Bytes())
+			if err != nil {
+				// the client gets an unsigned response, which
+				// it can't tell apart from a tampered one
+				log.WithFields(log.Fields{
+					"rid": getRequestID(r),
+				}).Errorf("failed to sign response: %v", err)
+			} else {
+				w.Header().Set(formats.HeaderResponseSignature, sig)
+			}
+			w.WriteHeader(sw.status)
+			w.Write(sw.body.Bytes())
+		})
+	}
+}
+
+// handleResponseSigningKey returns the public key verifying the
+// signatures of responses
+func (a *autographer) handleResponseSigningKey(w http.ResponseWriter, r *http.Request) {
+	if a.responseSigner == nil {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "response signing is not enabled")
+		return
+	}
+	respdata, err := json.Marshal(formats.ResponseSigningKey{
+		KeyID:     a.responseSigner.keyID,
+		Algorithm: a.responseSigner.alg,
+		PublicKey: a.responseSigner.publicKey,
+	})
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "failed to marshal response signing key: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respdata)
+}
@@ -0,0 +1,170 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mozilla.org/autograph/client"
+	"go.mozilla.org/autograph/formats"
+)
+
+func pemPrivateKey(t *testing.T, key crypto.PrivateKey) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func TestSignResponses(t *testing.T) {
+	t.Parallel()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		key crypto.Signer
+		alg string
+	}{
+		{ecKey, "ES384"},
+		{rsaKey, "RS256"},
+	} {
+		rs, err := newResponseSigner(responseSigningConfig{KeyID: "responses-2020", PrivateKey: pemPrivateKey(t, tc.key)})
+		if err != nil {
+			t.Fatalf("testcase %d: failed to load response signing key: %v", i, err)
+		}
+		handler := handleMiddlewares(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`[{"signature":"c2lnbmF0dXJl"}]`))
+			}),
+			compressResponses(),
+			signResponses(rs),
+		)
+		req := httptest.NewRequest("POST", "http://foo.bar/sign/data", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated || w.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("testcase %d: expected a gzipped 201 response, got %d %q", i, w.Code, w.Header().Get("Content-Encoding"))
+		}
+		gz, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the signature covers the uncompressed body
+		signature := w.Header().Get(formats.HeaderResponseSignature)
+		header, err := base64.RawURLEncoding.DecodeString(strings.Split(signature, ".")[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(header) != `{"alg":"`+tc.alg+`","kid":"responses-2020"}` {
+			t.Fatalf("testcase %d: unexpected JWS header %s", i, header)
+		}
+		err = client.VerifyResponseSignature(signature, body, tc.key.Public())
+		if err != nil {
+			t.Fatalf("testcase %d: failed to verify response signature: %v", i, err)
+		}
+		err = client.VerifyResponseSignature(signature, bytes.Replace(body, []byte("c2ln"), []byte("c2lm"), 1), tc.key.Public())
+		if err == nil {
+			t.Fatalf("testcase %d: expected tampered response to fail verification", i)
+		}
+	}
+}
+
+func TestNewResponseSignerErrors(t *testing.T) {
+	t.Parallel()
+
+	smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		conf responseSigningConfig
+		err  string
+	}{
+		{responseSigningConfig{PrivateKey: pemPrivateKey(t, ecKey)}, "requires a key ID"},
+		{responseSigningConfig{KeyID: "foo", PrivateKey: "not a key"}, "failed to parse response signing key"},
+		{responseSigningConfig{KeyID: "foo", PrivateKey: pemPrivateKey(t, smallKey)}, "at least 2048 bits"},
+	} {
+		_, err := newResponseSigner(tc.conf)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Fatalf("testcase %d: expected error containing %q, got %v", i, tc.err, err)
+		}
+	}
+}
+
+func TestHandleResponseSigningKey(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(1)
+	req := httptest.NewRequest("GET", "http://foo.bar/response-signing-key", nil)
+	w := httptest.NewRecorder()
+	tmpag.handleResponseSigningKey(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without response signing, got %d", w.Code)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.responseSigner, err = newResponseSigner(responseSigningConfig{KeyID: "responses-2020", PrivateKey: pemPrivateKey(t, ecKey)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	tmpag.handleResponseSigningKey(w, req)
+	var key formats.ResponseSigningKey
+	err = json.Unmarshal(w.Body.Bytes(), &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.KeyID != "responses-2020" || key.Algorithm != "ES256" {
+		t.Fatalf("unexpected response signing key %+v", key)
+	}
+	der, err := base64.StdEncoding.DecodeString(key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub.(*ecdsa.PublicKey).X.Cmp(ecKey.X) != 0 {
+		t.Fatal("expected the public key of the response signing key")
+	}
+}
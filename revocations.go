@@ -0,0 +1,203 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/formats"
+)
+
+const (
+	// maxRevocationRefLength is the maximum length of the signature
+	// references revocations are looked up by
+	maxRevocationRefLength = 64
+
+	// defaultRevocationsLimit is the number of revocations returned
+	// when the admin does not set a limit
+	defaultRevocationsLimit = 100
+
+	// maxRevocationsLimit is the maximum number of revocations
+	// returned at once
+	maxRevocationsLimit = 1000
+)
+
+// revocationsConfig enables the registry of revoked signatures
+type revocationsConfig struct {
+	Enabled bool
+}
+
+// revocationStore stores and finds revoked signatures. It is
+// implemented by the database handler.
+type revocationStore interface {
+	InsertRevocation(ctx context.Context, r database.Revocation) (database.Revocation, error)
+	FindRevocations(ctx context.Context, ref, digest string) ([]database.Revocation, error)
+	ListRevocations(ctx context.Context, limit int) ([]database.Revocation, error)
+}
+
+// enableRevocations records signature revocations in the database,
+// when the configuration enables it
+func (a *autographer) enableRevocations(conf revocationsConfig) error {
+	if !conf.Enabled {
+		return nil
+	}
+	if a.db == nil {
+		return errors.New("the signature revocation registry requires a database")
+	}
+	a.revocations = a.db
+	log.Infof("recording signature revocations in the database")
+	return nil
+}
+
+// parseRevocationQuery returns the signature reference and the
+// lowercase digest a revocation or status query refers to. At least one
+// of them must be set.
+func parseRevocationQuery(ref, digest string) (string, string, error) {
+	if ref == "" && digest == "" {
+		return "", "", errors.New("missing ref or digest of the signature")
+	}
+	if len(ref) > maxRevocationRefLength {
+		return "", "", errors.Errorf("invalid ref longer than %d characters", maxRevocationRefLength)
+	}
+	if digest != "" {
+		var err error
+		digest, err = parseDigest(digest)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return ref, digest, nil
+}
+
+// revocationResponse returns the API form of a revocation
+func revocationResponse(rev database.Revocation) formats.Revocation {
+	return formats.Revocation{
+		Ref:       rev.Ref,
+		Digest:    rev.Digest,
+		Reason:    rev.Reason,
+		CreatedBy: rev.CreatedBy,
+		CreatedAt: rev.CreatedAt,
+	}
+}
+
+// handleRevocations lists the latest revocations on GET, and revokes a
+// signature by reference or digest on POST
+func (a *autographer) handleRevocations(w http.ResponseWriter, r *http.Request) {
+	userid, body, ok := a.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+	if a.revocations == nil {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "signature revocations are not enabled")
+		return
+	}
+	if r.Method == http.MethodGet {
+		limit := defaultRevocationsLimit
+		if r.URL.Query().Get("limit") != "" {
+			var err error
+			limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+			if err != nil || limit < 1 || limit > maxRevocationsLimit {
+				httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "limit must be between 1 and %d", maxRevocationsLimit)
+				return
+			}
+		}
+		revocations, err := a.revocations.ListRevocations(r.Context(), limit)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+			return
+		}
+		resp := []formats.Revocation{}
+		for _, rev := range revocations {
+			resp = append(resp, revocationResponse(rev))
+		}
+		writeAdminJSON(w, r, resp)
+		return
+	}
+	var req formats.Revocation
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "failed to parse request body: %v", err)
+		return
+	}
+	req.Ref, req.Digest, err = parseRevocationQuery(req.Ref, req.Digest)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "%v", err)
+		return
+	}
+	if req.Reason == "" {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "missing reason for revoking signature")
+		return
+	}
+	rev, err := a.revocations.InsertRevocation(r.Context(), database.Revocation{
+		Ref:       req.Ref,
+		Digest:    req.Digest,
+		Reason:    req.Reason,
+		CreatedBy: userid,
+	})
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"rid":     getRequestID(r),
+		"ref":     rev.Ref,
+		"digest":  rev.Digest,
+		"reason":  rev.Reason,
+		"user_id": userid,
+	}).Warn("revoked signature")
+	a.exportEvent(formats.ExportedEvent{
+		Type:      formats.EventTypeRevocation,
+		RequestID: getRequestID(r),
+		UserID:    userid,
+		Ref:       rev.Ref,
+		Digest:    rev.Digest,
+		Reason:    rev.Reason,
+	})
+	writeAdminJSON(w, r, revocationResponse(rev))
+}
+
+// handleRevocationStatus tells an authenticated client whether the
+// signature with the "ref" query parameter, or the input or file with
+// the "digest" query parameter, was revoked
+func (a *autographer) handleRevocationStatus(w http.ResponseWriter, r *http.Request) {
+	body, read := a.readRequestBody(w, r)
+	if !read {
+		return
+	}
+	_, err := a.authorize(r, body)
+	if err != nil {
+		authError(w, r, err)
+		return
+	}
+	if a.revocations == nil {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "signature revocations are not enabled")
+		return
+	}
+	ref, digest, err := parseRevocationQuery(r.URL.Query().Get("ref"), r.URL.Query().Get("digest"))
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "%v", err)
+		return
+	}
+	revocations, err := a.revocations.FindRevocations(r.Context(), ref, digest)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	resp := formats.RevocationStatus{
+		Revoked:     len(revocations) > 0,
+		Revocations: []formats.Revocation{},
+	}
+	for _, rev := range revocations {
+		resp.Revocations = append(resp.Revocations, revocationResponse(rev))
+	}
+	writeAdminJSON(w, r, resp)
+}
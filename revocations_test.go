@@ -0,0 +1,175 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+// memoryRevocationStore is a revocationStore that keeps revocations in
+// memory
+type memoryRevocationStore struct {
+	sync.Mutex
+	revocations []database.Revocation
+}
+
+func (m *memoryRevocationStore) InsertRevocation(ctx context.Context, r database.Revocation) (database.Revocation, error) {
+	m.Lock()
+	defer m.Unlock()
+	r.ID = int64(len(m.revocations) + 1)
+	r.CreatedAt = time.Now()
+	m.revocations = append(m.revocations, r)
+	return r, nil
+}
+
+func (m *memoryRevocationStore) FindRevocations(ctx context.Context, ref, digest string) (revocations []database.Revocation, err error) {
+	m.Lock()
+	defer m.Unlock()
+	for i := len(m.revocations) - 1; i >= 0; i-- {
+		r := m.revocations[i]
+		if (ref != "" && r.Ref == ref) || (digest != "" && r.Digest == digest) {
+			revocations = append(revocations, r)
+		}
+	}
+	return revocations, nil
+}
+
+func (m *memoryRevocationStore) ListRevocations(ctx context.Context, limit int) (revocations []database.Revocation, err error) {
+	m.Lock()
+	defer m.Unlock()
+	for i := len(m.revocations) - 1; i >= 0 && len(revocations) < limit; i-- {
+		revocations = append(revocations, m.revocations[i])
+	}
+	return revocations, nil
+}
+
+func TestSignatureRevocations(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(1)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners([]signer.Configuration{conf.Signers[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := authorization{ID: "revocationuser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: []string{conf.Signers[0].ID}}
+	admin := authorization{ID: "revocationadmin", Key: "a4ex0ztpcu9msw5h5flc7qfhsc7btg2tzb2s3hgf1gtx5vqhnh", Admin: true}
+	err = tmpag.addAuthorizations([]authorization{user, admin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := new(memorySink)
+	tmpag.addExporter(exporterConfig{Type: "memory", BatchSize: 1, FlushInterval: 10 * time.Millisecond}, sink)
+
+	newRequest := func(method, url string, auth authorization, body []byte) *http.Request {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+		return req
+	}
+	status := func(query string) (resp formats.RevocationStatus) {
+		w := httptest.NewRecorder()
+		tmpag.handleRevocationStatus(w, newRequest("GET", "http://foo.bar/revocations/status?"+query, user, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("revocation status of %q failed with %d: %s", query, w.Code, w.Body.String())
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	w := httptest.NewRecorder()
+	tmpag.handleRevocationStatus(w, newRequest("GET", "http://foo.bar/revocations/status?ref=abc", user, nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected revocations to be disabled, got %d: %s", w.Code, w.Body.String())
+	}
+	tmpag.revocations = new(memoryRevocationStore)
+
+	digest := sha256Hex([]byte("a mis-signed add-on"))
+	body, err := json.Marshal(formats.Revocation{Digest: digest, Reason: "signed with the wrong key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	tmpag.handleRevocations(w, newRequest("POST", "http://foo.bar/admin/revocations", user, body))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected non-admin user to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, invalid := range []formats.Revocation{
+		{Reason: "no ref or digest"},
+		{Ref: "1dh3a7ncpd7q71rm08k0ttbbc1"},
+		{Digest: "not hex", Reason: "invalid digest"},
+	} {
+		invalidBody, err := json.Marshal(invalid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = httptest.NewRecorder()
+		tmpag.handleRevocations(w, newRequest("POST", "http://foo.bar/admin/revocations", admin, invalidBody))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected invalid revocation %+v to be refused, got %d: %s", invalid, w.Code, w.Body.String())
+		}
+	}
+	w = httptest.NewRecorder()
+	tmpag.handleRevocations(w, newRequest("POST", "http://foo.bar/admin/revocations", admin, body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("revoking digest failed with %d: %s", w.Code, w.Body.String())
+	}
+
+	resp := status("digest=" + digest)
+	if !resp.Revoked || len(resp.Revocations) != 1 || resp.Revocations[0].Reason != "signed with the wrong key" ||
+		resp.Revocations[0].CreatedBy != admin.ID {
+		t.Fatalf("expected digest to be revoked, got %+v", resp)
+	}
+	resp = status("ref=1dh3a7ncpd7q71rm08k0ttbbc1")
+	if resp.Revoked || len(resp.Revocations) != 0 {
+		t.Fatalf("expected signature not to be revoked, got %+v", resp)
+	}
+
+	w = httptest.NewRecorder()
+	tmpag.handleRevocations(w, newRequest("GET", "http://foo.bar/admin/revocations?limit=10", admin, nil))
+	var list []formats.Revocation
+	err = json.Unmarshal(w.Body.Bytes(), &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Digest != digest {
+		t.Fatalf("unexpected revocations: %s", w.Body.String())
+	}
+
+	var revocation *formats.ExportedEvent
+	for i := 0; revocation == nil; i++ {
+		if i > 100 {
+			t.Fatal("timed out waiting for the revocation event")
+		}
+		time.Sleep(10 * time.Millisecond)
+		for _, event := range sink.received() {
+			if event.Type == formats.EventTypeRevocation {
+				revocation = &event
+				break
+			}
+		}
+	}
+	if revocation.UserID != admin.ID || revocation.Digest != digest || revocation.Reason != "signed with the wrong key" {
+		t.Fatalf("unexpected revocation event %+v", revocation)
+	}
+}
@@ -0,0 +1,47 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/signer"
+)
+
+// rootSetConfig is a named set of trust anchors, like the roots of the
+// prod, stage or autograph-dev environment, that /verify requests can
+// pin signatures to
+type rootSetConfig struct {
+	Name string
+
+	// Certificates are the PEM encoded root certificates of the
+	// set
+	Certificates string
+}
+
+// addRootSets parses the root sets of the configuration
+func (a *autographer) addRootSets(confs []rootSetConfig) error {
+	if len(confs) == 0 {
+		return nil
+	}
+	rootSets := make(map[string]*signer.RootSet)
+	for _, conf := range confs {
+		if conf.Name == "" {
+			return errors.New("root sets must have a name")
+		}
+		if _, ok := rootSets[conf.Name]; ok {
+			return errors.Errorf("root set %q is defined more than once", conf.Name)
+		}
+		set, err := signer.ParseRootSet(conf.Name, []byte(conf.Certificates))
+		if err != nil {
+			return err
+		}
+		rootSets[conf.Name] = set
+		log.Infof("loaded root set %q with %d certificates", conf.Name, len(set.Certs))
+	}
+	a.rootSets = rootSets
+	return nil
+}
@@ -0,0 +1,87 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultRotationCheckSample is the number of recent signatures
+	// re-verified after a rotation when the configuration does not
+	// set a sample size
+	defaultRotationCheckSample = 10
+
+	// rotationCheckTimeout is how long re-verifying the signatures
+	// of a signer can take, downloads of their x5u included
+	rotationCheckTimeout = time.Minute
+)
+
+// rotationCheckConfig configures the re-verification of recent
+// signatures after the end-entity of a signer changes
+type rotationCheckConfig struct {
+	// Disabled stops autograph from re-verifying signatures after
+	// end-entity rotations and rollbacks
+	Disabled bool
+
+	// Sample is the number of the latest signatures of the signer
+	// re-verified, 10 by default
+	Sample int
+}
+
+// signatureReverifier is implemented by signers that re-verify their
+// latest signatures with the chains published at their x5u, like the
+// contentsignaturepki signers
+type signatureReverifier interface {
+	Reverify(ctx context.Context, sample int) (verified int, err error)
+}
+
+// reverifyAfterRotation re-verifies a sample of the latest signatures
+// of a signer in the background once its end-entity changed
+func (a *autographer) reverifyAfterRotation(signerID string, s signatureReverifier) {
+	if a.rotationCheck.Disabled {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), rotationCheckTimeout)
+		defer cancel()
+		a.reverifySignatures(ctx, signerID, s)
+	}()
+}
+
+// reverifySignatures re-verifies a sample of the latest signatures of a
+// signer, and alerts with an error log and a failed
+// rotation_reverification metric when any of them doesn't verify with
+// its published x5u anymore
+func (a *autographer) reverifySignatures(ctx context.Context, signerID string, s signatureReverifier) error {
+	sample := a.rotationCheck.Sample
+	if sample <= 0 {
+		sample = defaultRotationCheckSample
+	}
+	verified, err := s.Reverify(ctx, sample)
+	result := "success"
+	if err != nil {
+		result = "failed"
+		log.WithFields(log.Fields{
+			"signer_id": signerID,
+			"verified":  verified,
+		}).Errorf("signatures failed re-verification after end-entity rotation: %v", err)
+	} else {
+		log.WithFields(log.Fields{
+			"signer_id": signerID,
+			"verified":  verified,
+		}).Info("re-verified signatures after end-entity rotation")
+	}
+	if a.stats != nil {
+		sendStatsErr := a.stats.Incr("rotation_reverification", []string{"signer:" + signerID, "result:" + result}, 1.0)
+		if sendStatsErr != nil {
+			log.Warnf("Error sending rotation_reverification: %s", sendStatsErr)
+		}
+	}
+	return err
+}
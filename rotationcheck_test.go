@@ -0,0 +1,45 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// sampledReverifier is a signatureReverifier that records the sample
+// size it was asked for
+type sampledReverifier struct {
+	sample int
+	err    error
+}
+
+func (s *sampledReverifier) Reverify(ctx context.Context, sample int) (int, error) {
+	s.sample = sample
+	if s.err != nil {
+		return 0, s.err
+	}
+	return sample + 1, nil
+}
+
+func TestReverifySignatures(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(1)
+	reverifier := new(sampledReverifier)
+	err := tmpag.reverifySignatures(context.Background(), "rotated", reverifier)
+	if err != nil || reverifier.sample != defaultRotationCheckSample {
+		t.Fatalf("expected the default sample to be re-verified, got %d: %v", reverifier.sample, err)
+	}
+
+	tmpag.rotationCheck.Sample = 3
+	reverifier.err = errors.New("signature does not verify")
+	err = tmpag.reverifySignatures(context.Background(), "rotated", reverifier)
+	if err != reverifier.err || reverifier.sample != 3 {
+		t.Fatalf("expected the failed re-verification of 3 signatures, got %d: %v", reverifier.sample, err)
+	}
+}
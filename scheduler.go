@@ -0,0 +1,253 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mozilla.org/autograph/formats"
+)
+
+// priorityHeader is the request header clients use to lower the
+// priority of a request below the priority of their authorization
+const priorityHeader = "X-Autograph-Priority"
+
+// requestPriority is the scheduling class of a signing request
+type requestPriority int
+
+const (
+	priorityLow requestPriority = iota
+	priorityNormal
+	priorityHigh
+)
+
+var priorityNames = map[string]requestPriority{
+	"low":    priorityLow,
+	"normal": priorityNormal,
+	"high":   priorityHigh,
+}
+
+// parsePriority returns the priority named "low", "normal" or "high",
+// or normal when the name is empty
+func parsePriority(name string) (requestPriority, error) {
+	if name == "" {
+		return priorityNormal, nil
+	}
+	p, ok := priorityNames[name]
+	if !ok {
+		return priorityNormal, errors.Errorf("unknown priority %q, must be one of low, normal or high", name)
+	}
+	return p, nil
+}
+
+func (p requestPriority) String() string {
+	for name, value := range priorityNames {
+		if value == p {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// schedulerConfig configures the number of signing requests processed
+// at once, and how the requests waiting for a worker are queued
+type schedulerConfig struct {
+	// Workers is the number of requests processed at once.
+	// Scheduling is disabled when it is zero.
+	Workers int
+
+	// MaxQueued is the number of requests that can wait for a
+	// worker. Requests beyond it are rejected. Defaults to
+	// 10 times the number of workers.
+	MaxQueued int
+
+	// ShedLowPriorityAt is the queue length from which low
+	// priority requests are rejected, keeping the rest of the
+	// queue for normal and high priority requests. Defaults to
+	// half of MaxQueued.
+	ShedLowPriorityAt int
+}
+
+// errSchedulerOverloaded is returned when a request is rejected
+// because too many requests are waiting for a worker
+var errSchedulerOverloaded = errors.New("too many requests are waiting to be processed")
+
+// scheduler hands a fixed number of worker slots to signing requests,
+// high priority requests first and in arrival order within a priority
+type scheduler struct {
+	sync.Mutex
+	conf    schedulerConfig
+	running int
+	queued  int
+	// queues holds the channels of waiting requests, indexed by
+	// priority
+	queues [priorityHigh + 1]*list.List
+}
+
+// enableScheduler queues signing requests beyond the number of workers
+// of the configuration, when it sets one
+func (a *autographer) enableScheduler(conf schedulerConfig) {
+	if conf.Workers > 0 {
+		a.scheduler = newScheduler(conf)
+	}
+}
+
+func newScheduler(conf schedulerConfig) *scheduler {
+	if conf.MaxQueued <= 0 {
+		conf.MaxQueued = 10 * conf.Workers
+	}
+	if conf.ShedLowPriorityAt <= 0 {
+		conf.ShedLowPriorityAt = conf.MaxQueued / 2
+	}
+	s := &scheduler{conf: conf}
+	for i := range s.queues {
+		s.queues[i] = list.New()
+	}
+	return s
+}
+
+// acquire waits for a worker slot. It returns errSchedulerOverloaded
+// when the queue is too long for the priority of the request, or the
+// error of the context when it is done first.
+func (s *scheduler) acquire(ctx context.Context, p requestPriority) error {
+	s.Lock()
+	if s.running < s.conf.Workers && s.queued == 0 {
+		s.running++
+		s.Unlock()
+		return nil
+	}
+	if s.queued >= s.conf.MaxQueued || (p == priorityLow && s.queued >= s.conf.ShedLowPriorityAt) {
+		s.Unlock()
+		return errSchedulerOverloaded
+	}
+	ready := make(chan struct{})
+	elem := s.queues[p].PushBack(ready)
+	s.queued++
+	s.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		s.Lock()
+		defer s.Unlock()
+		select {
+		case <-ready:
+			// the slot was handed over while the context
+			// ended, pass it on to the next request
+			s.releaseLocked()
+		default:
+			s.queues[p].Remove(elem)
+			s.queued--
+		}
+		return ctx.Err()
+	}
+}
+
+// release frees a worker slot and hands it to the next waiting
+// request of the highest priority
+func (s *scheduler) release() {
+	s.Lock()
+	defer s.Unlock()
+	s.releaseLocked()
+}
+
+func (s *scheduler) releaseLocked() {
+	for p := priorityHigh; p >= priorityLow; p-- {
+		if elem := s.queues[p].Front(); elem != nil {
+			s.queues[p].Remove(elem)
+			s.queued--
+			// the slot passes to the waiting request, so
+			// the running count does not change
+			close(elem.Value.(chan struct{}))
+			return
+		}
+	}
+	s.running--
+}
+
+// load returns the number of requests running and waiting for a
+// worker
+func (s *scheduler) load() (running, queued int) {
+	s.Lock()
+	defer s.Unlock()
+	return s.running, s.queued
+}
+
+// getRequestPriority returns the priority of a request: the priority
+// of the user authorization, or the priority of the request header
+// when it is lower
+func (a *autographer) getRequestPriority(r *http.Request, userid string) (requestPriority, error) {
+	auth, err := a.getAuthByID(userid)
+	if err != nil {
+		return priorityNormal, err
+	}
+	p, err := parsePriority(auth.Priority)
+	if err != nil {
+		return priorityNormal, err
+	}
+	if r.Header.Get(priorityHeader) != "" {
+		requested, err := parsePriority(r.Header.Get(priorityHeader))
+		if err != nil {
+			return priorityNormal, err
+		}
+		if requested < p {
+			p = requested
+		}
+	}
+	return p, nil
+}
+
+// admitRequest reserves an in-flight slot for the user and, when
+// scheduling is enabled, waits for a worker. It writes an error to the
+// client and returns false when the request is rejected, otherwise
+// callers must call the returned release func when they are done.
+func (a *autographer) admitRequest(w http.ResponseWriter, r *http.Request, userid string) (release func(), ok bool) {
+	releaseUser, ok := a.acquireUserSlot(w, r, userid)
+	if !ok {
+		return nil, false
+	}
+	if a.scheduler == nil {
+		endRequest := a.load.startRequest()
+		return func() {
+			endRequest()
+			releaseUser()
+		}, true
+	}
+	p, err := a.getRequestPriority(r, userid)
+	if err != nil {
+		releaseUser()
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "%v", err)
+		return nil, false
+	}
+	err = a.scheduler.acquire(r.Context(), p)
+	if err != nil {
+		releaseUser()
+		switch err {
+		case errSchedulerOverloaded:
+			log.WithFields(log.Fields{
+				"rid":      getRequestID(r),
+				"user_id":  userid,
+				"priority": p.String(),
+			}).Warn("shedding signing request")
+			w.Header().Set("Retry-After", "1")
+			httpError(w, r, http.StatusServiceUnavailable, formats.ErrorCodeOverloaded, "%v", err)
+		default:
+			httpError(w, r, http.StatusServiceUnavailable, formats.ErrorCodeCanceled, "request ended while waiting for a worker: %v", err)
+		}
+		return nil, false
+	}
+	endRequest := a.load.startRequest()
+	return func() {
+		endRequest()
+		a.scheduler.release()
+		releaseUser()
+	}, true
+}
@@ -0,0 +1,140 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/signer"
+)
+
+// waitQueued waits for the scheduler to have n requests queued
+func waitQueued(t *testing.T, s *scheduler, n int) {
+	for i := 0; i < 1000; i++ {
+		s.Lock()
+		queued := s.queued
+		s.Unlock()
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d queued requests", n)
+}
+
+func TestSchedulerPriorityOrder(t *testing.T) {
+	t.Parallel()
+
+	s := newScheduler(schedulerConfig{Workers: 1})
+	err := s.acquire(context.Background(), priorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := make(chan requestPriority, 3)
+	for i, p := range []requestPriority{priorityLow, priorityNormal, priorityHigh} {
+		go func(p requestPriority) {
+			err := s.acquire(context.Background(), p)
+			if err != nil {
+				t.Error(err)
+			}
+			order <- p
+			s.release()
+		}(p)
+		waitQueued(t, s, i+1)
+	}
+	s.release()
+	for _, expected := range []requestPriority{priorityHigh, priorityNormal, priorityLow} {
+		p := <-order
+		if p != expected {
+			t.Fatalf("expected %s priority request to run next, got %s", expected, p)
+		}
+	}
+}
+
+func TestSchedulerShedsLoad(t *testing.T) {
+	t.Parallel()
+
+	s := newScheduler(schedulerConfig{Workers: 1, MaxQueued: 2, ShedLowPriorityAt: 1})
+	err := s.acquire(context.Background(), priorityHigh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 2)
+	go func() { done <- s.acquire(ctx, priorityNormal) }()
+	waitQueued(t, s, 1)
+
+	err = s.acquire(context.Background(), priorityLow)
+	if err != errSchedulerOverloaded {
+		t.Fatalf("expected low priority request to be shed, got %v", err)
+	}
+	go func() { done <- s.acquire(ctx, priorityHigh) }()
+	waitQueued(t, s, 2)
+	err = s.acquire(context.Background(), priorityHigh)
+	if err != errSchedulerOverloaded {
+		t.Fatalf("expected request to be rejected when the queue is full, got %v", err)
+	}
+
+	// waiting requests leave the queue when their context ends
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != context.Canceled {
+			t.Fatalf("expected canceled request, got %v", err)
+		}
+	}
+	s.release()
+	if s.running != 0 || s.queued != 0 {
+		t.Fatalf("expected an idle scheduler, got %d running and %d queued", s.running, s.queued)
+	}
+}
+
+func TestGetRequestPriority(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(1)
+	err := tmpag.addSigners([]signer.Configuration{conf.Signers[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers := []string{conf.Signers[0].ID}
+	err = tmpag.addAuthorizations([]authorization{
+		{ID: "releaseuser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: signers, Priority: "high"},
+		{ID: "bulkuser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: signers, Priority: "low"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, testcase := range []struct {
+		userid   string
+		header   string
+		expected requestPriority
+	}{
+		{"releaseuser", "", priorityHigh},
+		{"releaseuser", "low", priorityLow},
+		// requests cannot raise their priority
+		{"bulkuser", "high", priorityLow},
+	} {
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/data", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(priorityHeader, testcase.header)
+		p, err := tmpag.getRequestPriority(req, testcase.userid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p != testcase.expected {
+			t.Fatalf("test case %d: expected priority %s, got %s", i, testcase.expected, p)
+		}
+	}
+
+	err = tmpag.addAuthorizations([]authorization{{ID: "badpriority", Key: "abcdef", Signers: signers, Priority: "urgent"}})
+	if err == nil {
+		t.Fatal("expected unknown priority to fail")
+	}
+}
@@ -0,0 +1,154 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/formats"
+)
+
+// securityLogConfig routes the security events of authentication
+// failures, authorization denials, policy rejections, admin actions
+// and key rotations away from the request logs
+type securityLogConfig struct {
+	// Output is "stdout", "stderr" or the path of a file the
+	// security events are appended to as JSON lines. Events are
+	// not written to a log when it is empty.
+	Output string
+
+	// Exporters send security events to dedicated sinks. When it
+	// is empty, security events go to the event exporters of
+	// signing and audit events.
+	Exporters []exporterConfig
+}
+
+// securityLog writes security events as JSON lines
+type securityLog struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// write appends a security event to the log
+func (l *securityLog) write(data []byte) {
+	l.Lock()
+	defer l.Unlock()
+	_, err := l.w.Write(append(data, '\n'))
+	if err != nil {
+		log.Errorf("failed to write security event: %v", err)
+	}
+}
+
+// enableSecurityLog opens the output and starts the exporters of the
+// security event log
+func (a *autographer) enableSecurityLog(conf securityLogConfig) error {
+	switch conf.Output {
+	case "":
+	case "stdout":
+		a.securityLog = &securityLog{w: os.Stdout}
+	case "stderr":
+		a.securityLog = &securityLog{w: os.Stderr}
+	default:
+		fd, err := os.OpenFile(conf.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return errors.Wrap(err, "failed to open security log")
+		}
+		a.securityLog = &securityLog{w: fd}
+	}
+	for i, exporterConf := range conf.Exporters {
+		sink, err := newEventSink(exporterConf)
+		if err != nil {
+			return errors.Wrapf(err, "failed to configure security exporter %d", i)
+		}
+		a.securityExporters = append(a.securityExporters, a.newEventExporter(exporterConf, sink))
+		log.Infof("exporting security events to %s sink", exporterConf.Type)
+	}
+	return nil
+}
+
+// clientIP returns the address of the client of a request, from the
+// header configured for lockouts when they are enabled
+func (a *autographer) clientIP(r *http.Request) string {
+	if a.lockout != nil {
+		return a.lockout.clientIP(r)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// securityEvent sends a security event of a request to the security
+// log and to the security exporters, or the event exporters when
+// there are no security exporters
+func (a *autographer) securityEvent(r *http.Request, event formats.ExportedEvent) {
+	event.Type = formats.EventTypeSecurity
+	event.SchemaVersion = formats.SecurityEventSchemaVersion
+	event.Timestamp = time.Now().UTC()
+	event.RequestID = getRequestID(r)
+	event.Endpoint = r.URL.Path
+	event.SourceIP = a.clientIP(r)
+	if a.securityLog != nil {
+		data, err := json.Marshal(event)
+		if err != nil {
+			log.Errorf("failed to marshal security event: %v", err)
+		} else {
+			a.securityLog.write(data)
+		}
+	}
+	if len(a.securityExporters) > 0 {
+		queueEvent(a.securityExporters, event)
+		return
+	}
+	a.exportEvent(event)
+}
+
+// authorizationDenied writes an error to the client and sends a
+// security event when an authenticated user or frontend isn't allowed
+// to use a signer or endpoint
+func (a *autographer) authorizationDenied(w http.ResponseWriter, r *http.Request, status int, code formats.ErrorCode, userid, signerID string, err error) {
+	a.securityEvent(r, formats.ExportedEvent{
+		Action:   formats.SecurityActionAuthorizationDenied,
+		UserID:   userid,
+		SignerID: signerID,
+		Message:  err.Error(),
+	})
+	httpError(w, r, status, code, "%v", err)
+}
+
+// signingRejected sends a security event when a signer refused a
+// signing request because of its policy
+func (a *autographer) signingRejected(r *http.Request, code formats.ErrorCode, userid, signerID string, err error) {
+	if code != formats.ErrorCodeInputDenied && code != formats.ErrorCodeSignerNotPermitted {
+		return
+	}
+	a.securityEvent(r, formats.ExportedEvent{
+		Action:   formats.SecurityActionPolicyRejected,
+		UserID:   userid,
+		SignerID: signerID,
+		Message:  err.Error(),
+	})
+}
+
+// keyRotated sends a security event when an admin adds or retires a
+// key or credential
+func (a *autographer) keyRotated(r *http.Request, userid, signerID, message string) {
+	a.securityEvent(r, formats.ExportedEvent{
+		Action:   formats.SecurityActionKeyRotated,
+		UserID:   userid,
+		SignerID: signerID,
+		Message:  message,
+	})
+}
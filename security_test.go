@@ -0,0 +1,144 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+func TestSecurityLog(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "autograph-security-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpag := newAutographer(100)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err = tmpag.addSigners([]signer.Configuration{conf.Signers[0], conf.Signers[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := authorization{ID: "secureduser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: []string{conf.Signers[0].ID}}
+	admin := authorization{ID: "secureadmin", Key: "a4ex0ztpcu9msw5h5flc7qfhsc7btg2tzb2s3hgf1gtx5vqhnh", Admin: true}
+	err = tmpag.addAuthorizations([]authorization{user, admin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logPath := filepath.Join(dir, "security.log")
+	err = tmpag.enableSecurityLog(securityLogConfig{Output: logPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// security events go to a dedicated sink instead of the event
+	// exporters when one is configured
+	exported := new(memorySink)
+	tmpag.addExporter(exporterConfig{Type: "memory", FlushInterval: 10 * time.Millisecond}, exported)
+	secured := new(memorySink)
+	tmpag.securityExporters = append(tmpag.securityExporters,
+		tmpag.newEventExporter(exporterConfig{Type: "memory", FlushInterval: 10 * time.Millisecond}, secured))
+
+	newRequest := func(method, url string, auth authorization, key string, body []byte) *http.Request {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "192.0.2.10:4321"
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, key, sha256.New, id(), "application/json", body))
+		return req
+	}
+	body, err := json.Marshal([]formats.SignatureRequest{{Input: "Y2FyaWJvdW1hdXJpY2UK", KeyID: conf.Signers[1].ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, testcase := range []struct {
+		req    *http.Request
+		status int
+	}{
+		{newRequest("POST", "http://foo.bar/sign/data", user, "wrongkey", body), http.StatusUnauthorized},
+		{newRequest("POST", "http://foo.bar/sign/data", user, user.Key, body), http.StatusUnauthorized},
+		{newRequest("GET", "http://foo.bar/admin/usage", user, user.Key, nil), http.StatusUnauthorized},
+		{newRequest("GET", "http://foo.bar/admin/usage", admin, admin.Key, nil), http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		if testcase.req.URL.Path == "/admin/usage" {
+			tmpag.handleUsage(w, testcase.req)
+		} else {
+			tmpag.handleSignature(w, testcase.req)
+		}
+		if w.Code != testcase.status {
+			t.Fatalf("testcase %d: expected status %d, got %d: %s", i, testcase.status, w.Code, w.Body.String())
+		}
+	}
+
+	expected := []formats.ExportedEvent{
+		{Action: formats.SecurityActionAuthenticationFailed, UserID: user.ID, Endpoint: "/sign/data"},
+		{Action: formats.SecurityActionAuthorizationDenied, UserID: user.ID, SignerID: conf.Signers[1].ID, Endpoint: "/sign/data"},
+		{Action: formats.SecurityActionAuthorizationDenied, UserID: user.ID, Endpoint: "/admin/usage"},
+		{Action: formats.SecurityActionAdminAction, UserID: admin.ID, Endpoint: "/admin/usage", Message: "GET /admin/usage"},
+	}
+	checkEvents := func(source string, events []formats.ExportedEvent) {
+		if len(events) != len(expected) {
+			t.Fatalf("expected %d security events in %s, got %+v", len(expected), source, events)
+		}
+		for i, event := range events {
+			if event.Type != formats.EventTypeSecurity || event.SchemaVersion != formats.SecurityEventSchemaVersion ||
+				event.Action != expected[i].Action || event.UserID != expected[i].UserID ||
+				event.SignerID != expected[i].SignerID || event.Endpoint != expected[i].Endpoint ||
+				(expected[i].Message != "" && event.Message != expected[i].Message) ||
+				event.SourceIP != "192.0.2.10" || event.Timestamp.IsZero() {
+				t.Fatalf("unexpected security event %d in %s: %+v", i, source, event)
+			}
+		}
+	}
+
+	fd, err := os.Open(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	var logged []formats.ExportedEvent
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		var event formats.ExportedEvent
+		err = json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			t.Fatalf("failed to parse security log line %q: %v", scanner.Text(), err)
+		}
+		logged = append(logged, event)
+	}
+	checkEvents("security log", logged)
+
+	var events []formats.ExportedEvent
+	for i := 0; len(events) < len(expected); i++ {
+		if i > 100 {
+			t.Fatalf("timed out waiting for security events, got %+v", events)
+		}
+		time.Sleep(10 * time.Millisecond)
+		events = secured.received()
+	}
+	checkEvents("security exporter", events)
+	for _, event := range exported.received() {
+		if event.Type == formats.EventTypeSecurity {
+			t.Fatalf("expected security events to only go to the security exporter, got %+v", event)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// http2Config configures HTTP/2 support of the API server
+type http2Config struct {
+	// Enabled turns on HTTP/2. When the server has no TLS
+	// certificate, HTTP/2 is served over cleartext (h2c) to
+	// clients and load balancers with prior knowledge or that
+	// send an h2c upgrade request.
+	Enabled bool
+
+	// MaxConcurrentStreams is the number of concurrent streams
+	// each client can open on a connection. Zero uses the
+	// http2 package default of 250.
+	MaxConcurrentStreams uint32
+
+	// MaxReadFrameSize is the largest frame the server will
+	// read. Zero uses the http2 package default.
+	MaxReadFrameSize uint32
+
+	// IdleTimeout is how long an idle HTTP/2 connection stays
+	// open. Zero uses the server IdleTimeout.
+	IdleTimeout time.Duration
+}
+
+// hasTLS returns true when both a certificate and a key are
+// configured for the API server
+func (c *configuration) hasTLS() bool {
+	return c.Server.TLSCert != "" && c.Server.TLSKey != ""
+}
+
+// newServer returns an http.Server listening on addr and configured
+// with timeouts and HTTP/2 settings from the server configuration
+func newServer(conf configuration, addr string, handler http.Handler) (*http.Server, error) {
+	var h2s *http2.Server
+	if conf.Server.HTTP2.Enabled {
+		h2s = &http2.Server{
+			MaxConcurrentStreams: conf.Server.HTTP2.MaxConcurrentStreams,
+			MaxReadFrameSize:     conf.Server.HTTP2.MaxReadFrameSize,
+			IdleTimeout:          conf.Server.HTTP2.IdleTimeout,
+		}
+		if !conf.hasTLS() {
+			handler = h2c.NewHandler(handler, h2s)
+		}
+	}
+	server := &http.Server{
+		IdleTimeout:       conf.Server.IdleTimeout,
+		ReadTimeout:       conf.Server.ReadTimeout,
+		ReadHeaderTimeout: conf.Server.ReadHeaderTimeout,
+		WriteTimeout:      conf.Server.WriteTimeout,
+		MaxHeaderBytes:    conf.Server.MaxHeaderBytes,
+		Addr:              addr,
+		Handler:           handler,
+	}
+	if h2s != nil && conf.hasTLS() {
+		err := http2.ConfigureServer(server, h2s)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to configure HTTP/2")
+		}
+	} else if !conf.Server.HTTP2.Enabled && conf.hasTLS() {
+		// net/http negotiates HTTP/2 over TLS by default, a
+		// non-nil empty map disables it
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	return server, nil
+}
+
+// listenAndServe starts the server with TLS when a certificate and
+// key are configured and in cleartext otherwise
+func listenAndServe(conf configuration, server *http.Server) error {
+	log.Infof("starting autograph on %s with timeouts: idle %s read %s read header %s write %s, TLS %t, HTTP/2 %t",
+		server.Addr, server.IdleTimeout, server.ReadTimeout, server.ReadHeaderTimeout, server.WriteTimeout,
+		conf.hasTLS(), conf.Server.HTTP2.Enabled)
+	if conf.hasTLS() {
+		return server.ListenAndServeTLS(conf.Server.TLSCert, conf.Server.TLSKey)
+	}
+	return server.ListenAndServe()
+}
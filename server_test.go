@@ -0,0 +1,77 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestNewServerH2C(t *testing.T) {
+	t.Parallel()
+
+	var c configuration
+	c.Server.HTTP2.Enabled = true
+	c.Server.HTTP2.MaxConcurrentStreams = 10
+	c.Server.ReadHeaderTimeout = 5 * time.Second
+	server, err := newServer(c, "localhost:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.ReadHeaderTimeout != 5*time.Second {
+		t.Fatalf("expected read header timeout of 5s, got %s", server.ReadHeaderTimeout)
+	}
+	ts := httptest.NewServer(server.Handler)
+	defer ts.Close()
+
+	// connect with prior knowledge of HTTP/2 over cleartext
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("expected an HTTP/2 response, got %s", resp.Proto)
+	}
+
+	// HTTP/1.1 clients are still served
+	resp1, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp1.Body.Close()
+	if resp1.ProtoMajor != 1 {
+		t.Fatalf("expected an HTTP/1.1 response, got %s", resp1.Proto)
+	}
+}
+
+func TestNewServerHTTP2DisabledWithTLS(t *testing.T) {
+	t.Parallel()
+
+	var c configuration
+	c.Server.TLSCert = "cert.pem"
+	c.Server.TLSKey = "key.pem"
+	server, err := newServer(c, "localhost:0", http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.TLSNextProto == nil || len(server.TLSNextProto) != 0 {
+		t.Fatalf("expected HTTP/2 to be disabled over TLS")
+	}
+}
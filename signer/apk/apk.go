@@ -35,6 +35,7 @@ const (
 // for Android application packages.
 type APKSigner struct {
 	signer.Configuration
+	signer.KeyZeroizer
 	signingKey        crypto.PrivateKey
 	signingCert       *x509.Certificate
 	signatureFileName string
@@ -60,6 +61,7 @@ func New(conf signer.Configuration) (s *APKSigner, err error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "apk: failed to parse private key")
 	}
+	s.ZeroizeAtExit(s.signingKey)
 	block, _ := pem.Decode([]byte(conf.Certificate))
 	if block == nil {
 		return nil, errors.New("apk: failed to parse certificate PEM")
@@ -73,6 +75,7 @@ func New(conf signer.Configuration) (s *APKSigner, err error) {
 	if time.Now().Before(s.signingCert.NotBefore) || time.Now().After(s.signingCert.NotAfter) {
 		return nil, errors.New("apk: signer certificate is not currently valid")
 	}
+	s.Certificate = conf.Certificate
 	// the name of the signature block file inside the META-INF directory
 	// is determined by the private key type
 	switch s.signingKey.(type) {
@@ -119,29 +122,81 @@ func (s *APKSigner) SignFile(input []byte, options interface{}) (signer.SignedFi
 		return nil, errors.Wrap(err, "apk: got invalid ZIP option")
 	}
 
-	var (
-		signedFile []byte
-	)
-	manifest, sigfile, err := makeJARManifests(input)
+	manifest, sigfile, err := PrepareJAR(input)
 	if err != nil {
-		return nil, errors.Wrap(err, "apk: cannot make JAR manifests from APK")
+		return nil, err
 	}
 	p7sig, err := s.signData(sigfile, options)
 	if err != nil {
 		return nil, errors.Wrap(err, "apk: failed to sign APK")
 	}
-	if opt.ZIP == ZIPMethodCompressPassthrough {
-		signedFile, err = appendSignatureFilesToJAR(input, manifest, sigfile, p7sig, s.signatureFileName)
+	return assembleJAR(input, manifest, sigfile, p7sig, opt.ZIP, s.signatureFileName)
+}
+
+// PrepareJAR returns the JAR manifest and signature file of an
+// unsigned APK. Clients that don't want to upload the whole APK send
+// the signature file to SignData and pass the returned detached
+// signature to AssembleJAR.
+func PrepareJAR(input []byte) (manifest, sigfile []byte, err error) {
+	err = signer.ValidateZIP(input)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "apk")
+	}
+	manifest, sigfile, err = makeJARManifests(input)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "apk: cannot make JAR manifests from APK")
+	}
+	return
+}
+
+// AssembleJAR inserts the manifests from PrepareJAR and the detached
+// pkcs7 signature of the signature file in an APK, like SignFile does
+func AssembleJAR(input, manifest, sigfile, p7sig []byte, options interface{}) ([]byte, error) {
+	opt, err := GetOptions(options)
+	if err != nil {
+		return nil, errors.Wrap(err, "apk: cannot get options")
+	}
+	if opt.ZIP == "" {
+		opt.ZIP = ZIPMethodCompressAll
+	}
+	err = validateZIPOption(opt.ZIP)
+	if err != nil {
+		return nil, errors.Wrap(err, "apk: got invalid ZIP option")
+	}
+	p7, err := pkcs7.Parse(p7sig)
+	if err != nil {
+		return nil, errors.Wrap(err, "apk: failed to parse pkcs7 signature")
+	}
+	if len(p7.Certificates) < 1 {
+		return nil, errors.New("apk: pkcs7 signature has no signing certificate")
+	}
+	var signatureFileName string
+	switch p7.Certificates[0].PublicKey.(type) {
+	case *rsa.PublicKey:
+		signatureFileName = "SIGNATURE.RSA"
+	case *dsa.PublicKey:
+		signatureFileName = "SIGNATURE.DSA"
+	case *ecdsa.PublicKey:
+		signatureFileName = "SIGNATURE.EC"
+	default:
+		return nil, errors.Errorf("apk: unsupported signing certificate key type %T", p7.Certificates[0].PublicKey)
+	}
+	return assembleJAR(input, manifest, sigfile, p7sig, opt.ZIP, signatureFileName)
+}
+
+func assembleJAR(input, manifest, sigfile, p7sig []byte, zipMethod, signatureFileName string) ([]byte, error) {
+	if zipMethod == ZIPMethodCompressPassthrough {
+		signedFile, err := appendSignatureFilesToJAR(input, manifest, sigfile, p7sig, signatureFileName)
 		if err != nil {
 			return nil, errors.Wrap(err, "apk: failed to append signatures files to APK")
 		}
-	} else { // opt.ZIP == ZIPMethodCompressAll
-		signedFile, err = repackAndAlignJAR(input, manifest, sigfile, p7sig, s.signatureFileName)
-		if err != nil {
-			return nil, errors.Wrap(err, "apk: failed to repack and align APK")
-		}
+		return signedFile, nil
+	}
+	// zipMethod == ZIPMethodCompressAll
+	signedFile, err := repackAndAlignJAR(input, manifest, sigfile, p7sig, signatureFileName)
+	if err != nil {
+		return nil, errors.Wrap(err, "apk: failed to repack and align APK")
 	}
-
 	return signedFile, nil
 }
 
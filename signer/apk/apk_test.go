@@ -119,6 +119,60 @@ func TestSignFile(t *testing.T) {
 	}
 }
 
+func TestPrepareAndAssembleJAR(t *testing.T) {
+	t.Parallel()
+
+	s, err := New(apksignerconf)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	manifest, sigfile, err := PrepareJAR(testAPK)
+	if err != nil {
+		t.Fatalf("failed to prepare jar: %v", err)
+	}
+	sig, err := s.SignData(sigfile, s.GetDefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to sign signature file: %v", err)
+	}
+	p7sig := sig.(*Signature).Data
+	for _, zipMethod := range []string{ZIPMethodCompressAll, ZIPMethodCompressPassthrough} {
+		signedAPK, err := AssembleJAR(testAPK, manifest, sigfile, p7sig, Options{ZIP: zipMethod})
+		if err != nil {
+			t.Fatalf("failed to assemble %s jar: %v", zipMethod, err)
+		}
+		r, err := zip.NewReader(bytes.NewReader(signedAPK), int64(len(signedAPK)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string][]byte)
+		for _, f := range r.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[f.Name], err = ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(files["META-INF/MANIFEST.MF"], manifest) || !bytes.Equal(files["META-INF/SIGNATURE.SF"], sigfile) {
+			t.Fatalf("%s: expected the prepared manifests in the signed apk", zipMethod)
+		}
+		sig2, err := Unmarshal(base64.StdEncoding.EncodeToString(files["META-INF/SIGNATURE.RSA"]), files["META-INF/SIGNATURE.SF"])
+		if err != nil {
+			t.Fatalf("%s: failed to unmarshal signature: %v", zipMethod, err)
+		}
+		if sig2.Verify() != nil {
+			t.Fatalf("%s: failed to verify apk signature: %v", zipMethod, sig2.Verify())
+		}
+	}
+	_, err = AssembleJAR(testAPK, manifest, sigfile, []byte("not a pkcs7 signature"), nil)
+	if err == nil {
+		t.Fatal("expected an invalid signature to be rejected")
+	}
+}
+
 func TestSignData(t *testing.T) {
 	t.Parallel()
 
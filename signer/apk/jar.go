@@ -14,6 +14,7 @@ import (
 	"unicode/utf8"
 
 	"github.com/pkg/errors"
+	"go.mozilla.org/autograph/signer"
 )
 
 // consts and vars for formatFilename
@@ -79,6 +80,7 @@ func makeJARManifests(input []byte) (manifest, sigfile []byte, err error) {
 	// first generate the manifest file by calculated a sha256 in each zip entry
 	mw := bytes.NewBuffer(manifest)
 
+	var files []*zip.File
 	for _, f := range r.File {
 		if isSignatureFile(f.Name) {
 			// reserved signature files do not get included in the manifest
@@ -88,27 +90,22 @@ func makeJARManifests(input []byte) (manifest, sigfile []byte, err error) {
 			// directories do not get included
 			continue
 		}
-		rc, err := f.Open()
-		if err != nil {
-			return manifest, sigfile, err
-		}
-		data, err := ioutil.ReadAll(rc)
-		if err != nil {
-			return manifest, sigfile, err
-		}
-		h := sha256.New()
-		h.Write(data)
-		h1 := sha1.New()
-		h1.Write(data)
-
+		files = append(files, f)
+	}
+	// hash the files concurrently, APKs can have thousands of them
+	digests, err := signer.DigestZIPFiles(files, 0)
+	if err != nil {
+		return manifest, sigfile, err
+	}
+	for i, f := range files {
 		filename, err := formatFilename([]byte(f.Name))
 		if err != nil {
 			return manifest, sigfile, err
 		}
 		fmt.Fprintf(mw, "Name: %s\nSHA-256-Digest: %s\nSHA1-Digest: %s\n\n",
 			filename,
-			base64.StdEncoding.EncodeToString(h.Sum(nil)),
-			base64.StdEncoding.EncodeToString(h1.Sum(nil)))
+			base64.StdEncoding.EncodeToString(digests[i].SHA256),
+			base64.StdEncoding.EncodeToString(digests[i].SHA1))
 	}
 	manifestBody := mw.Bytes()
 	manifest = []byte(`Manifest-Version: 1.0
@@ -1,14 +1,14 @@
 package apk2
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 
 	"crypto/ecdsa"
 	"crypto/sha256"
 	"crypto/x509"
-	"os"
-	"os/exec"
+	"encoding/pem"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -19,6 +19,15 @@ const (
 	// Type of this signer is "apk2" represents a signer that
 	// shells out to apksigner to sign artifacts
 	Type = "apk2"
+
+	// V4SignatureArtifactName is the name of the APK Signature
+	// Scheme v4 artifact returned when v4 signing is enabled
+	V4SignatureArtifactName = "signed.apk.idsig"
+
+	// tempSpaceOverhead is the temporary storage reserved for the
+	// keys, certificates and v4 signature of a signature on top of
+	// the input and signed APKs
+	tempSpaceOverhead = 64 * 1024
 )
 
 // APK2Signer holds the configuration of the signer
@@ -31,6 +40,13 @@ type APK2Signer struct {
 	minSdkVersion string
 
 	pkcs8Key []byte
+
+	// stampPKCS8Key is the pkcs8 encoded key of the source stamp,
+	// nil when source stamps are disabled
+	stampPKCS8Key []byte
+
+	// sandbox restricts the apksigner processes that sign
+	sandbox *signer.Sandbox
 }
 
 // New initializes an apk signer using a configuration
@@ -74,9 +90,53 @@ func New(conf signer.Configuration) (s *APK2Signer, err error) {
 		return nil, errors.New("apk2: missing public cert in signer configuration")
 	}
 	s.Certificate = conf.Certificate
+	s.V4Signing = conf.V4Signing
+
+	err = s.initStamp(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	s.sandbox, err = signer.NewSandbox(conf.Sandbox)
+	if err != nil {
+		return nil, errors.Wrap(err, "apk2: invalid sandbox in signer configuration")
+	}
+	s.Sandbox = conf.Sandbox
 	return
 }
 
+// initStamp loads the optional source stamp key and certificate
+func (s *APK2Signer) initStamp(conf signer.Configuration) error {
+	if conf.StampPrivateKey == "" && conf.StampCertificate == "" {
+		return nil
+	}
+	if conf.StampPrivateKey == "" || conf.StampCertificate == "" {
+		return errors.New("apk2: source stamps require both a stamp private key and a stamp certificate")
+	}
+	stampConf := conf
+	stampConf.PrivateKey = conf.StampPrivateKey
+	priv, err := stampConf.GetPrivateKey()
+	if err != nil {
+		return errors.Wrap(err, "apk2: failed to get stamp private key from configuration")
+	}
+	s.stampPKCS8Key, err = x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return errors.Wrap(err, "apk2: failed to encode stamp private key to pkcs8")
+	}
+	block, _ := pem.Decode([]byte(conf.StampCertificate))
+	if block == nil {
+		return errors.New("apk2: failed to parse PEM stamp certificate")
+	}
+	if _, err = x509.ParseCertificate(block.Bytes); err != nil {
+		return errors.Wrap(err, "apk2: failed to parse stamp certificate")
+	}
+	s.StampPrivateKey = conf.StampPrivateKey
+	s.StampCertificate = conf.StampCertificate
+	// Play shows this value as the stamp-cert-sha256 of the APK
+	log.Printf("apk2: signer %q embeds source stamps with certificate sha256 %x", s.ID, sha256.Sum256(block.Bytes))
+	return nil
+}
+
 // Config returns the configuration of the current signer
 func (s *APK2Signer) Config() signer.Configuration {
 	return signer.Configuration{
@@ -84,60 +144,121 @@ func (s *APK2Signer) Config() signer.Configuration {
 		Type:        s.Type,
 		PrivateKey:  s.PrivateKey,
 		Certificate: s.Certificate,
+		V4Signing:   s.V4Signing,
+
+		StampPrivateKey:  s.StampPrivateKey,
+		StampCertificate: s.StampCertificate,
 	}
 }
 
 // SignFile takes a whole APK and returns a signed and aligned version
 func (s *APK2Signer) SignFile(file []byte, options interface{}) (signer.SignedFile, error) {
-	keyPath, err := ioutil.TempFile("", fmt.Sprintf("apk2_%s.key", s.ID))
+	return s.SignFileContext(context.Background(), file, options)
+}
+
+// SignFileContext is like SignFile but kills apksigner when ctx is
+// done
+func (s *APK2Signer) SignFileContext(ctx context.Context, file []byte, options interface{}) (signer.SignedFile, error) {
+	signedApk, _, err := s.SignFileArtifacts(ctx, file, options)
+	return signedApk, err
+}
+
+// SignFileArtifacts is like SignFileContext but also returns the APK
+// v4 signature as an .idsig artifact when v4 signing is enabled
+func (s *APK2Signer) SignFileArtifacts(ctx context.Context, file []byte, options interface{}) (signer.SignedFile, []signer.Artifact, error) {
+	err := signer.ValidateZIP(file)
 	if err != nil {
-		return nil, errors.Wrap(err, "apk2: failed to create tempfile with private key")
+		return nil, nil, errors.Wrap(err, "apk2")
 	}
-	defer os.Remove(keyPath.Name())
-	err = ioutil.WriteFile(keyPath.Name(), []byte(s.pkcs8Key), 0400)
+	// apksigner writes the signed copy of the input next to it
+	space, err := signer.NewTempSpace(fmt.Sprintf("apk2_%s_", s.ID), 2*int64(len(file))+tempSpaceOverhead)
 	if err != nil {
-		return nil, errors.Wrap(err, "apk2: failed to write private key to tempfile")
+		return nil, nil, errors.Wrap(err, "apk2: failed to reserve temporary storage")
 	}
+	defer space.Release()
 
-	certPath, err := ioutil.TempFile("", fmt.Sprintf("apk2_%s.cert", s.ID))
-	if err != nil {
-		return nil, errors.Wrap(err, "apk2: failed to create tempfile for input to sign")
-	}
-	defer os.Remove(certPath.Name())
-	err = ioutil.WriteFile(certPath.Name(), []byte(s.Certificate), 0400)
+	keyPath, certPath, err := s.writeKeyPair(space, "", s.pkcs8Key, s.Certificate)
 	if err != nil {
-		return nil, errors.Wrap(err, "apk2: failed to write public cert to tempfile")
+		return nil, nil, err
 	}
 
 	// write the input to a temp file
 	h := sha256.New()
 	h.Write(file)
-	tmpAPKFile, err := ioutil.TempFile("", fmt.Sprintf("apk2_input_%x.apk", h.Sum(nil)))
+	apkPath, err := space.WriteFile(fmt.Sprintf("apk2_input_%x.apk", h.Sum(nil)), file, 0600)
 	if err != nil {
-		return nil, errors.Wrap(err, "apk2: failed to create tempfile for input to sign")
+		return nil, nil, errors.Wrap(err, "apk2: failed to write input to sign to tempfile")
 	}
-	defer os.Remove(tmpAPKFile.Name())
-	ioutil.WriteFile(tmpAPKFile.Name(), file, 0755)
 
-	apkSigCmd := exec.Command("java", "-jar", "/usr/bin/apksigner", "sign",
-		"--key", keyPath.Name(),
-		"--cert", certPath.Name(),
+	args := []string{"-jar", "/usr/bin/apksigner", "sign",
+		"--key", keyPath,
+		"--cert", certPath,
 		"--v1-signing-enabled", "true",
 		"--v2-signing-enabled", "true",
 		"--min-sdk-version", s.minSdkVersion,
-		tmpAPKFile.Name(),
-	)
-	out, err := apkSigCmd.CombinedOutput()
+	}
+	if s.V4Signing {
+		// apksigner writes the v4 signature to <apk>.idsig
+		args = append(args, "--v4-signing-enabled", "true")
+	}
+	if s.stampPKCS8Key != nil {
+		stampKeyPath, stampCertPath, err := s.writeKeyPair(space, "stamp_", s.stampPKCS8Key, s.StampCertificate)
+		if err != nil {
+			return nil, nil, err
+		}
+		// the --key and --cert after --stamp-signer are the ones
+		// of the source stamp
+		args = append(args, "--stamp-signer",
+			"--key", stampKeyPath,
+			"--cert", stampCertPath,
+		)
+	}
+	args = append(args, apkPath)
+	err = s.sandbox.Chown(space)
 	if err != nil {
-		return nil, errors.Wrapf(err, "apk2: failed to sign\n%s", out)
+		return nil, nil, errors.Wrap(err, "apk2: failed to prepare sandbox")
+	}
+	out, err := s.sandbox.CombinedOutput(ctx, nil, "java", args...)
+	if errors.Cause(err) == signer.ErrSandboxTimeout {
+		return nil, nil, errors.Wrap(err, "apk2: signing timed out")
+	}
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "apk2: failed to sign\n%s", out)
 	}
 	log.Debugf("signed as:\n%s\n", string(out))
 
-	signedApk, err := ioutil.ReadFile(tmpAPKFile.Name())
+	signedApk, err := ioutil.ReadFile(apkPath)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "apk2: failed to read signed file")
+	}
+	if !s.V4Signing {
+		return signer.SignedFile(signedApk), nil, nil
+	}
+	idsig, err := ioutil.ReadFile(apkPath + ".idsig")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "apk2: failed to read v4 signature file")
+	}
+	return signer.SignedFile(signedApk), []signer.Artifact{
+		{
+			Name:        V4SignatureArtifactName,
+			ContentType: "application/octet-stream",
+			Data:        idsig,
+		},
+	}, nil
+}
+
+// writeKeyPair writes a pkcs8 key and a PEM certificate to tempfiles
+// of a temporary space for apksigner, and returns their paths
+func (s *APK2Signer) writeKeyPair(space *signer.TempSpace, prefix string, pkcs8Key []byte, cert string) (keyPath, certPath string, err error) {
+	keyPath, err = space.WriteFile(fmt.Sprintf("apk2_%s%s.key", prefix, s.ID), pkcs8Key, 0400)
+	if err != nil {
+		return "", "", errors.Wrap(err, "apk2: failed to write private key to tempfile")
+	}
+	certPath, err = space.WriteFile(fmt.Sprintf("apk2_%s%s.cert", prefix, s.ID), []byte(cert), 0400)
 	if err != nil {
-		return nil, errors.Wrap(err, "apk2: failed to read signed file")
+		return "", "", errors.Wrap(err, "apk2: failed to write public cert to tempfile")
 	}
-	return signer.SignedFile(signedApk), nil
+	return keyPath, certPath, nil
 }
 
 // Options are not implemented for this signer
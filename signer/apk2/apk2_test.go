@@ -1,10 +1,12 @@
 package apk2
 
 import (
+	"context"
 	"go.mozilla.org/autograph/signer"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
 	"testing"
 )
 
@@ -69,6 +71,50 @@ func TestNewSigner(t *testing.T) {
 		invalidConf.Certificate = ""
 		assertNewSignerWithConfErrs(t, invalidConf)
 	})
+
+	t.Run("valid source stamp", func(t *testing.T) {
+		t.Parallel()
+
+		s, err := New(stampSignerConf())
+		if err != nil {
+			t.Fatalf("%s: signer initialization failed with: %v", t.Name(), err)
+		}
+		if s.stampPKCS8Key == nil {
+			t.Fatalf("%s: expected the stamp key to be loaded", t.Name())
+		}
+	})
+
+	t.Run("source stamp without certificate", func(t *testing.T) {
+		t.Parallel()
+
+		invalidConf := stampSignerConf()
+		invalidConf.StampCertificate = ""
+		assertNewSignerWithConfErrs(t, invalidConf)
+	})
+
+	t.Run("source stamp without private key", func(t *testing.T) {
+		t.Parallel()
+
+		invalidConf := stampSignerConf()
+		invalidConf.StampPrivateKey = ""
+		assertNewSignerWithConfErrs(t, invalidConf)
+	})
+
+	t.Run("invalid source stamp certificate", func(t *testing.T) {
+		t.Parallel()
+
+		invalidConf := stampSignerConf()
+		invalidConf.StampCertificate = "not a certificate"
+		assertNewSignerWithConfErrs(t, invalidConf)
+	})
+
+	t.Run("invalid sandbox", func(t *testing.T) {
+		t.Parallel()
+
+		invalidConf := apk2signerconf
+		invalidConf.Sandbox.MaxMemory = -1
+		assertNewSignerWithConfErrs(t, invalidConf)
+	})
 }
 
 func TestConfig(t *testing.T) {
@@ -129,6 +175,72 @@ func TestSignFile(t *testing.T) {
 	})
 }
 
+func TestSignFileArtifactsV4(t *testing.T) {
+	v4conf := apk2signerconf
+	v4conf.V4Signing = true
+	s := assertNewSignerWithConfOK(t, v4conf)
+
+	signedFile, artifacts, err := s.SignFileArtifacts(context.Background(), testAPK, s.GetDefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to sign file: %v", err)
+	}
+	if len(artifacts) != 1 || artifacts[0].Name != V4SignatureArtifactName || len(artifacts[0].Data) == 0 {
+		t.Fatalf("expected a single non-empty %q artifact, got %+v", V4SignatureArtifactName, artifacts)
+	}
+
+	// apksigner looks for the v4 signature next to the APK
+	tmpApk, err := ioutil.TempFile("", "apk2_TestSignFileArtifactsV4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpApk.Name())
+	defer os.Remove(tmpApk.Name() + ".idsig")
+	ioutil.WriteFile(tmpApk.Name(), signedFile, 0755)
+	ioutil.WriteFile(tmpApk.Name()+".idsig", artifacts[0].Data, 0755)
+
+	apkSignerVerifySig := exec.Command("java", "-jar", "/usr/bin/apksigner", "verify", "--verbose", tmpApk.Name())
+	out, err := apkSignerVerifySig.CombinedOutput()
+	if err != nil {
+		t.Fatalf("error verifying apk signature: %s\n%s", err, out)
+	}
+}
+
+func TestSignFileWithSourceStamp(t *testing.T) {
+	s, err := New(stampSignerConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedFile, err := s.SignFile(testAPK, s.GetDefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to sign file: %v", err)
+	}
+
+	tmpApk, err := ioutil.TempFile("", "apk2_TestSignFileWithSourceStamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpApk.Name())
+	ioutil.WriteFile(tmpApk.Name(), signedFile, 0755)
+
+	apkSignerVerifySig := exec.Command("java", "-jar", "/usr/bin/apksigner", "verify", "--verbose", tmpApk.Name())
+	out, err := apkSignerVerifySig.CombinedOutput()
+	if err != nil {
+		t.Fatalf("error verifying apk signature: %s\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "Source Stamp") {
+		t.Fatalf("expected apksigner to find a source stamp, got:\n%s", out)
+	}
+}
+
+// stampSignerConf returns a signer configuration that uses its own
+// key and certificate as source stamp
+func stampSignerConf() signer.Configuration {
+	conf := apk2signerconf
+	conf.StampPrivateKey = apk2signerconf.PrivateKey
+	conf.StampCertificate = apk2signerconf.Certificate
+	return conf
+}
+
 var apk2signerconf = signer.Configuration{
 	ID:   "apk2test",
 	Type: Type,
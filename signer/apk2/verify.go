@@ -0,0 +1,658 @@
+package apk2
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha1" // register the hashes of JAR and content digests
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"math/big"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/pkcs7"
+)
+
+// Names of the signature schemes reported by VerifySignedFile
+const (
+	SchemeV1 = "v1"
+	SchemeV2 = "v2"
+	SchemeV3 = "v3"
+)
+
+const (
+	// apkSigningBlockMagic ends the APK Signing Block that holds
+	// v2 and v3 signatures, right before the central directory
+	apkSigningBlockMagic = "APK Sig Block 42"
+
+	// IDs of the signature schemes in the APK Signing Block
+	v2BlockID = 0x7109871a
+	v3BlockID = 0xf05368c0
+
+	// eocdSignature starts the end of central directory record,
+	// which is 22 bytes long without its comment
+	eocdSignature = 0x06054b50
+	eocdMinSize   = 22
+
+	// contentChunkSize is the size of the chunks of the APK hashed
+	// to compute v2 and v3 content digests
+	contentChunkSize = 1024 * 1024
+)
+
+// signature algorithm IDs of the v2 and v3 schemes. DSA and verity
+// signatures are skipped, apksigner always adds another one.
+const (
+	sigRSAPSSSHA256   = 0x0101
+	sigRSAPSSSHA512   = 0x0102
+	sigRSAPKCS1SHA256 = 0x0103
+	sigRSAPKCS1SHA512 = 0x0104
+	sigECDSASHA256    = 0x0201
+	sigECDSASHA512    = 0x0202
+)
+
+// Verification is the result of the verification of a signed APK or
+// AAB
+type Verification struct {
+	// Schemes are the signature schemes the file is signed with,
+	// like v1 and v2. AABs are only signed with v1.
+	Schemes []string
+
+	// Certificates are the certificates of the signers of the
+	// file, the first one of each scheme, without duplicates
+	Certificates []*x509.Certificate
+}
+
+// VerifySignedFile verifies the v1 JAR signature and the v2 and v3
+// APK Signing Block signatures of an APK or AAB without the Android
+// SDK. It checks the digests of the signed contents, the signatures
+// and that each signature scheme found in the file is valid, but not
+// the certificate chains, which are usually self-signed.
+func VerifySignedFile(signedFile signer.SignedFile) (*Verification, error) {
+	var (
+		v      = new(Verification)
+		v2Cert *x509.Certificate
+	)
+	zipReader, err := zip.NewReader(bytes.NewReader(signedFile), int64(len(signedFile)))
+	if err != nil {
+		return nil, errors.Wrap(err, "apk2: failed to read zip")
+	}
+	blocks, err := readSigningBlock(signedFile)
+	if err != nil {
+		return nil, err
+	}
+
+	v1Cert, v1StrippedSchemes, err := verifyV1(zipReader)
+	if err != nil {
+		return nil, errors.Wrap(err, "apk2: v1 signature verification failed")
+	}
+	if v1Cert != nil {
+		v.Schemes = append(v.Schemes, SchemeV1)
+		v.addCertificate(v1Cert)
+	}
+	for _, scheme := range []struct {
+		name string
+		id   uint32
+	}{
+		{SchemeV2, v2BlockID},
+		{SchemeV3, v3BlockID},
+	} {
+		block, ok := blocks.schemes[scheme.id]
+		if !ok {
+			continue
+		}
+		cert, err := verifySchemeBlock(signedFile, blocks, block, scheme.id == v3BlockID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "apk2: %s signature verification failed", scheme.name)
+		}
+		if scheme.id == v2BlockID {
+			v2Cert = cert
+		}
+		v.Schemes = append(v.Schemes, scheme.name)
+		v.addCertificate(cert)
+	}
+	if len(v.Schemes) == 0 {
+		return nil, errors.New("apk2: file is not signed")
+	}
+	// a v1 signature made alongside newer schemes lists them to
+	// detect their removal
+	for _, stripped := range v1StrippedSchemes {
+		if _, ok := blocks.schemes[stripped]; !ok {
+			return nil, errors.Errorf("apk2: v1 signature expects a scheme block 0x%x that was removed", stripped)
+		}
+	}
+	// v3 signatures can be made by a rotated key, but v1 and v2
+	// signers must be the same
+	if v1Cert != nil && v2Cert != nil && !bytes.Equal(v1Cert.Raw, v2Cert.Raw) {
+		return nil, errors.New("apk2: v1 and v2 signatures are made by different certificates")
+	}
+	return v, nil
+}
+
+// addCertificate adds a signer certificate to the result unless
+// another scheme already has it
+func (v *Verification) addCertificate(cert *x509.Certificate) {
+	for _, c := range v.Certificates {
+		if bytes.Equal(c.Raw, cert.Raw) {
+			return
+		}
+	}
+	v.Certificates = append(v.Certificates, cert)
+}
+
+// isV1SignatureFile returns whether a file in META-INF is part of a
+// v1 signature, and not a signed file
+func isV1SignatureFile(name string) bool {
+	if !strings.HasPrefix(name, "META-INF/") || strings.Count(name, "/") != 1 {
+		return false
+	}
+	if name == "META-INF/MANIFEST.MF" {
+		return true
+	}
+	switch strings.ToUpper(path.Ext(name)) {
+	case ".SF", ".RSA", ".DSA", ".EC":
+		return true
+	}
+	return false
+}
+
+// jarSection is a section of a JAR manifest or signature file
+type jarSection map[string]string
+
+// parseJARSections parses a JAR manifest or signature file into its
+// main section and its named sections
+func parseJARSections(data []byte) (main jarSection, named map[string]jarSection, err error) {
+	text := strings.Replace(string(data), "\r\n", "\n", -1)
+	// unwrap the continuation lines of long values
+	text = strings.Replace(text, "\n ", "", -1)
+	named = make(map[string]jarSection)
+	for i, rawSection := range strings.Split(text, "\n\n") {
+		if strings.TrimSpace(rawSection) == "" {
+			continue
+		}
+		section := make(jarSection)
+		for _, line := range strings.Split(strings.Trim(rawSection, "\n"), "\n") {
+			kv := strings.SplitN(line, ": ", 2)
+			if len(kv) != 2 {
+				return nil, nil, errors.Errorf("invalid line %q", line)
+			}
+			section[kv[0]] = kv[1]
+		}
+		if i == 0 {
+			main = section
+			continue
+		}
+		name, ok := section["Name"]
+		if !ok {
+			return nil, nil, errors.Errorf("section %d has no name", i)
+		}
+		if _, ok := named[name]; ok {
+			return nil, nil, errors.Errorf("duplicate section for %q", name)
+		}
+		named[name] = section
+	}
+	if main == nil {
+		return nil, nil, errors.New("missing main section")
+	}
+	return main, named, nil
+}
+
+// jarDigests maps the digest attribute prefixes of JAR files to
+// their hash
+var jarDigests = []struct {
+	prefix string
+	hash   crypto.Hash
+}{
+	{"SHA1", crypto.SHA1},
+	{"SHA-1", crypto.SHA1},
+	{"SHA-256", crypto.SHA256},
+	{"SHA-384", crypto.SHA384},
+	{"SHA-512", crypto.SHA512},
+}
+
+// checkJARDigests verifies the digests of data in a JAR section with
+// attributes named prefix + suffix, like SHA-256-Digest-Manifest, and
+// returns an error when the section has none
+func checkJARDigests(section jarSection, suffix string, data []byte) error {
+	found := false
+	for _, d := range jarDigests {
+		value, ok := section[d.prefix+suffix]
+		if !ok {
+			continue
+		}
+		found = true
+		expected, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s%s", d.prefix, suffix)
+		}
+		h := d.hash.New()
+		h.Write(data)
+		if !bytes.Equal(h.Sum(nil), expected) {
+			return errors.Errorf("%s%s does not match", d.prefix, suffix)
+		}
+	}
+	if !found {
+		return errors.Errorf("no supported digest%s", suffix)
+	}
+	return nil
+}
+
+// verifyV1 verifies the v1 JAR signatures of a zip and returns the
+// certificate of the signer, nil when the zip has no v1 signature,
+// and the IDs of the newer schemes the signer declared
+func verifyV1(zipReader *zip.Reader) (cert *x509.Certificate, schemes []uint32, err error) {
+	files := make(map[string]*zip.File)
+	for _, f := range zipReader.File {
+		if _, ok := files[f.Name]; ok {
+			return nil, nil, errors.Errorf("%q occurs twice in zip", f.Name)
+		}
+		files[f.Name] = f
+	}
+	readFile := func(f *zip.File) ([]byte, error) {
+		rc, err := f.Open()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open %q", f.Name)
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+
+	var sigFiles []string
+	for name := range files {
+		if isV1SignatureFile(name) && strings.ToUpper(path.Ext(name)) == ".SF" {
+			sigFiles = append(sigFiles, name)
+		}
+	}
+	manifestFile, ok := files["META-INF/MANIFEST.MF"]
+	if !ok || len(sigFiles) == 0 {
+		return nil, nil, nil
+	}
+	if len(sigFiles) > 1 {
+		return nil, nil, errors.Errorf("found %d signature files, only one signer is supported", len(sigFiles))
+	}
+	manifest, err := readFile(manifestFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, entries, err := parseJARSections(manifest)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse manifest")
+	}
+
+	sigFileName := sigFiles[0]
+	sigFile, err := readFile(files[sigFileName])
+	if err != nil {
+		return nil, nil, err
+	}
+	var block []byte
+	base := strings.TrimSuffix(sigFileName, path.Ext(sigFileName))
+	for _, ext := range []string{".RSA", ".EC", ".DSA"} {
+		if f, ok := files[base+ext]; ok {
+			block, err = readFile(f)
+			if err != nil {
+				return nil, nil, err
+			}
+			break
+		}
+	}
+	if block == nil {
+		return nil, nil, errors.Errorf("no signature block for %q", sigFileName)
+	}
+	p7, err := pkcs7.Parse(block)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse PKCS7 signature block")
+	}
+	p7.Content = sigFile
+	err = p7.Verify()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "invalid PKCS7 signature of signature file")
+	}
+	cert = p7.GetOnlySigner()
+	if cert == nil {
+		return nil, nil, errors.New("PKCS7 signature must have exactly one signer")
+	}
+
+	sigMain, _, err := parseJARSections(sigFile)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse signature file")
+	}
+	err = checkJARDigests(sigMain, "-Digest-Manifest", manifest)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "signature file does not match the manifest")
+	}
+	if apkSigned, ok := sigMain["X-Android-APK-Signed"]; ok {
+		for _, id := range strings.Split(apkSigned, ",") {
+			switch strings.TrimSpace(id) {
+			case "2":
+				schemes = append(schemes, v2BlockID)
+			case "3":
+				schemes = append(schemes, v3BlockID)
+			}
+		}
+	}
+
+	for name, f := range files {
+		if strings.HasSuffix(name, "/") || isV1SignatureFile(name) {
+			continue
+		}
+		entry, ok := entries[name]
+		if !ok {
+			return nil, nil, errors.Errorf("%q is not in the manifest", name)
+		}
+		data, err := readFile(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = checkJARDigests(entry, "-Digest", data)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "invalid manifest entry for %q", name)
+		}
+	}
+	for name := range entries {
+		if _, ok := files[name]; !ok {
+			return nil, nil, errors.Errorf("%q is in the manifest but not in the zip", name)
+		}
+	}
+	return cert, schemes, nil
+}
+
+// signingBlock is the location of the APK Signing Block and the
+// values of the scheme blocks it holds
+type signingBlock struct {
+	start, cdStart, eocdStart int
+	schemes                   map[uint32][]byte
+}
+
+// readSigningBlock finds the APK Signing Block of a zip, which is
+// empty when the zip has none
+func readSigningBlock(file []byte) (b signingBlock, err error) {
+	b.schemes = make(map[uint32][]byte)
+	b.eocdStart = -1
+	for i := len(file) - eocdMinSize; i >= 0 && i >= len(file)-eocdMinSize-0xffff; i-- {
+		if binary.LittleEndian.Uint32(file[i:]) == eocdSignature &&
+			int(binary.LittleEndian.Uint16(file[i+20:]))+i+eocdMinSize == len(file) {
+			b.eocdStart = i
+			break
+		}
+	}
+	if b.eocdStart < 0 {
+		return b, errors.New("apk2: end of central directory not found")
+	}
+	b.cdStart = int(binary.LittleEndian.Uint32(file[b.eocdStart+16:]))
+	cdSize := int(binary.LittleEndian.Uint32(file[b.eocdStart+12:]))
+	if b.cdStart+cdSize != b.eocdStart {
+		return b, errors.New("apk2: central directory is not right before its end record")
+	}
+	b.start = b.cdStart
+	if b.cdStart < 32 || string(file[b.cdStart-16:b.cdStart]) != apkSigningBlockMagic {
+		return b, nil
+	}
+	blockSize := binary.LittleEndian.Uint64(file[b.cdStart-24:])
+	if blockSize < 24 || blockSize > uint64(b.cdStart-8) {
+		return b, errors.Errorf("apk2: invalid APK Signing Block size %d", blockSize)
+	}
+	b.start = b.cdStart - int(blockSize) - 8
+	if binary.LittleEndian.Uint64(file[b.start:]) != blockSize {
+		return b, errors.New("apk2: APK Signing Block sizes do not match")
+	}
+	pairs := file[b.start+8 : b.cdStart-24]
+	for len(pairs) > 0 {
+		if len(pairs) < 12 {
+			return b, errors.New("apk2: truncated APK Signing Block pair")
+		}
+		pairLen := binary.LittleEndian.Uint64(pairs)
+		if pairLen < 4 || pairLen > uint64(len(pairs)-8) {
+			return b, errors.Errorf("apk2: invalid APK Signing Block pair length %d", pairLen)
+		}
+		id := binary.LittleEndian.Uint32(pairs[8:])
+		b.schemes[id] = pairs[12 : 8+pairLen]
+		pairs = pairs[8+pairLen:]
+	}
+	return b, nil
+}
+
+// readLengthPrefixed reads a value prefixed by its uint32 length and
+// returns it and the remaining data
+func readLengthPrefixed(data []byte) (value, rest []byte, err error) {
+	if len(data) < 4 {
+		return nil, nil, errors.New("truncated length prefix")
+	}
+	size := binary.LittleEndian.Uint32(data)
+	if uint64(size) > uint64(len(data)-4) {
+		return nil, nil, errors.Errorf("length %d exceeds the remaining %d bytes", size, len(data)-4)
+	}
+	return data[4 : 4+size], data[4+size:], nil
+}
+
+// readUint32 reads a uint32 and returns it and the remaining data
+func readUint32(data []byte) (uint32, []byte, error) {
+	if len(data) < 4 {
+		return 0, nil, errors.New("truncated uint32")
+	}
+	return binary.LittleEndian.Uint32(data), data[4:], nil
+}
+
+// algorithmPair is a signature or digest algorithm ID and its value
+type algorithmPair struct {
+	id    uint32
+	value []byte
+}
+
+// readAlgorithmPairs reads a length prefixed sequence of length
+// prefixed algorithm IDs and values
+func readAlgorithmPairs(data []byte) (pairs []algorithmPair, err error) {
+	for len(data) > 0 {
+		var pair, value []byte
+		pair, data, err = readLengthPrefixed(data)
+		if err != nil {
+			return nil, err
+		}
+		var id uint32
+		id, pair, err = readUint32(pair)
+		if err != nil {
+			return nil, err
+		}
+		value, _, err = readLengthPrefixed(pair)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, algorithmPair{id: id, value: value})
+	}
+	return pairs, nil
+}
+
+// contentDigestHash returns the hash of the content digest of a
+// signature algorithm, or 0 for skipped and unknown algorithms
+func contentDigestHash(alg uint32) crypto.Hash {
+	switch alg {
+	case sigRSAPSSSHA256, sigRSAPKCS1SHA256, sigECDSASHA256:
+		return crypto.SHA256
+	case sigRSAPSSSHA512, sigRSAPKCS1SHA512, sigECDSASHA512:
+		return crypto.SHA512
+	}
+	return 0
+}
+
+// verifySchemeBlock verifies a v2 or v3 scheme block and returns the
+// certificate of its signer
+func verifySchemeBlock(file []byte, b signingBlock, block []byte, isV3 bool) (cert *x509.Certificate, err error) {
+	signers, _, err := readLengthPrefixed(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read signers")
+	}
+	var signerData []byte
+	signerData, signers, err = readLengthPrefixed(signers)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read signer")
+	}
+	if len(signers) != 0 && !isV3 {
+		return nil, errors.New("only one signer is supported")
+	}
+	// v3 blocks can have one signer per range of SDK versions, with
+	// the same rules, so the first one is verified
+	signedData, rest, err := readLengthPrefixed(signerData)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read signed data")
+	}
+	if isV3 {
+		if len(rest) < 8 {
+			return nil, errors.New("truncated sdk versions")
+		}
+		rest = rest[8:]
+	}
+	rawSignatures, rest, err := readLengthPrefixed(rest)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read signatures")
+	}
+	rawPublicKey, _, err := readLengthPrefixed(rest)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read public key")
+	}
+	signatures, err := readAlgorithmPairs(rawSignatures)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read signatures")
+	}
+	pubKey, err := x509.ParsePKIXPublicKey(rawPublicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse public key")
+	}
+
+	// verify the signatures of the signed data before reading it
+	verified := 0
+	for _, sig := range signatures {
+		if contentDigestHash(sig.id) == 0 {
+			continue
+		}
+		err = verifySchemeSignature(pubKey, sig.id, signedData, sig.value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid signature 0x%04x", sig.id)
+		}
+		verified++
+	}
+	if verified == 0 {
+		return nil, errors.New("no signature with a supported algorithm")
+	}
+
+	rawDigests, rest, err := readLengthPrefixed(signedData)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read digests")
+	}
+	rawCerts, _, err := readLengthPrefixed(rest)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read certificates")
+	}
+	digests, err := readAlgorithmPairs(rawDigests)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read digests")
+	}
+	rawCert, _, err := readLengthPrefixed(rawCerts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read first certificate")
+	}
+	cert, err = x509.ParseCertificate(rawCert)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse certificate")
+	}
+	certKey, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil || !bytes.Equal(certKey, rawPublicKey) {
+		return nil, errors.New("public key does not match the signer certificate")
+	}
+	if len(digests) != len(signatures) {
+		return nil, errors.New("signatures and digests have different algorithms")
+	}
+	for i, digest := range digests {
+		if digest.id != signatures[i].id {
+			return nil, errors.New("signatures and digests have different algorithms")
+		}
+		hash := contentDigestHash(digest.id)
+		if hash == 0 {
+			continue
+		}
+		if !bytes.Equal(contentDigest(file, b, hash), digest.value) {
+			return nil, errors.Errorf("content digest 0x%04x does not match the file", digest.id)
+		}
+	}
+	return cert, nil
+}
+
+// verifySchemeSignature verifies the signature of the signed data of
+// a v2 or v3 signer
+func verifySchemeSignature(pubKey interface{}, alg uint32, data, sig []byte) error {
+	hash := contentDigestHash(alg)
+	h := hash.New()
+	h.Write(data)
+	digest := h.Sum(nil)
+	switch alg {
+	case sigRSAPSSSHA256, sigRSAPSSSHA512, sigRSAPKCS1SHA256, sigRSAPKCS1SHA512:
+		rsaKey, ok := pubKey.(*rsa.PublicKey)
+		if !ok {
+			return errors.Errorf("algorithm requires an rsa key, got %T", pubKey)
+		}
+		if alg == sigRSAPSSSHA256 || alg == sigRSAPSSSHA512 {
+			return rsa.VerifyPSS(rsaKey, hash, digest, sig, &rsa.PSSOptions{SaltLength: hash.Size()})
+		}
+		return rsa.VerifyPKCS1v15(rsaKey, hash, digest, sig)
+	case sigECDSASHA256, sigECDSASHA512:
+		ecKey, ok := pubKey.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.Errorf("algorithm requires an ecdsa key, got %T", pubKey)
+		}
+		var ecdsaSig struct {
+			R, S *big.Int
+		}
+		rest, err := asn1.Unmarshal(sig, &ecdsaSig)
+		if err != nil || len(rest) != 0 || ecdsaSig.R == nil || ecdsaSig.S == nil {
+			return errors.New("invalid ecdsa signature encoding")
+		}
+		if !ecdsa.Verify(ecKey, digest, ecdsaSig.R, ecdsaSig.S) {
+			return errors.New("ecdsa signature verification failed")
+		}
+		return nil
+	}
+	return errors.Errorf("unsupported signature algorithm 0x%04x", alg)
+}
+
+// contentDigest returns the v2 and v3 digest of the zip entries, the
+// central directory and its end record, which points to the start of
+// the APK Signing Block for the signatures to cover their removal
+func contentDigest(file []byte, b signingBlock, hash crypto.Hash) []byte {
+	eocd := make([]byte, len(file)-b.eocdStart)
+	copy(eocd, file[b.eocdStart:])
+	binary.LittleEndian.PutUint32(eocd[16:], uint32(b.start))
+	sections := [][]byte{file[:b.start], file[b.cdStart:b.eocdStart], eocd}
+
+	var chunkDigests []byte
+	chunks := 0
+	prefix := make([]byte, 5)
+	for _, section := range sections {
+		for len(section) > 0 {
+			chunk := section
+			if len(chunk) > contentChunkSize {
+				chunk = chunk[:contentChunkSize]
+			}
+			section = section[len(chunk):]
+			prefix[0] = 0xa5
+			binary.LittleEndian.PutUint32(prefix[1:], uint32(len(chunk)))
+			h := hash.New()
+			h.Write(prefix)
+			h.Write(chunk)
+			chunkDigests = h.Sum(chunkDigests)
+			chunks++
+		}
+	}
+	prefix[0] = 0x5a
+	binary.LittleEndian.PutUint32(prefix[1:], uint32(chunks))
+	h := hash.New()
+	h.Write(prefix)
+	h.Write(chunkDigests)
+	return h.Sum(nil)
+}
@@ -0,0 +1,210 @@
+package apk2
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"go.mozilla.org/autograph/signer/apk"
+	"go.mozilla.org/pkcs7"
+)
+
+// testSigningKey returns the key and certificate of the test signer
+func testSigningKey(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	priv, err := apk2signerconf.GetPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode([]byte(apk2signerconf.Certificate))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv.(*rsa.PrivateKey), cert
+}
+
+// signV1 returns a copy of the test APK with a v1 signature made with
+// the Go JAR signer of the apk package. extraHeader is added to the
+// main section of the signature file.
+func signV1(t *testing.T, extraHeader string) []byte {
+	key, cert := testSigningKey(t)
+	manifest, sigfile, err := apk.PrepareJAR(testAPK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extraHeader != "" {
+		sigfile = bytes.Replace(sigfile, []byte("\n"), []byte("\n"+extraHeader+"\n"), 1)
+	}
+	toBeSigned, err := pkcs7.NewSignedData(sigfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = toBeSigned.AddSigner(cert, key, pkcs7.SignerInfoConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	toBeSigned.Detach()
+	p7sig, err := toBeSigned.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := apk.AssembleJAR(testAPK, manifest, sigfile, p7sig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// lengthPrefixed concatenates values and prefixes them with their
+// uint32 length
+func lengthPrefixed(values ...[]byte) []byte {
+	joined := bytes.Join(values, nil)
+	out := make([]byte, 4, 4+len(joined))
+	binary.LittleEndian.PutUint32(out, uint32(len(joined)))
+	return append(out, joined...)
+}
+
+func uint32Bytes(v uint32) []byte {
+	out := make([]byte, 4)
+	binary.LittleEndian.PutUint32(out, v)
+	return out
+}
+
+// addSchemeBlocks inserts an APK Signing Block with v2 or v3 scheme
+// blocks signed with RSA PKCS#1 v1.5 and SHA256 before the central
+// directory of a zip, like apksigner does
+func addSchemeBlocks(t *testing.T, file []byte, ids ...uint32) []byte {
+	key, cert := testSigningKey(t)
+	b, err := readSigningBlock(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.schemes) != 0 {
+		t.Fatal("file already has an APK Signing Block")
+	}
+	digest := contentDigest(file, b, crypto.SHA256)
+	pubKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pairs []byte
+	for _, id := range ids {
+		sdkVersions := []byte{}
+		if id == v3BlockID {
+			sdkVersions = append(uint32Bytes(24), uint32Bytes(0x7fffffff)...)
+		}
+		signedData := bytes.Join([][]byte{
+			lengthPrefixed(lengthPrefixed(uint32Bytes(sigRSAPKCS1SHA256), lengthPrefixed(digest))),
+			lengthPrefixed(lengthPrefixed(cert.Raw)),
+			sdkVersions,
+			lengthPrefixed(),
+		}, nil)
+		hashed := sha256.Sum256(signedData)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signerBlock := lengthPrefixed(
+			lengthPrefixed(signedData),
+			sdkVersions,
+			lengthPrefixed(lengthPrefixed(uint32Bytes(sigRSAPKCS1SHA256), lengthPrefixed(sig))),
+			lengthPrefixed(pubKey),
+		)
+		value := lengthPrefixed(signerBlock)
+		pair := make([]byte, 12)
+		binary.LittleEndian.PutUint64(pair, uint64(4+len(value)))
+		binary.LittleEndian.PutUint32(pair[8:], id)
+		pairs = append(pairs, append(pair, value...)...)
+	}
+	size := make([]byte, 8)
+	binary.LittleEndian.PutUint64(size, uint64(len(pairs)+8+len(apkSigningBlockMagic)))
+	block := bytes.Join([][]byte{size, pairs, size, []byte(apkSigningBlockMagic)}, nil)
+
+	out := bytes.Join([][]byte{file[:b.cdStart], block, file[b.cdStart:]}, nil)
+	binary.LittleEndian.PutUint32(out[b.eocdStart+len(block)+16:], uint32(b.cdStart+len(block)))
+	return out
+}
+
+func TestVerifySignedFile(t *testing.T) {
+	t.Parallel()
+
+	_, cert := testSigningKey(t)
+	v1Signed := signV1(t, "")
+	for _, testcase := range []struct {
+		name    string
+		file    []byte
+		schemes []string
+	}{
+		{"v1", v1Signed, []string{SchemeV1}},
+		{"v1 v2", addSchemeBlocks(t, signV1(t, "X-Android-APK-Signed: 2"), v2BlockID), []string{SchemeV1, SchemeV2}},
+		{"v1 v2 v3", addSchemeBlocks(t, v1Signed, v2BlockID, v3BlockID), []string{SchemeV1, SchemeV2, SchemeV3}},
+	} {
+		v, err := VerifySignedFile(testcase.file)
+		if err != nil {
+			t.Fatalf("%s: verification failed: %v", testcase.name, err)
+		}
+		if strings.Join(v.Schemes, " ") != strings.Join(testcase.schemes, " ") {
+			t.Fatalf("%s: expected schemes %q, got %q", testcase.name, testcase.schemes, v.Schemes)
+		}
+		if len(v.Certificates) != 1 || !bytes.Equal(v.Certificates[0].Raw, cert.Raw) {
+			t.Fatalf("%s: expected the test certificate, got %d certificates", testcase.name, len(v.Certificates))
+		}
+	}
+}
+
+func TestVerifySignedFileFailures(t *testing.T) {
+	t.Parallel()
+
+	var unsigned bytes.Buffer
+	w := zip.NewWriter(&unsigned)
+	f, err := w.Create("AndroidManifest.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("manifest"))
+	w.Close()
+
+	key, _ := testSigningKey(t)
+	pubKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2Signed := addSchemeBlocks(t, signV1(t, ""), v2BlockID)
+	// without v1 signature, only the v2 content digest covers the
+	// zip entries
+	tamperedContent := addSchemeBlocks(t, unsigned.Bytes(), v2BlockID)
+	tamperedContent[40] ^= 0xff
+	// change a byte of the v2 signature, which is right before the
+	// public key at the end of the block
+	tamperedSig := append([]byte{}, v2Signed...)
+	b, err := readSigningBlock(tamperedSig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamperedSig[b.cdStart-24-4-len(pubKey)-10] ^= 0xff
+
+	for _, testcase := range []struct {
+		name string
+		file []byte
+	}{
+		{"not a zip", []byte("not a zip")},
+		{"unsigned", unsigned.Bytes()},
+		{"stripped v2 scheme", signV1(t, "X-Android-APK-Signed: 2")},
+		{"tampered content", tamperedContent},
+		{"tampered signature", tamperedSig},
+	} {
+		_, err := VerifySignedFile(testcase.file)
+		if err == nil {
+			t.Fatalf("%s: expected verification to fail", testcase.name)
+		}
+	}
+}
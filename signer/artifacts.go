@@ -0,0 +1,29 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"context"
+)
+
+// Artifact is a named output returned alongside a signed file, such
+// as a detached signature, an updated manifest or an APK v4 .idsig
+type Artifact struct {
+	// Name is the file name of the artifact, e.g. "app.apk.idsig"
+	Name string
+
+	// ContentType is the media type of the artifact data
+	ContentType string
+
+	// Data is the content of the artifact
+	Data []byte
+}
+
+// ArtifactsFileSigner is an interface to a file signer that returns
+// sidecar artifacts alongside the signed file. It aborts signing
+// when its context is done.
+type ArtifactsFileSigner interface {
+	SignFileArtifacts(ctx context.Context, file []byte, options interface{}) (SignedFile, []Artifact, error)
+}
@@ -3,10 +3,10 @@ package contentsignature // import "go.mozilla.org/autograph/signer/contentsigna
 import (
 	"crypto"
 	"crypto/ecdsa"
-	"crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/asn1"
+	"encoding/json"
 	"hash"
 	"io"
 
@@ -44,6 +44,7 @@ const (
 // ContentSigner implements an issuer of content signatures
 type ContentSigner struct {
 	signer.Configuration
+	signer.KeyZeroizer
 	priv crypto.PrivateKey
 	pub  crypto.PublicKey
 	rand io.Reader
@@ -56,6 +57,9 @@ func New(conf signer.Configuration) (s *ContentSigner, err error) {
 	s.Type = conf.Type
 	s.PrivateKey = conf.PrivateKey
 	s.X5U = conf.X5U
+	s.Decompress = conf.Decompress
+	s.MaxDecompressedSize = conf.MaxDecompressedSize
+	s.DeterministicECDSA = conf.DeterministicECDSA
 	if conf.Type != Type {
 		return nil, errors.Errorf("contentsignature: invalid type %q, must be %q", conf.Type, Type)
 	}
@@ -65,16 +69,21 @@ func New(conf signer.Configuration) (s *ContentSigner, err error) {
 	if conf.PrivateKey == "" {
 		return nil, errors.New("contentsignature: missing private key in signer configuration")
 	}
-	s.rand = conf.GetRand()
 	s.priv, s.pub, s.PublicKey, err = conf.GetKeys()
 	if err != nil {
 		return nil, errors.Wrap(err, "contentsignature: failed to retrieve signer")
 	}
+	s.ZeroizeAtExit(s.priv)
+	s.rand = conf.GetRandForKey(s.priv)
 	switch s.pub.(type) {
 	case *ecdsa.PublicKey:
 	default:
 		return nil, errors.New("contentsignature: invalid private key algorithm, must be ecdsa")
 	}
+	err = conf.CheckDeterministicECDSA(s.priv)
+	if err != nil {
+		return nil, errors.Wrap(err, "contentsignature")
+	}
 	s.Mode = s.getModeFromCurve()
 	return
 }
@@ -82,20 +91,34 @@ func New(conf signer.Configuration) (s *ContentSigner, err error) {
 // Config returns the configuration of the current signer
 func (s *ContentSigner) Config() signer.Configuration {
 	return signer.Configuration{
-		ID:         s.ID,
-		Type:       s.Type,
-		Mode:       s.Mode,
-		PrivateKey: s.PrivateKey,
-		PublicKey:  s.PublicKey,
-		X5U:        s.X5U,
+		ID:                  s.ID,
+		Type:                s.Type,
+		Mode:                s.Mode,
+		PrivateKey:          s.PrivateKey,
+		PublicKey:           s.PublicKey,
+		X5U:                 s.X5U,
+		Decompress:          s.Decompress,
+		MaxDecompressedSize: s.MaxDecompressedSize,
+		DeterministicECDSA:  s.DeterministicECDSA,
 	}
 }
 
 // SignData takes input data, templates it, hashes it and signs it.
 // The returned signature is of type ContentSignature and ready to be Marshalled.
+//
+// When the signer allows decompression and the content_encoding option
+// is set, the input is decompressed before it is templated and hashed.
 func (s *ContentSigner) SignData(input []byte, options interface{}) (signer.Signature, error) {
+	opt, err := GetOptions(options)
+	if err != nil {
+		return nil, errors.Wrap(err, "contentsignature: failed to parse options")
+	}
+	input, err = s.decompress(input, opt.ContentEncoding)
+	if err != nil {
+		return nil, err
+	}
 	if len(input) < 10 {
-		return nil, errors.Errorf("contentsignature: refusing to sign input data shorter than 10 bytes")
+		return nil, errors.Wrap(signer.ErrInputTooShort, "contentsignature: refusing to sign input data shorter than 10 bytes")
 	}
 	alg, hash := makeTemplatedHash(input, s.Mode)
 	sig, err := s.SignHash(hash, options)
@@ -109,9 +132,6 @@ func (s *ContentSigner) SignData(input []byte, options interface{}) (signer.Sign
 //
 // The name of the hash function is returned, followed by the hash bytes
 func makeTemplatedHash(data []byte, curvename string) (alg string, out []byte) {
-	templated := make([]byte, len(SignaturePrefix)+len(data))
-	copy(templated[:len(SignaturePrefix)], []byte(SignaturePrefix))
-	copy(templated[len(SignaturePrefix):], data)
 	var md hash.Hash
 	switch curvename {
 	case P384ECDSA:
@@ -124,7 +144,10 @@ func makeTemplatedHash(data []byte, curvename string) (alg string, out []byte) {
 		md = sha256.New()
 		alg = "sha256"
 	}
-	md.Write(templated)
+	// hash the prefix and data in turn rather than copying large
+	// inputs to template them
+	io.WriteString(md, SignaturePrefix)
+	md.Write(data)
 	return alg, md.Sum(nil)
 }
 
@@ -132,18 +155,15 @@ func makeTemplatedHash(data []byte, curvename string) (alg string, out []byte) {
 // has already been hashed with something like sha384
 func (s *ContentSigner) SignHash(input []byte, options interface{}) (signer.Signature, error) {
 	if len(input) != 32 && len(input) != 48 && len(input) != 64 {
-		return nil, errors.Errorf("contentsignature: refusing to sign input hash. length %d, expected 32, 48 or 64", len(input))
+		return nil, errors.Wrapf(signer.ErrInvalidHashLength, "contentsignature: refusing to sign input hash. length %d, expected 32, 48 or 64", len(input))
 	}
-	var err error
-	csig := new(ContentSignature)
-	csig = &ContentSignature{
+	csig := &ContentSignature{
 		Len:  getSignatureLen(s.Mode),
 		Mode: s.Mode,
 		X5U:  s.X5U,
 		ID:   s.ID,
 	}
-
-	asn1Sig, err := s.priv.(crypto.Signer).Sign(rand.Reader, input, nil)
+	asn1Sig, err := signer.SignECDSADigest(s.priv, s.rand, input, s.DeterministicECDSA)
 	if err != nil {
 		return nil, errors.Wrap(err, "contentsignature: failed to sign hash")
 	}
@@ -204,7 +224,40 @@ func (s *ContentSigner) getModeFromCurve() string {
 	}
 }
 
-// GetDefaultOptions returns nil because this signer has no option
+// decompress returns the input decoded from its content encoding,
+// or an error if the signer does not allow decompression
+func (s *ContentSigner) decompress(input []byte, encoding string) ([]byte, error) {
+	if encoding == "" || encoding == signer.EncodingIdentity {
+		return input, nil
+	}
+	if !s.Decompress {
+		return nil, errors.Wrapf(signer.ErrInvalidEncoding, "contentsignature: signer does not allow %q content encoding", encoding)
+	}
+	out, err := signer.Decompress(input, encoding, s.MaxDecompressedSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "contentsignature")
+	}
+	return out, nil
+}
+
+// Options contains options for signing data with a content signature
+type Options struct {
+	// ContentEncoding is the "gzip" or "br" encoding of the input,
+	// which is decompressed before signing when the signer allows it
+	ContentEncoding string `json:"content_encoding,omitempty"`
+}
+
+// GetDefaultOptions returns default options of the signer
 func (s *ContentSigner) GetDefaultOptions() interface{} {
-	return nil
+	return Options{}
+}
+
+// GetOptions takes a input interface and reflects it into a struct of options
+func GetOptions(input interface{}) (options Options, err error) {
+	buf, err := json.Marshal(input)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(buf, &options)
+	return
 }
@@ -7,13 +7,17 @@
 package contentsignature
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/ecdsa"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"strings"
 	"testing"
 
+	"github.com/pkg/errors"
 	"go.mozilla.org/autograph/signer"
 )
 
@@ -197,6 +201,91 @@ func TestMarshalUnfinished(t *testing.T) {
 	}
 }
 
+func TestWebCrypto(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	for i, testcase := range PASSINGTESTCASES {
+		s, err := New(testcase.cfg)
+		if err != nil {
+			t.Fatalf("testcase %d signer initialization failed with: %v", i, err)
+		}
+		sig, err := s.SignData(input, nil)
+		if err != nil {
+			t.Fatalf("testcase %d failed to sign data: %v", i, err)
+		}
+		enc, err := sig.(*ContentSignature).WebCrypto()
+		if err != nil {
+			t.Fatalf("testcase %d failed to encode signature: %v", i, err)
+		}
+		sigstr, err := sig.Marshal()
+		if err != nil {
+			t.Fatalf("testcase %d failed to marshal signature: %v", i, err)
+		}
+		if base64.RawURLEncoding.EncodeToString(enc.Signature) != sigstr {
+			t.Fatalf("testcase %d expected the raw signature of %q", i, sigstr)
+		}
+		pubkey := s.pub.(*ecdsa.PublicKey)
+		if enc.Algorithm.Name != "ECDSA" || enc.Algorithm.NamedCurve != pubkey.Params().Name {
+			t.Fatalf("testcase %d unexpected algorithm %+v for curve %s", i, enc.Algorithm, pubkey.Params().Name)
+		}
+		if string(enc.DataPrefix) != SignaturePrefix {
+			t.Fatalf("testcase %d unexpected data prefix %q", i, enc.DataPrefix)
+		}
+		// the WebCrypto hash name of the sha2 hash of the signature
+		if enc.Algorithm.Hash != "SHA-"+strings.TrimPrefix(getSignatureHash(s.Mode), "sha") {
+			t.Fatalf("testcase %d unexpected hash %q for mode %s", i, enc.Algorithm.Hash, s.Mode)
+		}
+	}
+
+	_, err := (&ContentSignature{Finished: false}).WebCrypto()
+	if err == nil || err.Error() != "contentsignature.WebCrypto: unfinished cannot be encoded" {
+		t.Fatalf("expected to fail with 'unfinished cannot be encoded' but got %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	var signers []*ContentSigner
+	for i, testcase := range PASSINGTESTCASES {
+		s, err := New(testcase.cfg)
+		if err != nil {
+			t.Fatalf("testcase %d signer initialization failed with: %v", i, err)
+		}
+		signers = append(signers, s)
+	}
+	for i, s := range signers {
+		sig, err := s.SignData(input, nil)
+		if err != nil {
+			t.Fatalf("testcase %d failed to sign data: %v", i, err)
+		}
+		sigstr, err := sig.Marshal()
+		if err != nil {
+			t.Fatalf("testcase %d failed to marshal signature: %v", i, err)
+		}
+		err = Verify(s.PublicKey, sigstr, input)
+		if err != nil {
+			t.Fatalf("testcase %d failed to verify signature: %v", i, err)
+		}
+		err = Verify(s.PublicKey, sigstr, []byte("foobarbaz1234abcde"))
+		if err == nil || !strings.Contains(err.Error(), "verification failed") {
+			t.Fatalf("testcase %d expected the signature of other data to fail, got %v", i, err)
+		}
+		// the keys of other curves don't match the mode
+		for _, other := range signers {
+			if other.Mode == s.Mode {
+				continue
+			}
+			err = Verify(other.PublicKey, sigstr, input)
+			if err == nil || !strings.Contains(err.Error(), "does not match") {
+				t.Fatalf("testcase %d expected a %s key to fail, got %v", i, other.Mode, err)
+			}
+		}
+	}
+	err := Verify("bm90IGEga2V5", "", input)
+	if err == nil || !strings.Contains(err.Error(), "failed to parse public key") {
+		t.Fatalf("expected an invalid key to fail, got %v", err)
+	}
+}
+
 func TestMarshalBadSigLen(t *testing.T) {
 	var cs = &ContentSignature{
 		Finished: true,
@@ -231,7 +320,134 @@ func TestNoShortData(t *testing.T) {
 	if err == nil {
 		t.Fatal("expected to fail with input data too short but succeeded")
 	}
-	if err.Error() != "contentsignature: refusing to sign input data shorter than 10 bytes" {
+	if err.Error() != "contentsignature: refusing to sign input data shorter than 10 bytes: input is too short" {
 		t.Fatalf("expected to fail with input data too short but failed with: %v", err)
 	}
 }
+
+func TestSignDeterministic(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	for i, testcase := range PASSINGTESTCASES {
+		cfg := testcase.cfg
+		cfg.DeterministicECDSA = true
+		s, err := New(cfg)
+		if err != nil {
+			t.Fatalf("testcase %d signer initialization failed with: %v", i, err)
+		}
+		if !s.Config().DeterministicECDSA {
+			t.Fatalf("testcase %d expected the configuration to enable deterministic signatures", i)
+		}
+		var sigs []string
+		for j := 0; j < 2; j++ {
+			sig, err := s.SignData(input, nil)
+			if err != nil {
+				t.Fatalf("testcase %d failed to sign data: %v", i, err)
+			}
+			sigstr, err := sig.Marshal()
+			if err != nil {
+				t.Fatalf("testcase %d failed to marshal signature: %v", i, err)
+			}
+			sigs = append(sigs, sigstr)
+		}
+		if sigs[0] != sigs[1] {
+			t.Fatalf("testcase %d expected reproducible signatures, got %q and %q", i, sigs[0], sigs[1])
+		}
+		cs, err := Unmarshal(sigs[0])
+		if err != nil {
+			t.Fatalf("testcase %d failed to unmarshal signature: %v", i, err)
+		}
+		keyBytes, err := base64.StdEncoding.DecodeString(s.PublicKey)
+		if err != nil {
+			t.Fatalf("testcase %d failed to parse public key: %v", i, err)
+		}
+		pubkey, err := x509.ParsePKIXPublicKey(keyBytes)
+		if err != nil {
+			t.Fatalf("testcase %d failed to parse public key DER: %v", i, err)
+		}
+		if !cs.VerifyData(input, pubkey.(*ecdsa.PublicKey)) {
+			t.Fatalf("testcase %d failed to verify deterministic content signature", i)
+		}
+	}
+}
+
+func TestSignCompressedData(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	gzw.Write(input)
+	gzw.Close()
+
+	conf := PASSINGTESTCASES[0].cfg
+	s, err := New(conf)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	_, err = s.SignData(buf.Bytes(), Options{ContentEncoding: signer.EncodingGzip})
+	if errors.Cause(err) != signer.ErrInvalidEncoding {
+		t.Fatalf("expected signer without decompress to refuse gzip input, got: %v", err)
+	}
+
+	conf.Decompress = true
+	s, err = New(conf)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	sig, err := s.SignData(buf.Bytes(), map[string]interface{}{"content_encoding": "gzip"})
+	if err != nil {
+		t.Fatalf("failed to sign gzip input: %v", err)
+	}
+	if !sig.(*ContentSignature).VerifyData(input, s.pub.(*ecdsa.PublicKey)) {
+		t.Fatal("failed to verify signature of gzip input against decompressed data")
+	}
+
+	conf.MaxDecompressedSize = int64(len(input) - 1)
+	s, err = New(conf)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	_, err = s.SignData(buf.Bytes(), Options{ContentEncoding: signer.EncodingGzip})
+	if errors.Cause(err) != signer.ErrDecompressedTooLarge {
+		t.Fatalf("expected gzip input over the size limit to fail, got: %v", err)
+	}
+}
+
+func BenchmarkSignData(b *testing.B) {
+	for _, size := range []int{1 << 10, 1 << 20} {
+		input := bytes.Repeat([]byte("a"), size)
+		for _, testcase := range PASSINGTESTCASES {
+			s, err := New(testcase.cfg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(fmt.Sprintf("%s/%d", s.Mode, size), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					_, err := s.SignData(input, nil)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkSignHash(b *testing.B) {
+	for _, testcase := range PASSINGTESTCASES {
+		s, err := New(testcase.cfg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, hash := makeTemplatedHash([]byte("foobarbaz1234abcd"), s.Mode)
+		b.Run(s.Mode, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := s.SignHash(hash, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
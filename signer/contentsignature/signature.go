@@ -1,11 +1,14 @@
 package contentsignature // import "go.mozilla.org/autograph/signer/contentsignature"
 import (
 	"crypto/ecdsa"
+	"crypto/x509"
 	"encoding/base64"
 	"fmt"
 	"math/big"
 
 	"github.com/pkg/errors"
+
+	"go.mozilla.org/autograph/signer"
 )
 
 // ContentSignature contains the parsed representation of a signature
@@ -48,6 +51,12 @@ func (sig *ContentSignature) Marshal() (str string, err error) {
 	if sig.Len != P256ECDSABYTESIZE && sig.Len != P384ECDSABYTESIZE && sig.Len != P521ECDSABYTESIZE {
 		return "", fmt.Errorf("contentsignature.Marshal: invalid signature length %d", sig.Len)
 	}
+	encodedsig := base64.RawURLEncoding.EncodeToString(sig.rawRS())
+	return fmt.Sprintf("%s", encodedsig), nil
+}
+
+// rawRS returns the R||S concatenation of the signature
+func (sig *ContentSignature) rawRS() []byte {
 	// write R and S into a slice of len
 	// both R and S are zero-padded to the left to be exactly
 	// len/2 in length
@@ -58,8 +67,32 @@ func (sig *ContentSignature) Marshal() (str string, err error) {
 	rs := make([]byte, sig.Len)
 	copy(rs[Rstart:Rend], sig.R.Bytes())
 	copy(rs[Sstart:Send], sig.S.Bytes())
-	encodedsig := base64.RawURLEncoding.EncodeToString(rs)
-	return fmt.Sprintf("%s", encodedsig), nil
+	return rs
+}
+
+// WebCrypto returns the R||S signature with the ECDSA parameters the
+// browser WebCrypto API verifies it with, on the data prefixed with
+// the content signature template
+func (sig *ContentSignature) WebCrypto() (*signer.WebCryptoEncoding, error) {
+	if !sig.Finished {
+		return nil, fmt.Errorf("contentsignature.WebCrypto: unfinished cannot be encoded")
+	}
+	alg := signer.WebCryptoAlgorithm{Name: "ECDSA"}
+	switch sig.Mode {
+	case P256ECDSA:
+		alg.NamedCurve, alg.Hash = "P-256", "SHA-256"
+	case P384ECDSA:
+		alg.NamedCurve, alg.Hash = "P-384", "SHA-384"
+	case P521ECDSA:
+		alg.NamedCurve, alg.Hash = "P-521", "SHA-512"
+	default:
+		return nil, fmt.Errorf("contentsignature.WebCrypto: unknown mode %q", sig.Mode)
+	}
+	return &signer.WebCryptoEncoding{
+		Signature:  sig.rawRS(),
+		Algorithm:  alg,
+		DataPrefix: []byte(SignaturePrefix),
+	}, nil
 }
 
 // Unmarshal parses a base64 url encoded content signature
@@ -97,6 +130,37 @@ func Unmarshal(signature string) (sig *ContentSignature, err error) {
 	return sig, nil
 }
 
+// Verify verifies a legacy content signature of input with the public
+// key of the signer, the base64 of its DER encoding as returned in the
+// public_key of signature responses. Legacy signatures are issued
+// without an x5u chain, so consumers pin the public key instead of a
+// root, and the mode of the signature must match the curve of the key.
+func Verify(publicKey, signature string, input []byte) error {
+	keyBytes, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return errors.Wrap(err, "contentsignature: failed to decode public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(keyBytes)
+	if err != nil {
+		return errors.Wrap(err, "contentsignature: failed to parse public key")
+	}
+	pubKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.Errorf("contentsignature: expected an ecdsa public key, got %T", key)
+	}
+	sig, err := Unmarshal(signature)
+	if err != nil {
+		return err
+	}
+	if getSignatureLen(sig.Mode) != 2*((pubKey.Params().BitSize+7)/8) {
+		return errors.Errorf("contentsignature: %s signature does not match the %s public key", sig.Mode, pubKey.Params().Name)
+	}
+	if !sig.VerifyData(input, pubKey) {
+		return errors.New("contentsignature: ecdsa signature verification failed")
+	}
+	return nil
+}
+
 func (sig *ContentSignature) String() string {
 	return fmt.Sprintf("ID=%s Mode=%s Len=%d HashName=%s X5U=%s Finished=%t R=%s S=%s",
 		sig.ID, sig.Mode, sig.Len, sig.HashName, sig.X5U, sig.Finished, sig.R.String(), sig.S.String())
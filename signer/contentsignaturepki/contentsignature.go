@@ -1,15 +1,21 @@
 package contentsignaturepki // import "go.mozilla.org/autograph/signer/contentsignaturepki"
 
 import (
+	"context"
 	"crypto"
 	"crypto/ecdsa"
-	"crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/x509"
 	"encoding/asn1"
+	"encoding/json"
 	"fmt"
 	"hash"
 	"io"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"go.mozilla.org/autograph/database"
@@ -17,14 +23,9 @@ import (
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	"go.mozilla.org/mozlogrus"
+	"golang.org/x/crypto/ed25519"
 )
 
-func init() {
-	// initialize the logger
-	mozlogrus.Enable("autograph")
-}
-
 const (
 	// Type of this signer is 'contentsignaturepki'
 	Type = "contentsignaturepki"
@@ -41,6 +42,13 @@ const (
 	// P384ECDSABYTESIZE defines the bytes length of a P384ECDSA signature
 	P384ECDSABYTESIZE = 96
 
+	// Ed25519 defines an ed25519 content signature, made with an
+	// Ed25519 end-entity key issued by the ecdsa issuer
+	Ed25519 = "ed25519"
+
+	// Ed25519BYTESIZE defines the bytes length of an Ed25519 signature
+	Ed25519BYTESIZE = 64
+
 	// SignaturePrefix is a string preprended to data prior to signing
 	SignaturePrefix = "Content-Signature:\x00"
 
@@ -52,17 +60,46 @@ const (
 // ContentSigner implements an issuer of content signatures
 type ContentSigner struct {
 	signer.Configuration
+	signer.KeyZeroizer
 	IssuerPrivKey, IssuerPubKey string
-	issuerPriv, eePriv          crypto.PrivateKey
-	issuerPub, eePub            crypto.PublicKey
-	eeLabel                     string
+	issuerPriv                  crypto.PrivateKey
+	issuerPub                   crypto.PublicKey
 	rand                        io.Reader
 	validity                    time.Duration
 	clockSkewTolerance          time.Duration
+	notBeforeBackdate           time.Duration
+	notAfterMargin              time.Duration
+	rotationInterval            time.Duration
+	rotationOverlap             time.Duration
 	chainUploadLocation         string
-	chain                       string
+	x5uTemplate                 *template.Template
+	eeLabelTemplate             *template.Template
+	chainNameTemplate           *template.Template
 	caCert                      string
 	db                          *database.Handler
+
+	// instanceLock is the database lock that keeps an ed25519
+	// signer on a single instance
+	instanceLock *database.SignerLock
+
+	// keyConf is the configuration end-entity keys are looked up
+	// and generated with
+	keyConf signer.Configuration
+
+	// ee holds the *endEntity the signer signs with, and rotateMu
+	// serializes its rotations and rollbacks. previousEE is the
+	// end-entity replaced by the last rotation, which rollbacks
+	// return to when the signer has no database.
+	ee         atomic.Value
+	rotateMu   sync.Mutex
+	previousEE *endEntity
+
+	// recent are the latest signatures of the signer, which are
+	// re-verified after its end-entity changes
+	recent recentSignatures
+
+	// now returns the time scheduled rotations are due at
+	now func() time.Time
 }
 
 // New initializes a ContentSigner using a signer configuration
@@ -73,9 +110,24 @@ func New(conf signer.Configuration) (s *ContentSigner, err error) {
 	s.IssuerPrivKey = conf.IssuerPrivKey
 	s.IssuerCert = conf.IssuerCert
 	s.X5U = conf.X5U
+	s.Decompress = conf.Decompress
+	s.MaxDecompressedSize = conf.MaxDecompressedSize
+	s.DeterministicECDSA = conf.DeterministicECDSA
 	s.validity = conf.Validity
 	s.clockSkewTolerance = conf.ClockSkewTolerance
+	s.notBeforeBackdate = conf.NotBeforeBackdate
+	if s.notBeforeBackdate == 0 {
+		s.notBeforeBackdate = s.clockSkewTolerance
+	}
+	s.notAfterMargin = conf.NotAfterMargin
+	if s.notAfterMargin == 0 {
+		s.notAfterMargin = s.clockSkewTolerance
+	}
+	s.rotationInterval = conf.RotationInterval
+	s.rotationOverlap = conf.RotationOverlap
+	s.now = time.Now
 	s.chainUploadLocation = conf.ChainUploadLocation
+	s.ChainUpload = conf.ChainUpload
 	s.caCert = conf.CaCert
 	s.db = conf.DB
 
@@ -88,6 +140,27 @@ func New(conf signer.Configuration) (s *ContentSigner, err error) {
 	if conf.IssuerPrivKey == "" {
 		return nil, fmt.Errorf("contentsignaturepki %q: missing issuer private key in signer configuration", s.ID)
 	}
+	err = validateChainUpload(conf.ChainUploadLocation, conf.ChainUpload)
+	if err != nil {
+		return nil, errors.Wrapf(err, "contentsignaturepki %q", s.ID)
+	}
+	if conf.X5UTemplate != "" {
+		s.X5UTemplate = conf.X5UTemplate
+		s.x5uTemplate, err = template.New("x5u").Option("missingkey=error").Parse(conf.X5UTemplate)
+		if err != nil {
+			return nil, errors.Wrapf(err, "contentsignaturepki %q: failed to parse x5u template", s.ID)
+		}
+	}
+	s.EELabelTemplate = conf.EELabelTemplate
+	s.eeLabelTemplate, err = parseNameTemplate("end-entity label", conf.EELabelTemplate, DefaultEELabelTemplate)
+	if err != nil {
+		return nil, errors.Wrapf(err, "contentsignaturepki %q", s.ID)
+	}
+	s.ChainNameTemplate = conf.ChainNameTemplate
+	s.chainNameTemplate, err = parseNameTemplate("chain name", conf.ChainNameTemplate, DefaultChainNameTemplate)
+	if err != nil {
+		return nil, errors.Wrapf(err, "contentsignaturepki %q", s.ID)
+	}
 	s.rand = conf.GetRand()
 	// make a temporary config since we need to retrieve the
 	// issuer private key from the hsm
@@ -97,124 +170,487 @@ func New(conf signer.Configuration) (s *ContentSigner, err error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "contentsignaturepki %q: failed to get keys", s.ID)
 	}
+	s.ZeroizeAtExit(s.issuerPriv)
 	// if validity is undef, default to 30 days
 	if s.validity == 0 {
 		log.Printf("contentsignaturepki %q: no validity configured, defaulting to 30 days", s.ID)
 		s.validity = 720 * time.Hour
 	}
 
+	err = s.validateRotation()
+	if err != nil {
+		return nil, errors.Wrapf(err, "contentsignaturepki %q", s.ID)
+	}
+
 	switch s.issuerPub.(type) {
 	case *ecdsa.PublicKey:
 	default:
 		return nil, fmt.Errorf("contentsignaturepki %q: invalid public key type for issuer, must be ecdsa", s.ID)
 	}
 	s.Mode = s.getModeFromCurve()
+	switch conf.Mode {
+	case "", s.Mode:
+	case Ed25519:
+		if conf.DeterministicECDSA {
+			return nil, fmt.Errorf("contentsignaturepki %q: deterministicecdsa doesn't apply to mode %q, whose signatures are always deterministic", s.ID, Ed25519)
+		}
+		// hsms don't make ed25519 keys, so the end-entities are
+		// generated in memory and can't be shared with other
+		// instances through the database. The signer runs on the
+		// single instance that holds its lock in the database,
+		// and keeps its end-entities in memory like without one.
+		if s.db != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			s.instanceLock, err = s.db.LockSigner(ctx, s.ID)
+			cancel()
+			if err != nil {
+				return nil, errors.Wrapf(err, "contentsignaturepki %q: mode %q runs on a single instance", s.ID, Ed25519)
+			}
+			s.db = nil
+		}
+		s.Mode = Ed25519
+	default:
+		return nil, fmt.Errorf("contentsignaturepki %q: invalid mode %q, must be %q or empty", s.ID, conf.Mode, Ed25519)
+	}
 
-	err = s.initEE(conf)
+	err = conf.CheckDeterministicECDSA(nil)
 	if err != nil {
+		return nil, errors.Wrapf(err, "contentsignaturepki %q", s.ID)
+	}
+	s.keyConf = conf
+	err = s.initEE(context.Background())
+	if err != nil {
+		if s.instanceLock != nil {
+			s.instanceLock.Release()
+		}
 		return nil, errors.Wrapf(err, "contentsignaturepki %q: failed to initialize end-entity", s.ID)
 	}
 	return
 }
 
+// endEntity is the end-entity key and chain a signer signs with. It is
+// never modified once the signer uses it: rotations make a new one and
+// swap it in atomically, so a signature in flight during a rotation is
+// made with the key of the x5u it returns.
+type endEntity struct {
+	label     string
+	priv      crypto.PrivateKey
+	pub       crypto.PublicKey
+	publicKey string
+	x5u       string
+	// chain is the chain downloaded from x5u, end-entity first
+	chain []*x509.Certificate
+}
+
+// currentEE returns the end-entity the signer signs with
+func (s *ContentSigner) currentEE() *endEntity {
+	return s.ee.Load().(*endEntity)
+}
+
 // initEE configures an end-entity key and certificate that will be used
 // for signing. It will try to retrieve an existing one from db/hsm, and if
 // no suitable candidate can be found, a new one will be created.
-func (s *ContentSigner) initEE(conf signer.Configuration) error {
-	err := s.findAndSetEE(conf)
+//
+// Database queries, chain uploads and downloads are aborted when ctx
+// is done.
+func (s *ContentSigner) initEE(ctx context.Context) error {
+	ee, err := s.findEE(ctx)
 	switch err {
 	case nil:
-		log.Printf("contentsignaturepki %q: reusing existing EE %q", s.ID, s.eeLabel)
+		log.Printf("contentsignaturepki %q: reusing existing EE %q", s.ID, ee.label)
 	case database.ErrNoSuitableEEFound:
 		// No suitable end-entity found, making a new chain
 		log.Printf("contentsignaturepki %q: making new end-entity", s.ID)
-		var tx *database.Transaction
-		if s.db != nil {
-			tx, err = s.db.BeginEndEntityOperations()
-			if err != nil {
-				return errors.Wrapf(err, "contentsignaturepki %q: failed to begin db operations", s.ID)
-			}
+		ee, err = s.createEE(ctx, func(*endEntity) bool { return true })
+		if err != nil {
+			return err
 		}
-		// to prevent race conditions, we perform another set of the EE just in case
+	default:
+		return errors.Wrapf(err, "contentsignaturepki %q: failed to find suitable end-entity", s.ID)
+	}
+	err = s.keyConf.CheckDeterministicECDSA(ee.priv)
+	if err != nil {
+		return errors.Wrapf(err, "contentsignaturepki %q: end-entity %q", s.ID, ee.label)
+	}
+	ee.chain, err = GetX5UContext(ctx, ee.x5u)
+	if err != nil {
+		return errors.Wrapf(err, "contentsignaturepki %q: failed to verify x5u", s.ID)
+	}
+	err = s.verifyEEKey(ee)
+	if err != nil {
+		return errors.Wrapf(err, "contentsignaturepki %q", s.ID)
+	}
+	s.ee.Store(ee)
+	return nil
+}
+
+// createEE generates an end-entity key, uploads its chain and inserts
+// it in the database while holding the end-entity lock of the
+// database. When reuse is set, a suitable end-entity of the database
+// it accepts, like one another instance created while it waited for
+// the lock, is returned instead.
+func (s *ContentSigner) createEE(ctx context.Context, reuse func(*endEntity) bool) (*endEntity, error) {
+	var (
+		tx  *database.Transaction
+		err error
+	)
+	if s.db != nil {
+		tx, err = s.db.BeginEndEntityOperationsContext(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "contentsignaturepki %q: failed to begin db operations", s.ID)
+		}
+	}
+	ee, err := s.createLockedEE(ctx, tx, reuse)
+	if err != nil {
+		if tx != nil {
+			tx.Rollback()
+		}
+		return nil, err
+	}
+	if tx != nil {
+		// close the transaction
+		err = tx.End()
+		if err != nil {
+			return nil, errors.Wrapf(err, "contentsignaturepki %q: failed to commit end-entity operations in database", s.ID)
+		}
+	}
+	return ee, nil
+}
+
+// createLockedEE is the part of createEE that runs under the lock
+func (s *ContentSigner) createLockedEE(ctx context.Context, tx *database.Transaction, reuse func(*endEntity) bool) (*endEntity, error) {
+	if reuse != nil {
+		// to prevent race conditions, we perform another search of the EE just in case
 		// someone else created it before we managed to obtain the lock
-		err = s.findAndSetEE(conf)
-		switch err {
-		case nil:
+		ee, err := s.findEE(ctx)
+		switch {
+		case err == nil && reuse(ee):
 			// alright we found a suitable EE this time to don't make one
-			goto releaseLock
-		case database.ErrNoSuitableEEFound:
+			return ee, nil
+		case err == nil:
+			// the caller wants another EE than this one, continue on
+		case err == database.ErrNoSuitableEEFound:
 			// still nothing suitable, continue on
-			break
 		default:
 			// some other error popped up, exit
-			return err
+			return nil, err
 		}
-		// create a label and generate the key
-		s.eeLabel = fmt.Sprintf("%s-%s", s.ID, time.Now().UTC().Format("20060102150405"))
-		s.eePriv, s.eePub, err = conf.MakeKey(s.issuerPub, s.eeLabel)
+	}
+	// create a label and generate the key
+	label, err := executeNameTemplate(s.eeLabelTemplate, nameTemplateData{
+		SignerID:   s.ID,
+		CommonName: s.ID + CSNameSpace,
+	}, s.rand)
+	if err != nil {
+		return nil, errors.Wrapf(err, "contentsignaturepki %q: failed to make end-entity label", s.ID)
+	}
+	ee := &endEntity{label: label}
+	if s.Mode == Ed25519 {
+		ee.pub, ee.priv, err = ed25519.GenerateKey(s.rand)
+	} else {
+		ee.priv, ee.pub, err = s.keyConf.MakeKey(s.issuerPub, label)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "contentsignaturepki %q: failed to generate end entity", s.ID)
+	}
+	ee.publicKey, err = encodePublicKey(ee.pub)
+	if err != nil {
+		return nil, errors.Wrapf(err, "contentsignaturepki %q", s.ID)
+	}
+	// make the certificate and upload the chain
+	ee.x5u, err = s.makeAndUploadChain(ctx, ee.pub)
+	if err != nil {
+		return nil, errors.Wrapf(err, "contentsignaturepki %q: failed to make chain and x5u", s.ID)
+	}
+	if tx != nil {
+		// insert it in database
+		hsmHandle := signer.GetPrivKeyHandle(ee.priv)
+		err = tx.InsertEE(ee.x5u, ee.label, s.ID, hsmHandle)
 		if err != nil {
-			return errors.Wrapf(err, "contentsignaturepki %q: failed to generate end entity", s.ID)
+			return nil, errors.Wrapf(err, "contentsignaturepki %q: failed to insert EE into database", s.ID)
 		}
-		// make the certificate and upload the chain
-		err = s.makeAndUploadChain()
+		log.Printf("contentsignaturepki %q: generated private key labeled %q with hsm handle %d and x5u %q", s.ID, ee.label, hsmHandle, ee.x5u)
+	}
+	return ee, nil
+}
+
+// Rotate makes a new end-entity and chain, and switches the signer to
+// it once its x5u is verified. Signatures in flight complete with the
+// previous end-entity, whose key is not zeroized since they may still
+// use it. Concurrent rotations of a signer run one after the other.
+func (s *ContentSigner) Rotate(ctx context.Context) error {
+	s.rotateMu.Lock()
+	defer s.rotateMu.Unlock()
+	ee, err := s.createEE(ctx, nil)
+	if err != nil {
+		return err
+	}
+	ee.chain, err = GetX5UContext(ctx, ee.x5u)
+	if err != nil {
+		return errors.Wrapf(err, "contentsignaturepki %q: failed to verify x5u", s.ID)
+	}
+	previous := s.currentEE()
+	s.ee.Store(ee)
+	s.previousEE = previous
+	log.Printf("contentsignaturepki %q: rotated end-entity from %q to %q", s.ID, previous.label, ee.label)
+	return nil
+}
+
+// Rollback switches the signer back to the end-entity it used before
+// the current one, like after a rotation published a bad chain, and
+// returns its label and x5u. With a database, the current end-entity
+// is marked as rolled back so instances never return to it, and the
+// previous one becomes current for all instances once they restart or
+// reload it. Without a database, the signer returns to the end-entity
+// replaced by its last rotation.
+func (s *ContentSigner) Rollback(ctx context.Context) (label, x5u string, err error) {
+	s.rotateMu.Lock()
+	defer s.rotateMu.Unlock()
+	current := s.currentEE()
+	var previous *endEntity
+	if s.db != nil {
+		previous, err = s.rollbackEEInDB(ctx, current)
 		if err != nil {
-			return errors.Wrapf(err, "contentsignaturepki %q: failed to make chain and x5u", s.ID)
+			return "", "", err
 		}
-		if tx != nil {
-			// insert it in database
-			hsmHandle := signer.GetPrivKeyHandle(s.eePriv)
-			err = tx.InsertEE(s.X5U, s.eeLabel, s.ID, hsmHandle)
-			if err != nil {
-				return errors.Wrapf(err, "contentsignaturepki %q: failed to insert EE into database", s.ID)
-			}
-			log.Printf("contentsignaturepki %q: generated private key labeled %q with hsm handle %d and x5u %q", s.ID, s.eeLabel, hsmHandle, s.X5U)
+	} else {
+		if s.previousEE == nil {
+			return "", "", errors.Wrapf(database.ErrNoPreviousEE, "contentsignaturepki %q: no rotation to roll back", s.ID)
 		}
-	releaseLock:
-		if tx != nil {
-			// close the transaction
-			err = tx.End()
-			if err != nil {
-				return errors.Wrapf(err, "contentsignaturepki %q: failed to commit end-entity operations in database", s.ID)
-			}
+		// copy the end-entity, which is never modified once used
+		restored := *s.previousEE
+		restored.chain, err = GetX5UContext(ctx, restored.x5u)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "contentsignaturepki %q: failed to verify x5u of previous end-entity", s.ID)
 		}
+		previous = &restored
+	}
+	s.ee.Store(previous)
+	s.previousEE = nil
+	log.Printf("contentsignaturepki %q: rolled back end-entity from %q to %q", s.ID, current.label, previous.label)
+	return previous.label, previous.x5u, nil
+}
+
+// Sync switches the signer to the current end-entity of the database,
+// like one made or restored by a rotation or rollback of another
+// instance, and returns whether it changed. Standby instances sync
+// their signers so they sign with the end-entity of the primary as
+// soon as they are promoted. Signers without a database, or whose
+// database has no valid end-entity yet, keep their end-entity.
+func (s *ContentSigner) Sync(ctx context.Context) (changed bool, err error) {
+	if s.db == nil {
+		return false, nil
+	}
+	s.rotateMu.Lock()
+	defer s.rotateMu.Unlock()
+	current := s.currentEE()
+	ee, err := s.findEE(ctx)
+	switch err {
+	case nil:
+	case database.ErrNoSuitableEEFound:
+		return false, nil
 	default:
-		return errors.Wrapf(err, "contentsignaturepki %q: failed to find suitable end-entity", s.ID)
+		return false, errors.Wrapf(err, "contentsignaturepki %q: failed to find current end-entity", s.ID)
+	}
+	if ee.label == current.label && ee.x5u == current.x5u {
+		return false, nil
 	}
-	_, err = GetX5U(s.X5U)
+	err = s.keyConf.CheckDeterministicECDSA(ee.priv)
 	if err != nil {
-		return errors.Wrapf(err, "contentsignaturepki %q: failed to verify x5u", s.ID)
+		return false, errors.Wrapf(err, "contentsignaturepki %q: end-entity %q", s.ID, ee.label)
+	}
+	ee.chain, err = GetX5UContext(ctx, ee.x5u)
+	if err != nil {
+		return false, errors.Wrapf(err, "contentsignaturepki %q: failed to verify x5u", s.ID)
+	}
+	err = s.verifyEEKey(ee)
+	if err != nil {
+		return false, errors.Wrapf(err, "contentsignaturepki %q", s.ID)
+	}
+	s.ee.Store(ee)
+	s.previousEE = current
+	log.Printf("contentsignaturepki %q: synced end-entity from %q to %q", s.ID, current.label, ee.label)
+	return true, nil
+}
+
+// EndEntity returns the label and x5u of the end-entity the signer
+// signs with
+func (s *ContentSigner) EndEntity() (label, x5u string) {
+	ee := s.currentEE()
+	return ee.label, ee.x5u
+}
+
+// rollbackEEInDB loads the end-entity created before current from the
+// database and hsm, verifies its x5u, and makes it the current
+// end-entity of the signer in the database while holding the
+// end-entity lock
+func (s *ContentSigner) rollbackEEInDB(ctx context.Context, current *endEntity) (*endEntity, error) {
+	tx, err := s.db.BeginEndEntityOperationsContext(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "contentsignaturepki %q: failed to begin db operations", s.ID)
+	}
+	label, x5u, err := tx.GetPreviousEE(ctx, s.ID, current.label)
+	if err != nil {
+		tx.Rollback()
+		return nil, errors.Wrapf(err, "contentsignaturepki %q", s.ID)
+	}
+	previous, err := s.loadEE(label, x5u)
+	if err == nil {
+		err = s.keyConf.CheckDeterministicECDSA(previous.priv)
+	}
+	if err == nil {
+		previous.chain, err = GetX5UContext(ctx, previous.x5u)
+		if err != nil {
+			err = errors.Wrap(err, "failed to verify x5u of previous end-entity")
+		}
+	}
+	if err == nil {
+		err = s.verifyEEKey(previous)
+	}
+	if err == nil {
+		err = tx.RollbackEE(ctx, s.ID, current.label, previous.label)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, errors.Wrapf(err, "contentsignaturepki %q", s.ID)
+	}
+	err = tx.End()
+	if err != nil {
+		return nil, errors.Wrapf(err, "contentsignaturepki %q: failed to commit end-entity operations in database", s.ID)
+	}
+	return previous, nil
+}
+
+// CertificateChain returns the chain of the current end-entity, as
+// published at its x5u
+func (s *ContentSigner) CertificateChain() []*x509.Certificate {
+	return s.currentEE().chain
+}
+
+// CheckX5U downloads the chain of the current end-entity from its x5u
+// again, and returns an error when it doesn't parse or verify anymore,
+// or isn't the chain the signer published, like when the upload
+// location was overwritten or corrupted
+func (s *ContentSigner) CheckX5U(ctx context.Context) error {
+	ee := s.currentEE()
+	certs, err := GetX5UContext(ctx, ee.x5u)
+	if err != nil {
+		return errors.Wrapf(err, "contentsignaturepki %q: invalid chain at x5u %q", s.ID, ee.x5u)
+	}
+	pub, err := encodePublicKey(certs[0].PublicKey)
+	if err != nil {
+		return errors.Wrapf(err, "contentsignaturepki %q: invalid end-entity public key at x5u %q", s.ID, ee.x5u)
+	}
+	if pub != ee.publicKey {
+		return errors.Errorf("contentsignaturepki %q: end-entity at x5u %q doesn't match the key %q the signer uses", s.ID, ee.x5u, ee.label)
+	}
+	for i := range certs {
+		if i >= len(ee.chain) || !certs[i].Equal(ee.chain[i]) {
+			return errors.Errorf("contentsignaturepki %q: chain at x5u %q differs from the chain the signer published", s.ID, ee.x5u)
+		}
 	}
 	return nil
 }
 
+// AtExit zeroizes the issuer key and the key of the current
+// end-entity, which rotations replace after initialization, and
+// releases the instance lock of ed25519 signers
+func (s *ContentSigner) AtExit() error {
+	signer.ZeroizePrivateKey(s.currentEE().priv)
+	if s.instanceLock != nil {
+		err := s.instanceLock.Release()
+		if err != nil {
+			log.Printf("contentsignaturepki %q: failed to release instance lock: %v", s.ID, err)
+		}
+	}
+	return s.KeyZeroizer.AtExit()
+}
+
 // Config returns the configuration of the current signer
 func (s *ContentSigner) Config() signer.Configuration {
+	ee := s.currentEE()
 	return signer.Configuration{
 		ID:                  s.ID,
 		Type:                s.Type,
 		Mode:                s.Mode,
 		PrivateKey:          s.PrivateKey,
-		PublicKey:           s.PublicKey,
+		PublicKey:           ee.publicKey,
 		IssuerPrivKey:       s.IssuerPrivKey,
 		IssuerCert:          s.IssuerCert,
-		X5U:                 s.X5U,
+		X5U:                 ee.x5u,
+		X5UTemplate:         s.X5UTemplate,
 		Validity:            s.validity,
 		ClockSkewTolerance:  s.clockSkewTolerance,
+		NotBeforeBackdate:   s.notBeforeBackdate,
+		NotAfterMargin:      s.notAfterMargin,
+		RotationInterval:    s.rotationInterval,
+		RotationOverlap:     s.rotationOverlap,
 		ChainUploadLocation: s.chainUploadLocation,
+		ChainUpload:         s.ChainUpload,
 		CaCert:              s.caCert,
+		EELabelTemplate:     s.EELabelTemplate,
+		ChainNameTemplate:   s.ChainNameTemplate,
+		Decompress:          s.Decompress,
+		MaxDecompressedSize: s.MaxDecompressedSize,
+		DeterministicECDSA:  s.DeterministicECDSA,
 	}
 }
 
 // SignData takes input data, templates it, hashes it and signs it.
 // The returned signature is of type ContentSignature and ready to be Marshalled.
+//
+// Ed25519 signers sign the templated input itself, which the algorithm
+// hashes with sha512 as part of the signature.
+//
+// When the signer allows decompression and the content_encoding option
+// is set, the input is decompressed before it is templated and hashed.
 func (s *ContentSigner) SignData(input []byte, options interface{}) (signer.Signature, error) {
+	opt, err := GetOptions(options)
+	if err != nil {
+		return nil, errors.Wrapf(err, "contentsignaturepki %q: failed to parse options", s.ID)
+	}
+	input, err = s.decompress(input, opt.ContentEncoding)
+	if err != nil {
+		return nil, err
+	}
 	if len(input) < 10 {
-		return nil, fmt.Errorf("contentsignaturepki %q: refusing to sign input data shorter than 10 bytes", s.ID)
+		return nil, errors.Wrapf(signer.ErrInputTooShort, "contentsignaturepki %q: refusing to sign input data shorter than 10 bytes", s.ID)
 	}
-	alg, hash := MakeTemplatedHash(input, s.Mode)
-	sig, err := s.SignHash(hash, options)
-	sig.(*ContentSignature).storeHashName(alg)
-	return sig, err
+	if s.Mode != Ed25519 {
+		alg, hash := MakeTemplatedHash(input, s.Mode)
+		sig, err := s.SignHash(hash, options)
+		sig.(*ContentSignature).storeHashName(alg)
+		return sig, err
+	}
+	msg := makeTemplatedInput(input)
+	csig, err := s.sign(s.currentEE(), msg)
+	if err != nil {
+		return nil, err
+	}
+	csig.storeHashName(getSignatureHash(s.Mode))
+	if len(msg) <= maxRecentMessageSize {
+		s.recent.add(msg, csig)
+	}
+	return csig, nil
+}
+
+// makeTemplatedInput returns the input data prefixed with the string
+// "Content-Signature:\x00", which Ed25519 signers sign without hashing
+// it first
+func makeTemplatedInput(data []byte) []byte {
+	msg := make([]byte, 0, len(SignaturePrefix)+len(data))
+	msg = append(msg, SignaturePrefix...)
+	return append(msg, data...)
+}
+
+// toSign returns what the signer signs for some input data: its
+// templated input in Ed25519 mode, or its templated hash otherwise
+func (s *ContentSigner) toSign(data []byte) []byte {
+	if s.Mode == Ed25519 {
+		return makeTemplatedInput(data)
+	}
+	_, hash := MakeTemplatedHash(data, s.Mode)
+	return hash
 }
 
 // MakeTemplatedHash returns the templated sha384 of the input data. The template adds
@@ -223,9 +659,6 @@ func (s *ContentSigner) SignData(input []byte, options interface{}) (signer.Sign
 //
 // The name of the hash function is returned, followed by the hash bytes
 func MakeTemplatedHash(data []byte, curvename string) (alg string, out []byte) {
-	templated := make([]byte, len(SignaturePrefix)+len(data))
-	copy(templated[:len(SignaturePrefix)], []byte(SignaturePrefix))
-	copy(templated[len(SignaturePrefix):], data)
 	var md hash.Hash
 	switch curvename {
 	case P384ECDSA:
@@ -235,26 +668,58 @@ func MakeTemplatedHash(data []byte, curvename string) (alg string, out []byte) {
 		md = sha256.New()
 		alg = "sha256"
 	}
-	md.Write(templated)
+	// hash the prefix and data in turn rather than copying large
+	// inputs to template them
+	io.WriteString(md, SignaturePrefix)
+	md.Write(data)
 	return alg, md.Sum(nil)
 }
 
 // SignHash takes an input hash and returns a signature. It assumes the input data
 // has already been hashed with something like sha384
+//
+// Ed25519 signers refuse to sign hashes, since their signatures are
+// made on the templated input rather than a hash of it.
 func (s *ContentSigner) SignHash(input []byte, options interface{}) (signer.Signature, error) {
+	if s.Mode == Ed25519 {
+		return nil, errors.Wrapf(signer.ErrInvalidHashLength, "contentsignaturepki %q: refusing to sign input hash, ed25519 signers only sign data", s.ID)
+	}
 	if len(input) != 32 && len(input) != 48 && len(input) != 64 {
-		return nil, fmt.Errorf("contentsignaturepki %q: refusing to sign input hash. length %d, expected 32, 48 or 64", s.ID, len(input))
+		return nil, errors.Wrapf(signer.ErrInvalidHashLength, "contentsignaturepki %q: refusing to sign input hash. length %d, expected 32, 48 or 64", s.ID, len(input))
+	}
+	// load the end-entity once so the signature and its x5u match
+	// when the signer rotates concurrently
+	csig, err := s.sign(s.currentEE(), input)
+	if err != nil {
+		return nil, err
 	}
-	var err error
-	csig := new(ContentSignature)
-	csig = &ContentSignature{
+	s.recent.add(input, csig)
+	return csig, nil
+}
+
+// sign signs with an end-entity of the signer what toSign returns: a
+// templated hash, or a templated input in Ed25519 mode
+func (s *ContentSigner) sign(ee *endEntity, input []byte) (*ContentSignature, error) {
+	csig := &ContentSignature{
 		Len:  getSignatureLen(s.Mode),
 		Mode: s.Mode,
-		X5U:  s.X5U,
+		X5U:  ee.x5u,
 		ID:   s.ID,
+
+		keyLabel: ee.label,
 	}
 
-	asn1Sig, err := s.eePriv.(crypto.Signer).Sign(rand.Reader, input, nil)
+	if priv, ok := ee.priv.(ed25519.PrivateKey); ok {
+		// the R and S halves of the signature are stored like
+		// those of ecdsa signatures, which marshals them back
+		// byte for byte
+		raw := ed25519.Sign(priv, input)
+		csig.R = new(big.Int).SetBytes(raw[:Ed25519BYTESIZE/2])
+		csig.S = new(big.Int).SetBytes(raw[Ed25519BYTESIZE/2:])
+		csig.Finished = true
+		return csig, nil
+	}
+	asn1Sig, err := signer.SignECDSADigest(ee.priv, s.keyConf.GetRandForKey(ee.priv), input, s.DeterministicECDSA)
 	if err != nil {
 		return nil, errors.Wrapf(err, "contentsignaturepki %q: failed to sign hash", s.ID)
 	}
@@ -269,7 +734,7 @@ func (s *ContentSigner) SignHash(input []byte, options interface{}) (signer.Sign
 	return csig, nil
 }
 
-// getSignatureLen returns the size of an ECDSA signature issued by the signer,
+// getSignatureLen returns the size of a signature issued by the signer,
 // or -1 if the mode is unknown
 //
 // The signature length is double the size size of the curve field, in bytes
@@ -281,18 +746,23 @@ func getSignatureLen(mode string) int {
 		return P256ECDSABYTESIZE
 	case P384ECDSA:
 		return P384ECDSABYTESIZE
+	case Ed25519:
+		return Ed25519BYTESIZE
 	}
 	return -1
 }
 
 // getSignatureHash returns the name of the hash function used by a given mode,
-// or an empty string if the mode is unknown
+// or an empty string if the mode is unknown. For Ed25519, it is the
+// hash the algorithm computes over the templated input.
 func getSignatureHash(mode string) string {
 	switch mode {
 	case P256ECDSA:
 		return "sha256"
 	case P384ECDSA:
 		return "sha384"
+	case Ed25519:
+		return "sha512"
 	}
 	return ""
 }
@@ -309,9 +779,42 @@ func (s *ContentSigner) getModeFromCurve() string {
 	}
 }
 
-// GetDefaultOptions returns nil because this signer has no option
+// decompress returns the input decoded from its content encoding,
+// or an error if the signer does not allow decompression
+func (s *ContentSigner) decompress(input []byte, encoding string) ([]byte, error) {
+	if encoding == "" || encoding == signer.EncodingIdentity {
+		return input, nil
+	}
+	if !s.Decompress {
+		return nil, errors.Wrapf(signer.ErrInvalidEncoding, "contentsignaturepki %q: signer does not allow %q content encoding", s.ID, encoding)
+	}
+	out, err := signer.Decompress(input, encoding, s.MaxDecompressedSize)
+	if err != nil {
+		return nil, errors.Wrapf(err, "contentsignaturepki %q", s.ID)
+	}
+	return out, nil
+}
+
+// Options contains options for signing data with a content signature
+type Options struct {
+	// ContentEncoding is the "gzip" or "br" encoding of the input,
+	// which is decompressed before signing when the signer allows it
+	ContentEncoding string `json:"content_encoding,omitempty"`
+}
+
+// GetDefaultOptions returns default options of the signer
 func (s *ContentSigner) GetDefaultOptions() interface{} {
-	return nil
+	return Options{}
+}
+
+// GetOptions takes a input interface and reflects it into a struct of options
+func GetOptions(input interface{}) (options Options, err error) {
+	buf, err := json.Marshal(input)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(buf, &options)
+	return
 }
 
 // Verify takes the location of a cert chain (x5u), a signature in its
@@ -327,14 +830,17 @@ func Verify(x5u, signature string, input []byte) error {
 	if len(certs) < 1 {
 		return fmt.Errorf("no certificate found in x5u")
 	}
-	key := certs[0].PublicKey.(*ecdsa.PublicKey)
+	key := certs[0].PublicKey
 	// parse the json signature
 	sig, err := Unmarshal(signature)
 	if err != nil {
 		return err
 	}
-	// make a templated hash
+	// verify the templated input with the end-entity key
 	if !sig.VerifyData(input, key) {
+		if _, ok := key.(ed25519.PublicKey); ok {
+			return fmt.Errorf("ed25519 signature verification failed")
+		}
 		return fmt.Errorf("ecdsa signature verification failed")
 	}
 	return nil
@@ -7,11 +7,36 @@
 package contentsignaturepki
 
 import (
+	"context"
 	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"text/template"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/pkg/errors"
+	"go.mozilla.org/autograph/database"
 	"go.mozilla.org/autograph/signer"
+	"golang.org/x/crypto/ed25519"
 )
 
 func TestSign(t *testing.T) {
@@ -71,9 +96,9 @@ func TestSign(t *testing.T) {
 		}
 
 		// verify the signature using the public key of the end entity
-		certs, err := GetX5U(s.X5U)
+		certs, err := GetX5U(s.Config().X5U)
 		if err != nil {
-			t.Fatalf("testcase %d failed to get X5U %q: %v", i, s.X5U, err)
+			t.Fatalf("testcase %d failed to get X5U %q: %v", i, s.Config().X5U, err)
 		}
 		key := certs[0].PublicKey.(*ecdsa.PublicKey)
 		if !sig.(*ContentSignature).VerifyData([]byte(input), key) {
@@ -82,6 +107,620 @@ func TestSign(t *testing.T) {
 	}
 }
 
+func TestEndEntityValidityMargins(t *testing.T) {
+	cfg := PASSINGTESTCASES[0].cfg
+	cfg.Validity = 24 * time.Hour
+	cfg.ClockSkewTolerance = time.Hour
+	cfg.NotBeforeBackdate = 48 * time.Hour
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if s.Config().NotAfterMargin != time.Hour {
+		t.Fatalf("expected notafter margin to default to clock skew tolerance, got %s", s.Config().NotAfterMargin)
+	}
+	certs, err := GetX5U(s.Config().X5U)
+	if err != nil {
+		t.Fatalf("failed to get X5U %q: %v", s.Config().X5U, err)
+	}
+	now := time.Now()
+	backdate := now.Sub(certs[0].NotBefore)
+	if backdate < 47*time.Hour || backdate > 49*time.Hour {
+		t.Fatalf("expected end-entity notbefore to be backdated by 48h, got %s", backdate)
+	}
+	lifetime := certs[0].NotAfter.Sub(now)
+	if lifetime < 24*time.Hour || lifetime > 26*time.Hour {
+		t.Fatalf("expected end-entity notafter to be 25h from now, got %s", lifetime)
+	}
+}
+
+func TestGetX5UDeduplicatesDownloads(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	chain, err := ioutil.ReadFile(strings.TrimPrefix(s.Config().X5U, "file://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu        sync.Mutex
+		downloads int
+	)
+	release, stalled := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chains/stalled.chain" {
+			<-stalled
+			return
+		}
+		mu.Lock()
+		downloads++
+		mu.Unlock()
+		<-release
+		w.Write(chain)
+	}))
+	defer server.Close()
+	x5u := server.URL + "/chains/ee.chain"
+
+	const callers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			certs, err := GetX5U(x5u)
+			if err == nil && len(certs) != 3 {
+				err = fmt.Errorf("expected 3 certificates, got %d", len(certs))
+			}
+			errs <- err
+		}()
+	}
+	// wait for all callers to join the download in flight
+	for i := 0; ; i++ {
+		if i > 100 {
+			t.Fatal("timed out waiting for the callers to join the download")
+		}
+		x5uCallsMu.Lock()
+		call := x5uCalls[x5u]
+		joined := call != nil && call.waiters == callers
+		x5uCallsMu.Unlock()
+		if joined {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if downloads != 1 {
+		t.Fatalf("expected a single download of the x5u, got %d", downloads)
+	}
+
+	// a caller that gives up doesn't wait for the download, which
+	// is canceled when no one else waits for it
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	defer close(stalled)
+	_, err = GetX5UContext(ctx, server.URL+"/chains/stalled.chain")
+	if errors.Cause(err) != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+	x5uCallsMu.Lock()
+	defer x5uCallsMu.Unlock()
+	if _, ok := x5uCalls[server.URL+"/chains/stalled.chain"]; ok {
+		t.Fatal("expected the abandoned download to be removed")
+	}
+}
+
+func TestReadX5U(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	chainPath := strings.TrimPrefix(s.Config().X5U, "file://")
+	chain, err := ioutil.ReadFile(chainPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a fake S3 endpoint serving the chain to signed requests
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Authorization"), "Credential=AKIDTEST/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodGet || r.URL.Path != "/chains-bucket/chains/ee.chain" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(chain)
+	}))
+	defer server.Close()
+	defaultS3Config := x5uS3Config
+	defer func() { x5uS3Config = defaultS3Config }()
+	x5uS3Config = aws.NewConfig().
+		WithEndpoint(server.URL).
+		WithS3ForcePathStyle(true).
+		WithRegion("us-west-2").
+		WithCredentials(credentials.NewStaticCredentials("AKIDTEST", "secret", ""))
+
+	certs, err := GetX5U("s3://chains-bucket/chains/ee.chain")
+	if err != nil {
+		t.Fatalf("failed to get s3 x5u: %v", err)
+	}
+	if len(certs) != 3 {
+		t.Fatalf("expected 3 certificates, got %d", len(certs))
+	}
+	body, err := ReadX5U(context.Background(), "file://"+chainPath)
+	if err != nil || string(body) != string(chain) {
+		t.Fatalf("failed to read file x5u: %v", err)
+	}
+
+	for _, testcase := range []struct {
+		x5u, err string
+	}{
+		{"s3://chains-bucket/chains/missing.chain", "failed to retrieve x5u from s3://chains-bucket/chains/missing.chain"},
+		{"s3://chains-bucket", "must have a bucket and a key"},
+		{"ftp://example.net/chain.pem", "unsupported x5u scheme \"ftp\""},
+	} {
+		_, err = ReadX5U(context.Background(), testcase.x5u)
+		if err == nil || !strings.Contains(err.Error(), testcase.err) {
+			t.Fatalf("expected reading %q to fail with %q, got %v", testcase.x5u, testcase.err, err)
+		}
+	}
+}
+
+func TestX5UTemplate(t *testing.T) {
+	cfg := PASSINGTESTCASES[0].cfg
+	cfg.X5U = "https://unused.example.net/"
+	cfg.X5UTemplate = "file:///tmp/autograph_unit_tests/chains/{{.ChainName}}"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if !strings.HasPrefix(s.Config().X5U, "file:///tmp/autograph_unit_tests/chains/testsigner0.content-signature.mozilla.org-") {
+		t.Fatalf("expected x5u to be made from the template, got %q", s.Config().X5U)
+	}
+
+	s.x5uTemplate, err = template.New("x5u").Parse("https://cdn.example.net/{{.SignerID}}/{{.ChainName}}?cachebust=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x5u, err := s.makeX5U("foo.chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x5u != "https://cdn.example.net/testsigner0/foo.chain?cachebust=1" {
+		t.Fatalf("unexpected x5u %q", x5u)
+	}
+
+	cfg.X5UTemplate = "https://cdn.example.net/{{.ChainName"
+	_, err = New(cfg)
+	if err == nil || !strings.Contains(err.Error(), "failed to parse x5u template") {
+		t.Fatalf("expected invalid x5u template to fail, got: %v", err)
+	}
+}
+
+func TestNameTemplates(t *testing.T) {
+	cfg := PASSINGTESTCASES[0].cfg
+	cfg.EELabelTemplate = "cs-{{.SignerID}}-{{.Random}}"
+	cfg.ChainNameTemplate = `{{.Now.Format "2006"}}/{{.SignerID}}-{{.Serial}}.chain`
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if !regexp.MustCompile(`^cs-testsigner0-[0-9a-f]{16}$`).MatchString(s.currentEE().label) {
+		t.Fatalf("expected end-entity label to be made from the template, got %q", s.currentEE().label)
+	}
+	expectedPrefix := fmt.Sprintf("file:///tmp/autograph_unit_tests/chains/%d/testsigner0-", time.Now().UTC().Year())
+	if !strings.HasPrefix(s.Config().X5U, expectedPrefix) {
+		t.Fatalf("expected x5u to start with %q, got %q", expectedPrefix, s.Config().X5U)
+	}
+
+	for _, invalid := range []string{"", "../{{.SignerID}}", "/{{.SignerID}}", "{{.SignerID}} {{.Random}}", "{{.Missing}}"} {
+		tpl, err := parseNameTemplate("chain name", invalid, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, err := executeNameTemplate(tpl, nameTemplateData{SignerID: "foo"}, rand.Reader)
+		if err == nil {
+			t.Fatalf("expected template %q to fail but it returned %q", invalid, name)
+		}
+	}
+}
+
+func TestS3UploadInput(t *testing.T) {
+	target, _ := url.Parse("s3://chains-bucket/signer/")
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	input := s3UploadInput("chain", "ee.chain", target, signer.ChainUploadConfig{}, now)
+	if *input.Bucket != "chains-bucket" || *input.Key != "/signer/ee.chain" || *input.ACL != "public-read" {
+		t.Fatalf("unexpected default upload to %q %q with ACL %v", *input.Bucket, *input.Key, input.ACL)
+	}
+	if input.ServerSideEncryption != nil || input.StorageClass != nil || input.ObjectLockMode != nil || input.ContentMD5 != nil {
+		t.Fatal("expected default upload without encryption, storage class or object lock")
+	}
+
+	input = s3UploadInput("chain", "ee.chain", target, signer.ChainUploadConfig{
+		ACL:                 "none",
+		SSEKMSKeyID:         "arn:aws:kms:us-west-2:111122223333:key/1234abcd",
+		StorageClass:        "STANDARD_IA",
+		ObjectLockMode:      "COMPLIANCE",
+		ObjectLockRetention: 24 * time.Hour,
+		ObjectLockLegalHold: true,
+	}, now)
+	if input.ACL != nil {
+		t.Fatalf("expected upload without ACL, got %q", *input.ACL)
+	}
+	if *input.ServerSideEncryption != "aws:kms" || *input.SSEKMSKeyId != "arn:aws:kms:us-west-2:111122223333:key/1234abcd" {
+		t.Fatalf("expected KMS encryption, got %q with key %q", *input.ServerSideEncryption, *input.SSEKMSKeyId)
+	}
+	if *input.StorageClass != "STANDARD_IA" {
+		t.Fatalf("expected storage class STANDARD_IA, got %q", *input.StorageClass)
+	}
+	if *input.ObjectLockMode != "COMPLIANCE" || !input.ObjectLockRetainUntilDate.Equal(now.Add(24*time.Hour)) || *input.ObjectLockLegalHoldStatus != "ON" {
+		t.Fatalf("unexpected object lock %q until %s with legal hold %q",
+			*input.ObjectLockMode, input.ObjectLockRetainUntilDate, *input.ObjectLockLegalHoldStatus)
+	}
+	// md5 of "chain"
+	if *input.ContentMD5 != "mVERL43SsOUll8Jxl/ESHA==" {
+		t.Fatalf("unexpected content md5 %q", *input.ContentMD5)
+	}
+}
+
+func TestUploadToHTTPS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpsupload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a client certificate the upload endpoint requires
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "autograph"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientCertDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, clientKey.Public(), clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, _ := x509.ParseCertificate(clientCertDER)
+	clientKeyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	var uploaded []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.Header.Get("Authorization") != "Bearer s3cr3t" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		uploaded = append(uploaded, r.URL.Path+" "+string(body))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	tokenFile := filepath.Join(dir, "token")
+	err = ioutil.WriteFile(tokenFile, []byte("s3cr3t\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := signer.ChainUploadConfig{
+		BearerTokenFile: tokenFile,
+		CACert:          writePEM("ca.pem", "CERTIFICATE", server.Certificate().Raw),
+		ClientCert:      writePEM("client.pem", "CERTIFICATE", clientCertDER),
+		ClientKey:       writePEM("client.key", "EC PRIVATE KEY", clientKeyDER),
+	}
+	err = uploadToHTTPS(context.Background(), "chain", server.URL+"/chains/ee.chain", conf)
+	if err != nil {
+		t.Fatalf("failed to upload chain: %v", err)
+	}
+	if len(uploaded) != 1 || uploaded[0] != "/chains/ee.chain chain" {
+		t.Fatalf("unexpected uploads %q", uploaded)
+	}
+
+	// the endpoint refuses uploads without the token
+	err = ioutil.WriteFile(tokenFile, []byte("wrong"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = uploadToHTTPS(context.Background(), "chain", server.URL+"/chains/ee.chain", conf)
+	if err == nil || !strings.Contains(err.Error(), "403 Forbidden") {
+		t.Fatalf("expected upload with a wrong token to fail, got: %v", err)
+	}
+
+	// and the TLS handshake fails without the client certificate
+	conf.ClientCert, conf.ClientKey = "", ""
+	err = uploadToHTTPS(context.Background(), "chain", server.URL+"/chains/ee.chain", conf)
+	if err == nil {
+		t.Fatal("expected upload without client certificate to fail")
+	}
+}
+
+func TestWriteLocalFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localchains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target, err := url.Parse("file://" + dir + "/chains/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := strings.Repeat("-----BEGIN CERTIFICATE-----\n", 1000)
+	dest := filepath.Join(dir, "chains", "2024", "test.chain")
+
+	// readers of the published chain never see a partial write
+	done := make(chan struct{})
+	partial := make(chan string, 1)
+	go func() {
+		for {
+			select {
+			case <-done:
+				close(partial)
+				return
+			default:
+			}
+			data, err := ioutil.ReadFile(dest)
+			if err == nil && len(data) != len(chain) {
+				partial <- string(data)
+				close(partial)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		err = writeLocalFile(chain, "2024/test.chain", target)
+		if err != nil {
+			t.Fatalf("failed to write chain: %v", err)
+		}
+	}
+	close(done)
+	if data, ok := <-partial; ok {
+		t.Fatalf("read a partial chain of %d bytes", len(data))
+	}
+
+	info, err := os.Stat(dest)
+	if err != nil {
+		t.Fatalf("failed to stat chain: %v", err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Fatalf("expected chain mode 0644, got %s", info.Mode().Perm())
+	}
+	files, err := ioutil.ReadDir(filepath.Dir(dest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "test.chain" {
+		t.Fatalf("expected only the chain in its directory, got %d files", len(files))
+	}
+}
+
+func TestCheckX5U(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkx5u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newSigner := func(sub string) *ContentSigner {
+		cfg := PASSINGTESTCASES[0].cfg
+		cfg.ChainUploadLocation = "file://" + dir + "/" + sub + "/"
+		cfg.X5U = cfg.ChainUploadLocation
+		s, err := New(cfg)
+		if err != nil {
+			t.Fatalf("signer initialization failed with: %v", err)
+		}
+		return s
+	}
+	s, other := newSigner("current"), newSigner("other")
+	err = s.CheckX5U(context.Background())
+	if err != nil {
+		t.Fatalf("expected the published chain to be valid, got: %v", err)
+	}
+
+	chainPath := strings.TrimPrefix(s.Config().X5U, "file://")
+	otherChain, err := ioutil.ReadFile(strings.TrimPrefix(other.Config().X5U, "file://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, testcase := range []struct {
+		chain string
+		err   string
+	}{
+		{string(otherChain), "doesn't match the key"},
+		{"not a chain", "failed to find ee certificate in chain"},
+		{string(otherChain[:len(otherChain)/2]), "invalid chain at x5u"},
+	} {
+		err = ioutil.WriteFile(chainPath, []byte(testcase.chain), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.CheckX5U(context.Background())
+		if err == nil || !strings.Contains(err.Error(), testcase.err) {
+			t.Errorf("testcase %d: expected error containing %q, got: %v", i, testcase.err, err)
+		}
+	}
+}
+
+func TestVerifyEEKey(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	current := s.currentEE()
+	err = s.verifyEEKey(current)
+	if err != nil {
+		t.Fatalf("expected the key of the end-entity to match its certificate, got: %v", err)
+	}
+
+	// a handle that resolves to another key
+	otherPriv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, err := encodePublicKey(otherPriv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := *current
+	other.priv, other.pub, other.publicKey = otherPriv, otherPriv.Public(), otherPub
+	err = s.verifyEEKey(&other)
+	if err == nil || !strings.Contains(err.Error(), "public key of end-entity") {
+		t.Fatalf("expected a public key mismatch, got: %v", err)
+	}
+
+	// a handle whose public key object is stale
+	other.publicKey = current.publicKey
+	err = s.verifyEEKey(&other)
+	if err == nil || !strings.Contains(err.Error(), "private key of end-entity") {
+		t.Fatalf("expected a private key mismatch, got: %v", err)
+	}
+}
+
+func TestValidateChainUpload(t *testing.T) {
+	for i, testcase := range []struct {
+		location string
+		conf     signer.ChainUploadConfig
+		err      string
+	}{
+		{"file:///tmp/chains/", signer.ChainUploadConfig{}, ""},
+		{"s3://bucket/", signer.ChainUploadConfig{ACL: "none", ServerSideEncryption: "AES256", StorageClass: "GLACIER"}, ""},
+		{"s3://bucket/", signer.ChainUploadConfig{SSEKMSKeyID: "alias/chains"}, ""},
+		{"s3://bucket/", signer.ChainUploadConfig{ObjectLockMode: "GOVERNANCE", ObjectLockRetention: time.Hour}, ""},
+		{"file:///tmp/chains/", signer.ChainUploadConfig{StorageClass: "GLACIER"}, "only supported by s3://"},
+		{"s3://bucket/", signer.ChainUploadConfig{ServerSideEncryption: "rot13"}, "unknown chain upload server-side encryption"},
+		{"s3://bucket/", signer.ChainUploadConfig{ServerSideEncryption: "AES256", SSEKMSKeyID: "alias/chains"}, "requires \"aws:kms\""},
+		{"s3://bucket/", signer.ChainUploadConfig{ObjectLockMode: "FOREVER", ObjectLockRetention: time.Hour}, "unknown chain upload object lock mode"},
+		{"s3://bucket/", signer.ChainUploadConfig{ObjectLockMode: "COMPLIANCE"}, "requires a retention"},
+		{"s3://bucket/", signer.ChainUploadConfig{ObjectLockRetention: time.Hour}, "requires an object lock mode"},
+		{"https://artifacts.example.net/chains/", signer.ChainUploadConfig{BearerTokenFile: "/run/secrets/token", CACert: "/etc/ca.pem"}, ""},
+		{"https://artifacts.example.net/chains/", signer.ChainUploadConfig{ClientCert: "/etc/client.pem", ClientKey: "/etc/client.key"}, ""},
+		{"s3://bucket/", signer.ChainUploadConfig{BearerTokenFile: "/run/secrets/token"}, "only supported by https://"},
+		{"https://artifacts.example.net/chains/", signer.ChainUploadConfig{ClientCert: "/etc/client.pem"}, "must be set together"},
+		{"https://artifacts.example.net/chains/", signer.ChainUploadConfig{StorageClass: "GLACIER"}, "only supported by s3://"},
+	} {
+		err := validateChainUpload(testcase.location, testcase.conf)
+		if testcase.err == "" && err != nil {
+			t.Errorf("testcase %d: expected valid chain upload, got: %v", i, err)
+		}
+		if testcase.err != "" && (err == nil || !strings.Contains(err.Error(), testcase.err)) {
+			t.Errorf("testcase %d: expected error containing %q, got: %v", i, testcase.err, err)
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	cfg := PASSINGTESTCASES[1].cfg
+	// rotations made within the same second need distinct labels
+	// and chain names
+	cfg.EELabelTemplate = "{{.SignerID}}-{{.Random}}"
+	cfg.ChainNameTemplate = "{{.CommonName}}-{{.Serial}}.chain"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	initial := s.Config()
+
+	// sign concurrently with rotations, and check every signature
+	// verifies with the chain of its own x5u
+	input := []byte("foobarbaz1234abcd")
+	stop := make(chan struct{})
+	sigs := make(chan *ContentSignature, 1000)
+	var signers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		signers.Add(1)
+		go func() {
+			defer signers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				sig, err := s.SignData(input, nil)
+				if err != nil {
+					t.Errorf("failed to sign data: %v", err)
+					return
+				}
+				select {
+				case sigs <- sig.(*ContentSignature):
+				default:
+				}
+			}
+		}()
+	}
+	var rotations sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		rotations.Add(1)
+		go func() {
+			defer rotations.Done()
+			err := s.Rotate(context.Background())
+			if err != nil {
+				t.Errorf("rotation failed: %v", err)
+			}
+		}()
+	}
+	rotations.Wait()
+	close(stop)
+	signers.Wait()
+	close(sigs)
+
+	rotated := s.Config()
+	if rotated.X5U == initial.X5U || rotated.PublicKey == initial.PublicKey || rotated.PublicKey == "" {
+		t.Fatalf("expected the x5u and public key to change after rotation, got %q and %q", rotated.X5U, rotated.PublicKey)
+	}
+	x5us := map[string]bool{}
+	for sig := range sigs {
+		x5us[sig.X5U] = true
+		certs, err := GetX5U(sig.X5U)
+		if err != nil {
+			t.Fatalf("failed to get X5U %q: %v", sig.X5U, err)
+		}
+		if !sig.VerifyData(input, certs[0].PublicKey.(*ecdsa.PublicKey)) {
+			t.Fatalf("signature does not verify with the chain of its x5u %q", sig.X5U)
+		}
+	}
+	if len(x5us) == 0 {
+		t.Fatal("expected signatures made during rotations")
+	}
+
+	// a signature after the rotation uses the new end-entity
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.(*ContentSignature).X5U != rotated.X5U {
+		t.Fatalf("expected the signature to use the rotated x5u %q, got %q", rotated.X5U, sig.(*ContentSignature).X5U)
+	}
+}
+
 var PASSINGTESTCASES = []struct {
 	cfg signer.Configuration
 }{
@@ -174,6 +813,349 @@ mpvOMOT3falDgXh0iOgdIA==
 	}},
 }
 
+func TestRotateIfDue(t *testing.T) {
+	cfg := PASSINGTESTCASES[1].cfg
+	cfg.EELabelTemplate = "{{.SignerID}}-{{.Random}}"
+	cfg.ChainNameTemplate = "{{.CommonName}}-{{.Serial}}.chain"
+	cfg.Validity = 24 * time.Hour
+	cfg.ClockSkewTolerance = time.Hour
+
+	for i, testcase := range []struct {
+		interval, overlap time.Duration
+		err               string
+	}{
+		{-time.Hour, 0, "must be positive"},
+		{0, time.Hour, "requires a rotation interval"},
+		{time.Hour, 25 * time.Hour, "must be shorter than the 25h0m0s lifetime"},
+	} {
+		invalid := cfg
+		invalid.RotationInterval, invalid.RotationOverlap = testcase.interval, testcase.overlap
+		_, err := New(invalid)
+		if err == nil || !strings.Contains(err.Error(), testcase.err) {
+			t.Fatalf("testcase %d: expected %q, got %v", i, testcase.err, err)
+		}
+	}
+
+	// signers without a rotation interval never rotate on schedule
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if !s.RotationDue().IsZero() {
+		t.Fatalf("expected no scheduled rotation, got %s", s.RotationDue())
+	}
+	rotated, err := s.RotateIfDue(context.Background())
+	if err != nil || rotated {
+		t.Fatalf("expected no rotation, got %t and %v", rotated, err)
+	}
+
+	cfg.RotationInterval = 12 * time.Hour
+	s, err = New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if s.Config().RotationOverlap != 6*time.Hour {
+		t.Fatalf("expected the overlap to default to a quarter of the validity, got %s", s.Config().RotationOverlap)
+	}
+	due := s.RotationDue().Sub(time.Now())
+	if due < 11*time.Hour || due > 12*time.Hour {
+		t.Fatalf("expected the rotation to be due in 12h, got %s", due)
+	}
+	rotated, err = s.RotateIfDue(context.Background())
+	if err != nil || rotated {
+		t.Fatalf("expected no rotation before it is due, got %t and %v", rotated, err)
+	}
+
+	// the overlap makes the rotation due before the certificate
+	// expires when it comes before the interval
+	cfg.RotationInterval = 48 * time.Hour
+	cfg.RotationOverlap = 20 * time.Hour
+	s, err = New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	due = s.RotationDue().Sub(time.Now())
+	if due < 4*time.Hour || due > 5*time.Hour {
+		t.Fatalf("expected the rotation to be due 20h before the certificate expires in 25h, got %s", due)
+	}
+	initial := s.Config()
+	s.now = func() time.Time { return time.Now().Add(5 * time.Hour) }
+	rotated, err = s.RotateIfDue(context.Background())
+	if err != nil || !rotated {
+		t.Fatalf("expected a rotation once it is due, got %t and %v", rotated, err)
+	}
+	if s.Config().X5U == initial.X5U || s.Config().PublicKey == initial.PublicKey {
+		t.Fatal("expected the x5u and public key to change after the rotation")
+	}
+	s.now = time.Now
+	rotated, err = s.RotateIfDue(context.Background())
+	if err != nil || rotated {
+		t.Fatalf("expected the new end-entity not to be due, got %t and %v", rotated, err)
+	}
+	// signatures are made with the new end-entity
+	sig, err := s.SignData([]byte("foobarbaz1234abcd"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Verify(s.Config().X5U, sigstr, []byte("foobarbaz1234abcd"))
+	if err != nil {
+		t.Fatalf("failed to verify signature of the rotated end-entity: %v", err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	cfg := PASSINGTESTCASES[1].cfg
+	cfg.EELabelTemplate = "{{.SignerID}}-{{.Random}}"
+	cfg.ChainNameTemplate = "{{.CommonName}}-{{.Serial}}.chain"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	_, _, err = s.Rollback(context.Background())
+	if errors.Cause(err) != database.ErrNoPreviousEE {
+		t.Fatalf("expected rollback without rotation to fail with ErrNoPreviousEE, got %v", err)
+	}
+	initialLabel, initialX5U := s.currentEE().label, s.Config().X5U
+	initialEE := s.CertificateChain()[0]
+	err = s.Rotate(context.Background())
+	if err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	if s.currentEE().label == initialLabel {
+		t.Fatal("expected rotation to change the end-entity")
+	}
+	if s.CertificateChain()[0].Equal(initialEE) {
+		t.Fatal("expected rotation to change the certificate chain")
+	}
+	label, x5u, err := s.Rollback(context.Background())
+	if err != nil {
+		t.Fatalf("failed to roll back: %v", err)
+	}
+	if label != initialLabel || x5u != initialX5U || s.Config().X5U != initialX5U {
+		t.Fatalf("expected rollback to %q with x5u %q, got %q with x5u %q", initialLabel, initialX5U, label, x5u)
+	}
+	if !s.CertificateChain()[0].Equal(initialEE) {
+		t.Fatal("expected rollback to restore the certificate chain")
+	}
+	sig, err := s.SignData([]byte("foobarbaz1234abcd"), nil)
+	if err != nil {
+		t.Fatalf("failed to sign after rollback: %v", err)
+	}
+	if sig.(*ContentSignature).X5U != initialX5U {
+		t.Fatalf("expected signature with x5u %q, got %q", initialX5U, sig.(*ContentSignature).X5U)
+	}
+	_, _, err = s.Rollback(context.Background())
+	if errors.Cause(err) != database.ErrNoPreviousEE {
+		t.Fatalf("expected a second rollback to fail with ErrNoPreviousEE, got %v", err)
+	}
+}
+
+func TestReverify(t *testing.T) {
+	cfg := PASSINGTESTCASES[1].cfg
+	cfg.EELabelTemplate = "{{.SignerID}}-{{.Random}}"
+	cfg.ChainNameTemplate = "{{.CommonName}}-{{.Serial}}.chain"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	verified, err := s.Reverify(context.Background(), 10)
+	if err != nil || verified != 1 {
+		t.Fatalf("expected the probe signature to verify without signatures to sample, got %d: %v", verified, err)
+	}
+	for i := 0; i < recentSignaturesSize+5; i++ {
+		_, err = s.SignData([]byte(fmt.Sprintf("foobarbaz1234abcd%d", i)), nil)
+		if err != nil {
+			t.Fatalf("failed to sign: %v", err)
+		}
+	}
+	latest := s.recent.latest(recentSignaturesSize + 10)
+	_, newest := MakeTemplatedHash([]byte(fmt.Sprintf("foobarbaz1234abcd%d", recentSignaturesSize+4)), s.Mode)
+	if len(latest) != recentSignaturesSize || string(latest[0].signed) != string(newest) {
+		t.Fatalf("expected the %d newest signatures, newest first, got %d", recentSignaturesSize, len(latest))
+	}
+	initialX5U := s.Config().X5U
+
+	err = s.Rotate(context.Background())
+	if err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	verified, err = s.Reverify(context.Background(), 10)
+	if err != nil || verified != 11 {
+		t.Fatalf("expected 10 signatures of the previous end-entity and the probe to verify, got %d: %v", verified, err)
+	}
+
+	// overwriting the chain of the previous end-entity breaks the
+	// verification of the signatures issued with it
+	chainPath, err := url.Parse(initialX5U)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotatedChain, err := ioutil.ReadFile(strings.TrimPrefix(s.Config().X5U, "file://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(chainPath.Path, rotatedChain, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified, err = s.Reverify(context.Background(), 10)
+	if err == nil || verified != 1 || !strings.Contains(err.Error(), "10 of 11 signatures failed re-verification") {
+		t.Fatalf("expected the signatures of the overwritten chain to fail, got %d: %v", verified, err)
+	}
+}
+
+func TestSignEd25519(t *testing.T) {
+	cfg := PASSINGTESTCASES[0].cfg
+	cfg.ID = "testsignered25519"
+	cfg.Mode = Ed25519
+	cfg.EELabelTemplate = "{{.SignerID}}-{{.Random}}"
+	cfg.ChainNameTemplate = "{{.CommonName}}-{{.Serial}}.chain"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if s.Mode != Ed25519 || s.Config().Mode != Ed25519 {
+		t.Fatalf("expected signer mode %q, got %q", Ed25519, s.Mode)
+	}
+	input := []byte("foobarbaz1234abcd")
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	err = Verify(s.Config().X5U, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature: %v", err)
+	}
+	err = Verify(s.Config().X5U, sigstr, []byte("foobarbaz1234abce"))
+	if err == nil || err.Error() != "ed25519 signature verification failed" {
+		t.Fatalf("expected the signature of other data to fail verification, got %v", err)
+	}
+
+	// the signature parses as a p256ecdsa one unless its mode is given
+	cs, err := UnmarshalMode(sigstr, Ed25519)
+	if err != nil {
+		t.Fatalf("failed to unmarshal signature: %v", err)
+	}
+	if cs.Mode != Ed25519 || cs.Len != Ed25519BYTESIZE || cs.HashName != "sha512" {
+		t.Fatalf("unexpected unmarshalled signature %s", cs)
+	}
+	sigstr2, err := cs.Marshal()
+	if err != nil || sigstr2 != sigstr {
+		t.Fatalf("marshalling signature changed its format, expected %q, got %q: %v", sigstr, sigstr2, err)
+	}
+	_, err = UnmarshalMode(sigstr, P384ECDSA)
+	if err == nil {
+		t.Fatal("expected an ed25519 signature to fail to unmarshal as a p384ecdsa one")
+	}
+	enc, err := cs.WebCrypto()
+	if err != nil {
+		t.Fatalf("failed to encode signature for webcrypto: %v", err)
+	}
+	pub := s.CertificateChain()[0].PublicKey.(ed25519.PublicKey)
+	if enc.Algorithm.Name != "Ed25519" || !ed25519.Verify(pub, append(enc.DataPrefix, input...), enc.Signature) {
+		t.Fatalf("webcrypto encoding does not verify with algorithm %+v", enc.Algorithm)
+	}
+
+	_, err = s.SignHash(make([]byte, 48), nil)
+	if errors.Cause(err) != signer.ErrInvalidHashLength {
+		t.Fatalf("expected ed25519 signer to refuse to sign a hash, got %v", err)
+	}
+
+	err = s.Rotate(context.Background())
+	if err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	verified, err := s.Reverify(context.Background(), 10)
+	if err != nil || verified != 2 {
+		t.Fatalf("expected the signature of the previous end-entity and the probe to verify, got %d: %v", verified, err)
+	}
+
+	// with a database, the signer needs the lock of its single
+	// instance, which an unreachable database can't give
+	unreachable, err := sql.Open("postgres", "postgres://autograph@127.0.0.1:1/autograph?sslmode=disable&connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unreachable.Close()
+	dbConf := cfg
+	dbConf.DB = &database.Handler{DB: unreachable}
+	_, err = New(dbConf)
+	if err == nil || !strings.Contains(err.Error(), "runs on a single instance") {
+		t.Fatalf("expected an ed25519 signer without its instance lock to be refused, got %v", err)
+	}
+	deterministicConf := cfg
+	deterministicConf.DeterministicECDSA = true
+	_, err = New(deterministicConf)
+	if err == nil || !strings.Contains(err.Error(), "deterministicecdsa doesn't apply") {
+		t.Fatalf("expected an ed25519 signer with deterministicecdsa to be refused, got %v", err)
+	}
+
+	cfg.Mode = "rsa"
+	_, err = New(cfg)
+	if err == nil || !strings.Contains(err.Error(), `invalid mode "rsa"`) {
+		t.Fatalf("expected an unknown mode to be refused, got %v", err)
+	}
+}
+
+func TestValidateChain(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	certs, err := GetX5U(s.Config().X5U)
+	if err != nil {
+		t.Fatalf("failed to get X5U %q: %v", s.Config().X5U, err)
+	}
+	valid := chainConstraints{
+		Hostname: s.ID + CSNameSpace,
+		Now:      time.Now(),
+		Validity: s.validity,
+	}
+	err = validateChain(certs, valid)
+	if err != nil {
+		t.Fatalf("expected chain to be valid but got %v", err)
+	}
+
+	wrongHost := valid
+	wrongHost.Hostname = "other" + CSNameSpace
+	skewed := valid
+	skewed.ClockSkewTolerance = 100 * 24 * time.Hour
+	for _, testcase := range []struct {
+		name        string
+		certs       []*x509.Certificate
+		constraints chainConstraints
+		err         string
+	}{
+		{"wrong order", []*x509.Certificate{certs[1], certs[0], certs[2]}, valid, "is not issued by the next certificate"},
+		{"missing root", certs[:2], valid, "chain has 2 certificates"},
+		{"wrong hostname", certs, wrongHost, "does not match hostname"},
+		{"clock skew", certs, skewed, "is not valid for clients with a clock 2400h0m0s late"},
+	} {
+		err := validateChain(testcase.certs, testcase.constraints)
+		if errors.Cause(err) != ErrInvalidChain || !strings.Contains(err.Error(), testcase.err) {
+			t.Errorf("%s: expected ErrInvalidChain with %q but got %v", testcase.name, testcase.err, err)
+		}
+	}
+}
+
+func TestNewRefusesInvalidChain(t *testing.T) {
+	cfg := PASSINGTESTCASES[0].cfg
+	cfg.ClockSkewTolerance = time.Hour
+	cfg.NotBeforeBackdate = time.Minute
+	_, err := New(cfg)
+	if err == nil || !strings.Contains(err.Error(), "not valid for clients with a clock 1h0m0s late") {
+		t.Fatalf("expected a chain backdated less than the clock skew tolerance to be refused, got %v", err)
+	}
+}
+
 func TestNewFailure(t *testing.T) {
 	TESTCASES := []struct {
 		err string
@@ -253,7 +1235,7 @@ func TestNoShortData(t *testing.T) {
 	if err == nil {
 		t.Fatal("expected to fail with input data too short but succeeded")
 	}
-	if err.Error() != `contentsignaturepki "testsigner0": refusing to sign input data shorter than 10 bytes` {
+	if err.Error() != `contentsignaturepki "testsigner0": refusing to sign input data shorter than 10 bytes: input is too short` {
 		t.Fatalf("expected to fail with input data too short but failed with: %v", err)
 	}
 }
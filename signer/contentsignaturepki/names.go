@@ -0,0 +1,79 @@
+package contentsignaturepki
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultEELabelTemplate is the template of end-entity labels
+	// when a signer does not configure one
+	DefaultEELabelTemplate = `{{.SignerID}}-{{.Now.Format "20060102150405"}}`
+
+	// DefaultChainNameTemplate is the template of chain names when
+	// a signer does not configure one
+	DefaultChainNameTemplate = `{{.CommonName}}-{{.NotAfter.Format "2006-01-02-15-04-05"}}.chain`
+)
+
+// nameTemplateData is passed to end-entity label and chain name
+// templates. NotBefore, NotAfter and Serial are only set for chain
+// names, since labels are made before the certificate is issued.
+type nameTemplateData struct {
+	SignerID   string
+	CommonName string
+	Now        time.Time
+	NotBefore  time.Time
+	NotAfter   time.Time
+	// Serial is the hex serial number of the end-entity certificate
+	Serial string
+	// Random is 16 random hex characters
+	Random string
+}
+
+// parseNameTemplate parses a label or chain name template, or the
+// default template when text is empty
+func parseNameTemplate(name, text, defaultText string) (*template.Template, error) {
+	if text == "" {
+		text = defaultText
+	}
+	tpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s template", name)
+	}
+	return tpl, nil
+}
+
+// executeNameTemplate returns a label or chain name made from a
+// template. Names cannot be empty, contain whitespace or backslashes,
+// start with a slash or contain ".." path segments.
+func executeNameTemplate(tpl *template.Template, data nameTemplateData, rand io.Reader) (string, error) {
+	random := make([]byte, 8)
+	_, err := io.ReadFull(rand, random)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read random bytes")
+	}
+	data.Random = hex.EncodeToString(random)
+	data.Now = time.Now().UTC()
+
+	var out bytes.Buffer
+	err = tpl.Execute(&out, data)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to execute %s template", tpl.Name())
+	}
+	name := out.String()
+	if name == "" || strings.ContainsAny(name, " \t\r\n\\") || strings.HasPrefix(name, "/") {
+		return "", errors.Errorf("invalid %s %q", tpl.Name(), name)
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", errors.Errorf("invalid %s %q", tpl.Name(), name)
+		}
+	}
+	return name, nil
+}
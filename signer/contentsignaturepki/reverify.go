@@ -0,0 +1,123 @@
+package contentsignaturepki // import "go.mozilla.org/autograph/signer/contentsignaturepki"
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	// recentSignaturesSize is the number of latest signatures a
+	// signer keeps to re-verify them after its end-entity changes
+	recentSignaturesSize = 64
+
+	// reverifyProbe is the data of the signature of the current
+	// end-entity that is verified with the other samples
+	reverifyProbe = "AUTOGRAPH END-ENTITY REVERIFICATION"
+
+	// maxRecentMessageSize is the size of the largest templated
+	// input an Ed25519 signer keeps with its latest signatures,
+	// which are made on the input rather than its hash
+	maxRecentMessageSize = 64 * 1024
+)
+
+// recentSignature is a signature the signer issued, with the templated
+// hash it covers, or the templated input for Ed25519 signatures
+type recentSignature struct {
+	signed []byte
+	sig    ContentSignature
+}
+
+// recentSignatures is a ring of the latest signatures of a signer. The
+// zero value is empty and ready to use.
+type recentSignatures struct {
+	sync.Mutex
+	sigs []recentSignature
+	next int
+}
+
+// add records a signature of signed, replacing the oldest one when the
+// ring is full
+func (r *recentSignatures) add(signed []byte, sig *ContentSignature) {
+	rs := recentSignature{signed: append([]byte(nil), signed...), sig: *sig}
+	r.Lock()
+	defer r.Unlock()
+	if len(r.sigs) < recentSignaturesSize {
+		r.sigs = append(r.sigs, rs)
+		return
+	}
+	r.sigs[r.next] = rs
+	r.next = (r.next + 1) % recentSignaturesSize
+}
+
+// latest returns up to n of the latest signatures, newest first
+func (r *recentSignatures) latest(n int) []recentSignature {
+	r.Lock()
+	defer r.Unlock()
+	if n > len(r.sigs) {
+		n = len(r.sigs)
+	}
+	out := make([]recentSignature, 0, n)
+	for i := 0; i < n; i++ {
+		// the newest signature is just before next, wrapping
+		// around the end of a full ring
+		j := (r.next - 1 - i + 2*len(r.sigs)) % len(r.sigs)
+		out = append(out, r.sigs[j])
+	}
+	return out
+}
+
+// Reverify downloads the chains of the latest sample signatures of the
+// signer from their x5u again and verifies the signatures with them,
+// along with a new signature of the current end-entity, to confirm a
+// rotation, rollback or sync of the end-entity didn't break the
+// verification of signatures issued before or after it. It returns the
+// number of verified signatures, and an error listing those that failed.
+func (s *ContentSigner) Reverify(ctx context.Context, sample int) (verified int, err error) {
+	samples := s.recent.latest(sample)
+	ee := s.currentEE()
+	signed := s.toSign([]byte(reverifyProbe))
+	probe, err := s.sign(ee, signed)
+	if err != nil {
+		return 0, err
+	}
+	samples = append(samples, recentSignature{signed: signed, sig: *probe})
+
+	var (
+		chains   = make(map[string]crypto.PublicKey)
+		failures []string
+	)
+	for _, rs := range samples {
+		pub, ok := chains[rs.sig.X5U]
+		if !ok {
+			certs, err := GetX5UContext(ctx, rs.sig.X5U)
+			if err != nil {
+				failures = append(failures, err.Error())
+				continue
+			}
+			pub = certs[0].PublicKey
+			switch pub.(type) {
+			case *ecdsa.PublicKey, ed25519.PublicKey:
+			default:
+				failures = append(failures, errors.Errorf("end-entity at x5u %q has a %T public key, not ecdsa or ed25519", rs.sig.X5U, pub).Error())
+				continue
+			}
+			chains[rs.sig.X5U] = pub
+		}
+		if !rs.sig.verifySigned(rs.signed, pub) {
+			failures = append(failures, errors.Errorf("signature does not verify with the end-entity at x5u %q", rs.sig.X5U).Error())
+			continue
+		}
+		verified++
+	}
+	if len(failures) > 0 {
+		return verified, errors.Errorf("contentsignaturepki %q: %d of %d signatures failed re-verification: %s",
+			s.ID, len(failures), len(samples), strings.Join(failures, "; "))
+	}
+	return verified, nil
+}
@@ -0,0 +1,104 @@
+package contentsignaturepki // import "go.mozilla.org/autograph/signer/contentsignaturepki"
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxDefaultRotationOverlap caps the default rotation overlap of
+// signers with long validities
+const maxDefaultRotationOverlap = 24 * time.Hour
+
+// validateRotation checks the rotation schedule of the signer, and
+// defaults its overlap to a quarter of the validity, at most a day
+func (s *ContentSigner) validateRotation() error {
+	if s.rotationInterval < 0 || s.rotationOverlap < 0 {
+		return errors.New("rotation interval and overlap must be positive")
+	}
+	if s.rotationInterval == 0 {
+		if s.rotationOverlap > 0 {
+			return errors.New("rotation overlap requires a rotation interval")
+		}
+		return nil
+	}
+	if s.rotationOverlap == 0 {
+		s.rotationOverlap = s.validity / 4
+		if s.rotationOverlap > maxDefaultRotationOverlap {
+			s.rotationOverlap = maxDefaultRotationOverlap
+		}
+	}
+	if s.rotationOverlap >= s.validity+s.notAfterMargin {
+		return errors.Errorf("rotation overlap of %s must be shorter than the %s lifetime of end-entities",
+			s.rotationOverlap, s.validity+s.notAfterMargin)
+	}
+	return nil
+}
+
+// RotationDue returns when the current end-entity is due for a
+// scheduled rotation: once it is RotationInterval old, or
+// RotationOverlap before its certificate expires, whichever comes
+// first. It returns the zero time when scheduled rotations are
+// disabled.
+func (s *ContentSigner) RotationDue() time.Time {
+	if s.rotationInterval == 0 {
+		return time.Time{}
+	}
+	return s.rotationDue(s.currentEE())
+}
+
+// rotationDue returns when an end-entity is due for a scheduled
+// rotation
+func (s *ContentSigner) rotationDue(ee *endEntity) time.Time {
+	cert := ee.chain[0]
+	due := cert.NotBefore.Add(s.notBeforeBackdate + s.rotationInterval)
+	if expiry := cert.NotAfter.Add(-s.rotationOverlap); expiry.Before(due) {
+		due = expiry
+	}
+	return due
+}
+
+// RotateIfDue rotates the end-entity when it is due for a scheduled
+// rotation, and returns whether the end-entity changed. The new
+// end-entity is made and its chain uploaded and verified before it is
+// swapped in, while the certificate of the current one is still valid.
+//
+// Under the end-entity lock of the database, the signer switches to an
+// end-entity another instance rotated to in the meantime instead of
+// making one, so the instances sharing a database rotate once.
+func (s *ContentSigner) RotateIfDue(ctx context.Context) (rotated bool, err error) {
+	if s.rotationInterval == 0 {
+		return false, nil
+	}
+	s.rotateMu.Lock()
+	defer s.rotateMu.Unlock()
+	current := s.currentEE()
+	due := s.rotationDue(current)
+	if s.now().Before(due) {
+		return false, nil
+	}
+	ee, err := s.createEE(ctx, func(found *endEntity) bool {
+		return found.label != current.label
+	})
+	if err != nil {
+		return false, err
+	}
+	err = s.keyConf.CheckDeterministicECDSA(ee.priv)
+	if err != nil {
+		return false, errors.Wrapf(err, "contentsignaturepki %q: end-entity %q", s.ID, ee.label)
+	}
+	ee.chain, err = GetX5UContext(ctx, ee.x5u)
+	if err != nil {
+		return false, errors.Wrapf(err, "contentsignaturepki %q: failed to verify x5u", s.ID)
+	}
+	err = s.verifyEEKey(ee)
+	if err != nil {
+		return false, errors.Wrapf(err, "contentsignaturepki %q", s.ID)
+	}
+	s.ee.Store(ee)
+	s.previousEE = current
+	log.Printf("contentsignaturepki %q: rotated end-entity from %q to %q, which was due at %s", s.ID, current.label, ee.label, due.UTC())
+	return true, nil
+}
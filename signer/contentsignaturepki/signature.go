@@ -1,11 +1,15 @@
 package contentsignaturepki // import "go.mozilla.org/autograph/signer/contentsignaturepki"
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"encoding/base64"
 	"fmt"
 	"math/big"
 
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
+
+	"go.mozilla.org/autograph/signer"
 )
 
 // ContentSignature contains the parsed representation of a signature
@@ -17,6 +21,16 @@ type ContentSignature struct {
 	ID       string
 	Len      int
 	Finished bool
+
+	// keyLabel is the label of the end-entity that made the
+	// signature, unset on parsed signatures
+	keyLabel string
+}
+
+// KeyLabel returns the label of the end-entity key that made the
+// signature
+func (sig *ContentSignature) KeyLabel() string {
+	return sig.keyLabel
 }
 
 // a private struct to unmarshal asn1 signatures produced by crypto.Signer
@@ -28,10 +42,27 @@ func (sig *ContentSignature) storeHashName(alg string) {
 	sig.HashName = alg
 }
 
-// VerifyData verifies a signatures on its raw, untemplated, input using a public key
-func (sig *ContentSignature) VerifyData(input []byte, pubKey *ecdsa.PublicKey) bool {
+// VerifyData verifies a signatures on its raw, untemplated, input using
+// an ecdsa or ed25519 public key
+func (sig *ContentSignature) VerifyData(input []byte, pubKey crypto.PublicKey) bool {
+	if _, ok := pubKey.(ed25519.PublicKey); ok {
+		return sig.verifySigned(makeTemplatedInput(input), pubKey)
+	}
 	_, hash := MakeTemplatedHash(input, sig.Mode)
-	return sig.VerifyHash(hash, pubKey)
+	return sig.verifySigned(hash, pubKey)
+}
+
+// verifySigned verifies a signature on what its signer signed: the
+// templated hash with an ecdsa public key, or the templated input
+// with an ed25519 one
+func (sig *ContentSignature) verifySigned(signed []byte, pubKey crypto.PublicKey) bool {
+	switch key := pubKey.(type) {
+	case *ecdsa.PublicKey:
+		return sig.Mode != Ed25519 && sig.VerifyHash(signed, key)
+	case ed25519.PublicKey:
+		return sig.Len == Ed25519BYTESIZE && ed25519.Verify(key, signed, sig.rawRS())
+	}
+	return false
 }
 
 // VerifyHash verifies a signature on its templated hash using a public key
@@ -40,14 +71,22 @@ func (sig *ContentSignature) VerifyHash(hash []byte, pubKey *ecdsa.PublicKey) bo
 }
 
 // Marshal returns the R||S signature is encoded in base64 URL safe,
-// following DL/ECSSA format spec from IEEE Std 1363-2000.
+// following DL/ECSSA format spec from IEEE Std 1363-2000. Ed25519
+// signatures are encoded as is, their R and S halves being stored
+// like those of ecdsa signatures.
 func (sig *ContentSignature) Marshal() (str string, err error) {
 	if !sig.Finished {
 		return "", fmt.Errorf("contentsignature.Marshal: unfinished cannot be encoded")
 	}
-	if sig.Len != P256ECDSABYTESIZE && sig.Len != P384ECDSABYTESIZE {
+	if sig.Len != P256ECDSABYTESIZE && sig.Len != P384ECDSABYTESIZE && sig.Len != Ed25519BYTESIZE {
 		return "", fmt.Errorf("contentsignature.Marshal: invalid signature length %d", sig.Len)
 	}
+	encodedsig := base64.RawURLEncoding.EncodeToString(sig.rawRS())
+	return fmt.Sprintf("%s", encodedsig), nil
+}
+
+// rawRS returns the R||S concatenation of the signature
+func (sig *ContentSignature) rawRS() []byte {
 	// write R and S into a slice of len
 	// both R and S are zero-padded to the left to be exactly
 	// len/2 in length
@@ -58,14 +97,43 @@ func (sig *ContentSignature) Marshal() (str string, err error) {
 	rs := make([]byte, sig.Len)
 	copy(rs[Rstart:Rend], sig.R.Bytes())
 	copy(rs[Sstart:Send], sig.S.Bytes())
-	encodedsig := base64.RawURLEncoding.EncodeToString(rs)
-	return fmt.Sprintf("%s", encodedsig), nil
+	return rs
+}
+
+// WebCrypto returns the R||S signature with the ECDSA or Ed25519
+// parameters the browser WebCrypto API verifies it with, on the data
+// prefixed with the content signature template
+func (sig *ContentSignature) WebCrypto() (*signer.WebCryptoEncoding, error) {
+	if !sig.Finished {
+		return nil, fmt.Errorf("contentsignaturepki.WebCrypto: unfinished cannot be encoded")
+	}
+	alg := signer.WebCryptoAlgorithm{Name: "ECDSA"}
+	switch sig.Mode {
+	case P256ECDSA:
+		alg.NamedCurve, alg.Hash = "P-256", "SHA-256"
+	case P384ECDSA:
+		alg.NamedCurve, alg.Hash = "P-384", "SHA-384"
+	case Ed25519:
+		// the hash is part of the algorithm
+		alg.Name = "Ed25519"
+	default:
+		return nil, fmt.Errorf("contentsignaturepki.WebCrypto: unknown mode %q", sig.Mode)
+	}
+	return &signer.WebCryptoEncoding{
+		Signature:  sig.rawRS(),
+		Algorithm:  alg,
+		DataPrefix: []byte(SignaturePrefix),
+	}, nil
 }
 
 // Unmarshal parses a base64 url encoded content signature
 // and returns it into a ContentSignature structure that can be verified.
 //
 // Note this function does not set the X5U value of a signature.
+//
+// Ed25519 signatures have the length of P256ECDSA ones and parse as
+// such, use UnmarshalMode to parse them with their mode. Either way,
+// VerifyData verifies them with the ed25519 key of their end-entity.
 func Unmarshal(signature string) (sig *ContentSignature, err error) {
 	if len(signature) < 30 {
 		return nil, errors.Errorf("contentsignature: signature cannot be shorter than 30 characters, got %d", len(signature))
@@ -95,6 +163,21 @@ func Unmarshal(signature string) (sig *ContentSignature, err error) {
 	return sig, nil
 }
 
+// UnmarshalMode parses a base64 url encoded content signature of the
+// given mode, like the name of its Content-Signature header parameter
+func UnmarshalMode(signature, mode string) (*ContentSignature, error) {
+	sig, err := Unmarshal(signature)
+	if err != nil {
+		return nil, err
+	}
+	if getSignatureLen(mode) != sig.Len {
+		return nil, errors.Errorf("contentsignature: %d bytes signature is not a valid %q signature", sig.Len, mode)
+	}
+	sig.Mode = mode
+	sig.HashName = getSignatureHash(mode)
+	return sig, nil
+}
+
 func (sig *ContentSignature) String() string {
 	return fmt.Sprintf("ID=%s Mode=%s Len=%d HashName=%s X5U=%s Finished=%t R=%s S=%s",
 		sig.ID, sig.Mode, sig.Len, sig.HashName, sig.X5U, sig.Finished, sig.R.String(), sig.S.String())
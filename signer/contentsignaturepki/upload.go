@@ -1,31 +1,47 @@
 package contentsignaturepki
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/pkg/errors"
+
+	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/autograph/trace"
 )
 
 // upload takes a string and a filename and puts it at the upload location
 // defined in the signer, then returns its URL
-func (s *ContentSigner) upload(data, name string) error {
+func (s *ContentSigner) upload(ctx context.Context, data, name string) error {
 	parsedURL, err := url.Parse(s.chainUploadLocation)
 	if err != nil {
 		return errors.Wrap(err, "failed to parse chain upload location")
 	}
 	switch parsedURL.Scheme {
 	case "s3":
-		return uploadToS3(data, name, parsedURL)
+		return uploadToS3(ctx, data, name, parsedURL, s.ChainUpload)
+	case "https":
+		return uploadToHTTPS(ctx, data, s.chainUploadLocation+name, s.ChainUpload)
 	case "file":
 		return writeLocalFile(data, name, parsedURL)
 	default:
@@ -33,45 +49,321 @@ func (s *ContentSigner) upload(data, name string) error {
 	}
 }
 
-func uploadToS3(data, name string, target *url.URL) error {
+func uploadToS3(ctx context.Context, data, name string, target *url.URL, conf signer.ChainUploadConfig) error {
 	sess := session.Must(session.NewSession())
 	uploader := s3manager.NewUploader(sess)
-	_, err := uploader.Upload(&s3manager.UploadInput{
+	input := s3UploadInput(data, name, target, conf, time.Now())
+	// tag the chain with the request that made it
+	if t, ok := trace.FromContext(ctx); ok {
+		input.Metadata = aws.StringMap(t.Metadata())
+	}
+	_, err := uploader.UploadWithContext(ctx, input)
+	return err
+}
+
+// s3UploadInput returns the S3 upload of a chain with the parameters
+// of the chain upload configuration
+func s3UploadInput(data, name string, target *url.URL, conf signer.ChainUploadConfig, now time.Time) *s3manager.UploadInput {
+	input := &s3manager.UploadInput{
 		Bucket:             aws.String(target.Host),
 		Key:                aws.String(target.Path + name),
-		ACL:                aws.String("public-read"),
+		ACL:                aws.String(s3.ObjectCannedACLPublicRead),
 		Body:               strings.NewReader(data),
 		ContentType:        aws.String("binary/octet-stream"),
 		ContentDisposition: aws.String("attachment"),
-	})
-	return err
+	}
+	switch conf.ACL {
+	case "":
+	case chainUploadNoACL:
+		input.ACL = nil
+	default:
+		input.ACL = aws.String(conf.ACL)
+	}
+	if conf.SSEKMSKeyID != "" {
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		input.SSEKMSKeyId = aws.String(conf.SSEKMSKeyID)
+	}
+	if conf.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(conf.ServerSideEncryption)
+	}
+	if conf.StorageClass != "" {
+		input.StorageClass = aws.String(conf.StorageClass)
+	}
+	if conf.ObjectLockMode != "" {
+		input.ObjectLockMode = aws.String(conf.ObjectLockMode)
+		input.ObjectLockRetainUntilDate = aws.Time(now.Add(conf.ObjectLockRetention).UTC())
+	}
+	if conf.ObjectLockLegalHold {
+		input.ObjectLockLegalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+	if conf.ObjectLockMode != "" || conf.ObjectLockLegalHold {
+		// S3 requires the digest of objects uploaded with an
+		// object lock
+		sum := md5.Sum([]byte(data))
+		input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	return input
 }
 
-func writeLocalFile(data, name string, target *url.URL) error {
-	// upload dir may not exist yet
-	_, err := os.Stat(target.Path)
-	if err != nil {
-		if strings.Contains(err.Error(), "no such file or directory") {
-			// create the target directory
-			err = os.MkdirAll(target.Path, 0755)
-			if err != nil {
-				return errors.Wrap(err, "failed to make directory")
-			}
-		} else {
-			return err
+// chainUploadNoACL is the ACL of chains uploaded without an ACL
+const chainUploadNoACL = "none"
+
+// validateChainUpload checks the parameters of chains uploaded to S3.
+// ACLs and storage classes are left to S3, which knows the current
+// ones.
+func validateChainUpload(location string, conf signer.ChainUploadConfig) error {
+	httpsConf := signer.ChainUploadConfig{
+		BearerTokenFile: conf.BearerTokenFile,
+		CACert:          conf.CACert,
+		ClientCert:      conf.ClientCert,
+		ClientKey:       conf.ClientKey,
+	}
+	if !reflect.DeepEqual(httpsConf, signer.ChainUploadConfig{}) {
+		if !strings.HasPrefix(location, "https://") {
+			return errors.Errorf("chain upload authentication is only supported by https:// upload locations, not %q", location)
+		}
+		if (conf.ClientCert == "") != (conf.ClientKey == "") {
+			return errors.New("chain upload client certificate and key must be set together")
 		}
 	}
-	// write the file into the target dir
-	return ioutil.WriteFile(target.Path+name, []byte(data), 0755)
+	s3Conf := conf
+	s3Conf.BearerTokenFile, s3Conf.CACert, s3Conf.ClientCert, s3Conf.ClientKey = "", "", "", ""
+	if reflect.DeepEqual(s3Conf, signer.ChainUploadConfig{}) {
+		return nil
+	}
+	if !strings.HasPrefix(location, "s3://") {
+		return errors.Errorf("chain upload parameters are only supported by s3:// upload locations, not %q", location)
+	}
+	switch conf.ServerSideEncryption {
+	case "", s3.ServerSideEncryptionAwsKms:
+	case s3.ServerSideEncryptionAes256:
+		if conf.SSEKMSKeyID != "" {
+			return errors.Errorf("chain upload KMS key requires %q server-side encryption", s3.ServerSideEncryptionAwsKms)
+		}
+	default:
+		return errors.Errorf("unknown chain upload server-side encryption %q, must be %q or %q",
+			conf.ServerSideEncryption, s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms)
+	}
+	switch conf.ObjectLockMode {
+	case "":
+		if conf.ObjectLockRetention != 0 {
+			return errors.New("chain upload object lock retention requires an object lock mode")
+		}
+	case s3.ObjectLockModeGovernance, s3.ObjectLockModeCompliance:
+		if conf.ObjectLockRetention <= 0 {
+			return errors.Errorf("chain upload object lock mode %q requires a retention", conf.ObjectLockMode)
+		}
+	default:
+		return errors.Errorf("unknown chain upload object lock mode %q, must be %q or %q",
+			conf.ObjectLockMode, s3.ObjectLockModeGovernance, s3.ObjectLockModeCompliance)
+	}
+	return nil
+}
+
+// uploadToHTTPS puts a chain to an https:// upload endpoint, like an
+// internal artifact service, authenticated with the bearer token or
+// client certificate of the chain upload configuration
+func uploadToHTTPS(ctx context.Context, data, chainURL string, conf signer.ChainUploadConfig) error {
+	client, err := httpsUploadClient(conf)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, chainURL, strings.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "failed to make chain upload request")
+	}
+	req.Header.Set("Content-Type", "application/pem-certificate-chain")
+	if conf.BearerTokenFile != "" {
+		// read the token for each upload, so it can be rotated
+		token, err := ioutil.ReadFile(conf.BearerTokenFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to read chain upload bearer token")
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	if t, ok := trace.FromContext(ctx); ok {
+		t.SetHeaders(req.Header)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "failed to upload chain")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("failed to upload chain to %s: %s: %s", chainURL, resp.Status, body)
+	}
+	return nil
+}
+
+// httpsUploadClient returns a client verifying upload endpoints with
+// the CA certificate of the chain upload configuration, and presenting
+// its client certificate
+func httpsUploadClient(conf signer.ChainUploadConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if conf.CACert != "" {
+		data, err := ioutil.ReadFile(conf.CACert)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read chain upload CA certificate")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no certificate found in chain upload CA certificate %q", conf.CACert)
+		}
+	}
+	if conf.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(conf.ClientCert, conf.ClientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load chain upload client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{
+		Timeout:   httpsUploadTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+// httpsUploadTimeout is how long an https:// upload endpoint has to
+// accept a chain
+const httpsUploadTimeout = 30 * time.Second
+
+// writeLocalFile publishes a chain into a local directory, like one
+// served by a co-located web server. The chain is written to a
+// temporary file in the same directory then renamed, so readers see
+// either no chain or the complete one, never a partial write.
+func writeLocalFile(data, name string, target *url.URL) error {
+	// upload dir, or the subdirectory of a chain name made from a
+	// template, may not exist yet
+	dest := target.Path + name
+	dir := path.Dir(dest)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "failed to make directory")
+	}
+	tmp, err := ioutil.TempFile(dir, "."+path.Base(dest)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary chain file")
+	}
+	// removes the temporary file when it wasn't renamed
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(data)
+	if err == nil {
+		// make sure the chain is on disk before it is published
+		err = tmp.Sync()
+	}
+	if err == nil {
+		// chains are public, and served by another user
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write temporary chain file")
+	}
+	err = os.Rename(tmp.Name(), dest)
+	if err != nil {
+		return errors.Wrap(err, "failed to publish chain file")
+	}
+	return nil
 }
 
 // GetX5U retrieves a chain of certs from upload location, parses and verifies it,
 // then returns the slice of parsed certificates.
 func GetX5U(x5u string) (certs []*x509.Certificate, err error) {
+	return GetX5UContext(context.Background(), x5u)
+}
+
+// x5uCall is a download of an x5u shared by the callers that asked
+// for it while it was in flight
+type x5uCall struct {
+	done  chan struct{}
+	certs []*x509.Certificate
+	err   error
+
+	// waiters is the number of callers waiting for the download,
+	// which is canceled when they all gave up
+	waiters int
+	cancel  context.CancelFunc
+}
+
+var (
+	x5uCallsMu sync.Mutex
+	x5uCalls   = make(map[string]*x5uCall)
+)
+
+// GetX5UContext is like GetX5U but stops waiting for the download when
+// the context is done. Concurrent calls for the same x5u share a single
+// download and its parsed chain, which is canceled when all of them
+// are done.
+func GetX5UContext(ctx context.Context, x5u string) (certs []*x509.Certificate, err error) {
+	x5uCallsMu.Lock()
+	call, ok := x5uCalls[x5u]
+	if !ok {
+		// the download outlives the caller that started it when
+		// others wait for it, so it only keeps its trace
+		fetchCtx, cancel := context.WithCancel(context.Background())
+		if t, ok := trace.FromContext(ctx); ok {
+			fetchCtx = trace.NewContext(fetchCtx, t)
+		}
+		call = &x5uCall{done: make(chan struct{}), cancel: cancel}
+		x5uCalls[x5u] = call
+		go func() {
+			certs, err := fetchX5U(fetchCtx, x5u)
+			x5uCallsMu.Lock()
+			call.certs, call.err = certs, err
+			if x5uCalls[x5u] == call {
+				delete(x5uCalls, x5u)
+			}
+			x5uCallsMu.Unlock()
+			cancel()
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	x5uCallsMu.Unlock()
+
+	select {
+	case <-call.done:
+		if call.err != nil {
+			return nil, call.err
+		}
+		// callers may modify their slice, not the certificates
+		return append([]*x509.Certificate(nil), call.certs...), nil
+	case <-ctx.Done():
+		x5uCallsMu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			call.cancel()
+			if x5uCalls[x5u] == call {
+				delete(x5uCalls, x5u)
+			}
+		}
+		x5uCallsMu.Unlock()
+		return nil, errors.Wrap(ctx.Err(), "failed to retrieve x5u")
+	}
+}
+
+// x5uS3Config overrides the AWS configuration of the environment for
+// s3 x5u downloads, which tests point to a fake S3 endpoint
+var x5uS3Config = aws.NewConfig()
+
+// ReadX5U returns the PEM chain at an x5u without verifying it. Besides
+// https, x5u can be file URLs of local chains and s3://bucket/key URLs,
+// which are read with the AWS credentials and configuration of the
+// environment, so chains can be verified without a public web server.
+func ReadX5U(ctx context.Context, x5u string) ([]byte, error) {
 	parsedURL, err := url.Parse(x5u)
 	if err != nil {
-		err = errors.Wrap(err, "failed to parse chain upload location")
-		return
+		return nil, errors.Wrap(err, "failed to parse x5u")
+	}
+	switch parsedURL.Scheme {
+	case "s3":
+		return readFromS3(ctx, parsedURL)
+	case "http", "https", "file":
+	default:
+		return nil, errors.Errorf("unsupported x5u scheme %q", parsedURL.Scheme)
 	}
 	c := &http.Client{}
 	if parsedURL.Scheme == "file" {
@@ -79,24 +371,80 @@ func GetX5U(x5u string) (certs []*x509.Certificate, err error) {
 		t.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
 		c.Transport = t
 	}
-	resp, err := c.Get(x5u)
+	req, err := http.NewRequest(http.MethodGet, x5u, nil)
 	if err != nil {
-		err = errors.Wrap(err, "failed to retrieve x5u")
-		return
+		return nil, errors.Wrap(err, "failed to make x5u request")
+	}
+	if t, ok := trace.FromContext(ctx); ok {
+		t.SetHeaders(req.Header)
+	}
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to retrieve x5u")
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		err = errors.Errorf("failed to retrieve x5u from %s: %s", x5u, resp.Status)
-		return
+		return nil, errors.Errorf("failed to retrieve x5u from %s: %s", x5u, resp.Status)
 	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		err = errors.Wrap(err, "failed to parse x5u body")
+		return nil, errors.Wrap(err, "failed to parse x5u body")
+	}
+	return body, nil
+}
+
+// readFromS3 downloads the object at an s3://bucket/key x5u. The
+// region of the bucket is looked up when the environment doesn't set
+// one.
+func readFromS3(ctx context.Context, target *url.URL) ([]byte, error) {
+	bucket, key := target.Host, strings.TrimPrefix(target.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, errors.Errorf("s3 x5u %q must have a bucket and a key", target)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *x5uS3Config,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to make aws session")
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		region, err := s3manager.GetBucketRegion(ctx, sess, bucket, "us-east-1")
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to find region of bucket %q", bucket)
+		}
+		sess = sess.Copy(aws.NewConfig().WithRegion(region))
+	}
+	input := &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}
+	out, err := s3.New(sess).GetObjectWithContext(ctx, input, func(r *request.Request) {
+		if t, ok := trace.FromContext(ctx); ok {
+			t.SetHeaders(r.HTTPRequest.Header)
+		}
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to retrieve x5u from %s", target)
+	}
+	defer out.Body.Close()
+	body, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse x5u body")
+	}
+	return body, nil
+}
+
+// fetchX5U downloads, parses and verifies the chain at an x5u
+func fetchX5U(ctx context.Context, x5u string) (certs []*x509.Certificate, err error) {
+	body, err := ReadX5U(ctx, x5u)
+	if err != nil {
 		return
 	}
 	// verify the chain
 	// the first cert is the end entity, then the intermediate and the root
 	block, rest := pem.Decode(body)
+	if block == nil {
+		err = errors.New("failed to find ee certificate in chain")
+		return
+	}
 	ee, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
 		err = errors.Wrap(err, "failed to parse ee certificate from chain")
@@ -106,6 +454,10 @@ func GetX5U(x5u string) (certs []*x509.Certificate, err error) {
 
 	// the second cert is the intermediate
 	block, rest = pem.Decode(rest)
+	if block == nil {
+		err = errors.New("failed to find intermediate issuer certificate in chain")
+		return
+	}
 	inter, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
 		err = errors.Wrap(err, "failed to parse intermediate issuer certificate from chain")
@@ -117,6 +469,10 @@ func GetX5U(x5u string) (certs []*x509.Certificate, err error) {
 
 	// the third and last cert is the root
 	block, rest = pem.Decode(rest)
+	if block == nil {
+		err = errors.New("failed to find root certificate in chain")
+		return
+	}
 	root, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
 		err = errors.Wrap(err, "failed to parse root certificate from chain")
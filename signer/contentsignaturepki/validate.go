@@ -0,0 +1,137 @@
+package contentsignaturepki
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidChain is returned when a chain fails the checks Firefox
+// makes on content signature chains, before it is published
+var ErrInvalidChain = errors.New("chain fails firefox content signature constraints")
+
+// chainConstraints are the constraints a chain must meet before it is
+// published to the x5u
+type chainConstraints struct {
+	// Hostname is the name the end-entity must have in its SAN
+	Hostname string
+
+	// Now is the time the chain starts being used
+	Now time.Time
+
+	// Validity is how long the end-entity will sign after Now
+	Validity time.Duration
+
+	// ClockSkewTolerance is how far the clocks of clients can be
+	// off, in either direction
+	ClockSkewTolerance time.Duration
+}
+
+// parseChain parses a PEM chain into its certificates
+func parseChain(chain []byte) (certs []*x509.Certificate, err error) {
+	rest := chain
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse certificate %d of chain", len(certs))
+		}
+		certs = append(certs, cert)
+	}
+	if len(bytes.TrimSpace(rest)) != 0 {
+		return nil, errors.New("trailing data after the certificates of chain")
+	}
+	return certs, nil
+}
+
+// validateChain checks a chain against the constraints Firefox enforces
+// on content signature chains, and returns an error listing every check
+// that failed. The chain must be the end-entity, the intermediate then
+// the root, each signed by the next one and the root self-signed. The
+// SAN of the end-entity must match the hostname, and it must have the
+// code signing EKU, like its issuers when they restrict their EKUs.
+// Every certificate must be valid for clients whose clock is off by up
+// to the clock skew tolerance while the end-entity is in use.
+func validateChain(certs []*x509.Certificate, c chainConstraints) error {
+	var failures []string
+	fail := func(format string, args ...interface{}) {
+		failures = append(failures, fmt.Sprintf(format, args...))
+	}
+	if len(certs) != 3 {
+		return errors.Wrapf(ErrInvalidChain, "chain has %d certificates, expected the end-entity, intermediate and root", len(certs))
+	}
+	ee := certs[0]
+
+	// chain order
+	for i, cert := range certs {
+		name := cert.Subject.CommonName
+		if i < len(certs)-1 {
+			parent := certs[i+1]
+			if !bytes.Equal(cert.RawIssuer, parent.RawSubject) {
+				fail("certificate %d %q is not issued by the next certificate %q", i, name, parent.Subject.CommonName)
+			} else if err := cert.CheckSignatureFrom(parent); err != nil {
+				fail("certificate %d %q is not signed by the next certificate %q: %v", i, name, parent.Subject.CommonName, err)
+			}
+		} else {
+			if !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+				fail("root certificate %q is not self-signed", name)
+			} else if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+				fail("root certificate %q has an invalid self signature: %v", name, err)
+			}
+		}
+		if i > 0 && !cert.IsCA {
+			fail("issuer certificate %d %q is not a CA", i, name)
+		}
+	}
+
+	// SAN
+	if err := ee.VerifyHostname(c.Hostname); err != nil {
+		fail("end-entity %q does not match hostname %q: SAN is %q", ee.Subject.CommonName, c.Hostname, ee.DNSNames)
+	}
+
+	// EKU
+	for i, cert := range certs {
+		if i > 0 && len(cert.ExtKeyUsage) == 0 && len(cert.UnknownExtKeyUsage) == 0 {
+			// issuers without an EKU extension don't restrict usage
+			continue
+		}
+		hasCodeSigning := false
+		for _, eku := range cert.ExtKeyUsage {
+			if eku == x509.ExtKeyUsageCodeSigning || (i > 0 && eku == x509.ExtKeyUsageAny) {
+				hasCodeSigning = true
+				break
+			}
+		}
+		if !hasCodeSigning {
+			fail("certificate %d %q is missing the code signing extended key usage", i, cert.Subject.CommonName)
+		}
+	}
+
+	// validity, at the second resolution of certificate times
+	notBefore := c.Now.Add(-c.ClockSkewTolerance).Truncate(time.Second)
+	notAfter := c.Now.Add(c.Validity + c.ClockSkewTolerance).Truncate(time.Second)
+	for i, cert := range certs {
+		if cert.NotBefore.After(notBefore) {
+			fail("certificate %d %q is not valid for clients with a clock %s late: notBefore=%s",
+				i, cert.Subject.CommonName, c.ClockSkewTolerance, cert.NotBefore)
+		}
+		if cert.NotAfter.Before(notAfter) {
+			fail("certificate %d %q expires before the end of the validity for clients with a clock %s early: notAfter=%s",
+				i, cert.Subject.CommonName, c.ClockSkewTolerance, cert.NotAfter)
+		}
+	}
+
+	if len(failures) > 0 {
+		return errors.Wrap(ErrInvalidChain, strings.Join(failures, "; "))
+	}
+	return nil
+}
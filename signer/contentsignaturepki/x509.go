@@ -2,8 +2,12 @@ package contentsignaturepki
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"math/big"
@@ -11,69 +15,139 @@ import (
 
 	"github.com/pkg/errors"
 	"go.mozilla.org/autograph/database"
-	"go.mozilla.org/autograph/signer"
+	"golang.org/x/crypto/ed25519"
 )
 
-// findAndSetEE searches the database for an end-entity key that is currently
+// findEE searches the database for an end-entity key that is currently
 // valid for this signer and is not older than cfg.Validity days
-func (s *ContentSigner) findAndSetEE(conf signer.Configuration) (err error) {
-	var tmpX5U string
+func (s *ContentSigner) findEE(ctx context.Context) (*endEntity, error) {
 	if s.db == nil {
 		// no database, no chance to find an existing key
-		return database.ErrNoSuitableEEFound
+		return nil, database.ErrNoSuitableEEFound
 	}
 	// search the database for the label of an end-entity private key that is still valid.
-	s.eeLabel, tmpX5U, err = s.db.GetLabelOfLatestEE(s.ID, s.validity)
+	label, x5u, err := s.db.GetLabelOfLatestEEContext(ctx, s.ID, s.validity)
 	if err != nil {
-		return
+		return nil, err
 	}
-	if tmpX5U != "" {
-		s.X5U = tmpX5U
+	return s.loadEE(label, x5u)
+}
+
+// loadEE retrieves the keys of the end-entity labeled label from the
+// hsm
+func (s *ContentSigner) loadEE(label, x5u string) (*endEntity, error) {
+	if x5u == "" {
+		x5u = s.X5U
+	}
+	ee := &endEntity{label: label, x5u: x5u}
+	conf := s.keyConf
+	conf.PrivateKey = label
+	var err error
+	ee.priv, ee.pub, ee.publicKey, err = conf.GetKeys()
+	if err != nil {
+		return nil, errors.Wrapf(err, "found end-entity labeled %q in database but not in hsm", label)
 	}
-	conf.PrivateKey = s.eeLabel
-	s.rand = conf.GetRand()
-	s.eePriv, s.eePub, s.PublicKey, err = conf.GetKeys()
+	return ee, nil
+}
+
+// verifyEEKey checks the hsm handle of an end-entity resolves to the
+// key of the certificate published at its x5u, by comparing their
+// public keys and verifying a test signature of its private key. It
+// catches handles that point to another key, like when a label was
+// reused or the hsm was restored from an older backup, which would
+// make signatures nobody can verify.
+func (s *ContentSigner) verifyEEKey(ee *endEntity) error {
+	certPub := ee.chain[0].PublicKey
+	switch certPub.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+	default:
+		return errors.Errorf("certificate of end-entity %q at x5u %q doesn't have an ecdsa or ed25519 public key", ee.label, ee.x5u)
+	}
+	publicKey, err := encodePublicKey(certPub)
 	if err != nil {
-		err = errors.Wrapf(err, "found suitable end-entity labeled %q in database but not in hsm", s.eeLabel)
-		return
+		return err
 	}
-	return
+	if publicKey != ee.publicKey {
+		return errors.Errorf("public key of end-entity %q in hsm doesn't match its certificate at x5u %q", ee.label, ee.x5u)
+	}
+	signed := s.toSign([]byte("autograph end-entity key check"))
+	sig, err := s.sign(ee, signed)
+	if err != nil {
+		return errors.Wrapf(err, "failed to sign with private key of end-entity %q", ee.label)
+	}
+	if !sig.verifySigned(signed, certPub) {
+		return errors.Errorf("private key of end-entity %q in hsm doesn't match its certificate at x5u %q", ee.label, ee.x5u)
+	}
+	return nil
+}
+
+// encodePublicKey returns the base64 DER encoding of an end-entity
+// public key, like signer.Configuration.GetKeys
+func encodePublicKey(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal end-entity public key")
+	}
+	return base64.StdEncoding.EncodeToString(der), nil
 }
 
 // makeAndUploadChain makes a certificate using the end-entity public key,
-// uploads the chain to its destination and creates an X5U download URL
-func (s *ContentSigner) makeAndUploadChain() (err error) {
-	var fullChain, chainName string
-	fullChain, chainName, err = s.makeChain()
+// uploads the chain to its destination and returns its X5U download URL
+func (s *ContentSigner) makeAndUploadChain(ctx context.Context, eePub crypto.PublicKey) (string, error) {
+	fullChain, chainName, err := s.makeChain(eePub)
 	if err != nil {
-		return errors.Wrap(err, "failed to make chain")
+		return "", errors.Wrap(err, "failed to make chain")
 	}
-	err = s.upload(fullChain, chainName)
+	err = s.upload(ctx, fullChain, chainName)
 	if err != nil {
-		return errors.Wrap(err, "failed to upload chain")
+		return "", errors.Wrap(err, "failed to upload chain")
 	}
-	newX5U := s.X5U + chainName
-	_, err = GetX5U(newX5U)
+	newX5U, err := s.makeX5U(chainName)
 	if err != nil {
-		return errors.Wrap(err, "failed to download new chain")
+		return "", errors.Wrap(err, "failed to make x5u")
 	}
-	s.X5U = newX5U
-	return
+	_, err = GetX5UContext(ctx, newX5U)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to download new chain")
+	}
+	return newX5U, nil
+}
+
+// makeX5U returns the public URL of a chain: the x5u template executed
+// with the chain name when the signer has one, or the chain name
+// appended to the configured x5u otherwise
+func (s *ContentSigner) makeX5U(chainName string) (string, error) {
+	if s.x5uTemplate == nil {
+		return s.X5U + chainName, nil
+	}
+	var x5u bytes.Buffer
+	err := s.x5uTemplate.Execute(&x5u, struct {
+		ChainName string
+		SignerID  string
+	}{
+		ChainName: chainName,
+		SignerID:  s.ID,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to execute x5u template")
+	}
+	return x5u.String(), nil
 }
 
 // makeChain issues an end-entity certificate using the ca private key and the first
 // cert of the chain (which is supposed to match the ca private key).  it
 // returns the entire chain of certificate, its name (based on the ee cn &
 // expiration) and an error.
-func (s *ContentSigner) makeChain() (chain string, name string, err error) {
+func (s *ContentSigner) makeChain(eePub crypto.PublicKey) (chain string, name string, err error) {
 	cn := s.ID + CSNameSpace
+	now := time.Now().UTC()
 
-	// cert is backdated to allow for clock skew tolerance
-	notBefore := time.Now().UTC().Add(-s.clockSkewTolerance)
+	// cert is backdated to allow for clients with a late clock
+	notBefore := now.Add(-s.notBeforeBackdate)
 
 	// cert will be in used for `validity` number of days, but will remain
-	// valid for longer than that to account for clock skew
-	notAfter := time.Now().UTC().Add(s.validity + s.clockSkewTolerance)
+	// valid for longer than that to account for clients with an early clock
+	notAfter := now.Add(s.validity + s.notAfterMargin)
 
 	block, _ := pem.Decode([]byte(s.IssuerCert))
 	if block == nil {
@@ -103,7 +177,7 @@ func (s *ContentSigner) makeChain() (chain string, name string, err error) {
 		KeyUsage:    x509.KeyUsageDigitalSignature,
 	}
 
-	certBytes, err := x509.CreateCertificate(s.rand, crtTpl, issuer, s.eePub, s.issuerPriv)
+	certBytes, err := x509.CreateCertificate(s.keyConf.GetRandForKey(s.issuerPriv), crtTpl, issuer, eePub, s.issuerPriv)
 	if err != nil {
 		err = errors.Wrap(err, "failed to issue end-entity cert")
 		return
@@ -142,8 +216,28 @@ func (s *ContentSigner) makeChain() (chain string, name string, err error) {
 		return
 	}
 
-	// return a chain with the EE cert first then the issuers
+	// return a chain with the EE cert first then the issuers, once
+	// it passes the checks of firefox
 	chain = certPem.String() + s.IssuerCert + s.caCert
-	name = fmt.Sprintf("%s-%s.chain", cert.Subject.CommonName, cert.NotAfter.Format("2006-01-02-15-04-05"))
+	certs, err := parseChain([]byte(chain))
+	if err != nil {
+		return
+	}
+	err = validateChain(certs, chainConstraints{
+		Hostname:           cn,
+		Now:                now,
+		Validity:           s.validity,
+		ClockSkewTolerance: s.clockSkewTolerance,
+	})
+	if err != nil {
+		return
+	}
+	name, err = executeNameTemplate(s.chainNameTemplate, nameTemplateData{
+		SignerID:   s.ID,
+		CommonName: cert.Subject.CommonName,
+		NotBefore:  cert.NotBefore,
+		NotAfter:   cert.NotAfter,
+		Serial:     fmt.Sprintf("%x", cert.SerialNumber),
+	}, s.rand)
 	return
 }
@@ -0,0 +1,108 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"context"
+)
+
+// ContextHashSigner is an interface to a hash signer that aborts
+// signing when its context is done
+type ContextHashSigner interface {
+	SignHashContext(ctx context.Context, data []byte, options interface{}) (Signature, error)
+}
+
+// ContextDataSigner is an interface to a data signer that aborts
+// signing when its context is done
+type ContextDataSigner interface {
+	SignDataContext(ctx context.Context, data []byte, options interface{}) (Signature, error)
+}
+
+// ContextFileSigner is an interface to a file signer that aborts
+// signing when its context is done
+type ContextFileSigner interface {
+	SignFileContext(ctx context.Context, file []byte, options interface{}) (SignedFile, error)
+}
+
+// CallContext runs call in a goroutine and returns its error, or the
+// context error as soon as ctx is done. It bounds calls that cannot be
+// canceled, like PKCS#11 signatures: the abandoned call keeps running
+// until it returns, which releases its HSM session, and its results
+// must not be read after CallContext returned the context error.
+func CallContext(ctx context.Context, call func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		return call()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SignHashContext signs a hash with the signer's SignHashContext
+// method when it implements one. Otherwise, it calls SignHash with
+// CallContext, which returns the context error when ctx is done
+// before the signature, including one the HSM is making.
+func SignHashContext(ctx context.Context, s HashSigner, data []byte, options interface{}) (Signature, error) {
+	if cs, ok := s.(ContextHashSigner); ok {
+		return cs.SignHashContext(ctx, data, options)
+	}
+	var sig Signature
+	err := CallContext(ctx, func() (err error) {
+		sig, err = s.SignHash(data, options)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// SignDataContext signs data with the signer's SignDataContext
+// method when it implements one. Otherwise, it calls SignData with
+// CallContext, which returns the context error when ctx is done
+// before the signature.
+func SignDataContext(ctx context.Context, s DataSigner, data []byte, options interface{}) (Signature, error) {
+	if cs, ok := s.(ContextDataSigner); ok {
+		return cs.SignDataContext(ctx, data, options)
+	}
+	var sig Signature
+	err := CallContext(ctx, func() (err error) {
+		sig, err = s.SignData(data, options)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// SignFileContext signs a file with the signer's SignFileContext
+// method when it implements one. Otherwise, it calls SignFile with
+// CallContext, which returns the context error when ctx is done
+// before the signed file.
+func SignFileContext(ctx context.Context, s FileSigner, file []byte, options interface{}) (SignedFile, error) {
+	if cs, ok := s.(ContextFileSigner); ok {
+		return cs.SignFileContext(ctx, file, options)
+	}
+	var signedFile SignedFile
+	err := CallContext(ctx, func() (err error) {
+		signedFile, err = s.SignFile(file, options)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return signedFile, nil
+}
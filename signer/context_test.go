@@ -0,0 +1,120 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type testSignature struct{}
+
+func (sig *testSignature) Marshal() (string, error) { return "", nil }
+
+// testSigner implements DataSigner but not ContextDataSigner
+type testSigner struct {
+	calls int
+}
+
+func (s *testSigner) SignData(data []byte, options interface{}) (Signature, error) {
+	s.calls++
+	return new(testSignature), nil
+}
+
+func (s *testSigner) GetDefaultOptions() interface{} { return nil }
+
+// testContextSigner implements ContextDataSigner
+type testContextSigner struct {
+	testSigner
+	contextCalls int
+}
+
+func (s *testContextSigner) SignDataContext(ctx context.Context, data []byte, options interface{}) (Signature, error) {
+	s.contextCalls++
+	return new(testSignature), nil
+}
+
+func TestSignDataContext(t *testing.T) {
+	s := new(testSigner)
+	_, err := SignDataContext(context.Background(), s, []byte("foo"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.calls != 1 {
+		t.Fatalf("expected SignData to be called once, got %d", s.calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = SignDataContext(ctx, s, []byte("foo"), nil)
+	if err != context.Canceled {
+		t.Fatalf("expected error %v with a canceled context, got %v", context.Canceled, err)
+	}
+	if s.calls != 1 {
+		t.Fatalf("expected SignData not to be called with a canceled context")
+	}
+
+	cs := new(testContextSigner)
+	_, err = SignDataContext(ctx, cs, []byte("foo"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.contextCalls != 1 || cs.calls != 0 {
+		t.Fatalf("expected SignDataContext to be called instead of SignData")
+	}
+}
+
+// blockingHashSigner blocks in SignHash until release is closed, like
+// an HSM signature that doesn't return, and closes returned after
+type blockingHashSigner struct {
+	release  chan struct{}
+	returned chan struct{}
+}
+
+func (s *blockingHashSigner) SignHash(data []byte, options interface{}) (Signature, error) {
+	defer close(s.returned)
+	<-s.release
+	return new(testSignature), nil
+}
+
+func (s *blockingHashSigner) GetDefaultOptions() interface{} { return nil }
+
+func TestSignHashContextReturnsOnDeadline(t *testing.T) {
+	s := &blockingHashSigner{
+		release:  make(chan struct{}),
+		returned: make(chan struct{}),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := SignHashContext(ctx, s, []byte("foo"), nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected error %v from a blocked signer, got %v", context.DeadlineExceeded, err)
+	}
+	select {
+	case <-s.returned:
+		t.Fatal("expected the blocked signature to still be in progress")
+	default:
+	}
+
+	// the abandoned signature returns, and releases its session,
+	// once the signer does
+	close(s.release)
+	select {
+	case <-s.returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the abandoned signature to return")
+	}
+
+	s = &blockingHashSigner{
+		release:  make(chan struct{}),
+		returned: make(chan struct{}),
+	}
+	close(s.release)
+	sig, err := SignHashContext(context.Background(), s, []byte("foo"), nil)
+	if err != nil || sig == nil {
+		t.Fatalf("expected a signature from a signer that returns, got %v", err)
+	}
+}
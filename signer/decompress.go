@@ -0,0 +1,77 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/andybalholm/brotli"
+	"github.com/pkg/errors"
+)
+
+const (
+	// EncodingIdentity is the content encoding of uncompressed input
+	EncodingIdentity = "identity"
+
+	// EncodingGzip is the content encoding of gzip compressed input
+	EncodingGzip = "gzip"
+
+	// EncodingBrotli is the content encoding of brotli compressed input
+	EncodingBrotli = "br"
+
+	// DefaultMaxDecompressedSize is the maximum size in bytes of
+	// decompressed input when a signer does not configure one
+	DefaultMaxDecompressedSize = 10 * 1024 * 1024
+)
+
+var (
+	// ErrDecompressedTooLarge is returned when compressed input
+	// expands beyond the maximum decompressed size of a signer
+	ErrDecompressedTooLarge = errors.New("decompressed input is too large")
+
+	// ErrInvalidEncoding is returned when input is not valid for
+	// its content encoding, or the content encoding is unsupported
+	ErrInvalidEncoding = errors.New("invalid content encoding")
+)
+
+// Decompress returns input decoded from a content encoding of
+// "identity", "gzip" or "br". An empty encoding is the same as
+// "identity". The decompressed output cannot be larger than maxSize
+// bytes, or DefaultMaxDecompressedSize when maxSize is zero.
+func Decompress(input []byte, encoding string, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxDecompressedSize
+	}
+	var (
+		r   io.Reader
+		err error
+	)
+	switch encoding {
+	case "", EncodingIdentity:
+		return input, nil
+	case EncodingGzip:
+		r, err = gzip.NewReader(bytes.NewReader(input))
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidEncoding, "failed to read gzip header: %v", err)
+		}
+	case EncodingBrotli:
+		r = brotli.NewReader(bytes.NewReader(input))
+	default:
+		return nil, errors.Wrapf(ErrInvalidEncoding, "unsupported content encoding %q", encoding)
+	}
+	// read one byte past the limit to tell a payload of exactly
+	// maxSize bytes apart from a larger one
+	out, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidEncoding, "failed to decompress %s input: %v", encoding, err)
+	}
+	if int64(len(out)) > maxSize {
+		return nil, errors.Wrapf(ErrDecompressedTooLarge, "%s input decompresses to more than %d bytes", encoding, maxSize)
+	}
+	return out, nil
+}
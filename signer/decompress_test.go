@@ -0,0 +1,87 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/pkg/errors"
+)
+
+func gzipData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func brotliData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := brotli.NewWriter(&buf)
+	w.Write(data)
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	t.Parallel()
+
+	data := bytes.Repeat([]byte("compressible content "), 100)
+	for _, testcase := range []struct {
+		encoding string
+		input    []byte
+	}{
+		{"", data},
+		{EncodingIdentity, data},
+		{EncodingGzip, gzipData(t, data)},
+		{EncodingBrotli, brotliData(t, data)},
+	} {
+		out, err := Decompress(testcase.input, testcase.encoding, 0)
+		if err != nil {
+			t.Fatalf("encoding %q: failed to decompress: %v", testcase.encoding, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatalf("encoding %q: decompressed data does not match input", testcase.encoding)
+		}
+		// a limit of exactly the decompressed size is accepted
+		_, err = Decompress(testcase.input, testcase.encoding, int64(len(data)))
+		if err != nil {
+			t.Fatalf("encoding %q: failed to decompress at size limit: %v", testcase.encoding, err)
+		}
+	}
+}
+
+func TestDecompressErrors(t *testing.T) {
+	t.Parallel()
+
+	data := bytes.Repeat([]byte{0}, 4096)
+	for i, testcase := range []struct {
+		encoding string
+		input    []byte
+		maxSize  int64
+		expected error
+	}{
+		{EncodingGzip, gzipData(t, data), 4095, ErrDecompressedTooLarge},
+		{EncodingBrotli, brotliData(t, data), 1024, ErrDecompressedTooLarge},
+		{EncodingGzip, []byte("not gzip data"), 0, ErrInvalidEncoding},
+		{EncodingBrotli, []byte("not brotli data"), 0, ErrInvalidEncoding},
+		{"deflate", data, 0, ErrInvalidEncoding},
+	} {
+		_, err := Decompress(testcase.input, testcase.encoding, testcase.maxSize)
+		if errors.Cause(err) != testcase.expected {
+			t.Fatalf("test case %d: expected error %v but got %v", i, testcase.expected, err)
+		}
+	}
+}
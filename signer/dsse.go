@@ -0,0 +1,84 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// DSSEEnvelope is a Dead Simple Signing Envelope, which carries a
+// payload with its type and signatures of their pre-authentication
+// encoding. In-toto attestations and supply-chain tooling consume
+// envelopes as is.
+type DSSEEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"`
+	Signatures  []DSSESignature `json:"signatures"`
+}
+
+// DSSESignature is a base64 encoded signature in a DSSE envelope,
+// with the optional ID of the key that made it
+type DSSESignature struct {
+	KeyID string `json:"keyid,omitempty"`
+	Sig   string `json:"sig"`
+}
+
+// PAE returns the DSSE pre-authentication encoding of a payload and
+// its type, which is the data signed in an envelope
+func PAE(payloadType string, payload []byte) []byte {
+	prefix := fmt.Sprintf("DSSEv1 %d %s %d ", len(payloadType), payloadType, len(payload))
+	return append([]byte(prefix), payload...)
+}
+
+// NewDSSEEnvelope returns an envelope of a payload with the
+// signature of its pre-authentication encoding
+func NewDSSEEnvelope(payloadType string, payload []byte, keyID string, sig []byte) *DSSEEnvelope {
+	return &DSSEEnvelope{
+		PayloadType: payloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures: []DSSESignature{{
+			KeyID: keyID,
+			Sig:   base64.StdEncoding.EncodeToString(sig),
+		}},
+	}
+}
+
+// Marshal returns the JSON envelope
+func (env *DSSEEnvelope) Marshal() (string, error) {
+	out, err := json.Marshal(env)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal dsse envelope")
+	}
+	return string(out), nil
+}
+
+// ParseDSSEEnvelope parses a JSON envelope with a single signature
+// and returns it with its decoded payload and signature
+func ParseDSSEEnvelope(envelope string) (env *DSSEEnvelope, payload, sig []byte, err error) {
+	env = new(DSSEEnvelope)
+	err = json.Unmarshal([]byte(envelope), env)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to parse dsse envelope")
+	}
+	if env.PayloadType == "" {
+		return nil, nil, nil, errors.New("dsse envelope has no payload type")
+	}
+	if len(env.Signatures) != 1 {
+		return nil, nil, nil, errors.Errorf("dsse envelope has %d signatures, expected one", len(env.Signatures))
+	}
+	payload, err = base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to decode dsse payload")
+	}
+	sig, err = base64.StdEncoding.DecodeString(env.Signatures[0].Sig)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to decode dsse signature")
+	}
+	return env, payload, sig, nil
+}
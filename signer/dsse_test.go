@@ -0,0 +1,46 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPAE(t *testing.T) {
+	// example of the DSSE protocol specification
+	pae := PAE("http://example.com/HelloWorld", []byte("hello world"))
+	expected := "DSSEv1 29 http://example.com/HelloWorld 11 hello world"
+	if string(pae) != expected {
+		t.Fatalf("expected pre-authentication encoding %q, got %q", expected, pae)
+	}
+}
+
+func TestDSSEEnvelope(t *testing.T) {
+	env := NewDSSEEnvelope("application/vnd.in-toto+json", []byte(`{"_type":"statement"}`), "somekey", []byte("signature"))
+	envelope, err := env.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, payload, sig, err := ParseDSSEEnvelope(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.PayloadType != "application/vnd.in-toto+json" || parsed.Signatures[0].KeyID != "somekey" ||
+		string(payload) != `{"_type":"statement"}` || !bytes.Equal(sig, []byte("signature")) {
+		t.Fatalf("parsed envelope does not match: %+v", parsed)
+	}
+	for _, invalid := range []string{
+		"not json",
+		`{"payload":"e30=","signatures":[{"sig":"c2ln"}]}`,
+		`{"payloadType":"text/plain","payload":"e30=","signatures":[]}`,
+		`{"payloadType":"text/plain","payload":"not base64!","signatures":[{"sig":"c2ln"}]}`,
+	} {
+		_, _, _, err = ParseDSSEEnvelope(invalid)
+		if err == nil {
+			t.Fatalf("expected envelope %q to be invalid", invalid)
+		}
+	}
+}
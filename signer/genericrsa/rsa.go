@@ -1,6 +1,7 @@
 package genericrsa
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/rsa"
 	"crypto/sha1"
@@ -10,6 +11,7 @@ import (
 	"encoding/json"
 	"hash"
 	"io"
+	"strings"
 
 	"go.mozilla.org/autograph/formats"
 
@@ -25,6 +27,7 @@ const (
 // RSASigner holds the configuration of the signer
 type RSASigner struct {
 	signer.Configuration
+	signer.KeyZeroizer
 
 	// key is the RSA private key to sign hashes.
 	// we use the `crypto.PrivateKey` interface to support
@@ -59,6 +62,11 @@ type Options struct {
 	// This is the only way to specify the hash function when using the
 	// crypto.Signer interface.
 	Hash crypto.Hash
+
+	// PayloadType, when set in a data signing request, wraps the
+	// signature in a DSSE envelope of the input with this payload
+	// type, like application/vnd.in-toto+json
+	PayloadType string `json:"payload_type,omitempty"`
 }
 
 // HashFunc returns the Hash used by the signer so that Options implements
@@ -104,6 +112,7 @@ func New(conf signer.Configuration) (s *RSASigner, err error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "genericrsa: error fetching key for signer %q", s.ID)
 	}
+	s.ZeroizeAtExit(s.key)
 	_, ok := s.pubKey.(*rsa.PublicKey)
 	if !ok {
 		return nil, errors.Errorf("genericrsa: unsupported public key type %T for signer %q, use RSA keys", s.pubKey, s.ID)
@@ -146,14 +155,33 @@ func (s *RSASigner) Config() signer.Configuration {
 		ID:         s.ID,
 		Type:       s.Type,
 		Mode:       s.Mode,
+		Hash:       s.Hash,
 		PrivateKey: s.PrivateKey,
 		PublicKey:  s.PublicKey,
 		SignerOpts: s.sigOpts,
 	}
 }
 
-// SignData takes data, hashes it and returns a signed base64 encoded hash
+// SignData takes data, hashes it and returns a signed base64 encoded
+// hash, or a DSSE envelope of the data when the options have a
+// payload type
 func (s *RSASigner) SignData(data []byte, options interface{}) (signer.Signature, error) {
+	opts, err := GetOptions(options)
+	if err != nil {
+		return nil, errors.Wrapf(signer.ErrInvalidOptions, "genericrsa: %v", err)
+	}
+	if opts.PayloadType == "" {
+		return s.signHash(s.hashData(data))
+	}
+	sig, err := s.signHash(s.hashData(signer.PAE(opts.PayloadType, data)))
+	if err != nil {
+		return nil, err
+	}
+	return signer.NewDSSEEnvelope(opts.PayloadType, data, s.ID, sig.(*Signature).Data), nil
+}
+
+// hashData hashes data with the hash of the signer
+func (s *RSASigner) hashData(data []byte) []byte {
 	var h hash.Hash
 	switch s.Hash {
 	case "sha1":
@@ -162,15 +190,27 @@ func (s *RSASigner) SignData(data []byte, options interface{}) (signer.Signature
 		h = sha256.New()
 	}
 	h.Write(data)
-	return s.SignHash(h.Sum(nil), options)
+	return h.Sum(nil)
 }
 
 // SignHash takes an input hash and returns a signed base64 encoded hash
 func (s *RSASigner) SignHash(digest []byte, options interface{}) (signer.Signature, error) {
+	opts, err := GetOptions(options)
+	if err != nil {
+		return nil, errors.Wrapf(signer.ErrInvalidOptions, "genericrsa: %v", err)
+	}
+	if opts.PayloadType != "" {
+		return nil, errors.Wrap(signer.ErrInvalidOptions, "genericrsa: dsse envelopes need the payload, sign it as data")
+	}
+	return s.signHash(digest)
+}
+
+// signHash signs a digest of the length of the signer hash
+func (s *RSASigner) signHash(digest []byte) (signer.Signature, error) {
 	if len(digest) != s.hashSize {
-		return nil, errors.Errorf("genericrsa: refusing to sign input hash. Got length %d, expected %d", len(digest), s.hashSize)
+		return nil, errors.Wrapf(signer.ErrInvalidHashLength, "genericrsa: refusing to sign input hash. Got length %d, expected %d", len(digest), s.hashSize)
 	}
-	sigBytes, err := s.key.(crypto.Signer).Sign(s.rng, digest, s.sigOpts)
+	sigBytes, err := signer.SignWithKey(s.key, s.rng, digest, s.sigOpts)
 	if err != nil {
 		return nil, errors.Wrap(err, "genericrsa: error signing hash")
 	}
@@ -205,6 +245,16 @@ func (s *RSASigner) GetDefaultOptions() interface{} {
 	return Options{}
 }
 
+// GetOptions takes a input interface and reflects it into a struct of options
+func GetOptions(input interface{}) (options Options, err error) {
+	buf, err := json.Marshal(input)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(buf, &options)
+	return
+}
+
 // VerifySignature verifies a rsa signature for the given SHA1
 // digest for the given RSA public and signature bytes
 func VerifySignature(input, sigBytes []byte, pubKey *rsa.PublicKey, sigopt interface{}, mode string) (err error) {
@@ -253,9 +303,24 @@ func VerifyGenericRsaSignatureResponse(input []byte, sr formats.SignatureRespons
 	if sr.Type != Type {
 		return errors.Errorf("genericrsa: signature response of type %q cannot be verified by %q", sr.Type, Type)
 	}
-	sig, err := Unmarshal(sr.Signature)
-	if err != nil {
-		return errors.Wrap(err, "genericrsa: failed to unmarshal rsa signature")
+	// DSSE envelopes are JSON objects and other signatures base64
+	var sigBytes []byte
+	if strings.HasPrefix(sr.Signature, "{") {
+		env, payload, envSig, err := signer.ParseDSSEEnvelope(sr.Signature)
+		if err != nil {
+			return errors.Wrap(err, "genericrsa: failed to parse dsse envelope")
+		}
+		if !bytes.Equal(payload, input) {
+			return errors.New("genericrsa: dsse envelope payload does not match input")
+		}
+		input = signer.PAE(env.PayloadType, payload)
+		sigBytes = envSig
+	} else {
+		sig, err := Unmarshal(sr.Signature)
+		if err != nil {
+			return errors.Wrap(err, "genericrsa: failed to unmarshal rsa signature")
+		}
+		sigBytes = sig.(*Signature).Data
 	}
 	keyBytes, err := base64.StdEncoding.DecodeString(sr.PublicKey)
 	if err != nil {
@@ -266,7 +331,7 @@ func VerifyGenericRsaSignatureResponse(input []byte, sr formats.SignatureRespons
 		return errors.Wrap(err, "genericrsa: failed to parse pkix public key")
 	}
 	pubKey := keyInterface.(*rsa.PublicKey)
-	err = VerifySignature(input, sig.(*Signature).Data, pubKey, sr.SignerOpts, sr.Mode)
+	err = VerifySignature(input, sigBytes, pubKey, sr.SignerOpts, sr.Mode)
 	if err != nil {
 		return errors.Wrap(err, "genericrsa: failed to verify signature")
 	}
@@ -13,6 +13,7 @@ import (
 	"encoding/base64"
 	"testing"
 
+	"github.com/pkg/errors"
 	"go.mozilla.org/autograph/signer"
 )
 
@@ -245,6 +246,67 @@ func TestSignData(t *testing.T) {
 	}
 }
 
+func TestSignDataInDSSEEnvelope(t *testing.T) {
+	t.Parallel()
+
+	input := []byte(`{"_type":"https://in-toto.io/Statement/v0.1"}`)
+	options := map[string]interface{}{"payload_type": "application/vnd.in-toto+json"}
+	for i, conf := range rsaSignerConfs {
+		s := assertNewSignerWithConfOK(t, conf)
+
+		sig, err := s.SignData(input, options)
+		if err != nil {
+			t.Fatalf("in config %d %q, failed to sign data: %v", i, conf.ID, err)
+		}
+		envelope, err := sig.Marshal()
+		if err != nil {
+			t.Fatalf("in config %d %q, failed to marshal envelope: %v", i, conf.ID, err)
+		}
+		env, payload, _, err := signer.ParseDSSEEnvelope(envelope)
+		if err != nil {
+			t.Fatalf("in config %d %q, failed to parse envelope: %v", i, conf.ID, err)
+		}
+		if env.PayloadType != "application/vnd.in-toto+json" || env.Signatures[0].KeyID != conf.ID || !bytes.Equal(payload, input) {
+			t.Fatalf("in config %d %q, unexpected envelope %s", i, conf.ID, envelope)
+		}
+		sr := formats.SignatureResponse{
+			Type:       s.Config().Type,
+			Mode:       s.Config().Mode,
+			PublicKey:  s.Config().PublicKey,
+			Signature:  envelope,
+			SignerOpts: s.Config().SignerOpts,
+		}
+		err = VerifyGenericRsaSignatureResponse(input, sr)
+		if err != nil {
+			t.Fatalf("in config %d %q, failed to verify envelope: %v", i, conf.ID, err)
+		}
+		err = VerifyGenericRsaSignatureResponse([]byte("another payload"), sr)
+		if err == nil {
+			t.Fatalf("in config %d %q, expected envelope of another payload to fail verification", i, conf.ID)
+		}
+
+		// the signature covers the pre-authentication encoding, not the payload
+		sigBytes, err := base64.StdEncoding.DecodeString(env.Signatures[0].Sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKey := &s.key.(*rsa.PrivateKey).PublicKey
+		err = VerifySignature(signer.PAE(env.PayloadType, input), sigBytes, pubKey, s.sigOpts, s.Mode)
+		if err != nil {
+			t.Fatalf("in config %d %q, failed to verify signature of the pre-authentication encoding: %v", i, conf.ID, err)
+		}
+		err = VerifySignature(input, sigBytes, pubKey, s.sigOpts, s.Mode)
+		if err == nil {
+			t.Fatalf("in config %d %q, expected signature of the payload alone to fail verification", i, conf.ID)
+		}
+
+		_, err = s.SignHash(make([]byte, s.hashSize), options)
+		if errors.Cause(err) != signer.ErrInvalidOptions {
+			t.Fatalf("in config %d %q, expected hash signing with a payload type to fail with invalid options, got %v", i, conf.ID, err)
+		}
+	}
+}
+
 func TestVerifySignatureFromB64(t *testing.T) {
 	t.Parallel()
 
@@ -1,14 +1,15 @@
 package gpg2
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
-	"sync"
+	"runtime"
+	"strings"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -23,18 +24,10 @@ const (
 	// or loading keys exported with gnu-dummy s2k encrypted
 	// passphrases https://github.com/golang/go/issues/13605
 	Type = "gpg2"
-
-	keyRingFilename = "autograph_gpg2_keyring.gpg"
-	secRingFilename = "autograph_gpg2_secring.gpg"
 )
 
 var isAlphanumeric = regexp.MustCompile(`^[a-zA-Z0-9]+$`).MatchString
 
-// gpg2 fails when multiple signers are called at in parallel so we serialize
-// invoking this signer through a global mutex. For more info on this particular
-// piece of gpg sadness, see https://answers.launchpad.net/duplicity/+question/296122
-var serializeSigning sync.Mutex
-
 // GPG2Signer holds the configuration of the signer
 type GPG2Signer struct {
 	signer.Configuration
@@ -47,9 +40,24 @@ type GPG2Signer struct {
 	// gpg secret key
 	passphrase string
 
-	// tmpDir is the signer's temporary working directory. It
-	// holds the gpg sec and keyrings
+	// tmpDir is the signer's temporary working directory. It is
+	// the GNUPGHOME the keys are imported into, and is copied to a
+	// new GNUPGHOME for each signature: gpg fails when several
+	// processes share a homedir and its agent, for more info on
+	// this particular piece of gpg sadness, see
+	// https://answers.launchpad.net/duplicity/+question/296122
 	tmpDir string
+
+	// keyring is the temporary space of tmpDir
+	keyring *signer.TempSpace
+
+	// processes limits the number of gpg processes signing in
+	// parallel. It is a channel rather than a semaphore so
+	// requests can stop waiting for it when their context is done.
+	processes chan struct{}
+
+	// sandbox restricts the gpg processes that sign
+	sandbox *signer.Sandbox
 }
 
 // New initializes a pgp signer using a configuration
@@ -88,55 +96,79 @@ func New(conf signer.Configuration) (s *GPG2Signer, err error) {
 
 	s.passphrase = conf.Passphrase
 
-	s.tmpDir, err = createKeyRing(s)
+	if conf.MaxProcesses < 0 {
+		return nil, errors.New("gpg2: max processes in signer configuration must be positive")
+	}
+	s.MaxProcesses = conf.MaxProcesses
+	if s.MaxProcesses == 0 {
+		s.MaxProcesses = runtime.NumCPU()
+	}
+	s.processes = make(chan struct{}, s.MaxProcesses)
+
+	s.sandbox, err = signer.NewSandbox(conf.Sandbox)
+	if err != nil {
+		return nil, errors.Wrap(err, "gpg2: invalid sandbox in signer configuration")
+	}
+	s.Sandbox = conf.Sandbox
+
+	s.keyring, err = createKeyRing(s)
 	if err != nil {
 		return nil, errors.Wrap(err, "gpg2: error creating keyring")
 	}
+	s.tmpDir = s.keyring.Dir()
 	return
 }
 
-// createKeyRing creates a temporary gpg sec and keyrings, loads the
-// private and public keys for the signer, and returns the temporary
-// director holding the rings
-func createKeyRing(s *GPG2Signer) (string, error) {
+// createKeyRing creates a temporary GNUPGHOME, loads the private and
+// public keys for the signer in it, and returns its temporary space
+func createKeyRing(s *GPG2Signer) (*signer.TempSpace, error) {
 	// reuse keyring in tempdir
 	prefix := fmt.Sprintf("autograph_%s_%s", s.Type, s.KeyID)
 
-	dir, err := ioutil.TempDir("", prefix)
+	space, err := signer.NewTempSpace(prefix, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "gpg2: error creating tempdir for keyring")
+	}
+	err = s.importKeys(space.Dir())
 	if err != nil {
-		return "", errors.Wrap(err, "gpg2: error creating tempdir for keyring")
+		space.Release()
+		return nil, err
 	}
+	return space, nil
+}
 
+// importKeys imports the private and public keys of the signer in a
+// GNUPGHOME
+func (s *GPG2Signer) importKeys(dir string) error {
 	// write the public key to a temp file in our signer's temp dir
 	tmpPublicKeyFile, err := ioutil.TempFile(dir, "gpg2_publickey")
 	if err != nil {
-		return "", errors.Wrap(err, "gpg2: error creating tempfile for public key")
+		return errors.Wrap(err, "gpg2: error creating tempfile for public key")
 	}
 	defer os.Remove(tmpPublicKeyFile.Name())
 	err = ioutil.WriteFile(tmpPublicKeyFile.Name(), []byte(s.PublicKey), 0755)
 	if err != nil {
-		return "", errors.Wrap(err, "gpg2: error writing public key to tempfile")
+		return errors.Wrap(err, "gpg2: error writing public key to tempfile")
 	}
 
 	// write the private key to a temp file in our signer's temp dir
 	tmpPrivateKeyFile, err := ioutil.TempFile(dir, "gpg2_privatekey")
 	if err != nil {
-		return "", errors.Wrap(err, "gpg2: error creating tempfile for private key")
+		return errors.Wrap(err, "gpg2: error creating tempfile for private key")
 	}
 	defer os.Remove(tmpPrivateKeyFile.Name())
 	err = ioutil.WriteFile(tmpPrivateKeyFile.Name(), []byte(s.PrivateKey), 0755)
 	if err != nil {
-		return "", errors.Wrap(err, "gpg2: error writing private key to tempfile")
+		return errors.Wrap(err, "gpg2: error writing private key to tempfile")
 	}
 
-	keyRingPath := filepath.Join(dir, keyRingFilename)
-	secRingPath := filepath.Join(dir, secRingFilename)
+	// the agent gpg starts to import the private key must not be
+	// copied to the homedirs of signatures
+	defer killAgent(nil, dir)
 
 	// call gpg to create a new keyring and load the public key in it
 	gpgLoadPublicKey := exec.Command("gpg",
-		"--no-default-keyring",
-		"--keyring", keyRingPath,
-		"--secret-keyring", secRingPath,
+		"--homedir", dir,
 		"--no-tty",
 		"--batch",
 		"--yes",
@@ -144,32 +176,97 @@ func createKeyRing(s *GPG2Signer) (string, error) {
 	)
 	out, err := gpgLoadPublicKey.CombinedOutput()
 	if err != nil {
-		return "", errors.Wrapf(err, "gpg2: failed to load public key into keyring: %s\n%s", err, out)
+		return errors.Wrapf(err, "gpg2: failed to load public key into keyring: %s\n%s", err, out)
 	}
 	log.Debugf(fmt.Sprintf("gpg2: loaded public key %s", string(out)))
 
 	// call gpg to load the private key in it
-	gpgLoadPrivateKey := exec.Command("gpg", "--no-default-keyring",
-		"--keyring", keyRingPath,
-		"--secret-keyring", secRingPath,
+	gpgLoadPrivateKey := exec.Command("gpg",
+		"--homedir", dir,
 		"--no-tty",
 		"--batch",
 		"--yes",
 		"--import", tmpPrivateKeyFile.Name())
 	out, err = gpgLoadPrivateKey.CombinedOutput()
 	if err != nil {
-		return "", errors.Wrapf(err, "gpg2: failed to load private key into keyring: %s\n%s", err, out)
+		return errors.Wrapf(err, "gpg2: failed to load private key into keyring: %s\n%s", err, out)
 	}
 	log.Debugf(fmt.Sprintf("gpg2: loaded private key %s", string(out)))
 
-	return dir, nil
+	return nil
+
+}
+
+// killAgent stops the gpg-agent of a GNUPGHOME, which would otherwise
+// keep running after its homedir is removed. It runs in the sandbox
+// that started the agent.
+func killAgent(sandbox *signer.Sandbox, homedir string) {
+	out, err := sandbox.CombinedOutput(context.Background(), nil, "gpgconf", "--homedir", homedir, "--kill", "gpg-agent")
+	if err != nil {
+		log.Warnf("gpg2: failed to stop gpg-agent of %s: %v\n%s", homedir, err, out)
+	}
+}
+
+// newRequestHome copies the GNUPGHOME of the signer to a new
+// temporary space for a single signature with size bytes of input,
+// and returns it
+func (s *GPG2Signer) newRequestHome(size int64) (*signer.TempSpace, error) {
+	keyringSize, err := dirSize(s.tmpDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "gpg2: error measuring keyring")
+	}
+	space, err := signer.NewTempSpace(fmt.Sprintf("autograph_%s_%s_req", s.Type, s.KeyID), keyringSize+size)
+	if err != nil {
+		return nil, errors.Wrap(err, "gpg2: error reserving temporary storage for request")
+	}
+	home := space.Dir()
+	err = filepath.Walk(s.tmpDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.tmpDir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(home, rel)
+		switch {
+		case info.IsDir():
+			return os.Mkdir(target, 0700)
+		case info.Mode().IsRegular():
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(target, data, 0600)
+		}
+		// skip the sockets of agents
+		return nil
+	})
+	if err != nil {
+		space.Release()
+		return nil, errors.Wrap(err, "gpg2: error copying keyring for request")
+	}
+	return space, nil
+}
 
+// dirSize returns the size of the regular files under a directory
+func dirSize(dir string) (size int64, err error) {
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
 }
 
-// AtExit removes the temp dir containing the signer key and sec rings
+// AtExit removes the temporary GNUPGHOME containing the signer keys
 // when the app is shut down gracefully
 func (s *GPG2Signer) AtExit() error {
-	err := os.RemoveAll(s.tmpDir)
+	err := s.keyring.Release()
 	if err == nil {
 		log.Infof("gpg2: cleaned up %s in exit handler", s.tmpDir)
 	}
@@ -188,25 +285,40 @@ func (s *GPG2Signer) Config() signer.Configuration {
 
 // SignData takes data and returns an armored signature with pgp header and footer
 func (s *GPG2Signer) SignData(data []byte, options interface{}) (signer.Signature, error) {
-	keyRingPath := filepath.Join(s.tmpDir, keyRingFilename)
-	secRingPath := filepath.Join(s.tmpDir, secRingFilename)
+	return s.SignDataContext(context.Background(), data, options)
+}
 
-	// write the input to a temp file
-	tmpContentFile, err := ioutil.TempFile(s.tmpDir, fmt.Sprintf("gpg2_%s_input", s.ID))
+// SignDataContext is like SignData but stops waiting for other gpg
+// invocations and kills gpg when ctx is done
+func (s *GPG2Signer) SignDataContext(ctx context.Context, data []byte, options interface{}) (signer.Signature, error) {
+	// wait for one of the gpg processes of the signer to be free
+	select {
+	case s.processes <- struct{}{}:
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "gpg2: aborted waiting to sign")
+	}
+	defer func() { <-s.processes }()
+
+	space, err := s.newRequestHome(int64(len(data)))
 	if err != nil {
-		return nil, errors.Wrap(err, "gpg2: failed to create tempfile for input to sign")
+		return nil, err
 	}
-	defer os.Remove(tmpContentFile.Name())
-	ioutil.WriteFile(tmpContentFile.Name(), data, 0755)
+	defer space.Release()
+	home := space.Dir()
+	defer killAgent(s.sandbox, home)
 
-	// take a mutex to prevent multiple invocations of gpg in parallel
-	serializeSigning.Lock()
-	defer serializeSigning.Unlock()
+	// write the input to a temp file
+	contentPath, err := space.WriteFile(fmt.Sprintf("gpg2_%s_input", s.ID), data, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "gpg2: failed to write input to sign to tempfile")
+	}
+	err = s.sandbox.Chown(space)
+	if err != nil {
+		return nil, errors.Wrap(err, "gpg2: failed to prepare sandbox")
+	}
 
-	gpgVerifySig := exec.Command("gpg",
-		"--no-default-keyring",
-		"--keyring", keyRingPath,
-		"--secret-keyring", secRingPath,
+	out, err := s.sandbox.CombinedOutput(ctx, strings.NewReader(s.passphrase), "gpg",
+		"--homedir", home,
 		"--armor",
 		"--no-tty",
 		"--batch",
@@ -215,15 +327,11 @@ func (s *GPG2Signer) SignData(data []byte, options interface{}) (signer.Signatur
 		"--output", "-",
 		"--pinentry-mode", "loopback",
 		"--passphrase-fd", "0",
-		"--detach-sign", tmpContentFile.Name(),
+		"--detach-sign", contentPath,
 	)
-	stdin, err := gpgVerifySig.StdinPipe()
-	if err != nil {
-		return nil, errors.Wrap(err, "gpg2: failed to create stdin pipe for sign cmd")
+	if errors.Cause(err) == signer.ErrSandboxTimeout {
+		return nil, errors.Wrap(err, "gpg2: signing timed out")
 	}
-	io.WriteString(stdin, s.passphrase)
-	stdin.Close()
-	out, err := gpgVerifySig.CombinedOutput()
 	if err != nil {
 		return nil, errors.Wrapf(err, "gpg2: failed to sign input %s\n%s", err, out)
 	}
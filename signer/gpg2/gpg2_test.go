@@ -2,10 +2,16 @@ package gpg2
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"go.mozilla.org/autograph/signer"
 )
@@ -87,6 +93,14 @@ func TestNewSigner(t *testing.T) {
 		invalidConf.KeyID = "!?;\\"
 		assertNewSignerWithConfErrs(t, invalidConf)
 	})
+
+	t.Run("negative MaxProcesses", func(t *testing.T) {
+		t.Parallel()
+
+		invalidConf := gpg2signerconf
+		invalidConf.MaxProcesses = -1
+		assertNewSignerWithConfErrs(t, invalidConf)
+	})
 }
 
 func TestConfig(t *testing.T) {
@@ -439,3 +453,101 @@ gAAPg+05bWI=
 =459B
 -----END PGP PUBLIC KEY BLOCK-----`,
 }
+
+func TestSignDataInParallel(t *testing.T) {
+	conf := gpg2signerconf
+	conf.MaxProcesses = 4
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.AtExit()
+
+	errs := make(chan error, 16)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			_, err := s.SignData([]byte(fmt.Sprintf("parallel input %d", i)), nil)
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("parallel signature failed: %v", err)
+		}
+	}
+
+	// each signature uses its own homedir, removed when it is done
+	homes, err := filepath.Glob(filepath.Join(os.TempDir(), fmt.Sprintf("autograph_%s_%s_req*", s.Type, s.KeyID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(homes) != 0 {
+		t.Fatalf("expected request homedirs to be removed, found %q", homes)
+	}
+}
+
+func TestSignDataWaitsForProcesses(t *testing.T) {
+	conf := gpg2signerconf
+	conf.MaxProcesses = 1
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.AtExit()
+
+	// take the only process slot
+	s.processes <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = s.SignDataContext(ctx, []byte("foo"), nil)
+	if errors.Cause(err) != context.DeadlineExceeded {
+		t.Fatalf("expected the signature to time out waiting for a process, got %v", err)
+	}
+	<-s.processes
+	_, err = s.SignDataContext(context.Background(), []byte("foo"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignDataInSandbox(t *testing.T) {
+	conf := gpg2signerconf
+	conf.Sandbox = signer.SandboxConfig{
+		Timeout:   10 * time.Second,
+		MaxMemory: 1 << 30,
+	}
+	if os.Geteuid() == 0 {
+		conf.Sandbox.User = "nobody"
+	}
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.AtExit()
+	_, err = s.SignData([]byte("sandboxed input"), nil)
+	if err != nil {
+		t.Fatalf("failed to sign in the sandbox: %v", err)
+	}
+
+	// a gpg that hangs is killed after the timeout
+	conf.Sandbox = signer.SandboxConfig{
+		Timeout: 100 * time.Millisecond,
+		Wrapper: []string{"sh", "-c", `sleep 5; exec "$@"`, "sh"},
+	}
+	s, err = New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.AtExit()
+	start := time.Now()
+	_, err = s.SignData([]byte("sandboxed input"), nil)
+	if errors.Cause(err) != signer.ErrSandboxTimeout {
+		t.Fatalf("expected the signature to time out, got %v", err)
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Fatalf("expected the sandbox to kill gpg, it took %s", time.Since(start))
+	}
+
+	conf.Sandbox = signer.SandboxConfig{User: "nosuchsandboxuser"}
+	assertNewSignerWithConfErrs(t, conf)
+}
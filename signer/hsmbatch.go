@@ -0,0 +1,193 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"crypto"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultHSMBatchDelay is how long a batch waits for more
+	// requests when batching does not configure a delay
+	DefaultHSMBatchDelay = time.Millisecond
+
+	// DefaultHSMBatchPipelines is the number of batches signed at
+	// the same time when batching does not configure pipelines
+	DefaultHSMBatchPipelines = 4
+)
+
+// HSMBatchConfig configures the batching of digest signatures made
+// with HSM keys
+type HSMBatchConfig struct {
+	// MaxBatchSize is the maximum number of signatures in a
+	// batch. Batching is disabled when it is zero.
+	MaxBatchSize int
+
+	// MaxDelay is how long the first request of a batch waits
+	// for more requests before the batch is signed
+	MaxDelay time.Duration
+
+	// Pipelines is the number of batches signed at the same time.
+	// Each pipeline signs its batch back to back on one HSM
+	// session at a time, so it should not exceed the number of
+	// sessions the HSM allows.
+	Pipelines int
+}
+
+type hsmSignRequest struct {
+	key    crypto.Signer
+	rand   io.Reader
+	digest []byte
+	opts   crypto.SignerOpts
+	result chan hsmSignResult
+}
+
+type hsmSignResult struct {
+	sig []byte
+	err error
+}
+
+// hsmBatcher coalesces concurrent signing requests into batches and
+// signs them on a fixed number of pipelines, instead of making every
+// request compete for HSM sessions
+type hsmBatcher struct {
+	conf     HSMBatchConfig
+	requests chan *hsmSignRequest
+	batches  chan []*hsmSignRequest
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newHSMBatcher(conf HSMBatchConfig) *hsmBatcher {
+	if conf.MaxDelay <= 0 {
+		conf.MaxDelay = DefaultHSMBatchDelay
+	}
+	if conf.Pipelines <= 0 {
+		conf.Pipelines = DefaultHSMBatchPipelines
+	}
+	b := &hsmBatcher{
+		conf:     conf,
+		requests: make(chan *hsmSignRequest),
+		batches:  make(chan []*hsmSignRequest),
+		stop:     make(chan struct{}),
+	}
+	b.wg.Add(1 + conf.Pipelines)
+	go b.collect()
+	for i := 0; i < conf.Pipelines; i++ {
+		go b.pipeline()
+	}
+	return b
+}
+
+// collect groups requests into batches of up to MaxBatchSize
+// requests, or fewer when MaxDelay passes after the first request
+func (b *hsmBatcher) collect() {
+	defer b.wg.Done()
+	defer close(b.batches)
+	for {
+		var batch []*hsmSignRequest
+		select {
+		case req := <-b.requests:
+			batch = append(batch, req)
+		case <-b.stop:
+			return
+		}
+		timer := time.NewTimer(b.conf.MaxDelay)
+	fill:
+		for len(batch) < b.conf.MaxBatchSize {
+			select {
+			case req := <-b.requests:
+				batch = append(batch, req)
+			case <-timer.C:
+				break fill
+			}
+		}
+		timer.Stop()
+		b.batches <- batch
+	}
+}
+
+// pipeline signs the requests of each batch in order
+func (b *hsmBatcher) pipeline() {
+	defer b.wg.Done()
+	for batch := range b.batches {
+		for _, req := range batch {
+			sig, err := req.key.Sign(req.rand, req.digest, req.opts)
+			req.result <- hsmSignResult{sig, err}
+		}
+	}
+}
+
+// sign queues a request and waits for its signature
+func (b *hsmBatcher) sign(key crypto.Signer, rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	req := &hsmSignRequest{
+		key:    key,
+		rand:   rand,
+		digest: digest,
+		opts:   opts,
+		result: make(chan hsmSignResult, 1),
+	}
+	select {
+	case b.requests <- req:
+	case <-b.stop:
+		return nil, errors.New("hsm batching is stopped")
+	}
+	res := <-req.result
+	return res.sig, res.err
+}
+
+// close stops collecting requests and waits for queued batches
+func (b *hsmBatcher) close() {
+	close(b.stop)
+	b.wg.Wait()
+}
+
+var (
+	hsmBatchMu sync.RWMutex
+	hsmBatch   *hsmBatcher
+)
+
+// ConfigureHSMBatching enables the batching of signatures made with
+// HSM keys, or disables it when conf.MaxBatchSize is zero
+func ConfigureHSMBatching(conf HSMBatchConfig) {
+	hsmBatchMu.Lock()
+	defer hsmBatchMu.Unlock()
+	if hsmBatch != nil {
+		hsmBatch.close()
+		hsmBatch = nil
+	}
+	if conf.MaxBatchSize <= 0 {
+		return
+	}
+	hsmBatch = newHSMBatcher(conf)
+	log.Infof("batching HSM signatures by up to %d requests over %d pipelines with a %s delay",
+		hsmBatch.conf.MaxBatchSize, hsmBatch.conf.Pipelines, hsmBatch.conf.MaxDelay)
+}
+
+// SignWithKey signs a digest with a private key. Signatures made with
+// HSM keys go through the batching pipelines when batching is
+// enabled, and other keys sign directly.
+func SignWithKey(key crypto.PrivateKey, rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	cs, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("private key of type %T does not implement crypto.Signer", key)
+	}
+	if GetPrivKeyHandle(key) == 0 {
+		return cs.Sign(rand, digest, opts)
+	}
+	hsmBatchMu.RLock()
+	b := hsmBatch
+	hsmBatchMu.RUnlock()
+	if b == nil {
+		return cs.Sign(rand, digest, opts)
+	}
+	return b.sign(cs, rand, digest, opts)
+}
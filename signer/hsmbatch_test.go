@@ -0,0 +1,82 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// concurrencySigner records how many signatures it makes at once
+type concurrencySigner struct {
+	*ecdsa.PrivateKey
+	current, max int32
+}
+
+func (s *concurrencySigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	n := atomic.AddInt32(&s.current, 1)
+	defer atomic.AddInt32(&s.current, -1)
+	for {
+		max := atomic.LoadInt32(&s.max)
+		if n <= max || atomic.CompareAndSwapInt32(&s.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+	return s.PrivateKey.Sign(rand, digest, opts)
+}
+
+func TestHSMBatcher(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &concurrencySigner{PrivateKey: key}
+	b := newHSMBatcher(HSMBatchConfig{MaxBatchSize: 8, MaxDelay: 5 * time.Millisecond, Pipelines: 2})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			digest := sha256.Sum256([]byte{byte(i)})
+			sig, err := b.sign(cs, rand.Reader, digest[:], crypto.SHA256)
+			if err != nil {
+				errs <- err
+				return
+			}
+			var esig struct{ R, S *big.Int }
+			_, err = asn1.Unmarshal(sig, &esig)
+			if err != nil || !ecdsa.Verify(&key.PublicKey, digest[:], esig.R, esig.S) {
+				t.Errorf("request %d: signature does not verify", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if cs.max > 2 {
+		t.Fatalf("expected at most 2 signatures at once, got %d", cs.max)
+	}
+
+	b.close()
+	_, err = b.sign(cs, rand.Reader, make([]byte, 32), crypto.SHA256)
+	if err == nil {
+		t.Fatal("expected signing to fail after the batcher is closed")
+	}
+}
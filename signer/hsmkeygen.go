@@ -0,0 +1,361 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/miekg/pkcs11"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// HSMKeyGenConfig configures the PKCS#11 mechanisms and key attributes
+// MakeKey uses to generate keys in the HSM, for HSM key policies that
+// differ from the defaults
+type HSMKeyGenConfig struct {
+	// ECDSAMechanism is the name of the mechanism that generates
+	// ECDSA key pairs, CKM_EC_KEY_PAIR_GEN by default
+	ECDSAMechanism string
+
+	// RSAMechanism is the name of the mechanism that generates RSA
+	// key pairs, CKM_RSA_PKCS_KEY_PAIR_GEN by default
+	RSAMechanism string
+
+	// PrivateKeyAttributes sets boolean attributes of generated
+	// private keys by name, like CKA_EXTRACTABLE: false, over the
+	// default CKA_TOKEN, CKA_SIGN and CKA_SENSITIVE true and
+	// CKA_EXTRACTABLE false. RSA private keys also default to
+	// CKA_DECRYPT true.
+	PrivateKeyAttributes map[string]bool
+
+	// PublicKeyAttributes sets boolean attributes of generated
+	// public keys by name, over the default CKA_TOKEN and
+	// CKA_VERIFY true. RSA public keys also default to CKA_ENCRYPT
+	// true.
+	PublicKeyAttributes map[string]bool
+
+	// ECDSAFallbackMechanisms and RSAFallbackMechanisms are tried
+	// in order when the module rejects the previous mechanism with
+	// CKR_MECHANISM_INVALID
+	ECDSAFallbackMechanisms []string
+	RSAFallbackMechanisms   []string
+
+	// MaxLabelLength is the longest key label the HSM stores, so
+	// longer labels fail before a key is generated. Zero means no
+	// limit.
+	MaxLabelLength int
+
+	// NoKeyID leaves CKA_ID out of the key templates, for HSMs that
+	// assign object IDs themselves, like the 2 bytes IDs of the
+	// YubiHSM2. Keys are looked up by label either way.
+	NoKeyID bool
+}
+
+// hsmKeyGenMechanisms are the key pair generation mechanisms by name
+var hsmKeyGenMechanisms = map[string]uint{
+	"CKM_EC_KEY_PAIR_GEN":        pkcs11.CKM_EC_KEY_PAIR_GEN,
+	"CKM_ECDSA_KEY_PAIR_GEN":     pkcs11.CKM_ECDSA_KEY_PAIR_GEN,
+	"CKM_RSA_PKCS_KEY_PAIR_GEN":  pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN,
+	"CKM_RSA_X9_31_KEY_PAIR_GEN": pkcs11.CKM_RSA_X9_31_KEY_PAIR_GEN,
+}
+
+// hsmKeyAttributes are the boolean key attributes that can be set by name
+var hsmKeyAttributes = map[string]uint{
+	"CKA_TOKEN":               pkcs11.CKA_TOKEN,
+	"CKA_PRIVATE":             pkcs11.CKA_PRIVATE,
+	"CKA_MODIFIABLE":          pkcs11.CKA_MODIFIABLE,
+	"CKA_COPYABLE":            pkcs11.CKA_COPYABLE,
+	"CKA_DESTROYABLE":         pkcs11.CKA_DESTROYABLE,
+	"CKA_SENSITIVE":           pkcs11.CKA_SENSITIVE,
+	"CKA_EXTRACTABLE":         pkcs11.CKA_EXTRACTABLE,
+	"CKA_SIGN":                pkcs11.CKA_SIGN,
+	"CKA_SIGN_RECOVER":        pkcs11.CKA_SIGN_RECOVER,
+	"CKA_VERIFY":              pkcs11.CKA_VERIFY,
+	"CKA_VERIFY_RECOVER":      pkcs11.CKA_VERIFY_RECOVER,
+	"CKA_ENCRYPT":             pkcs11.CKA_ENCRYPT,
+	"CKA_DECRYPT":             pkcs11.CKA_DECRYPT,
+	"CKA_WRAP":                pkcs11.CKA_WRAP,
+	"CKA_UNWRAP":              pkcs11.CKA_UNWRAP,
+	"CKA_DERIVE":              pkcs11.CKA_DERIVE,
+	"CKA_TRUSTED":             pkcs11.CKA_TRUSTED,
+	"CKA_WRAP_WITH_TRUSTED":   pkcs11.CKA_WRAP_WITH_TRUSTED,
+	"CKA_ALWAYS_AUTHENTICATE": pkcs11.CKA_ALWAYS_AUTHENTICATE,
+}
+
+// hsmKeyGenerator is the subset of the PKCS#11 API that generates key
+// pairs, implemented by *pkcs11.Ctx
+type hsmKeyGenerator interface {
+	OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error)
+	CloseSession(sh pkcs11.SessionHandle) error
+	GenerateKeyPair(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, public, private []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error)
+	GetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, a []*pkcs11.Attribute) ([]*pkcs11.Attribute, error)
+}
+
+// named curve OIDs of the CKA_EC_PARAMS of generated ECDSA keys
+var (
+	oidNamedCurveP256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidNamedCurveP384 = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidNamedCurveP521 = asn1.ObjectIdentifier{1, 3, 132, 0, 35}
+)
+
+var (
+	hsmKeyGenMu sync.RWMutex
+	hsmKeyGen   *HSMKeyGenConfig
+)
+
+// ConfigureHSMKeyGen sets the mechanisms and key attributes MakeKey
+// generates HSM keys with. A zero config restores the defaults. It
+// returns an error for unknown mechanisms or attributes, and for
+// private keys that could not sign or would not outlive their session.
+func ConfigureHSMKeyGen(conf HSMKeyGenConfig) error {
+	err := conf.validate()
+	if err != nil {
+		return err
+	}
+	hsmKeyGenMu.Lock()
+	defer hsmKeyGenMu.Unlock()
+	if conf.isZero() {
+		hsmKeyGen = nil
+		return nil
+	}
+	hsmKeyGen = &conf
+	log.Infof("generating HSM keys with ecdsa mechanisms %v, rsa mechanisms %v, private key attributes %v and public key attributes %v",
+		conf.ecdsaMechanisms(), conf.rsaMechanisms(), conf.PrivateKeyAttributes, conf.PublicKeyAttributes)
+	return nil
+}
+
+func (conf HSMKeyGenConfig) isZero() bool {
+	return conf.ECDSAMechanism == "" && conf.RSAMechanism == "" &&
+		len(conf.PrivateKeyAttributes) == 0 && len(conf.PublicKeyAttributes) == 0 &&
+		len(conf.ECDSAFallbackMechanisms) == 0 && len(conf.RSAFallbackMechanisms) == 0 &&
+		conf.MaxLabelLength == 0 && !conf.NoKeyID
+}
+
+// getHSMKeyGen returns the configured key generation policy, or nil
+// when MakeKey uses the defaults
+func getHSMKeyGen() *HSMKeyGenConfig {
+	hsmKeyGenMu.RLock()
+	defer hsmKeyGenMu.RUnlock()
+	return hsmKeyGen
+}
+
+func (conf HSMKeyGenConfig) validate() error {
+	for _, mech := range append(conf.ecdsaMechanisms(), conf.rsaMechanisms()...) {
+		if _, ok := hsmKeyGenMechanisms[mech]; !ok {
+			return errors.Errorf("hsmkeygen: unknown key pair generation mechanism %q", mech)
+		}
+	}
+	for name, attrs := range map[string]map[string]bool{
+		"private key": conf.PrivateKeyAttributes,
+		"public key":  conf.PublicKeyAttributes,
+	} {
+		for attr := range attrs {
+			if _, ok := hsmKeyAttributes[attr]; !ok {
+				return errors.Errorf("hsmkeygen: unknown %s attribute %q", name, attr)
+			}
+		}
+	}
+	// keys are looked up by label after they are made, and
+	// made to sign
+	for _, attr := range []string{"CKA_TOKEN", "CKA_SIGN"} {
+		if value, ok := conf.PrivateKeyAttributes[attr]; ok && !value {
+			return errors.Errorf("hsmkeygen: private key attribute %s cannot be false", attr)
+		}
+	}
+	if value, ok := conf.PublicKeyAttributes["CKA_TOKEN"]; ok && !value {
+		return errors.New("hsmkeygen: public key attribute CKA_TOKEN cannot be false")
+	}
+	return nil
+}
+
+// ecdsaMechanisms returns the ECDSA key pair generation mechanisms in
+// the order they are tried
+func (conf HSMKeyGenConfig) ecdsaMechanisms() []string {
+	mech := conf.ECDSAMechanism
+	if mech == "" {
+		mech = "CKM_EC_KEY_PAIR_GEN"
+	}
+	return append([]string{mech}, conf.ECDSAFallbackMechanisms...)
+}
+
+// rsaMechanisms returns the RSA key pair generation mechanisms in the
+// order they are tried
+func (conf HSMKeyGenConfig) rsaMechanisms() []string {
+	mech := conf.RSAMechanism
+	if mech == "" {
+		mech = "CKM_RSA_PKCS_KEY_PAIR_GEN"
+	}
+	return append([]string{mech}, conf.RSAFallbackMechanisms...)
+}
+
+// templates returns the public and private key templates of a key pair
+// with the default boolean attributes of its key type overridden by
+// the configured ones
+func (conf HSMKeyGenConfig) templates(keyType uint, label []byte, pubParams []*pkcs11.Attribute) (pubTpl, privTpl []*pkcs11.Attribute) {
+	pubDefaults := map[string]bool{"CKA_TOKEN": true, "CKA_VERIFY": true}
+	privDefaults := map[string]bool{"CKA_TOKEN": true, "CKA_SIGN": true, "CKA_SENSITIVE": true, "CKA_EXTRACTABLE": false}
+	if keyType == pkcs11.CKK_RSA {
+		pubDefaults["CKA_ENCRYPT"] = true
+		privDefaults["CKA_DECRYPT"] = true
+	}
+	pubTpl = []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	privTpl = []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if !conf.NoKeyID {
+		pubTpl = append(pubTpl, pkcs11.NewAttribute(pkcs11.CKA_ID, label))
+		privTpl = append(privTpl, pkcs11.NewAttribute(pkcs11.CKA_ID, label))
+	}
+	pubTpl = append(pubTpl, pubParams...)
+	pubTpl = append(pubTpl, booleanAttributes(pubDefaults, conf.PublicKeyAttributes)...)
+	privTpl = append(privTpl, booleanAttributes(privDefaults, conf.PrivateKeyAttributes)...)
+	return
+}
+
+// booleanAttributes returns the attributes of defaults overridden by
+// overrides, sorted by name so templates are stable
+func booleanAttributes(defaults, overrides map[string]bool) (attrs []*pkcs11.Attribute) {
+	values := make(map[string]bool, len(defaults)+len(overrides))
+	for name, value := range defaults {
+		values[name] = value
+	}
+	for name, value := range overrides {
+		values[name] = value
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attrs = append(attrs, pkcs11.NewAttribute(hsmKeyAttributes[name], values[name]))
+	}
+	return
+}
+
+// makeHSMKey generates a key pair in a slot of the HSM with the
+// configured mechanisms and attributes, using the label as CKA_LABEL
+// and CKA_ID like crypto11 does unless the HSM assigns IDs
+func (conf HSMKeyGenConfig) makeHSMKey(ctx hsmKeyGenerator, slot uint, keyTpl interface{}, label []byte) (crypto.PrivateKey, crypto.PublicKey, error) {
+	if conf.MaxLabelLength > 0 && len(label) > conf.MaxLabelLength {
+		return nil, nil, errors.Errorf("key label %q is longer than the %d bytes the hsm stores", label, conf.MaxLabelLength)
+	}
+	var (
+		keyType   uint
+		mechNames []string
+		pubParams []*pkcs11.Attribute
+	)
+	switch keyTplType := keyTpl.(type) {
+	case *ecdsa.PublicKey:
+		var oid asn1.ObjectIdentifier
+		switch keyTplType.Params().Name {
+		case "P-256":
+			oid = oidNamedCurveP256
+		case "P-384":
+			oid = oidNamedCurveP384
+		case "P-521":
+			oid = oidNamedCurveP521
+		default:
+			return nil, nil, errors.Errorf("unsupported curve %q", keyTplType.Params().Name)
+		}
+		params, err := asn1.Marshal(oid)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to marshal ec params")
+		}
+		keyType, mechNames = pkcs11.CKK_EC, conf.ecdsaMechanisms()
+		pubParams = []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params)}
+	case *rsa.PublicKey:
+		keyType, mechNames = pkcs11.CKK_RSA, conf.rsaMechanisms()
+		pubParams = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, keyTplType.Size()*8),
+		}
+	default:
+		return nil, nil, errors.Errorf("making key of type %T is not supported", keyTpl)
+	}
+	pubTpl, privTpl := conf.templates(keyType, label, pubParams)
+
+	// the session shares the login of the crypto11 sessions, and
+	// the token objects it makes outlive it
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to open hsm session")
+	}
+	defer ctx.CloseSession(session)
+	var pubHandle, privHandle pkcs11.ObjectHandle
+	for i, mechName := range mechNames {
+		mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(hsmKeyGenMechanisms[mechName], nil)}
+		pubHandle, privHandle, err = ctx.GenerateKeyPair(session, mech, pubTpl, privTpl)
+		if err == nil {
+			break
+		}
+		if err != pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID) || i == len(mechNames)-1 {
+			return nil, nil, errors.Wrapf(err, "failed to generate key pair with %s", mechName)
+		}
+		log.Warnf("hsm rejected key pair generation mechanism %s, falling back to %s", mechName, mechNames[i+1])
+	}
+	switch keyTplType := keyTpl.(type) {
+	case *ecdsa.PublicKey:
+		attrs, err := ctx.GetAttributeValue(session, pubHandle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to read ec point of generated key")
+		}
+		pub, err := unmarshalECPoint(keyTplType.Curve, attrs[0].Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &crypto11.PKCS11PrivateKeyECDSA{PKCS11PrivateKey: crypto11.PKCS11PrivateKey{
+			PKCS11Object: crypto11.PKCS11Object{Handle: privHandle, Slot: slot},
+			PubKey:       pub,
+		}}, pub, nil
+	default:
+		attrs, err := ctx.GetAttributeValue(session, pubHandle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to read modulus of generated key")
+		}
+		pub := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}
+		return &crypto11.PKCS11PrivateKeyRSA{PKCS11PrivateKey: crypto11.PKCS11PrivateKey{
+			PKCS11Object: crypto11.PKCS11Object{Handle: privHandle, Slot: slot},
+			PubKey:       pub,
+		}}, pub, nil
+	}
+}
+
+// unmarshalECPoint parses the CKA_EC_POINT of a public key, which HSMs
+// return either DER encoded in an octet string as the standard requires,
+// or raw
+func unmarshalECPoint(curve elliptic.Curve, point []byte) (*ecdsa.PublicKey, error) {
+	var raw []byte
+	rest, err := asn1.Unmarshal(point, &raw)
+	if err != nil || len(rest) != 0 {
+		raw = point
+	}
+	x, y := elliptic.Unmarshal(curve, raw)
+	if x == nil {
+		return nil, errors.New("failed to parse ec point of generated key")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
@@ -0,0 +1,124 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"strings"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+func TestConfigureHSMKeyGen(t *testing.T) {
+	for i, testcase := range []struct {
+		conf HSMKeyGenConfig
+		err  string
+	}{
+		{HSMKeyGenConfig{}, ""},
+		{HSMKeyGenConfig{ECDSAMechanism: "CKM_ECDSA_KEY_PAIR_GEN", RSAMechanism: "CKM_RSA_X9_31_KEY_PAIR_GEN"}, ""},
+		{HSMKeyGenConfig{PrivateKeyAttributes: map[string]bool{"CKA_EXTRACTABLE": false, "CKA_MODIFIABLE": false, "CKA_TOKEN": true}}, ""},
+		{HSMKeyGenConfig{ECDSAMechanism: "CKM_AES_KEY_GEN"}, `unknown key pair generation mechanism "CKM_AES_KEY_GEN"`},
+		{HSMKeyGenConfig{PublicKeyAttributes: map[string]bool{"CKA_FOO": true}}, `unknown public key attribute "CKA_FOO"`},
+		{HSMKeyGenConfig{PrivateKeyAttributes: map[string]bool{"CKA_SIGN": false}}, "private key attribute CKA_SIGN cannot be false"},
+		{HSMKeyGenConfig{PrivateKeyAttributes: map[string]bool{"CKA_TOKEN": false}}, "private key attribute CKA_TOKEN cannot be false"},
+		{HSMKeyGenConfig{PublicKeyAttributes: map[string]bool{"CKA_TOKEN": false}}, "public key attribute CKA_TOKEN cannot be false"},
+	} {
+		err := ConfigureHSMKeyGen(testcase.conf)
+		if testcase.err == "" && err != nil {
+			t.Fatalf("testcase %d: unexpected error: %v", i, err)
+		}
+		if testcase.err != "" && (err == nil || !strings.Contains(err.Error(), testcase.err)) {
+			t.Fatalf("testcase %d: expected error %q, got %v", i, testcase.err, err)
+		}
+	}
+	defer ConfigureHSMKeyGen(HSMKeyGenConfig{})
+
+	err := ConfigureHSMKeyGen(HSMKeyGenConfig{RSAMechanism: "CKM_RSA_X9_31_KEY_PAIR_GEN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyGen := getHSMKeyGen(); keyGen == nil || keyGen.rsaMechanisms()[0] != "CKM_RSA_X9_31_KEY_PAIR_GEN" || keyGen.ecdsaMechanisms()[0] != "CKM_EC_KEY_PAIR_GEN" {
+		t.Fatalf("unexpected key generation config %+v", keyGen)
+	}
+	err = ConfigureHSMKeyGen(HSMKeyGenConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyGen := getHSMKeyGen(); keyGen != nil {
+		t.Fatalf("expected a zero config to restore the defaults, got %+v", keyGen)
+	}
+}
+
+func TestHSMKeyGenTemplates(t *testing.T) {
+	boolAttr := func(tpl []*pkcs11.Attribute, attrType uint) (value, found bool) {
+		for _, attr := range tpl {
+			if attr.Type == attrType {
+				return len(attr.Value) == 1 && attr.Value[0] == 1, true
+			}
+		}
+		return false, false
+	}
+	conf := HSMKeyGenConfig{
+		PrivateKeyAttributes: map[string]bool{"CKA_MODIFIABLE": false, "CKA_SENSITIVE": true, "CKA_DECRYPT": false},
+		PublicKeyAttributes:  map[string]bool{"CKA_ENCRYPT": false},
+	}
+	pubTpl, privTpl := conf.templates(pkcs11.CKK_RSA, []byte("testkey"), nil)
+	for _, testcase := range []struct {
+		tpl      []*pkcs11.Attribute
+		attr     uint
+		name     string
+		expected bool
+	}{
+		{privTpl, pkcs11.CKA_TOKEN, "private CKA_TOKEN", true},
+		{privTpl, pkcs11.CKA_SIGN, "private CKA_SIGN", true},
+		{privTpl, pkcs11.CKA_EXTRACTABLE, "private CKA_EXTRACTABLE", false},
+		{privTpl, pkcs11.CKA_MODIFIABLE, "private CKA_MODIFIABLE", false},
+		{privTpl, pkcs11.CKA_DECRYPT, "private CKA_DECRYPT", false},
+		{pubTpl, pkcs11.CKA_VERIFY, "public CKA_VERIFY", true},
+		{pubTpl, pkcs11.CKA_ENCRYPT, "public CKA_ENCRYPT", false},
+	} {
+		value, found := boolAttr(testcase.tpl, testcase.attr)
+		if !found || value != testcase.expected {
+			t.Errorf("expected %s %t, got %t (found %t)", testcase.name, testcase.expected, value, found)
+		}
+	}
+	// ECDSA keys don't default to the RSA encryption attributes
+	pubTpl, privTpl = HSMKeyGenConfig{}.templates(pkcs11.CKK_EC, []byte("testkey"), nil)
+	if _, found := boolAttr(privTpl, pkcs11.CKA_DECRYPT); found {
+		t.Error("expected no CKA_DECRYPT in the ecdsa private key template")
+	}
+	if _, found := boolAttr(pubTpl, pkcs11.CKA_ENCRYPT); found {
+		t.Error("expected no CKA_ENCRYPT in the ecdsa public key template")
+	}
+}
+
+func TestUnmarshalECPoint(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := elliptic.Marshal(elliptic.P384(), priv.X, priv.Y)
+	der, err := asn1.Marshal(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, point := range [][]byte{der, raw} {
+		pub, err := unmarshalECPoint(elliptic.P384(), point)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pub.X.Cmp(priv.X) != 0 || pub.Y.Cmp(priv.Y) != 0 {
+			t.Fatal("parsed ec point does not match the public key")
+		}
+	}
+	_, err = unmarshalECPoint(elliptic.P384(), []byte("not a point"))
+	if err == nil {
+		t.Fatal("expected an invalid ec point to fail")
+	}
+}
@@ -0,0 +1,80 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"crypto"
+	"strings"
+	"sync"
+
+	"github.com/ThalesIgnite/crypto11"
+	log "github.com/sirupsen/logrus"
+)
+
+// hsmKeys caches the keys found in the HSM by label, so lookups of
+// the same label from signer initialization, lazy and degraded signer
+// retries and end-entity lookups reuse the PKCS#11 object handles
+// instead of searching the HSM again
+var hsmKeys = struct {
+	sync.RWMutex
+	byLabel map[string]crypto.PrivateKey
+}{byLabel: make(map[string]crypto.PrivateKey)}
+
+// findHSMKey returns the cached key for an HSM label, or searches the
+// HSM for it and caches the result
+func findHSMKey(label string) (crypto.PrivateKey, error) {
+	hsmKeys.RLock()
+	key, ok := hsmKeys.byLabel[label]
+	hsmKeys.RUnlock()
+	if ok {
+		return key, nil
+	}
+	key, err := crypto11.FindKeyPair(nil, []byte(label))
+	if err != nil {
+		return nil, err
+	}
+	cacheHSMKey(label, key)
+	return key, nil
+}
+
+// cacheHSMKey stores the key of an HSM label
+func cacheHSMKey(label string, key crypto.PrivateKey) {
+	hsmKeys.Lock()
+	hsmKeys.byLabel[label] = key
+	hsmKeys.Unlock()
+}
+
+// ResetHSMKeyCache drops the cached HSM keys, so the next lookups
+// search the HSM for their labels again. The heartbeat calls it when
+// the HSM is unreachable, since handles may not survive a reconnect.
+func ResetHSMKeyCache() {
+	hsmKeys.Lock()
+	hsmKeys.byLabel = make(map[string]crypto.PrivateKey)
+	hsmKeys.Unlock()
+}
+
+// PrewarmHSMKeys looks up and caches the HSM keys of the private and
+// issuer key labels of signer configurations. Labels that cannot be
+// found are logged and skipped, since signers report their own errors
+// when they initialize. It returns the number of cached keys.
+func PrewarmHSMKeys(confs []Configuration) (n int) {
+	for _, conf := range confs {
+		if !conf.isHsmAvailable {
+			continue
+		}
+		for _, label := range []string{conf.PrivateKey, conf.IssuerPrivKey} {
+			if label == "" || strings.HasPrefix(removePrivateKeyNewlines(label), "-----BEGIN") {
+				continue
+			}
+			_, err := findHSMKey(label)
+			if err != nil {
+				log.Warnf("signer %q: failed to prewarm HSM key %q: %v", conf.ID, label, err)
+				continue
+			}
+			n++
+		}
+	}
+	return
+}
@@ -0,0 +1,43 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+)
+
+func TestHSMKeyCache(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheHSMKey("cachedkey", key)
+	defer ResetHSMKeyCache()
+
+	cached, err := findHSMKey("cachedkey")
+	if err != nil {
+		t.Fatalf("expected cached key to be found without an HSM, got: %v", err)
+	}
+	if cached != key {
+		t.Fatalf("expected the cached key, got %v", cached)
+	}
+
+	// signers without an HSM are not looked up
+	n := PrewarmHSMKeys([]Configuration{{ID: "nohsm", PrivateKey: "somelabel"}})
+	if n != 0 {
+		t.Fatalf("expected no key to be prewarmed without an HSM, got %d", n)
+	}
+
+	ResetHSMKeyCache()
+	hsmKeys.RLock()
+	_, ok := hsmKeys.byLabel["cachedkey"]
+	hsmKeys.RUnlock()
+	if ok {
+		t.Fatal("expected the key cache to be empty after a reset")
+	}
+}
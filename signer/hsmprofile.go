@@ -0,0 +1,109 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/pkg/errors"
+)
+
+// HSMProfile holds the PKCS#11 session settings and key generation
+// quirks of a family of HSMs, so deployments don't need to tune them
+type HSMProfile struct {
+	Name string
+
+	// MaxSessions is the number of sessions the module allows.
+	// crypto11 opens up to 1024 by default, and refuses to start
+	// when the token reports a lower maximum.
+	MaxSessions int
+
+	// IdleTimeout evicts idle sessions from the pool before the
+	// HSM expires them
+	IdleTimeout time.Duration
+
+	// PoolWaitTimeout bounds how long a signature waits for a
+	// session when they are all in use
+	PoolWaitTimeout time.Duration
+
+	// KeyGen holds the key generation defaults of the HSM
+	KeyGen HSMKeyGenConfig
+}
+
+var hsmProfiles = map[string]HSMProfile{
+	// The YubiHSM2 allows 16 sessions, which it closes after 30
+	// seconds without a command. Its objects have 2 bytes IDs the
+	// device assigns when CKA_ID is not set, and labels of up to
+	// 40 bytes.
+	"yubihsm2": {
+		Name:            "yubihsm2",
+		MaxSessions:     16,
+		IdleTimeout:     25 * time.Second,
+		PoolWaitTimeout: 30 * time.Second,
+		KeyGen: HSMKeyGenConfig{
+			MaxLabelLength: 40,
+			NoKeyID:        true,
+		},
+	},
+	// The Nitrokey HSM 2 is a smart card the OpenSC module sends
+	// one command at a time, so a few sessions avoid queueing
+	// signatures behind slow key generations. Key generation falls
+	// back to X9.31 RSA keys on modules without the PKCS #1
+	// mechanism.
+	"nitrokey": {
+		Name:            "nitrokey",
+		MaxSessions:     4,
+		PoolWaitTimeout: time.Minute,
+		KeyGen: HSMKeyGenConfig{
+			RSAFallbackMechanisms: []string{"CKM_RSA_X9_31_KEY_PAIR_GEN"},
+		},
+	},
+}
+
+// GetHSMProfile returns the compatibility profile of an HSM by name
+func GetHSMProfile(name string) (HSMProfile, error) {
+	profile, ok := hsmProfiles[name]
+	if !ok {
+		var names []string
+		for name := range hsmProfiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return HSMProfile{}, errors.Errorf("unknown hsm profile %q, expected one of %v", name, names)
+	}
+	return profile, nil
+}
+
+// Apply sets the settings of the profile that hsm and keyGen leave
+// unset, so settings configured explicitly take precedence
+func (p HSMProfile) Apply(hsm *crypto11.PKCS11Config, keyGen *HSMKeyGenConfig) {
+	if hsm.MaxSessions == 0 {
+		hsm.MaxSessions = p.MaxSessions
+	}
+	if hsm.IdleTimeout == 0 {
+		hsm.IdleTimeout = p.IdleTimeout
+	}
+	if hsm.PoolWaitTimeout == 0 {
+		hsm.PoolWaitTimeout = p.PoolWaitTimeout
+	}
+	if keyGen.ECDSAMechanism == "" {
+		keyGen.ECDSAMechanism = p.KeyGen.ECDSAMechanism
+	}
+	if keyGen.RSAMechanism == "" {
+		keyGen.RSAMechanism = p.KeyGen.RSAMechanism
+	}
+	if len(keyGen.ECDSAFallbackMechanisms) == 0 {
+		keyGen.ECDSAFallbackMechanisms = p.KeyGen.ECDSAFallbackMechanisms
+	}
+	if len(keyGen.RSAFallbackMechanisms) == 0 {
+		keyGen.RSAFallbackMechanisms = p.KeyGen.RSAFallbackMechanisms
+	}
+	if keyGen.MaxLabelLength == 0 {
+		keyGen.MaxLabelLength = p.KeyGen.MaxLabelLength
+	}
+	keyGen.NoKeyID = keyGen.NoKeyID || p.KeyGen.NoKeyID
+}
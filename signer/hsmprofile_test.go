@@ -0,0 +1,199 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/miekg/pkcs11"
+)
+
+// fakeHSM generates keys in memory the way a PKCS#11 module with the
+// quirks of a small HSM would
+type fakeHSM struct {
+	// mechanisms the module supports
+	mechanisms map[uint]bool
+	// maxIDLength rejects longer CKA_ID values, zero allows any
+	maxIDLength int
+
+	sessions   int
+	generated  []uint
+	ecPoints   map[pkcs11.ObjectHandle][]byte
+	rsaModulus map[pkcs11.ObjectHandle]*rsa.PublicKey
+}
+
+func (f *fakeHSM) OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error) {
+	f.sessions++
+	return pkcs11.SessionHandle(f.sessions), nil
+}
+
+func (f *fakeHSM) CloseSession(sh pkcs11.SessionHandle) error {
+	f.sessions--
+	return nil
+}
+
+func (f *fakeHSM) GenerateKeyPair(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, public, private []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	if !f.mechanisms[m[0].Mechanism] {
+		return 0, 0, pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+	}
+	var params []byte
+	var bits int
+	for _, attr := range append(public, private...) {
+		switch attr.Type {
+		case pkcs11.CKA_ID:
+			if f.maxIDLength > 0 && len(attr.Value) > f.maxIDLength {
+				return 0, 0, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_VALUE_INVALID)
+			}
+		case pkcs11.CKA_EC_PARAMS:
+			params = attr.Value
+		case pkcs11.CKA_MODULUS_BITS:
+			bits = int(new(big.Int).SetBytes(reverse(attr.Value)).Int64())
+		}
+	}
+	f.generated = append(f.generated, m[0].Mechanism)
+	handle := pkcs11.ObjectHandle(2 * len(f.generated))
+	if params != nil {
+		var oid asn1.ObjectIdentifier
+		_, err := asn1.Unmarshal(params, &oid)
+		if err != nil || !oid.Equal(oidNamedCurveP384) {
+			return 0, 0, pkcs11.Error(pkcs11.CKR_DOMAIN_PARAMS_INVALID)
+		}
+		priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		if err != nil {
+			return 0, 0, err
+		}
+		point, err := asn1.Marshal(elliptic.Marshal(elliptic.P384(), priv.X, priv.Y))
+		if err != nil {
+			return 0, 0, err
+		}
+		f.ecPoints[handle] = point
+	} else {
+		priv, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return 0, 0, err
+		}
+		f.rsaModulus[handle] = &priv.PublicKey
+	}
+	return handle, handle + 1, nil
+}
+
+func (f *fakeHSM) GetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, a []*pkcs11.Attribute) ([]*pkcs11.Attribute, error) {
+	var attrs []*pkcs11.Attribute
+	for _, attr := range a {
+		switch attr.Type {
+		case pkcs11.CKA_EC_POINT:
+			attrs = append(attrs, pkcs11.NewAttribute(attr.Type, f.ecPoints[o]))
+		case pkcs11.CKA_MODULUS:
+			attrs = append(attrs, pkcs11.NewAttribute(attr.Type, f.rsaModulus[o].N.Bytes()))
+		case pkcs11.CKA_PUBLIC_EXPONENT:
+			attrs = append(attrs, pkcs11.NewAttribute(attr.Type, big.NewInt(int64(f.rsaModulus[o].E)).Bytes()))
+		}
+	}
+	return attrs, nil
+}
+
+// reverse returns the big endian bytes of a little endian PKCS#11 ulong
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+func TestHSMProfiles(t *testing.T) {
+	_, err := GetHSMProfile("cloudhsm9000")
+	if err == nil || !strings.Contains(err.Error(), "expected one of [nitrokey yubihsm2]") {
+		t.Fatalf("expected unknown profile error, got %v", err)
+	}
+
+	t.Run("yubihsm2", func(t *testing.T) {
+		profile, err := GetHSMProfile("yubihsm2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hsm := crypto11.PKCS11Config{MaxSessions: 8}
+		var keyGen HSMKeyGenConfig
+		profile.Apply(&hsm, &keyGen)
+		if hsm.MaxSessions != 8 || hsm.IdleTimeout != 25*time.Second || hsm.PoolWaitTimeout != 30*time.Second {
+			t.Fatalf("unexpected session settings %+v", hsm)
+		}
+		err = keyGen.validate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the yubihsm2 rejects crypto11's CKA_ID of the whole label
+		f := &fakeHSM{
+			mechanisms:  map[uint]bool{pkcs11.CKM_EC_KEY_PAIR_GEN: true, pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN: true},
+			maxIDLength: 2,
+			ecPoints:    make(map[pkcs11.ObjectHandle][]byte),
+			rsaModulus:  make(map[pkcs11.ObjectHandle]*rsa.PublicKey),
+		}
+		_, _, err = HSMKeyGenConfig{}.makeHSMKey(f, 0, &ecdsa.PublicKey{Curve: elliptic.P384()}, []byte("normandy-20200901120000"))
+		if err == nil {
+			t.Fatal("expected the fake yubihsm2 to reject the key id")
+		}
+		priv, pub, err := keyGen.makeHSMKey(f, 0, &ecdsa.PublicKey{Curve: elliptic.P384()}, []byte("normandy-20200901120000"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pub.(*ecdsa.PublicKey).Curve != elliptic.P384() || priv.(*crypto11.PKCS11PrivateKeyECDSA).PubKey != pub {
+			t.Fatalf("unexpected key pair %T %T", priv, pub)
+		}
+		_, _, err = keyGen.makeHSMKey(f, 0, &ecdsa.PublicKey{Curve: elliptic.P384()}, []byte(strings.Repeat("a", 41)))
+		if err == nil || !strings.Contains(err.Error(), "longer than the 40 bytes") {
+			t.Fatalf("expected a long label to fail, got %v", err)
+		}
+		if f.sessions != 0 {
+			t.Fatalf("expected all sessions to be closed, %d are open", f.sessions)
+		}
+	})
+
+	t.Run("nitrokey", func(t *testing.T) {
+		profile, err := GetHSMProfile("nitrokey")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hsm crypto11.PKCS11Config
+		keyGen := HSMKeyGenConfig{PrivateKeyAttributes: map[string]bool{"CKA_MODIFIABLE": false}}
+		profile.Apply(&hsm, &keyGen)
+		if hsm.MaxSessions != 4 || keyGen.PrivateKeyAttributes["CKA_MODIFIABLE"] || keyGen.NoKeyID {
+			t.Fatalf("unexpected settings %+v %+v", hsm, keyGen)
+		}
+		err = keyGen.validate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := &fakeHSM{
+			mechanisms: map[uint]bool{pkcs11.CKM_EC_KEY_PAIR_GEN: true, pkcs11.CKM_RSA_X9_31_KEY_PAIR_GEN: true},
+			ecPoints:   make(map[pkcs11.ObjectHandle][]byte),
+			rsaModulus: make(map[pkcs11.ObjectHandle]*rsa.PublicKey),
+		}
+		_, pub, err := keyGen.makeHSMKey(f, 0, &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 1023)}, []byte("testkey"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pub.(*rsa.PublicKey).N.BitLen() != 1024 || pub.(*rsa.PublicKey).E != 65537 {
+			t.Fatalf("unexpected rsa public key of %d bits", pub.(*rsa.PublicKey).N.BitLen())
+		}
+		if len(f.generated) != 1 || f.generated[0] != pkcs11.CKM_RSA_X9_31_KEY_PAIR_GEN {
+			t.Fatalf("expected key generation to fall back to x9.31, got mechanisms %v", f.generated)
+		}
+		// without a fallback the mechanism error is returned
+		_, _, err = HSMKeyGenConfig{}.makeHSMKey(f, 0, &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 1023)}, []byte("testkey"))
+		if err == nil || !strings.Contains(err.Error(), "CKM_RSA_PKCS_KEY_PAIR_GEN") {
+			t.Fatalf("expected the pkcs1 mechanism to fail, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package macos
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/pkcs7"
+)
+
+// oidCDHashesPlist is the signed attribute with the plist of the code
+// directory hashes a code signature covers
+var oidCDHashesPlist = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 9, 1}
+
+// signCMS returns a detached CMS signature of data using SHA256,
+// with the certificate chain of the signer and extra signed
+// attributes. When timestamp is true and the signer has a TSA, the
+// signature is countersigned with an RFC 3161 timestamp.
+func (s *MacOSSigner) signCMS(ctx context.Context, data []byte, attrs []pkcs7.Attribute, timestamp bool) ([]byte, error) {
+	toBeSigned, err := pkcs7.NewSignedData(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "macos: cannot initialize signed data")
+	}
+	toBeSigned.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	err = toBeSigned.AddSignerChain(s.chain[0], s.key, s.chain[1:], pkcs7.SignerInfoConfig{
+		ExtraSignedAttributes: attrs,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "macos: cannot sign")
+	}
+	if timestamp && s.Timestamp.URL != "" {
+		err = signer.TimestampPKCS7(ctx, s.Timestamp, toBeSigned)
+		if err != nil {
+			return nil, errors.Wrap(err, "macos: cannot timestamp signature")
+		}
+	}
+	toBeSigned.Detach()
+	sig, err := toBeSigned.Finish()
+	if err != nil {
+		return nil, errors.Wrap(err, "macos: cannot finish signing data")
+	}
+	return sig, nil
+}
+
+// verifyCMS verifies a detached CMS signature of data and returns the
+// certificate of the signer
+func verifyCMS(sig, data []byte, roots *x509.CertPool) (*x509.Certificate, error) {
+	p7, err := pkcs7.Parse(sig)
+	if err != nil {
+		return nil, errors.Wrap(err, "macos: failed to parse CMS signature")
+	}
+	p7.Content = data
+	err = p7.VerifyWithChain(roots)
+	if err != nil {
+		return nil, errors.Wrap(err, "macos: failed to verify CMS signature")
+	}
+	_, err = signer.VerifyPKCS7Timestamps(p7, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "macos: failed to verify CMS signature timestamp")
+	}
+	cert := p7.GetOnlySigner()
+	if cert == nil {
+		return nil, errors.New("macos: CMS signature must have exactly one signer")
+	}
+	return cert, nil
+}
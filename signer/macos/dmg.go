@@ -0,0 +1,398 @@
+package macos
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/pkcs7"
+)
+
+// A UDIF disk image ends with a 512 bytes koly trailer, which locates
+// its data fork, resource fork and code signature. The code signature
+// is an embedded signature superblob placed between the image data
+// and the trailer, like the ones codesign embeds in Mach-O binaries.
+const (
+	kolyMagic = "koly"
+	kolySize  = 512
+
+	// offsets of the code signature location in the koly trailer
+	kolyCodeSignatureOffset = 296
+	kolyCodeSignatureSize   = 304
+
+	// magic numbers of the code signature blobs
+	magicEmbeddedSignature = 0xfade0cc0
+	magicCodeDirectory     = 0xfade0c02
+	magicBlobWrapper       = 0xfade0b01
+
+	// types of the blobs in the superblob index
+	slotCodeDirectory = 0
+	slotRequirements  = 2
+	slotSignature     = 0x10000
+
+	// special slots of the code directory, whose hashes are
+	// stored before the page hashes in reverse order
+	specialSlotRequirements = 2
+	specialSlotRepSpecific  = 6
+	numSpecialSlots         = 6
+
+	// codeDirectoryVersion supports team IDs
+	codeDirectoryVersion = 0x20200
+	codeDirectorySize    = 52
+
+	hashTypeSHA256 = 2
+	pageSizeLog2   = 12
+	pageSize       = 1 << pageSizeLog2
+
+	// cmsSizeMargin is the room reserved for the CMS signature in
+	// addition to the certificate chain
+	cmsSizeMargin = 4096
+
+	// timestampSizeMargin is the room reserved for the timestamp
+	// token and TSA certificates of timestamped CMS signatures
+	timestampSizeMargin = 8192
+)
+
+// emptyRequirements is a requirements blob without requirements
+var emptyRequirements = []byte{0xfa, 0xde, 0x0c, 0x01, 0, 0, 0, 12, 0, 0, 0, 0}
+
+// codeDirectory is the code directory of a disk image
+type codeDirectory struct {
+	identifier   string
+	teamID       string
+	codeLimit    uint32
+	specialSlots [numSpecialSlots][]byte
+	codeSlots    [][]byte
+}
+
+// marshal returns the code directory blob
+func (cd *codeDirectory) marshal() []byte {
+	identOffset := codeDirectorySize
+	teamOffset := 0
+	hashOffset := identOffset + len(cd.identifier) + 1
+	if cd.teamID != "" {
+		teamOffset = hashOffset
+		hashOffset += len(cd.teamID) + 1
+	}
+	hashOffset += numSpecialSlots * sha256.Size
+	length := hashOffset + len(cd.codeSlots)*sha256.Size
+
+	buf := new(bytes.Buffer)
+	for _, v := range []uint32{
+		magicCodeDirectory,
+		uint32(length),
+		codeDirectoryVersion,
+		0, // flags
+		uint32(hashOffset),
+		uint32(identOffset),
+		numSpecialSlots,
+		uint32(len(cd.codeSlots)),
+		cd.codeLimit,
+	} {
+		binary.Write(buf, binary.BigEndian, v)
+	}
+	buf.Write([]byte{sha256.Size, hashTypeSHA256, 0, pageSizeLog2})
+	binary.Write(buf, binary.BigEndian, uint32(0)) // spare2
+	binary.Write(buf, binary.BigEndian, uint32(0)) // scatterOffset
+	binary.Write(buf, binary.BigEndian, uint32(teamOffset))
+	buf.WriteString(cd.identifier + "\x00")
+	if cd.teamID != "" {
+		buf.WriteString(cd.teamID + "\x00")
+	}
+	for i := numSpecialSlots; i > 0; i-- {
+		slot := cd.specialSlots[i-1]
+		if slot == nil {
+			slot = make([]byte, sha256.Size)
+		}
+		buf.Write(slot)
+	}
+	for _, slot := range cd.codeSlots {
+		buf.Write(slot)
+	}
+	return buf.Bytes()
+}
+
+// pageHashes returns the SHA256 hashes of each page of data
+func pageHashes(data []byte) (hashes [][]byte) {
+	for start := 0; start < len(data); start += pageSize {
+		end := start + pageSize
+		if end > len(data) {
+			end = len(data)
+		}
+		h := sha256.Sum256(data[start:end])
+		hashes = append(hashes, h[:])
+	}
+	return
+}
+
+// parseKoly returns the koly trailer of a disk image and the length
+// of the image data it signs, which excludes an existing code
+// signature
+func parseKoly(input []byte) (koly []byte, codeLimit int, err error) {
+	if len(input) < kolySize {
+		return nil, 0, errors.New("macos: file is too short to be a disk image")
+	}
+	koly = input[len(input)-kolySize:]
+	if string(koly[:4]) != kolyMagic {
+		return nil, 0, errors.New("macos: file is not a disk image, koly trailer not found")
+	}
+	codeLimit = len(input) - kolySize
+	sigOffset := binary.BigEndian.Uint64(koly[kolyCodeSignatureOffset:])
+	sigSize := binary.BigEndian.Uint64(koly[kolyCodeSignatureSize:])
+	if sigSize > 0 {
+		if sigOffset > uint64(codeLimit) || sigSize > uint64(codeLimit)-sigOffset {
+			return nil, 0, errors.New("macos: code signature of the disk image is out of bounds")
+		}
+		codeLimit = int(sigOffset)
+	}
+	return koly, codeLimit, nil
+}
+
+// cdHashesPlist returns the plist of the hash of a code directory
+// for the CMS signature
+func cdHashesPlist(cdBlob []byte) []byte {
+	h := sha256.Sum256(cdBlob)
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>cdhashes</key>
+	<array>
+		<data>
+		%s
+		</data>
+	</array>
+</dict>
+</plist>
+`, base64.StdEncoding.EncodeToString(h[:20])))
+}
+
+// signDMG embeds a code signature in a disk image, replacing its
+// existing signature
+func (s *MacOSSigner) signDMG(ctx context.Context, input []byte, identifier string) ([]byte, error) {
+	if len(identifier) > 256 || bytes.IndexByte([]byte(identifier), 0) != -1 {
+		return nil, errors.Errorf("macos: invalid identifier %q", identifier)
+	}
+	koly, codeLimit, err := parseKoly(input)
+	if err != nil {
+		return nil, errors.Wrapf(signer.ErrMalformedInput, "%v", err)
+	}
+	if uint64(codeLimit) > math.MaxUint32 {
+		return nil, errors.New("macos: disk images larger than 4GB are not supported")
+	}
+	cd := &codeDirectory{
+		identifier: identifier,
+		codeLimit:  uint32(codeLimit),
+		codeSlots:  pageHashes(input[:codeLimit]),
+	}
+	if len(s.chain[0].Subject.OrganizationalUnit) > 0 {
+		// the team ID of apple developer certificates
+		cd.teamID = s.chain[0].Subject.OrganizationalUnit[0]
+	}
+
+	// the koly trailer is signed with the location of the code
+	// signature, so room is reserved for a signature of unknown size
+	cmsSize := cmsSizeMargin
+	for _, cert := range s.chain {
+		cmsSize += len(cert.Raw)
+	}
+	if s.Timestamp.URL != "" {
+		cmsSize += timestampSizeMargin
+	}
+	cdSize := len(cd.marshal())
+	reservedSize := 12 + 3*8 + cdSize + len(emptyRequirements) + 8 + cmsSize
+	signedKoly := make([]byte, kolySize)
+	copy(signedKoly, koly)
+	binary.BigEndian.PutUint64(signedKoly[kolyCodeSignatureOffset:], uint64(codeLimit))
+	binary.BigEndian.PutUint64(signedKoly[kolyCodeSignatureSize:], uint64(reservedSize))
+
+	kolyHash := sha256.Sum256(signedKoly)
+	reqHash := sha256.Sum256(emptyRequirements)
+	cd.specialSlots[specialSlotRepSpecific-1] = kolyHash[:]
+	cd.specialSlots[specialSlotRequirements-1] = reqHash[:]
+	cdBlob := cd.marshal()
+
+	if err = ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "macos: aborting before signing code directory")
+	}
+	cms, err := s.signCMS(ctx, cdBlob, []pkcs7.Attribute{
+		{Type: oidCDHashesPlist, Value: cdHashesPlist(cdBlob)},
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+	superblob := makeSuperblob([]blob{
+		{slotCodeDirectory, cdBlob},
+		{slotRequirements, emptyRequirements},
+		{slotSignature, wrapBlob(cms)},
+	})
+	if len(superblob) > reservedSize {
+		return nil, errors.Errorf("macos: code signature of %d bytes exceeds the %d bytes reserved", len(superblob), reservedSize)
+	}
+
+	output := make([]byte, 0, codeLimit+reservedSize+kolySize)
+	output = append(output, input[:codeLimit]...)
+	output = append(output, superblob...)
+	output = append(output, make([]byte, reservedSize-len(superblob))...)
+	output = append(output, signedKoly...)
+	return output, nil
+}
+
+// blob is an entry of a superblob
+type blob struct {
+	slot uint32
+	data []byte
+}
+
+// makeSuperblob returns an embedded signature superblob
+func makeSuperblob(blobs []blob) []byte {
+	headerSize := 12 + 8*len(blobs)
+	length := headerSize
+	for _, b := range blobs {
+		length += len(b.data)
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint32(magicEmbeddedSignature))
+	binary.Write(buf, binary.BigEndian, uint32(length))
+	binary.Write(buf, binary.BigEndian, uint32(len(blobs)))
+	offset := headerSize
+	for _, b := range blobs {
+		binary.Write(buf, binary.BigEndian, b.slot)
+		binary.Write(buf, binary.BigEndian, uint32(offset))
+		offset += len(b.data)
+	}
+	for _, b := range blobs {
+		buf.Write(b.data)
+	}
+	return buf.Bytes()
+}
+
+// wrapBlob returns a blob wrapper of the CMS signature
+func wrapBlob(data []byte) []byte {
+	buf := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(buf, magicBlobWrapper)
+	binary.BigEndian.PutUint32(buf[4:], uint32(8+len(data)))
+	return append(buf, data...)
+}
+
+// parseSuperblob returns the blobs of an embedded signature superblob
+// by slot
+func parseSuperblob(data []byte) (map[uint32][]byte, error) {
+	if len(data) < 12 || binary.BigEndian.Uint32(data) != magicEmbeddedSignature {
+		return nil, errors.New("macos: invalid code signature superblob")
+	}
+	length := binary.BigEndian.Uint32(data[4:])
+	count := binary.BigEndian.Uint32(data[8:])
+	if uint64(length) > uint64(len(data)) || uint64(12)+8*uint64(count) > uint64(length) {
+		return nil, errors.New("macos: code signature superblob is truncated")
+	}
+	data = data[:length]
+	blobs := make(map[uint32][]byte)
+	for i := uint32(0); i < count; i++ {
+		slot := binary.BigEndian.Uint32(data[12+8*i:])
+		offset := binary.BigEndian.Uint32(data[16+8*i:])
+		if uint64(offset)+8 > uint64(length) {
+			return nil, errors.Errorf("macos: blob in slot %d is out of bounds", slot)
+		}
+		blobLength := binary.BigEndian.Uint32(data[offset+4:])
+		if blobLength < 8 || uint64(offset)+uint64(blobLength) > uint64(length) {
+			return nil, errors.Errorf("macos: blob in slot %d is out of bounds", slot)
+		}
+		blobs[slot] = data[offset : offset+blobLength]
+	}
+	return blobs, nil
+}
+
+// verifyDMG verifies the code signature of a disk image covers its
+// data and koly trailer
+func verifyDMG(signedFile []byte, roots *x509.CertPool) error {
+	koly, codeLimit, err := parseKoly(signedFile)
+	if err != nil {
+		return err
+	}
+	if codeLimit == len(signedFile)-kolySize {
+		return errors.New("macos: disk image is not signed")
+	}
+	blobs, err := parseSuperblob(signedFile[codeLimit : len(signedFile)-kolySize])
+	if err != nil {
+		return err
+	}
+	cdBlob, ok := blobs[slotCodeDirectory]
+	if !ok || len(cdBlob) < codeDirectorySize || binary.BigEndian.Uint32(cdBlob) != magicCodeDirectory {
+		return errors.New("macos: code signature has no code directory")
+	}
+	hashOffset := binary.BigEndian.Uint32(cdBlob[16:])
+	nSpecialSlots := binary.BigEndian.Uint32(cdBlob[24:])
+	nCodeSlots := binary.BigEndian.Uint32(cdBlob[28:])
+	cdCodeLimit := binary.BigEndian.Uint32(cdBlob[32:])
+	if cdBlob[36] != sha256.Size || cdBlob[37] != hashTypeSHA256 || cdBlob[39] != pageSizeLog2 {
+		return errors.New("macos: code directory must use SHA256 hashes of 4096 bytes pages")
+	}
+	if int(cdCodeLimit) != codeLimit {
+		return errors.Errorf("macos: code directory covers %d bytes, expected %d", cdCodeLimit, codeLimit)
+	}
+	if nSpecialSlots < specialSlotRepSpecific || uint64(hashOffset) < uint64(nSpecialSlots)*sha256.Size ||
+		uint64(hashOffset)+uint64(nCodeSlots)*sha256.Size > uint64(len(cdBlob)) {
+		return errors.New("macos: code directory hashes are out of bounds")
+	}
+	specialSlot := func(n uint32) []byte {
+		start := hashOffset - n*sha256.Size
+		return cdBlob[start : start+sha256.Size]
+	}
+	kolyHash := sha256.Sum256(koly)
+	if !bytes.Equal(specialSlot(specialSlotRepSpecific), kolyHash[:]) {
+		return errors.New("macos: koly trailer does not match its hash in the code directory")
+	}
+	if req, ok := blobs[slotRequirements]; ok {
+		reqHash := sha256.Sum256(req)
+		if !bytes.Equal(specialSlot(specialSlotRequirements), reqHash[:]) {
+			return errors.New("macos: requirements do not match their hash in the code directory")
+		}
+	}
+	hashes := pageHashes(signedFile[:codeLimit])
+	if len(hashes) != int(nCodeSlots) {
+		return errors.Errorf("macos: code directory has %d page hashes, expected %d", nCodeSlots, len(hashes))
+	}
+	for i, h := range hashes {
+		start := hashOffset + uint32(i)*sha256.Size
+		if !bytes.Equal(cdBlob[start:start+sha256.Size], h) {
+			return errors.Errorf("macos: page %d does not match its hash in the code directory", i)
+		}
+	}
+
+	sigBlob, ok := blobs[slotSignature]
+	if !ok || binary.BigEndian.Uint32(sigBlob) != magicBlobWrapper {
+		return errors.New("macos: code signature has no CMS signature")
+	}
+	_, err = verifyCMS(sigBlob[8:], cdBlob, roots)
+	return err
+}
+
+// testDMG is an unsigned disk image returned by GetTestFile
+var testDMG = makeTestDMG()
+
+// makeTestDMG returns a disk image with a data fork of a few pages
+// and a resource plist
+func makeTestDMG() []byte {
+	data := bytes.Repeat([]byte("autograph test disk image\n"), 400)
+	plist := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict><key>resource-fork</key><dict/></dict></plist>
+`)
+	koly := make([]byte, kolySize)
+	copy(koly, kolyMagic)
+	binary.BigEndian.PutUint32(koly[4:], 4)
+	binary.BigEndian.PutUint32(koly[8:], kolySize)
+	binary.BigEndian.PutUint64(koly[32:], uint64(len(data)))
+	binary.BigEndian.PutUint64(koly[216:], uint64(len(data)))
+	binary.BigEndian.PutUint64(koly[224:], uint64(len(plist)))
+	binary.BigEndian.PutUint64(koly[492:], uint64(len(data)/512))
+	out := append(data, plist...)
+	return append(out, koly...)
+}
@@ -0,0 +1,225 @@
+package macos
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/autograph/signer"
+)
+
+const (
+	// Type of this signer is "macos", which signs macOS disk
+	// images and installer packages
+	Type = "macos"
+
+	// ModeDMG represents a signer that embeds code signatures in
+	// UDIF disk images (.dmg)
+	ModeDMG = "dmg"
+
+	// ModePkg represents a signer that signs flat installer
+	// packages (.pkg), which are xar archives
+	ModePkg = "pkg"
+)
+
+// MacOSSigner holds the configuration of the signer
+type MacOSSigner struct {
+	signer.Configuration
+
+	// key is the private key of the leaf certificate of chain
+	key crypto.PrivateKey
+
+	// chain is the certificate chain of the signer, leaf first,
+	// which is embedded in signatures
+	chain []*x509.Certificate
+
+	// rand is the CSPRNG to use from the HSM or crypto/rand
+	rand io.Reader
+}
+
+// New initializes a macos signer using a configuration
+func New(conf signer.Configuration) (s *MacOSSigner, err error) {
+	s = new(MacOSSigner)
+
+	if conf.Type != Type {
+		return nil, errors.Errorf("macos: invalid type %q, must be %q", conf.Type, Type)
+	}
+	s.Type = conf.Type
+
+	if conf.ID == "" {
+		return nil, errors.New("macos: missing signer ID in signer configuration")
+	}
+	s.ID = conf.ID
+
+	switch conf.Mode {
+	case ModeDMG, ModePkg:
+	default:
+		return nil, errors.Errorf("macos: unknown signer mode %q, must be %q or %q", conf.Mode, ModeDMG, ModePkg)
+	}
+	s.Mode = conf.Mode
+
+	if conf.PrivateKey == "" {
+		return nil, errors.New("macos: missing private key in signer configuration")
+	}
+	s.PrivateKey = conf.PrivateKey
+	if conf.Certificate == "" {
+		return nil, errors.New("macos: missing certificate in signer configuration")
+	}
+	s.Certificate = conf.Certificate
+	s.Timestamp = conf.Timestamp
+
+	var pub crypto.PublicKey
+	s.key, pub, s.PublicKey, err = conf.GetKeys()
+	if err != nil {
+		return nil, errors.Wrap(err, "macos: failed to get keys")
+	}
+	// CMS signatures are made with go.mozilla.org/pkcs7, which
+	// only supports keys held in memory
+	switch s.key.(type) {
+	case *rsa.PrivateKey:
+	case *ecdsa.PrivateKey:
+		if s.Mode == ModePkg {
+			return nil, errors.New("macos: pkg signers require an RSA key")
+		}
+	default:
+		return nil, errors.Errorf("macos: unsupported private key type %T", s.key)
+	}
+
+	s.chain, err = parseChain(conf.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	leafPub, err := x509.MarshalPKIXPublicKey(s.chain[0].PublicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "macos: failed to marshal certificate public key")
+	}
+	keyPub, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, errors.Wrap(err, "macos: failed to marshal public key")
+	}
+	if !bytes.Equal(leafPub, keyPub) {
+		return nil, errors.New("macos: private key does not match the leaf certificate")
+	}
+	s.rand = conf.GetRand()
+	return
+}
+
+// parseChain parses a PEM certificate chain, leaf first
+func parseChain(chainPEM string) (chain []*x509.Certificate, err error) {
+	rest := []byte(chainPEM)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "macos: failed to parse certificate")
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("macos: no certificate found in signer configuration")
+	}
+	return chain, nil
+}
+
+// Config returns the configuration of the current signer
+func (s *MacOSSigner) Config() signer.Configuration {
+	return signer.Configuration{
+		ID:          s.ID,
+		Type:        s.Type,
+		Mode:        s.Mode,
+		PrivateKey:  s.PrivateKey,
+		PublicKey:   s.PublicKey,
+		Certificate: s.Certificate,
+		Timestamp:   s.Timestamp,
+	}
+}
+
+// SignFile signs a disk image or an installer package, depending on
+// the mode of the signer, and returns the signed file
+func (s *MacOSSigner) SignFile(input []byte, options interface{}) (signer.SignedFile, error) {
+	return s.SignFileContext(context.Background(), input, options)
+}
+
+// SignFileContext is like SignFile but stops before signing when
+// ctx is done
+func (s *MacOSSigner) SignFileContext(ctx context.Context, input []byte, options interface{}) (signer.SignedFile, error) {
+	opt, err := GetOptions(options)
+	if err != nil {
+		return nil, errors.Wrap(err, "macos: cannot get options")
+	}
+	var output []byte
+	switch s.Mode {
+	case ModeDMG:
+		identifier := opt.Identifier
+		if identifier == "" {
+			identifier = s.ID
+		}
+		output, err = s.signDMG(ctx, input, identifier)
+	case ModePkg:
+		output, err = s.signPkg(ctx, input)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// Options contains the parameters of macos signatures
+type Options struct {
+	// Identifier is the code signing identifier of a disk image,
+	// like "org.mozilla.firefox". It defaults to the signer ID and
+	// is ignored for installer packages.
+	Identifier string `json:"identifier,omitempty"`
+}
+
+// GetDefaultOptions returns default options of the signer
+func (s *MacOSSigner) GetDefaultOptions() interface{} {
+	return Options{}
+}
+
+// GetOptions takes a input interface and reflects it into a struct of options
+func GetOptions(input interface{}) (options Options, err error) {
+	buf, err := json.Marshal(input)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(buf, &options)
+	return
+}
+
+// GetTestFile returns an unsigned file of the mode of the signer
+func (s *MacOSSigner) GetTestFile() []byte {
+	if s.Mode == ModePkg {
+		return testPkg
+	}
+	return testDMG
+}
+
+// VerifySignedFile verifies the signature of a disk image or an
+// installer package signed in a mode. When roots is not nil, the
+// certificate chain of the signature must also lead to one of the
+// roots.
+func VerifySignedFile(signedFile []byte, mode string, roots *x509.CertPool) error {
+	switch mode {
+	case ModeDMG:
+		return verifyDMG(signedFile, roots)
+	case ModePkg:
+		return verifyPkg(signedFile, roots)
+	default:
+		return errors.Errorf("macos: unknown signer mode %q", mode)
+	}
+}
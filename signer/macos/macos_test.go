@@ -0,0 +1,250 @@
+package macos
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"encoding/xml"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/signer"
+)
+
+// newTestConf returns the configuration of a signer with a key and
+// a leaf certificate issued by a new root, and a pool of that root
+func newTestConf(t *testing.T, mode string, key crypto.Signer) (signer.Configuration, *x509.CertPool) {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test apple root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTpl, rootTpl, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject: pkix.Name{
+			CommonName:         "Developer ID Application: Autograph Test (TEAMID1234)",
+			OrganizationalUnit: []string{"TEAMID1234"},
+		},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}, root, key.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return signer.Configuration{
+		ID:          "macostest",
+		Type:        Type,
+		Mode:        mode,
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})),
+	}, roots
+}
+
+func TestSignDMG(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, roots := newTestConf(t, ModeDMG, key)
+	s, err := New(conf)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	err = VerifySignedFile(s.GetTestFile(), ModeDMG, nil)
+	if err == nil || !strings.Contains(err.Error(), "not signed") {
+		t.Fatalf("expected unsigned disk image to fail verification, got %v", err)
+	}
+
+	signed, err := s.SignFile(s.GetTestFile(), Options{Identifier: "org.mozilla.firefox"})
+	if err != nil {
+		t.Fatalf("failed to sign disk image: %v", err)
+	}
+	err = VerifySignedFile(signed, ModeDMG, roots)
+	if err != nil {
+		t.Fatalf("failed to verify signed disk image: %v", err)
+	}
+	if !bytes.Contains(signed, []byte("org.mozilla.firefox\x00TEAMID1234\x00")) {
+		t.Fatal("expected code directory to have the identifier and team ID")
+	}
+	if !bytes.Equal(signed[:len(testDMG)-kolySize], testDMG[:len(testDMG)-kolySize]) {
+		t.Fatal("expected image data to be unchanged")
+	}
+
+	// signing a signed image replaces its signature
+	resigned, err := s.SignFile(signed, Options{Identifier: "org.mozilla.firefox"})
+	if err != nil {
+		t.Fatalf("failed to sign signed disk image: %v", err)
+	}
+	if len(resigned) != len(signed) {
+		t.Fatalf("expected signed image of %d bytes, got %d", len(signed), len(resigned))
+	}
+	err = VerifySignedFile(resigned, ModeDMG, roots)
+	if err != nil {
+		t.Fatalf("failed to verify signed disk image: %v", err)
+	}
+
+	// tampering with the data or the trailer breaks the signature
+	for i, offset := range []int{10, len(signed) - kolySize + 224} {
+		tampered := make([]byte, len(signed))
+		copy(tampered, signed)
+		tampered[offset]++
+		err = VerifySignedFile(tampered, ModeDMG, roots)
+		if err == nil {
+			t.Fatalf("testcase %d: expected tampered disk image to fail verification", i)
+		}
+	}
+	err = VerifySignedFile(signed, ModeDMG, x509.NewCertPool())
+	if err == nil {
+		t.Fatal("expected verification with other roots to fail")
+	}
+	_, err = s.SignFile([]byte("not a disk image"), nil)
+	if err == nil {
+		t.Fatal("expected signing a file that isn't a disk image to fail")
+	}
+}
+
+func TestSignPkg(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, roots := newTestConf(t, ModePkg, key)
+	s, err := New(conf)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	signed, err := s.SignFile(s.GetTestFile(), s.GetDefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to sign package: %v", err)
+	}
+	err = VerifySignedFile(signed, ModePkg, roots)
+	if err != nil {
+		t.Fatalf("failed to verify signed package: %v", err)
+	}
+
+	// the file data moved after the signatures
+	_, compressedTOC, heap, err := parseXarHeader(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xmlTOC, err := decompressTOC(compressedTOC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var toc struct {
+		Offset int64 `xml:"toc>file>data>offset"`
+		Size   int64 `xml:"toc>file>data>size"`
+	}
+	err = xml.Unmarshal(xmlTOC, &toc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := heapSlice(heap, toc.Offset, toc.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(`<?xml version="1.0" encoding="utf-8"?>`)) || !bytes.HasSuffix(testPkg, data) {
+		t.Fatalf("expected the Distribution file at offset %d, got %q", toc.Offset, data)
+	}
+
+	_, err = s.SignFile(signed, nil)
+	if err == nil || !strings.Contains(err.Error(), "already signed") {
+		t.Fatalf("expected signing a signed package to fail, got %v", err)
+	}
+	tampered := make([]byte, len(signed))
+	copy(tampered, signed)
+	tampered[len(tampered)-1]++
+	err = VerifySignedFile(tampered, ModePkg, roots)
+	if err != nil {
+		t.Fatalf("expected file data to be covered by its TOC checksums only, got %v", err)
+	}
+	copy(tampered, signed)
+	tampered[xarHeaderSize+10]++
+	err = VerifySignedFile(tampered, ModePkg, roots)
+	if err == nil {
+		t.Fatal("expected tampered TOC to fail verification")
+	}
+	err = VerifySignedFile(testPkg, ModePkg, roots)
+	if err == nil || !strings.Contains(err.Error(), "not signed") {
+		t.Fatalf("expected unsigned package to fail verification, got %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaConf, _ := newTestConf(t, ModePkg, rsaKey)
+	ecConf, _ := newTestConf(t, ModePkg, ecKey)
+	for i, tc := range []struct {
+		conf signer.Configuration
+		err  string
+	}{
+		{signer.Configuration{ID: "macostest", Type: "xpi", Mode: ModePkg}, "invalid type"},
+		{signer.Configuration{Type: Type, Mode: ModePkg}, "missing signer ID"},
+		{signer.Configuration{ID: "macostest", Type: Type, Mode: "macho"}, "unknown signer mode"},
+		{signer.Configuration{ID: "macostest", Type: Type, Mode: ModeDMG, Certificate: rsaConf.Certificate}, "missing private key"},
+		{signer.Configuration{ID: "macostest", Type: Type, Mode: ModeDMG, PrivateKey: rsaConf.PrivateKey}, "missing certificate"},
+		{ecConf, "require an RSA key"},
+		{signer.Configuration{ID: "macostest", Type: Type, Mode: ModePkg, PrivateKey: rsaConf.PrivateKey, Certificate: ecConf.Certificate}, "does not match"},
+	} {
+		_, err := New(tc.conf)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Fatalf("testcase %d: expected error containing %q, got %v", i, tc.err, err)
+		}
+	}
+	s, err := New(rsaConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Config().Mode != ModePkg || s.Config().PublicKey == "" {
+		t.Fatalf("unexpected signer configuration %+v", s.Config())
+	}
+}
+
+func TestParseSuperblobBounds(t *testing.T) {
+	superblob := makeSuperblob([]blob{{slotRequirements, emptyRequirements}})
+	binary.BigEndian.PutUint32(superblob[16:], 1000)
+	_, err := parseSuperblob(superblob)
+	if err == nil {
+		t.Fatal("expected blob out of bounds to fail parsing")
+	}
+}
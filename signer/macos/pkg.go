@@ -0,0 +1,459 @@
+package macos
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/autograph/signer"
+)
+
+// A flat installer package is a xar archive: a header, a zlib
+// compressed XML table of contents (TOC) and a heap holding the
+// checksum of the compressed TOC and the data of the files. The
+// signatures of the checksum are stored in the heap after it, and
+// located by the signature elements of the TOC.
+const (
+	xarMagic      = "xar!"
+	xarHeaderSize = 28
+
+	// checksum algorithms of the xar header
+	xarChecksumSHA1  = 1
+	xarChecksumOther = 3
+
+	// xmldsigNamespace is the namespace of the KeyInfo elements of
+	// the signatures
+	xmldsigNamespace = "http://www.w3.org/2000/09/xmldsig#"
+
+	// maxTOCSize is the maximum size of an uncompressed TOC
+	maxTOCSize = 64 << 20
+)
+
+// xarHeader is the header of a xar archive
+type xarHeader struct {
+	raw          []byte
+	checksumHash crypto.Hash
+}
+
+// parseXarHeader parses the header of a xar archive and returns it
+// with the compressed TOC and the heap
+func parseXarHeader(input []byte) (header *xarHeader, toc, heap []byte, err error) {
+	if len(input) < xarHeaderSize || string(input[:4]) != xarMagic {
+		return nil, nil, nil, errors.New("macos: file is not a xar archive")
+	}
+	size := int(binary.BigEndian.Uint16(input[4:]))
+	if size < xarHeaderSize || size > len(input) {
+		return nil, nil, nil, errors.New("macos: invalid xar header size")
+	}
+	header = &xarHeader{
+		raw: input[:size],
+	}
+	switch binary.BigEndian.Uint32(input[24:]) {
+	case xarChecksumSHA1:
+		header.checksumHash = crypto.SHA1
+	case xarChecksumOther:
+		// the name of the algorithm follows the header
+		switch strings.TrimRight(string(input[xarHeaderSize:size]), "\x00") {
+		case "sha256":
+			header.checksumHash = crypto.SHA256
+		case "sha512":
+			header.checksumHash = crypto.SHA512
+		default:
+			return nil, nil, nil, errors.New("macos: unsupported xar checksum algorithm")
+		}
+	default:
+		return nil, nil, nil, errors.New("macos: unsupported xar checksum algorithm")
+	}
+	compressedLength := binary.BigEndian.Uint64(input[8:])
+	if compressedLength > uint64(len(input)-size) {
+		return nil, nil, nil, errors.New("macos: xar TOC is truncated")
+	}
+	toc = input[size : size+int(compressedLength)]
+	heap = input[size+int(compressedLength):]
+	return header, toc, heap, nil
+}
+
+// marshal returns the header of an archive with a compressed TOC of
+// a new length
+func (h *xarHeader) marshal(compressedLength, tocLength int) []byte {
+	raw := make([]byte, len(h.raw))
+	copy(raw, h.raw)
+	binary.BigEndian.PutUint64(raw[8:], uint64(compressedLength))
+	binary.BigEndian.PutUint64(raw[16:], uint64(tocLength))
+	return raw
+}
+
+// checksum returns the checksum of a compressed TOC
+func (h *xarHeader) checksum(toc []byte) []byte {
+	hash := h.checksumHash.New()
+	hash.Write(toc)
+	return hash.Sum(nil)
+}
+
+// decompressTOC returns the XML of a compressed TOC
+func decompressTOC(toc []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(toc))
+	if err != nil {
+		return nil, errors.Wrap(err, "macos: failed to decompress xar TOC")
+	}
+	defer r.Close()
+	xmlTOC, err := ioutil.ReadAll(io.LimitReader(r, maxTOCSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "macos: failed to decompress xar TOC")
+	}
+	if len(xmlTOC) > maxTOCSize {
+		return nil, errors.New("macos: xar TOC is too large")
+	}
+	return xmlTOC, nil
+}
+
+// compressTOC returns the compressed XML of a TOC
+func compressTOC(xmlTOC []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := zlib.NewWriter(buf)
+	_, err := w.Write(xmlTOC)
+	if err != nil {
+		return nil, errors.Wrap(err, "macos: failed to compress xar TOC")
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "macos: failed to compress xar TOC")
+	}
+	return buf.Bytes(), nil
+}
+
+// xarSignature is a signature element of a TOC
+type xarSignature struct {
+	XMLName xml.Name
+	Style   string     `xml:"style,attr"`
+	Offset  int64      `xml:"offset"`
+	Size    int64      `xml:"size"`
+	KeyInfo xarKeyInfo `xml:"KeyInfo"`
+}
+
+// xarKeyInfo holds the base64 DER certificate chain of a signature,
+// leaf first
+type xarKeyInfo struct {
+	XMLName      xml.Name
+	Certificates []string `xml:"X509Data>X509Certificate"`
+}
+
+// xarTOC holds the elements of a TOC that locate its checksum and
+// signatures in the heap
+type xarTOC struct {
+	Checksum struct {
+		Style  string `xml:"style,attr"`
+		Offset int64  `xml:"offset"`
+		Size   int64  `xml:"size"`
+	} `xml:"toc>checksum"`
+	Signature  *xarSignature `xml:"toc>signature"`
+	XSignature *xarSignature `xml:"toc>x-signature"`
+}
+
+// heapSlice returns the data of the heap at an offset
+func heapSlice(heap []byte, offset, size int64) ([]byte, error) {
+	if offset < 0 || size < 0 || offset > int64(len(heap)) || size > int64(len(heap))-offset {
+		return nil, errors.New("macos: xar heap data is out of bounds")
+	}
+	return heap[offset : offset+size], nil
+}
+
+// signTOC returns the XML of a TOC with the signature elements
+// inserted after its checksum and the offsets of the file data and
+// extended attributes in the heap shifted by the size of the
+// signatures
+func signTOC(xmlTOC []byte, signatures []xarSignature, shift int64) ([]byte, error) {
+	var (
+		out     = new(bytes.Buffer)
+		dec     = xml.NewDecoder(bytes.NewReader(xmlTOC))
+		enc     = xml.NewEncoder(out)
+		stack   []string
+		offset  []byte
+		checked bool
+	)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "macos: failed to parse xar TOC")
+		}
+		parent := ""
+		if len(stack) > 1 {
+			parent = stack[len(stack)-2]
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			if len(stack) == 3 && (t.Name.Local == "signature" || t.Name.Local == "x-signature") {
+				return nil, errors.New("macos: package is already signed")
+			}
+			if len(stack) == 3 && t.Name.Local == "checksum" {
+				checked = true
+			}
+		case xml.CharData:
+			if len(stack) > 0 && stack[len(stack)-1] == "offset" && (parent == "data" || parent == "ea") {
+				offset = append(offset, t...)
+				continue
+			}
+		case xml.EndElement:
+			if t.Name.Local == "offset" && (parent == "data" || parent == "ea") {
+				n, err := strconv.ParseInt(strings.TrimSpace(string(offset)), 10, 64)
+				if err != nil {
+					return nil, errors.Wrap(err, "macos: invalid heap offset in xar TOC")
+				}
+				offset = nil
+				err = enc.EncodeToken(xml.CharData(strconv.FormatInt(n+shift, 10)))
+				if err != nil {
+					return nil, errors.Wrap(err, "macos: failed to write xar TOC")
+				}
+			}
+			stack = stack[:len(stack)-1]
+			if len(stack) == 2 && t.Name.Local == "checksum" {
+				err = enc.EncodeToken(t)
+				if err != nil {
+					return nil, errors.Wrap(err, "macos: failed to write xar TOC")
+				}
+				for _, sig := range signatures {
+					err = enc.Encode(sig)
+					if err != nil {
+						return nil, errors.Wrap(err, "macos: failed to write xar signature")
+					}
+				}
+				continue
+			}
+		}
+		err = enc.EncodeToken(xml.CopyToken(tok))
+		if err != nil {
+			return nil, errors.Wrap(err, "macos: failed to write xar TOC")
+		}
+	}
+	err := enc.Flush()
+	if err != nil {
+		return nil, errors.Wrap(err, "macos: failed to write xar TOC")
+	}
+	if !checked {
+		return nil, errors.New("macos: xar TOC has no checksum")
+	}
+	return out.Bytes(), nil
+}
+
+// signPkg signs the TOC checksum of an installer package with an RSA
+// signature and a CMS signature
+func (s *MacOSSigner) signPkg(ctx context.Context, input []byte) ([]byte, error) {
+	header, compressedTOC, heap, err := parseXarHeader(input)
+	if err != nil {
+		return nil, errors.Wrapf(signer.ErrMalformedInput, "%v", err)
+	}
+	xmlTOC, err := decompressTOC(compressedTOC)
+	if err != nil {
+		return nil, errors.Wrapf(signer.ErrMalformedInput, "%v", err)
+	}
+	var toc xarTOC
+	err = xml.Unmarshal(xmlTOC, &toc)
+	if err != nil {
+		return nil, errors.Wrapf(signer.ErrMalformedInput, "macos: failed to parse xar TOC: %v", err)
+	}
+	checksumSize := int64(header.checksumHash.Size())
+	if toc.Checksum.Offset != 0 || toc.Checksum.Size != checksumSize {
+		return nil, errors.New("macos: xar TOC checksum must be at the start of the heap")
+	}
+	if int64(len(heap)) < checksumSize {
+		return nil, errors.New("macos: xar heap is truncated")
+	}
+
+	// the TOC records the size of the CMS signature before it is
+	// made, so it is measured on a signature of a dummy checksum,
+	// and isn't timestamped since tokens vary in size
+	if err = ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "macos: aborting before signing xar TOC")
+	}
+	dummyCMS, err := s.signCMS(ctx, make([]byte, checksumSize), nil, false)
+	if err != nil {
+		return nil, err
+	}
+	rsaSize := int64(s.key.(*rsa.PrivateKey).Size())
+	cmsSize := int64(len(dummyCMS))
+	keyInfo := xarKeyInfo{XMLName: xml.Name{Space: xmldsigNamespace, Local: "KeyInfo"}}
+	for _, cert := range s.chain {
+		keyInfo.Certificates = append(keyInfo.Certificates, base64.StdEncoding.EncodeToString(cert.Raw))
+	}
+	signatures := []xarSignature{
+		{
+			XMLName: xml.Name{Local: "signature"},
+			Style:   "RSA",
+			Offset:  checksumSize,
+			Size:    rsaSize,
+			KeyInfo: keyInfo,
+		},
+		{
+			XMLName: xml.Name{Local: "x-signature"},
+			Style:   "CMS",
+			Offset:  checksumSize + rsaSize,
+			Size:    cmsSize,
+			KeyInfo: keyInfo,
+		},
+	}
+	signedTOC, err := signTOC(xmlTOC, signatures, rsaSize+cmsSize)
+	if err != nil {
+		return nil, err
+	}
+	compressedSignedTOC, err := compressTOC(signedTOC)
+	if err != nil {
+		return nil, err
+	}
+	checksum := header.checksum(compressedSignedTOC)
+
+	if err = ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "macos: aborting before signing xar TOC")
+	}
+	rsaSig, err := s.key.(*rsa.PrivateKey).Sign(s.rand, checksum, header.checksumHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "macos: failed to sign xar TOC checksum")
+	}
+	cms, err := s.signCMS(ctx, checksum, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(cms)) != cmsSize {
+		return nil, errors.Errorf("macos: CMS signature of %d bytes does not match the %d bytes reserved", len(cms), cmsSize)
+	}
+
+	output := new(bytes.Buffer)
+	output.Write(header.marshal(len(compressedSignedTOC), len(signedTOC)))
+	output.Write(compressedSignedTOC)
+	output.Write(checksum)
+	output.Write(rsaSig)
+	output.Write(cms)
+	output.Write(heap[checksumSize:])
+	return output.Bytes(), nil
+}
+
+// verifyPkg verifies the RSA and CMS signatures of the TOC checksum
+// of an installer package
+func verifyPkg(signedFile []byte, roots *x509.CertPool) error {
+	header, compressedTOC, heap, err := parseXarHeader(signedFile)
+	if err != nil {
+		return err
+	}
+	xmlTOC, err := decompressTOC(compressedTOC)
+	if err != nil {
+		return err
+	}
+	var toc xarTOC
+	err = xml.Unmarshal(xmlTOC, &toc)
+	if err != nil {
+		return errors.Wrap(err, "macos: failed to parse xar TOC")
+	}
+	checksum, err := heapSlice(heap, toc.Checksum.Offset, toc.Checksum.Size)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(checksum, header.checksum(compressedTOC)) {
+		return errors.New("macos: xar TOC does not match its checksum")
+	}
+	if toc.Signature == nil || toc.Signature.Style != "RSA" || toc.XSignature == nil || toc.XSignature.Style != "CMS" {
+		return errors.New("macos: package is not signed")
+	}
+
+	if len(toc.Signature.KeyInfo.Certificates) == 0 {
+		return errors.New("macos: xar RSA signature has no certificate")
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(toc.Signature.KeyInfo.Certificates[0]), ""))
+	if err != nil {
+		return errors.Wrap(err, "macos: failed to decode xar signature certificate")
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return errors.Wrap(err, "macos: failed to parse xar signature certificate")
+	}
+	pubKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("macos: xar signature certificate does not have an RSA key")
+	}
+	rsaSig, err := heapSlice(heap, toc.Signature.Offset, toc.Signature.Size)
+	if err != nil {
+		return err
+	}
+	err = rsa.VerifyPKCS1v15(pubKey, header.checksumHash, checksum, rsaSig)
+	if err != nil {
+		return errors.Wrap(err, "macos: failed to verify xar RSA signature")
+	}
+
+	cms, err := heapSlice(heap, toc.XSignature.Offset, toc.XSignature.Size)
+	if err != nil {
+		return err
+	}
+	cmsCert, err := verifyCMS(cms, checksum, roots)
+	if err != nil {
+		return err
+	}
+	if !cmsCert.Equal(cert) {
+		return errors.New("macos: xar RSA and CMS signatures are made by different certificates")
+	}
+	return nil
+}
+
+// testPkg is an unsigned installer package returned by GetTestFile
+var testPkg = makeTestPkg()
+
+// makeTestPkg returns a xar archive with a Distribution file
+func makeTestPkg() []byte {
+	data := []byte(`<?xml version="1.0" encoding="utf-8"?>
+<installer-gui-script minSpecVersion="1"><title>autograph test package</title></installer-gui-script>
+`)
+	dataSum := sha1.Sum(data)
+	xmlTOC := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<xar>
+ <toc>
+  <checksum style="sha1">
+   <offset>0</offset>
+   <size>20</size>
+  </checksum>
+  <creation-time>2020-01-01T00:00:00</creation-time>
+  <file id="1">
+   <data>
+    <length>` + strconv.Itoa(len(data)) + `</length>
+    <offset>20</offset>
+    <size>` + strconv.Itoa(len(data)) + `</size>
+    <encoding style="application/octet-stream"/>
+    <extracted-checksum style="sha1">` + hex.EncodeToString(dataSum[:]) + `</extracted-checksum>
+    <archived-checksum style="sha1">` + hex.EncodeToString(dataSum[:]) + `</archived-checksum>
+   </data>
+   <name>Distribution</name>
+   <type>file</type>
+  </file>
+ </toc>
+</xar>
+`)
+	compressedTOC, err := compressTOC(xmlTOC)
+	if err != nil {
+		panic(err)
+	}
+	header := make([]byte, xarHeaderSize)
+	copy(header, xarMagic)
+	binary.BigEndian.PutUint16(header[4:], xarHeaderSize)
+	binary.BigEndian.PutUint16(header[6:], 1)
+	binary.BigEndian.PutUint64(header[8:], uint64(len(compressedTOC)))
+	binary.BigEndian.PutUint64(header[16:], uint64(len(xmlTOC)))
+	binary.BigEndian.PutUint32(header[24:], xarChecksumSHA1)
+	tocSum := sha1.Sum(compressedTOC)
+
+	out := append(header, compressedTOC...)
+	out = append(out, tocSum[:]...)
+	return append(out, data...)
+}
@@ -1,6 +1,7 @@
 package mar
 
 import (
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
@@ -9,6 +10,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"regexp"
+	"strings"
 
 	"github.com/pkg/errors"
 	"go.mozilla.org/autograph/signer"
@@ -20,13 +23,33 @@ const (
 	Type = "mar"
 )
 
+// channelNameFormat is a regex for the format channel names must follow
+var channelNameFormat = regexp.MustCompile(signer.IDFormat)
+
 // MARSigner holds the configuration of the signer
 type MARSigner struct {
 	signer.Configuration
+	signer.KeyZeroizer
 	signingKey    crypto.PrivateKey
 	publicKey     crypto.PublicKey
 	rand          io.Reader
 	defaultSigAlg uint32
+
+	// channels are the keys of the release channels of the
+	// signer, selected with the channel option
+	channels map[string]*channelKey
+
+	// channelNames are the names of the channels in
+	// configuration order
+	channelNames []string
+}
+
+// channelKey is the key of a release channel
+type channelKey struct {
+	signingKey    crypto.PrivateKey
+	publicKey     crypto.PublicKey
+	b64PublicKey  string
+	defaultSigAlg uint32
 }
 
 // New initializes a mar signer using a configuration
@@ -43,34 +66,131 @@ func New(conf signer.Configuration) (s *MARSigner, err error) {
 	}
 	s.ID = conf.ID
 
-	if conf.PrivateKey == "" {
+	if conf.PrivateKey == "" && len(conf.MARChannels) == 0 {
 		return nil, errors.New("mar: missing private key in signer configuration")
 	}
 
 	s.PrivateKey = conf.PrivateKey
 	s.rand = conf.GetRand()
-	s.signingKey, s.publicKey, s.PublicKey, err = conf.GetKeys()
+	if conf.PrivateKey != "" {
+		var key *channelKey
+		key, err = loadKey(conf)
+		if err != nil {
+			return nil, err
+		}
+		s.signingKey, s.publicKey, s.PublicKey, s.defaultSigAlg = key.signingKey, key.publicKey, key.b64PublicKey, key.defaultSigAlg
+		s.ZeroizeAtExit(s.signingKey)
+	}
+
+	s.channels = make(map[string]*channelKey)
+	for _, channel := range conf.MARChannels {
+		if !channelNameFormat.MatchString(channel.Name) {
+			return nil, errors.Errorf("mar: channel name %q must match %s", channel.Name, signer.IDFormat)
+		}
+		if _, ok := s.channels[channel.Name]; ok {
+			return nil, errors.Errorf("mar: duplicate channel %q", channel.Name)
+		}
+		if channel.PrivateKey == "" {
+			return nil, errors.Errorf("mar: missing private key of channel %q", channel.Name)
+		}
+		channelConf := conf
+		channelConf.PrivateKey = channel.PrivateKey
+		channelConf.PublicKey = channel.PublicKey
+		s.channels[channel.Name], err = loadKey(channelConf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "mar: channel %q", channel.Name)
+		}
+		s.ZeroizeAtExit(s.channels[channel.Name].signingKey)
+		s.channelNames = append(s.channelNames, channel.Name)
+	}
+	if s.PublicKey == "" {
+		// without a default key, the signer is identified by
+		// the key of its first channel
+		s.PublicKey = s.channels[s.channelNames[0]].b64PublicKey
+	}
+	return
+}
+
+// loadKey loads the private key of a configuration and selects its
+// default signature algorithm depending on the public key type
+func loadKey(conf signer.Configuration) (key *channelKey, err error) {
+	key = new(channelKey)
+	key.signingKey, key.publicKey, key.b64PublicKey, err = conf.GetKeys()
 	if err != nil {
 		return nil, errors.Wrap(err, "mar: failed to get keys")
 	}
-
-	// select the default signature algorithm depending on the public key type
-	switch pubKey := s.publicKey.(type) {
+	switch pubKey := key.publicKey.(type) {
 	case *rsa.PublicKey:
-		s.defaultSigAlg = margo.SigAlgRsaPkcs1Sha384
+		key.defaultSigAlg = margo.SigAlgRsaPkcs1Sha384
 	case *ecdsa.PublicKey:
 		switch pubKey.Params().Name {
 		case elliptic.P256().Params().Name:
-			s.defaultSigAlg = margo.SigAlgEcdsaP256Sha256
+			key.defaultSigAlg = margo.SigAlgEcdsaP256Sha256
 		case elliptic.P384().Params().Name:
-			s.defaultSigAlg = margo.SigAlgEcdsaP384Sha384
+			key.defaultSigAlg = margo.SigAlgEcdsaP384Sha384
 		default:
 			return nil, fmt.Errorf("mar: elliptic curve %q is not supported", pubKey.Params().Name)
 		}
 	default:
-		return nil, errors.Errorf("mar: unsupported public key type %T", s.signingKey)
+		return nil, errors.Errorf("mar: unsupported public key type %T", key.signingKey)
 	}
-	return
+	return key, nil
+}
+
+// selectKey returns the key of the channel requested in the options,
+// or the default key when no channel is requested. The channel must
+// be one of the channels allowed in the context, if restricted.
+func (s *MARSigner) selectKey(ctx context.Context, opt Options) (*channelKey, error) {
+	if allowed := AllowedChannelsFromContext(ctx); len(allowed) > 0 && !containsChannel(allowed, opt.Channel) {
+		if opt.Channel == "" {
+			return nil, errors.Wrapf(signer.ErrOptionNotPermitted, "mar: a channel option is required, allowed channels are %s", strings.Join(allowed, ", "))
+		}
+		return nil, errors.Wrapf(signer.ErrOptionNotPermitted, "mar: channel %q is not allowed", opt.Channel)
+	}
+	if opt.Channel == "" {
+		if s.signingKey == nil {
+			return nil, errors.Wrapf(signer.ErrInvalidOptions, "mar: signer %q requires a channel option, one of %s", s.ID, strings.Join(s.channelNames, ", "))
+		}
+		return &channelKey{
+			signingKey:    s.signingKey,
+			publicKey:     s.publicKey,
+			b64PublicKey:  s.PublicKey,
+			defaultSigAlg: s.defaultSigAlg,
+		}, nil
+	}
+	key, ok := s.channels[opt.Channel]
+	if !ok {
+		return nil, errors.Wrapf(signer.ErrInvalidOptions, "mar: signer %q has no channel %q", s.ID, opt.Channel)
+	}
+	return key, nil
+}
+
+func containsChannel(channels []string, channel string) bool {
+	for _, c := range channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// Channels returns the names of the release channels of the signer
+func (s *MARSigner) Channels() []string {
+	return append([]string(nil), s.channelNames...)
+}
+
+// PublicKeyForOptions returns the base64 DER public key of the channel
+// selected by the options, which clients verify signatures with
+func (s *MARSigner) PublicKeyForOptions(options interface{}) (string, error) {
+	opt, err := GetOptions(options)
+	if err != nil {
+		return "", errors.Wrap(err, "mar: failed to get options")
+	}
+	key, err := s.selectKey(context.Background(), opt)
+	if err != nil {
+		return "", err
+	}
+	return key.b64PublicKey, nil
 }
 
 // Config returns the configuration of the current signer
@@ -85,16 +205,35 @@ func (s *MARSigner) Config() signer.Configuration {
 
 // SignFile takes a MAR file and returns a signed MAR file
 func (s *MARSigner) SignFile(input []byte, options interface{}) (signer.SignedFile, error) {
+	return s.SignFileContext(context.Background(), input, options)
+}
+
+// SignFileContext is like SignFile but restricts the channels of the
+// signature to the ones allowed in the context
+func (s *MARSigner) SignFileContext(ctx context.Context, input []byte, options interface{}) (signer.SignedFile, error) {
+	opt, err := GetOptions(options)
+	if err != nil {
+		return nil, errors.Wrap(err, "mar: failed to get options")
+	}
+	// parse the header and index of the input before selecting a
+	// key, so malformed files never reach the HSM
 	var marFile margo.File
-	err := margo.Unmarshal(input, &marFile)
+	err = margo.Unmarshal(input, &marFile)
+	if err != nil {
+		return nil, errors.Wrapf(signer.ErrMalformedInput, "mar: failed to unmarshal input file: %v", err)
+	}
+	key, err := s.selectKey(ctx, opt)
 	if err != nil {
-		return nil, errors.Wrap(err, "mar: failed to unmarshal input file")
+		return nil, err
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
 	}
 
 	// flush the signatures if any is present, we'll make new ones
 	marFile.SignaturesHeader.NumSignatures = uint32(0)
 	marFile.Signatures = nil
-	err = marFile.PrepareSignature(s.signingKey, s.publicKey)
+	err = marFile.PrepareSignature(key.signingKey, key.publicKey)
 	if err != nil {
 		return nil, errors.Wrap(err, "mar: failed to prepare signature")
 	}
@@ -118,39 +257,109 @@ func (s *MARSigner) SignFile(input []byte, options interface{}) (signer.SignedFi
 // signature. You should consider calling the SignFile interface instead, which will handle
 // all that magic for you.
 func (s *MARSigner) SignData(data []byte, options interface{}) (signer.Signature, error) {
+	return s.SignDataContext(context.Background(), data, options)
+}
+
+// SignDataContext is like SignData but restricts the channels of the
+// signature to the ones allowed in the context
+func (s *MARSigner) SignDataContext(ctx context.Context, data []byte, options interface{}) (signer.Signature, error) {
 	opt, err := GetOptions(options)
 	if err != nil {
 		return nil, errors.Wrap(err, "mar: failed to get options")
 	}
+	key, err := s.selectKey(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
 	// if no options were defined, use the default value from the signer
 	if opt.SigAlg == 0 {
-		opt.SigAlg = s.defaultSigAlg
+		opt.SigAlg = key.defaultSigAlg
 	}
 	hashed, _, err := margo.Hash(data, opt.SigAlg)
 	if err != nil {
 		return nil, errors.Wrap(err, "mar: failed to hash input")
 	}
-	return s.SignHash(hashed, options)
+	return s.SignHashContext(ctx, hashed, options)
 }
 
 // SignHash takes the hash of the signable data of a MAR file, signs it and returns a base64 encoded signature
 func (s *MARSigner) SignHash(hashed []byte, options interface{}) (signer.Signature, error) {
+	return s.SignHashContext(context.Background(), hashed, options)
+}
+
+// SignHashContext is like SignHash but restricts the channels of the
+// signature to the ones allowed in the context
+func (s *MARSigner) SignHashContext(ctx context.Context, hashed []byte, options interface{}) (signer.Signature, error) {
 	opt, err := GetOptions(options)
 	if err != nil {
 		return nil, errors.Wrap(err, "mar: failed to get options")
 	}
+	key, err := s.selectKey(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
 	// if no options were defined, use the default value from the signer
 	if opt.SigAlg == 0 {
-		opt.SigAlg = s.defaultSigAlg
+		opt.SigAlg = key.defaultSigAlg
 	}
-	sig := new(Signature)
-	sig.Data, err = margo.Sign(s.signingKey, s.rand, hashed, opt.SigAlg)
+	var data []byte
+	err = signer.CallContext(ctx, func() (err error) {
+		data, err = margo.Sign(key.signingKey, s.rand, hashed, opt.SigAlg)
+		return err
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "mar: failed to sign")
 	}
+	sig := new(Signature)
+	sig.Data = data
 	return sig, nil
 }
 
+// PrepareHash replaces the signatures of a MAR file with a signature
+// header for the public key of the signer, and returns the file and
+// the hash of its signable block. Clients that don't want to upload
+// the whole file send the hash to SignHash and pass the returned
+// signature to EmbedSignature.
+func PrepareHash(input []byte, pubKey crypto.PublicKey) (*margo.File, []byte, error) {
+	marFile := new(margo.File)
+	err := margo.Unmarshal(input, marFile)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "mar: failed to unmarshal input file")
+	}
+	marFile.SignaturesHeader.NumSignatures = uint32(0)
+	marFile.Signatures = nil
+	err = marFile.PrepareSignature(nil, pubKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "mar: failed to prepare signature")
+	}
+	signableBlock, err := marFile.MarshalForSignature()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "mar: failed to marshal file for signature")
+	}
+	hashed, _, err := margo.Hash(signableBlock, marFile.Signatures[0].AlgorithmID)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "mar: failed to hash signable block")
+	}
+	return marFile, hashed, nil
+}
+
+// EmbedSignature stores the signature of the hash returned by
+// PrepareHash in the MAR file and returns the signed file
+func EmbedSignature(marFile *margo.File, sig []byte) ([]byte, error) {
+	if len(marFile.Signatures) != 1 {
+		return nil, errors.Errorf("mar: expected 1 prepared signature, got %d", len(marFile.Signatures))
+	}
+	if uint32(len(sig)) != marFile.Signatures[0].Size {
+		return nil, errors.Errorf("mar: signature is %d bytes long, the prepared header expects %d", len(sig), marFile.Signatures[0].Size)
+	}
+	marFile.Signatures[0].Data = sig
+	output, err := marFile.Marshal()
+	if err != nil {
+		return nil, errors.Wrap(err, "mar: failed to marshal signed file")
+	}
+	return output, nil
+}
+
 // Signature is a MAR signature
 type Signature struct {
 	Data []byte
@@ -167,13 +376,50 @@ type Options struct {
 	// SigAlg is an integer that represents the type of signature requested.
 	// It must map the SigAlg constants from the MAR package
 	SigAlg uint32 `json:"sigalg"`
+
+	// Channel is the name of the release channel whose key signs,
+	// like "nightly" or "release". The default key of the signer
+	// signs when it is empty.
+	Channel string `json:"channel,omitempty"`
 }
 
-// GetDefaultOptions returns default options of the signer
+// GetDefaultOptions returns default options of the signer, with its
+// first channel when it has no default key
 func (s *MARSigner) GetDefaultOptions() interface{} {
+	if s.signingKey == nil {
+		first := s.channels[s.channelNames[0]]
+		return Options{SigAlg: first.defaultSigAlg, Channel: s.channelNames[0]}
+	}
 	return Options{SigAlg: s.defaultSigAlg}
 }
 
+type allowedChannelsContextKey struct{}
+
+// WithAllowedChannels returns a context that limits the channels MAR
+// signers sign with to the allowed ones, like the channels the
+// credential of a request is allowed to sign for
+func WithAllowedChannels(ctx context.Context, channels []string) context.Context {
+	return context.WithValue(ctx, allowedChannelsContextKey{}, channels)
+}
+
+// AllowedChannelsFromContext returns the channels set with
+// WithAllowedChannels
+func AllowedChannelsFromContext(ctx context.Context) []string {
+	channels, _ := ctx.Value(allowedChannelsContextKey{}).([]string)
+	return channels
+}
+
+// ValidateChannelNames returns an error when a channel name is
+// malformed
+func ValidateChannelNames(channels []string) error {
+	for _, channel := range channels {
+		if !channelNameFormat.MatchString(channel) {
+			return errors.Errorf("mar: channel name %q must match %s", channel, signer.IDFormat)
+		}
+	}
+	return nil
+}
+
 // GetOptions takes a input interface and reflects it into a struct of options
 func GetOptions(input interface{}) (options Options, err error) {
 	buf, err := json.Marshal(input)
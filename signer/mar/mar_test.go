@@ -1,6 +1,7 @@
 package mar
 
 import (
+	"context"
 	"crypto"
 	"crypto/sha1"
 	"crypto/sha256"
@@ -8,6 +9,8 @@ import (
 	"encoding/base64"
 	"testing"
 
+	"github.com/pkg/errors"
+
 	"go.mozilla.org/autograph/signer"
 	margo "go.mozilla.org/mar"
 )
@@ -102,6 +105,41 @@ func TestSignHash(t *testing.T) {
 	}
 }
 
+func TestPrepareHashAndEmbedSignature(t *testing.T) {
+	for i, marsignerconf := range marsignerconfs {
+		s, err := New(marsignerconf)
+		if err != nil {
+			t.Fatalf("failed to initialize signer %d: %v", i, err)
+		}
+		t.Logf("testing signer %d %q", i, s.ID)
+		marFile, hashed, err := PrepareHash(miniMarB, s.publicKey)
+		if err != nil {
+			t.Fatalf("failed to prepare hash: %v", err)
+		}
+		sig, err := s.SignHash(hashed, nil)
+		if err != nil {
+			t.Fatalf("failed to sign hash: %v", err)
+		}
+		_, err = EmbedSignature(marFile, sig.(*Signature).Data[1:])
+		if err == nil {
+			t.Fatal("expected a truncated signature to be rejected")
+		}
+		signedMAR, err := EmbedSignature(marFile, sig.(*Signature).Data)
+		if err != nil {
+			t.Fatalf("failed to embed signature: %v", err)
+		}
+		var parsedMar margo.File
+		err = margo.Unmarshal(signedMAR, &parsedMar)
+		if err != nil {
+			t.Fatalf("failed to parse file: %v", err)
+		}
+		err = parsedMar.VerifySignature(s.publicKey)
+		if err != nil {
+			t.Fatalf("failed to verify signature: %v", err)
+		}
+	}
+}
+
 func TestSignDataWithBadSigAlg(t *testing.T) {
 	s, err := New(marsignerconfs[0])
 	if err != nil {
@@ -140,6 +178,92 @@ BLzIeIhb7Kx//dd/6o+W7wd/X9kpA1nQpNy+uAZEbg==
 	}
 }
 
+func TestChannels(t *testing.T) {
+	conf := signer.Configuration{
+		ID:         "unittestmarchannels",
+		Type:       Type,
+		PrivateKey: marsignerconfs[0].PrivateKey,
+		MARChannels: []signer.MARChannel{
+			{Name: "nightly", PrivateKey: marsignerconfs[1].PrivateKey},
+			{Name: "release", PrivateKey: marsignerconfs[2].PrivateKey},
+		},
+	}
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Channels()) != 2 || s.Channels()[0] != "nightly" {
+		t.Fatalf("unexpected channels %v", s.Channels())
+	}
+	nightly, err := New(marsignerconfs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedMAR, err := s.SignFile(miniMarB, Options{Channel: "nightly"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsedMar margo.File
+	err = margo.Unmarshal(signedMAR, &parsedMar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = parsedMar.VerifySignature(nightly.publicKey)
+	if err != nil {
+		t.Fatalf("expected the nightly key to sign: %v", err)
+	}
+	pubKey, err := s.PublicKeyForOptions(Options{Channel: "nightly"})
+	if err != nil || pubKey != nightly.PublicKey {
+		t.Fatalf("expected the public key of the nightly channel, got %q: %v", pubKey, err)
+	}
+	pubKey, err = s.PublicKeyForOptions(nil)
+	if err != nil || pubKey != s.PublicKey {
+		t.Fatalf("expected the default public key, got %q: %v", pubKey, err)
+	}
+
+	_, err = s.SignData([]byte("foo"), Options{Channel: "aurora"})
+	if errors.Cause(err) != signer.ErrInvalidOptions {
+		t.Fatalf("expected an unknown channel to be invalid, got %v", err)
+	}
+	ctx := WithAllowedChannels(context.Background(), []string{"nightly"})
+	_, err = s.SignDataContext(ctx, []byte("foo"), Options{Channel: "nightly"})
+	if err != nil {
+		t.Fatalf("expected the allowed channel to sign: %v", err)
+	}
+	for _, channel := range []string{"release", ""} {
+		_, err = s.SignDataContext(ctx, []byte("foo"), Options{Channel: channel})
+		if errors.Cause(err) != signer.ErrOptionNotPermitted {
+			t.Fatalf("expected channel %q to be refused, got %v", channel, err)
+		}
+	}
+
+	// without a default key, the first channel is the default
+	conf.PrivateKey = ""
+	s, err = New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.PublicKey != nightly.PublicKey || s.GetDefaultOptions().(Options).Channel != "nightly" {
+		t.Fatalf("expected the nightly channel to be the default, got %+v", s.GetDefaultOptions())
+	}
+	_, err = s.SignData([]byte("foo"), nil)
+	if errors.Cause(err) != signer.ErrInvalidOptions {
+		t.Fatalf("expected a channel to be required, got %v", err)
+	}
+
+	for i, channels := range [][]signer.MARChannel{
+		{{Name: "nightly", PrivateKey: marsignerconfs[1].PrivateKey}, {Name: "nightly", PrivateKey: marsignerconfs[2].PrivateKey}},
+		{{Name: "night ly", PrivateKey: marsignerconfs[1].PrivateKey}},
+		{{Name: "nightly"}},
+	} {
+		conf.MARChannels = channels
+		_, err = New(conf)
+		if err == nil {
+			t.Fatalf("testcase %d: expected invalid channels to be refused", i)
+		}
+	}
+}
+
 var marsignerconfs = []signer.Configuration{
 	signer.Configuration{
 		ID:   "unittestmar",
@@ -0,0 +1,18 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd
+
+package signer
+
+// mlock is a no-op on platforms without mlock(2)
+func mlock(b []byte) error {
+	return nil
+}
+
+// munlock is a no-op on platforms without munlock(2)
+func munlock(b []byte) error {
+	return nil
+}
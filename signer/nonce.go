@@ -0,0 +1,36 @@
+package signer
+
+import (
+	"encoding/hex"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// nonceTemplatePrefix starts the data signed with a client nonce
+	nonceTemplatePrefix = "Autograph-Nonce:"
+
+	// MinNonceSize and MaxNonceSize bound the size in bytes of
+	// the nonces clients bind signatures to
+	MinNonceSize = 8
+	MaxNonceSize = 64
+)
+
+// NonceBoundInput returns the data signed in place of data when a
+// client binds a signature to a nonce, so the signature proves it was
+// made after the client picked the nonce:
+//
+//	"Autograph-Nonce:" || hex(nonce) || 0x00 || data
+//
+// Signers then template and hash it as any other data, so a content
+// signature covers "Content-Signature:\x00Autograph-Nonce:...".
+func NonceBoundInput(nonce, data []byte) ([]byte, error) {
+	if len(nonce) < MinNonceSize || len(nonce) > MaxNonceSize {
+		return nil, errors.Errorf("nonce must be between %d and %d bytes, got %d", MinNonceSize, MaxNonceSize, len(nonce))
+	}
+	input := make([]byte, 0, len(nonceTemplatePrefix)+2*len(nonce)+1+len(data))
+	input = append(input, nonceTemplatePrefix...)
+	input = append(input, hex.EncodeToString(nonce)...)
+	input = append(input, 0)
+	return append(input, data...), nil
+}
@@ -0,0 +1,24 @@
+package signer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNonceBoundInput(t *testing.T) {
+	t.Parallel()
+
+	input, err := NonceBoundInput([]byte{0, 1, 2, 3, 4, 5, 6, 0xff}, []byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(input, []byte("Autograph-Nonce:00010203040506ff\x00foo")) {
+		t.Fatalf("unexpected nonce bound input %q", input)
+	}
+	for _, size := range []int{0, MinNonceSize - 1, MaxNonceSize + 1} {
+		_, err = NonceBoundInput(make([]byte, size), []byte("foo"))
+		if err == nil {
+			t.Fatalf("expected nonce of %d bytes to be refused", size)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package nullsigner
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/autograph/signer"
+)
+
+const (
+	// Type of this signer is "nullsigner"
+	Type = "nullsigner"
+
+	// maxHashLength is the length of the longest digest accepted
+	// on /sign/hash, a SHA512 digest
+	maxHashLength = 64
+)
+
+// NullSigner returns deterministic fake signatures without any key, so
+// clients can integrate with and load test autograph before they get
+// a real signer
+type NullSigner struct {
+	signer.Configuration
+}
+
+// New initializes a null signer using a configuration
+func New(conf signer.Configuration) (s *NullSigner, err error) {
+	s = new(NullSigner)
+
+	if conf.Type != Type {
+		return nil, errors.Errorf("nullsigner: invalid type %q, must be %q", conf.Type, Type)
+	}
+	s.Type = conf.Type
+
+	if conf.ID == "" {
+		return nil, errors.New("nullsigner: missing signer ID in signer configuration")
+	}
+	s.ID = conf.ID
+
+	if conf.PrivateKey != "" || conf.PublicKey != "" {
+		return nil, errors.New("nullsigner: signer configuration must not have keys, null signers never use them")
+	}
+	return s, nil
+}
+
+// Config returns the configuration of the current signer
+func (s *NullSigner) Config() signer.Configuration {
+	return signer.Configuration{
+		ID:   s.ID,
+		Type: s.Type,
+	}
+}
+
+// SignData returns the fake signature of data
+func (s *NullSigner) SignData(data []byte, options interface{}) (signer.Signature, error) {
+	_, err := GetOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	return &Signature{Data: fakeSignature(s.ID, data)}, nil
+}
+
+// SignHash returns the fake signature of a digest
+func (s *NullSigner) SignHash(digest []byte, options interface{}) (signer.Signature, error) {
+	if len(digest) == 0 || len(digest) > maxHashLength {
+		return nil, errors.Wrapf(signer.ErrInvalidHashLength, "nullsigner: refusing to sign input hash. Got length %d, expected 1 to %d", len(digest), maxHashLength)
+	}
+	return s.SignData(digest, options)
+}
+
+// SignFile returns the file unchanged: null signers validate the
+// request but don't modify files
+func (s *NullSigner) SignFile(file []byte, options interface{}) (signer.SignedFile, error) {
+	_, err := GetOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	return signer.SignedFile(file), nil
+}
+
+// GetTestFile returns a file the signer accepts in SignFile
+func (s *NullSigner) GetTestFile() []byte {
+	return []byte("AUTOGRAPH NULL SIGNER TEST FILE")
+}
+
+// fakeSignature returns the HMAC-SHA256 of data keyed with the signer
+// ID: the same input signed by the same signer always has the same
+// signature, and anyone can verify it
+func fakeSignature(signerID string, data []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(signerID))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Signature is a null signature
+type Signature struct {
+	Data []byte
+}
+
+// Marshal returns the base64 representation of a signature
+func (sig *Signature) Marshal() (string, error) {
+	return base64.StdEncoding.EncodeToString(sig.Data), nil
+}
+
+// Unmarshal decodes a base64 signature string into a Signature
+func Unmarshal(sigstr string) (*Signature, error) {
+	sigBytes, err := base64.StdEncoding.DecodeString(sigstr)
+	if err != nil {
+		return nil, errors.Wrap(err, "nullsigner: failed to decode signature")
+	}
+	return &Signature{Data: sigBytes}, nil
+}
+
+// Options are not used by null signers, but are validated like the
+// options of real signers so clients find mistakes early
+type Options struct {
+}
+
+// GetDefaultOptions returns default options of the signer
+func (s *NullSigner) GetDefaultOptions() interface{} {
+	return Options{}
+}
+
+// GetOptions takes a input interface and reflects it into a struct of
+// options, and returns an error when it has options null signers
+// don't know
+func GetOptions(input interface{}) (options Options, err error) {
+	if input == nil {
+		return
+	}
+	buf, err := json.Marshal(input)
+	if err != nil {
+		return options, errors.Wrap(err, "nullsigner: failed to marshal options")
+	}
+	if bytes.Equal(buf, []byte("null")) {
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&options)
+	if err != nil {
+		return options, errors.Wrap(err, "nullsigner: invalid options")
+	}
+	return
+}
+
+// VerifySignature verifies the fake signature of data by a null signer
+func VerifySignature(signerID string, data []byte, sigstr string) error {
+	sig, err := Unmarshal(sigstr)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(sig.Data, fakeSignature(signerID, data)) {
+		return errors.New("nullsigner: signature does not match input")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package nullsigner
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"go.mozilla.org/autograph/signer"
+)
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	for i, testcase := range []struct {
+		conf  signer.Configuration
+		valid bool
+	}{
+		{signer.Configuration{ID: "null1", Type: Type}, true},
+		{signer.Configuration{ID: "null1", Type: "rsapss"}, false},
+		{signer.Configuration{Type: Type}, false},
+		{signer.Configuration{ID: "null1", Type: Type, PrivateKey: "key"}, false},
+	} {
+		_, err := New(testcase.conf)
+		if testcase.valid && err != nil {
+			t.Fatalf("testcase %d: unexpected error: %v", i, err)
+		}
+		if !testcase.valid && err == nil {
+			t.Fatalf("testcase %d: expected an error", i)
+		}
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	t.Parallel()
+
+	s, err := New(signer.Configuration{ID: "null1", Type: Type})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := New(signer.Configuration{ID: "null2", Type: Type})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := []byte("foobarbaz1234abcd")
+
+	sig, err := s.SignData(input, s.GetDefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	againstr, _ := again.Marshal()
+	if againstr != sigstr {
+		t.Fatalf("expected deterministic signatures, got %q and %q", sigstr, againstr)
+	}
+	err = VerifySignature(s.ID, input, sigstr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = VerifySignature(s.ID, []byte("tampered"), sigstr)
+	if err == nil {
+		t.Fatal("expected the signature of other data to be refused")
+	}
+	otherSig, err := other.SignData(input, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherstr, _ := otherSig.Marshal()
+	if otherstr == sigstr {
+		t.Fatal("expected signers to have different signatures")
+	}
+
+	_, err = s.SignHash(make([]byte, 65), nil)
+	if errors.Cause(err) != signer.ErrInvalidHashLength {
+		t.Fatalf("expected an invalid hash length error, got %v", err)
+	}
+	_, err = s.SignHash(make([]byte, 32), map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedFile, err := s.SignFile(s.GetTestFile(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(signedFile, s.GetTestFile()) {
+		t.Fatal("expected the file to be returned unchanged")
+	}
+}
+
+func TestOptionsValidation(t *testing.T) {
+	t.Parallel()
+
+	s, err := New(signer.Configuration{ID: "null1", Type: Type})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.SignData([]byte("foo"), map[string]interface{}{"id": "unknown"})
+	if err == nil {
+		t.Fatal("expected unknown options to be refused")
+	}
+	_, err = s.SignFile([]byte("foo"), map[string]interface{}{"zip": "all"})
+	if err == nil {
+		t.Fatal("expected unknown file options to be refused")
+	}
+}
@@ -0,0 +1,199 @@
+package pgp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// KeyRequest describes an OpenPGP key to generate for a signer
+type KeyRequest struct {
+	// Name, Comment and Email make the user ID of the key,
+	// like "Name (Comment) <Email>"
+	Name    string
+	Comment string
+	Email   string
+
+	// Curve is the ECDSA curve of the key, P-256 or P-384.
+	// Defaults to P-256.
+	Curve string
+
+	// Lifetime is how long the key is valid after its creation.
+	// Keys without lifetime never expire.
+	Lifetime time.Duration
+}
+
+// Validate checks the parameters of a key request
+func (req KeyRequest) Validate() error {
+	if req.Name == "" && req.Email == "" {
+		return errors.New("pgp: key request needs a name or an email")
+	}
+	if _, _, err := req.curve(); err != nil {
+		return err
+	}
+	if req.Lifetime < 0 || req.Lifetime/time.Second > math.MaxUint32 {
+		return errors.Errorf("pgp: invalid key lifetime %s", req.Lifetime)
+	}
+	if packet.NewUserId(req.Name, req.Comment, req.Email) == nil {
+		return errors.New("pgp: name, comment and email of a key cannot contain ()<> or null characters")
+	}
+	return nil
+}
+
+// curve returns the curve of the key and the hash of its signatures
+func (req KeyRequest) curve() (elliptic.Curve, crypto.Hash, error) {
+	switch req.Curve {
+	case "", "P-256":
+		return elliptic.P256(), crypto.SHA256, nil
+	case "P-384":
+		return elliptic.P384(), crypto.SHA384, nil
+	default:
+		return nil, 0, errors.Errorf("pgp: unsupported curve %q, must be P-256 or P-384", req.Curve)
+	}
+}
+
+// GeneratedKey is an OpenPGP key generated for a signer
+type GeneratedKey struct {
+	Fingerprint string
+	KeyID       string
+	Email       string
+	CreatedAt   time.Time
+
+	// PublicKey is the armored public key with its self-signed
+	// user ID
+	PublicKey string
+
+	// PrivateKey is the label of the key in the HSM, or the
+	// armored private key when the signer has no HSM
+	PrivateKey string
+	OnHSM      bool
+
+	// publicKeyPackets is the binary public key, which Web Key
+	// Directories serve
+	publicKeyPackets []byte
+}
+
+// GenerateKey makes a new OpenPGP key with a user ID from the
+// request. The primary key certifies the user ID and signs data, so
+// the key has no subkey and its private part can stay in the HSM,
+// where it is generated when the signer has access to one. The key
+// is not used by the signer until its configuration is updated.
+func (s *PGPSigner) GenerateKey(req KeyRequest) (*GeneratedKey, error) {
+	err := req.Validate()
+	if err != nil {
+		return nil, err
+	}
+	curve, hash, _ := req.curve()
+	now := time.Now().UTC().Truncate(time.Second)
+	label := fmt.Sprintf("%s-pgp-%s", s.ID, now.Format("20060102150405"))
+	priv, _, err := s.conf.MakeKey(&ecdsa.PublicKey{Curve: curve}, label)
+	if err != nil {
+		return nil, errors.Wrap(err, "pgp: failed to make key")
+	}
+	keySigner, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("pgp: generated key of type %T is not a signer", priv)
+	}
+	config := &packet.Config{DefaultHash: hash, Rand: s.conf.GetRand()}
+	entity, err := newEntity(now, keySigner, req, config)
+	if err != nil {
+		return nil, err
+	}
+
+	var pub bytes.Buffer
+	err = entity.Serialize(&pub)
+	if err != nil {
+		return nil, errors.Wrap(err, "pgp: failed to serialize public key")
+	}
+	key := &GeneratedKey{
+		Fingerprint:      fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint),
+		KeyID:            entity.PrimaryKey.KeyIdString(),
+		Email:            req.Email,
+		CreatedAt:        now,
+		publicKeyPackets: pub.Bytes(),
+	}
+	key.PublicKey, err = armorPackets(pub.Bytes(), openpgp.PublicKeyType)
+	if err != nil {
+		return nil, err
+	}
+	if _, inMemory := priv.(*ecdsa.PrivateKey); !inMemory {
+		key.PrivateKey = label
+		key.OnHSM = true
+		return key, nil
+	}
+	var private bytes.Buffer
+	err = entity.SerializePrivate(&private, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "pgp: failed to serialize private key")
+	}
+	key.PrivateKey, err = armorPackets(private.Bytes(), openpgp.PrivateKeyType)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// newEntity returns an entity with the primary key of a signer and
+// a positive self-certification of the user ID of the request
+func newEntity(now time.Time, keySigner crypto.Signer, req KeyRequest, config *packet.Config) (*openpgp.Entity, error) {
+	primary := packet.NewSignerPrivateKey(now, keySigner)
+	uid := packet.NewUserId(req.Name, req.Comment, req.Email)
+	isPrimaryID := true
+	selfSig := &packet.Signature{
+		CreationTime: now,
+		SigType:      packet.SigTypePositiveCert,
+		PubKeyAlgo:   primary.PubKeyAlgo,
+		Hash:         config.Hash(),
+		IsPrimaryId:  &isPrimaryID,
+		FlagsValid:   true,
+		FlagSign:     true,
+		FlagCertify:  true,
+		IssuerKeyId:  &primary.KeyId,
+	}
+	if req.Lifetime > 0 {
+		lifetime := uint32(req.Lifetime / time.Second)
+		selfSig.KeyLifetimeSecs = &lifetime
+	}
+	err := selfSig.SignUserId(uid.Id, &primary.PublicKey, primary, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "pgp: failed to self-sign user ID")
+	}
+	return &openpgp.Entity{
+		PrimaryKey: &primary.PublicKey,
+		PrivateKey: primary,
+		Identities: map[string]*openpgp.Identity{
+			uid.Id: {
+				Name:          uid.Id,
+				UserId:        uid,
+				SelfSignature: selfSig,
+			},
+		},
+	}, nil
+}
+
+// armorPackets returns armored OpenPGP packets of a block type
+func armorPackets(packets []byte, blockType string) (string, error) {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, blockType, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "pgp: failed to armor key")
+	}
+	_, err = w.Write(packets)
+	if err != nil {
+		return "", errors.Wrap(err, "pgp: failed to armor key")
+	}
+	err = w.Close()
+	if err != nil {
+		return "", errors.Wrap(err, "pgp: failed to armor key")
+	}
+	return buf.String(), nil
+}
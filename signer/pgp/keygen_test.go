@@ -0,0 +1,206 @@
+package pgp
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/signer"
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestGenerateKey(t *testing.T) {
+	s, err := New(pgpsignerconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, curve := range []string{"", "P-384"} {
+		key, err := s.GenerateKey(KeyRequest{
+			Name:     "Autograph Test",
+			Email:    "autograph-test@example.net",
+			Curve:    curve,
+			Lifetime: 365 * 24 * time.Hour,
+		})
+		if err != nil {
+			t.Fatalf("curve %q: failed to generate key: %v", curve, err)
+		}
+		if key.OnHSM {
+			t.Fatalf("curve %q: expected an in-memory key", curve)
+		}
+		entity, err := readArmoredEntity(key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entity.PrimaryKey.KeyIdString() != key.KeyID {
+			t.Fatalf("curve %q: key ID %s does not match public key %s", curve, key.KeyID, entity.PrimaryKey.KeyIdString())
+		}
+		identity := entity.Identities["Autograph Test <autograph-test@example.net>"]
+		if identity == nil || identity.SelfSignature.KeyLifetimeSecs == nil || *identity.SelfSignature.KeyLifetimeSecs != 365*24*3600 {
+			t.Fatalf("curve %q: expected a self-signed user ID with a key lifetime, got %+v", curve, entity.Identities)
+		}
+
+		// the generated key configures a new pgp signer
+		keySigner, err := New(signer.Configuration{ID: "pgpgenerated", Type: Type, PrivateKey: key.PrivateKey})
+		if err != nil {
+			t.Fatalf("curve %q: failed to load generated key: %v", curve, err)
+		}
+		input := []byte("signed with a generated key")
+		sig, err := keySigner.SignData(input, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{entity}, bytes.NewReader(input), bytes.NewReader(sig.(*Signature).Data))
+		if err != nil {
+			t.Fatalf("curve %q: failed to verify signature: %v", curve, err)
+		}
+		verifyWithGnuPG(t, key.PublicKey, input, sig.(*Signature).Data)
+	}
+}
+
+// verifyWithGnuPG imports a public key in a temporary GNUPGHOME and
+// verifies a detached signature with it
+func verifyWithGnuPG(t *testing.T, publicKey string, input, sig []byte) {
+	home, err := ioutil.TempDir("", "autograph_pgp_keygen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	defer exec.Command("gpgconf", "--homedir", home, "--kill", "gpg-agent").Run()
+	files := map[string][]byte{"key.asc": []byte(publicKey), "input": input, "input.asc": sig}
+	for name, data := range files {
+		err = ioutil.WriteFile(filepath.Join(home, name), data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := exec.Command("gpg", "--homedir", home, "--import", filepath.Join(home, "key.asc")).CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to import public key: %s\n%s", err, out)
+	}
+	out, err = exec.Command("gpg", "--homedir", home, "--verify", filepath.Join(home, "input.asc"), filepath.Join(home, "input")).CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to verify signature: %s\n%s", err, out)
+	}
+}
+
+func TestGenerateKeyInvalidRequests(t *testing.T) {
+	s, err := New(pgpsignerconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, req := range []KeyRequest{
+		{},
+		{Name: "Autograph Test", Curve: "P-521"},
+		{Name: "Autograph <Test>"},
+		{Name: "Autograph Test", Lifetime: -time.Hour},
+	} {
+		_, err = s.GenerateKey(req)
+		if err == nil {
+			t.Fatalf("testcase %d: expected key generation to fail", i)
+		}
+	}
+}
+
+func TestNewWithHSMLabelWithoutHSM(t *testing.T) {
+	_, err := New(signer.Configuration{ID: "pgphsm", Type: Type, PrivateKey: "pgphsm-pgp-20200101000000"})
+	if err == nil {
+		t.Fatal("expected a signer with an HSM label and no public key to fail")
+	}
+	s, err := New(pgpsignerconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = New(signer.Configuration{ID: "pgphsm", Type: Type, PrivateKey: "pgphsm-pgp-20200101000000", PublicKey: s.PublicKey})
+	if err == nil {
+		t.Fatal("expected a signer with an HSM label and no HSM to fail")
+	}
+}
+
+func TestWKDHash(t *testing.T) {
+	// example of the OpenPGP Web Key Directory draft
+	hash, err := wkdHash("Joe.Doe@Example.ORG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != "iy9q119eutrkn8s1mk4r39qejnbu3n5q" {
+		t.Fatalf("unexpected web key directory hash %q", hash)
+	}
+	for _, email := range []string{"", "@example.org", "joe.doe@", "joe.doe"} {
+		_, err = wkdHash(email)
+		if err == nil {
+			t.Fatalf("expected email %q to be invalid", email)
+		}
+	}
+}
+
+func TestPublishKey(t *testing.T) {
+	var submitted []string
+	keyserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/pks/add" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		submitted = append(submitted, r.FormValue("keytext"))
+	}))
+	defer keyserver.Close()
+	wkdDir, err := ioutil.TempDir("", "autograph_pgp_wkd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(wkdDir)
+
+	conf := pgpsignerconf
+	conf.PGPPublish = signer.PGPPublishConfig{
+		Keyservers:   []string{keyserver.URL},
+		WKDDirectory: wkdDir,
+	}
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := s.GenerateKey(KeyRequest{Name: "Autograph Test", Email: "Joe.Doe@Example.ORG"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	locations, err := s.PublishKey(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wkdFile := filepath.Join(wkdDir, "hu", "iy9q119eutrkn8s1mk4r39qejnbu3n5q")
+	if len(locations) != 2 || locations[0] != keyserver.URL || locations[1] != wkdFile {
+		t.Fatalf("unexpected publication locations %q", locations)
+	}
+	if len(submitted) != 1 || submitted[0] != key.PublicKey {
+		t.Fatalf("expected the armored public key to be submitted to the keyserver, got %q", submitted)
+	}
+	published, err := ioutil.ReadFile(wkdFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entities, err := openpgp.ReadKeyRing(bytes.NewReader(published))
+	if err != nil || len(entities) != 1 || entities[0].PrimaryKey.KeyIdString() != key.KeyID {
+		t.Fatalf("expected the binary public key in the web key directory, got %d entities: %v", len(entities), err)
+	}
+	if _, err = os.Stat(filepath.Join(wkdDir, "policy")); err != nil {
+		t.Fatalf("expected a web key directory policy file: %v", err)
+	}
+
+	// keyservers errors are returned
+	s.PGPPublish.Keyservers = []string{keyserver.URL + "/missing"}
+	_, err = s.PublishKey(context.Background(), key)
+	if err == nil {
+		t.Fatal("expected publication to a failing keyserver to fail")
+	}
+	s.PGPPublish = signer.PGPPublishConfig{}
+	_, err = s.PublishKey(context.Background(), key)
+	if err == nil {
+		t.Fatal("expected publication without locations to fail")
+	}
+}
@@ -2,11 +2,17 @@ package pgp
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"strings"
 
 	"github.com/pkg/errors"
 	"go.mozilla.org/autograph/signer"
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
 const (
@@ -20,6 +26,14 @@ const (
 type PGPSigner struct {
 	signer.Configuration
 	entity *openpgp.Entity
+
+	// hash is the digest algorithm of signatures, which
+	// matches the curve size of ECDSA keys
+	hash crypto.Hash
+
+	// conf is the configuration the signer was initialized
+	// with, which keeps access to the HSM to generate keys
+	conf signer.Configuration
 }
 
 // New initializes a pgp signer using a configuration
@@ -40,14 +54,23 @@ func New(conf signer.Configuration) (s *PGPSigner, err error) {
 		return nil, errors.New("pgp: missing private key in signer configuration")
 	}
 	s.PrivateKey = conf.PrivateKey
-	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewBufferString(s.PrivateKey))
-	if err != nil {
-		return nil, errors.Wrap(err, "pgp: failed to read armored keyring")
+	s.PGPPublish = conf.PGPPublish
+	s.conf = conf
+	if strings.HasPrefix(strings.TrimSpace(s.PrivateKey), "-----BEGIN PGP") {
+		s.entity, err = readArmoredEntity(s.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		s.entity, err = loadHSMEntity(conf)
+		if err != nil {
+			return nil, err
+		}
 	}
-	if len(entities) != 1 {
-		return nil, errors.Errorf("pgp: found %d entities in armored keyring, expected one", len(entities))
+	s.hash = crypto.SHA256
+	if pub, ok := s.entity.PrimaryKey.PublicKey.(*ecdsa.PublicKey); ok && pub.Curve == elliptic.P384() {
+		s.hash = crypto.SHA384
 	}
-	s.entity = entities[0]
 
 	// serialize the public key
 	var pubkeybuf bytes.Buffer
@@ -70,6 +93,50 @@ func New(conf signer.Configuration) (s *PGPSigner, err error) {
 	return
 }
 
+// readArmoredEntity returns the single entity of an armored keyring
+func readArmoredEntity(armored string) (*openpgp.Entity, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewBufferString(armored))
+	if err != nil {
+		return nil, errors.Wrap(err, "pgp: failed to read armored keyring")
+	}
+	if len(entities) != 1 {
+		return nil, errors.Errorf("pgp: found %d entities in armored keyring, expected one", len(entities))
+	}
+	return entities[0], nil
+}
+
+// loadHSMEntity returns the entity of a primary key stored in the
+// HSM under the label of the private key. The armored public key of
+// the configuration provides the user IDs and creation time of the
+// key, which must match the HSM key.
+func loadHSMEntity(conf signer.Configuration) (*openpgp.Entity, error) {
+	if conf.PublicKey == "" {
+		return nil, errors.New("pgp: the private key is not an armored keyring and the armored public key of the HSM key is missing")
+	}
+	entity, err := readArmoredEntity(conf.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := conf.GetPrivateKey()
+	if err != nil {
+		return nil, errors.Wrapf(err, "pgp: failed to get HSM key %q", conf.PrivateKey)
+	}
+	hsmSigner, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("pgp: HSM key %q of type %T is not a signer", conf.PrivateKey, priv)
+	}
+	switch hsmSigner.Public().(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+	default:
+		return nil, errors.Errorf("pgp: unsupported HSM key type %T", hsmSigner.Public())
+	}
+	entity.PrivateKey = packet.NewSignerPrivateKey(entity.PrimaryKey.CreationTime, hsmSigner)
+	if entity.PrivateKey.Fingerprint != entity.PrimaryKey.Fingerprint {
+		return nil, errors.Errorf("pgp: HSM key %q does not match the public key %X", conf.PrivateKey, entity.PrimaryKey.Fingerprint)
+	}
+	return entity, nil
+}
+
 // Config returns the configuration of the current signer
 func (s *PGPSigner) Config() signer.Configuration {
 	return signer.Configuration{
@@ -77,6 +144,7 @@ func (s *PGPSigner) Config() signer.Configuration {
 		Type:       s.Type,
 		PrivateKey: s.PrivateKey,
 		PublicKey:  s.PublicKey,
+		PGPPublish: s.PGPPublish,
 	}
 }
 
@@ -84,7 +152,7 @@ func (s *PGPSigner) Config() signer.Configuration {
 func (s *PGPSigner) SignData(data []byte, options interface{}) (signer.Signature, error) {
 	out := bytes.NewBuffer(nil)
 	message := bytes.NewBuffer(data)
-	err := openpgp.ArmoredDetachSign(out, s.entity, message, nil)
+	err := openpgp.ArmoredDetachSign(out, s.entity, message, &packet.Config{DefaultHash: s.hash})
 	if err != nil {
 		return nil, errors.Wrap(err, "pgp: failed to sign")
 	}
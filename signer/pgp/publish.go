@@ -0,0 +1,150 @@
+package pgp
+
+import (
+	"context"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// zbase32Alphabet is the human-oriented base32 alphabet of the hashed
+// local parts of Web Key Directory file names
+const zbase32Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+// keyserverClient submits keys to HKP keyservers
+var keyserverClient = &http.Client{Timeout: 30 * time.Second}
+
+// zbase32 encodes data with the z-base-32 alphabet, most significant
+// bits first and without padding
+func zbase32(data []byte) string {
+	var (
+		out  strings.Builder
+		acc  uint
+		bits uint
+	)
+	for _, b := range data {
+		acc = acc<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out.WriteByte(zbase32Alphabet[(acc>>bits)&0x1f])
+		}
+	}
+	if bits > 0 {
+		out.WriteByte(zbase32Alphabet[(acc<<(5-bits))&0x1f])
+	}
+	return out.String()
+}
+
+// wkdHash returns the name of the file of an email address in the
+// hu directory of a Web Key Directory: the z-base-32 encoded SHA1
+// of the lowercased local part of the address
+func wkdHash(email string) (string, error) {
+	at := strings.LastIndex(email, "@")
+	if at < 1 || at == len(email)-1 {
+		return "", errors.Errorf("pgp: invalid email address %q", email)
+	}
+	digest := sha1.Sum([]byte(strings.ToLower(email[:at])))
+	return zbase32(digest[:]), nil
+}
+
+// PublishKey submits the public key to the keyservers of the signer
+// and writes it to its Web Key Directory. It returns the locations
+// the key was published to, which are the ones before a failure when
+// it returns an error.
+func (s *PGPSigner) PublishKey(ctx context.Context, key *GeneratedKey) (locations []string, err error) {
+	if len(s.PGPPublish.Keyservers) == 0 && s.PGPPublish.WKDDirectory == "" {
+		return nil, errors.Errorf("pgp: signer %q has no keyserver or web key directory to publish keys to", s.ID)
+	}
+	for _, keyserver := range s.PGPPublish.Keyservers {
+		err = submitToKeyserver(ctx, keyserver, key.PublicKey)
+		if err != nil {
+			return locations, err
+		}
+		locations = append(locations, keyserver)
+	}
+	if s.PGPPublish.WKDDirectory != "" {
+		location, err := writeToWKD(s.PGPPublish.WKDDirectory, key)
+		if err != nil {
+			return locations, err
+		}
+		locations = append(locations, location)
+	}
+	return locations, nil
+}
+
+// submitToKeyserver sends an armored public key to the /pks/add
+// endpoint of an HKP keyserver
+func submitToKeyserver(ctx context.Context, keyserver, armoredKey string) error {
+	form := url.Values{"keytext": {armoredKey}}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(keyserver, "/")+"/pks/add", strings.NewReader(form.Encode()))
+	if err != nil {
+		return errors.Wrapf(err, "pgp: failed to make keyserver request to %q", keyserver)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := keyserverClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "pgp: failed to submit key to keyserver %q", keyserver)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 512})
+		return errors.Errorf("pgp: keyserver %q refused key with status %d: %s", keyserver, resp.StatusCode, body)
+	}
+	return nil
+}
+
+// writeToWKD writes the binary public key to the hu directory of a
+// Web Key Directory, and creates the policy file the directory must
+// have if it is missing. The key file is renamed into place so
+// clients never fetch a partial key.
+func writeToWKD(dir string, key *GeneratedKey) (string, error) {
+	if key.Email == "" {
+		return "", errors.New("pgp: cannot publish a key without email address to a web key directory")
+	}
+	hash, err := wkdHash(key.Email)
+	if err != nil {
+		return "", err
+	}
+	huDir := filepath.Join(dir, "hu")
+	err = os.MkdirAll(huDir, 0755)
+	if err != nil {
+		return "", errors.Wrap(err, "pgp: failed to create web key directory")
+	}
+	policy := filepath.Join(dir, "policy")
+	if _, err = os.Stat(policy); os.IsNotExist(err) {
+		err = ioutil.WriteFile(policy, nil, 0644)
+		if err != nil {
+			return "", errors.Wrap(err, "pgp: failed to create web key directory policy")
+		}
+	}
+	tmpFile, err := ioutil.TempFile(huDir, "."+hash)
+	if err != nil {
+		return "", errors.Wrap(err, "pgp: failed to create web key directory key file")
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(key.publicKeyPackets)
+	if err == nil {
+		err = tmpFile.Chmod(0644)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "pgp: failed to write web key directory key file")
+	}
+	location := filepath.Join(huDir, hash)
+	err = os.Rename(tmpFile.Name(), location)
+	if err != nil {
+		return "", errors.Wrap(err, "pgp: failed to write web key directory key file")
+	}
+	return location, nil
+}
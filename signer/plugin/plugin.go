@@ -0,0 +1,359 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/signer"
+)
+
+const (
+	// Type of this signer is "plugin"
+	Type = "plugin"
+
+	// defaultTimeout is how long a plugin has to start or to
+	// answer a signing operation when the configuration doesn't
+	// set a timeout
+	defaultTimeout = 10 * time.Second
+)
+
+// PluginSigner forwards signing operations to an external process, so
+// signer types can be added to autograph without compiling them in.
+// It implements the signing interfaces the plugin supports through
+// the plugin* types it is embedded in.
+type PluginSigner struct {
+	signer.Configuration
+
+	// init is the description of the signer the plugin returned
+	// when it first started
+	init InitResponse
+
+	// mu protects proc, which is restarted when the plugin exits
+	mu   sync.Mutex
+	proc *process
+}
+
+// process is a running plugin
+type process struct {
+	cmd    *exec.Cmd
+	client *rpc.Client
+
+	// exited is closed when the process exits
+	exited chan struct{}
+}
+
+// New starts the plugin of a signer configuration and returns a signer
+// with the signing interfaces it supports
+func New(conf signer.Configuration) (signer.Signer, error) {
+	if conf.Type != Type {
+		return nil, errors.Errorf("plugin: invalid type %q, must be %q", conf.Type, Type)
+	}
+	if conf.ID == "" {
+		return nil, errors.New("plugin: missing signer ID in signer configuration")
+	}
+	if conf.Plugin.Command == "" {
+		return nil, errors.Errorf("plugin: missing plugin command in configuration of signer %q", conf.ID)
+	}
+	if conf.Plugin.Timeout <= 0 {
+		conf.Plugin.Timeout = defaultTimeout
+	}
+	s := &PluginSigner{Configuration: conf}
+	proc, init, err := s.start()
+	if err != nil {
+		return nil, err
+	}
+	s.proc, s.init = proc, *init
+	if s.Mode == "" {
+		s.Mode = s.init.Mode
+	}
+	if s.PublicKey == "" {
+		s.PublicKey = s.init.PublicKey
+	}
+	switch {
+	case s.init.HashSigning && s.init.DataSigning && s.init.FileSigning:
+		return &pluginHashDataFileSigner{s, pluginHash{s}, pluginData{s}, pluginFile{s}}, nil
+	case s.init.HashSigning && s.init.DataSigning:
+		return &pluginHashDataSigner{s, pluginHash{s}, pluginData{s}}, nil
+	case s.init.HashSigning && s.init.FileSigning:
+		return &pluginHashFileSigner{s, pluginHash{s}, pluginFile{s}}, nil
+	case s.init.DataSigning && s.init.FileSigning:
+		return &pluginDataFileSigner{s, pluginData{s}, pluginFile{s}}, nil
+	case s.init.HashSigning:
+		return &pluginHashSigner{s, pluginHash{s}}, nil
+	case s.init.DataSigning:
+		return &pluginDataSigner{s, pluginData{s}}, nil
+	case s.init.FileSigning:
+		return &pluginFileSigner{s, pluginFile{s}}, nil
+	}
+	s.proc.stop()
+	return nil, errors.Errorf("plugin: plugin of signer %q supports no signing operation", conf.ID)
+}
+
+// start runs the plugin and initializes it
+func (s *PluginSigner) start() (*process, *InitResponse, error) {
+	cmd := exec.Command(s.Plugin.Command, s.Plugin.Args...)
+	// don't leak the environment of autograph, like AWS
+	// credentials, to the plugin
+	cmd.Env = s.Plugin.Env
+	if cmd.Env == nil {
+		cmd.Env = []string{}
+	}
+	// the standard error of the plugin goes to the logs of autograph
+	stderr := log.WithFields(log.Fields{"signer_id": s.ID, "plugin": s.Plugin.Command}).WriterLevel(log.InfoLevel)
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "plugin: failed to start plugin of signer %q", s.ID)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "plugin: failed to start plugin of signer %q", s.ID)
+	}
+	err = cmd.Start()
+	if err != nil {
+		stderr.Close()
+		return nil, nil, errors.Wrapf(err, "plugin: failed to start plugin of signer %q", s.ID)
+	}
+	proc := &process{
+		cmd:    cmd,
+		client: rpc.NewClientWithCodec(jsonrpc.NewClientCodec(stdio{stdout, stdin})),
+		exited: make(chan struct{}),
+	}
+	go func() {
+		err := cmd.Wait()
+		stderr.Close()
+		log.Infof("plugin: plugin of signer %q exited: %v", s.ID, err)
+		close(proc.exited)
+	}()
+
+	var init InitResponse
+	err = proc.call(context.Background(), s.Plugin.Timeout, "Init", InitRequest{
+		ID:          s.ID,
+		Mode:        s.Mode,
+		PrivateKey:  s.PrivateKey,
+		PublicKey:   s.PublicKey,
+		Certificate: s.Certificate,
+		Settings:    s.Plugin.Settings,
+	}, &init)
+	if err != nil {
+		proc.stop()
+		return nil, nil, errors.Wrapf(err, "plugin: failed to initialize plugin of signer %q", s.ID)
+	}
+	return proc, &init, nil
+}
+
+// call calls a method of the plugin and waits for its response until
+// the timeout or the context is done
+func (p *process) call(ctx context.Context, timeout time.Duration, method string, args, reply interface{}) error {
+	call := p.client.Go(serviceName+"."+method, args, reply, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			if _, ok := call.Error.(rpc.ServerError); ok {
+				return errors.Errorf("plugin returned an error: %v", call.Error)
+			}
+			// the connection to the plugin broke, make sure
+			// it exits so it is restarted by the next call
+			p.stop()
+			return call.Error
+		}
+		return nil
+	case <-p.exited:
+		return errors.New("plugin exited")
+	case <-timer.C:
+		return errors.Errorf("plugin did not answer %s within %s", method, timeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// running returns whether the process hasn't exited
+func (p *process) running() bool {
+	select {
+	case <-p.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// stop closes the standard input of the plugin, which makes it exit,
+// and kills it if it doesn't
+func (p *process) stop() {
+	p.client.Close()
+	select {
+	case <-p.exited:
+	case <-time.After(time.Second):
+		p.cmd.Process.Kill()
+		<-p.exited
+	}
+}
+
+// process returns the running plugin, and restarts it when it exited
+func (s *PluginSigner) process() (*process, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.proc.running() {
+		return s.proc, nil
+	}
+	log.Warnf("plugin: restarting plugin of signer %q", s.ID)
+	proc, init, err := s.start()
+	if err != nil {
+		return nil, err
+	}
+	if init.HashSigning != s.init.HashSigning || init.DataSigning != s.init.DataSigning || init.FileSigning != s.init.FileSigning {
+		// the signing interfaces of the signer can't change
+		proc.stop()
+		return nil, errors.Errorf("plugin: plugin of signer %q changed its signing operations when restarted", s.ID)
+	}
+	s.proc = proc
+	return proc, nil
+}
+
+// sign sends a signing operation to the plugin
+func (s *PluginSigner) sign(ctx context.Context, operation string, input []byte, options interface{}) (*SignResponse, error) {
+	req := SignRequest{Operation: operation, Input: input}
+	if options != nil {
+		var err error
+		req.Options, err = json.Marshal(options)
+		if err != nil {
+			return nil, errors.Wrap(err, "plugin: failed to marshal signing options")
+		}
+	}
+	proc, err := s.process()
+	if err != nil {
+		return nil, err
+	}
+	var resp SignResponse
+	err = proc.call(ctx, s.Plugin.Timeout, "Sign", req, &resp)
+	if err != nil {
+		return nil, errors.Wrapf(err, "plugin: failed to sign %s with signer %q", operation, s.ID)
+	}
+	return &resp, nil
+}
+
+// Config returns the configuration of the signer
+func (s *PluginSigner) Config() signer.Configuration {
+	return s.Configuration
+}
+
+// Options are the JSON signing options of a plugin
+type Options json.RawMessage
+
+// MarshalJSON returns the options as they are sent to the plugin
+func (o Options) MarshalJSON() ([]byte, error) {
+	if len(o) == 0 {
+		return []byte("null"), nil
+	}
+	return []byte(o), nil
+}
+
+// GetDefaultOptions returns the default options of the plugin
+func (s *PluginSigner) GetDefaultOptions() interface{} {
+	if len(s.init.DefaultOptions) == 0 {
+		return nil
+	}
+	return Options(s.init.DefaultOptions)
+}
+
+// Signature is a signature marshaled by a plugin
+type Signature string
+
+// Marshal returns the signature marshaled by the plugin
+func (sig Signature) Marshal() (string, error) { return string(sig), nil }
+
+// pluginHash signs hashes with a plugin
+type pluginHash struct{ s *PluginSigner }
+
+func (h pluginHash) SignHash(digest []byte, options interface{}) (signer.Signature, error) {
+	return h.SignHashContext(context.Background(), digest, options)
+}
+
+func (h pluginHash) SignHashContext(ctx context.Context, digest []byte, options interface{}) (signer.Signature, error) {
+	resp, err := h.s.sign(ctx, OperationHash, digest, options)
+	if err != nil {
+		return nil, err
+	}
+	return Signature(resp.Signature), nil
+}
+
+// pluginData signs data with a plugin
+type pluginData struct{ s *PluginSigner }
+
+func (d pluginData) SignData(data []byte, options interface{}) (signer.Signature, error) {
+	return d.SignDataContext(context.Background(), data, options)
+}
+
+func (d pluginData) SignDataContext(ctx context.Context, data []byte, options interface{}) (signer.Signature, error) {
+	resp, err := d.s.sign(ctx, OperationData, data, options)
+	if err != nil {
+		return nil, err
+	}
+	return Signature(resp.Signature), nil
+}
+
+// pluginFile signs files with a plugin
+type pluginFile struct{ s *PluginSigner }
+
+func (f pluginFile) SignFile(file []byte, options interface{}) (signer.SignedFile, error) {
+	return f.SignFileContext(context.Background(), file, options)
+}
+
+func (f pluginFile) SignFileContext(ctx context.Context, file []byte, options interface{}) (signer.SignedFile, error) {
+	resp, err := f.s.sign(ctx, OperationFile, file, options)
+	if err != nil {
+		return nil, err
+	}
+	return resp.SignedFile, nil
+}
+
+func (f pluginFile) GetTestFile() []byte {
+	return f.s.init.TestFile
+}
+
+// plugin signers with the signing interfaces each plugin supports
+type (
+	pluginHashDataFileSigner struct {
+		*PluginSigner
+		pluginHash
+		pluginData
+		pluginFile
+	}
+	pluginHashDataSigner struct {
+		*PluginSigner
+		pluginHash
+		pluginData
+	}
+	pluginHashFileSigner struct {
+		*PluginSigner
+		pluginHash
+		pluginFile
+	}
+	pluginDataFileSigner struct {
+		*PluginSigner
+		pluginData
+		pluginFile
+	}
+	pluginHashSigner struct {
+		*PluginSigner
+		pluginHash
+	}
+	pluginDataSigner struct {
+		*PluginSigner
+		pluginData
+	}
+	pluginFileSigner struct {
+		*PluginSigner
+		pluginFile
+	}
+)
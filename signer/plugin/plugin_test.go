@@ -0,0 +1,194 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"go.mozilla.org/autograph/signer"
+)
+
+// the test binary serves testPlugin when it runs as a plugin
+const testPluginEnv = "AUTOGRAPH_TEST_PLUGIN=1"
+
+func TestMain(m *testing.M) {
+	if os.Getenv("AUTOGRAPH_TEST_PLUGIN") == "1" {
+		err := Serve(testPlugin{})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testPlugin signs data with the input and the suffix option, and
+// files by reversing them
+type testPlugin struct{}
+
+type testOptions struct {
+	Suffix string `json:"suffix"`
+}
+
+func (testPlugin) Init(req InitRequest) (*InitResponse, error) {
+	if req.Settings["fail"] != "" {
+		return nil, errors.New(req.Settings["fail"])
+	}
+	return &InitResponse{
+		Mode:           "test",
+		PublicKey:      "pub-" + req.ID,
+		DataSigning:    true,
+		FileSigning:    req.Settings["files"] != "",
+		DefaultOptions: json.RawMessage(`{"suffix":"default"}`),
+		TestFile:       []byte("testfile"),
+	}, nil
+}
+
+func (testPlugin) Sign(req SignRequest) (*SignResponse, error) {
+	switch string(req.Input) {
+	case "slow":
+		time.Sleep(2 * time.Second)
+	case "crash":
+		os.Exit(3)
+	case "error":
+		return nil, errors.New("refusing to sign")
+	}
+	switch req.Operation {
+	case OperationData:
+		var opts testOptions
+		if len(req.Options) > 0 {
+			err := json.Unmarshal(req.Options, &opts)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &SignResponse{Signature: string(req.Input) + "/" + opts.Suffix}, nil
+	case OperationFile:
+		out := make([]byte, len(req.Input))
+		for i, b := range req.Input {
+			out[len(out)-1-i] = b
+		}
+		return &SignResponse{SignedFile: out}, nil
+	}
+	return nil, errors.Errorf("unsupported operation %q", req.Operation)
+}
+
+func testConf(settings map[string]string) signer.Configuration {
+	return signer.Configuration{
+		ID:   "testplugin",
+		Type: Type,
+		Plugin: signer.PluginConfig{
+			Command:  os.Args[0],
+			Env:      []string{testPluginEnv},
+			Settings: settings,
+			Timeout:  time.Second,
+		},
+	}
+}
+
+func TestPluginSigner(t *testing.T) {
+	s, err := New(testConf(map[string]string{"files": "yes"}))
+	if err != nil {
+		t.Fatalf("failed to start plugin: %v", err)
+	}
+	defer s.(*pluginDataFileSigner).proc.stop()
+	if _, ok := s.(signer.HashSigner); ok {
+		t.Fatal("expected plugin signer not to sign hashes")
+	}
+	if s.Config().Mode != "test" || s.Config().PublicKey != "pub-testplugin" {
+		t.Fatalf("expected mode and public key from the plugin, got %q and %q", s.Config().Mode, s.Config().PublicKey)
+	}
+
+	dataSigner := s.(signer.DataSigner)
+	sig, err := dataSigner.SignData([]byte("foo"), dataSigner.GetDefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	marshaled, _ := sig.Marshal()
+	if marshaled != "foo/default" {
+		t.Fatalf("expected signature %q, got %q", "foo/default", marshaled)
+	}
+	sig, err = dataSigner.SignData([]byte("bar"), map[string]interface{}{"suffix": "custom"})
+	if err != nil {
+		t.Fatalf("failed to sign data with options: %v", err)
+	}
+	marshaled, _ = sig.Marshal()
+	if marshaled != "bar/custom" {
+		t.Fatalf("expected signature %q, got %q", "bar/custom", marshaled)
+	}
+
+	signedFile, err := s.(signer.FileSigner).SignFile([]byte("abc"), nil)
+	if err != nil {
+		t.Fatalf("failed to sign file: %v", err)
+	}
+	if string(signedFile) != "cba" {
+		t.Fatalf("expected signed file %q, got %q", "cba", signedFile)
+	}
+	if string(s.(signer.TestFileGetter).GetTestFile()) != "testfile" {
+		t.Fatal("expected the test file of the plugin")
+	}
+
+	_, err = dataSigner.SignData([]byte("error"), nil)
+	if err == nil || !strings.Contains(err.Error(), "plugin returned an error: refusing to sign") {
+		t.Fatalf("expected the error of the plugin, got: %v", err)
+	}
+
+	_, err = dataSigner.SignData([]byte("slow"), nil)
+	if err == nil || !strings.Contains(err.Error(), "did not answer Sign within") {
+		t.Fatalf("expected the plugin to time out, got: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = signer.SignDataContext(ctx, dataSigner, []byte("foo"), nil)
+	if errors.Cause(err) != context.Canceled {
+		t.Fatalf("expected a canceled operation, got: %v", err)
+	}
+}
+
+func TestPluginRestart(t *testing.T) {
+	s, err := New(testConf(nil))
+	if err != nil {
+		t.Fatalf("failed to start plugin: %v", err)
+	}
+	dataSigner := s.(*pluginDataSigner)
+	defer func() { dataSigner.proc.stop() }()
+
+	_, err = dataSigner.SignData([]byte("crash"), nil)
+	if err == nil {
+		t.Fatal("expected signing to fail when the plugin crashes")
+	}
+	sig, err := dataSigner.SignData([]byte("foo"), nil)
+	if err != nil {
+		t.Fatalf("expected the plugin to restart, got: %v", err)
+	}
+	marshaled, _ := sig.Marshal()
+	if marshaled != "foo/" {
+		t.Fatalf("expected signature %q, got %q", "foo/", marshaled)
+	}
+}
+
+func TestNewFailures(t *testing.T) {
+	for i, testcase := range []struct {
+		conf signer.Configuration
+		err  string
+	}{
+		{signer.Configuration{ID: "foo", Type: "nullsigner"}, `invalid type "nullsigner"`},
+		{signer.Configuration{Type: Type}, "missing signer ID"},
+		{signer.Configuration{ID: "foo", Type: Type}, "missing plugin command"},
+		{signer.Configuration{ID: "foo", Type: Type, Plugin: signer.PluginConfig{Command: "/nonexistent/plugin"}}, "failed to start plugin"},
+		{testConf(map[string]string{"fail": "bad settings"}), "failed to initialize plugin of signer \"testplugin\": plugin returned an error: bad settings"},
+	} {
+		_, err := New(testcase.conf)
+		if err == nil || !strings.Contains(err.Error(), testcase.err) {
+			t.Errorf("testcase %d: expected error containing %q, got: %v", i, testcase.err, err)
+		}
+	}
+}
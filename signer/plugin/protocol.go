@@ -0,0 +1,128 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// The plugin protocol is JSON-RPC 1.0, as implemented by net/rpc/jsonrpc,
+// over the standard input and output of the plugin process. Autograph
+// calls Plugin.Init once when the plugin starts, then Plugin.Sign for
+// each signing operation, possibly several at the same time. The
+// plugin exits when its standard input is closed.
+const (
+	// serviceName is the name of the RPC service of plugins
+	serviceName = "Plugin"
+
+	// OperationHash, OperationData and OperationFile are the
+	// signing operations of SignRequest, matching /sign/hash,
+	// /sign/data and /sign/file
+	OperationHash = "hash"
+	OperationData = "data"
+	OperationFile = "file"
+)
+
+// InitRequest passes the configuration of the signer to the plugin
+type InitRequest struct {
+	ID          string            `json:"id"`
+	Mode        string            `json:"mode,omitempty"`
+	PrivateKey  string            `json:"privatekey,omitempty"`
+	PublicKey   string            `json:"publickey,omitempty"`
+	Certificate string            `json:"certificate,omitempty"`
+	Settings    map[string]string `json:"settings,omitempty"`
+}
+
+// InitResponse describes the signer implemented by the plugin
+type InitResponse struct {
+	// Mode and PublicKey are returned by the signer
+	// configuration, unless it sets them
+	Mode      string `json:"mode,omitempty"`
+	PublicKey string `json:"publickey,omitempty"`
+
+	// HashSigning, DataSigning and FileSigning are the signing
+	// operations the plugin supports
+	HashSigning bool `json:"hash_signing"`
+	DataSigning bool `json:"data_signing"`
+	FileSigning bool `json:"file_signing"`
+
+	// DefaultOptions are the options of requests that don't set
+	// any. They are passed back to the plugin in SignRequest.
+	DefaultOptions json.RawMessage `json:"default_options,omitempty"`
+
+	// TestFile is a file the plugin signs for the monitor
+	TestFile []byte `json:"test_file,omitempty"`
+}
+
+// SignRequest is a signing operation sent to the plugin
+type SignRequest struct {
+	Operation string          `json:"operation"`
+	Input     []byte          `json:"input"`
+	Options   json.RawMessage `json:"options,omitempty"`
+}
+
+// SignResponse is the result of a signing operation: the marshaled
+// signature of hash and data operations, or the signed file
+type SignResponse struct {
+	Signature  string `json:"signature,omitempty"`
+	SignedFile []byte `json:"signed_file,omitempty"`
+}
+
+// Plugin is implemented by plugin executables and served with Serve
+type Plugin interface {
+	Init(req InitRequest) (*InitResponse, error)
+	Sign(req SignRequest) (*SignResponse, error)
+}
+
+// service exposes a Plugin with the method signatures of net/rpc
+type service struct {
+	p Plugin
+}
+
+func (s *service) Init(req InitRequest, resp *InitResponse) error {
+	r, err := s.p.Init(req)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return errors.New("plugin returned no init response")
+	}
+	*resp = *r
+	return nil
+}
+
+func (s *service) Sign(req SignRequest, resp *SignResponse) error {
+	r, err := s.p.Sign(req)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return errors.New("plugin returned no sign response")
+	}
+	*resp = *r
+	return nil
+}
+
+// stdio is the connection of a plugin to autograph
+type stdio struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// Serve serves a plugin to autograph over the standard input and
+// output of the process, and returns when autograph closes the
+// standard input. Plugins must not write anything else to their
+// standard output, and can log to their standard error.
+func Serve(p Plugin) error {
+	server := rpc.NewServer()
+	err := server.RegisterName(serviceName, &service{p})
+	if err != nil {
+		return errors.Wrap(err, "failed to register plugin")
+	}
+	server.ServeCodec(jsonrpc.NewServerCodec(stdio{os.Stdin, os.Stdout}))
+	return nil
+}
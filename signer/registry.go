@@ -0,0 +1,68 @@
+package signer
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Factory initializes a signer from its configuration. The stats
+// client is nil when statsd isn't configured.
+type Factory func(conf Configuration, stats *StatsClient) (Signer, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// RegisterType makes a signer type available to the configuration of
+// autograph, so builds can compile in their own signers without
+// modifying the main package. It is meant to be called from the init
+// function of the package implementing the signer, which the build
+// then imports for its side effects:
+//
+//	func init() {
+//		signer.RegisterType("mysigner", func(conf signer.Configuration, stats *signer.StatsClient) (signer.Signer, error) {
+//			return mysigner.New(conf)
+//		})
+//	}
+//
+// The signer must implement Signer and at least one of the signing
+// interfaces, like DataSigner or FileSigner, and can implement the
+// optional ones. Types built into autograph take precedence over
+// registered ones. RegisterType panics when the type is empty, the
+// factory is nil or the type is already registered.
+func RegisterType(typ string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if typ == "" {
+		panic("signer: RegisterType with an empty type")
+	}
+	if factory == nil {
+		panic(fmt.Sprintf("signer: RegisterType of %q with a nil factory", typ))
+	}
+	if _, dup := factories[typ]; dup {
+		panic(fmt.Sprintf("signer: RegisterType called twice for type %q", typ))
+	}
+	factories[typ] = factory
+}
+
+// LookupType returns the factory of a registered signer type
+func LookupType(typ string) (factory Factory, ok bool) {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	factory, ok = factories[typ]
+	return
+}
+
+// RegisteredTypes returns the registered signer types in order
+func RegisteredTypes() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	var types []string
+	for typ := range factories {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
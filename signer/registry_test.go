@@ -0,0 +1,50 @@
+package signer
+
+import (
+	"testing"
+)
+
+func TestRegisterType(t *testing.T) {
+	factory := func(conf Configuration, stats *StatsClient) (Signer, error) {
+		return nil, nil
+	}
+	if _, ok := LookupType("registrytest"); !ok {
+		RegisterType("registrytest", factory)
+	}
+	if _, ok := LookupType("registrytest"); !ok {
+		t.Fatal("expected registered type to be found")
+	}
+	if _, ok := LookupType("registrytest-unknown"); ok {
+		t.Fatal("expected unregistered type not to be found")
+	}
+	found := false
+	for _, typ := range RegisteredTypes() {
+		if typ == "registrytest" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected registered type in %q", RegisteredTypes())
+	}
+
+	for i, testcase := range []struct {
+		typ     string
+		factory Factory
+	}{
+		{"", factory},
+		{"registrytest-nil", nil},
+		{"registrytest", factory},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("testcase %d: expected RegisterType(%q) to panic", i, testcase.typ)
+				}
+			}()
+			RegisterType(testcase.typ, testcase.factory)
+		}()
+	}
+	if _, ok := LookupType("registrytest-nil"); ok {
+		t.Fatal("expected nil factory not to be registered")
+	}
+}
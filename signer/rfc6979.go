@@ -0,0 +1,78 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"io"
+
+	// the hash functions of deterministic nonces
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"github.com/pkg/errors"
+)
+
+// ErrDeterministicKey is returned when deterministic ECDSA signatures
+// are enabled for a key that isn't a software ECDSA key
+var ErrDeterministicKey = errors.New("deterministic ecdsa signatures require a software ecdsa key")
+
+// CheckDeterministicECDSA returns an error when a signer enables
+// DeterministicECDSA with a key that cannot make deterministic
+// signatures, like an HSM key. When key is nil, it checks the keys
+// MakeKey generates, which are HSM keys when the HSM is available.
+func (cfg *Configuration) CheckDeterministicECDSA(key crypto.PrivateKey) error {
+	if !cfg.DeterministicECDSA {
+		return nil
+	}
+	if key == nil {
+		if cfg.isHsmAvailable {
+			return errors.Wrapf(ErrDeterministicKey, "signer %q generates keys in the hsm", cfg.ID)
+		}
+		return nil
+	}
+	if _, ok := key.(*ecdsa.PrivateKey); !ok {
+		return errors.Wrapf(ErrDeterministicKey, "signer %q has a %T key", cfg.ID, key)
+	}
+	return nil
+}
+
+// SignECDSADigest signs a digest with an ECDSA key and returns the
+// ASN.1 encoded signature. When deterministic is set, the nonce is
+// derived from the key and digest per RFC 6979 and rand is not used,
+// otherwise it signs like SignWithKey.
+func SignECDSADigest(key crypto.PrivateKey, rand io.Reader, digest []byte, deterministic bool) ([]byte, error) {
+	if !deterministic {
+		return SignWithKey(key, rand, digest, nil)
+	}
+	priv, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.Wrapf(ErrDeterministicKey, "cannot sign with a %T key", key)
+	}
+	hashFunc, err := deterministicHash(digest)
+	if err != nil {
+		return nil, err
+	}
+	// crypto/ecdsa signs in constant time and derives the nonce per
+	// RFC 6979 when rand is nil
+	return priv.Sign(nil, digest, hashFunc)
+}
+
+// deterministicHash returns the hash function of the HMAC-DRBG of RFC
+// 6979 for a digest, which is the function that made the digest
+func deterministicHash(digest []byte) (crypto.Hash, error) {
+	switch len(digest) {
+	case crypto.SHA224.Size():
+		return crypto.SHA224, nil
+	case crypto.SHA256.Size():
+		return crypto.SHA256, nil
+	case crypto.SHA384.Size():
+		return crypto.SHA384, nil
+	case crypto.SHA512.Size():
+		return crypto.SHA512, nil
+	}
+	return 0, errors.Wrapf(ErrInvalidHashLength, "no deterministic nonce hash for a %d bytes digest", len(digest))
+}
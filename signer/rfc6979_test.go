@@ -0,0 +1,152 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func hexInt(t *testing.T, s string) *big.Int {
+	v, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		t.Fatalf("invalid hex integer %q", s)
+	}
+	return v
+}
+
+func TestSignDeterministicECDSA(t *testing.T) {
+	// test vectors of the "sample" message in appendix A.2.5 and
+	// A.2.6 of RFC 6979
+	sample256 := sha256.Sum256([]byte("sample"))
+	sample384 := sha512.Sum384([]byte("sample"))
+	for i, testcase := range []struct {
+		curve  elliptic.Curve
+		d      string
+		digest []byte
+		r, s   string
+	}{
+		{
+			curve:  elliptic.P256(),
+			d:      "C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721",
+			digest: sample256[:],
+			r:      "EFD48B2AACB6A8FD1140DD9CD45E81D69D2C877B56AAF991C34D0EA84EAF3716",
+			s:      "F7CB1C942D657C41D436C7A1B6E29F65F3E900DBB9AFF4064DC4AB2F843ACDA8",
+		},
+		{
+			curve:  elliptic.P384(),
+			d:      "6B9D3DAD2E1B8C1C05B19875B6659F4DE23C3B667BF297BA9AA47740787137D896D5724E4C70A825F872C9EA60D2EDF5",
+			digest: sample384[:],
+			r:      "94EDBB92A5ECB8AAD4736E56C691916B3F88140666CE9FA73D64C4EA95AD133C81A648152E44ACF96E36DD1E80FABE46",
+			s:      "99EF4AEB15F178CEA1FE40DB2603138F130E740A19624526203B6351D0A3A94FA329C145786E679E7B82C71A38628AC8",
+		},
+	} {
+		priv := &ecdsa.PrivateKey{D: hexInt(t, testcase.d)}
+		priv.Curve = testcase.curve
+		priv.X, priv.Y = testcase.curve.ScalarBaseMult(priv.D.Bytes())
+
+		sig, err := SignECDSADigest(priv, nil, testcase.digest, true)
+		if err != nil {
+			t.Fatalf("testcase %d: %v", i, err)
+		}
+		var ecdsaSig struct{ R, S *big.Int }
+		_, err = asn1.Unmarshal(sig, &ecdsaSig)
+		if err != nil {
+			t.Fatalf("testcase %d: %v", i, err)
+		}
+		r, s := ecdsaSig.R, ecdsaSig.S
+		if r.Cmp(hexInt(t, testcase.r)) != 0 || s.Cmp(hexInt(t, testcase.s)) != 0 {
+			t.Fatalf("testcase %d: expected r=%s s=%s, got r=%X s=%X", i, testcase.r, testcase.s, r, s)
+		}
+		if !ecdsa.Verify(&priv.PublicKey, testcase.digest, r, s) {
+			t.Fatalf("testcase %d: signature does not verify", i)
+		}
+	}
+}
+
+func TestSignECDSADigest(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha512.Sum384([]byte("foobarbaz1234abcd"))
+
+	// deterministic signatures don't read the random source
+	first, err := SignECDSADigest(priv, nil, digest[:], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := SignECDSADigest(priv, nil, digest[:], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatal("expected deterministic signatures of the same digest to be equal")
+	}
+	random, err := SignECDSADigest(priv, rand.Reader, digest[:], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first, random) {
+		t.Fatal("expected random signatures to differ from deterministic ones")
+	}
+	for _, sig := range [][]byte{first, random} {
+		var ecdsaSig struct{ R, S *big.Int }
+		_, err = asn1.Unmarshal(sig, &ecdsaSig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ecdsa.Verify(&priv.PublicKey, digest[:], ecdsaSig.R, ecdsaSig.S) {
+			t.Fatal("signature does not verify")
+		}
+	}
+
+	_, err = SignECDSADigest(priv, nil, []byte("short"), true)
+	if errors.Cause(err) != ErrInvalidHashLength {
+		t.Fatalf("expected an invalid digest length to fail, got %v", err)
+	}
+	cfg := Configuration{ID: "foo", DeterministicECDSA: true}
+	if err = cfg.CheckDeterministicECDSA(priv); err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.CheckDeterministicECDSA("not a key"); errors.Cause(err) != ErrDeterministicKey {
+		t.Fatalf("expected a non software ecdsa key to fail, got %v", err)
+	}
+}
+
+func BenchmarkSignECDSADigest(b *testing.B) {
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384()} {
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			b.Fatal(err)
+		}
+		digest := make([]byte, curve.Params().BitSize/8)
+		_, err = rand.Read(digest)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, deterministic := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%s/deterministic=%t", curve.Params().Name, deterministic), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					_, err := SignECDSADigest(priv, rand.Reader, digest, deterministic)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
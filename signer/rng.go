@@ -0,0 +1,110 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"bytes"
+	"crypto"
+	"io"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/pkg/errors"
+)
+
+const (
+	// RNGHSM selects the RNG of the HSM as the random source of a
+	// signer
+	RNGHSM = "hsm"
+
+	// RNGSystem selects crypto/rand as the random source of a
+	// signer, even when an HSM is available
+	RNGSystem = "system"
+
+	// rngSelfTestBlocks and rngSelfTestBlockSize are the number and
+	// size of the blocks read from a random source by its self-test
+	rngSelfTestBlocks    = 16
+	rngSelfTestBlockSize = 16
+
+	// rngSelfTestMinDistinct is the minimum number of distinct byte
+	// values in the blocks of a self-test. 256 random bytes have
+	// about 162, and fewer than 64 is practically impossible.
+	rngSelfTestMinDistinct = 64
+)
+
+// ErrRNGSelfTest is returned when a random source fails its self-test
+var ErrRNGSelfTest = errors.New("random source failed its self-test")
+
+// CheckRand validates the random source of the configuration and runs
+// its self-test
+func (cfg *Configuration) CheckRand() error {
+	switch cfg.RNG {
+	case "", RNGSystem:
+	case RNGHSM:
+		if !cfg.isHsmAvailable {
+			return errors.Errorf("signer %q uses the hsm rng but the hsm is not available", cfg.ID)
+		}
+	default:
+		return errors.Errorf("signer %q has unknown rng %q, must be %q or %q", cfg.ID, cfg.RNG, RNGHSM, RNGSystem)
+	}
+	err := SelfTestRand(cfg.GetRand())
+	if err != nil {
+		return errors.Wrapf(err, "signer %q", cfg.ID)
+	}
+	return nil
+}
+
+// GetRandForKey returns the random source of signatures made with a
+// key: the RNG of the HSM for HSM keys, which draw their nonces from
+// the HSM whatever the reader, and the RNG of the configuration for
+// keys in memory
+func (cfg *Configuration) GetRandForKey(key crypto.PrivateKey) io.Reader {
+	switch key.(type) {
+	case *crypto11.PKCS11PrivateKeyECDSA, *crypto11.PKCS11PrivateKeyRSA:
+		return new(crypto11.PKCS11RandReader)
+	}
+	return cfg.GetRand()
+}
+
+// CheckHSMRand returns an error when the RNG of the HSM doesn't
+// return random bytes, for the heartbeat
+func (cfg *Configuration) CheckHSMRand() error {
+	if !cfg.isHsmAvailable {
+		return errors.Errorf("HSM is not available for signer %s", cfg.ID)
+	}
+	return SelfTestRand(new(crypto11.PKCS11RandReader))
+}
+
+// SelfTestRand reads blocks from a random source and returns an error
+// when the source fails, repeats a block, like the continuous test of
+// FIPS 140-2, or returns too few distinct byte values, like a source
+// stuck on zeros
+func SelfTestRand(r io.Reader) error {
+	var (
+		previous []byte
+		seen     [256]bool
+		distinct int
+	)
+	for i := 0; i < rngSelfTestBlocks; i++ {
+		block := make([]byte, rngSelfTestBlockSize)
+		_, err := io.ReadFull(r, block)
+		if err != nil {
+			return errors.Wrapf(ErrRNGSelfTest, "failed to read: %v", err)
+		}
+		if bytes.Equal(block, previous) {
+			return errors.Wrap(ErrRNGSelfTest, "returned the same block twice in a row")
+		}
+		previous = block
+		for _, b := range block {
+			if !seen[b] {
+				seen[b] = true
+				distinct++
+			}
+		}
+	}
+	if distinct < rngSelfTestMinDistinct {
+		return errors.Wrapf(ErrRNGSelfTest, "returned %d distinct byte values out of %d bytes", distinct, rngSelfTestBlocks*rngSelfTestBlockSize)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package signer
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ThalesIgnite/crypto11"
+	pkgerrors "github.com/pkg/errors"
+)
+
+// repeatReader returns the same block forever
+type repeatReader struct{ block []byte }
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.block[i%len(r.block)]
+	}
+	return len(p), nil
+}
+
+// countReader returns incrementing blocks of few byte values
+type countReader struct{ n byte }
+
+func (r *countReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.n % 8
+		r.n++
+	}
+	return len(p), nil
+}
+
+func TestSelfTestRand(t *testing.T) {
+	if err := SelfTestRand(rand.Reader); err != nil {
+		t.Fatalf("crypto/rand failed the self-test: %v", err)
+	}
+	for _, testcase := range []struct {
+		name string
+		r    io.Reader
+	}{
+		{"zeros", bytes.NewReader(make([]byte, 1024))},
+		{"repeated block", repeatReader{[]byte("0123456789abcdef")}},
+		{"few byte values", &countReader{}},
+		{"short read", bytes.NewReader([]byte("too short"))},
+		{"failed read", io.MultiReader()},
+	} {
+		err := SelfTestRand(testcase.r)
+		if pkgerrors.Cause(err) != ErrRNGSelfTest {
+			t.Errorf("%s: expected ErrRNGSelfTest but got %v", testcase.name, err)
+		}
+	}
+}
+
+func TestCheckRand(t *testing.T) {
+	for _, testcase := range []struct {
+		rng string
+		err string
+	}{
+		{"", ""},
+		{RNGSystem, ""},
+		{RNGHSM, "the hsm is not available"},
+		{"dev-urandom", "unknown rng"},
+	} {
+		cfg := Configuration{ID: "rngtest", RNG: testcase.rng}
+		err := cfg.CheckRand()
+		if testcase.err == "" && err != nil {
+			t.Errorf("rng %q: unexpected error %v", testcase.rng, err)
+		}
+		if testcase.err != "" && (err == nil || !strings.Contains(err.Error(), testcase.err)) {
+			t.Errorf("rng %q: expected error containing %q but got %v", testcase.rng, testcase.err, err)
+		}
+	}
+}
+
+func TestGetRandSystem(t *testing.T) {
+	cfg := Configuration{RNG: RNGSystem, isHsmAvailable: true}
+	if cfg.GetRand() != rand.Reader {
+		t.Fatal("expected the system rng to be crypto/rand even with an hsm")
+	}
+}
+
+func TestCheckHSMRandWithoutHSM(t *testing.T) {
+	cfg := Configuration{ID: "rngtest"}
+	err := cfg.CheckHSMRand()
+	if err == nil || pkgerrors.Cause(err) == ErrRNGSelfTest {
+		t.Fatalf("expected an hsm unavailable error but got %v", err)
+	}
+}
+
+func TestGetRandForKey(t *testing.T) {
+	cfg := Configuration{RNG: RNGSystem}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GetRandForKey(key) != rand.Reader {
+		t.Error("expected keys in memory to use the rng of the configuration")
+	}
+	if _, ok := cfg.GetRandForKey(&crypto11.PKCS11PrivateKeyECDSA{}).(*crypto11.PKCS11RandReader); !ok {
+		t.Error("expected hsm keys to use the rng of the hsm")
+	}
+}
@@ -0,0 +1,114 @@
+package signer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RootSet is a named set of trust anchors verifiers pin signatures to,
+// like the roots of the prod, stage or autograph-dev environment, so a
+// signature made in one environment doesn't verify in another
+type RootSet struct {
+	Name  string
+	Certs []*x509.Certificate
+	pool  *x509.CertPool
+}
+
+// ParseRootSet returns the root set name of the PEM encoded
+// certificates in data
+func ParseRootSet(name string, data []byte) (*RootSet, error) {
+	set := &RootSet{Name: name, pool: x509.NewCertPool()}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse certificate %d of root set %q", len(set.Certs), name)
+		}
+		set.Certs = append(set.Certs, cert)
+		set.pool.AddCert(cert)
+	}
+	if len(set.Certs) == 0 {
+		return nil, errors.Errorf("root set %q has no PEM certificate", name)
+	}
+	return set, nil
+}
+
+// Pool returns the roots of the set as a certificate pool
+func (s *RootSet) Pool() *x509.CertPool {
+	return s.pool
+}
+
+// Contains returns whether a certificate is one of the roots of the set
+func (s *RootSet) Contains(cert *x509.Certificate) bool {
+	for _, root := range s.Certs {
+		if bytes.Equal(root.Raw, cert.Raw) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsSHA256 returns whether the hex SHA256 fingerprint of one of
+// the roots of the set is fingerprint, with or without colons
+func (s *RootSet) ContainsSHA256(fingerprint string) bool {
+	fingerprint = strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+	for _, root := range s.Certs {
+		sum := sha256.Sum256(root.Raw)
+		if hex.EncodeToString(sum[:]) == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// Anchors returns whether a certificate is one of the roots of the set
+// or is issued by one of them. Validity periods are not checked, since
+// files like APKs stay valid after their certificates expire.
+func (s *RootSet) Anchors(cert *x509.Certificate) bool {
+	if s.Contains(cert) {
+		return true
+	}
+	for _, root := range s.Certs {
+		if bytes.Equal(cert.RawIssuer, root.RawSubject) && cert.CheckSignatureFrom(root) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyChain checks that a chain of certificates, starting with the
+// end-entity and followed by its intermediates, is valid at time t and
+// chains to one of the roots of the set
+func (s *RootSet) VerifyChain(certs []*x509.Certificate, t time.Time) error {
+	if len(certs) == 0 {
+		return errors.New("no certificate to verify")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         s.pool,
+		Intermediates: intermediates,
+		CurrentTime:   t,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "certificate %q does not chain to root set %q", certs[0].Subject.CommonName, s.Name)
+	}
+	return nil
+}
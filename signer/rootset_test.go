@@ -0,0 +1,92 @@
+package signer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newTestCert returns a certificate issued by parent with parentKey,
+// or a self-signed CA when parent is nil
+func newTestCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil || cn != "leaf",
+	}
+	if parent == nil {
+		parent, parentKey = tpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestRootSet(t *testing.T) {
+	t.Parallel()
+
+	prodRoot, prodKey := newTestCert(t, "prod root", nil, nil)
+	stageRoot, stageKey := newTestCert(t, "stage root", nil, nil)
+	inter, interKey := newTestCert(t, "prod intermediate", prodRoot, prodKey)
+	leaf, _ := newTestCert(t, "leaf", inter, interKey)
+	stageLeaf, _ := newTestCert(t, "leaf", stageRoot, stageKey)
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: prodRoot.Raw})
+	prod, err := ParseRootSet("prod", append([]byte("# prod roots\n"), data...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prod.Certs) != 1 || !prod.Contains(prodRoot) || prod.Contains(stageRoot) {
+		t.Fatalf("expected the prod root set to only contain the prod root")
+	}
+	sum := sha256.Sum256(prodRoot.Raw)
+	if !prod.ContainsSHA256(hex.EncodeToString(sum[:])) || prod.ContainsSHA256("00") {
+		t.Fatal("expected the prod root set to be found by fingerprint")
+	}
+	if !prod.Anchors(prodRoot) || !prod.Anchors(inter) || prod.Anchors(leaf) || prod.Anchors(stageLeaf) {
+		t.Fatal("expected the prod root set to only anchor its roots and the certificates they issue")
+	}
+	err = prod.VerifyChain([]*x509.Certificate{leaf, inter}, time.Now())
+	if err != nil {
+		t.Fatalf("expected leaf to chain to the prod roots: %v", err)
+	}
+	err = prod.VerifyChain([]*x509.Certificate{stageLeaf}, time.Now())
+	if err == nil {
+		t.Fatal("expected stage leaf not to chain to the prod roots")
+	}
+	err = prod.VerifyChain([]*x509.Certificate{leaf, inter}, time.Now().Add(2*time.Hour))
+	if err == nil {
+		t.Fatal("expected expired chain to fail verification")
+	}
+
+	_, err = ParseRootSet("empty", []byte("no certificate"))
+	if err == nil {
+		t.Fatal("expected root set without certificates to fail")
+	}
+	_, err = ParseRootSet("invalid", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("garbage")}))
+	if err == nil {
+		t.Fatal("expected root set with an invalid certificate to fail")
+	}
+}
@@ -21,6 +21,7 @@ const (
 // RSAPSSSigner holds the configuration of the signer
 type RSAPSSSigner struct {
 	signer.Configuration
+	signer.KeyZeroizer
 
 	// key is the RSA private key to sign hashes.
 	// we use the `crypto.PrivateKey` interface to support
@@ -61,6 +62,7 @@ func New(conf signer.Configuration) (s *RSAPSSSigner, err error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "rsapss: error fetching key from signer configuration")
 	}
+	s.ZeroizeAtExit(s.key)
 	_, ok := s.pubKey.(*rsa.PublicKey)
 	if !ok {
 		return nil, errors.Errorf("rsapss: unsupported public key type %T, use RSA keys", s.pubKey)
@@ -89,7 +91,7 @@ func (s *RSAPSSSigner) SignData(data []byte, options interface{}) (signer.Signat
 // SignHash takes an input hash and returns a signed base64 encoded hash
 func (s *RSAPSSSigner) SignHash(digest []byte, options interface{}) (signer.Signature, error) {
 	if len(digest) != 20 {
-		return nil, errors.Errorf("rsapss: refusing to sign input hash. Got length %d, expected 20.", len(digest))
+		return nil, errors.Wrapf(signer.ErrInvalidHashLength, "rsapss: refusing to sign input hash. Got length %d, expected 20", len(digest))
 	}
 
 	opts := &rsa.PSSOptions{
@@ -97,7 +99,7 @@ func (s *RSAPSSSigner) SignHash(digest []byte, options interface{}) (signer.Sign
 		Hash:       crypto.SHA1,
 	}
 
-	sigBytes, err := s.key.(crypto.Signer).Sign(s.rng, digest, opts)
+	sigBytes, err := signer.SignWithKey(s.key, s.rng, digest, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "rsapss: error signing hash")
 	}
@@ -0,0 +1,251 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrSandboxTimeout is returned when a sandboxed process runs longer
+// than the timeout of its sandbox
+var ErrSandboxTimeout = errors.New("sandboxed process timed out")
+
+// SandboxConfig restricts the processes signers like gpg2 and apk2 run
+// to sign, so an untrusted input exploiting them is contained
+type SandboxConfig struct {
+	// User runs the processes as a dedicated user, by name or uid.
+	// Autograph must run as root or with CAP_SETUID and
+	// CAP_SETGID to switch users.
+	User string `yaml:"user,omitempty"`
+
+	// Group is the group of the processes, by name or gid.
+	// Defaults to the primary group of User.
+	Group string `yaml:"group,omitempty"`
+
+	// AppArmorProfile confines the processes to an AppArmor
+	// profile with aa-exec
+	AppArmorProfile string `yaml:"apparmorprofile,omitempty"`
+
+	// Wrapper is a command and its arguments the command of a
+	// process is appended to, to load a seccomp profile or run it
+	// in another sandbox, e.g. ["bwrap", "--seccomp", "3", ...]
+	Wrapper []string `yaml:"wrapper,omitempty"`
+
+	// Env are the "KEY=value" environment variables of the
+	// processes, which only inherit the PATH of autograph
+	Env []string `yaml:"env,omitempty"`
+
+	// Timeout kills processes that run longer, with their
+	// children
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// MaxCPUTime, MaxMemory, MaxFileSize and MaxOpenFiles are the
+	// CPU time, address space bytes, bytes per written file and
+	// open files resource limits of the processes, set with
+	// prlimit
+	MaxCPUTime   time.Duration `yaml:"maxcputime,omitempty"`
+	MaxMemory    int64         `yaml:"maxmemory,omitempty"`
+	MaxFileSize  int64         `yaml:"maxfilesize,omitempty"`
+	MaxOpenFiles int64         `yaml:"maxopenfiles,omitempty"`
+}
+
+// IsZero returns whether the configuration doesn't restrict processes
+func (c SandboxConfig) IsZero() bool {
+	return c.User == "" && c.Group == "" && c.AppArmorProfile == "" &&
+		len(c.Wrapper) == 0 && len(c.Env) == 0 && c.Timeout == 0 &&
+		c.MaxCPUTime == 0 && c.MaxMemory == 0 && c.MaxFileSize == 0 && c.MaxOpenFiles == 0
+}
+
+// Sandbox runs the processes of a signer with the restrictions of its
+// configuration. A nil Sandbox runs them unrestricted.
+type Sandbox struct {
+	conf SandboxConfig
+
+	// prefix is the command and arguments of the wrappers that
+	// apply the restrictions, in the order they run
+	prefix []string
+
+	// uid and gid are the ids of the dedicated user, or -1
+	uid, gid int
+}
+
+// NewSandbox validates a sandbox configuration, resolves its user and
+// group, and checks its wrappers are installed. It returns nil for a
+// zero configuration.
+func NewSandbox(conf SandboxConfig) (*Sandbox, error) {
+	if conf.IsZero() {
+		return nil, nil
+	}
+	s := &Sandbox{conf: conf, uid: -1, gid: -1}
+	if conf.Timeout < 0 || conf.MaxCPUTime < 0 || conf.MaxMemory < 0 || conf.MaxFileSize < 0 || conf.MaxOpenFiles < 0 {
+		return nil, errors.New("sandbox timeout and resource limits must be positive")
+	}
+	if conf.Group != "" && conf.User == "" {
+		return nil, errors.New("sandbox group requires a user")
+	}
+	if conf.User != "" {
+		if !sandboxUsersSupported {
+			return nil, errors.New("sandbox users are not supported on this platform")
+		}
+		err := s.lookupUser()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var limits []string
+	if conf.MaxCPUTime > 0 {
+		// the CPU time limit is in seconds, rounded up
+		limits = append(limits, fmt.Sprintf("--cpu=%d", int64((conf.MaxCPUTime+time.Second-1)/time.Second)))
+	}
+	if conf.MaxMemory > 0 {
+		limits = append(limits, fmt.Sprintf("--as=%d", conf.MaxMemory))
+	}
+	if conf.MaxFileSize > 0 {
+		limits = append(limits, fmt.Sprintf("--fsize=%d", conf.MaxFileSize))
+	}
+	if conf.MaxOpenFiles > 0 {
+		limits = append(limits, fmt.Sprintf("--nofile=%d", conf.MaxOpenFiles))
+	}
+	// resource limits apply first, so the profiles of the
+	// wrappers don't need to allow prlimit
+	if len(limits) > 0 {
+		_, err := exec.LookPath("prlimit")
+		if err != nil {
+			return nil, errors.Wrap(err, "sandbox resource limits require prlimit")
+		}
+		s.prefix = append(append([]string{"prlimit"}, limits...), "--")
+	}
+	if conf.AppArmorProfile != "" {
+		_, err := exec.LookPath("aa-exec")
+		if err != nil {
+			return nil, errors.Wrap(err, "sandbox apparmor profile requires aa-exec")
+		}
+		s.prefix = append(s.prefix, "aa-exec", "-p", conf.AppArmorProfile, "--")
+	}
+	s.prefix = append(s.prefix, conf.Wrapper...)
+	if len(conf.Wrapper) > 0 {
+		_, err := exec.LookPath(conf.Wrapper[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "sandbox wrapper %q not found", conf.Wrapper[0])
+		}
+	}
+	return s, nil
+}
+
+// lookupUser resolves the uid and gid of the user and group of the
+// configuration, which can be names or ids
+func (s *Sandbox) lookupUser() error {
+	u, err := user.Lookup(s.conf.User)
+	if err != nil {
+		u, err = user.LookupId(s.conf.User)
+	}
+	if err != nil {
+		return errors.Errorf("unknown sandbox user %q", s.conf.User)
+	}
+	s.uid, err = strconv.Atoi(u.Uid)
+	if err != nil {
+		return errors.Wrapf(err, "invalid uid of sandbox user %q", s.conf.User)
+	}
+	gid := u.Gid
+	if s.conf.Group != "" {
+		g, err := user.LookupGroup(s.conf.Group)
+		if err != nil {
+			g, err = user.LookupGroupId(s.conf.Group)
+		}
+		if err != nil {
+			return errors.Errorf("unknown sandbox group %q", s.conf.Group)
+		}
+		gid = g.Gid
+	}
+	s.gid, err = strconv.Atoi(gid)
+	if err != nil {
+		return errors.Wrapf(err, "invalid gid of sandbox user %q", s.conf.User)
+	}
+	return nil
+}
+
+// CombinedOutput runs name with args in the sandbox, with stdin as
+// its standard input when it isn't nil, and returns its standard
+// output and error. The process and the children in its process group
+// are killed when ctx is done or after the timeout of the sandbox, and
+// the error is then ctx.Err() or ErrSandboxTimeout.
+func (s *Sandbox) CombinedOutput(ctx context.Context, stdin io.Reader, name string, args ...string) ([]byte, error) {
+	if s == nil {
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Stdin = stdin
+		return cmd.CombinedOutput()
+	}
+	argv := append(append(append([]string{}, s.prefix...), name), args...)
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin = stdin
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// don't leak the environment of autograph, like AWS
+	// credentials, to processes handling untrusted inputs
+	cmd.Env = append([]string{"PATH=" + os.Getenv("PATH")}, s.conf.Env...)
+	setProcAttr(cmd, s.uid, s.gid)
+
+	var timeout <-chan time.Time
+	if s.conf.Timeout > 0 {
+		timer := time.NewTimer(s.conf.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+		return out.Bytes(), err
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = errors.Wrapf(ErrSandboxTimeout, "killed after %s", s.conf.Timeout)
+	}
+	killProcessGroup(cmd)
+	<-done
+	return out.Bytes(), err
+}
+
+// Chown gives the user of the sandbox the files of a temporary space,
+// which its processes read and write. It does nothing without a user.
+func (s *Sandbox) Chown(space *TempSpace) error {
+	if s == nil || s.uid < 0 {
+		return nil
+	}
+	// the user must be able to reach the space, but not to list
+	// the other spaces of the storage
+	for _, dir := range []string{filepath.Dir(space.storage.dir), space.storage.dir} {
+		err := os.Chmod(dir, 0711)
+		if err != nil {
+			return errors.Wrap(err, "failed to open temporary storage to the sandbox user")
+		}
+	}
+	err := filepath.Walk(space.Dir(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, s.uid, s.gid)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to give temporary files to the sandbox user")
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd
+
+package signer
+
+import "os/exec"
+
+// sandboxUsersSupported is false since commands cannot switch users
+// on this platform
+const sandboxUsersSupported = false
+
+// setProcAttr does nothing on this platform
+func setProcAttr(cmd *exec.Cmd, uid, gid int) {}
+
+// killProcessGroup only kills the command, since there are no process
+// groups on this platform
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,103 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestNewSandbox(t *testing.T) {
+	s, err := NewSandbox(SandboxConfig{})
+	if s != nil || err != nil {
+		t.Fatalf("expected no sandbox for a zero configuration, got %+v %v", s, err)
+	}
+	for i, testcase := range []struct {
+		conf SandboxConfig
+		err  string
+	}{
+		{SandboxConfig{Timeout: -time.Second}, "must be positive"},
+		{SandboxConfig{MaxOpenFiles: -1}, "must be positive"},
+		{SandboxConfig{Group: "nogroup"}, "sandbox group requires a user"},
+		{SandboxConfig{User: "nosuchsandboxuser"}, `unknown sandbox user "nosuchsandboxuser"`},
+		{SandboxConfig{User: "root", Group: "nosuchsandboxgroup"}, `unknown sandbox group "nosuchsandboxgroup"`},
+		{SandboxConfig{Wrapper: []string{"/nonexistent/seccomp-loader"}}, `sandbox wrapper "/nonexistent/seccomp-loader" not found`},
+	} {
+		_, err := NewSandbox(testcase.conf)
+		if err == nil || !strings.Contains(err.Error(), testcase.err) {
+			t.Fatalf("testcase %d: expected error %q, got %v", i, testcase.err, err)
+		}
+	}
+
+	s, err = NewSandbox(SandboxConfig{User: "0", Group: "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.uid != 0 || s.gid != 0 {
+		t.Fatalf("expected the ids of root, got %d:%d", s.uid, s.gid)
+	}
+	if _, err := exec.LookPath("prlimit"); err != nil {
+		t.Skip("prlimit is not installed")
+	}
+	s, err = NewSandbox(SandboxConfig{
+		MaxCPUTime:   1500 * time.Millisecond,
+		MaxMemory:    1 << 30,
+		MaxFileSize:  1 << 20,
+		MaxOpenFiles: 64,
+		Wrapper:      []string{"env"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"prlimit", "--cpu=2", "--as=1073741824", "--fsize=1048576", "--nofile=64", "--", "env"}
+	if !reflect.DeepEqual(s.prefix, expected) {
+		t.Fatalf("expected wrappers %q, got %q", expected, s.prefix)
+	}
+}
+
+func TestSandboxCombinedOutput(t *testing.T) {
+	os.Setenv("AUTOGRAPH_SANDBOX_TEST_SECRET", "leaked")
+	defer os.Unsetenv("AUTOGRAPH_SANDBOX_TEST_SECRET")
+
+	s, err := NewSandbox(SandboxConfig{Env: []string{"GREETING=hello"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := s.CombinedOutput(context.Background(), strings.NewReader("from stdin"), "sh", "-c", `cat; echo " $GREETING $AUTOGRAPH_SANDBOX_TEST_SECRET"; echo err >&2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "from stdin hello \nerr\n" {
+		t.Fatalf("expected the sandbox to only pass its environment, got %q", out)
+	}
+
+	// the process and its children are killed after the timeout
+	s, err = NewSandbox(SandboxConfig{Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = s.CombinedOutput(context.Background(), nil, "sh", "-c", "sleep 5 & sleep 5")
+	if errors.Cause(err) != ErrSandboxTimeout {
+		t.Fatalf("expected the process to time out, got %v", err)
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Fatalf("expected the children of the process to be killed, it took %s", time.Since(start))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.CombinedOutput(ctx, nil, "sleep", "5")
+	if err != context.Canceled {
+		t.Fatalf("expected the process to be canceled, got %v", err)
+	}
+}
@@ -7,6 +7,7 @@
 package signer // import "go.mozilla.org/autograph/signer"
 
 import (
+	"context"
 	"crypto"
 	"crypto/dsa"
 	"crypto/ecdsa"
@@ -37,6 +38,37 @@ import (
 // IDFormat is a regex for the format IDs must follow
 const IDFormat = `^[a-zA-Z0-9-_]{1,64}$`
 
+var (
+	// ErrInputTooShort is returned by signers that refuse to sign
+	// an input because it is too short
+	ErrInputTooShort = errors.New("input is too short")
+
+	// ErrInvalidHashLength is returned by hash signers when the
+	// input hash length doesn't match the signer hash function
+	ErrInvalidHashLength = errors.New("invalid hash length")
+
+	// ErrInputRejected is returned by signers when a pre-sign
+	// inspection of the input refuses to sign it
+	ErrInputRejected = errors.New("input rejected by signer inspection")
+
+	// ErrMalformedInput is returned by file signers when an input
+	// isn't a well-formed file of the format they sign. They check
+	// it before any key operation.
+	ErrMalformedInput = errors.New("malformed input file")
+
+	// ErrThresholdNotMet is returned by threshold signers when too
+	// few key shares produced a valid partial signature
+	ErrThresholdNotMet = errors.New("not enough partial signatures to meet the signing threshold")
+
+	// ErrInvalidOptions is returned by signers when the options of
+	// a request are invalid, like an unknown key selection
+	ErrInvalidOptions = errors.New("invalid signing options")
+
+	// ErrOptionNotPermitted is returned by signers when the
+	// credential of a request isn't allowed the requested options
+	ErrOptionNotPermitted = errors.New("signing option not permitted")
+)
+
 // RSACacheConfig is a config for the RSAKeyCache
 type RSACacheConfig struct {
 	// NumKeys is the number of RSA keys matching the issuer size
@@ -86,6 +118,158 @@ type RecommendationConfig struct {
 	ValidityDuration time.Duration `yaml:"duration,omitempty"`
 }
 
+// InspectionConfig configures the checks XPI signers run on the
+// manifest of an add-on before signing it
+type InspectionConfig struct {
+	// AllowedIDs is a list of add-on ID patterns the signer is
+	// limited to. When set, the signer refuses to sign add-ons
+	// whose requested or manifest ID doesn't match a pattern.
+	// Patterns use the syntax of path.Match, like "*@mozilla.org".
+	AllowedIDs []string `yaml:"allowed_ids,omitempty"`
+
+	// BlockedIDs is a list of add-on IDs the signer refuses to sign
+	BlockedIDs []string `yaml:"blocked_ids,omitempty"`
+
+	// PreventVersionRegression refuses to sign an add-on with a
+	// version lower than the highest version of the same add-on ID
+	// previously signed by the signer. It requires a database.
+	PreventVersionRegression bool `yaml:"prevent_version_regression,omitempty"`
+}
+
+// ThresholdConfig configures the key shares of a threshold signer
+type ThresholdConfig struct {
+	// Required is the number of partial signatures, out of the
+	// number of shares, a signature requires
+	Required int `yaml:"required,omitempty"`
+
+	// Shares are the keys that produce partial signatures
+	Shares []ThresholdShare `yaml:"shares,omitempty"`
+}
+
+// ThresholdShare is a key share of a threshold signer. A local share
+// has a PEM private key or the label of a key in the HSM. A remote
+// share is a signer of another autograph instance, reached with its
+// URL, KeyID and Hawk credentials, and requires a PublicKey to verify
+// its partial signatures.
+type ThresholdShare struct {
+	ID         string `yaml:"id"`
+	PrivateKey string `yaml:"privatekey,omitempty"`
+	PublicKey  string `yaml:"publickey,omitempty"`
+
+	URL     string `yaml:"url,omitempty"`
+	KeyID   string `yaml:"keyid,omitempty"`
+	HawkID  string `yaml:"hawkid,omitempty"`
+	HawkKey string `yaml:"hawkkey,omitempty"`
+}
+
+// MARChannel is the key of a release channel of a MAR signer, like
+// nightly, beta or release, selected with the channel option
+type MARChannel struct {
+	Name       string `yaml:"name"`
+	PrivateKey string `yaml:"privatekey"`
+	PublicKey  string `yaml:"publickey,omitempty"`
+}
+
+// PGPPublishConfig is where a pgp signer publishes the public keys
+// generated through the admin API
+type PGPPublishConfig struct {
+	// Keyservers are the base URLs of HKP keyservers public keys
+	// are submitted to, like https://keys.openpgp.org
+	Keyservers []string `yaml:"keyservers,omitempty"`
+
+	// WKDDirectory is the local openpgpkey directory of a Web Key
+	// Directory, served at /.well-known/openpgpkey/ of the domain
+	// of the key email addresses
+	WKDDirectory string `yaml:"wkd_directory,omitempty"`
+}
+
+// SigstoreConfig configures the Fulcio and Rekor instances of a
+// sigstore signer, and the identity token it gets certificates with
+type SigstoreConfig struct {
+	// FulcioURL is the base URL of the Fulcio certificate
+	// authority. Defaults to https://fulcio.sigstore.dev
+	FulcioURL string `yaml:"fulcio_url,omitempty"`
+
+	// RekorURL is the base URL of the Rekor transparency log.
+	// Defaults to https://rekor.sigstore.dev
+	RekorURL string `yaml:"rekor_url,omitempty"`
+
+	// IdentityTokenFile is the path of the OIDC identity token of
+	// autograph, like a projected service account token. It is
+	// read again for each certificate, so it can be rotated.
+	IdentityTokenFile string `yaml:"identity_token_file,omitempty"`
+}
+
+// PluginConfig specifies the external process of plugin signers
+type PluginConfig struct {
+	// Command is the path of the plugin executable, which serves
+	// the plugin protocol on its standard input and output
+	Command string `yaml:"command,omitempty"`
+
+	// Args are the arguments of the plugin executable
+	Args []string `yaml:"args,omitempty"`
+
+	// Env are the "KEY=value" environment variables of the
+	// plugin, which doesn't inherit the environment of autograph
+	Env []string `yaml:"env,omitempty"`
+
+	// Settings are passed to the plugin when it starts, to
+	// configure the signer without adding fields to autograph
+	Settings map[string]string `yaml:"settings,omitempty"`
+
+	// Timeout is how long the plugin has to start or to answer
+	// a signing operation. Defaults to 10 seconds.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// ChainUploadConfig specifies the parameters of chains uploaded to S3
+// or to https:// endpoints
+type ChainUploadConfig struct {
+	// ACL is the canned ACL of uploaded chains. Defaults to
+	// public-read. Set it to "none" to upload chains without an
+	// ACL to buckets whose object ownership is bucket owner
+	// enforced, which reject ACLs.
+	ACL string `yaml:"acl,omitempty"`
+
+	// ServerSideEncryption is the server-side encryption of
+	// uploaded chains, "AES256" or "aws:kms". It defaults to
+	// "aws:kms" when SSEKMSKeyID is set.
+	ServerSideEncryption string `yaml:"server_side_encryption,omitempty"`
+
+	// SSEKMSKeyID is the ID or ARN of the KMS key encrypting
+	// uploaded chains, instead of the AWS managed key
+	SSEKMSKeyID string `yaml:"sse_kms_key_id,omitempty"`
+
+	// StorageClass is the storage class of uploaded chains, like
+	// STANDARD or INTELLIGENT_TIERING
+	StorageClass string `yaml:"storage_class,omitempty"`
+
+	// ObjectLockMode is the object lock mode of uploaded chains,
+	// GOVERNANCE or COMPLIANCE, which keeps them from being
+	// deleted or overwritten for ObjectLockRetention. It requires
+	// a bucket with object lock enabled.
+	ObjectLockMode      string        `yaml:"object_lock_mode,omitempty"`
+	ObjectLockRetention time.Duration `yaml:"object_lock_retention,omitempty"`
+
+	// ObjectLockLegalHold places a legal hold on uploaded chains,
+	// which keeps them until the hold is removed
+	ObjectLockLegalHold bool `yaml:"object_lock_legal_hold,omitempty"`
+
+	// BearerTokenFile is the path of the bearer token chains are
+	// uploaded to https:// endpoints with. It is read again for
+	// each upload, so it can be rotated.
+	BearerTokenFile string `yaml:"bearer_token_file,omitempty"`
+
+	// CACert is the path of the PEM certificates verifying
+	// https:// upload endpoints instead of the system roots
+	CACert string `yaml:"ca_cert,omitempty"`
+
+	// ClientCert and ClientKey are the paths of the PEM
+	// certificate and key presented to https:// upload endpoints
+	ClientCert string `yaml:"client_cert,omitempty"`
+	ClientKey  string `yaml:"client_key,omitempty"`
+}
+
 // Configuration defines the parameters of a signer
 type Configuration struct {
 	ID            string            `json:"id"`
@@ -102,6 +286,12 @@ type Configuration struct {
 	// certificate chain to validate a content signature
 	X5U string `json:"x5u,omitempty"`
 
+	// X5UTemplate is an optional text/template of the public URL of
+	// a certificate chain, for when chains are served from another
+	// location than X5U + chain name, such as a CDN in front of the
+	// chain upload bucket. It can use {{.ChainName}} and {{.SignerID}}.
+	X5UTemplate string `json:"x5u_template,omitempty"`
+
 	// RSACacheConfig for XPI signers this specifies config for an
 	// RSA cache
 	RSACacheConfig RSACacheConfig `json:"rsacacheconfig,omitempty"`
@@ -110,6 +300,32 @@ type Configuration struct {
 	// recommendations files for XPI signers
 	RecommendationConfig RecommendationConfig `yaml:"recommendation,omitempty"`
 
+	// InspectionConfig specifies the checks XPI signers run on
+	// add-on manifests before signing them
+	InspectionConfig InspectionConfig `yaml:"inspection,omitempty"`
+
+	// ThresholdConfig specifies the key shares of threshold signers
+	ThresholdConfig ThresholdConfig `yaml:"threshold,omitempty"`
+
+	// MARChannels are the keys of the release channels of MAR
+	// signers, in addition to or instead of PrivateKey
+	MARChannels []MARChannel `yaml:"channels,omitempty"`
+
+	// PGPPublish specifies where pgp signers publish the public
+	// keys generated through the admin API
+	PGPPublish PGPPublishConfig `yaml:"pgp_publish,omitempty"`
+
+	// Sigstore specifies the Fulcio and Rekor instances of
+	// sigstore signers
+	Sigstore SigstoreConfig `yaml:"sigstore,omitempty"`
+
+	// Plugin specifies the external process of plugin signers
+	Plugin PluginConfig `yaml:"plugin,omitempty"`
+
+	// Timestamp specifies the RFC 3161 timestamp authority
+	// countersigning the PKCS7 signatures of xpi and macos signers
+	Timestamp TimestampConfig `yaml:"timestamp,omitempty"`
+
 	// NoPKCS7SignedAttributes for signing legacy APKs don't sign
 	// attributes and use a legacy PKCS7 digest
 	NoPKCS7SignedAttributes bool `json:"nopkcs7signedattributes,omitempty"`
@@ -122,6 +338,15 @@ type Configuration struct {
 	// gpg secret key for the gpg2 signer type
 	Passphrase string `json:"passphrase,omitempty"`
 
+	// MaxProcesses caps the number of gpg processes a gpg2 signer
+	// runs in parallel, each with its own temporary GNUPGHOME.
+	// Defaults to the number of CPUs.
+	MaxProcesses int `json:"maxprocesses,omitempty"`
+
+	// Sandbox restricts the processes of signers that shell out,
+	// like gpg2 and apk2
+	Sandbox SandboxConfig `yaml:"sandbox,omitempty"`
+
 	// Validity is the lifetime of a end-entity certificate
 	Validity time.Duration `json:"validity,omitempty"`
 
@@ -132,10 +357,46 @@ type Configuration struct {
 	// have a total validity of 10+30+10=50 days.
 	ClockSkewTolerance time.Duration `json:"clock_skew_tolerance,omitempty"`
 
+	// NotBeforeBackdate is how far in the past the notbefore value
+	// of an end-entity certificate is set, to accept clients with a
+	// clock running late. Defaults to ClockSkewTolerance.
+	NotBeforeBackdate time.Duration `json:"notbeforebackdate,omitempty"`
+
+	// NotAfterMargin is added to the validity of an end-entity
+	// certificate in its notafter value, to accept clients with a
+	// clock running early. Defaults to ClockSkewTolerance.
+	NotAfterMargin time.Duration `json:"notaftermargin,omitempty"`
+
+	// RotationInterval enables the scheduled rotation of the
+	// end-entity of contentsignaturepki signers, which is replaced
+	// once it is that old
+	RotationInterval time.Duration `json:"rotationinterval,omitempty"`
+
+	// RotationOverlap is how long before its certificate expires an
+	// end-entity is replaced at the latest, so clients that cached
+	// its chain keep verifying signatures. Defaults to a quarter of
+	// the validity, at most a day.
+	RotationOverlap time.Duration `json:"rotationoverlap,omitempty"`
+
 	// ChainUploadLocation is the target a certificate chain should be
 	// uploaded to in order for clients to find it at the x5u location.
 	ChainUploadLocation string `json:"chain_upload_location,omitempty"`
 
+	// ChainUpload specifies the encryption, storage class, object
+	// lock and ACL of chains uploaded to S3, and the authentication
+	// of chains uploaded to https:// endpoints
+	ChainUpload ChainUploadConfig `yaml:"chain_upload,omitempty"`
+
+	// EELabelTemplate is an optional text/template of the label of
+	// new end-entity keys, to match HSM label policies. Defaults to
+	// {{.SignerID}}-{{.Now.Format "20060102150405"}}
+	EELabelTemplate string `json:"ee_label_template,omitempty"`
+
+	// ChainNameTemplate is an optional text/template of the name of
+	// uploaded certificate chains, to match existing bucket layouts.
+	// Defaults to {{.CommonName}}-{{.NotAfter.Format "2006-01-02-15-04-05"}}.chain
+	ChainNameTemplate string `json:"chain_name_template,omitempty"`
+
 	// CaCert is the certificate of the root of the pki, when used
 	CaCert string `json:"cacert,omitempty"`
 
@@ -147,6 +408,41 @@ type Configuration struct {
 	// PSSSaltLength constants from the rsa package.
 	SaltLength int `json:"saltlength,omitempty"`
 
+	// V4Signing enables APK Signature Scheme v4 for the apk2
+	// signer type, which returns an .idsig artifact alongside
+	// the signed APK
+	V4Signing bool `json:"v4signing,omitempty"`
+
+	// StampPrivateKey and StampCertificate are the optional key
+	// and certificate apk2 signers embed a SourceStamp block
+	// with, which identifies the distribution channel of an APK
+	StampPrivateKey  string `json:"stampprivatekey,omitempty"`
+	StampCertificate string `json:"stampcertificate,omitempty"`
+
+	// Decompress allows content signature signers to decompress
+	// gzip or brotli input before templating and hashing it, when
+	// a request sets the content_encoding option
+	Decompress bool `json:"decompress,omitempty"`
+
+	// MaxDecompressedSize is the maximum size in bytes of input
+	// decompressed by a signer. Defaults to 10MB.
+	MaxDecompressedSize int64 `json:"maxdecompressedsize,omitempty"`
+
+	// RNG is the random source of the signer: "hsm" for the RNG of
+	// the HSM, "system" for crypto/rand, or empty for the HSM when
+	// it is available and crypto/rand otherwise
+	RNG string `json:"rng,omitempty"`
+
+	// DeterministicECDSA makes content signature signers derive
+	// the nonces of ECDSA signatures from the key and digest per
+	// RFC 6979 instead of reading them from the random source, so
+	// signatures are reproducible. It requires software keys.
+	DeterministicECDSA bool `json:"deterministicecdsa,omitempty"`
+
+	// Lazy defers the initialization of the signer from startup
+	// to its first use or the background warmup
+	Lazy bool `json:"lazy,omitempty"`
+
 	// SignerOpts contains options for signing with a Signer
 	SignerOpts crypto.SignerOpts `json:"signer_opts,omitempty"`
 
@@ -165,6 +461,26 @@ type Signer interface {
 	Config() Configuration
 }
 
+// OptionsPublicKeyer is an interface to a signer that holds several
+// keys and selects one with the signing options
+type OptionsPublicKeyer interface {
+	PublicKeyForOptions(options interface{}) (string, error)
+}
+
+// CertificateChainer is an interface to a signer whose certificate
+// chain changes at runtime, like when end-entities rotate. It returns
+// the current chain, end-entity first.
+type CertificateChainer interface {
+	CertificateChain() []*x509.Certificate
+}
+
+// X5UChecker is an interface to a signer that publishes its chain at
+// an x5u. CheckX5U downloads the chain again and returns an error when
+// it isn't the chain of the key the signer uses anymore.
+type X5UChecker interface {
+	CheckX5U(ctx context.Context) error
+}
+
 // StatefulSigner is an interface to an issuer of digital signatures
 // that stores out of memory state (files, HSM or DB connections,
 // etc.) to clean up at exit
@@ -195,6 +511,13 @@ type Signature interface {
 	Marshal() (signature string, err error)
 }
 
+// KeyLabeler is an interface to a signature that knows the label of
+// the key that made it, like the end-entity of a signer whose key
+// rotates
+type KeyLabeler interface {
+	KeyLabel() string
+}
+
 // SignedFile is an []bytes that contains file data
 type SignedFile []byte
 
@@ -205,8 +528,15 @@ type TestFileGetter interface {
 }
 
 // GetRand returns a cryptographically secure random number from the
-// HSM if available and otherwise rand.Reader
+// HSM if available and otherwise rand.Reader, unless the RNG of the
+// configuration selects the source
 func (cfg *Configuration) GetRand() io.Reader {
+	switch cfg.RNG {
+	case RNGSystem:
+		return rand.Reader
+	case RNGHSM:
+		return new(crypto11.PKCS11RandReader)
+	}
 	if cfg.isHsmAvailable {
 		return new(crypto11.PKCS11RandReader)
 	}
@@ -273,11 +603,21 @@ func (cfg *Configuration) GetKeys() (priv crypto.PrivateKey, pub crypto.PublicKe
 func (cfg *Configuration) GetPrivateKey() (crypto.PrivateKey, error) {
 	cfg.PrivateKey = removePrivateKeyNewlines(cfg.PrivateKey)
 	if cfg.PrivateKeyHasPEMPrefix() {
-		return ParsePrivateKey([]byte(cfg.PrivateKey))
+		key, err := ParsePrivateKey([]byte(cfg.PrivateKey))
+		if err != nil {
+			return nil, err
+		}
+		// locking can fail when RLIMIT_MEMLOCK is low, which
+		// shouldn't prevent the signer from starting
+		err = LockPrivateKey(key)
+		if err != nil {
+			log.Debugf("signer %q: %s", cfg.ID, err)
+		}
+		return key, nil
 	}
 	// otherwise, we assume the privatekey represents a label in the HSM
 	if cfg.isHsmAvailable {
-		key, err := crypto11.FindKeyPair(nil, []byte(cfg.PrivateKey))
+		key, err := findHSMKey(cfg.PrivateKey)
 		if err != nil {
 			return nil, err
 		}
@@ -308,6 +648,9 @@ func ParsePrivateKey(keyPEMBlock []byte) (key crypto.PrivateKey, err error) {
 		}
 		skippedBlockTypes = append(skippedBlockTypes, keyDERBlock.Type)
 	}
+	// the parsed key copies what it needs out of the DER bytes,
+	// so wipe them once we're done
+	defer ZeroizeBytes(keyDERBlock.Bytes)
 	// Attempt to parse the given private key DER block. OpenSSL 0.9.8 generates
 	// PKCS#1 private keys by default, while OpenSSL 1.0.0 generates PKCS#8 keys.
 	// OpenSSL ecparam generates SEC1 EC private keys for ECDSA. We try all three.
@@ -395,6 +738,10 @@ func (cfg *Configuration) PrivateKeyHasPEMPrefix() bool {
 // CheckHSMConnection (exposed via the signer.Configuration
 // interface).  It tried to fetch the signer private key and errors if
 // that fails or the private key is not an HSM key handle.
+//
+// The check always searches the HSM rather than the key cache. It
+// drops cached keys when the search fails, and refreshes the cached
+// key of the signer when it succeeds.
 func (cfg *Configuration) CheckHSMConnection() error {
 	if cfg.PrivateKeyHasPEMPrefix() {
 		return errors.Errorf("private key for signer %s has a PEM prefix and is not an HSM key label", cfg.ID)
@@ -403,12 +750,14 @@ func (cfg *Configuration) CheckHSMConnection() error {
 		return errors.Errorf("HSM is not available for signer %s", cfg.ID)
 	}
 
-	privKey, err := cfg.GetPrivateKey()
+	privKey, err := crypto11.FindKeyPair(nil, []byte(cfg.PrivateKey))
 	if err != nil {
+		ResetHSMKeyCache()
 		return errors.Wrapf(err, "error fetching private key for signer %s", cfg.ID)
 	}
 	// returns 0 if the key is not stored in the hsm
 	if GetPrivKeyHandle(privKey) != 0 {
+		cacheHSMKey(cfg.PrivateKey, privKey)
 		return nil
 	}
 	return errors.Errorf("Unable to check HSM connection for signer %s private key is not stored in the HSM", cfg.ID)
@@ -417,6 +766,7 @@ func (cfg *Configuration) CheckHSMConnection() error {
 // MakeKey generates a new key of type keyTpl and returns the priv and public interfaces.
 // If an HSM is available, it is used to generate and store the key, in which case 'priv'
 // just points to the HSM handler and must be used via the crypto.Signer interface.
+// HSM keys are generated with the mechanisms and attributes set by ConfigureHSMKeyGen.
 func (cfg *Configuration) MakeKey(keyTpl interface{}, keyName string) (priv crypto.PrivateKey, pub crypto.PublicKey, err error) {
 	if cfg.isHsmAvailable {
 		var slots []uint
@@ -428,6 +778,10 @@ func (cfg *Configuration) MakeKey(keyTpl interface{}, keyName string) (priv cryp
 			return nil, nil, errors.New("failed to find a usable slot in hsm context")
 		}
 		keyNameBytes := []byte(keyName)
+		if keyGen := getHSMKeyGen(); keyGen != nil {
+			// follow the configured key policy
+			return keyGen.makeHSMKey(cfg.hsmCtx, slots[0], keyTpl, keyNameBytes)
+		}
 		switch keyTplType := keyTpl.(type) {
 		case *ecdsa.PublicKey:
 			priv, err = crypto11.GenerateECDSAKeyPairOnSlot(slots[0], keyNameBytes, keyNameBytes, keyTplType)
@@ -453,9 +807,9 @@ func (cfg *Configuration) MakeKey(keyTpl interface{}, keyName string) (priv cryp
 	case *ecdsa.PublicKey:
 		switch keyTplType.Params().Name {
 		case "P-256":
-			priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			priv, err = ecdsa.GenerateKey(elliptic.P256(), cfg.GetRand())
 		case "P-384":
-			priv, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+			priv, err = ecdsa.GenerateKey(elliptic.P384(), cfg.GetRand())
 		default:
 			return nil, nil, fmt.Errorf("unsupported curve %q",
 				keyTpl.(*ecdsa.PublicKey).Params().Name)
@@ -467,7 +821,7 @@ func (cfg *Configuration) MakeKey(keyTpl interface{}, keyName string) (priv cryp
 		return
 	case *rsa.PublicKey:
 		keySize := keyTplType.Size()
-		priv, err = rsa.GenerateKey(rand.Reader, keySize)
+		priv, err = rsa.GenerateKey(cfg.GetRand(), keySize)
 		if err != nil {
 			return nil, nil, errors.Wrap(err, "failed to generate rsa key in memory")
 		}
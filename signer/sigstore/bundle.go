@@ -0,0 +1,199 @@
+package sigstore
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BundleMediaType is the media type of the sigstore bundles the
+// signer returns
+const BundleMediaType = "application/vnd.dev.sigstore.bundle+json;version=0.1"
+
+// Bundle is a sigstore bundle in the JSON form of its protobuf
+// definition, which cosign and the sigstore clients verify. Byte
+// fields are base64 encoded and 64-bit integers are strings.
+type Bundle struct {
+	MediaType            string               `json:"mediaType"`
+	VerificationMaterial VerificationMaterial `json:"verificationMaterial"`
+	MessageSignature     MessageSignature     `json:"messageSignature"`
+}
+
+// VerificationMaterial holds the certificate chain of the signing
+// key, leaf first, and the Rekor entry of the signature
+type VerificationMaterial struct {
+	X509CertificateChain struct {
+		Certificates []X509Certificate `json:"certificates"`
+	} `json:"x509CertificateChain"`
+	TlogEntries []TlogEntry `json:"tlogEntries"`
+}
+
+// X509Certificate is a DER certificate in a bundle
+type X509Certificate struct {
+	RawBytes string `json:"rawBytes"`
+}
+
+// TlogEntry is a Rekor entry in a bundle
+type TlogEntry struct {
+	LogIndex int64 `json:"logIndex,string"`
+	LogID    struct {
+		KeyID string `json:"keyId"`
+	} `json:"logId"`
+	KindVersion struct {
+		Kind    string `json:"kind"`
+		Version string `json:"version"`
+	} `json:"kindVersion"`
+	IntegratedTime   int64 `json:"integratedTime,string"`
+	InclusionPromise struct {
+		SignedEntryTimestamp string `json:"signedEntryTimestamp"`
+	} `json:"inclusionPromise"`
+	CanonicalizedBody string `json:"canonicalizedBody"`
+}
+
+// MessageSignature is the signature of a SHA256 digest
+type MessageSignature struct {
+	MessageDigest struct {
+		Algorithm string `json:"algorithm"`
+		Digest    string `json:"digest"`
+	} `json:"messageDigest"`
+	Signature string `json:"signature"`
+}
+
+// Marshal returns the JSON bundle
+func (b *Bundle) Marshal() (string, error) {
+	out, err := json.Marshal(b)
+	if err != nil {
+		return "", errors.Wrap(err, "sigstore: failed to marshal bundle")
+	}
+	return string(out), nil
+}
+
+// newBundle returns the bundle of a signature recorded in Rekor
+func newBundle(digest, sig []byte, chain []*x509.Certificate, entry *rekorEntry) *Bundle {
+	b := &Bundle{MediaType: BundleMediaType}
+	for _, cert := range chain {
+		b.VerificationMaterial.X509CertificateChain.Certificates = append(
+			b.VerificationMaterial.X509CertificateChain.Certificates,
+			X509Certificate{RawBytes: base64.StdEncoding.EncodeToString(cert.Raw)})
+	}
+	tlog := TlogEntry{
+		LogIndex:          entry.LogIndex,
+		IntegratedTime:    entry.IntegratedTime,
+		CanonicalizedBody: entry.Body,
+	}
+	// Rekor returns the log ID in hex and bundles have its bytes
+	logID, err := hex.DecodeString(entry.LogID)
+	if err == nil {
+		tlog.LogID.KeyID = base64.StdEncoding.EncodeToString(logID)
+	}
+	tlog.KindVersion.Kind = hashedRekordKind
+	tlog.KindVersion.Version = hashedRekordVersion
+	tlog.InclusionPromise.SignedEntryTimestamp = entry.Verification.SignedEntryTimestamp
+	b.VerificationMaterial.TlogEntries = []TlogEntry{tlog}
+	b.MessageSignature.MessageDigest.Algorithm = "SHA2_256"
+	b.MessageSignature.MessageDigest.Digest = base64.StdEncoding.EncodeToString(digest)
+	b.MessageSignature.Signature = base64.StdEncoding.EncodeToString(sig)
+	return b
+}
+
+// parseBundle parses a JSON sigstore bundle
+func parseBundle(data []byte) (*Bundle, error) {
+	b := new(Bundle)
+	err := json.Unmarshal(data, b)
+	if err != nil {
+		return nil, errors.Wrap(err, "sigstore: failed to parse bundle")
+	}
+	if b.MediaType != BundleMediaType {
+		return nil, errors.Errorf("sigstore: unsupported bundle media type %q", b.MediaType)
+	}
+	return b, nil
+}
+
+// VerifyHash verifies a sigstore bundle is a signature of a SHA256
+// digest: the signature is made by the key of the leaf certificate,
+// and the Rekor entry of the bundle records that signature. When
+// roots is not nil, the certificate chain must also lead to one of
+// the roots at the time the entry was integrated in the log. The
+// inclusion promise of Rekor is not verified.
+func VerifyHash(digest []byte, bundle string, roots *x509.CertPool) error {
+	b, err := parseBundle([]byte(bundle))
+	if err != nil {
+		return err
+	}
+	bundleDigest, err := base64.StdEncoding.DecodeString(b.MessageSignature.MessageDigest.Digest)
+	if err != nil || b.MessageSignature.MessageDigest.Algorithm != "SHA2_256" || !bytes.Equal(bundleDigest, digest) {
+		return errors.New("sigstore: bundle is not a signature of the SHA256 digest")
+	}
+	sig, err := base64.StdEncoding.DecodeString(b.MessageSignature.Signature)
+	if err != nil {
+		return errors.Wrap(err, "sigstore: failed to decode signature")
+	}
+	var chain []*x509.Certificate
+	for _, c := range b.VerificationMaterial.X509CertificateChain.Certificates {
+		der, err := base64.StdEncoding.DecodeString(c.RawBytes)
+		if err != nil {
+			return errors.Wrap(err, "sigstore: failed to decode certificate")
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return errors.Wrap(err, "sigstore: failed to parse certificate")
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return errors.New("sigstore: bundle has no certificate")
+	}
+	pubKey, ok := chain[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.Errorf("sigstore: unsupported certificate key type %T", chain[0].PublicKey)
+	}
+	var ecdsaSig struct {
+		R, S *big.Int
+	}
+	_, err = asn1.Unmarshal(sig, &ecdsaSig)
+	if err != nil || !ecdsa.Verify(pubKey, digest, ecdsaSig.R, ecdsaSig.S) {
+		return errors.New("sigstore: signature verification failed")
+	}
+
+	if len(b.VerificationMaterial.TlogEntries) != 1 {
+		return errors.Errorf("sigstore: bundle has %d rekor entries, expected one", len(b.VerificationMaterial.TlogEntries))
+	}
+	tlog := b.VerificationMaterial.TlogEntries[0]
+	body, err := base64.StdEncoding.DecodeString(tlog.CanonicalizedBody)
+	if err != nil {
+		return errors.Wrap(err, "sigstore: failed to decode rekor entry")
+	}
+	var entry hashedRekord
+	err = json.Unmarshal(body, &entry)
+	if err != nil {
+		return errors.Wrap(err, "sigstore: failed to parse rekor entry")
+	}
+	if !entry.records(digest, sig, chain[0]) {
+		return errors.New("sigstore: rekor entry does not record the signature of the bundle")
+	}
+
+	if roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range chain[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err = chain[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   time.Unix(tlog.IntegratedTime, 0),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		})
+		if err != nil {
+			return errors.Wrap(err, "sigstore: failed to verify certificate chain")
+		}
+	}
+	return nil
+}
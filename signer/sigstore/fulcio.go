@@ -0,0 +1,168 @@
+package sigstore
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxResponseSize is the maximum size of Fulcio and Rekor responses
+const maxResponseSize = 1 << 20
+
+// fulcioPublicKey is the public key of a Fulcio certificate request
+type fulcioPublicKey struct {
+	Content   string `json:"content"`
+	Algorithm string `json:"algorithm"`
+}
+
+// fulcioCertRequest is the body of a v1 Fulcio certificate request.
+// SignedEmailAddress proves possession of the private key with a
+// signature of the subject of the identity token.
+type fulcioCertRequest struct {
+	PublicKey          fulcioPublicKey `json:"publicKey"`
+	SignedEmailAddress string          `json:"signedEmailAddress"`
+}
+
+// tokenSubject returns the email claim of a JWT identity token, or
+// its sub claim when it has no email, which Fulcio expects the
+// proof of possession to sign. The token is not verified, Fulcio
+// does that.
+func tokenSubject(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("sigstore: identity token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", errors.Wrap(err, "sigstore: failed to decode identity token payload")
+	}
+	var claims struct {
+		Subject string `json:"sub"`
+		Email   string `json:"email"`
+	}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return "", errors.Wrap(err, "sigstore: failed to parse identity token claims")
+	}
+	if claims.Email != "" {
+		return claims.Email, nil
+	}
+	if claims.Subject == "" {
+		return "", errors.New("sigstore: identity token has no email or sub claim")
+	}
+	return claims.Subject, nil
+}
+
+// requestCert generates an ephemeral key and requests a certificate
+// of its public key from Fulcio with the identity token
+func (s *SigstoreSigner) requestCert(ctx context.Context) (*ephemeralCert, error) {
+	tokenBytes, err := ioutil.ReadFile(s.Sigstore.IdentityTokenFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "sigstore: failed to read identity token")
+	}
+	token := strings.TrimSpace(string(tokenBytes))
+	subject, err := tokenSubject(token)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), s.rng)
+	if err != nil {
+		return nil, errors.Wrap(err, "sigstore: failed to generate ephemeral key")
+	}
+	pubKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "sigstore: failed to marshal ephemeral public key")
+	}
+	subjectDigest := sha256.Sum256([]byte(subject))
+	proof, err := key.Sign(s.rng, subjectDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, errors.Wrap(err, "sigstore: failed to sign identity token subject")
+	}
+	body, err := json.Marshal(fulcioCertRequest{
+		PublicKey: fulcioPublicKey{
+			Content:   base64.StdEncoding.EncodeToString(pubKey),
+			Algorithm: "ecdsa",
+		},
+		SignedEmailAddress: base64.StdEncoding.EncodeToString(proof),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "sigstore: failed to marshal certificate request")
+	}
+	req, err := http.NewRequest(http.MethodPost, s.Sigstore.FulcioURL+"/api/v1/signingCert", bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "sigstore: failed to make certificate request")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/pem-certificate-chain")
+	respBody, err := s.do(ctx, req, "fulcio")
+	if err != nil {
+		return nil, err
+	}
+	chain, err := parseCertificateChain(respBody)
+	if err != nil {
+		return nil, err
+	}
+	leafKey, ok := chain[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok || leafKey.X.Cmp(key.X) != 0 || leafKey.Y.Cmp(key.Y) != 0 {
+		return nil, errors.New("sigstore: fulcio certificate is not for the ephemeral key")
+	}
+	return &ephemeralCert{key: key, chain: chain}, nil
+}
+
+// parseCertificateChain parses a PEM certificate chain, leaf first
+func parseCertificateChain(chainPEM []byte) (chain []*x509.Certificate, err error) {
+	for {
+		var block *pem.Block
+		block, chainPEM = pem.Decode(chainPEM)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "sigstore: failed to parse fulcio certificate")
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("sigstore: fulcio returned no certificate")
+	}
+	return chain, nil
+}
+
+// do sends a request to Fulcio or Rekor and returns the body of a
+// successful response
+func (s *SigstoreSigner) do(ctx context.Context, req *http.Request, service string) ([]byte, error) {
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "sigstore: %s request failed", service)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, errors.Wrapf(err, "sigstore: failed to read %s response", service)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if len(body) > 512 {
+			body = body[:512]
+		}
+		return nil, errors.Errorf("sigstore: %s returned status %d: %s", service, resp.StatusCode, body)
+	}
+	return body, nil
+}
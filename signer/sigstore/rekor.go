@@ -0,0 +1,123 @@
+package sigstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// hashedRekordKind and hashedRekordVersion are the type of the
+	// Rekor entries of signed digests
+	hashedRekordKind    = "hashedrekord"
+	hashedRekordVersion = "0.0.1"
+)
+
+// hashedRekord is a Rekor entry of a signature of a SHA256 digest,
+// with the certificate of the signing key
+type hashedRekord struct {
+	APIVersion string           `json:"apiVersion"`
+	Kind       string           `json:"kind"`
+	Spec       hashedRekordSpec `json:"spec"`
+}
+
+type hashedRekordSpec struct {
+	Signature struct {
+		Content   string `json:"content"`
+		PublicKey struct {
+			Content string `json:"content"`
+		} `json:"publicKey"`
+	} `json:"signature"`
+	Data struct {
+		Hash struct {
+			Algorithm string `json:"algorithm"`
+			Value     string `json:"value"`
+		} `json:"hash"`
+	} `json:"data"`
+}
+
+// rekorEntry is an entry of the Rekor log. Body is the canonicalized
+// entry and SignedEntryTimestamp the promise of Rekor to include it
+// in the log.
+type rekorEntry struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+	Verification   struct {
+		SignedEntryTimestamp string `json:"signedEntryTimestamp"`
+	} `json:"verification"`
+}
+
+// newHashedRekord returns the Rekor entry of a signature of a digest
+func newHashedRekord(digest, sig []byte, cert *x509.Certificate) hashedRekord {
+	entry := hashedRekord{APIVersion: hashedRekordVersion, Kind: hashedRekordKind}
+	entry.Spec.Signature.Content = base64.StdEncoding.EncodeToString(sig)
+	entry.Spec.Signature.PublicKey.Content = base64.StdEncoding.EncodeToString(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	entry.Spec.Data.Hash.Algorithm = "sha256"
+	entry.Spec.Data.Hash.Value = hex.EncodeToString(digest)
+	return entry
+}
+
+// records returns whether an entry returned by Rekor records the
+// signature of a digest with a certificate. Rekor canonicalizes the
+// entries it returns, so the decoded values are compared.
+func (entry hashedRekord) records(digest, sig []byte, cert *x509.Certificate) bool {
+	if entry.Kind != hashedRekordKind || entry.Spec.Data.Hash.Algorithm != "sha256" {
+		return false
+	}
+	entryDigest, err := hex.DecodeString(entry.Spec.Data.Hash.Value)
+	if err != nil || !bytes.Equal(entryDigest, digest) {
+		return false
+	}
+	entrySig, err := base64.StdEncoding.DecodeString(entry.Spec.Signature.Content)
+	if err != nil || !bytes.Equal(entrySig, sig) {
+		return false
+	}
+	entryCert, err := base64.StdEncoding.DecodeString(entry.Spec.Signature.PublicKey.Content)
+	if err != nil {
+		return false
+	}
+	block, _ := pem.Decode(entryCert)
+	return block != nil && bytes.Equal(block.Bytes, cert.Raw)
+}
+
+// uploadEntry records the signature of a digest in Rekor and returns
+// the log entry
+func (s *SigstoreSigner) uploadEntry(ctx context.Context, digest, sig []byte, cert *x509.Certificate) (*rekorEntry, error) {
+	body, err := json.Marshal(newHashedRekord(digest, sig, cert))
+	if err != nil {
+		return nil, errors.Wrap(err, "sigstore: failed to marshal rekor entry")
+	}
+	req, err := http.NewRequest(http.MethodPost, s.Sigstore.RekorURL+"/api/v1/log/entries", bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "sigstore: failed to make rekor request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	respBody, err := s.do(ctx, req, "rekor")
+	if err != nil {
+		return nil, err
+	}
+	// the response maps the UUID of the entry to the entry
+	var entries map[string]rekorEntry
+	err = json.Unmarshal(respBody, &entries)
+	if err != nil {
+		return nil, errors.Wrap(err, "sigstore: failed to parse rekor response")
+	}
+	if len(entries) != 1 {
+		return nil, errors.Errorf("sigstore: rekor returned %d entries, expected one", len(entries))
+	}
+	for _, entry := range entries {
+		return &entry, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,176 @@
+package sigstore
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/autograph/signer"
+)
+
+const (
+	// Type of this signer is "sigstore", which signs with short
+	// lived Fulcio certificates and records signatures in Rekor
+	Type = "sigstore"
+
+	// DefaultFulcioURL is the public good Fulcio instance
+	DefaultFulcioURL = "https://fulcio.sigstore.dev"
+
+	// DefaultRekorURL is the public good Rekor instance
+	DefaultRekorURL = "https://rekor.sigstore.dev"
+
+	// certRenewalMargin is how long before it expires a
+	// certificate is replaced, so signatures are recorded in
+	// Rekor while it is still valid
+	certRenewalMargin = 2 * time.Minute
+)
+
+// SigstoreSigner holds the configuration of the signer
+type SigstoreSigner struct {
+	signer.Configuration
+
+	// client calls Fulcio and Rekor
+	client *http.Client
+
+	// rng generates ephemeral keys and signatures
+	rng io.Reader
+
+	// certMu guards cert, which is renewed before it expires
+	certMu sync.Mutex
+	cert   *ephemeralCert
+}
+
+// ephemeralCert is an in-memory key with the Fulcio certificate
+// chain of its public key, leaf first
+type ephemeralCert struct {
+	key   *ecdsa.PrivateKey
+	chain []*x509.Certificate
+}
+
+// New initializes a sigstore signer using a configuration
+func New(conf signer.Configuration) (s *SigstoreSigner, err error) {
+	s = new(SigstoreSigner)
+
+	if conf.Type != Type {
+		return nil, errors.Errorf("sigstore: invalid type %q, must be %q", conf.Type, Type)
+	}
+	s.Type = conf.Type
+
+	if conf.ID == "" {
+		return nil, errors.New("sigstore: missing signer ID in signer configuration")
+	}
+	s.ID = conf.ID
+
+	if conf.Sigstore.IdentityTokenFile == "" {
+		return nil, errors.New("sigstore: missing identity token file in signer configuration")
+	}
+	s.Sigstore = conf.Sigstore
+	if s.Sigstore.FulcioURL == "" {
+		s.Sigstore.FulcioURL = DefaultFulcioURL
+	}
+	if s.Sigstore.RekorURL == "" {
+		s.Sigstore.RekorURL = DefaultRekorURL
+	}
+	s.Sigstore.FulcioURL = strings.TrimSuffix(s.Sigstore.FulcioURL, "/")
+	s.Sigstore.RekorURL = strings.TrimSuffix(s.Sigstore.RekorURL, "/")
+	s.client = &http.Client{Timeout: 30 * time.Second}
+	s.rng = conf.GetRand()
+	return s, nil
+}
+
+// Config returns the configuration of the current signer
+func (s *SigstoreSigner) Config() signer.Configuration {
+	return signer.Configuration{
+		ID:       s.ID,
+		Type:     s.Type,
+		Sigstore: s.Sigstore,
+	}
+}
+
+// SignData hashes data with SHA256 and signs the digest
+func (s *SigstoreSigner) SignData(data []byte, options interface{}) (signer.Signature, error) {
+	return s.SignDataContext(context.Background(), data, options)
+}
+
+// SignDataContext hashes data with SHA256 and signs the digest,
+// aborting the Fulcio and Rekor requests when ctx is done
+func (s *SigstoreSigner) SignDataContext(ctx context.Context, data []byte, options interface{}) (signer.Signature, error) {
+	digest := sha256.Sum256(data)
+	return s.SignHashContext(ctx, digest[:], options)
+}
+
+// SignHash signs a SHA256 digest
+func (s *SigstoreSigner) SignHash(digest []byte, options interface{}) (signer.Signature, error) {
+	return s.SignHashContext(context.Background(), digest, options)
+}
+
+// SignHashContext signs a SHA256 digest with the ephemeral key of a
+// Fulcio certificate, records the signature in Rekor and returns a
+// sigstore bundle with the signature, certificate chain and Rekor
+// entry
+func (s *SigstoreSigner) SignHashContext(ctx context.Context, digest []byte, options interface{}) (signer.Signature, error) {
+	if len(digest) != sha256.Size {
+		return nil, errors.Wrapf(signer.ErrInvalidHashLength, "sigstore: refusing to sign input hash. Got length %d, expected %d", len(digest), sha256.Size)
+	}
+	cert, err := s.getCert(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := cert.key.Sign(s.rng, digest, crypto.SHA256)
+	if err != nil {
+		return nil, errors.Wrap(err, "sigstore: failed to sign digest")
+	}
+	entry, err := s.uploadEntry(ctx, digest, sig, cert.chain[0])
+	if err != nil {
+		return nil, err
+	}
+	return newBundle(digest, sig, cert.chain, entry), nil
+}
+
+// getCert returns the current ephemeral certificate, or requests a
+// new one from Fulcio when it is about to expire
+func (s *SigstoreSigner) getCert(ctx context.Context) (*ephemeralCert, error) {
+	s.certMu.Lock()
+	defer s.certMu.Unlock()
+	if s.cert != nil && time.Now().Add(certRenewalMargin).Before(s.cert.chain[0].NotAfter) {
+		return s.cert, nil
+	}
+	cert, err := s.requestCert(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.cert = cert
+	return cert, nil
+}
+
+// Options are not implemented for this signer
+type Options struct {
+}
+
+// GetDefaultOptions returns default options of the signer
+func (s *SigstoreSigner) GetDefaultOptions() interface{} {
+	return Options{}
+}
+
+// Unmarshal parses a JSON sigstore bundle
+func Unmarshal(sigstr string) (signer.Signature, error) {
+	b, err := parseBundle([]byte(sigstr))
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// VerifyData verifies a sigstore bundle is a signature of data
+func VerifyData(data []byte, bundle string, roots *x509.CertPool) error {
+	digest := sha256.Sum256(data)
+	return VerifyHash(digest[:], bundle, roots)
+}
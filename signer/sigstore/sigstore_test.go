@@ -0,0 +1,290 @@
+package sigstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/signer"
+)
+
+const testIdentity = "autograph@example.net"
+
+// fakeSigstore is a Fulcio and Rekor test server
+type fakeSigstore struct {
+	*httptest.Server
+	caKey      *ecdsa.PrivateKey
+	caCert     *x509.Certificate
+	certs      int32
+	entries    int32
+	certExpiry time.Duration
+}
+
+func newFakeSigstore(t *testing.T) *fakeSigstore {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake fulcio root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTpl, caTpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSigstore{caKey: caKey, caCert: caCert, certExpiry: 10 * time.Minute}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/signingCert", f.handleSigningCert)
+	mux.HandleFunc("/api/v1/log/entries", f.handleLogEntries)
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+func (f *fakeSigstore) handleSigningCert(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+testToken() {
+		http.Error(w, "invalid identity token", http.StatusUnauthorized)
+		return
+	}
+	var req fulcioCertRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	der, _ := base64.StdEncoding.DecodeString(req.PublicKey.Content)
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	proof, _ := base64.StdEncoding.DecodeString(req.SignedEmailAddress)
+	digest := sha256.Sum256([]byte(testIdentity))
+	var sig struct{ R, S *big.Int }
+	_, err = asn1.Unmarshal(proof, &sig)
+	if err != nil || !ecdsa.Verify(pub.(*ecdsa.PublicKey), digest[:], sig.R, sig.S) {
+		http.Error(w, "invalid proof of possession", http.StatusBadRequest)
+		return
+	}
+	n := atomic.AddInt32(&f.certs, 1)
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:   big.NewInt(int64(n) + 1),
+		NotBefore:      time.Now().Add(-time.Minute),
+		NotAfter:       time.Now().Add(f.certExpiry),
+		EmailAddresses: []string{testIdentity},
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}, f.caCert, pub, f.caKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.WriteHeader(http.StatusCreated)
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})
+}
+
+func (f *fakeSigstore) handleLogEntries(w http.ResponseWriter, r *http.Request) {
+	var entry hashedRekord
+	err := json.NewDecoder(r.Body).Decode(&entry)
+	if err != nil || entry.Kind != hashedRekordKind {
+		http.Error(w, "invalid entry", http.StatusBadRequest)
+		return
+	}
+	body, _ := json.Marshal(entry)
+	n := atomic.AddInt32(&f.entries, 1)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]rekorEntry{
+		"24296fb24b8ad77a": {
+			Body:           base64.StdEncoding.EncodeToString(body),
+			IntegratedTime: time.Now().Unix(),
+			LogID:          "c0d23d6ad406973f9559f3ba2d1ca01f84147d8ffc5b8445c224f98b9591801d",
+			LogIndex:       int64(n),
+		},
+	})
+}
+
+// testToken returns an unsigned JWT with the test identity
+func testToken() string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"RS256"}`)) + "." +
+		enc.EncodeToString([]byte(`{"sub":"1234","email":"`+testIdentity+`"}`)) + "." +
+		enc.EncodeToString([]byte("signature"))
+}
+
+// newTestSigner returns a signer using the fake sigstore with its
+// identity token in dir
+func newTestSigner(t *testing.T, f *fakeSigstore, dir string) *SigstoreSigner {
+	tokenFile := filepath.Join(dir, "token")
+	err := ioutil.WriteFile(tokenFile, []byte(testToken()+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(signer.Configuration{
+		ID:   "sigstoretest",
+		Type: Type,
+		Sigstore: signer.SigstoreConfig{
+			FulcioURL:         f.URL,
+			RekorURL:          f.URL + "/",
+			IdentityTokenFile: tokenFile,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSignAndVerify(t *testing.T) {
+	f := newFakeSigstore(t)
+	defer f.Close()
+	dir, err := ioutil.TempDir("", "autograph_sigstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := newTestSigner(t, f, dir)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(f.caCert)
+	input := []byte("an artifact to sign")
+	for i := 0; i < 2; i++ {
+		sig, err := s.SignData(input, s.GetDefaultOptions())
+		if err != nil {
+			t.Fatalf("failed to sign data: %v", err)
+		}
+		bundle, err := sig.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = VerifyData(input, bundle, roots)
+		if err != nil {
+			t.Fatalf("failed to verify bundle: %v", err)
+		}
+		err = VerifyData([]byte("another artifact"), bundle, roots)
+		if err == nil {
+			t.Fatal("expected bundle of another artifact to fail verification")
+		}
+		_, err = Unmarshal(bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the certificate is reused until it is about to expire
+	if f.certs != 1 || f.entries != 2 {
+		t.Fatalf("expected 1 certificate and 2 rekor entries, got %d and %d", f.certs, f.entries)
+	}
+
+	// verification fails with other roots
+	otherRoots := x509.NewCertPool()
+	sig, err := s.SignHash(make([]byte, 32), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, _ := sig.Marshal()
+	err = VerifyHash(make([]byte, 32), bundle, otherRoots)
+	if err == nil || !strings.Contains(err.Error(), "certificate chain") {
+		t.Fatalf("expected certificate chain verification to fail, got %v", err)
+	}
+}
+
+func TestCertificateRenewal(t *testing.T) {
+	f := newFakeSigstore(t)
+	defer f.Close()
+	dir, err := ioutil.TempDir("", "autograph_sigstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f.certExpiry = time.Minute
+	s := newTestSigner(t, f, dir)
+
+	for i := 0; i < 2; i++ {
+		_, err := s.SignHash(make([]byte, 32), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// certificates expiring within the renewal margin are replaced
+	if f.certs != 2 {
+		t.Fatalf("expected 2 certificates, got %d", f.certs)
+	}
+}
+
+func TestSignFailures(t *testing.T) {
+	f := newFakeSigstore(t)
+	defer f.Close()
+	dir, err := ioutil.TempDir("", "autograph_sigstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestSigner(t, f, dir)
+	_, err = s.SignHash([]byte("too short"), nil)
+	if err == nil {
+		t.Fatal("expected a hash of invalid length to fail")
+	}
+	err = ioutil.WriteFile(s.Sigstore.IdentityTokenFile, []byte("not a jwt"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.SignData([]byte("data"), nil)
+	if err == nil {
+		t.Fatal("expected an invalid identity token to fail")
+	}
+
+	s = newTestSigner(t, f, dir)
+	s.Sigstore.RekorURL = f.URL + "/missing"
+	_, err = s.SignData([]byte("data"), nil)
+	if err == nil || !strings.Contains(err.Error(), "rekor returned status 404") {
+		t.Fatalf("expected rekor failure, got %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for i, conf := range []signer.Configuration{
+		{ID: "sigstoretest", Type: "pgp", Sigstore: signer.SigstoreConfig{IdentityTokenFile: "/tmp/token"}},
+		{Type: Type, Sigstore: signer.SigstoreConfig{IdentityTokenFile: "/tmp/token"}},
+		{ID: "sigstoretest", Type: Type},
+	} {
+		_, err := New(conf)
+		if err == nil {
+			t.Fatalf("testcase %d: expected signer initialization to fail", i)
+		}
+	}
+	s, err := New(signer.Configuration{ID: "sigstoretest", Type: Type, Sigstore: signer.SigstoreConfig{IdentityTokenFile: "/tmp/token"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Config().Sigstore.FulcioURL != DefaultFulcioURL || s.Config().Sigstore.RekorURL != DefaultRekorURL {
+		t.Fatalf("expected default sigstore URLs, got %+v", s.Config().Sigstore)
+	}
+}
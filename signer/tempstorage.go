@@ -0,0 +1,329 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// tempStorageRoot is the directory of the temporary storage directory
+// that holds a directory per autograph process
+const tempStorageRoot = "autograph-tmp"
+
+// tempDirAttempts is the number of times a process tries to create and
+// lock its directory, which another process recovering the storage can
+// remove between the two
+const tempDirAttempts = 3
+
+// ErrTempStorageFull is returned when the temporary files of a signing
+// operation would exceed the quota of the temporary storage
+var ErrTempStorageFull = errors.New("temporary storage quota exceeded")
+
+// TempStorageConfig configures where file signers write the temporary
+// files of signing operations, like the inputs and keys of apksigner
+// and the keyrings of gpg
+type TempStorageConfig struct {
+	// Dir is the directory temporary files are written to, the
+	// system temporary directory by default
+	Dir string
+
+	// MaxSize is the maximum number of bytes signing operations can
+	// reserve for their temporary files at the same time. Operations
+	// that would exceed it fail with ErrTempStorageFull. There is
+	// no quota when it is zero.
+	MaxSize int64
+}
+
+// TempStorageStats reports the usage of the temporary storage
+type TempStorageStats struct {
+	// Dir is the directory of the temporary files of this process
+	Dir string
+
+	// MaxSize is the quota of the temporary storage, zero when
+	// there is none
+	MaxSize int64
+
+	// Reserved is the number of bytes reserved by the temporary
+	// spaces in use
+	Reserved int64
+
+	// Used is the number of bytes on disk in the temporary spaces
+	Used int64
+
+	// Spaces is the number of temporary spaces in use
+	Spaces int
+
+	// Rejected is the number of temporary spaces refused because
+	// of the quota since the storage was configured
+	Rejected int64
+}
+
+// tempStorage is the directory of the temporary files of an autograph
+// process, and the reservations of the spaces in it
+type tempStorage struct {
+	sync.Mutex
+	dir string
+	// lock holds the lock of dir that tells other processes it is
+	// in use, nil where directories can't be locked
+	lock     *os.File
+	maxSize  int64
+	reserved int64
+	spaces   int
+	rejected int64
+}
+
+var (
+	tempStorageMu sync.Mutex
+	tempStore     *tempStorage
+)
+
+// ConfigureTempStorage sets the directory and quota of temporary
+// files. It removes the temporary files left behind by autograph
+// processes that are no longer running, like after a crash, and must
+// be called before signers are initialized.
+func ConfigureTempStorage(conf TempStorageConfig) error {
+	if conf.MaxSize < 0 {
+		return errors.Errorf("temporary storage quota %d cannot be negative", conf.MaxSize)
+	}
+	tempStorageMu.Lock()
+	defer tempStorageMu.Unlock()
+	storage, err := newTempStorage(conf, tempStore == nil)
+	if err != nil {
+		return err
+	}
+	tempStore = storage
+	if conf.MaxSize > 0 {
+		log.Infof("writing temporary files to %s with a quota of %d bytes", storage.dir, conf.MaxSize)
+	} else {
+		log.Infof("writing temporary files to %s", storage.dir)
+	}
+	return nil
+}
+
+// newTempStorage creates and locks a directory for the temporary files
+// of the process, named after its pid and a random suffix since
+// processes of different containers sharing the storage can have the
+// same pid. When recover is set, it first removes the directories no
+// running process holds the lock of, like after a crash. Directories
+// are never recovered on platforms where they can't be locked.
+func newTempStorage(conf TempStorageConfig, recover bool) (*tempStorage, error) {
+	if conf.Dir == "" {
+		conf.Dir = os.TempDir()
+	}
+	root := filepath.Join(conf.Dir, tempStorageRoot)
+	err := os.MkdirAll(root, 0700)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create temporary storage directory")
+	}
+	if recover && tempDirLocking {
+		entries, err := ioutil.ReadDir(root)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list temporary storage directory")
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				recoverTempDir(filepath.Join(root, entry.Name()))
+			}
+		}
+	}
+	prefix := strconv.Itoa(os.Getpid()) + "-"
+	for attempt := 1; ; attempt++ {
+		dir, err := ioutil.TempDir(root, prefix)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create temporary storage directory")
+		}
+		storage := &tempStorage{dir: dir, maxSize: conf.MaxSize}
+		if !tempDirLocking {
+			return storage, nil
+		}
+		storage.lock, err = lockTempDir(dir)
+		if err == nil {
+			// the directory was removed if another process
+			// locked it first
+			if _, err = os.Stat(dir); err == nil {
+				return storage, nil
+			}
+			storage.lock.Close()
+		}
+		if attempt == tempDirAttempts {
+			return nil, errors.Wrap(err, "failed to lock temporary storage directory")
+		}
+	}
+}
+
+// recoverTempDir removes the temporary files of a process when it no
+// longer holds the lock of their directory
+func recoverTempDir(path string) {
+	lock, err := lockTempDir(path)
+	if err != nil {
+		// in use by a running process
+		return
+	}
+	defer lock.Close()
+	size := diskUsage(path)
+	err = os.RemoveAll(path)
+	if err != nil {
+		log.Warnf("failed to remove temporary files left behind in %s: %v", path, err)
+		return
+	}
+	log.Infof("removed %d bytes of temporary files left behind in %s", size, path)
+}
+
+// getTempStorage returns the configured temporary storage, or one in
+// the system temporary directory without quota
+func getTempStorage() (*tempStorage, error) {
+	tempStorageMu.Lock()
+	defer tempStorageMu.Unlock()
+	if tempStore == nil {
+		storage, err := newTempStorage(TempStorageConfig{}, false)
+		if err != nil {
+			return nil, err
+		}
+		tempStore = storage
+	}
+	return tempStore, nil
+}
+
+// reserve counts size bytes against the quota
+func (t *tempStorage) reserve(size int64) error {
+	t.Lock()
+	defer t.Unlock()
+	if t.maxSize > 0 && t.reserved+size > t.maxSize {
+		t.rejected++
+		return errors.Wrapf(ErrTempStorageFull, "cannot reserve %d bytes with %d of %d bytes in use", size, t.reserved, t.maxSize)
+	}
+	t.reserved += size
+	t.spaces++
+	return nil
+}
+
+// release returns size bytes to the quota
+func (t *tempStorage) release(size int64) {
+	t.Lock()
+	defer t.Unlock()
+	t.reserved -= size
+	t.spaces--
+}
+
+// TempSpace is a temporary directory for the files of a signing
+// operation. Its reserved size counts against the quota of the
+// temporary storage until it is released.
+type TempSpace struct {
+	storage *tempStorage
+	dir     string
+	size    int64
+	once    sync.Once
+}
+
+// NewTempSpace reserves size bytes of temporary storage and creates a
+// directory for them whose name starts with prefix. Callers must
+// Release it when they are done with its files.
+func NewTempSpace(prefix string, size int64) (*TempSpace, error) {
+	storage, err := getTempStorage()
+	if err != nil {
+		return nil, err
+	}
+	err = storage.reserve(size)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(storage.dir, prefix)
+	if err != nil {
+		storage.release(size)
+		return nil, errors.Wrap(err, "failed to create temporary directory")
+	}
+	return &TempSpace{storage: storage, dir: dir, size: size}, nil
+}
+
+// Dir returns the path of the directory of the space
+func (s *TempSpace) Dir() string {
+	return s.dir
+}
+
+// WriteFile writes data to a new file of the space whose name starts
+// with prefix, and returns its path
+func (s *TempSpace) WriteFile(prefix string, data []byte, perm os.FileMode) (string, error) {
+	fd, err := ioutil.TempFile(s.dir, prefix)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create temporary file")
+	}
+	err = fd.Chmod(perm)
+	if err == nil {
+		_, err = fd.Write(data)
+	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+		return "", errors.Wrap(err, "failed to write temporary file")
+	}
+	return fd.Name(), nil
+}
+
+// Release removes the directory of the space and returns its size to
+// the quota. It is safe to call more than once.
+func (s *TempSpace) Release() error {
+	var err error
+	s.once.Do(func() {
+		err = os.RemoveAll(s.dir)
+		s.storage.release(s.size)
+	})
+	return err
+}
+
+// GetTempStorageStats returns the usage of the temporary storage
+func GetTempStorageStats() (TempStorageStats, error) {
+	storage, err := getTempStorage()
+	if err != nil {
+		return TempStorageStats{}, err
+	}
+	storage.Lock()
+	stats := TempStorageStats{
+		Dir:      storage.dir,
+		MaxSize:  storage.maxSize,
+		Reserved: storage.reserved,
+		Spaces:   storage.spaces,
+		Rejected: storage.rejected,
+	}
+	storage.Unlock()
+	stats.Used = diskUsage(storage.dir)
+	return stats, nil
+}
+
+// CleanupTempStorage removes the directory of the temporary files of
+// the process when it shuts down. Temporary spaces reserved afterwards
+// get a new directory.
+func CleanupTempStorage() error {
+	tempStorageMu.Lock()
+	defer tempStorageMu.Unlock()
+	if tempStore == nil {
+		return nil
+	}
+	err := os.RemoveAll(tempStore.dir)
+	if tempStore.lock != nil {
+		tempStore.lock.Close()
+	}
+	tempStore = nil
+	return err
+}
+
+// diskUsage returns the size of the regular files under a directory
+func diskUsage(dir string) (size int64) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
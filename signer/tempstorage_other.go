@@ -0,0 +1,24 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd
+
+package signer
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// tempDirLocking is whether temporary storage directories can be
+// locked on this platform. Without locks, the temporary files of
+// processes are never removed by others.
+const tempDirLocking = false
+
+// lockTempDir cannot lock directories on this platform
+func lockTempDir(dir string) (*os.File, error) {
+	return nil, errors.New("locking temporary storage directories is not supported on this platform")
+}
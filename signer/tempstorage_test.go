@@ -0,0 +1,153 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestTempStorageQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autograph-tempstorage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ConfigureTempStorage(TempStorageConfig{Dir: dir, MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		tempStorageMu.Lock()
+		tempStore = nil
+		tempStorageMu.Unlock()
+	}()
+
+	space, err := NewTempSpace("test_", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processDir := filepath.Dir(space.Dir())
+	if filepath.Dir(processDir) != filepath.Join(dir, tempStorageRoot) || !strings.HasPrefix(filepath.Base(processDir), strconv.Itoa(os.Getpid())+"-") {
+		t.Fatalf("expected the space in the directory of the process, got %s", space.Dir())
+	}
+	path, err := space.WriteFile("input", []byte("foobar"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "foobar" {
+		t.Fatalf("unexpected temporary file %q: %v", data, err)
+	}
+
+	_, err = NewTempSpace("test_", 50)
+	if errors.Cause(err) != ErrTempStorageFull {
+		t.Fatalf("expected the quota to be exceeded, got %v", err)
+	}
+	stats, err := GetTempStorageStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.MaxSize != 100 || stats.Reserved != 60 || stats.Used != 6 || stats.Spaces != 1 || stats.Rejected != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	err = space.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	space.Release()
+	if _, err := os.Stat(space.Dir()); !os.IsNotExist(err) {
+		t.Fatalf("expected the space to be removed, got %v", err)
+	}
+	space, err = NewTempSpace("test_", 100)
+	if err != nil {
+		t.Fatalf("expected the released space to be returned to the quota, got %v", err)
+	}
+	space.Release()
+	stats, err = GetTempStorageStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Reserved != 0 || stats.Spaces != 0 || stats.Used != 0 {
+		t.Fatalf("unexpected stats after release %+v", stats)
+	}
+
+	err = CleanupTempStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stats.Dir); !os.IsNotExist(err) {
+		t.Fatalf("expected the directory of the process to be removed, got %v", err)
+	}
+	// spaces reserved after a cleanup get a new directory
+	space, err = NewTempSpace("test_", 100)
+	if err != nil {
+		t.Fatalf("expected to reserve a space after cleanup, got %v", err)
+	}
+	space.Release()
+	err = CleanupTempStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ConfigureTempStorage(TempStorageConfig{MaxSize: -1})
+	if err == nil {
+		t.Fatal("expected a negative quota to fail")
+	}
+}
+
+func TestTempStorageRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autograph-tempstorage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, tempStorageRoot)
+
+	// the files of a crashed process, and of running processes,
+	// one of them with our pid like in another container
+	leftovers := map[string]bool{"1234-crashed": false, "1234-running": true, strconv.Itoa(os.Getpid()) + "-running": true}
+	for name, running := range leftovers {
+		err = os.MkdirAll(filepath.Join(root, name, "req"), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(root, name, "req", "input"), []byte("leftover"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if running {
+			lock, err := lockTempDir(filepath.Join(root, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lock.Close()
+		}
+	}
+
+	storage, err := newTempStorage(TempStorageConfig{Dir: dir}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.lock.Close()
+	for name, kept := range leftovers {
+		_, err := os.Stat(filepath.Join(root, name, "req"))
+		if kept != (err == nil) {
+			t.Fatalf("expected the files of %s to be kept: %t, got %v", name, kept, err)
+		}
+	}
+	if info, err := os.Stat(storage.dir); err != nil || !info.IsDir() {
+		t.Fatalf("expected the directory of the process to be created, got %v", err)
+	}
+	// the directory of the process is locked until it exits
+	if _, err := lockTempDir(storage.dir); err == nil {
+		t.Fatal("expected the directory of the process to be locked")
+	}
+}
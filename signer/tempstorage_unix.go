@@ -0,0 +1,33 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build linux || darwin || freebsd || openbsd || netbsd
+// +build linux darwin freebsd openbsd netbsd
+
+package signer
+
+import (
+	"os"
+	"syscall"
+)
+
+// tempDirLocking is whether temporary storage directories can be
+// locked on this platform
+const tempDirLocking = true
+
+// lockTempDir takes an exclusive lock of a temporary storage directory,
+// which is held until the returned file is closed or the process exits,
+// or returns an error when another process holds it
+func lockTempDir(dir string) (*os.File, error) {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(fd.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return fd, nil
+}
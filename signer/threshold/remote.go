@@ -0,0 +1,127 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package threshold
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/hawk"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+// remoteShareTimeout is how long a remote share can take to return a
+// partial signature
+const remoteShareTimeout = 30 * time.Second
+
+// remoteShare is a key share held by a signer of another autograph
+// instance, which returns partial signatures from its /sign/hash
+// endpoint
+type remoteShare struct {
+	shareID string
+	url     string
+	keyID   string
+	creds   *hawk.Credentials
+	pub     crypto.PublicKey
+	client  *http.Client
+}
+
+func newRemoteShare(shareConf signer.ThresholdShare) (*remoteShare, error) {
+	u, err := url.ParseRequestURI(shareConf.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid url")
+	}
+	u.Path = path.Join(u.Path, "sign", "hash")
+	if shareConf.KeyID == "" {
+		return nil, errors.New("missing keyid of remote share")
+	}
+	if shareConf.HawkID == "" || shareConf.HawkKey == "" {
+		return nil, errors.New("missing hawk credentials of remote share")
+	}
+	if shareConf.PublicKey == "" {
+		return nil, errors.New("missing public key of remote share")
+	}
+	pub, err := parsePublicKey(shareConf.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteShare{
+		shareID: shareConf.ID,
+		url:     u.String(),
+		keyID:   shareConf.KeyID,
+		creds: &hawk.Credentials{
+			ID:   shareConf.HawkID,
+			Key:  shareConf.HawkKey,
+			Hash: sha256.New,
+		},
+		pub:    pub,
+		client: &http.Client{Timeout: remoteShareTimeout},
+	}, nil
+}
+
+func (r *remoteShare) id() string                  { return r.shareID }
+func (r *remoteShare) publicKey() crypto.PublicKey { return r.pub }
+
+func (r *remoteShare) sign(ctx context.Context, digest []byte) ([]byte, error) {
+	body, err := json.Marshal([]formats.SignatureRequest{{
+		Input: base64.StdEncoding.EncodeToString(digest),
+		KeyID: r.keyID,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	auth := hawk.NewRequestAuth(req, r.creds, 0)
+	payloadhash := auth.PayloadHash("application/json")
+	payloadhash.Write(body)
+	auth.SetHash(payloadhash)
+	req.Header.Set("Authorization", auth.RequestHeader())
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, errors.Errorf("remote share returned status %d: %s", resp.StatusCode, msg)
+	}
+	var sigresps []formats.SignatureResponse
+	err = json.NewDecoder(resp.Body).Decode(&sigresps)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse remote share response")
+	}
+	if len(sigresps) != 1 {
+		return nil, errors.Errorf("remote share returned %d signatures, expected 1", len(sigresps))
+	}
+	return decodeSignature(sigresps[0].Signature)
+}
+
+// decodeSignature decodes a signature encoded with standard base64,
+// like genericrsa signatures, or URL safe base64, like content
+// signatures
+func decodeSignature(sig string) ([]byte, error) {
+	sig = strings.NewReplacer("-", "+", "_", "/").Replace(strings.TrimRight(sig, "="))
+	return base64.RawStdEncoding.DecodeString(sig)
+}
@@ -0,0 +1,516 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package threshold // import "go.mozilla.org/autograph/signer/threshold"
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+
+	// register the hashes
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"github.com/pkg/errors"
+
+	"go.mozilla.org/autograph/signer"
+)
+
+const (
+	// Type of this signer is "threshold"
+	Type = "threshold"
+)
+
+// share is a key that produces partial signatures
+type share interface {
+	id() string
+	publicKey() crypto.PublicKey
+	sign(ctx context.Context, digest []byte) ([]byte, error)
+}
+
+// ThresholdSigner signs hashes and data with k-of-n key shares. A
+// signature is the set of k valid partial signatures of the digest
+// collected from the first shares to answer.
+type ThresholdSigner struct {
+	signer.Configuration
+	signer.KeyZeroizer
+
+	required int
+	hash     crypto.Hash
+	shares   []share
+}
+
+// New initializes a threshold signer using a configuration
+func New(conf signer.Configuration) (s *ThresholdSigner, err error) {
+	s = new(ThresholdSigner)
+
+	if conf.Type != Type {
+		return nil, errors.Errorf("threshold: invalid type %q, must be %q", conf.Type, Type)
+	}
+	s.Type = conf.Type
+
+	if conf.ID == "" {
+		return nil, errors.New("threshold: missing signer ID in signer configuration")
+	}
+	s.ID = conf.ID
+
+	s.Hash = conf.Hash
+	if s.Hash == "" {
+		s.Hash = "sha256"
+	}
+	s.hash, err = getHash(s.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	tconf := conf.ThresholdConfig
+	if len(tconf.Shares) == 0 {
+		return nil, errors.New("threshold: missing key shares in signer configuration")
+	}
+	if tconf.Required < 1 || tconf.Required > len(tconf.Shares) {
+		return nil, errors.Errorf("threshold: required partial signatures must be between 1 and the %d shares, got %d", len(tconf.Shares), tconf.Required)
+	}
+	s.required = tconf.Required
+
+	ids := make(map[string]bool)
+	keys := make(map[string]string)
+	for _, shareConf := range tconf.Shares {
+		if shareConf.ID == "" {
+			return nil, errors.New("threshold: missing key share ID")
+		}
+		if ids[shareConf.ID] {
+			return nil, errors.Errorf("threshold: duplicate key share ID %q", shareConf.ID)
+		}
+		ids[shareConf.ID] = true
+
+		var sh share
+		if shareConf.URL != "" {
+			sh, err = newRemoteShare(shareConf)
+		} else {
+			sh, err = newLocalShare(conf, shareConf, s.hash)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "threshold: failed to initialize key share %q", shareConf.ID)
+		}
+		if local, ok := sh.(*localShare); ok {
+			s.ZeroizeAtExit(local.key)
+		}
+		der, err := x509.MarshalPKIXPublicKey(sh.publicKey())
+		if err != nil {
+			return nil, errors.Wrapf(err, "threshold: failed to marshal public key of share %q", shareConf.ID)
+		}
+		// a key used by two shares would count twice toward
+		// the threshold
+		if other, ok := keys[string(der)]; ok {
+			return nil, errors.Errorf("threshold: key shares %q and %q use the same key", other, shareConf.ID)
+		}
+		keys[string(der)] = shareConf.ID
+		s.shares = append(s.shares, sh)
+	}
+
+	s.PublicKey, err = s.publicKeySet().Marshal()
+	if err != nil {
+		return nil, errors.Wrap(err, "threshold: failed to marshal public key set")
+	}
+	return s, nil
+}
+
+// Config returns the configuration of the current signer
+func (s *ThresholdSigner) Config() signer.Configuration {
+	return signer.Configuration{
+		ID:        s.ID,
+		Type:      s.Type,
+		Hash:      s.Hash,
+		PublicKey: s.PublicKey,
+	}
+}
+
+// publicKeySet returns the public keys of the shares of the signer
+func (s *ThresholdSigner) publicKeySet() PublicKeySet {
+	set := PublicKeySet{Required: s.required, Hash: s.Hash}
+	for _, sh := range s.shares {
+		der, _ := x509.MarshalPKIXPublicKey(sh.publicKey())
+		set.Keys = append(set.Keys, SharePublicKey{ShareID: sh.id(), PublicKey: der})
+	}
+	return set
+}
+
+// SignData hashes data and returns a threshold signature of the hash
+func (s *ThresholdSigner) SignData(data []byte, options interface{}) (signer.Signature, error) {
+	return s.SignDataContext(context.Background(), data, options)
+}
+
+// SignDataContext hashes data and returns a threshold signature of
+// the hash, or the context error when ctx is done first
+func (s *ThresholdSigner) SignDataContext(ctx context.Context, data []byte, options interface{}) (signer.Signature, error) {
+	h := s.hash.New()
+	h.Write(data)
+	return s.SignHashContext(ctx, h.Sum(nil), options)
+}
+
+// SignHash returns a threshold signature of a hash
+func (s *ThresholdSigner) SignHash(digest []byte, options interface{}) (signer.Signature, error) {
+	return s.SignHashContext(context.Background(), digest, options)
+}
+
+// partialResult is the partial signature of a share, or its error
+type partialResult struct {
+	index int
+	sig   []byte
+	err   error
+}
+
+// SignHashContext requests a partial signature of a hash from every
+// share in parallel and returns as soon as the required number of
+// partial signatures are valid, canceling the other requests. It
+// returns ErrThresholdNotMet when too many shares failed to meet the
+// threshold, or the context error when ctx is done first.
+func (s *ThresholdSigner) SignHashContext(ctx context.Context, digest []byte, options interface{}) (signer.Signature, error) {
+	if len(digest) != s.hash.Size() {
+		return nil, errors.Wrapf(signer.ErrInvalidHashLength, "threshold: refusing to sign input hash. Got length %d, expected %d", len(digest), s.hash.Size())
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan partialResult, len(s.shares))
+	for i, sh := range s.shares {
+		go func(i int, sh share) {
+			sig, err := sh.sign(ctx, digest)
+			if err == nil {
+				err = verifyPartial(sh.publicKey(), s.hash, digest, sig)
+			}
+			results <- partialResult{index: i, sig: sig, err: err}
+		}(i, sh)
+	}
+
+	var (
+		partials []partialResult
+		failures []string
+	)
+	for range s.shares {
+		res := <-results
+		if res.err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", s.shares[res.index].id(), res.err))
+			if len(failures) > len(s.shares)-s.required {
+				break
+			}
+			continue
+		}
+		partials = append(partials, res)
+		if len(partials) == s.required {
+			break
+		}
+	}
+	if len(partials) < s.required {
+		if err := ctx.Err(); err != nil {
+			return nil, errors.Wrap(err, "threshold: signing aborted")
+		}
+		return nil, errors.Wrapf(signer.ErrThresholdNotMet, "threshold: got %d of %d required partial signatures (%s)",
+			len(partials), s.required, strings.Join(failures, "; "))
+	}
+	// order partial signatures like the shares in the configuration
+	sort.Slice(partials, func(i, j int) bool { return partials[i].index < partials[j].index })
+	sig := &Signature{Required: s.required}
+	for _, partial := range partials {
+		sig.Partials = append(sig.Partials, PartialSignature{
+			ShareID:   s.shares[partial.index].id(),
+			Signature: partial.sig,
+		})
+	}
+	return sig, nil
+}
+
+// Options are not implemented for this signer
+type Options struct {
+}
+
+// GetDefaultOptions returns default options of the signer
+func (s *ThresholdSigner) GetDefaultOptions() interface{} {
+	return Options{}
+}
+
+// PartialSignature is the signature of a digest by a key share. ECDSA
+// signatures are ASN.1 encoded and RSA signatures use PKCS#1 v1.5.
+type PartialSignature struct {
+	ShareID   string `json:"share"`
+	Signature []byte `json:"signature"`
+}
+
+// Signature is a threshold signature: the set of partial signatures
+// of the required number of distinct key shares
+type Signature struct {
+	Required int                `json:"required"`
+	Partials []PartialSignature `json:"signatures"`
+}
+
+// Marshal returns the base64 representation of the JSON encoding of a
+// threshold signature
+func (sig *Signature) Marshal() (string, error) {
+	data, err := json.Marshal(sig)
+	if err != nil {
+		return "", errors.Wrap(err, "threshold: failed to marshal signature")
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// Unmarshal decodes a base64 threshold signature
+func Unmarshal(sigstr string) (*Signature, error) {
+	data, err := base64.StdEncoding.DecodeString(sigstr)
+	if err != nil {
+		return nil, errors.Wrap(err, "threshold: failed to base64 decode signature")
+	}
+	sig := new(Signature)
+	err = json.Unmarshal(data, sig)
+	if err != nil {
+		return nil, errors.Wrap(err, "threshold: failed to parse signature")
+	}
+	return sig, nil
+}
+
+// SharePublicKey is the DER encoded PKIX public key of a key share
+type SharePublicKey struct {
+	ShareID   string `json:"share"`
+	PublicKey []byte `json:"publickey"`
+}
+
+// PublicKeySet is the public key of a threshold signer: the hash it
+// signs, the public keys of its shares and the number of partial
+// signatures a signature requires
+type PublicKeySet struct {
+	Required int              `json:"required"`
+	Hash     string           `json:"hash"`
+	Keys     []SharePublicKey `json:"keys"`
+}
+
+// Marshal returns the base64 representation of the JSON encoding of a
+// public key set
+func (set PublicKeySet) Marshal() (string, error) {
+	data, err := json.Marshal(set)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// ParsePublicKeySet decodes the base64 public key of a threshold signer
+func ParsePublicKeySet(pubkey string) (*PublicKeySet, error) {
+	data, err := base64.StdEncoding.DecodeString(pubkey)
+	if err != nil {
+		return nil, errors.Wrap(err, "threshold: failed to base64 decode public key set")
+	}
+	set := new(PublicKeySet)
+	err = json.Unmarshal(data, set)
+	if err != nil {
+		return nil, errors.Wrap(err, "threshold: failed to parse public key set")
+	}
+	return set, nil
+}
+
+// VerifySignature checks that a base64 threshold signature of a digest
+// has valid partial signatures from at least the required number of
+// distinct shares of a base64 public key set
+func VerifySignature(digest []byte, sigstr, pubkey string) error {
+	set, err := ParsePublicKeySet(pubkey)
+	if err != nil {
+		return err
+	}
+	if set.Required < 1 {
+		return errors.Errorf("threshold: invalid public key set requiring %d partial signatures", set.Required)
+	}
+	hash, err := getHash(set.Hash)
+	if err != nil {
+		return err
+	}
+	sig, err := Unmarshal(sigstr)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, key := range set.Keys {
+		keys[key.ShareID], err = x509.ParsePKIXPublicKey(key.PublicKey)
+		if err != nil {
+			return errors.Wrapf(err, "threshold: failed to parse public key of share %q", key.ShareID)
+		}
+	}
+	valid := make(map[string]bool)
+	for _, partial := range sig.Partials {
+		pub, ok := keys[partial.ShareID]
+		if !ok {
+			return errors.Errorf("threshold: signature has a partial signature of unknown share %q", partial.ShareID)
+		}
+		err = verifyPartial(pub, hash, digest, partial.Signature)
+		if err != nil {
+			return errors.Wrapf(err, "threshold: invalid partial signature of share %q", partial.ShareID)
+		}
+		valid[partial.ShareID] = true
+	}
+	if len(valid) < set.Required {
+		return errors.Errorf("threshold: signature has %d valid partial signatures of distinct shares, %d required", len(valid), set.Required)
+	}
+	return nil
+}
+
+// getHash returns the hash function of a signer hash name
+func getHash(name string) (crypto.Hash, error) {
+	switch name {
+	case "sha256":
+		return crypto.SHA256, nil
+	case "sha384":
+		return crypto.SHA384, nil
+	case "sha512":
+		return crypto.SHA512, nil
+	}
+	return 0, errors.Errorf("threshold: unsupported hash %q, must be sha256, sha384 or sha512", name)
+}
+
+// parsePublicKey parses a PEM or base64 DER encoded PKIX public key
+func parsePublicKey(pubkey string) (crypto.PublicKey, error) {
+	var der []byte
+	if block, _ := pem.Decode([]byte(pubkey)); block != nil {
+		der = block.Bytes
+	} else {
+		var err error
+		der, err = base64.StdEncoding.DecodeString(pubkey)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode public key")
+		}
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse public key")
+	}
+	switch pub.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+		return pub, nil
+	}
+	return nil, errors.Errorf("unsupported public key type %T, use ECDSA or RSA keys", pub)
+}
+
+// localShare is a key share whose private key is in the
+// configuration or the HSM
+type localShare struct {
+	shareID string
+	key     crypto.PrivateKey
+	pub     crypto.PublicKey
+	hash    crypto.Hash
+	rng     io.Reader
+}
+
+func newLocalShare(conf signer.Configuration, shareConf signer.ThresholdShare, hash crypto.Hash) (*localShare, error) {
+	if shareConf.PrivateKey == "" {
+		return nil, errors.New("missing private key or url")
+	}
+	// copy the signer configuration to look the key up in the
+	// same HSM
+	keyConf := conf
+	keyConf.PrivateKey = shareConf.PrivateKey
+	key, pub, _, err := keyConf.GetKeys()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get private key")
+	}
+	if shareConf.PublicKey != "" {
+		confPub, err := parsePublicKey(shareConf.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if !publicKeysEqual(pub, confPub) {
+			return nil, errors.New("public key does not match private key")
+		}
+	}
+	return &localShare{
+		shareID: shareConf.ID,
+		key:     key,
+		pub:     pub,
+		hash:    hash,
+		rng:     conf.GetRand(),
+	}, nil
+}
+
+func (l *localShare) id() string                  { return l.shareID }
+func (l *localShare) publicKey() crypto.PublicKey { return l.pub }
+
+func (l *localShare) sign(ctx context.Context, digest []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return signer.SignWithKey(l.key, l.rng, digest, l.hash)
+}
+
+// publicKeysEqual returns whether two ECDSA or RSA public keys are equal
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	switch a := a.(type) {
+	case *ecdsa.PublicKey:
+		b, ok := b.(*ecdsa.PublicKey)
+		return ok && a.Curve == b.Curve && a.X.Cmp(b.X) == 0 && a.Y.Cmp(b.Y) == 0
+	case *rsa.PublicKey:
+		b, ok := b.(*rsa.PublicKey)
+		return ok && a.E == b.E && a.N.Cmp(b.N) == 0
+	}
+	return false
+}
+
+// verifyPartial checks a partial signature of a digest. ECDSA partial
+// signatures can be ASN.1 encoded or the concatenation of r and s,
+// like content signatures.
+func verifyPartial(pub crypto.PublicKey, hash crypto.Hash, digest, sig []byte) error {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		r, s, err := parseECDSASignature(pub, sig)
+		if err != nil {
+			return err
+		}
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("ecdsa signature verification failed")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	}
+	return errors.Errorf("unsupported public key type %T", pub)
+}
+
+// parseECDSASignature returns the r and s values of an ASN.1 or
+// concatenated ECDSA signature
+func parseECDSASignature(pub *ecdsa.PublicKey, sig []byte) (r, s *big.Int, err error) {
+	var ecdsaSig struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(sig, &ecdsaSig)
+	if err == nil && len(rest) == 0 && ecdsaSig.R != nil && ecdsaSig.S != nil {
+		return ecdsaSig.R, ecdsaSig.S, nil
+	}
+	size := (pub.Params().BitSize + 7) / 8
+	if len(sig) != 2*size {
+		return nil, nil, errors.New("invalid ecdsa signature encoding")
+	}
+	return new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:]), nil
+}
+
+// VerifyData hashes data with the hash of a base64 public key set and
+// checks its threshold signature
+func VerifyData(data []byte, sigstr, pubkey string) error {
+	set, err := ParsePublicKeySet(pubkey)
+	if err != nil {
+		return err
+	}
+	hash, err := getHash(set.Hash)
+	if err != nil {
+		return err
+	}
+	h := hash.New()
+	h.Write(data)
+	return VerifySignature(h.Sum(nil), sigstr, pubkey)
+}
@@ -0,0 +1,314 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package threshold
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+func mustGenerateECDSAKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+func mustEncodePublicKey(t *testing.T, pub crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+// newRemoteShareServer returns a server that signs hashes like the
+// /sign/hash endpoint of autograph, with ECDSA signatures encoded like
+// content signatures, or fails with a 503 when down is 1
+func newRemoteShareServer(t *testing.T, key *ecdsa.PrivateKey, down *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sign/hash" || !strings.HasPrefix(r.Header.Get("Authorization"), "Hawk ") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if atomic.LoadInt32(down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var sigreqs []formats.SignatureRequest
+		err := json.NewDecoder(r.Body).Decode(&sigreqs)
+		if err != nil || len(sigreqs) != 1 || sigreqs[0].KeyID != "remote-share" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		digest, _ := base64.StdEncoding.DecodeString(sigreqs[0].Input)
+		rs, ss, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := concatenate(rs, ss)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode([]formats.SignatureResponse{{
+			Signature: base64.RawURLEncoding.EncodeToString(sig),
+		}})
+	}))
+}
+
+func TestThresholdSigning(t *testing.T) {
+	t.Parallel()
+
+	_, keyA := mustGenerateECDSAKey(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyB := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	remoteKey, _ := mustGenerateECDSAKey(t)
+	var remoteDown int32
+	srv := newRemoteShareServer(t, remoteKey, &remoteDown)
+	defer srv.Close()
+
+	s, err := New(signer.Configuration{
+		ID:   "threshold-test",
+		Type: Type,
+		ThresholdConfig: signer.ThresholdConfig{
+			Required: 2,
+			Shares: []signer.ThresholdShare{
+				{ID: "a", PrivateKey: keyA},
+				{ID: "b", PrivateKey: keyB, PublicKey: mustEncodePublicKey(t, rsaKey.Public())},
+				{
+					ID:        "remote",
+					URL:       srv.URL,
+					KeyID:     "remote-share",
+					HawkID:    "alice",
+					HawkKey:   "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu",
+					PublicKey: mustEncodePublicKey(t, remoteKey.Public()),
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if s.Config().Hash != "sha256" {
+		t.Fatalf("expected default hash sha256, got %q", s.Config().Hash)
+	}
+
+	input := []byte("threshold signed data")
+	digest := sha256.Sum256(input)
+	sig, err := s.SignData(input, s.GetDefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = VerifySignature(digest[:], sigstr, s.Config().PublicKey)
+	if err != nil {
+		t.Fatalf("failed to verify threshold signature: %v", err)
+	}
+	if len(sig.(*Signature).Partials) != 2 {
+		t.Fatalf("expected 2 partial signatures, got %d", len(sig.(*Signature).Partials))
+	}
+
+	// a tampered digest doesn't verify
+	digest[0] ^= 0xff
+	if VerifySignature(digest[:], sigstr, s.Config().PublicKey) == nil {
+		t.Fatal("expected signature of another digest to fail verification")
+	}
+	digest[0] ^= 0xff
+
+	// the threshold is met with one share down
+	atomic.StoreInt32(&remoteDown, 1)
+	sig, err = s.SignHash(digest[:], nil)
+	if err != nil {
+		t.Fatalf("failed to sign hash with a share down: %v", err)
+	}
+	partials := sig.(*Signature).Partials
+	if len(partials) != 2 || partials[0].ShareID != "a" || partials[1].ShareID != "b" {
+		t.Fatalf("unexpected partial signatures %+v", partials)
+	}
+
+	// but not when two shares are down
+	s.shares[0] = &localShare{shareID: "a", key: rsaKey, pub: s.shares[0].publicKey(), hash: crypto.SHA256, rng: rand.Reader}
+	_, err = s.SignHash(digest[:], nil)
+	if errors.Cause(err) != signer.ErrThresholdNotMet {
+		t.Fatalf("expected threshold not to be met, got %v", err)
+	}
+
+	_, err = s.SignHash(digest[:16], nil)
+	if errors.Cause(err) != signer.ErrInvalidHashLength {
+		t.Fatalf("expected invalid hash length error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.SignHashContext(ctx, digest[:], nil)
+	if errors.Cause(err) != context.Canceled {
+		t.Fatalf("expected canceled context error, got %v", err)
+	}
+}
+
+func TestVerifySignatureRequiresDistinctShares(t *testing.T) {
+	t.Parallel()
+
+	_, keyA := mustGenerateECDSAKey(t)
+	_, keyB := mustGenerateECDSAKey(t)
+	s, err := New(signer.Configuration{
+		ID:   "threshold-test",
+		Type: Type,
+		Hash: "sha384",
+		ThresholdConfig: signer.ThresholdConfig{
+			Required: 2,
+			Shares: []signer.ThresholdShare{
+				{ID: "a", PrivateKey: keyA},
+				{ID: "b", PrivateKey: keyB},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	digest := make([]byte, 48)
+	sig, err := s.SignHash(digest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsig := sig.(*Signature)
+	tsig.Partials[1] = tsig.Partials[0]
+	sigstr, err := tsig.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if VerifySignature(digest, sigstr, s.Config().PublicKey) == nil {
+		t.Fatal("expected a signature with the partial signature of a single share to fail verification")
+	}
+	tsig.Partials = append(tsig.Partials, PartialSignature{ShareID: "c", Signature: tsig.Partials[0].Signature})
+	sigstr, err = tsig.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if VerifySignature(digest, sigstr, s.Config().PublicKey) == nil {
+		t.Fatal("expected a signature with the partial signature of an unknown share to fail verification")
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	t.Parallel()
+
+	_, keyA := mustGenerateECDSAKey(t)
+	_, keyB := mustGenerateECDSAKey(t)
+	remoteKey, _ := mustGenerateECDSAKey(t)
+	remote := signer.ThresholdShare{
+		ID:        "remote",
+		URL:       "https://autograph.example.net",
+		KeyID:     "share",
+		HawkID:    "alice",
+		HawkKey:   "secret",
+		PublicKey: mustEncodePublicKey(t, remoteKey.Public()),
+	}
+	remoteNoKey := remote
+	remoteNoKey.PublicKey = ""
+	remoteNoCreds := remote
+	remoteNoCreds.HawkKey = ""
+	otherKey, _ := mustGenerateECDSAKey(t)
+
+	for i, testcase := range []struct {
+		hash     string
+		required int
+		shares   []signer.ThresholdShare
+	}{
+		{"", 1, nil},
+		{"", 0, []signer.ThresholdShare{{ID: "a", PrivateKey: keyA}}},
+		{"", 2, []signer.ThresholdShare{{ID: "a", PrivateKey: keyA}}},
+		{"sha1", 1, []signer.ThresholdShare{{ID: "a", PrivateKey: keyA}}},
+		{"", 1, []signer.ThresholdShare{{ID: "a", PrivateKey: keyA}, {ID: "a", PrivateKey: keyB}}},
+		{"", 1, []signer.ThresholdShare{{ID: "a", PrivateKey: keyA}, {ID: "b", PrivateKey: keyA}}},
+		{"", 1, []signer.ThresholdShare{{ID: "a"}}},
+		{"", 1, []signer.ThresholdShare{{ID: "a", PrivateKey: keyA, PublicKey: mustEncodePublicKey(t, otherKey.Public())}}},
+		{"", 1, []signer.ThresholdShare{remoteNoKey}},
+		{"", 1, []signer.ThresholdShare{remoteNoCreds}},
+	} {
+		_, err := New(signer.Configuration{
+			ID:   "threshold-test",
+			Type: Type,
+			Hash: testcase.hash,
+			ThresholdConfig: signer.ThresholdConfig{
+				Required: testcase.required,
+				Shares:   testcase.shares,
+			},
+		})
+		if err == nil {
+			t.Fatalf("testcase %d: expected signer initialization to fail", i)
+		}
+	}
+}
+
+func TestParseECDSASignature(t *testing.T) {
+	t.Parallel()
+
+	key, _ := mustGenerateECDSAKey(t)
+	digest := sha256.Sum256([]byte("foo"))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	concatenated := concatenate(r, s)
+	for _, sig := range [][]byte{concatenated, mustMarshalASN1(t, r, s)} {
+		err = verifyPartial(&key.PublicKey, crypto.SHA256, digest[:], sig)
+		if err != nil {
+			t.Fatalf("failed to verify partial signature %x: %v", sig, err)
+		}
+	}
+	err = verifyPartial(&key.PublicKey, crypto.SHA256, digest[:], concatenated[:63])
+	if err == nil {
+		t.Fatal("expected a truncated signature to fail verification")
+	}
+}
+
+func mustMarshalASN1(t *testing.T, r, s *big.Int) []byte {
+	sig, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+// concatenate returns the concatenation of the 32 bytes big endian
+// encodings of r and s
+func concatenate(r, s *big.Int) []byte {
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+	return sig
+}
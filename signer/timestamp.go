@@ -0,0 +1,268 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
+)
+
+// OIDAttributeTimeStampToken is the unsigned attribute of a CMS
+// signer info holding an RFC 3161 timestamp of its signature
+var OIDAttributeTimeStampToken = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 14}
+
+var oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+
+const (
+	// defaultTimestampTimeout is how long a timestamp request
+	// waits for the TSA when TimestampConfig has no timeout
+	defaultTimestampTimeout = 10 * time.Second
+
+	// maxTimestampResponseSize is the maximum size of TSA responses
+	maxTimestampResponseSize = 1 << 20
+)
+
+// TimestampConfig is the RFC 3161 timestamp authority (TSA) that
+// countersigns the PKCS7 signatures of a signer, so they remain valid
+// after the signing certificate expires
+type TimestampConfig struct {
+	// URL is the HTTP endpoint of the TSA, like
+	// http://timestamp.digicert.com. Signatures are not
+	// timestamped when it is empty.
+	URL string `yaml:"url,omitempty"`
+
+	// Timeout is how long to wait for the TSA before failing the
+	// signature request. Defaults to 10s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// messageImprint is the hash of the data a timestamp covers
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+// timeStampReq is an RFC 3161 timestamp request
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional,default:false"`
+}
+
+// pkiStatusInfo is the status of an RFC 3161 timestamp response
+type pkiStatusInfo struct {
+	Status       int
+	StatusString []string       `asn1:"optional,utf8"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+// timeStampResp is an RFC 3161 timestamp response
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+// tstInfo holds the fields of the content of a timestamp token this
+// package checks
+type tstInfo struct {
+	MessageImprint messageImprint
+	GenTime        time.Time
+	Nonce          *big.Int
+}
+
+// parseTSTInfo parses the TSTInfo content of a timestamp token. Its
+// optional fields are walked by hand since encoding/asn1 can't tell
+// an absent accuracy from the next element.
+func parseTSTInfo(der []byte) (*tstInfo, error) {
+	var seq asn1.RawValue
+	_, err := asn1.Unmarshal(der, &seq)
+	if err != nil || seq.Tag != asn1.TagSequence {
+		return nil, errors.New("signer: invalid timestamp TSTInfo")
+	}
+	var (
+		info    tstInfo
+		version int
+		policy  asn1.ObjectIdentifier
+		serial  *big.Int
+		genTime asn1.RawValue
+	)
+	rest := seq.Bytes
+	for _, field := range []interface{}{&version, &policy, &info.MessageImprint, &serial, &genTime} {
+		rest, err = asn1.Unmarshal(rest, field)
+		if err != nil {
+			return nil, errors.Wrap(err, "signer: invalid timestamp TSTInfo")
+		}
+	}
+	info.GenTime, err = time.Parse("20060102150405Z0700", string(genTime.Bytes))
+	if err != nil {
+		// fractions of seconds are allowed in the generalized time
+		info.GenTime, err = time.Parse("20060102150405.999999999Z0700", string(genTime.Bytes))
+		if err != nil {
+			return nil, errors.Wrap(err, "signer: invalid timestamp generation time")
+		}
+	}
+	for len(rest) > 0 {
+		var field asn1.RawValue
+		rest, err = asn1.Unmarshal(rest, &field)
+		if err != nil {
+			return nil, errors.Wrap(err, "signer: invalid timestamp TSTInfo")
+		}
+		if field.Class == asn1.ClassUniversal && field.Tag == asn1.TagInteger {
+			info.Nonce = new(big.Int)
+			_, err = asn1.Unmarshal(field.FullBytes, &info.Nonce)
+			if err != nil {
+				return nil, errors.Wrap(err, "signer: invalid timestamp nonce")
+			}
+		}
+	}
+	return &info, nil
+}
+
+// RequestTimestamp requests an RFC 3161 timestamp of the SHA256 hash
+// of a signature from the TSA and returns the DER timestamp token
+// after checking it covers the signature
+func RequestTimestamp(ctx context.Context, conf TimestampConfig, signature []byte) ([]byte, error) {
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, errors.Wrap(err, "signer: failed to generate timestamp nonce")
+	}
+	digest := sha256.Sum256(signature)
+	req, err := asn1.Marshal(timeStampReq{
+		Version: 1,
+		MessageImprint: messageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+			HashedMessage: digest[:],
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "signer: failed to marshal timestamp request")
+	}
+	timeout := conf.Timeout
+	if timeout == 0 {
+		timeout = defaultTimestampTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	httpReq, err := http.NewRequest(http.MethodPost, conf.URL, bytes.NewReader(req))
+	if err != nil {
+		return nil, errors.Wrap(err, "signer: failed to make timestamp request")
+	}
+	httpReq.Header.Set("Content-Type", "application/timestamp-query")
+	resp, err := http.DefaultClient.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "signer: timestamp request failed")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxTimestampResponseSize))
+	if err != nil {
+		return nil, errors.Wrap(err, "signer: failed to read timestamp response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("signer: TSA returned status %d", resp.StatusCode)
+	}
+	var tsResp timeStampResp
+	_, err = asn1.Unmarshal(body, &tsResp)
+	if err != nil {
+		return nil, errors.Wrap(err, "signer: failed to parse timestamp response")
+	}
+	// 0 is granted and 1 granted with modifications
+	if tsResp.Status.Status > 1 || len(tsResp.TimeStampToken.FullBytes) == 0 {
+		return nil, errors.Errorf("signer: TSA rejected timestamp request with status %d %q",
+			tsResp.Status.Status, tsResp.Status.StatusString)
+	}
+	token := tsResp.TimeStampToken.FullBytes
+	info, err := verifyTimestampToken(token, signature, nil)
+	if err != nil {
+		return nil, err
+	}
+	if info.Nonce == nil || info.Nonce.Cmp(nonce) != 0 {
+		return nil, errors.New("signer: timestamp nonce does not match the request")
+	}
+	return token, nil
+}
+
+// verifyTimestampToken verifies a timestamp token is signed, with a
+// certificate chaining to roots when roots is not nil, and covers
+// the SHA256 hash of a signature
+func verifyTimestampToken(token, signature []byte, roots *x509.CertPool) (*tstInfo, error) {
+	p7, err := pkcs7.Parse(token)
+	if err != nil {
+		return nil, errors.Wrap(err, "signer: failed to parse timestamp token")
+	}
+	err = p7.VerifyWithChain(roots)
+	if err != nil {
+		return nil, errors.Wrap(err, "signer: failed to verify timestamp token")
+	}
+	info, err := parseTSTInfo(p7.Content)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(signature)
+	if !info.MessageImprint.HashAlgorithm.Algorithm.Equal(oidSHA256) || !bytes.Equal(info.MessageImprint.HashedMessage, digest[:]) {
+		return nil, errors.New("signer: timestamp does not cover the signature")
+	}
+	return info, nil
+}
+
+// TimestampPKCS7 requests a timestamp of the signature of each
+// signer of signed data and adds it to the unsigned attributes of the
+// signer. It must be called after adding the signers and before
+// finishing the signed data.
+func TimestampPKCS7(ctx context.Context, conf TimestampConfig, sd *pkcs7.SignedData) error {
+	signerInfos := sd.GetSignedData().SignerInfos
+	for i := range signerInfos {
+		token, err := RequestTimestamp(ctx, conf, signerInfos[i].EncryptedDigest)
+		if err != nil {
+			return err
+		}
+		err = signerInfos[i].SetUnauthenticatedAttributes([]pkcs7.Attribute{
+			{Type: OIDAttributeTimeStampToken, Value: asn1.RawValue{FullBytes: token}},
+		})
+		if err != nil {
+			return errors.Wrap(err, "signer: failed to add timestamp to signature")
+		}
+	}
+	return nil
+}
+
+// VerifyPKCS7Timestamps verifies the timestamps of the signers of a
+// PKCS7 signature cover their signatures, and returns the time of
+// each timestamp. Signers without a timestamp are skipped. When roots
+// is not nil, the timestamps must be signed by a TSA chaining to one
+// of the roots.
+func VerifyPKCS7Timestamps(p7 *pkcs7.PKCS7, roots *x509.CertPool) (times []time.Time, err error) {
+	for _, si := range p7.Signers {
+		for _, attr := range si.UnauthenticatedAttributes {
+			if !attr.Type.Equal(OIDAttributeTimeStampToken) {
+				continue
+			}
+			// the attribute value is a SET of one token
+			var token asn1.RawValue
+			_, err = asn1.Unmarshal(attr.Value.Bytes, &token)
+			if err != nil {
+				return nil, errors.Wrap(err, "signer: invalid timestamp attribute")
+			}
+			info, err := verifyTimestampToken(token.FullBytes, si.EncryptedDigest, roots)
+			if err != nil {
+				return nil, err
+			}
+			times = append(times, info.GenTime)
+		}
+	}
+	return times, nil
+}
@@ -0,0 +1,211 @@
+package signer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+)
+
+type testAccuracy struct {
+	Seconds int `asn1:"optional"`
+}
+
+type testTSTInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time `asn1:"generalized"`
+	Accuracy       testAccuracy
+	Nonce          *big.Int `asn1:"optional"`
+}
+
+// newTestTSA starts a TSA signing timestamps with a self-signed
+// certificate. When tamper is true, it timestamps another hash.
+func newTestTSA(t *testing.T, tamper bool) (*httptest.Server, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test tsa"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil || r.Header.Get("Content-Type") != "application/timestamp-query" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var req timeStampReq
+		_, err = asn1.Unmarshal(body, &req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if tamper {
+			req.MessageImprint.HashedMessage[0]++
+		}
+		info, err := asn1.Marshal(testTSTInfo{
+			Version:        1,
+			Policy:         asn1.ObjectIdentifier{1, 2, 3},
+			MessageImprint: req.MessageImprint,
+			SerialNumber:   big.NewInt(42),
+			GenTime:        time.Now().UTC().Truncate(time.Second),
+			Accuracy:       testAccuracy{Seconds: 1},
+			Nonce:          req.Nonce,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sd, err := pkcs7.NewSignedData(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := sd.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := asn1.Marshal(timeStampResp{TimeStampToken: asn1.RawValue{FullBytes: token}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Type", "application/timestamp-reply")
+		w.Write(resp)
+	}))
+	return ts, roots
+}
+
+func TestTimestampPKCS7(t *testing.T) {
+	t.Parallel()
+
+	tsa, tsaRoots := newTestTSA(t, false)
+	defer tsa.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := pkcs7.NewSignedData([]byte("foo bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().Add(-time.Second)
+	err = TimestampPKCS7(context.Background(), TimestampConfig{URL: tsa.URL}, sd)
+	if err != nil {
+		t.Fatalf("failed to timestamp signature: %v", err)
+	}
+	sig, err := sd.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p7, err := pkcs7.Parse(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p7.Verify()
+	if err != nil {
+		t.Fatalf("failed to verify timestamped signature: %v", err)
+	}
+	times, err := VerifyPKCS7Timestamps(p7, tsaRoots)
+	if err != nil {
+		t.Fatalf("failed to verify timestamp: %v", err)
+	}
+	if len(times) != 1 || times[0].Before(before.Truncate(time.Second)) || times[0].After(time.Now()) {
+		t.Fatalf("unexpected timestamp times %v", times)
+	}
+	_, err = VerifyPKCS7Timestamps(p7, x509.NewCertPool())
+	if err == nil {
+		t.Fatal("expected timestamp verification with other roots to fail")
+	}
+	p7.Signers[0].EncryptedDigest[0]++
+	_, err = VerifyPKCS7Timestamps(p7, tsaRoots)
+	if err == nil || !strings.Contains(err.Error(), "does not cover") {
+		t.Fatalf("expected timestamp of another signature to fail verification, got %v", err)
+	}
+}
+
+func TestRequestTimestampFailures(t *testing.T) {
+	t.Parallel()
+
+	tampering, _ := newTestTSA(t, true)
+	defer tampering.Close()
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, _ := asn1.Marshal(timeStampResp{Status: pkiStatusInfo{Status: 2}})
+		w.Write(resp)
+	}))
+	defer rejecting.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}))
+	defer hanging.Close()
+
+	for i, tc := range []struct {
+		conf TimestampConfig
+		err  string
+	}{
+		{TimestampConfig{URL: tampering.URL}, "does not cover the signature"},
+		{TimestampConfig{URL: rejecting.URL}, "rejected timestamp request with status 2"},
+		{TimestampConfig{URL: failing.URL}, "TSA returned status 503"},
+		{TimestampConfig{URL: hanging.URL, Timeout: 10 * time.Millisecond}, "timestamp request failed"},
+	} {
+		_, err := RequestTimestamp(context.Background(), tc.conf, []byte("signature"))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Fatalf("testcase %d: expected error containing %q, got %v", i, tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package signer
+
+// WebCryptoAlgorithm holds the parameters of the browser WebCrypto API
+// to import the public key of a signature with, in its importKey "spki"
+// format, and to verify the signature with
+type WebCryptoAlgorithm struct {
+	// Name is the algorithm name, like "ECDSA"
+	Name string `json:"name"`
+
+	// NamedCurve is the curve of the key, like "P-384"
+	NamedCurve string `json:"namedCurve"`
+
+	// Hash is the digest algorithm of the signature, like "SHA-384"
+	Hash string `json:"hash"`
+}
+
+// WebCryptoEncoding is a signature in the format the verify function of
+// the browser WebCrypto API takes. WebCrypto hashes the data itself, so
+// clients verify the signature on DataPrefix followed by the data.
+type WebCryptoEncoding struct {
+	// Signature is the raw signature, like the r||s concatenation
+	// of an ECDSA signature
+	Signature []byte
+
+	Algorithm WebCryptoAlgorithm
+
+	// DataPrefix is the template the signer prepends to the data
+	// before signing it
+	DataPrefix []byte
+}
+
+// WebCryptoSignature is an interface to a signature that can be encoded
+// for the browser WebCrypto API
+type WebCryptoSignature interface {
+	WebCrypto() (*WebCryptoEncoding, error)
+}
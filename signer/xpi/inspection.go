@@ -0,0 +1,388 @@
+package xpi
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/signer"
+)
+
+// webExtensionManifestPath is the path of the manifest in the ZIP
+// of a WebExtension
+const webExtensionManifestPath = "manifest.json"
+
+// AddOnManifest holds the fields of a WebExtension manifest.json that
+// inspection hooks look at
+type AddOnManifest struct {
+	// ID is the gecko add-on ID set in browser_specific_settings,
+	// or in the deprecated applications key
+	ID string
+
+	// Version is the version of the add-on
+	Version string
+}
+
+// Inspection describes an XPI about to be signed
+type Inspection struct {
+	// SignerID is the ID of the signer
+	SignerID string
+
+	// CN is the common name of the end-entity certificate, which
+	// is the add-on ID requested by the client
+	CN string
+
+	// Manifest is the parsed manifest.json of the XPI, or nil when
+	// the XPI doesn't have one, like legacy or system add-ons
+	Manifest *AddOnManifest
+}
+
+// AddOnID returns the add-on ID of the manifest, or the CN when the
+// manifest does not set one
+func (i Inspection) AddOnID() string {
+	if i.Manifest != nil && i.Manifest.ID != "" {
+		return i.Manifest.ID
+	}
+	return i.CN
+}
+
+// An InspectionHook looks at an XPI before it is signed and returns an
+// error to refuse signing it
+type InspectionHook func(ctx context.Context, i Inspection) error
+
+// AddInspectionHook adds a hook run before each file signature, after
+// the hooks configured in the signer inspection config
+func (s *XPISigner) AddInspectionHook(hook InspectionHook) {
+	s.inspectionHooks = append(s.inspectionHooks, hook)
+}
+
+type allowedIDsContextKey struct{}
+
+// WithAllowedIDs returns a context that limits the add-on IDs XPI
+// signers sign to the ones matching patterns, like the IDs the
+// credential of a request is allowed to sign
+func WithAllowedIDs(ctx context.Context, patterns []string) context.Context {
+	return context.WithValue(ctx, allowedIDsContextKey{}, patterns)
+}
+
+// AllowedIDsFromContext returns the patterns set with WithAllowedIDs
+func AllowedIDsFromContext(ctx context.Context) []string {
+	patterns, _ := ctx.Value(allowedIDsContextKey{}).([]string)
+	return patterns
+}
+
+// ValidateIDPatterns returns an error when an add-on ID pattern is
+// malformed
+func ValidateIDPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "xpi: invalid add-on ID pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// matchesIDPatterns returns true when an add-on ID matches one of the
+// patterns
+func matchesIDPatterns(id string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAllowedIDs returns an error when an add-on ID doesn't match the
+// allowlist of the signer or of the context. Empty IDs are skipped.
+func (s *XPISigner) checkAllowedIDs(ctx context.Context, ids ...string) error {
+	for _, patterns := range [][]string{s.InspectionConfig.AllowedIDs, AllowedIDsFromContext(ctx)} {
+		if len(patterns) == 0 {
+			continue
+		}
+		for _, id := range ids {
+			if id != "" && !matchesIDPatterns(id, patterns) {
+				return errors.Errorf("add-on ID %q is not allowed", id)
+			}
+		}
+	}
+	return nil
+}
+
+// parseAddOnManifest returns the manifest.json of an XPI, or nil when
+// it doesn't have one
+func parseAddOnManifest(input []byte) (*AddOnManifest, error) {
+	data, err := readFileFromZIP(input, webExtensionManifestPath)
+	if err != nil {
+		// readFileFromZIP doesn't distinguish a missing file
+		// from an unreadable ZIP, so check the ZIP is valid
+		if _, zerr := readXPIContentsToMap(input); zerr != nil {
+			return nil, zerr
+		}
+		return nil, nil
+	}
+	var raw struct {
+		Version                 string `json:"version"`
+		BrowserSpecificSettings struct {
+			Gecko struct {
+				ID string `json:"id"`
+			} `json:"gecko"`
+		} `json:"browser_specific_settings"`
+		Applications struct {
+			Gecko struct {
+				ID string `json:"id"`
+			} `json:"gecko"`
+		} `json:"applications"`
+	}
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse manifest.json")
+	}
+	m := &AddOnManifest{
+		ID:      raw.BrowserSpecificSettings.Gecko.ID,
+		Version: raw.Version,
+	}
+	if m.ID == "" {
+		m.ID = raw.Applications.Gecko.ID
+	}
+	return m, nil
+}
+
+// inspect checks the add-on IDs of an XPI against the allowlists and
+// runs the inspection hooks of the signer on it. Errors are wrapped in
+// signer.ErrInputRejected.
+func (s *XPISigner) inspect(ctx context.Context, cn string, input []byte) (*Inspection, error) {
+	if len(s.inspectionHooks) == 0 && len(s.InspectionConfig.AllowedIDs) == 0 && len(AllowedIDsFromContext(ctx)) == 0 {
+		return nil, nil
+	}
+	manifest, err := parseAddOnManifest(input)
+	if err != nil {
+		return nil, errors.Wrapf(signer.ErrInputRejected, "xpi: %v", err)
+	}
+	i := &Inspection{
+		SignerID: s.ID,
+		CN:       cn,
+		Manifest: manifest,
+	}
+	hooks := append([]InspectionHook{s.allowedIDsHook}, s.inspectionHooks...)
+	for _, hook := range hooks {
+		err = hook(ctx, *i)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"signer_id": s.ID,
+				"addon_id":  i.AddOnID(),
+			}).Warnf("xpi: inspection rejected add-on: %v", err)
+			return nil, errors.Wrapf(signer.ErrInputRejected, "xpi: %v", err)
+		}
+	}
+	return i, nil
+}
+
+// allowedIDsHook rejects add-ons whose requested or manifest ID is not
+// allowed
+func (s *XPISigner) allowedIDsHook(ctx context.Context, i Inspection) error {
+	if i.Manifest != nil {
+		return s.checkAllowedIDs(ctx, i.CN, i.Manifest.ID)
+	}
+	return s.checkAllowedIDs(ctx, i.CN)
+}
+
+// blockedIDsHook returns a hook that rejects add-ons whose requested
+// or manifest ID is blocked
+func blockedIDsHook(ids []string) InspectionHook {
+	blocked := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		blocked[id] = true
+	}
+	return func(ctx context.Context, i Inspection) error {
+		if blocked[i.CN] {
+			return errors.Errorf("add-on ID %q is blocked", i.CN)
+		}
+		if i.Manifest != nil && blocked[i.Manifest.ID] {
+			return errors.Errorf("add-on ID %q is blocked", i.Manifest.ID)
+		}
+		return nil
+	}
+}
+
+// addOnVersionStore records the highest version of each add-on ID
+// signed by a signer. It is implemented by the database handler.
+type addOnVersionStore interface {
+	GetSignedAddOnVersion(ctx context.Context, signerID, addonID string) (string, error)
+	SetSignedAddOnVersion(ctx context.Context, signerID, addonID, version string) error
+}
+
+// versionRegressionHook returns a hook that rejects add-ons whose
+// version is lower than the highest version previously signed. Signing
+// the same version again is allowed, so clients can retry.
+func versionRegressionHook(store addOnVersionStore) InspectionHook {
+	return func(ctx context.Context, i Inspection) error {
+		if i.Manifest == nil || i.Manifest.Version == "" {
+			return nil
+		}
+		signed, err := store.GetSignedAddOnVersion(ctx, i.SignerID, i.AddOnID())
+		if err == database.ErrAddOnVersionNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if CompareVersions(i.Manifest.Version, signed) < 0 {
+			return errors.Errorf("version %q of add-on %q is lower than signed version %q",
+				i.Manifest.Version, i.AddOnID(), signed)
+		}
+		return nil
+	}
+}
+
+// recordSignedVersion stores the version of a signed add-on when it is
+// higher than the highest version previously signed. Failures are
+// logged and don't fail the signature.
+func (s *XPISigner) recordSignedVersion(ctx context.Context, i *Inspection) {
+	if s.versions == nil || i == nil || i.Manifest == nil || i.Manifest.Version == "" {
+		return
+	}
+	signed, err := s.versions.GetSignedAddOnVersion(ctx, s.ID, i.AddOnID())
+	if err != nil && err != database.ErrAddOnVersionNotFound {
+		log.Errorf("xpi: failed to get signed version of add-on %q: %v", i.AddOnID(), err)
+		return
+	}
+	if err == nil && CompareVersions(i.Manifest.Version, signed) <= 0 {
+		return
+	}
+	err = s.versions.SetSignedAddOnVersion(ctx, s.ID, i.AddOnID(), i.Manifest.Version)
+	if err != nil {
+		log.Errorf("xpi: failed to record signed version of add-on %q: %v", i.AddOnID(), err)
+	}
+}
+
+// initInspection sets up the inspection hooks of an inspection config
+func (s *XPISigner) initInspection(conf signer.Configuration) error {
+	err := ValidateIDPatterns(conf.InspectionConfig.AllowedIDs)
+	if err != nil {
+		return err
+	}
+	s.InspectionConfig = conf.InspectionConfig
+	if len(conf.InspectionConfig.BlockedIDs) > 0 {
+		s.AddInspectionHook(blockedIDsHook(conf.InspectionConfig.BlockedIDs))
+	}
+	if conf.InspectionConfig.PreventVersionRegression {
+		if conf.DB == nil {
+			return errors.New("xpi: preventing version regressions requires a database")
+		}
+		s.versions = conf.DB
+		s.AddInspectionHook(versionRegressionHook(s.versions))
+	}
+	return nil
+}
+
+// CompareVersions compares two add-on versions using the Firefox
+// toolkit version format, and returns -1, 0 or 1 when a is lower,
+// equal or greater than b.
+//
+// Versions are dot separated parts, and each part is made of up to
+// four optional components: a number, a string, a number and a string,
+// like "1", "2b3" or "3pre1a". Numbers compare as integers and missing
+// numbers are zero. Strings compare byte-wise, and a missing string is
+// greater than any string, so "1.0a1" is lower than "1.0". Missing
+// parts are treated as "0", so "1" and "1.0.0" are equal.
+func CompareVersions(a, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for len(aParts) < len(bParts) {
+		aParts = append(aParts, "0")
+	}
+	for len(bParts) < len(aParts) {
+		bParts = append(bParts, "0")
+	}
+	for i := range aParts {
+		if c := compareVersionParts(parseVersionPart(aParts[i]), parseVersionPart(bParts[i])); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// versionPart is the number-string-number-string form of a version part
+type versionPart struct {
+	numA int64
+	strB string
+	numC int64
+	strD string
+}
+
+// parseVersionPart splits a part of a toolkit version in its components
+func parseVersionPart(part string) (p versionPart) {
+	p.numA, part = parseVersionNumber(part)
+	p.strB, part = parseVersionString(part)
+	p.numC, part = parseVersionNumber(part)
+	p.strD = part
+	return
+}
+
+// parseVersionNumber returns the number at the start of s and the rest
+// of s
+func parseVersionNumber(s string) (int64, string) {
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	n, err := strconv.ParseInt(s[:end], 10, 64)
+	if err != nil {
+		// empty or too long to parse
+		n = 0
+	}
+	return n, s[end:]
+}
+
+// parseVersionString returns the string at the start of s, up to the
+// next digit, and the rest of s
+func parseVersionString(s string) (string, string) {
+	end := 0
+	for end < len(s) && (s[end] < '0' || s[end] > '9') {
+		end++
+	}
+	return s[:end], s[end:]
+}
+
+func compareVersionParts(a, b versionPart) int {
+	if c := compareInt64(a.numA, b.numA); c != 0 {
+		return c
+	}
+	if c := compareVersionStrings(a.strB, b.strB); c != 0 {
+		return c
+	}
+	if c := compareInt64(a.numC, b.numC); c != 0 {
+		return c
+	}
+	return compareVersionStrings(a.strD, b.strD)
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareVersionStrings compares version strings where a missing
+// string is greater than any other
+func compareVersionStrings(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return 1
+	case b == "":
+		return -1
+	}
+	return strings.Compare(a, b)
+}
@@ -0,0 +1,264 @@
+package xpi
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/signer"
+)
+
+func TestCompareVersions(t *testing.T) {
+	t.Parallel()
+
+	var testcases = []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"1", "1.0.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"2.0", "1.99.99", 1},
+		{"1.0a1", "1.0", -1},
+		{"1.0a1", "1.0a2", -1},
+		{"1.0a2", "1.0b1", -1},
+		{"1.0b1", "1.0", -1},
+		{"1.0pre1", "1.0pre2", -1},
+		{"1.0.1", "1.0", 1},
+		{"1.0", "1.0.0.1", -1},
+	}
+	for i, testcase := range testcases {
+		if c := CompareVersions(testcase.a, testcase.b); c != testcase.expected {
+			t.Errorf("testcase %d: CompareVersions(%q, %q) = %d, expected %d", i, testcase.a, testcase.b, c, testcase.expected)
+		}
+		if c := CompareVersions(testcase.b, testcase.a); c != -testcase.expected {
+			t.Errorf("testcase %d: CompareVersions(%q, %q) = %d, expected %d", i, testcase.b, testcase.a, c, -testcase.expected)
+		}
+	}
+}
+
+func mustPackWebExtension(t *testing.T, manifest string) []byte {
+	return mustPackJAR(t, []Metafile{
+		{Name: "manifest.json", Body: []byte(manifest)},
+		{Name: "background.js", Body: []byte("console.log('hello')")},
+	})
+}
+
+func TestParseAddOnManifest(t *testing.T) {
+	t.Parallel()
+
+	m, err := parseAddOnManifest(mustPackWebExtension(t, `{"version": "1.2", "browser_specific_settings": {"gecko": {"id": "a@example.com"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != "a@example.com" || m.Version != "1.2" {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+
+	m, err = parseAddOnManifest(mustPackWebExtension(t, `{"version": "3", "applications": {"gecko": {"id": "b@example.com"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != "b@example.com" || m.Version != "3" {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+
+	m, err = parseAddOnManifest(mustPackJAR(t, []Metafile{{Name: "install.rdf", Body: []byte("<RDF/>")}}))
+	if err != nil || m != nil {
+		t.Fatalf("expected no manifest and no error, got %+v and %v", m, err)
+	}
+
+	_, err = parseAddOnManifest(mustPackWebExtension(t, `{"version": `))
+	if err == nil {
+		t.Fatal("expected an error parsing an invalid manifest")
+	}
+
+	_, err = parseAddOnManifest([]byte("not a zip"))
+	if err == nil {
+		t.Fatal("expected an error parsing an invalid ZIP")
+	}
+}
+
+type memoryVersionStore map[string]string
+
+func (m memoryVersionStore) GetSignedAddOnVersion(ctx context.Context, signerID, addonID string) (string, error) {
+	v, ok := m[signerID+"/"+addonID]
+	if !ok {
+		return "", database.ErrAddOnVersionNotFound
+	}
+	return v, nil
+}
+
+func (m memoryVersionStore) SetSignedAddOnVersion(ctx context.Context, signerID, addonID, version string) error {
+	m[signerID+"/"+addonID] = version
+	return nil
+}
+
+func TestInspectionBlockedIDs(t *testing.T) {
+	t.Parallel()
+
+	testcase := PASSINGTESTCASES[0]
+	testcase.InspectionConfig = signer.InspectionConfig{
+		BlockedIDs: []string{"blocked@example.com"},
+	}
+	s, err := New(testcase, nil)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+
+	// blocked through the requested ID
+	input := mustPackWebExtension(t, `{"version": "1.0"}`)
+	_, err = s.SignFile(input, Options{ID: "blocked@example.com", PKCS7Digest: "SHA256"})
+	if errors.Cause(err) != signer.ErrInputRejected {
+		t.Fatalf("expected input to be rejected, got %v", err)
+	}
+
+	// blocked through the manifest ID
+	input = mustPackWebExtension(t, `{"version": "1.0", "browser_specific_settings": {"gecko": {"id": "blocked@example.com"}}}`)
+	_, err = s.SignFile(input, Options{ID: "other@example.com", PKCS7Digest: "SHA256"})
+	if errors.Cause(err) != signer.ErrInputRejected {
+		t.Fatalf("expected input to be rejected, got %v", err)
+	}
+
+	_, err = s.SignFile(mustPackWebExtension(t, `{"version": "1.0"}`), Options{ID: "allowed@example.com", PKCS7Digest: "SHA256"})
+	if err != nil {
+		t.Fatalf("failed to sign allowed add-on: %v", err)
+	}
+}
+
+func TestInspectionVersionRegression(t *testing.T) {
+	t.Parallel()
+
+	testcase := PASSINGTESTCASES[0]
+	testcase.InspectionConfig = signer.InspectionConfig{
+		PreventVersionRegression: true,
+	}
+	_, err := New(testcase, nil)
+	if err == nil {
+		t.Fatal("expected signer initialization to fail without a database")
+	}
+
+	testcase.InspectionConfig = signer.InspectionConfig{}
+	s, err := New(testcase, nil)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	store := memoryVersionStore{}
+	s.versions = store
+	s.AddInspectionHook(versionRegressionHook(store))
+
+	manifest := `{"version": "%s", "browser_specific_settings": {"gecko": {"id": "addon@example.com"}}}`
+	opts := Options{ID: "addon@example.com", PKCS7Digest: "SHA256"}
+	for i, testcase := range []struct {
+		version  string
+		rejected bool
+		recorded string
+	}{
+		{"1.0", false, "1.0"},
+		{"1.1", false, "1.1"},
+		{"1.1", false, "1.1"},
+		{"1.0.9", true, "1.1"},
+		{"1.1b1", true, "1.1"},
+		{"2.0", false, "2.0"},
+	} {
+		_, err = s.SignFile(mustPackWebExtension(t, fmt.Sprintf(manifest, testcase.version)), opts)
+		if testcase.rejected && errors.Cause(err) != signer.ErrInputRejected {
+			t.Fatalf("testcase %d: expected version %q to be rejected, got %v", i, testcase.version, err)
+		}
+		if !testcase.rejected && err != nil {
+			t.Fatalf("testcase %d: failed to sign version %q: %v", i, testcase.version, err)
+		}
+		if store[s.ID+"/addon@example.com"] != testcase.recorded {
+			t.Fatalf("testcase %d: expected recorded version %q, got %q", i, testcase.recorded, store[s.ID+"/addon@example.com"])
+		}
+	}
+}
+
+func TestInspectionCustomHook(t *testing.T) {
+	t.Parallel()
+
+	s, err := New(PASSINGTESTCASES[0], nil)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	var inspected Inspection
+	s.AddInspectionHook(func(ctx context.Context, i Inspection) error {
+		inspected = i
+		if i.Manifest != nil && i.Manifest.Version == "6.6.6" {
+			return errors.New("unlucky version")
+		}
+		return nil
+	})
+	_, err = s.SignFile(mustPackWebExtension(t, `{"version": "1.0"}`), Options{ID: "hook@example.com", PKCS7Digest: "SHA256"})
+	if err != nil {
+		t.Fatalf("failed to sign add-on: %v", err)
+	}
+	if inspected.SignerID != s.ID || inspected.CN != "hook@example.com" || inspected.AddOnID() != "hook@example.com" {
+		t.Fatalf("unexpected inspection %+v", inspected)
+	}
+	_, err = s.SignFile(mustPackWebExtension(t, `{"version": "6.6.6"}`), Options{ID: "hook@example.com", PKCS7Digest: "SHA256"})
+	if errors.Cause(err) != signer.ErrInputRejected {
+		t.Fatalf("expected input to be rejected, got %v", err)
+	}
+}
+
+func TestInspectionAllowedIDs(t *testing.T) {
+	t.Parallel()
+
+	testcase := PASSINGTESTCASES[0]
+	testcase.InspectionConfig = signer.InspectionConfig{
+		AllowedIDs: []string{"[bad"},
+	}
+	_, err := New(testcase, nil)
+	if err == nil {
+		t.Fatal("expected signer initialization to fail with an invalid pattern")
+	}
+
+	testcase.InspectionConfig = signer.InspectionConfig{
+		AllowedIDs: []string{"*@mozilla.org", "{*}"},
+	}
+	s, err := New(testcase, nil)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	ctx := context.Background()
+	withGecko := `{"version": "1.0", "browser_specific_settings": {"gecko": {"id": "%s"}}}`
+	for i, testcase := range []struct {
+		ctx      context.Context
+		cn       string
+		manifest string
+		rejected bool
+	}{
+		{ctx, "a@mozilla.org", `{"version": "1.0"}`, false},
+		{ctx, "{5b3b5a9e-6c2b-4b5a-8e8b-1b1b1b1b1b1b}", `{"version": "1.0"}`, false},
+		{ctx, "a@example.com", `{"version": "1.0"}`, true},
+		// the manifest ID must match too
+		{ctx, "a@mozilla.org", fmt.Sprintf(withGecko, "a@example.com"), true},
+		{ctx, "a@mozilla.org", fmt.Sprintf(withGecko, "b@mozilla.org"), false},
+		// the context allowlist applies on top of the signer one
+		{WithAllowedIDs(ctx, []string{"a@*"}), "a@mozilla.org", `{"version": "1.0"}`, false},
+		{WithAllowedIDs(ctx, []string{"a@*"}), "b@mozilla.org", `{"version": "1.0"}`, true},
+		{WithAllowedIDs(ctx, []string{"a@*"}), "a@example.com", `{"version": "1.0"}`, true},
+	} {
+		opts := Options{ID: testcase.cn, PKCS7Digest: "SHA256"}
+		_, err = s.SignFileContext(testcase.ctx, mustPackWebExtension(t, testcase.manifest), opts)
+		if testcase.rejected && errors.Cause(err) != signer.ErrInputRejected {
+			t.Fatalf("testcase %d: expected file to be rejected, got %v", i, err)
+		}
+		if !testcase.rejected && err != nil {
+			t.Fatalf("testcase %d: failed to sign file: %v", i, err)
+		}
+
+		_, err = s.SignDataContext(testcase.ctx, []byte("Signature-Version: 1.0\n"), Options{ID: testcase.cn})
+		cnRejected := testcase.rejected && testcase.manifest == `{"version": "1.0"}`
+		if cnRejected && errors.Cause(err) != signer.ErrInputRejected {
+			t.Fatalf("testcase %d: expected data to be rejected, got %v", i, err)
+		}
+		if !cnRejected && err != nil {
+			t.Fatalf("testcase %d: failed to sign data: %v", i, err)
+		}
+	}
+}
@@ -13,6 +13,8 @@ import (
 	"io/ioutil"
 	"strings"
 	"unicode/utf8"
+
+	"go.mozilla.org/autograph/signer"
 )
 
 // consts and vars for formatFilename
@@ -124,6 +126,7 @@ func makeJARManifest(input []byte) (manifest []byte, err error) {
 	mw := bytes.NewBuffer(manifest)
 	manifest = []byte(fmt.Sprintf("Manifest-Version: 1.0\n\n"))
 
+	var files []*zip.File
 	for _, f := range r.File {
 		if isJARSignatureFile(f.Name) || isCOSESignatureFile(f.Name) {
 			// reserved signature files do not get included in the manifest
@@ -133,28 +136,22 @@ func makeJARManifest(input []byte) (manifest []byte, err error) {
 			// directories do not get included
 			continue
 		}
-		rc, err := f.Open()
-		if err != nil {
-			return manifest, err
-		}
-		data, err := ioutil.ReadAll(rc)
-		if err != nil {
-			return manifest, err
-		}
-
+		files = append(files, f)
+	}
+	// hash the files concurrently, add-ons can have thousands of them
+	digests, err := signer.DigestZIPFiles(files, 0)
+	if err != nil {
+		return manifest, err
+	}
+	for i, f := range files {
 		filename, err := formatFilename([]byte(f.Name))
 		if err != nil {
 			return manifest, err
 		}
-		h1 := sha1.New()
-		h1.Write(data)
-		h2 := sha256.New()
-		h2.Write(data)
-
 		fmt.Fprintf(mw, "Name: %s\nDigest-Algorithms: SHA1 SHA256\nSHA1-Digest: %s\nSHA256-Digest: %s\n\n",
 			filename,
-			base64.StdEncoding.EncodeToString(h1.Sum(nil)),
-			base64.StdEncoding.EncodeToString(h2.Sum(nil)))
+			base64.StdEncoding.EncodeToString(digests[i].SHA1),
+			base64.StdEncoding.EncodeToString(digests[i].SHA256))
 	}
 	manifestBody := mw.Bytes()
 	manifest = append(manifest, manifestBody...)
@@ -192,6 +189,17 @@ func (m *Metafile) IsNameValid() bool {
 
 // repackJARWithMetafiles inserts metafiles in the input JAR file and returns a JAR ZIP archive
 func repackJARWithMetafiles(input []byte, metafiles []Metafile) (output []byte, err error) {
+	return repackJARWithHeaders(input, metafiles, false)
+}
+
+// repackJARPreservingHeaders is like repackJARWithMetafiles but keeps
+// the compression method and modification time of each entry, which
+// repackJARWithMetafiles resets, in the order of the input
+func repackJARPreservingHeaders(input []byte, metafiles []Metafile) (output []byte, err error) {
+	return repackJARWithHeaders(input, metafiles, true)
+}
+
+func repackJARWithHeaders(input []byte, metafiles []Metafile, preserveHeaders bool) (output []byte, err error) {
 	for _, f := range metafiles {
 		if !f.IsNameValid() {
 			err = errors.Errorf("Cannot pack metafile with invalid path %q", f.Name)
@@ -233,6 +241,10 @@ func repackJARWithMetafiles(input []byte, metafiles []Metafile) (output []byte,
 			Name:   f.Name,
 			Method: zip.Deflate,
 		}
+		if preserveHeaders {
+			fwhead.Method = f.Method
+			fwhead.Modified = f.Modified
+		}
 		// insert the file into the archive
 		fw, err = w.CreateHeader(fwhead)
 		if err != nil {
@@ -418,9 +430,12 @@ func removeFileFromZIP(input []byte, filepath string) (output []byte, err error)
 		if err != nil {
 			return
 		}
+		// keep the headers for the signers that preserve them
+		// when repacking the JAR
 		fwhead := &zip.FileHeader{
-			Name:   f.Name,
-			Method: zip.Deflate,
+			Name:     f.Name,
+			Method:   f.Method,
+			Modified: f.Modified,
 		}
 		// insert the file into the archive
 		fw, err = w.CreateHeader(fwhead)
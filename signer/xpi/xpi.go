@@ -2,6 +2,7 @@ package xpi // import "go.mozilla.org/autograph/signer/xpi"
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/rsa"
 	"crypto/x509"
@@ -45,6 +46,15 @@ const (
 	// Firefox HotFixes
 	ModeHotFix = "hotfix"
 
+	// ModeOmniJa represents a signer that issues signatures for
+	// the omni.ja archives of Firefox builds in the release
+	// pipeline
+	ModeOmniJa = "omni.ja"
+
+	// omniJaCN is the subject CN of the end-entity certificates of
+	// omni.ja signatures
+	omniJaCN = "omni.ja@mozilla.org"
+
 	coseManifestPath       = "META-INF/cose.manifest"
 	coseSigPath            = "META-INF/cose.sig"
 	pkcs7ManifestPath      = "META-INF/manifest.mf"
@@ -59,6 +69,7 @@ const (
 // signatures for Firefox Add-ons of various types.
 type XPISigner struct {
 	signer.Configuration
+	signer.KeyZeroizer
 	issuerKey       crypto.PrivateKey
 	issuerPublicKey crypto.PublicKey
 	issuerCert      *x509.Certificate
@@ -117,6 +128,13 @@ type XPISigner struct {
 	//      |                        |                     |
 	//   not_before          now / signing TS          not_after
 	recommendationValidityDuration time.Duration
+
+	// inspectionHooks are run on each XPI before signing it
+	inspectionHooks []InspectionHook
+
+	// versions records the versions of signed add-ons when the
+	// signer prevents version regressions
+	versions addOnVersionStore
 }
 
 // New initializes an XPI signer using a configuration
@@ -140,6 +158,7 @@ func New(conf signer.Configuration, stats *signer.StatsClient) (s *XPISigner, er
 	if err != nil {
 		return nil, errors.Wrap(err, "xpi: GetKeys failed to retrieve signer")
 	}
+	s.ZeroizeAtExit(s.issuerKey)
 
 	block, _ := pem.Decode([]byte(conf.Certificate))
 	if block == nil {
@@ -180,10 +199,14 @@ func New(conf signer.Configuration, stats *signer.StatsClient) (s *XPISigner, er
 		// FIXME: this also needs to pin the signing key somehow
 		s.OU = "Production"
 		s.EndEntityCN = "firefox-hotfix@mozilla.org"
+	case ModeOmniJa:
+		s.OU = "Mozilla Components"
+		s.EndEntityCN = omniJaCN
 	default:
-		return nil, errors.Errorf("xpi: unknown signer mode %q, must be 'add-on', 'extension', 'system add-on' or 'hotfix'", conf.Mode)
+		return nil, errors.Errorf("xpi: unknown signer mode %q, must be 'add-on', 'extension', 'system add-on', 'hotfix' or 'omni.ja'", conf.Mode)
 	}
 	s.Mode = conf.Mode
+	s.Timestamp = conf.Timestamp
 	s.stats = stats
 
 	if conf.Mode == ModeAddOnWithRecommendation {
@@ -199,6 +222,11 @@ func New(conf signer.Configuration, stats *signer.StatsClient) (s *XPISigner, er
 	s.recommendationFilePath = conf.RecommendationConfig.FilePath
 	log.Infof("xpi: signer %q is ignoring recommendation file path %q", s.ID, s.recommendationFilePath)
 
+	err = s.initInspection(conf)
+	if err != nil {
+		return nil, err
+	}
+
 	// If the private key is rsa, launch go routines that
 	// populates the rsa cache with private keys of the same
 	// length
@@ -239,11 +267,18 @@ func (s *XPISigner) Config() signer.Configuration {
 		Mode:        s.Mode,
 		PrivateKey:  s.PrivateKey,
 		Certificate: s.Certificate,
+		Timestamp:   s.Timestamp,
 	}
 }
 
 // SignFile takes an unsigned zipped XPI file and returns a signed XPI file
 func (s *XPISigner) SignFile(input []byte, options interface{}) (signedFile signer.SignedFile, err error) {
+	return s.SignFileContext(context.Background(), input, options)
+}
+
+// SignFileContext is like SignFile but stops before issuing each of
+// the COSE and PKCS7 signatures when ctx is done
+func (s *XPISigner) SignFileContext(ctx context.Context, input []byte, options interface{}) (signedFile signer.SignedFile, err error) {
 	var (
 		pkcs7Manifest []byte
 		manifest      []byte
@@ -253,6 +288,10 @@ func (s *XPISigner) SignFile(input []byte, options interface{}) (signedFile sign
 		coseSigAlgs   []*cose.Algorithm
 	)
 
+	err = signer.ValidateZIP(input)
+	if err != nil {
+		return nil, errors.Wrap(err, "xpi")
+	}
 	opt, err = GetOptions(options)
 	if err != nil {
 		return nil, errors.Wrap(err, "xpi: cannot get options")
@@ -266,6 +305,11 @@ func (s *XPISigner) SignFile(input []byte, options interface{}) (signedFile sign
 		return nil, errors.Wrap(err, "xpi: error parsing cose_algorithms options")
 	}
 
+	inspection, err := s.inspect(ctx, cn, input)
+	if err != nil {
+		return nil, err
+	}
+
 	input, err = removeFileFromZIP(input, s.recommendationFilePath)
 	if err != nil {
 		return nil, errors.Wrap(err, "xpi: error removing recommendation file from XPI")
@@ -293,6 +337,9 @@ func (s *XPISigner) SignFile(input []byte, options interface{}) (signedFile sign
 	if len(coseSigAlgs) < 1 {
 		pkcs7Manifest = manifest
 	} else {
+		if err = ctx.Err(); err != nil {
+			return nil, errors.Wrap(err, "xpi: aborting before signing cose message")
+		}
 		coseSig, err = s.issueCOSESignature(cn, manifest, coseSigAlgs)
 		if err != nil {
 			return nil, errors.Wrap(err, "xpi: error signing cose message")
@@ -321,7 +368,10 @@ func (s *XPISigner) SignFile(input []byte, options interface{}) (signedFile sign
 		return nil, errors.Wrap(err, "xpi: error parsing PK7 Digest")
 	}
 
-	p7sig, err := s.signDataWithPKCS7(sigfile, cn, p7Digest)
+	if err = ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "xpi: aborting before signing PKCS7 signature")
+	}
+	p7sig, err := s.signDataWithPKCS7(ctx, sigfile, cn, p7Digest)
 	if err != nil {
 		return nil, errors.Wrap(err, "xpi: failed to sign XPI")
 	}
@@ -332,15 +382,28 @@ func (s *XPISigner) SignFile(input []byte, options interface{}) (signedFile sign
 		{pkcs7SigPath, p7sig},
 	}...)
 
-	signedFile, err = repackJARWithMetafiles(input, metas)
+	if s.Mode == ModeOmniJa {
+		// keep the order, compression and timestamps of the
+		// entries firefox and the update pipeline expect
+		signedFile, err = repackJARPreservingHeaders(input, metas)
+	} else {
+		signedFile, err = repackJARWithMetafiles(input, metas)
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "xpi: failed to repack XPI")
 	}
+	s.recordSignedVersion(ctx, inspection)
 	return signedFile, nil
 }
 
 // SignData takes an input signature file and returns a PKCS7 or COSE detached signature
 func (s *XPISigner) SignData(sigfile []byte, options interface{}) (signer.Signature, error) {
+	return s.SignDataContext(context.Background(), sigfile, options)
+}
+
+// SignDataContext is like SignData but also enforces the add-on ID
+// allowlist set in ctx with WithAllowedIDs
+func (s *XPISigner) SignDataContext(ctx context.Context, sigfile []byte, options interface{}) (signer.Signature, error) {
 	opt, err := GetOptions(options)
 	if err != nil {
 		return nil, errors.Wrap(err, "xpi: cannot get options")
@@ -349,6 +412,12 @@ func (s *XPISigner) SignData(sigfile []byte, options interface{}) (signer.Signat
 	if err != nil {
 		return nil, err
 	}
+	// the signature file doesn't include the manifest, so only
+	// the requested ID can be checked
+	err = s.checkAllowedIDs(ctx, cn)
+	if err != nil {
+		return nil, errors.Wrapf(signer.ErrInputRejected, "xpi: %v", err)
+	}
 	if len(opt.COSEAlgorithms) > 0 {
 		return nil, errors.Errorf("xpi: cannot use /sign/data for COSE signatures. Use /sign/file instead")
 	}
@@ -356,7 +425,7 @@ func (s *XPISigner) SignData(sigfile []byte, options interface{}) (signer.Signat
 		return nil, errors.Errorf("xpi: can only use SHA1 digests with /sign/data. Use /sign/file instead")
 	}
 
-	sigBytes, err := s.signDataWithPKCS7(sigfile, cn, pkcs7.OIDDigestAlgorithmSHA1)
+	sigBytes, err := s.signDataWithPKCS7(ctx, sigfile, cn, pkcs7.OIDDigestAlgorithmSHA1)
 	if err != nil {
 		return nil, err
 	}
@@ -366,7 +435,9 @@ func (s *XPISigner) SignData(sigfile []byte, options interface{}) (signer.Signat
 	return sig, nil
 }
 
-func (s *XPISigner) signDataWithPKCS7(sigfile []byte, cn string, digest asn1.ObjectIdentifier) ([]byte, error) {
+// signDataWithPKCS7 returns a detached PKCS7 signature of sigfile
+// by a new end-entity, timestamped by the TSA of the signer if any
+func (s *XPISigner) signDataWithPKCS7(ctx context.Context, sigfile []byte, cn string, digest asn1.ObjectIdentifier) ([]byte, error) {
 	eeCert, eeKey, err := s.MakeEndEntity(cn, nil)
 	if err != nil {
 		return nil, err
@@ -381,6 +452,12 @@ func (s *XPISigner) signDataWithPKCS7(sigfile []byte, cn string, digest asn1.Obj
 	if err != nil {
 		return nil, errors.Wrap(err, "xpi: cannot sign")
 	}
+	if s.Timestamp.URL != "" {
+		err = signer.TimestampPKCS7(ctx, s.Timestamp, toBeSigned)
+		if err != nil {
+			return nil, errors.Wrap(err, "xpi: cannot timestamp signature")
+		}
+	}
 	toBeSigned.Detach()
 	p7sig, err := toBeSigned.Finish()
 	if err != nil {
@@ -556,6 +633,7 @@ func (sig *Signature) String() string {
 // 2) the signature serializes and deserializes properly
 // 3) the PKCS7 signatures
 // 4) the signature cert chain verifies when an optional non-nil truststore is provided
+// 5) the RFC 3161 timestamps of the signature, if any, cover it
 //
 func verifyPKCS7SignatureRoundTrip(signedFile signer.SignedFile, truststore *x509.CertPool) error {
 	sigStrBytes, err := readFileFromZIP(signedFile, pkcs7SigPath)
@@ -577,6 +655,10 @@ func verifyPKCS7SignatureRoundTrip(signedFile signer.SignedFile, truststore *x50
 	if sig.VerifyWithChain(truststore) != nil {
 		return errors.Errorf("failed to verify xpi signature: %v", sig.VerifyWithChain(truststore))
 	}
+	_, err = signer.VerifyPKCS7Timestamps(sig.p7, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to verify xpi signature timestamp")
+	}
 
 	// make sure we still have the same string representation
 	sigStr2, err := sig.Marshal()
@@ -1,11 +1,21 @@
 package xpi
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
 	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"strings"
@@ -211,7 +221,7 @@ func TestSignDataWithPKCS7VerifiesDigests(t *testing.T) {
 	}
 
 	// NB: can't call SignData directly since it doesn't support SHA256
-	pkcs7SigSHA2, err := s.signDataWithPKCS7(input, "foo@bar.net", pkcs7.OIDDigestAlgorithmSHA256)
+	pkcs7SigSHA2, err := s.signDataWithPKCS7(context.Background(), input, "foo@bar.net", pkcs7.OIDDigestAlgorithmSHA256)
 	if err != nil {
 		t.Fatalf("failed to sign XPI with SHA2 digest %q", err)
 	}
@@ -220,7 +230,7 @@ func TestSignDataWithPKCS7VerifiesDigests(t *testing.T) {
 		t.Fatalf("failed to verify PKCS7 with SHA2 digest")
 	}
 
-	pkcs7SigSHA1, err := s.signDataWithPKCS7(input, "foo@bar.net", pkcs7.OIDDigestAlgorithmSHA1)
+	pkcs7SigSHA1, err := s.signDataWithPKCS7(context.Background(), input, "foo@bar.net", pkcs7.OIDDigestAlgorithmSHA1)
 	if err != nil {
 		t.Fatalf("failed to sign XPI with SHA1 digest %q", err)
 	}
@@ -229,7 +239,7 @@ func TestSignDataWithPKCS7VerifiesDigests(t *testing.T) {
 		t.Fatalf("failed to verify PKCS7 with SHA1 digest")
 	}
 
-	_, err = s.signDataWithPKCS7(input, "foo@bar.net", nil)
+	_, err = s.signDataWithPKCS7(context.Background(), input, "foo@bar.net", nil)
 	if err == nil {
 		t.Fatalf("signing XPI with nil digest did not error")
 	}
@@ -569,6 +579,185 @@ func TestSignFileWithCOSESignatures(t *testing.T) {
 	}
 }
 
+func TestSignOmniJa(t *testing.T) {
+	t.Parallel()
+
+	// make an omni.ja with stored and deflated entries
+	modified := time.Date(2019, time.October, 1, 12, 0, 0, 0, time.UTC)
+	entries := []struct {
+		name   string
+		method uint16
+	}{
+		{"chrome.manifest", zip.Deflate},
+		{"defaults/pref/greprefs.js", zip.Store},
+		{"components/components.manifest", zip.Deflate},
+		{"precomplete", zip.Store},
+	}
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	for _, e := range entries {
+		fw, err := w.CreateHeader(&zip.FileHeader{Name: e.name, Method: e.method, Modified: modified})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("content of " + e.name))
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcase := PASSINGTESTCASES[5]
+	testcase.Mode = ModeOmniJa
+	s, err := New(testcase, nil)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	signOptions := Options{
+		// the ID is ignored in favor of the omni.ja CN
+		ID:             "test@example.net",
+		COSEAlgorithms: []string{"ES256"},
+		PKCS7Digest:    "SHA256",
+	}
+	signedOmniJa, err := s.SignFile(buf.Bytes(), signOptions)
+	if err != nil {
+		t.Fatalf("failed to sign omni.ja: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(testcase.Certificate))
+	signOptions.ID = omniJaCN
+	err = VerifySignedFile(signedOmniJa, roots, signOptions)
+	if err != nil {
+		t.Fatalf("failed to verify signed omni.ja: %v", err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(signedOmniJa), int64(len(signedOmniJa)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range entries {
+		f := r.File[i]
+		if f.Name != e.name || f.Method != e.method || !f.Modified.Equal(modified) {
+			t.Fatalf("entry %d: expected %q with method %d, got %q with method %d modified at %s",
+				i, e.name, e.method, f.Name, f.Method, f.Modified)
+		}
+	}
+	p7sig, err := readFileFromZIP(signedOmniJa, pkcs7SigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p7, err := pkcs7.Parse(p7sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := p7.GetOnlySigner().Subject.CommonName; cn != omniJaCN {
+		t.Fatalf("expected end-entity CN %q, got %q", omniJaCN, cn)
+	}
+}
+
+// newTestTSA starts an RFC 3161 TSA timestamping requests with a
+// self-signed certificate
+func newTestTSA(t *testing.T) *httptest.Server {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test tsa"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type messageImprint struct {
+		HashAlgorithm pkix.AlgorithmIdentifier
+		HashedMessage []byte
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Version        int
+			MessageImprint messageImprint
+			Nonce          *big.Int
+			CertReq        bool
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		_, err := asn1.Unmarshal(body, &req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		info, _ := asn1.Marshal(struct {
+			Version        int
+			Policy         asn1.ObjectIdentifier
+			MessageImprint messageImprint
+			SerialNumber   *big.Int
+			GenTime        time.Time `asn1:"generalized"`
+			Nonce          *big.Int
+		}{1, asn1.ObjectIdentifier{1, 2, 3}, req.MessageImprint, big.NewInt(1), time.Now().UTC().Truncate(time.Second), req.Nonce})
+		sd, _ := pkcs7.NewSignedData(info)
+		sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{})
+		token, _ := sd.Finish()
+		resp, _ := asn1.Marshal(struct {
+			Status         struct{ Status int }
+			TimeStampToken asn1.RawValue
+		}{TimeStampToken: asn1.RawValue{FullBytes: token}})
+		w.Write(resp)
+	}))
+}
+
+func TestSignFileWithTimestamp(t *testing.T) {
+	t.Parallel()
+
+	tsa := newTestTSA(t)
+	defer tsa.Close()
+
+	testcase := PASSINGTESTCASES[0]
+	testcase.Timestamp = signer.TimestampConfig{URL: tsa.URL}
+	s, err := New(testcase, nil)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if s.Config().Timestamp.URL != tsa.URL {
+		t.Fatalf("expected signer configuration to have the TSA, got %+v", s.Config().Timestamp)
+	}
+	opts := s.GetDefaultOptions().(Options)
+	signedXPI, err := s.SignFile(unsignedBootstrap, opts)
+	if err != nil {
+		t.Fatalf("failed to sign file with a timestamp: %v", err)
+	}
+	err = VerifySignedFile(signedXPI, nil, opts)
+	if err != nil {
+		t.Fatalf("failed to verify timestamped file: %v", err)
+	}
+	sigBytes, err := readFileFromZIP(signedXPI, pkcs7SigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p7, err := pkcs7.Parse(sigBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	times, err := signer.VerifyPKCS7Timestamps(p7, nil)
+	if err != nil || len(times) != 1 {
+		t.Fatalf("expected one timestamp, got %v and error %v", times, err)
+	}
+
+	// signing fails when the TSA is down
+	tsa.Close()
+	_, err = s.SignFile(unsignedBootstrap, opts)
+	if err == nil || !strings.Contains(err.Error(), "cannot timestamp signature") {
+		t.Fatalf("expected signing to fail without the TSA, got %v", err)
+	}
+}
+
 var PASSINGTESTCASES = []signer.Configuration{
 	signer.Configuration{
 		ID:   "rsa addon",
@@ -1217,7 +1406,7 @@ M1ZxulpMFD86/QECIAY+AuNXfbhE6gX7xoedPYB3AML5oTmvdzTsL2IePSZpAiBl
 w2hKSJpdD11n9tJEQ7MieRzrqr58rqm9tymUH0rKIg==
 -----END RSA PRIVATE KEY-----`,
 	}},
-	{err: `xpi: unknown signer mode "InvalidMode", must be 'add-on', 'extension', 'system add-on' or 'hotfix'`, cfg: signer.Configuration{
+	{err: `xpi: unknown signer mode "InvalidMode", must be 'add-on', 'extension', 'system add-on', 'hotfix' or 'omni.ja'`, cfg: signer.Configuration{
 		ID:   "rsa addon",
 		Type: Type,
 		Mode: "InvalidMode",
@@ -0,0 +1,131 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"math/big"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+// ZeroizeBytes overwrites a byte slice with zeroes in place
+func ZeroizeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// zeroizeBigInt overwrites the words backing a big.Int in place
+// before resetting its value, such that the secret does not linger
+// in memory after the int is released
+func zeroizeBigInt(n *big.Int) {
+	if n == nil {
+		return
+	}
+	words := n.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	n.SetInt64(0)
+}
+
+// bigIntBytes returns the memory backing a big.Int as a byte slice
+// so it can be locked. The returned slice aliases the int.
+func bigIntBytes(n *big.Int) []byte {
+	if n == nil {
+		return nil
+	}
+	words := n.Bits()
+	if len(words) == 0 {
+		return nil
+	}
+	size := len(words) * int(unsafe.Sizeof(words[0]))
+	return (*[1 << 30]byte)(unsafe.Pointer(&words[0]))[:size:size]
+}
+
+// secretInts returns the secret components of a software private
+// key, or nil for keys that are not held in memory (such as HSM keys)
+func secretInts(priv crypto.PrivateKey) (ints []*big.Int) {
+	switch key := priv.(type) {
+	case *rsa.PrivateKey:
+		ints = append(ints, key.D, key.Precomputed.Dp, key.Precomputed.Dq, key.Precomputed.Qinv)
+		ints = append(ints, key.Primes...)
+		for _, crt := range key.Precomputed.CRTValues {
+			ints = append(ints, crt.Exp, crt.Coeff, crt.R)
+		}
+	case *ecdsa.PrivateKey:
+		ints = append(ints, key.D)
+	case *dsa.PrivateKey:
+		ints = append(ints, key.X)
+	}
+	return
+}
+
+// ZeroizePrivateKey overwrites the secret components of a software
+// private key in place, after which the key fails to sign. Keys stored
+// in an HSM are left untouched.
+//
+// Zeroization is best-effort: the copies the standard library makes
+// when signing, like the precomputed values of RSA keys and the cache
+// of ECDSA keys, are dropped but cannot be wiped, and neither can the
+// PEM strings of the configuration.
+func ZeroizePrivateKey(priv crypto.PrivateKey) {
+	if key, ok := priv.(ed25519.PrivateKey); ok {
+		// ed25519 keys are plain bytes rather than big ints
+		ZeroizeBytes(key)
+		return
+	}
+	for _, n := range secretInts(priv) {
+		munlock(bigIntBytes(n))
+		zeroizeBigInt(n)
+	}
+	if key, ok := priv.(*rsa.PrivateKey); ok {
+		// the precomputed values hold a copy of the key the
+		// standard library signs with, drop it so the key has
+		// to be precomputed again from its zeroed values
+		key.Precomputed = rsa.PrecomputedValues{}
+	}
+}
+
+// KeyZeroizer zeroizes the software private keys of a signer when the
+// app is shut down gracefully. Signers embed it and register the keys
+// they load with ZeroizeAtExit.
+type KeyZeroizer struct {
+	keys []crypto.PrivateKey
+}
+
+// ZeroizeAtExit registers private keys to zeroize in AtExit. It is
+// meant to be called while the signer is initialized.
+func (z *KeyZeroizer) ZeroizeAtExit(keys ...crypto.PrivateKey) {
+	z.keys = append(z.keys, keys...)
+}
+
+// AtExit zeroizes the registered private keys with ZeroizePrivateKey
+func (z *KeyZeroizer) AtExit() error {
+	for _, key := range z.keys {
+		ZeroizePrivateKey(key)
+	}
+	return nil
+}
+
+// LockPrivateKey locks the memory holding the secret components of a
+// software private key to keep it from being swapped to disk or
+// included in core dumps, where the platform supports it. It is a
+// no-op for keys stored in an HSM.
+func LockPrivateKey(priv crypto.PrivateKey) error {
+	for _, n := range secretInts(priv) {
+		err := mlock(bigIntBytes(n))
+		if err != nil {
+			return errors.Wrap(err, "failed to lock private key memory")
+		}
+	}
+	return nil
+}
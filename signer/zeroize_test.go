@@ -0,0 +1,93 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestZeroizeBytes(t *testing.T) {
+	b := []byte("some secret bytes")
+	ZeroizeBytes(b)
+	for i := range b {
+		if b[i] != 0 {
+			t.Fatalf("byte %d was not zeroized: %x", i, b)
+		}
+	}
+}
+
+func TestZeroizePrivateKey(t *testing.T) {
+	var keys []crypto.PrivateKey
+	for _, keyPEM := range []string{rsaPrivateKey, rsaPKCS8PrivateKey, ecdsaPrivateKey, dsaPKCS8PrivateKey} {
+		key, err := ParsePrivateKey([]byte(keyPEM))
+		if err != nil {
+			t.Fatalf("failed to parse private key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = append(keys, edKey)
+
+	digest := sha256.Sum256([]byte("some signed data"))
+	sign := func(key crypto.PrivateKey) error {
+		if dsaKey, ok := key.(*dsa.PrivateKey); ok {
+			_, _, err := dsa.Sign(rand.Reader, dsaKey, digest[:20])
+			return err
+		}
+		input, opts := digest[:], crypto.SignerOpts(crypto.SHA256)
+		if _, ok := key.(ed25519.PrivateKey); ok {
+			input, opts = []byte("some signed data"), crypto.Hash(0)
+		}
+		_, err := key.(crypto.Signer).Sign(rand.Reader, input, opts)
+		return err
+	}
+	for _, key := range keys {
+		err = LockPrivateKey(key)
+		if err != nil {
+			// mlock fails when RLIMIT_MEMLOCK is too low
+			t.Logf("failed to lock %T: %v", key, err)
+		}
+		// signing precomputes and caches the key in the
+		// standard library, which zeroization must not miss
+		err = sign(key)
+		if err != nil {
+			t.Fatalf("failed to sign with %T: %v", key, err)
+		}
+		var z KeyZeroizer
+		z.ZeroizeAtExit(key)
+		err = z.AtExit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if edKey, ok := key.(ed25519.PrivateKey); ok {
+			// ed25519 keys are plain bytes that still sign
+			// once zeroed, but not for their public key
+			if ed25519.Verify(edPub, []byte("some signed data"), ed25519.Sign(edKey, []byte("some signed data"))) {
+				t.Fatal("expected a zeroized ed25519 key to lose its secret")
+			}
+			continue
+		}
+		if sign(key) == nil {
+			t.Fatalf("expected signing with a zeroized %T to fail", key)
+		}
+	}
+}
+
+func TestZeroizeIgnoresNilAndUnknownKeys(t *testing.T) {
+	ZeroizePrivateKey(nil)
+	ZeroizePrivateKey("not a key")
+	if err := LockPrivateKey(nil); err != nil {
+		t.Fatalf("locking a nil key should be a no-op, got: %v", err)
+	}
+}
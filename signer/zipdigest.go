@@ -0,0 +1,90 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// ZIPFileDigests are the SHA1 and SHA256 digests of the content of a
+// file in a ZIP archive, as listed in JAR manifests
+type ZIPFileDigests struct {
+	SHA1   []byte
+	SHA256 []byte
+}
+
+// DigestZIPFiles hashes the content of files on a pool of workers and
+// returns their digests in the order of files. It uses one worker per
+// CPU when workers is zero or negative. Files are decompressed and
+// hashed by the workers concurrently, so archives with thousands of
+// files aren't limited to a single CPU. When files fail to read, the
+// error of the first one in the list is returned.
+func DigestZIPFiles(files []*zip.File, workers int) ([]ZIPFileDigests, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(files) {
+		workers = len(files)
+	}
+	var (
+		digests = make([]ZIPFileDigests, len(files))
+		errs    = make([]error, len(files))
+		next    = int64(-1)
+		failed  int32
+		wg      sync.WaitGroup
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				// stop taking files once one failed, the
+				// digests of the archive are useless
+				if i >= len(files) || atomic.LoadInt32(&failed) != 0 {
+					return
+				}
+				digests[i], errs[i] = digestZIPFile(files[i])
+				if errs[i] != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return digests, nil
+}
+
+// digestZIPFile streams the content of f to its hashes, without
+// holding the decompressed file in memory
+func digestZIPFile(f *zip.File) (digests ZIPFileDigests, err error) {
+	rc, err := f.Open()
+	if err != nil {
+		return digests, errors.Wrapf(err, "failed to open %q", f.Name)
+	}
+	defer rc.Close()
+	h1 := sha1.New()
+	h2 := sha256.New()
+	_, err = io.Copy(io.MultiWriter(h1, h2), rc)
+	if err != nil {
+		return digests, errors.Wrapf(err, "failed to read %q", f.Name)
+	}
+	digests.SHA1 = h1.Sum(nil)
+	digests.SHA256 = h2.Sum(nil)
+	return digests, nil
+}
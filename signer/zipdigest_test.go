@@ -0,0 +1,102 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func makeTestZIP(t testing.TB, nfiles int) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for i := 0; i < nfiles; i++ {
+		// store the files, so tests can corrupt their content
+		f, err := w.CreateHeader(&zip.FileHeader{
+			Name:   fmt.Sprintf("dir/file%d.js", i),
+			Method: zip.Store,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(f, "%s", strings.Repeat(fmt.Sprintf("console.log(%d);\n", i), i+1))
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDigestZIPFiles(t *testing.T) {
+	t.Parallel()
+
+	archive := makeTestZIP(t, 100)
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{0, 1, 7, 1000} {
+		digests, err := DigestZIPFiles(r.File, workers)
+		if err != nil {
+			t.Fatalf("%d workers: failed to digest files: %v", workers, err)
+		}
+		if len(digests) != len(r.File) {
+			t.Fatalf("%d workers: expected %d digests, got %d", workers, len(r.File), len(digests))
+		}
+		for i, f := range r.File {
+			data := []byte(strings.Repeat(fmt.Sprintf("console.log(%d);\n", i), i+1))
+			h1 := sha1.Sum(data)
+			h2 := sha256.Sum256(data)
+			if !bytes.Equal(digests[i].SHA1, h1[:]) || !bytes.Equal(digests[i].SHA256, h2[:]) {
+				t.Fatalf("%d workers: digests of %q don't match its content", workers, f.Name)
+			}
+		}
+	}
+
+	digests, err := DigestZIPFiles(nil, 0)
+	if err != nil || len(digests) != 0 {
+		t.Fatalf("expected no digests for no files, got %v %v", digests, err)
+	}
+}
+
+func TestDigestZIPFilesCorrupted(t *testing.T) {
+	t.Parallel()
+
+	archive := makeTestZIP(t, 20)
+	// corrupt the content of the third file, so its checksum fails
+	corrupted := bytes.Replace(archive, []byte("console.log(2);"), []byte("console.log(X);"), 1)
+	r, err := zip.NewReader(bytes.NewReader(corrupted), int64(len(corrupted)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = DigestZIPFiles(r.File, 4)
+	if err == nil || !strings.Contains(err.Error(), `failed to read "dir/file2.js"`) {
+		t.Fatalf("expected corrupted file to fail, got: %v", err)
+	}
+}
+
+func BenchmarkDigestZIPFiles(b *testing.B) {
+	archive := makeTestZIP(b, 2000)
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, workers := range []int{1, 0} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := DigestZIPFiles(r.File, workers)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
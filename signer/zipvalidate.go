@@ -0,0 +1,63 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"archive/zip"
+	"bytes"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// ValidateZIP checks a file signers parse as a ZIP archive, like an
+// XPI or an APK, before they make any signature. The central directory
+// must parse, every entry must have a unique name, a supported
+// compression method and a local header within the file, and the data
+// of entries must not overlap the data of other entries. It
+// returns an error wrapping ErrMalformedInput otherwise.
+func ValidateZIP(file []byte) error {
+	r, err := zip.NewReader(bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		return errors.Wrapf(ErrMalformedInput, "invalid zip central directory: %v", err)
+	}
+	if len(r.File) == 0 {
+		return errors.Wrap(ErrMalformedInput, "zip archive has no entries")
+	}
+	type span struct {
+		name       string
+		start, end int64
+	}
+	spans := make([]span, 0, len(r.File))
+	names := make(map[string]bool, len(r.File))
+	for _, f := range r.File {
+		if names[f.Name] {
+			// readers pick different entries of the same name,
+			// so the signed one may not be the one installed
+			return errors.Wrapf(ErrMalformedInput, "duplicate zip entry %q", f.Name)
+		}
+		names[f.Name] = true
+		if f.Method != zip.Store && f.Method != zip.Deflate {
+			return errors.Wrapf(ErrMalformedInput, "zip entry %q has unsupported compression method %d", f.Name, f.Method)
+		}
+		offset, err := f.DataOffset()
+		if err != nil {
+			return errors.Wrapf(ErrMalformedInput, "invalid local header of zip entry %q: %v", f.Name, err)
+		}
+		if f.CompressedSize64 > uint64(len(file)) || offset > int64(len(file))-int64(f.CompressedSize64) {
+			return errors.Wrapf(ErrMalformedInput, "data of zip entry %q is out of bounds", f.Name)
+		}
+		spans = append(spans, span{f.Name, offset, offset + int64(f.CompressedSize64)})
+	}
+	// the central directory of optimized jars like omni.ja isn't
+	// in the order of the data
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	for i := 1; i < len(spans); i++ {
+		if spans[i].start < spans[i-1].end {
+			return errors.Wrapf(ErrMalformedInput, "zip entry %q overlaps zip entry %q", spans[i].name, spans[i-1].name)
+		}
+	}
+	return nil
+}
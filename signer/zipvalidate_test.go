@@ -0,0 +1,73 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// makeNamedTestZIP returns a ZIP archive of files stored without
+// compression, in the order of names
+func makeNamedTestZIP(t *testing.T, names ...string) []byte {
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	for _, name := range names {
+		fw, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fw.Write([]byte("content of " + name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestValidateZIP(t *testing.T) {
+	valid := makeNamedTestZIP(t, "manifest.json", "background.js")
+	err := ValidateZIP(valid)
+	if err != nil {
+		t.Fatalf("expected a valid zip to pass, got %v", err)
+	}
+
+	// the central directory starts with the entry of manifest.json
+	cdOffset := bytes.Index(valid, []byte("PK\x01\x02"))
+	unsupportedMethod := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint16(unsupportedMethod[cdOffset+10:], 99)
+	badLocalHeader := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint32(badLocalHeader[cdOffset+42:], 5)
+	outOfBounds := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint32(outOfBounds[cdOffset+20:], uint32(len(valid)))
+	binary.LittleEndian.PutUint32(outOfBounds[cdOffset+24:], uint32(len(valid)))
+
+	for i, testcase := range []struct {
+		file []byte
+		err  string
+	}{
+		{[]byte("foobarbazbar"), "invalid zip central directory"},
+		{valid[:len(valid)-10], "invalid zip central directory"},
+		{makeNamedTestZIP(t), "zip archive has no entries"},
+		{makeNamedTestZIP(t, "manifest.json", "manifest.json"), `duplicate zip entry "manifest.json"`},
+		{unsupportedMethod, "unsupported compression method 99"},
+		{badLocalHeader, `invalid local header of zip entry "manifest.json"`},
+		{outOfBounds, `data of zip entry "manifest.json" is out of bounds`},
+	} {
+		err := ValidateZIP(testcase.file)
+		if errors.Cause(err) != ErrMalformedInput || !strings.Contains(err.Error(), testcase.err) {
+			t.Fatalf("testcase %d: expected malformed input error %q, got %v", i, testcase.err, err)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/autograph/signer/apk"
+	"go.mozilla.org/autograph/signer/apk2"
+	"go.mozilla.org/autograph/signer/contentsignature"
+	"go.mozilla.org/autograph/signer/contentsignaturepki"
+	"go.mozilla.org/autograph/signer/genericrsa"
+	"go.mozilla.org/autograph/signer/gpg2"
+	"go.mozilla.org/autograph/signer/macos"
+	"go.mozilla.org/autograph/signer/mar"
+	"go.mozilla.org/autograph/signer/nullsigner"
+	"go.mozilla.org/autograph/signer/pgp"
+	"go.mozilla.org/autograph/signer/plugin"
+	"go.mozilla.org/autograph/signer/rsapss"
+	"go.mozilla.org/autograph/signer/sigstore"
+	"go.mozilla.org/autograph/signer/threshold"
+	"go.mozilla.org/autograph/signer/xpi"
+)
+
+// signerInitConfig controls how signers are initialized at startup
+type signerInitConfig struct {
+	// Parallelism is the number of signers initialized at the
+	// same time. Defaults to 1, which initializes signers one
+	// after the other.
+	Parallelism int
+
+	// Timeout is how long a single signer can take to initialize
+	// before startup fails. Zero means no timeout.
+	Timeout time.Duration
+
+	// Warmup initializes lazy signers in the background once
+	// the API is up, instead of on their first use
+	Warmup bool
+
+	// AllowDegraded starts autograph with the signers that
+	// initialized successfully instead of failing. The others
+	// are reported in the heartbeat and retried every
+	// RetryInterval (defaults to 1 minute) until they recover.
+	AllowDegraded bool
+	RetryInterval time.Duration
+}
+
+// newSigner initializes a signer from its configuration. It returns a
+// nil signer and no error when the signer should be skipped.
+func (a *autographer) newSigner(signerConf signer.Configuration) (s signer.Signer, err error) {
+	var statsClient *signer.StatsClient
+	if a.stats != nil {
+		statsClient, err = signer.NewStatsClient(signerConf, a.stats)
+		if statsClient == nil || err != nil {
+			return nil, errors.Wrapf(err, "failed to add signer stats client %q or got back nil statsClient", signerConf.ID)
+		}
+	}
+	// give the database handler to the signer configuration
+	if a.db != nil {
+		signerConf.DB = a.db
+	}
+	// refuse to sign with a random source that fails its self-test
+	err = signerConf.CheckRand()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to add signer %q", signerConf.ID)
+	}
+	switch signerConf.Type {
+	case contentsignature.Type:
+		s, err = contentsignature.New(signerConf)
+	case contentsignaturepki.Type:
+		s, err = contentsignaturepki.New(signerConf)
+	case xpi.Type:
+		s, err = xpi.New(signerConf, statsClient)
+	case apk.Type:
+		s, err = apk.New(signerConf)
+	case apk2.Type:
+		s, err = apk2.New(signerConf)
+	case mar.Type:
+		s, err = mar.New(signerConf)
+		if err != nil && strings.HasPrefix(err.Error(), "mar: failed to parse private key: no suitable key found") {
+			log.Infof("Skipping signer %q from HSM", signerConf.ID)
+			return nil, nil
+		}
+	case pgp.Type:
+		s, err = pgp.New(signerConf)
+	case gpg2.Type:
+		s, err = gpg2.New(signerConf)
+	case genericrsa.Type:
+		s, err = genericrsa.New(signerConf)
+	case rsapss.Type:
+		s, err = rsapss.New(signerConf)
+	case threshold.Type:
+		s, err = threshold.New(signerConf)
+	case nullsigner.Type:
+		s, err = nullsigner.New(signerConf)
+	case sigstore.Type:
+		s, err = sigstore.New(signerConf)
+	case macos.Type:
+		s, err = macos.New(signerConf)
+	case plugin.Type:
+		s, err = plugin.New(signerConf)
+	default:
+		// signer types compiled in by the build
+		factory, ok := signer.LookupType(signerConf.Type)
+		if !ok {
+			return nil, fmt.Errorf("unknown signer type %q", signerConf.Type)
+		}
+		s, err = factory(signerConf, statsClient)
+		if err == nil && s == nil {
+			err = errors.Errorf("registered signer type %q returned a nil signer", signerConf.Type)
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to add signer %q", signerConf.ID)
+	}
+	if a.fips {
+		err = checkFIPSCompliance(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// newSignerWithTimeout is like newSigner but returns an error when the
+// signer takes longer than a.signerInit.Timeout to initialize. Signer
+// constructors cannot be interrupted, so a signer that times out keeps
+// initializing in the background and is discarded when done.
+func (a *autographer) newSignerWithTimeout(signerConf signer.Configuration) (signer.Signer, error) {
+	if a.signerInit.Timeout <= 0 {
+		return a.newSigner(signerConf)
+	}
+	type result struct {
+		s   signer.Signer
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		s, err := a.newSigner(signerConf)
+		done <- result{s, err}
+	}()
+	select {
+	case res := <-done:
+		return res.s, res.err
+	case <-time.After(a.signerInit.Timeout):
+		return nil, fmt.Errorf("failed to add signer %q: initialization timed out after %s", signerConf.ID, a.signerInit.Timeout)
+	}
+}
+
+// initSigners initializes signers with up to a.signerInit.Parallelism
+// running at the same time. It returns the signers in configuration
+// order, with nil entries for skipped signers and lazySigners for lazy
+// ones, or an error listing every signer that failed. When degraded
+// mode is allowed, signers that failed are returned as degradedSigners
+// instead.
+func (a *autographer) initSigners(signerConfs []signer.Configuration) ([]signer.Signer, error) {
+	parallelism := a.signerInit.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	var (
+		signers = make([]signer.Signer, len(signerConfs))
+		errs    = make([]error, len(signerConfs))
+		sem     = make(chan struct{}, parallelism)
+		wg      sync.WaitGroup
+	)
+	if types := signer.RegisteredTypes(); len(types) > 0 {
+		log.Infof("signer types registered by the build: %s", strings.Join(types, ", "))
+	}
+	if a.fips {
+		// lazy and degraded signers are only checked once
+		// initialized, so refuse their types before starting
+		for _, signerConf := range signerConfs {
+			err := checkFIPSConfiguration(signerConf)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	start := time.Now()
+	for i := range signerConfs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if signerConfs[i].Lazy {
+				signers[i] = newLazySigner(signerConfs[i], a.newSignerWithTimeout)
+				return
+			}
+			signers[i], errs[i] = a.newSignerWithTimeout(signerConfs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var failures []error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if a.signerInit.AllowDegraded {
+			log.Errorf("starting with degraded signer %q: %v", signerConfs[i].ID, err)
+			degraded := newDegradedSigner(signerConfs[i], err)
+			retryInterval := a.signerInit.RetryInterval
+			if retryInterval <= 0 {
+				retryInterval = defaultSignerRetryInterval
+			}
+			go degraded.retry(a.newSignerWithTimeout, retryInterval)
+			signers[i] = degraded
+			continue
+		}
+		failures = append(failures, err)
+	}
+	switch len(failures) {
+	case 0:
+	case 1:
+		return nil, failures[0]
+	default:
+		msgs := make([]string, len(failures))
+		for i, err := range failures {
+			msgs[i] = err.Error()
+		}
+		return nil, fmt.Errorf("failed to initialize %d signers:\n%s", len(failures), strings.Join(msgs, "\n"))
+	}
+	log.Infof("initialized %d signers in %s with parallelism %d", len(signerConfs), time.Since(start), parallelism)
+	return signers, nil
+}
@@ -0,0 +1,128 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/autograph/signer/contentsignaturepki"
+)
+
+func TestInitSignersParallel(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(1)
+	tmpag.signerInit.Parallelism = 4
+	err := tmpag.addSigners(conf.Signers)
+	if err != nil {
+		t.Fatalf("failed to initialize signers in parallel: %v", err)
+	}
+	signers := tmpag.getSigners()
+	if len(signers) != len(ag.getSigners()) {
+		t.Fatalf("expected %d signers but got %d", len(ag.getSigners()), len(signers))
+	}
+	for i, s := range ag.getSigners() {
+		if signers[i].Config().ID != s.Config().ID {
+			t.Fatalf("expected signer %d to be %q but got %q", i, s.Config().ID, signers[i].Config().ID)
+		}
+	}
+}
+
+func TestInitSignersAggregatesFailures(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(1)
+	tmpag.signerInit.Parallelism = 2
+	err := tmpag.addSigners([]signer.Configuration{
+		{ID: "unknowntype1", Type: "foo"},
+		conf.Signers[0],
+		{ID: "unknowntype2", Type: "bar"},
+	})
+	if err == nil {
+		t.Fatal("expected signers with unknown types to fail")
+	}
+	if !strings.Contains(err.Error(), "failed to initialize 2 signers") ||
+		!strings.Contains(err.Error(), `"foo"`) || !strings.Contains(err.Error(), `"bar"`) {
+		t.Fatalf("expected both failures to be reported, got: %v", err)
+	}
+	if len(tmpag.getSigners()) != 0 {
+		t.Fatalf("expected no signers to be added, got %d", len(tmpag.getSigners()))
+	}
+}
+
+func TestInitSignerTimeout(t *testing.T) {
+	t.Parallel()
+
+	// the x5u of this signer takes longer to download than
+	// the signer initialization timeout
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * time.Second)
+	}))
+	defer slowServer.Close()
+	var pkiConf signer.Configuration
+	for _, s := range conf.Signers {
+		if s.Type == contentsignaturepki.Type {
+			pkiConf = s
+			break
+		}
+	}
+	pkiConf.ID = "slowx5u"
+	pkiConf.X5U = slowServer.URL + "/"
+
+	tmpag := newAutographer(1)
+	tmpag.signerInit.Timeout = 100 * time.Millisecond
+	err := tmpag.addSigners([]signer.Configuration{pkiConf})
+	if err == nil || !strings.Contains(err.Error(), "initialization timed out") {
+		t.Fatalf("expected signer initialization to time out, got: %v", err)
+	}
+}
+
+// registeredSigner is a signer of a type registered by the build
+type registeredSigner struct {
+	signer.Configuration
+}
+
+func (s *registeredSigner) Config() signer.Configuration {
+	return s.Configuration
+}
+
+func TestInitRegisteredSignerType(t *testing.T) {
+	t.Parallel()
+
+	const typ = "testregistered"
+	if _, ok := signer.LookupType(typ); !ok {
+		signer.RegisterType(typ, func(conf signer.Configuration, stats *signer.StatsClient) (signer.Signer, error) {
+			if conf.PublicKey == "" {
+				return nil, errors.New("missing public key")
+			}
+			return &registeredSigner{conf}, nil
+		})
+	}
+
+	tmpag := newAutographer(1)
+	err := tmpag.addSigners([]signer.Configuration{{ID: "registered", Type: typ, PublicKey: "foo"}})
+	if err != nil {
+		t.Fatalf("failed to initialize signer of a registered type: %v", err)
+	}
+	s, ok := tmpag.getSignerByID("registered")
+	if !ok {
+		t.Fatal("expected signer of a registered type to be added")
+	}
+	if _, ok := s.(*registeredSigner); !ok {
+		t.Fatalf("expected a signer from the registered factory, got %T", s)
+	}
+
+	err = newAutographer(1).addSigners([]signer.Configuration{{ID: "registered", Type: typ}})
+	if err == nil || !strings.Contains(err.Error(), `failed to add signer "registered": missing public key`) {
+		t.Fatalf("expected the error of the registered factory, got: %v", err)
+	}
+}
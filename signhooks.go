@@ -0,0 +1,39 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/hooks"
+)
+
+// runSignHooks runs the hooks registered by the build for the stage of
+// a signing request, and writes the error response when one fails
+func (a *autographer) runSignHooks(ctx context.Context, w http.ResponseWriter, r *http.Request, event *hooks.Event) bool {
+	event.HTTPRequest = r
+	event.ResponseHeader = w.Header()
+	name, err := hooks.Run(ctx, event)
+	if err == nil {
+		return true
+	}
+	log.WithFields(log.Fields{
+		"rid":       getRequestID(r),
+		"hook":      name,
+		"stage":     event.Stage,
+		"user_id":   event.UserID,
+		"signer_id": event.SignerID,
+	}).Warnf("signing request failed in hook: %v", err)
+	if rejection, ok := err.(*hooks.Rejection); ok {
+		httpError(w, r, rejection.Status, formats.ErrorCodeRequestRejected, "%s", rejection.Message)
+		return false
+	}
+	httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "hook %q failed at stage %s: %v", name, event.Stage, err)
+	return false
+}
@@ -0,0 +1,118 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/hooks"
+	"go.mozilla.org/autograph/signer"
+)
+
+func TestSignHooks(t *testing.T) {
+	t.Parallel()
+
+	// hooks are global, so they only act on requests of this user
+	const hookUser = "signhooksuser"
+	if len(hooks.Registered(hooks.PostSign)) == 0 || hooks.Registered(hooks.PostSign)[0] != "testbilling" {
+		hooks.Register(hooks.PreValidate, "testquota", func(ctx context.Context, event *hooks.Event) error {
+			if event.UserID == hookUser && event.SignatureRequests[0].Input == base64.StdEncoding.EncodeToString([]byte("over quota")) {
+				return hooks.Reject(http.StatusPaymentRequired, "quota of %s exceeded", event.UserID)
+			}
+			return nil
+		})
+		hooks.Register(hooks.PreSign, "testbroken", func(ctx context.Context, event *hooks.Event) error {
+			if event.UserID == hookUser && string(event.Input) == "broken billing backend" {
+				return errors.New("billing backend unavailable")
+			}
+			return nil
+		})
+		hooks.Register(hooks.PostSign, "testbilling", func(ctx context.Context, event *hooks.Event) error {
+			if event.UserID == hookUser {
+				event.ResponseHeader.Add("X-Billed-Ref", event.SignatureResponse.Ref)
+			}
+			return nil
+		})
+	}
+
+	var signerConfs []signer.Configuration
+	for _, s := range conf.Signers {
+		if s.ID == "appkey1" {
+			signerConfs = append(signerConfs, s)
+		}
+	}
+	tmpag := newAutographer(1)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners(signerConfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := authorization{ID: hookUser, Key: "q8zt0wmx3rc5vn7bjp2kd6hyf9l4sgu1ea0oi8mw3kcz5nbx2p", Signers: []string{"appkey1"}}
+	err = tmpag.addAuthorizations([]authorization{user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(input string) *httptest.ResponseRecorder {
+		body, err := json.Marshal([]formats.SignatureRequest{{Input: base64.StdEncoding.EncodeToString([]byte(input))}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, user.ID, user.Key, sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		tmpag.handleSignature(w, req)
+		return w
+	}
+
+	w := sign("foobarbaz1234abcd")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var sigresps []formats.SignatureResponse
+	err = json.Unmarshal(w.Body.Bytes(), &sigresps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("X-Billed-Ref") != sigresps[0].Ref {
+		t.Fatalf("expected post-sign hook to add header with ref %q, got %q", sigresps[0].Ref, w.Header().Get("X-Billed-Ref"))
+	}
+
+	for i, testcase := range []struct {
+		input  string
+		status int
+		code   formats.ErrorCode
+	}{
+		{"over quota", http.StatusPaymentRequired, formats.ErrorCodeRequestRejected},
+		{"broken billing backend", http.StatusInternalServerError, formats.ErrorCodeInternal},
+	} {
+		w := sign(testcase.input)
+		var errResp formats.ErrorResponse
+		err = json.Unmarshal(w.Body.Bytes(), &errResp)
+		if err != nil {
+			t.Fatalf("testcase %d: failed to parse error response %q: %v", i, w.Body.String(), err)
+		}
+		if w.Code != testcase.status || errResp.Code != testcase.code {
+			t.Errorf("testcase %d: expected status %d and code %s but got %d and %s", i, testcase.status, testcase.code, w.Code, errResp.Code)
+		}
+		if w.Header().Get("X-Billed-Ref") != "" {
+			t.Errorf("testcase %d: expected post-sign hook not to run", i)
+		}
+	}
+}
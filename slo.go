@@ -0,0 +1,345 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/formats"
+)
+
+const (
+	// sloBuckets is the number of buckets operations are counted
+	// in over each rolling window, so a window rolls over in steps
+	// of a sixtieth of its size
+	sloBuckets = 60
+
+	// minSLOWindow is the smallest rolling window
+	minSLOWindow = time.Minute
+
+	// sloStatsInterval is how often error budgets are sent to statsd
+	sloStatsInterval = 30 * time.Second
+
+	// defaultSLOAvailability, defaultSLOLatencyThreshold and
+	// defaultSLOLatencyTarget are the objectives of signers when
+	// the configuration does not set them
+	defaultSLOAvailability     = 0.999
+	defaultSLOLatencyThreshold = time.Second
+	defaultSLOLatencyTarget    = 0.99
+)
+
+// defaultSLOWindows are the rolling windows when the configuration
+// does not set them
+var defaultSLOWindows = []time.Duration{time.Hour, 24 * time.Hour}
+
+// sloConfig configures the availability and latency objectives of
+// signers, and the rolling windows their error budgets are computed
+// over
+type sloConfig struct {
+	Enabled bool
+	Windows []time.Duration
+
+	// Default are the objectives of all signers, and Signers
+	// overrides them by signer ID
+	Default sloTarget
+	Signers map[string]sloTarget
+}
+
+// sloTarget is the objectives of a signer: the share of operations
+// that must not fail with a server error, and the share of successful
+// operations that must complete within the latency threshold
+type sloTarget struct {
+	Availability     float64
+	LatencyThreshold time.Duration
+	LatencyTarget    float64
+}
+
+// withDefaults returns the target with the objectives it doesn't set
+// taken from defaults
+func (t sloTarget) withDefaults(defaults sloTarget) sloTarget {
+	if t.Availability == 0 {
+		t.Availability = defaults.Availability
+	}
+	if t.LatencyThreshold == 0 {
+		t.LatencyThreshold = defaults.LatencyThreshold
+	}
+	if t.LatencyTarget == 0 {
+		t.LatencyTarget = defaults.LatencyTarget
+	}
+	return t
+}
+
+// validate returns an error when an objective is out of range
+func (t sloTarget) validate() error {
+	if t.Availability <= 0 || t.Availability >= 1 {
+		return errors.Errorf("availability objective %g must be between 0 and 1", t.Availability)
+	}
+	if t.LatencyTarget <= 0 || t.LatencyTarget >= 1 {
+		return errors.Errorf("latency objective %g must be between 0 and 1", t.LatencyTarget)
+	}
+	if t.LatencyThreshold <= 0 {
+		return errors.Errorf("latency threshold %s must be positive", t.LatencyThreshold)
+	}
+	return nil
+}
+
+// sloBucket counts the operations of a signer that started in a
+// slice of a rolling window
+type sloBucket struct {
+	start  time.Time
+	ops    int64
+	errors int64
+	slow   int64
+}
+
+// sloWindow counts the operations of a signer over a rolling window
+type sloWindow struct {
+	size    time.Duration
+	buckets [sloBuckets]sloBucket
+}
+
+// add counts an operation that completed at now
+func (w *sloWindow) add(now time.Time, failed, slow bool) {
+	width := w.size / sloBuckets
+	start := now.Truncate(width)
+	b := &w.buckets[(start.UnixNano()/int64(width))%sloBuckets]
+	if !b.start.Equal(start) {
+		*b = sloBucket{start: start}
+	}
+	b.ops++
+	if failed {
+		b.errors++
+	}
+	if slow {
+		b.slow++
+	}
+}
+
+// sum returns the counts of the operations in the window ending at now
+func (w *sloWindow) sum(now time.Time) (ops, errors, slow int64) {
+	for _, b := range w.buckets {
+		if b.ops == 0 || now.Sub(b.start) >= w.size {
+			continue
+		}
+		ops += b.ops
+		errors += b.errors
+		slow += b.slow
+	}
+	return
+}
+
+// sloTracker counts the operations of each signer over the rolling
+// windows of its objectives
+type sloTracker struct {
+	sync.Mutex
+	conf    sloConfig
+	now     func() time.Time
+	signers map[string][]*sloWindow
+}
+
+func newSLOTracker(conf sloConfig) (*sloTracker, error) {
+	if len(conf.Windows) == 0 {
+		conf.Windows = defaultSLOWindows
+	}
+	for _, window := range conf.Windows {
+		if window < minSLOWindow {
+			return nil, errors.Errorf("slo window %s must be at least %s", window, minSLOWindow)
+		}
+	}
+	conf.Default = conf.Default.withDefaults(sloTarget{
+		Availability:     defaultSLOAvailability,
+		LatencyThreshold: defaultSLOLatencyThreshold,
+		LatencyTarget:    defaultSLOLatencyTarget,
+	})
+	err := conf.Default.validate()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid default slo")
+	}
+	for id, target := range conf.Signers {
+		err = target.withDefaults(conf.Default).validate()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid slo of signer %q", id)
+		}
+	}
+	return &sloTracker{
+		conf:    conf,
+		now:     time.Now,
+		signers: make(map[string][]*sloWindow),
+	}, nil
+}
+
+// target returns the objectives of a signer
+func (t *sloTracker) target(signerID string) sloTarget {
+	return t.conf.Signers[signerID].withDefaults(t.conf.Default)
+}
+
+// record counts an operation of a signer that failed with a server
+// error or took latency to succeed
+func (t *sloTracker) record(signerID string, latency time.Duration, failed bool) {
+	slow := !failed && latency > t.target(signerID).LatencyThreshold
+	t.Lock()
+	defer t.Unlock()
+	windows, ok := t.signers[signerID]
+	if !ok {
+		for _, size := range t.conf.Windows {
+			windows = append(windows, &sloWindow{size: size})
+		}
+		t.signers[signerID] = windows
+	}
+	now := t.now()
+	for _, w := range windows {
+		w.add(now, failed, slow)
+	}
+}
+
+// budget returns the compliance with an objective of the share of
+// good operations, the share of its error budget that is left, and
+// the rate the budget is used at
+func budget(bad, total int64, objective float64) (compliance, remaining, burnRate float64) {
+	if total == 0 {
+		return 1, 1, 0
+	}
+	badRatio := float64(bad) / float64(total)
+	return 1 - badRatio, 1 - badRatio/(1-objective), badRatio / (1 - objective)
+}
+
+// report returns the objectives and error budgets of signers
+func (t *sloTracker) report(signerIDs []string) []formats.SignerSLO {
+	t.Lock()
+	defer t.Unlock()
+	now := t.now()
+	slos := []formats.SignerSLO{}
+	for _, id := range signerIDs {
+		target := t.target(id)
+		slo := formats.SignerSLO{
+			SignerID:           id,
+			AvailabilityTarget: target.Availability,
+			LatencyThreshold:   target.LatencyThreshold.String(),
+			LatencyTarget:      target.LatencyTarget,
+		}
+		for i, size := range t.conf.Windows {
+			window := formats.SLOWindow{Window: size.String()}
+			if windows, ok := t.signers[id]; ok {
+				window.Operations, window.Errors, window.Slow = windows[i].sum(now)
+			}
+			window.Availability, window.AvailabilityBudgetRemaining, window.AvailabilityBurnRate =
+				budget(window.Errors, window.Operations, target.Availability)
+			window.LatencyCompliance, window.LatencyBudgetRemaining, window.LatencyBurnRate =
+				budget(window.Slow, window.Operations-window.Errors, target.LatencyTarget)
+			slo.Windows = append(slo.Windows, window)
+		}
+		slos = append(slos, slo)
+	}
+	return slos
+}
+
+// enableSLO starts tracking the objectives of signers, when the
+// configuration enables it
+func (a *autographer) enableSLO(conf sloConfig) (err error) {
+	if !conf.Enabled {
+		return nil
+	}
+	for id := range conf.Signers {
+		if _, found := a.getSignerByID(id); !found {
+			return errors.Errorf("cannot set the slo of unknown signer %q", id)
+		}
+	}
+	a.slo, err = newSLOTracker(conf)
+	if err != nil {
+		return err
+	}
+	if a.stats != nil {
+		go a.sendSLOStats()
+	}
+	return nil
+}
+
+// sloError returns whether a signing error counts against the
+// availability objective of a signer. Errors of clients, like invalid
+// inputs or canceled requests, don't.
+func sloError(code formats.ErrorCode) bool {
+	switch code {
+	case formats.ErrorCodeSignerUnavailable, formats.ErrorCodeSigningFailed, formats.ErrorCodeHSMUnavailable,
+		formats.ErrorCodeTimeout, formats.ErrorCodeOverloaded, formats.ErrorCodeInternal:
+		return true
+	}
+	return false
+}
+
+// recordSLO counts a signing operation of a request against the
+// objectives of a signer, when they are enabled. The code is empty
+// when the operation succeeded, and its latency is the time since the
+// request started.
+func (a *autographer) recordSLO(r *http.Request, signerID string, code formats.ErrorCode) {
+	if a.slo == nil {
+		return
+	}
+	a.slo.record(signerID, time.Since(getRequestStartTime(r)), sloError(code))
+}
+
+// sloReport returns the objectives and error budgets of all signers
+func (a *autographer) sloReport() []formats.SignerSLO {
+	var ids []string
+	for _, s := range a.getSigners() {
+		ids = append(ids, s.Config().ID)
+	}
+	sort.Strings(ids)
+	return a.slo.report(ids)
+}
+
+// handleSLO returns the objectives of signers and their error budgets
+// over each rolling window
+func (a *autographer) handleSLO(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpError(w, r, http.StatusMethodNotAllowed, formats.ErrorCodeInvalidMethod, "%s method not allowed; endpoint accepts GET only", r.Method)
+		return
+	}
+	if a.slo == nil {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "slo tracking is not enabled")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.sloReport())
+}
+
+// sendSLOStats sends the error budgets of signers to statsd every
+// sloStatsInterval
+func (a *autographer) sendSLOStats() {
+	for {
+		time.Sleep(sloStatsInterval)
+		var err error
+		for _, slo := range a.sloReport() {
+			for _, window := range slo.Windows {
+				if err != nil {
+					break
+				}
+				tags := []string{"signer:" + slo.SignerID, "window:" + window.Window}
+				err = a.stats.Gauge("slo.availability", window.Availability, tags, 1)
+				if err == nil {
+					err = a.stats.Gauge("slo.availability_budget_remaining", window.AvailabilityBudgetRemaining, tags, 1)
+				}
+				if err == nil {
+					err = a.stats.Gauge("slo.availability_burn_rate", window.AvailabilityBurnRate, tags, 1)
+				}
+				if err == nil {
+					err = a.stats.Gauge("slo.latency_budget_remaining", window.LatencyBudgetRemaining, tags, 1)
+				}
+				if err == nil {
+					err = a.stats.Gauge("slo.latency_burn_rate", window.LatencyBurnRate, tags, 1)
+				}
+			}
+		}
+		if err != nil {
+			log.Warnf("Error sending slo stats: %s", err)
+		}
+	}
+}
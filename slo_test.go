@@ -0,0 +1,160 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+func TestSLOTracker(t *testing.T) {
+	t.Parallel()
+
+	tracker, err := newSLOTracker(sloConfig{
+		Windows: []time.Duration{time.Hour, 24 * time.Hour},
+		Default: sloTarget{Availability: 0.99},
+		Signers: map[string]sloTarget{"slowsigner": {LatencyThreshold: 10 * time.Second, LatencyTarget: 0.9}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 9, 1, 10, 0, 0, 0, time.UTC)
+	tracker.now = func() time.Time { return now }
+
+	// the failures of two hours ago only count in the day
+	for i := 0; i < 10; i++ {
+		tracker.record("fastsigner", time.Millisecond, true)
+	}
+	now = now.Add(2 * time.Hour)
+
+	// 200 operations of which 1 failed and 4 were slower than
+	// the default second
+	for i := 0; i < 200; i++ {
+		latency := 100 * time.Millisecond
+		if i < 4 {
+			latency = 2 * time.Second
+		}
+		tracker.record("fastsigner", latency, i == 199)
+		tracker.record("slowsigner", latency, false)
+	}
+
+	almostEqual := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	slos := tracker.report([]string{"fastsigner", "idlesigner", "slowsigner"})
+	if len(slos) != 3 {
+		t.Fatalf("expected the slos of 3 signers, got %+v", slos)
+	}
+	fast := slos[0]
+	if fast.AvailabilityTarget != 0.99 || fast.LatencyThreshold != "1s" || fast.LatencyTarget != defaultSLOLatencyTarget {
+		t.Fatalf("unexpected objectives %+v", fast)
+	}
+	hour, day := fast.Windows[0], fast.Windows[1]
+	if hour.Window != "1h0m0s" || hour.Operations != 200 || hour.Errors != 1 || hour.Slow != 4 {
+		t.Fatalf("unexpected counts over the hour %+v", hour)
+	}
+	// 1 error out of the 2 the objective allows, and 4 slow
+	// operations out of the 1.99 allowed
+	if !almostEqual(hour.Availability, 0.995) || !almostEqual(hour.AvailabilityBudgetRemaining, 0.5) || !almostEqual(hour.AvailabilityBurnRate, 0.5) {
+		t.Fatalf("unexpected availability over the hour %+v", hour)
+	}
+	if hour.LatencyBudgetRemaining >= 0 || hour.LatencyBurnRate <= 2 {
+		t.Fatalf("expected the latency budget to be exhausted over the hour, got %+v", hour)
+	}
+	if day.Operations != 210 || day.Errors != 11 || day.AvailabilityBudgetRemaining >= 0 {
+		t.Fatalf("expected the availability budget to be exhausted over the day, got %+v", day)
+	}
+
+	idle := slos[1].Windows[0]
+	if idle.Operations != 0 || idle.Availability != 1 || idle.AvailabilityBudgetRemaining != 1 || idle.LatencyBurnRate != 0 {
+		t.Fatalf("unexpected slo of an idle signer %+v", idle)
+	}
+	slow := slos[2]
+	if slow.LatencyThreshold != "10s" || slow.AvailabilityTarget != 0.99 || slow.Windows[0].Slow != 0 || slow.Windows[0].LatencyBudgetRemaining != 1 {
+		t.Fatalf("unexpected slo of the signer with its own objectives %+v", slow)
+	}
+
+	// the operations roll out of the windows
+	now = now.Add(25 * time.Hour)
+	slos = tracker.report([]string{"fastsigner"})
+	if slos[0].Windows[0].Operations != 0 || slos[0].Windows[1].Operations != 0 {
+		t.Fatalf("expected operations to roll out of the windows, got %+v", slos[0].Windows)
+	}
+
+	for i, conf := range []sloConfig{
+		{Windows: []time.Duration{time.Second}},
+		{Default: sloTarget{Availability: 1}},
+		{Default: sloTarget{LatencyTarget: 1.5}},
+		{Default: sloTarget{LatencyThreshold: -time.Second}},
+		{Signers: map[string]sloTarget{"foo": {Availability: -1}}},
+	} {
+		_, err = newSLOTracker(conf)
+		if err == nil {
+			t.Fatalf("testcase %d: expected invalid slo configuration to fail", i)
+		}
+	}
+}
+
+func TestHandleSLO(t *testing.T) {
+	t.Parallel()
+
+	signerID := conf.Signers[0].ID
+	tmpag := newAutographer(100)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners([]signer.Configuration{conf.Signers[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := authorization{ID: "slouser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: []string{signerID}}
+	err = tmpag.addAuthorizations([]authorization{auth})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getSLO := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		tmpag.handleSLO(w, httptest.NewRequest("GET", "http://foo.bar/__slo__", nil))
+		return w
+	}
+	if w := getSLO(); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without slo tracking, got %d", w.Code)
+	}
+	err = tmpag.enableSLO(sloConfig{Enabled: true, Signers: map[string]sloTarget{"unknown": {}}})
+	if err == nil {
+		t.Fatal("expected the slo of an unknown signer to fail")
+	}
+	err = tmpag.enableSLO(sloConfig{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`[{"input": "Y2FyaWJvdW1hdXJpY2UK", "keyid": "` + signerID + `"}]`)
+	req := httptest.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+	w := httptest.NewRecorder()
+	tmpag.handleSignature(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("signing failed with %d: %s", w.Code, w.Body.String())
+	}
+
+	w = getSLO()
+	var slos []formats.SignerSLO
+	err = json.Unmarshal(w.Body.Bytes(), &slos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slos) != 1 || slos[0].SignerID != signerID || len(slos[0].Windows) != len(defaultSLOWindows) ||
+		slos[0].Windows[0].Operations != 1 || slos[0].Windows[0].Errors != 0 || slos[0].AvailabilityTarget != defaultSLOAvailability {
+		t.Fatalf("unexpected slos %+v", slos)
+	}
+}
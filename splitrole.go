@@ -0,0 +1,313 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/autograph/signer/mar"
+	"go.mozilla.org/autograph/signer/xpi"
+)
+
+const (
+	// roleFrontend serves the API and forwards signing operations
+	// to workers
+	roleFrontend = "frontend"
+
+	// roleWorker signs the operations of frontends with its HSM
+	// and keys
+	roleWorker = "worker"
+
+	// defaultWorkerTimeout is how long a frontend waits for a
+	// worker when the configuration does not set a timeout
+	defaultWorkerTimeout = 30 * time.Second
+)
+
+// splitRoleConfig runs autograph as one tier of a split deployment:
+// stateless frontends serving the API, and signing workers attached to
+// the HSM in a locked-down network segment. Frontends and workers
+// authenticate each other with certificates issued by CACert.
+type splitRoleConfig struct {
+	// Role is "frontend" or "worker". Autograph serves the API
+	// and signs in the same process when it is empty.
+	Role string
+
+	// Workers are the base URLs of the workers of a frontend.
+	// Frontends send each operation to the next worker, and
+	// retry on the others when a worker is unavailable.
+	Workers []string
+
+	// CACert is the path to the PEM certificate of the CA that
+	// issues the certificates of frontends and workers
+	CACert string
+
+	// ClientCert and ClientKey are the paths to the PEM
+	// certificate and key frontends present to workers. Workers
+	// use the server TLS certificate and key.
+	ClientCert string
+	ClientKey  string
+
+	// AllowedClients are the common names of the frontend
+	// certificates workers accept. Workers accept any
+	// certificate issued by CACert when it is empty.
+	AllowedClients []string
+
+	// Timeout is how long a frontend waits for a worker to sign.
+	// Defaults to 30s.
+	Timeout time.Duration
+}
+
+// validateSplitRole checks the role of a configuration before the HSM
+// is initialized. Frontends serve the API from a network segment
+// without access to the HSM or keys.
+func validateSplitRole(conf configuration) error {
+	switch conf.SplitRole.Role {
+	case "", roleWorker:
+	case roleFrontend:
+		if conf.HSM.Path != "" || len(conf.Signers) > 0 {
+			return errors.New("frontends must not configure an HSM or signers, they use the signers of workers")
+		}
+	default:
+		return errors.Errorf("unknown role %q, must be %q or %q", conf.SplitRole.Role, roleFrontend, roleWorker)
+	}
+	return nil
+}
+
+// enableSplitRole adds the signers of the role of the instance:
+// frontends use the signers of their workers, workers and standalone
+// instances the signers of the configuration. Workers only accept the
+// allowed frontends.
+func (a *autographer) enableSplitRole(conf splitRoleConfig, signerConfs []signer.Configuration) error {
+	if conf.Role == roleFrontend {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultWorkerTimeout)
+		defer cancel()
+		return a.addWorkerSigners(ctx, conf)
+	}
+	err := a.addSigners(signerConfs)
+	if err != nil {
+		return err
+	}
+	if conf.Role == roleWorker {
+		a.allowedFrontends = make(map[string]bool)
+		for _, cn := range conf.AllowedClients {
+			a.allowedFrontends[cn] = true
+		}
+	}
+	return nil
+}
+
+// loadCertPool returns a pool with the PEM certificates of a file
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read CA certificate")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("no PEM certificate found in %q", path)
+	}
+	return pool, nil
+}
+
+// configureWorkerTLS requires frontends to present a certificate
+// issued by the CA of the split deployment to connect to a worker
+func configureWorkerTLS(conf configuration, server *http.Server) error {
+	if !conf.hasTLS() {
+		return errors.New("workers require a server TLS certificate and key")
+	}
+	if conf.SplitRole.CACert == "" {
+		return errors.New("workers require a CA certificate to authenticate frontends")
+	}
+	pool, err := loadCertPool(conf.SplitRole.CACert)
+	if err != nil {
+		return err
+	}
+	// keep the HTTP/2 settings of newServer
+	if server.TLSConfig == nil {
+		server.TLSConfig = &tls.Config{}
+	}
+	server.TLSConfig.ClientCAs = pool
+	server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return nil
+}
+
+// authorizeFrontend checks the client certificate of a worker request
+// was issued to an allowed frontend. It writes an error to the client
+// and returns false when it wasn't.
+func (a *autographer) authorizeFrontend(w http.ResponseWriter, r *http.Request) bool {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		httpError(w, r, http.StatusUnauthorized, formats.ErrorCodeUnauthorized, "missing frontend client certificate")
+		return false
+	}
+	if len(a.allowedFrontends) == 0 {
+		return true
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if !a.allowedFrontends[cn] {
+		a.authorizationDenied(w, r, http.StatusForbidden, formats.ErrorCodeUnauthorized, cn, "", errors.Errorf("frontend %q is not allowed", cn))
+		return false
+	}
+	return true
+}
+
+// handleWorkerSigners returns the signers of a worker to a frontend
+func (a *autographer) handleWorkerSigners(w http.ResponseWriter, r *http.Request) {
+	if !a.authorizeFrontend(w, r) {
+		return
+	}
+	var descs []formats.WorkerSigner
+	for _, s := range a.getSigners() {
+		s, err := resolveSigner(s)
+		if err != nil {
+			// frontends don't see unavailable signers,
+			// and reject authorizations that use them
+			log.Errorf("not exporting unavailable signer to frontends: %v", err)
+			continue
+		}
+		conf := s.Config()
+		desc := formats.WorkerSigner{
+			ID:        conf.ID,
+			Type:      conf.Type,
+			Mode:      conf.Mode,
+			Hash:      conf.Hash,
+			PublicKey: conf.PublicKey,
+			X5U:       conf.X5U,
+		}
+		if conf.SignerOpts != nil {
+			desc.SignerOpts, err = json.Marshal(conf.SignerOpts)
+			if err != nil {
+				httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "failed to marshal options of signer %q: %v", conf.ID, err)
+				return
+			}
+		}
+		_, desc.HashSigning = s.(signer.HashSigner)
+		_, desc.DataSigning = s.(signer.DataSigner)
+		_, desc.FileSigning = s.(signer.FileSigner)
+		if tfg, ok := s.(signer.TestFileGetter); ok && !desc.DataSigning {
+			desc.TestFile = tfg.GetTestFile()
+		}
+		descs = append(descs, desc)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(descs)
+}
+
+// handleWorkerSign signs an operation forwarded by a frontend, which
+// already authorized and checked the request of its user
+func (a *autographer) handleWorkerSign(w http.ResponseWriter, r *http.Request) {
+	if !a.authorizeFrontend(w, r) {
+		return
+	}
+	starttime := getRequestStartTime(r)
+	var req formats.WorkerSignRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "failed to parse worker request: %v", err)
+		return
+	}
+	s, ok := a.getSignerByID(req.SignerID)
+	if !ok {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "unknown signer %q", req.SignerID)
+		return
+	}
+	s, err = resolveSigner(s)
+	if err != nil {
+		httpError(w, r, http.StatusServiceUnavailable, formats.ErrorCodeSignerUnavailable, "%v", err)
+		return
+	}
+	var options interface{}
+	if req.DefaultOptions {
+		if ds, ok := s.(interface{ GetDefaultOptions() interface{} }); ok {
+			options = ds.GetDefaultOptions()
+		}
+	} else if len(req.Options) > 0 {
+		err = json.Unmarshal(req.Options, &options)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "failed to parse signing options: %v", err)
+			return
+		}
+	}
+	ctx, cancel := a.requestContext(r)
+	defer cancel()
+	if len(req.AllowedAddOnIDs) > 0 {
+		ctx = xpi.WithAllowedIDs(ctx, req.AllowedAddOnIDs)
+	}
+	if len(req.AllowedChannels) > 0 {
+		ctx = mar.WithAllowedChannels(ctx, req.AllowedChannels)
+	}
+
+	var (
+		resp formats.WorkerSignResponse
+		sig  signer.Signature
+	)
+	switch req.Operation {
+	case formats.WorkerOperationHash:
+		hashSigner, ok := s.(signer.HashSigner)
+		if !ok {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeUnsupportedOperation, "signer %q does not implement hash signing", req.SignerID)
+			return
+		}
+		sig, err = signer.SignHashContext(ctx, hashSigner, req.Input, options)
+	case formats.WorkerOperationData:
+		dataSigner, ok := s.(signer.DataSigner)
+		if !ok {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeUnsupportedOperation, "signer %q does not implement data signing", req.SignerID)
+			return
+		}
+		sig, err = signer.SignDataContext(ctx, dataSigner, req.Input, options)
+	case formats.WorkerOperationFile:
+		fileSigner, ok := s.(signer.FileSigner)
+		if !ok {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeUnsupportedOperation, "signer %q does not implement file signing", req.SignerID)
+			return
+		}
+		var artifacts []signer.Artifact
+		if artifactsSigner, ok := s.(signer.ArtifactsFileSigner); ok {
+			resp.SignedFile, artifacts, err = artifactsSigner.SignFileArtifacts(ctx, req.Input, options)
+		} else {
+			resp.SignedFile, err = signer.SignFileContext(ctx, fileSigner, req.Input, options)
+		}
+		for _, artifact := range artifacts {
+			resp.Artifacts = append(resp.Artifacts, formats.Artifact{
+				Name:        artifact.Name,
+				ContentType: artifact.ContentType,
+				Data:        base64.StdEncoding.EncodeToString(artifact.Data),
+			})
+		}
+	default:
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "unknown operation %q", req.Operation)
+		return
+	}
+	if err == nil && sig != nil {
+		resp.Signature, err = sig.Marshal()
+	}
+	if err != nil {
+		status, code := signingError(ctx, err)
+		httpError(w, r, status, code, "signing failed with error: %v", err)
+		return
+	}
+	resp.X5U = s.Config().X5U
+	log.WithFields(log.Fields{
+		"rid":          getRequestID(r),
+		"frontend_rid": req.RequestID,
+		"signer_id":    req.SignerID,
+		"operation":    req.Operation,
+		"t":            int32(time.Since(starttime) / time.Millisecond),
+	}).Info("worker signing operation succeeded")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,315 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+	margo "go.mozilla.org/mar"
+)
+
+// splitRoleCA issues the certificates of frontends and workers in tests
+type splitRoleCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newSplitRoleCA(t *testing.T, dir string) *splitRoleCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "split role test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &splitRoleCA{cert: cert, key: key, dir: dir}
+	ca.write(t, "ca.pem", "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *splitRoleCA) write(t *testing.T, name, blockType string, der []byte) string {
+	path := filepath.Join(ca.dir, name)
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// issue returns the paths to the PEM certificate and key of cn
+func (ca *splitRoleCA) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca.write(t, cn+".pem", "CERTIFICATE", der), ca.write(t, cn+"-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+// newTestWorker starts a worker with the signers of the configuration
+// that only accepts the frontends in allowed
+func newTestWorker(t *testing.T, ca *splitRoleCA, signerIDs []string, allowed ...string) *httptest.Server {
+	worker := newAutographer(100)
+	var confs []signer.Configuration
+	for _, s := range conf.Signers {
+		for _, id := range signerIDs {
+			if s.ID == id {
+				confs = append(confs, s)
+			}
+		}
+	}
+	err := worker.addSigners(confs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker.allowedFrontends = make(map[string]bool)
+	for _, cn := range allowed {
+		worker.allowedFrontends[cn] = true
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/__lbheartbeat__", handleLBHeartbeat)
+	mux.HandleFunc("/internal/signers", worker.handleWorkerSigners)
+	mux.HandleFunc("/internal/sign", worker.handleWorkerSign)
+
+	certPath, keyPath := ca.issue(t, "worker-"+id(), x509.ExtKeyUsageServerAuth)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := loadCertPool(filepath.Join(ca.dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(mux)
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	srv.StartTLS()
+	return srv
+}
+
+func TestSplitRoleSigning(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "autograph-splitrole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newSplitRoleCA(t, dir)
+	clientCert, clientKey := ca.issue(t, "frontend", x509.ExtKeyUsageClientAuth)
+	worker := newTestWorker(t, ca, []string{"appkey1", "testmar", "testapp-android"}, "frontend")
+	defer worker.Close()
+
+	// the first worker is down, so frontends fail over to the second
+	frontend := newAutographer(100)
+	frontend.hawkMaxTimestampSkew = time.Minute
+	err = frontend.addWorkerSigners(context.Background(), splitRoleConfig{
+		Role:       roleFrontend,
+		Workers:    []string{"https://127.0.0.1:1", worker.URL + "/"},
+		CACert:     filepath.Join(dir, "ca.pem"),
+		ClientCert: clientCert,
+		ClientKey:  clientKey,
+	})
+	if err != nil {
+		t.Fatalf("failed to add worker signers: %v", err)
+	}
+	if len(frontend.getSigners()) != 3 {
+		t.Fatalf("expected 3 worker signers, got %d", len(frontend.getSigners()))
+	}
+	if n := frontend.workers.available(context.Background()); n != 1 {
+		t.Fatalf("expected 1 available worker, got %d", n)
+	}
+	user := authorization{ID: "splitroleuser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: []string{"appkey1", "testmar"}}
+	err = frontend.addAuthorizations([]authorization{user})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(endpoint, keyid string, input []byte) (*httptest.ResponseRecorder, []formats.SignatureResponse) {
+		body, err := json.Marshal([]formats.SignatureRequest{{Input: base64.StdEncoding.EncodeToString(input), KeyID: keyid}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar"+endpoint, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, user.ID, user.Key, sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		frontend.handleSignature(w, req)
+		var resps []formats.SignatureResponse
+		if w.Code == http.StatusCreated {
+			err = json.Unmarshal(w.Body.Bytes(), &resps)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, resps
+	}
+
+	input := []byte("signed by a worker")
+	w, resps := sign("/sign/data", "appkey1", input)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("data signing failed with %d: %s", w.Code, w.Body.String())
+	}
+	err = verifyContentSignature(base64.StdEncoding.EncodeToString(input), "/sign/data", resps[0].Signature, resps[0].PublicKey)
+	if err != nil {
+		t.Fatalf("failed to verify worker signature: %v", err)
+	}
+
+	// errors of workers are returned to the client with their code
+	w, _ = sign("/sign/hash", "appkey1", []byte("not a hash"))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected hash of invalid length to fail with 400, got %d: %s", w.Code, w.Body.String())
+	}
+	var errResp formats.ErrorResponse
+	err = json.Unmarshal(w.Body.Bytes(), &errResp)
+	if err != nil || errResp.Code != formats.ErrorCodeInvalidInput {
+		t.Fatalf("expected the error code of the worker, got %s", w.Body.String())
+	}
+
+	// worker signers keep the signing interfaces of their type
+	apkSigner, ok := frontend.getSignerByID("testapp-android")
+	if !ok {
+		t.Fatal("missing apk2 worker signer")
+	}
+	if _, ok := apkSigner.(signer.DataSigner); ok {
+		t.Fatal("expected the apk2 worker signer not to sign data")
+	}
+	if len(apkSigner.(signer.TestFileGetter).GetTestFile()) == 0 {
+		t.Fatal("expected the apk2 worker signer to return its test file")
+	}
+
+	// miniMarB from the mar signer unit tests
+	marFile, err := base64.StdEncoding.DecodeString("TUFSMQAAAX0AAAAAAAABlgAAAAIAAAACAAABACDExrLgT1Lc1TbLUiKbIVxQl60L6ATvYe6L6JwewAbVSjhEUCGMQ0OK1TmKi18GGijNxaf/uU7Lm/RTyvm0VL7gcODm/pogDmRttf+rc2UfX7nthPxCgB/oOj7fXqDwYpiBPNSSHMIATUb7fnRRHqVTdqhkQZ2RqQsyKL7O6D/bN62EHmVTnn5LbYqYnDLhp+bEVGPo9ETsUpSk7XlFq3v96blLi4Iazm4LyPUXtQmixNwe6OOGpS+ZqobGAtooe7nPPC0Q/kqqKKQmcwCyTP/+lD1Vk7JXbDyGzYj9f9Cloq8PH7gyxOmNvwfHxMU95Jw/ExdFUDdK6QW7UPRTx7AAAAADAAAAQMSHgnYz95K8msSv6YA6IWRfT99ig0W74KDl0QvM0Ti+BRvI7FSmjjt4QOfVHRDko31NuVa2sUCo/PibauLI7GwAAAAAYWFhYWFhYWFhYWFhYWFhYWFhYWFhAAAAFQAAAWgAAAAVAAACWC9mb28vYmFyAA==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, resps = sign("/sign/file", "testmar", marFile)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("file signing failed with %d: %s", w.Code, w.Body.String())
+	}
+	signedFile, err := base64.StdEncoding.DecodeString(resps[0].SignedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signedMar margo.File
+	err = margo.Unmarshal(signedFile, &signedMar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawKey, err := base64.StdEncoding.DecodeString(resps[0].PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.ParsePKIXPublicKey(rawKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = signedMar.VerifySignature(key)
+	if err != nil {
+		t.Fatalf("failed to verify mar signed by a worker: %v", err)
+	}
+}
+
+func TestSplitRoleRejectsFrontends(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "autograph-splitrole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newSplitRoleCA(t, dir)
+	clientCert, clientKey := ca.issue(t, "frontend", x509.ExtKeyUsageClientAuth)
+	worker := newTestWorker(t, ca, []string{"appkey1"}, "another-frontend")
+	defer worker.Close()
+
+	splitConf := splitRoleConfig{
+		Role:       roleFrontend,
+		Workers:    []string{worker.URL},
+		CACert:     filepath.Join(dir, "ca.pem"),
+		ClientCert: clientCert,
+		ClientKey:  clientKey,
+	}
+	err = newAutographer(1).addWorkerSigners(context.Background(), splitConf)
+	if err == nil || !strings.Contains(err.Error(), `frontend "frontend" is not allowed`) {
+		t.Fatalf("expected worker to reject the frontend, got %v", err)
+	}
+
+	// frontends without a client certificate can't connect
+	splitConf.ClientCert = ""
+	err = newAutographer(1).addWorkerSigners(context.Background(), splitConf)
+	if err == nil {
+		t.Fatal("expected frontend without a client certificate to fail")
+	}
+	resp, err := worker.Client().Get(worker.URL + "/internal/signers")
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("expected worker to refuse connections without a client certificate")
+	}
+}
@@ -0,0 +1,198 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer/contentsignaturepki"
+)
+
+// defaultStandbySyncInterval is how often a standby instance syncs the
+// end-entities of its signers when the configuration does not set an
+// interval
+const defaultStandbySyncInterval = 30 * time.Second
+
+// standbyConfig starts the instance as a warm standby of a primary
+// sharing its database: it initializes its signers but isn't ready to
+// serve signing requests until an admin promotes it, and syncs the
+// end-entities rotated by the primary in the meantime
+type standbyConfig struct {
+	Enabled bool
+
+	// SyncInterval is how often end-entities are synced from the
+	// database
+	SyncInterval time.Duration
+}
+
+// endEntitySyncer is implemented by signers whose end-entity can be
+// rotated by another instance through the database, like the
+// contentsignaturepki signers
+type endEntitySyncer interface {
+	Sync(ctx context.Context) (changed bool, err error)
+}
+
+// standby syncs the signers of a standby instance until it is promoted
+type standby struct {
+	// promoteMu serializes syncs and promotions, so a promotion
+	// waits for a sync in progress and syncs one last time
+	promoteMu sync.Mutex
+	interval  time.Duration
+}
+
+// enableStandby starts the instance as a standby of the primary sharing
+// its database, when the configuration enables it
+func (a *autographer) enableStandby(conf standbyConfig, role string) error {
+	if !conf.Enabled {
+		return nil
+	}
+	if a.db == nil {
+		return errors.New("standby instances require the database of the primary")
+	}
+	if role != "" {
+		return errors.New("standby instances are not supported in split-role deployments")
+	}
+	a.initStandby(conf)
+	log.Warnf("starting as a standby instance, syncing signers every %s until promoted", a.standby.interval)
+	return nil
+}
+
+// initStandby starts the instance as a standby, and syncs its signers
+// in the background until it is promoted
+func (a *autographer) initStandby(conf standbyConfig) {
+	if conf.SyncInterval <= 0 {
+		conf.SyncInterval = defaultStandbySyncInterval
+	}
+	a.standby = &standby{interval: conf.SyncInterval}
+	atomic.StoreInt32(&a.standingBy, 1)
+	go a.syncSignersEvery(conf.SyncInterval)
+}
+
+// isStandby returns whether the instance is a standby that wasn't
+// promoted yet
+func (a *autographer) isStandby() bool {
+	return atomic.LoadInt32(&a.standingBy) == 1
+}
+
+// syncSigners syncs the end-entities of signers from the database, and
+// returns the error of the first signer that failed
+func (a *autographer) syncSigners(ctx context.Context) (err error) {
+	for _, s := range a.getSigners() {
+		if d, ok := s.(deferredSigner); ok {
+			// lazy signers load the current end-entity when
+			// they are initialized
+			s = d.initialized()
+		}
+		syncer, ok := s.(endEntitySyncer)
+		if !ok {
+			continue
+		}
+		_, syncErr := syncer.Sync(ctx)
+		if syncErr != nil {
+			log.WithFields(log.Fields{"signer_id": s.Config().ID}).Errorf("standby: failed to sync signer: %v", syncErr)
+			if err == nil {
+				err = syncErr
+			}
+		}
+	}
+	return err
+}
+
+// syncSignersEvery syncs the signers at an interval until the instance
+// is promoted
+func (a *autographer) syncSignersEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		a.standby.promoteMu.Lock()
+		if !a.isStandby() {
+			a.standby.promoteMu.Unlock()
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		a.syncSigners(ctx)
+		cancel()
+		a.standby.promoteMu.Unlock()
+	}
+}
+
+// checkHSMAccess checks the HSM answers with the signer configuration
+// the heartbeat uses, when signers use an HSM
+func (a *autographer) checkHSMAccess() error {
+	if a.heartbeatConf == nil || a.heartbeatConf.hsmSignerConf == nil {
+		return nil
+	}
+	hsmSignerConf := a.heartbeatConf.hsmSignerConf
+	checkResult := make(chan error, 1)
+	go func() {
+		checkResult <- hsmSignerConf.CheckHSMConnection()
+	}()
+	select {
+	case <-time.After(a.heartbeatConf.HSMCheckTimeout):
+		return errors.Errorf("checking HSM connection for signer %s timed out", hsmSignerConf.ID)
+	case err := <-checkResult:
+		return err
+	}
+}
+
+// handlePromoteStandby promotes a standby instance to serve signing
+// requests, after checking it can access the HSM and syncing its
+// signers one last time so they sign with the end-entities of the
+// primary
+func (a *autographer) handlePromoteStandby(w http.ResponseWriter, r *http.Request) {
+	userid, _, ok := a.authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+	if a.standby == nil {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "instance was not started as a standby")
+		return
+	}
+	a.standby.promoteMu.Lock()
+	defer a.standby.promoteMu.Unlock()
+	if !a.isStandby() {
+		httpError(w, r, http.StatusConflict, formats.ErrorCodeInvalidRequest, "standby instance was already promoted")
+		return
+	}
+	err := a.checkHSMAccess()
+	if err != nil {
+		httpError(w, r, http.StatusServiceUnavailable, formats.ErrorCodeHSMUnavailable, "refusing to promote standby instance: %v", err)
+		return
+	}
+	err = a.syncSigners(r.Context())
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "refusing to promote standby instance: %v", err)
+		return
+	}
+	atomic.StoreInt32(&a.standingBy, 0)
+	resp := formats.Promotion{
+		PromotedAt:  time.Now().UTC(),
+		EndEntities: []formats.EndEntity{},
+	}
+	for _, s := range a.getSigners() {
+		if d, ok := s.(deferredSigner); ok {
+			s = d.initialized()
+		}
+		if pkiSigner, ok := s.(*contentsignaturepki.ContentSigner); ok {
+			label, x5u := pkiSigner.EndEntity()
+			resp.EndEntities = append(resp.EndEntities, formats.EndEntity{
+				SignerID: pkiSigner.ID,
+				Label:    label,
+				X5U:      x5u,
+			})
+		}
+	}
+	log.WithFields(log.Fields{
+		"rid":     getRequestID(r),
+		"user_id": userid,
+	}).Warn("promoted standby instance")
+	writeAdminJSON(w, r, resp)
+}
@@ -0,0 +1,117 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+// syncingSigner counts the syncs of its end-entity, and fails them
+// with err
+type syncingSigner struct {
+	conf  signer.Configuration
+	syncs int32
+	err   error
+}
+
+func (s *syncingSigner) Config() signer.Configuration { return s.conf }
+
+func (s *syncingSigner) Sync(ctx context.Context) (bool, error) {
+	atomic.AddInt32(&s.syncs, 1)
+	return false, s.err
+}
+
+func TestPromoteStandby(t *testing.T) {
+	t.Parallel()
+
+	var signerConfs []signer.Configuration
+	for _, s := range conf.Signers {
+		if s.ID == "normandy" {
+			signerConfs = append(signerConfs, s)
+		}
+	}
+	tmpag := newAutographer(10)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	tmpag.heartbeatConf = &heartbeatConfig{}
+	err := tmpag.addSigners(signerConfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncer := &syncingSigner{conf: signer.Configuration{ID: "standbysyncer", Type: "syncing"}, err: errors.New("database unavailable")}
+	tmpag.addSigner(syncer)
+	user := authorization{ID: "standbyuser", Key: "n8c3kq0wz5xbv2mfj7thd4rgp9yl6sae1uo0ik3wq7mzc5xb8v", Signers: []string{"normandy"}}
+	admin := authorization{ID: "standbyadmin", Key: "r5mz2xq8kc0vbn4tj7fwh1dl9gp3syae6uo2ik8wq0mzx5cb7v", Admin: true}
+	err = tmpag.addAuthorizations([]authorization{user, admin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.setReady()
+	promote := func(auth authorization) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "http://foo.bar/admin/standby/promote", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", []byte("")))
+		w := httptest.NewRecorder()
+		tmpag.handlePromoteStandby(w, req)
+		return w
+	}
+
+	w := promote(admin)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected promoting an instance that isn't a standby to fail, got %d: %s", w.Code, w.Body.String())
+	}
+
+	tmpag.initStandby(standbyConfig{SyncInterval: time.Hour})
+	if ready, reason := tmpag.readiness(); ready || reason != "standby" {
+		t.Fatalf("expected standby instance not to be ready, got %v %q", ready, reason)
+	}
+	w = promote(user)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected promotion by a non-admin to fail, got %d: %s", w.Code, w.Body.String())
+	}
+	w = promote(admin)
+	if w.Code != http.StatusInternalServerError || atomic.LoadInt32(&syncer.syncs) != 1 {
+		t.Fatalf("expected promotion to fail when a signer fails to sync, got %d: %s", w.Code, w.Body.String())
+	}
+	if !tmpag.isStandby() {
+		t.Fatal("expected instance to stay a standby after a failed promotion")
+	}
+
+	syncer.err = nil
+	w = promote(admin)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected promotion to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp formats.Promotion
+	err = json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := tmpag.getSignerByID("normandy")
+	if len(resp.EndEntities) != 1 || resp.EndEntities[0].SignerID != "normandy" || resp.EndEntities[0].X5U != s.Config().X5U {
+		t.Fatalf("expected promotion to return the end-entity of normandy, got %s", w.Body.String())
+	}
+	if ready, reason := tmpag.readiness(); !ready {
+		t.Fatalf("expected promoted instance to be ready, got %q", reason)
+	}
+
+	w = promote(admin)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected promoting twice to fail, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,146 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"go.mozilla.org/autograph/formats"
+)
+
+const (
+	// contentTypeNDJSON streams batch signature responses as one
+	// JSON event per line
+	contentTypeNDJSON = "application/x-ndjson"
+
+	// contentTypeEventStream streams batch signature responses as
+	// server-sent events
+	contentTypeEventStream = "text/event-stream"
+)
+
+// streamContentType returns the streaming content type a client
+// accepts for the responses of a batch signature request, or an empty
+// string when it expects a JSON array of all responses
+func streamContentType(r *http.Request) string {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case contentTypeNDJSON, contentTypeEventStream:
+			return mediaType
+		}
+	}
+	return ""
+}
+
+// resultStream writes the responses of a batch signature request to
+// the client as each of them completes, instead of buffering the whole
+// batch. Until the first response is streamed, errors are sent with
+// their usual status. After that, the status was sent already, so
+// errors written with httpError are streamed as an error event.
+type resultStream struct {
+	http.ResponseWriter
+	contentType string
+
+	// index is the signature request being processed, which
+	// streamed errors refer to
+	index int
+
+	started   bool
+	errHeader http.Header
+}
+
+func newResultStream(w http.ResponseWriter, contentType string) *resultStream {
+	return &resultStream{ResponseWriter: w, contentType: contentType}
+}
+
+// Header returns a scratch header once the stream started, since the
+// headers were sent with the first response
+func (s *resultStream) Header() http.Header {
+	if !s.started {
+		return s.ResponseWriter.Header()
+	}
+	if s.errHeader == nil {
+		s.errHeader = make(http.Header)
+	}
+	return s.errHeader
+}
+
+func (s *resultStream) WriteHeader(status int) {
+	if !s.started {
+		s.ResponseWriter.WriteHeader(status)
+	}
+}
+
+// Write streams the error response httpError writes once the stream
+// started as an error event
+func (s *resultStream) Write(data []byte) (int, error) {
+	if !s.started {
+		return s.ResponseWriter.Write(data)
+	}
+	var errResp formats.ErrorResponse
+	err := json.Unmarshal(data, &errResp)
+	if err != nil {
+		return 0, err
+	}
+	err = s.writeEvent(formats.SignatureStreamEvent{Index: s.index, Error: &errResp}, false)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// start sends the status and headers of the stream
+func (s *resultStream) start() {
+	if s.started {
+		return
+	}
+	h := s.ResponseWriter.Header()
+	h.Set("Content-Type", s.contentType)
+	h.Set("Cache-Control", "no-cache")
+	s.ResponseWriter.WriteHeader(http.StatusCreated)
+	s.started = true
+}
+
+// writeResponse streams the response to the signature request at
+// index. Fault injection truncates the event when truncate is set.
+func (s *resultStream) writeResponse(index int, resp *formats.SignatureResponse, truncate bool) error {
+	s.start()
+	return s.writeEvent(formats.SignatureStreamEvent{Index: index, Response: resp}, truncate)
+}
+
+// writeEvent writes an event in the format of the stream and flushes
+// it to the client
+func (s *resultStream) writeEvent(event formats.SignatureStreamEvent, truncate bool) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if truncate {
+		data = data[:len(data)/2]
+	}
+	if s.contentType == contentTypeEventStream {
+		name := "signature"
+		if event.Error != nil {
+			name = "error"
+		}
+		_, err = fmt.Fprintf(s.ResponseWriter, "event: %s\ndata: %s\n\n", name, data)
+	} else {
+		_, err = fmt.Fprintf(s.ResponseWriter, "%s\n", data)
+	}
+	if err != nil {
+		return err
+	}
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mozilla.org/autograph/formats"
+)
+
+func TestStreamContentType(t *testing.T) {
+	t.Parallel()
+
+	for accept, expected := range map[string]string{
+		"":                                       "",
+		"application/json":                       "",
+		"application/x-ndjson":                   contentTypeNDJSON,
+		"text/event-stream; charset=utf-8":       contentTypeEventStream,
+		"application/json, application/x-ndjson": contentTypeNDJSON,
+		"invalid;;, text/event-stream":           contentTypeEventStream,
+	} {
+		req := httptest.NewRequest("POST", "http://foo.bar/sign/data", nil)
+		req.Header.Set("Accept", accept)
+		if contentType := streamContentType(req); contentType != expected {
+			t.Errorf("expected Accept %q to stream as %q, got %q", accept, expected, contentType)
+		}
+	}
+}
+
+func TestStreamSignatureResponses(t *testing.T) {
+	t.Parallel()
+
+	auth := conf.Authorizations[0]
+	input := base64.StdEncoding.EncodeToString([]byte("foobarbaz1234abcd"))
+	sign := func(accept string, sigreqs []formats.SignatureRequest) *httptest.ResponseRecorder {
+		body, err := json.Marshal(sigreqs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar/sign/data", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", accept)
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		ag.handleSignature(w, req)
+		return w
+	}
+	readEvents := func(w *httptest.ResponseRecorder, eventStream bool) (events []formats.SignatureStreamEvent) {
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if eventStream {
+				if !strings.HasPrefix(line, "data: ") {
+					continue
+				}
+				line = strings.TrimPrefix(line, "data: ")
+			}
+			var event formats.SignatureStreamEvent
+			err := json.Unmarshal([]byte(line), &event)
+			if err != nil {
+				t.Fatalf("failed to parse streamed event %q: %v", line, err)
+			}
+			events = append(events, event)
+		}
+		return events
+	}
+
+	batch := []formats.SignatureRequest{
+		{Input: input, KeyID: "appkey1"},
+		{Input: input, KeyID: "appkey2"},
+		{Input: input, KeyID: "appkey1"},
+	}
+	for _, contentType := range []string{contentTypeNDJSON, contentTypeEventStream} {
+		w := sign(contentType, batch)
+		if w.Code != http.StatusCreated || w.Header().Get("Content-Type") != contentType {
+			t.Fatalf("expected %s stream, got %d %q: %s", contentType, w.Code, w.Header().Get("Content-Type"), w.Body.String())
+		}
+		events := readEvents(w, contentType == contentTypeEventStream)
+		if len(events) != len(batch) {
+			t.Fatalf("expected %d streamed events, got %d: %s", len(batch), len(events), w.Body.String())
+		}
+		for i, event := range events {
+			if event.Index != i || event.Error != nil || event.Response == nil || event.Response.SignerID != batch[i].KeyID || event.Response.Signature == "" {
+				t.Fatalf("unexpected streamed event %d: %+v", i, event)
+			}
+		}
+	}
+
+	// an error after the first response ends the stream with an
+	// error event, and is sent with its status before it
+	failing := append(batch[:1:1], formats.SignatureRequest{Input: input, KeyID: "notasigner"})
+	w := sign(contentTypeNDJSON, failing)
+	events := readEvents(w, false)
+	if w.Code != http.StatusCreated || len(events) != 2 || events[1].Index != 1 || events[1].Error == nil ||
+		events[1].Error.Code != formats.ErrorCodeSignerNotPermitted {
+		t.Fatalf("expected a signature and an error event, got %d: %s", w.Code, w.Body.String())
+	}
+	w = sign(contentTypeNDJSON, failing[1:])
+	if w.Code != http.StatusUnauthorized || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected an error response before streaming, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,47 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/signer"
+)
+
+// tempStorageStatsInterval is how often the usage of temporary storage
+// is sent to statsd
+const tempStorageStatsInterval = 10 * time.Second
+
+// sendTempStorageStats sends the disk usage and reservations of the
+// temporary files of signers to statsd every tempStorageStatsInterval,
+// so large signing bursts can be watched against the quota
+func (a *autographer) sendTempStorageStats() {
+	var rejected int64
+	for {
+		time.Sleep(tempStorageStatsInterval)
+		stats, err := signer.GetTempStorageStats()
+		if err == nil {
+			err = a.stats.Gauge("tempstorage.used_bytes", float64(stats.Used), nil, 1)
+		}
+		if err == nil {
+			err = a.stats.Gauge("tempstorage.reserved_bytes", float64(stats.Reserved), nil, 1)
+		}
+		if err == nil {
+			err = a.stats.Gauge("tempstorage.spaces", float64(stats.Spaces), nil, 1)
+		}
+		if err == nil && stats.MaxSize > 0 {
+			err = a.stats.Gauge("tempstorage.quota_utilization", float64(stats.Reserved)/float64(stats.MaxSize), nil, 1)
+		}
+		if err == nil && stats.Rejected > rejected {
+			err = a.stats.Count("tempstorage.rejected", stats.Rejected-rejected, nil, 1)
+			rejected = stats.Rejected
+		}
+		if err != nil {
+			log.Warnf("Error sending temporary storage stats: %s", err)
+		}
+	}
+}
@@ -1,11 +1,8 @@
 package main
 
 import (
-	"archive/zip"
 	"bytes"
-	"crypto/ecdsa"
 	"crypto/sha256"
-	"crypto/sha512"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
@@ -16,9 +13,12 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/pkg/errors"
+	"go.mozilla.org/autograph/client"
 	"go.mozilla.org/autograph/formats"
 	"go.mozilla.org/autograph/signer/apk"
 	"go.mozilla.org/autograph/signer/apk2"
@@ -277,13 +277,10 @@ examples:
 				if err != nil {
 					log.Fatal(err)
 				}
-				var (
-					sigStatus bool
-					sigData   []byte
-				)
+				sigStatus := verify(input, request, response, reqType, roots)
+				var sigData []byte
 				switch response.Type {
 				case contentsignature.Type:
-					sigStatus = verifyContentSignature(input, response, req.URL.RequestURI())
 					sig, err := contentsignature.Unmarshal(response.Signature)
 					if err != nil {
 						log.Fatal(err)
@@ -297,7 +294,6 @@ examples:
 					sigStr += sig.Mode + "=" + response.Signature + "\n"
 					sigData = []byte(sigStr)
 				case xpi.Type:
-					sigStatus = verifyXPI(input, request, response, reqType, roots)
 					switch reqType {
 					case requestTypeData:
 						sigData, err = base64.StdEncoding.DecodeString(response.Signature)
@@ -309,46 +305,17 @@ examples:
 					if err != nil {
 						log.Fatal(err)
 					}
-				case apk.Type:
+				case apk.Type, apk2.Type, mar.Type:
 					sigData, err = base64.StdEncoding.DecodeString(response.SignedFile)
 					if err != nil {
 						log.Fatal(err)
 					}
-					sigStatus = verifyAPK(sigData)
-				case apk2.Type:
-					sigData, err = base64.StdEncoding.DecodeString(response.SignedFile)
-					if err != nil {
-						log.Fatal(err)
-					}
-					sigStatus = verifyAPK2(sigData)
-				case mar.Type:
-					sigStatus = verifyMAR(input)
-					sigData, err = base64.StdEncoding.DecodeString(response.SignedFile)
-					if err != nil {
-						log.Fatal(err)
-					}
-				case genericrsa.Type:
-					err = genericrsa.VerifyGenericRsaSignatureResponse(input, response)
-					if err != nil {
-						log.Fatal(err)
-					}
-					sigStatus = true
-					sigData, err = base64.StdEncoding.DecodeString(response.Signature)
-					if err != nil {
-						log.Fatal(err)
-					}
-				case rsapss.Type:
-					err = rsapss.VerifySignatureFromB64(requests[i].Input, response.Signature, response.PublicKey)
-					if err != nil {
-						log.Fatalf("got error verifying RSA-PSS response: %s", err)
-					}
-					sigStatus = true
+				case genericrsa.Type, rsapss.Type:
 					sigData, err = base64.StdEncoding.DecodeString(response.Signature)
 					if err != nil {
 						log.Fatal(err)
 					}
 				case gpg2.Type, pgp.Type:
-					sigStatus = verifyPGP(input, response.Signature, response.PublicKey)
 					sigData = []byte(response.Signature)
 				default:
 					log.Fatalf("unsupported signature type: %s", response.Type)
@@ -367,6 +334,19 @@ examples:
 					if response.Type == apk.Type {
 						fmt.Fprintf(os.Stderr, "Don't forget to run 'zipalign -c -v 4 %s'\n", outfile)
 					}
+					// write sidecar artifacts next to the output file
+					for _, artifact := range response.Artifacts {
+						artifactData, err := base64.StdEncoding.DecodeString(artifact.Data)
+						if err != nil {
+							log.Fatal(err)
+						}
+						artifactPath := filepath.Join(filepath.Dir(outfile), filepath.Base(artifact.Name))
+						err = ioutil.WriteFile(artifactPath, artifactData, 0644)
+						if err != nil {
+							log.Fatal(err)
+						}
+						log.Printf("artifact %q written to %s", artifact.Name, artifactPath)
+					}
 				}
 				if outkeyfile != "" {
 					err = ioutil.WriteFile(outkeyfile, []byte(response.PublicKey), 0644)
@@ -401,129 +381,32 @@ func getAuthHeader(req *http.Request, user, token string, hash func() hash.Hash,
 	return auth.RequestHeader()
 }
 
-// verify an ecdsa signature
-func verifyContentSignature(input []byte, resp formats.SignatureResponse, endpoint string) bool {
-	keyBytes, err := base64.StdEncoding.DecodeString(resp.PublicKey)
-	if err != nil {
-		log.Fatal(err)
-	}
-	keyInterface, err := x509.ParsePKIXPublicKey(keyBytes)
-	if err != nil {
-		log.Fatal(err)
-	}
-	pubKey := keyInterface.(*ecdsa.PublicKey)
-	if endpoint == "/sign/data" {
-		var templated []byte
-		templated = make([]byte, len("Content-Signature:\x00")+len(input))
-		copy(templated[:len("Content-Signature:\x00")], []byte("Content-Signature:\x00"))
-		copy(templated[len("Content-Signature:\x00"):], input)
-
-		var md hash.Hash
-		switch pubKey.Params().Name {
-		case "P-256":
-			md = sha256.New()
-		case "P-384":
-			md = sha512.New384()
-		case "P-521":
-			md = sha512.New()
-		default:
-			log.Fatalf("unsupported curve algorithm %q", pubKey.Params().Name)
-		}
-		md.Write(templated)
-		input = md.Sum(nil)
-	}
-	sig, err := contentsignature.Unmarshal(resp.Signature)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return ecdsa.Verify(pubKey, input, sig.R, sig.S)
-}
-
-func verifyXPI(input []byte, req formats.SignatureRequest, resp formats.SignatureResponse, reqType requestType, roots *x509.CertPool) bool {
+// verify checks a signature response with the client package and
+// skips signer types it cannot verify
+func verify(input []byte, req formats.SignatureRequest, resp formats.SignatureResponse, reqType requestType, roots *x509.CertPool) bool {
+	opts := &client.VerifyOptions{Roots: roots}
+	var err error
 	switch reqType {
 	case requestTypeData:
-		sig, err := xpi.Unmarshal(resp.Signature, input)
-		if err != nil {
-			log.Fatal(err)
-		}
-		err = sig.VerifyWithChain(nil)
-		if err != nil {
-			log.Fatal(err)
-		}
-		return true
+		// data signatures of xpi are verified without their chain
+		opts.Roots = nil
+		err = client.VerifyData(input, resp, opts)
+	case requestTypeHash:
+		err = client.VerifyHash(input, resp, opts)
 	case requestTypeFile:
-		signedFile, err := base64.StdEncoding.DecodeString(resp.SignedFile)
-		if err != nil {
-			log.Fatal(err)
-		}
-		err = xpi.VerifySignedFile(signedFile, roots, req.Options.(xpi.Options))
-		if err != nil {
-			log.Fatal(err)
+		if xpiOpts, ok := req.Options.(xpi.Options); ok {
+			opts.XPI = xpiOpts
 		}
-		return true
+		err = client.VerifyFile(resp, opts)
 	default:
 		return false
 	}
-}
-
-func verifyAPK(signedAPK []byte) bool {
-	zipReader := bytes.NewReader(signedAPK)
-	r, err := zip.NewReader(zipReader, int64(len(signedAPK)))
-	if err != nil {
-		log.Fatal(err)
-	}
-	var (
-		sigstr  string
-		sigdata []byte
-	)
-	for _, f := range r.File {
-		switch f.Name {
-		case "META-INF/SIGNATURE.SF":
-			rc, err := f.Open()
-			defer rc.Close()
-			if err != nil {
-				log.Fatal(err)
-			}
-			sigdata, err = ioutil.ReadAll(rc)
-			if err != nil {
-				log.Fatal(err)
-			}
-		case "META-INF/SIGNATURE.RSA", "META-INF/SIGNATURE.DSA", "META-INF/SIGNATURE.EC":
-			rc, err := f.Open()
-			defer rc.Close()
-			if err != nil {
-				log.Fatal(err)
-			}
-			rawsig, err := ioutil.ReadAll(rc)
-			if err != nil {
-				log.Fatal(err)
-			}
-			sigstr = base64.StdEncoding.EncodeToString(rawsig)
-		}
+	if errors.Cause(err) == client.ErrUnsupported {
+		log.Printf("%s verification is not implemented, skipping", resp.Type)
+		return true
 	}
-	// convert string format back to signature
-	sig, err := apk.Unmarshal(sigstr, sigdata)
 	if err != nil {
-		log.Fatalf("failed to unmarshal signature: %v", err)
-	}
-	// verify signature on input data
-	if sig.Verify() != nil {
-		log.Fatalf("failed to verify apk signature: %v", sig.Verify())
+		log.Fatal(err)
 	}
 	return true
 }
-
-func verifyMAR(signedMAR []byte) bool {
-	log.Println("mar verification is not implemented, skipping")
-	return true
-}
-
-func verifyPGP(input []byte, signature string, pubkey string) bool {
-	log.Println("pgp verification is not implemented, skipping")
-	return true
-}
-
-func verifyAPK2(input []byte) bool {
-	log.Println("apk2 verification is not implemented, skipping")
-	return true
-}
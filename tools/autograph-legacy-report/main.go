@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"go.mozilla.org/autograph/formats"
+)
+
+func main() {
+	var (
+		confPath, usagePath string
+		jsonOutput          bool
+		usage               []formats.UsageReport
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `%s - report the consumers of legacy content signature signers
+
+Usage: %s -c <autograph.yaml> [-usage <usage.json>] [-json]
+
+`, os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.StringVar(&confPath, "c", "", "path of the autograph configuration, encrypted with sops or not")
+	flag.StringVar(&usagePath, "usage", "", "path of a usage report returned by /admin/usage, to tell active consumers from idle ones")
+	flag.BoolVar(&jsonOutput, "json", false, "write the report in JSON")
+	flag.Parse()
+
+	if confPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	data, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		log.Fatalf("failed to read configuration: %v", err)
+	}
+	conf, err := loadConfig(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if usagePath != "" {
+		data, err = ioutil.ReadFile(usagePath)
+		if err != nil {
+			log.Fatalf("failed to read usage report: %v", err)
+		}
+		// an empty report still tells consumers are idle
+		usage = []formats.UsageReport{}
+		err = json.Unmarshal(data, &usage)
+		if err != nil {
+			log.Fatalf("failed to parse usage report: %v", err)
+		}
+	}
+	report := legacyConsumers(conf, usage)
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = printReport(os.Stdout, report)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/mozilla-services/yaml"
+	"github.com/pkg/errors"
+	"go.mozilla.org/sops"
+	"go.mozilla.org/sops/decrypt"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/autograph/signer/contentsignature"
+)
+
+const (
+	// statusActive consumers signed with a legacy signer during the
+	// usage period
+	statusActive = "active"
+
+	// statusIdle consumers are allowed to use a legacy signer but
+	// didn't sign with it during the usage period
+	statusIdle = "idle"
+
+	// statusUnknown consumers are allowed to use a legacy signer,
+	// without usage to tell whether they do
+	statusUnknown = "unknown"
+
+	// statusUnauthorized consumers signed with a legacy signer
+	// during the usage period but no longer are allowed to
+	statusUnauthorized = "unauthorized"
+)
+
+// autographConfig holds the signers and authorizations of an autograph
+// configuration
+type autographConfig struct {
+	Signers        []signer.Configuration
+	Authorizations []struct {
+		ID      string
+		Signers []string
+	}
+}
+
+// consumer is a user of a legacy content signature signer
+type consumer struct {
+	UserID   string `json:"user_id"`
+	SignerID string `json:"signer_id"`
+
+	// HasX5U is whether the signer sets the x5u of its legacy
+	// signatures, which consumers may already verify with a chain
+	HasX5U bool `json:"has_x5u"`
+
+	Status     string `json:"status"`
+	Signatures int64  `json:"signatures"`
+
+	// LastUsed is the last day of the usage period the consumer
+	// signed with the signer
+	LastUsed string `json:"last_used,omitempty"`
+}
+
+// loadConfig reads the signers and authorizations of an autograph
+// configuration, encrypted with sops or not
+func loadConfig(data []byte) (conf autographConfig, err error) {
+	confData, err := decrypt.Data(data, "yaml")
+	if err == sops.MetadataNotFound {
+		confData = data
+	} else if err != nil {
+		return conf, errors.Wrap(err, "failed to load sops encrypted configuration")
+	}
+	err = yaml.Unmarshal(confData, &conf)
+	if err != nil {
+		return conf, errors.Wrap(err, "failed to parse configuration")
+	}
+	return conf, nil
+}
+
+// legacyConsumers returns the users allowed to use the legacy content
+// signature signers of a configuration, and the users of the usage
+// reports that signed with them
+func legacyConsumers(conf autographConfig, usage []formats.UsageReport) []consumer {
+	legacySigners := make(map[string]signer.Configuration)
+	for _, s := range conf.Signers {
+		if s.Type == contentsignature.Type {
+			legacySigners[s.ID] = s
+		}
+	}
+	type key struct{ userID, signerID string }
+	consumers := make(map[key]*consumer)
+	for _, auth := range conf.Authorizations {
+		for _, signerID := range auth.Signers {
+			s, ok := legacySigners[signerID]
+			if !ok {
+				continue
+			}
+			status := statusUnknown
+			if usage != nil {
+				status = statusIdle
+			}
+			consumers[key{auth.ID, signerID}] = &consumer{
+				UserID:   auth.ID,
+				SignerID: signerID,
+				HasX5U:   s.X5U != "",
+				Status:   status,
+			}
+		}
+	}
+	for _, u := range usage {
+		s, ok := legacySigners[u.SignerID]
+		if !ok || u.Signatures == 0 {
+			continue
+		}
+		c, ok := consumers[key{u.UserID, u.SignerID}]
+		if !ok {
+			c = &consumer{
+				UserID:   u.UserID,
+				SignerID: u.SignerID,
+				HasX5U:   s.X5U != "",
+				Status:   statusUnauthorized,
+			}
+			consumers[key{u.UserID, u.SignerID}] = c
+		}
+		if c.Status == statusIdle {
+			c.Status = statusActive
+		}
+		c.Signatures += u.Signatures
+		if u.Day > c.LastUsed {
+			c.LastUsed = u.Day
+		}
+	}
+	var report []consumer
+	for _, c := range consumers {
+		report = append(report, *c)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].SignerID != report[j].SignerID {
+			return report[i].SignerID < report[j].SignerID
+		}
+		return report[i].UserID < report[j].UserID
+	})
+	return report
+}
+
+// printReport writes a table of the consumers of legacy signers
+func printReport(w io.Writer, report []consumer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SIGNER\tUSER\tSTATUS\tSIGNATURES\tLAST USED\tX5U")
+	for _, c := range report {
+		lastUsed := c.LastUsed
+		if lastUsed == "" {
+			lastUsed = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%t\n", c.SignerID, c.UserID, c.Status, c.Signatures, lastUsed, c.HasX5U)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mozilla.org/autograph/formats"
+)
+
+const testConfig = `
+signers:
+- id: legacy
+  type: contentsignature
+- id: legacy-x5u
+  type: contentsignature
+  x5u: https://example.net/chains/legacy.pem
+- id: normandy
+  type: contentsignaturepki
+authorizations:
+- id: alice
+  signers: [legacy, normandy]
+- id: bob
+  signers: [legacy, legacy-x5u]
+- id: carol
+  signers: [normandy]
+`
+
+func TestLegacyConsumers(t *testing.T) {
+	conf, err := loadConfig([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without usage the configuration only tells who may use the
+	// legacy signers
+	report := legacyConsumers(conf, nil)
+	expected := []consumer{
+		{UserID: "alice", SignerID: "legacy", Status: statusUnknown},
+		{UserID: "bob", SignerID: "legacy", Status: statusUnknown},
+		{UserID: "bob", SignerID: "legacy-x5u", HasX5U: true, Status: statusUnknown},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Fatalf("unexpected report without usage %+v", report)
+	}
+
+	usage := []formats.UsageReport{
+		{Day: "2020-09-01", SignerID: "legacy", UserID: "alice", Signatures: 10},
+		{Day: "2020-09-03", SignerID: "legacy", UserID: "alice", Signatures: 5},
+		{Day: "2020-09-02", SignerID: "legacy", UserID: "alice", Signatures: 1},
+		{Day: "2020-09-02", SignerID: "legacy-x5u", UserID: "bob", Errors: 3},
+		{Day: "2020-09-02", SignerID: "legacy", UserID: "dave", Signatures: 2},
+		{Day: "2020-09-02", SignerID: "normandy", UserID: "carol", Signatures: 100},
+	}
+	report = legacyConsumers(conf, usage)
+	expected = []consumer{
+		{UserID: "alice", SignerID: "legacy", Status: statusActive, Signatures: 16, LastUsed: "2020-09-03"},
+		{UserID: "bob", SignerID: "legacy", Status: statusIdle},
+		{UserID: "dave", SignerID: "legacy", Status: statusUnauthorized, Signatures: 2, LastUsed: "2020-09-02"},
+		{UserID: "bob", SignerID: "legacy-x5u", HasX5U: true, Status: statusIdle},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Fatalf("unexpected report with usage %+v", report)
+	}
+
+	var out bytes.Buffer
+	err = printReport(&out, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 || !strings.HasPrefix(lines[0], "SIGNER") || strings.Fields(lines[1])[2] != statusActive {
+		t.Fatalf("unexpected report table:\n%s", out.String())
+	}
+}
@@ -72,6 +72,35 @@ func verifyContentSignature(response formats.SignatureResponse) error {
 	return nil
 }
 
+// validate the signature and chain of a content signature pki response,
+// then check the end-entity covers the clock skew tolerance window
+func verifyContentSignaturePKI(response formats.SignatureResponse) error {
+	err := contentsignaturepki.Verify(response.X5U, response.Signature, []byte(inputdata))
+	if err != nil {
+		return err
+	}
+	certs, err := contentsignaturepki.GetX5U(response.X5U)
+	if err != nil {
+		return err
+	}
+	return verifyClockSkewTolerance(0, certs[0], conf.clockSkewTolerance)
+}
+
+// verifyClockSkewTolerance checks that a certificate is accepted by
+// clients with a clock up to tolerance ahead or behind the monitor's
+func verifyClockSkewTolerance(i int, cert *x509.Certificate, tolerance time.Duration) error {
+	now := time.Now()
+	if now.Add(-tolerance).Before(cert.NotBefore) {
+		return fmt.Errorf("Certificate %d %q is not valid for clients with a clock %s late: notBefore=%s",
+			i, cert.Subject.CommonName, tolerance, cert.NotBefore)
+	}
+	if now.Add(tolerance).After(cert.NotAfter) {
+		return fmt.Errorf("Certificate %d %q is not valid for clients with a clock %s early: notAfter=%s",
+			i, cert.Subject.CommonName, tolerance, cert.NotAfter)
+	}
+	return nil
+}
+
 func parsePublicKeyFromB64(b64PubKey string) (pubkey *ecdsa.PublicKey, err error) {
 	keyBytes, err := base64.StdEncoding.DecodeString(b64PubKey)
 	if err != nil {
@@ -122,6 +151,10 @@ func verifyCertChain(certs []*x509.Certificate) error {
 			return fmt.Errorf("Certificate %d %q is not yet valid: notBefore=%s",
 				i, cert.Subject.CommonName, cert.NotBefore)
 		}
+		err := verifyClockSkewTolerance(i, cert, conf.clockSkewTolerance)
+		if err != nil {
+			return err
+		}
 		log.Printf("Certificate %d %q is valid from %s to %s",
 			i, cert.Subject.CommonName, cert.NotBefore, cert.NotAfter)
 	}
@@ -136,6 +169,9 @@ func verifyRoot(cert *x509.Certificate) error {
 	if !cert.IsCA {
 		return fmt.Errorf("missing IS CA extension")
 	}
+	if conf.roots != nil && !conf.roots.Contains(cert) {
+		return fmt.Errorf("root is not in the root set of environment %q", conf.roots.Name)
+	}
 	if conf.rootHash != "" {
 		rhash := strings.Replace(conf.rootHash, ":", "", -1)
 		// We're configure to check the root hash matches expected value
@@ -4,9 +4,12 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -124,6 +127,52 @@ func TestVerifyFirefoxStagingRoot(t *testing.T) {
 	}
 }
 
+func TestVerifyFirefoxRootWithRootSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autograph-monitor-roots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "stage.pem"), FirefoxPKIStagingRootPEM, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadRootSet(dir, "prod")
+	if err == nil {
+		t.Fatal("expected missing root set to fail")
+	}
+	conf.roots, err = loadRootSet(dir, "stage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.rootHash = ""
+	defer func() { conf.roots = nil }()
+
+	for _, testcase := range []struct {
+		pem   []byte
+		valid bool
+	}{
+		{FirefoxPKIStagingRootPEM, true},
+		{FirefoxPKIRootPEM, false},
+	} {
+		block, _ := pem.Decode(testcase.pem)
+		if block == nil {
+			t.Fatalf("Failed to parse certificate PEM")
+		}
+		certX509, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("Could not parse X.509 certificate: %v", err)
+		}
+		err = verifyRoot(certX509)
+		if testcase.valid && err != nil {
+			t.Fatalf("Failed to verify root certificate in root set: %v", err)
+		}
+		if !testcase.valid && (err == nil || !strings.Contains(err.Error(), "not in the root set")) {
+			t.Fatalf("Expected root certificate outside the root set to fail, got: %v", err)
+		}
+	}
+}
+
 // fixtures -----------------------------------------------------------------
 
 var ValidMonitoringContentSignature = formats.SignatureResponse{
@@ -539,3 +588,24 @@ Vn4xqG5f6allz8lgpwAQ+AeEEClHca6hh6mj9KhD1Of1CC2Vx52GHNh/jMYEc3/g
 zLKniencBqn3Y2XH2daITGJddcleN09+a1NaTkT3hgr7LumxM8EVssPkC+z9j4Vf
 Gbste+8S5QCMhh00g5vR9QF8EaFqdxCdSxrsA4GmpCa5UQl8jtCnpp2DLKXuOh72
 -----END CERTIFICATE-----`
+
+func TestVerifyClockSkewTolerance(t *testing.T) {
+	now := time.Now()
+	cert := &x509.Certificate{
+		NotBefore: now.Add(-2 * time.Hour),
+		NotAfter:  now.Add(48 * time.Hour),
+	}
+	err := verifyClockSkewTolerance(0, cert, time.Hour)
+	if err != nil {
+		t.Fatalf("expected certificate to cover a 1h clock skew, got: %v", err)
+	}
+	err = verifyClockSkewTolerance(0, cert, 3*time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "late") {
+		t.Fatalf("expected certificate to not cover a 3h late clock, got: %v", err)
+	}
+	cert.NotBefore = now.Add(-72 * time.Hour)
+	err = verifyClockSkewTolerance(0, cert, 50*time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "early") {
+		t.Fatalf("expected certificate to not cover a 50h early clock, got: %v", err)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
 	"time"
 
@@ -17,6 +18,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
 	"go.mozilla.org/autograph/signer/apk"
 	"go.mozilla.org/autograph/signer/apk2"
 	"go.mozilla.org/autograph/signer/contentsignature"
@@ -24,6 +26,7 @@ import (
 	"go.mozilla.org/autograph/signer/genericrsa"
 	"go.mozilla.org/autograph/signer/gpg2"
 	"go.mozilla.org/autograph/signer/mar"
+	"go.mozilla.org/autograph/signer/nullsigner"
 	"go.mozilla.org/autograph/signer/pgp"
 	"go.mozilla.org/autograph/signer/rsapss"
 	"go.mozilla.org/autograph/signer/xpi"
@@ -36,15 +39,36 @@ type configuration struct {
 	env           string
 	rootHash      string
 	truststore    *x509.CertPool
+	// roots are the trusted roots of the environment, loaded from
+	// the root sets directory, that content signature chains and
+	// xpi signatures must chain to instead of the built-in roots
+	roots *signer.RootSet
 	// hash keystore for verifying XPI dep signers
 	depRootHash   string
 	depTruststore *x509.CertPool
+	// clock skew tolerance that content signature chains must
+	// cover before their notbefore and after their notafter
+	clockSkewTolerance time.Duration
 }
 
 var conf configuration
 
 const inputdata string = "AUTOGRAPH MONITORING"
 
+// loadRootSet reads the root set of an environment from the PEM file
+// named after it in dir, like prod.pem, or autograph-dev.pem when the
+// environment is not set
+func loadRootSet(dir, env string) (*signer.RootSet, error) {
+	if env == "" {
+		env = "autograph-dev"
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, env+".pem"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read root set of environment %q: %v", env, err)
+	}
+	return signer.ParseRootSet(env, data)
+}
+
 var softNotifCache map[string]time.Time
 
 func init() {
@@ -82,12 +106,41 @@ func main() {
 		conf.depRootHash = ""
 		conf.depTruststore = nil
 	}
+	if dir := os.Getenv("AUTOGRAPH_ROOT_SETS_DIR"); dir != "" {
+		var err error
+		conf.roots, err = loadRootSet(dir, conf.env)
+		if err != nil {
+			log.Fatal(err)
+		}
+		conf.rootHash = ""
+		conf.truststore = conf.roots.Pool()
+	}
 	if os.Getenv("AUTOGRAPH_ROOT_HASH") != "" {
 		conf.rootHash = os.Getenv("AUTOGRAPH_ROOT_HASH")
 	}
+	if os.Getenv("AUTOGRAPH_CLOCK_SKEW_TOLERANCE") != "" {
+		var err error
+		conf.clockSkewTolerance, err = time.ParseDuration(os.Getenv("AUTOGRAPH_CLOCK_SKEW_TOLERANCE"))
+		if err != nil {
+			log.Fatalf("failed to parse AUTOGRAPH_CLOCK_SKEW_TOLERANCE: %v", err)
+		}
+	}
 	if os.Getenv("LAMBDA_TASK_ROOT") != "" {
 		// we are inside a lambda environment so run as lambda
 		lambda.Start(Handler)
+	} else if os.Getenv("AUTOGRAPH_MONITOR_INTERVAL") != "" {
+		// run as a scheduled runner, publishing results every interval
+		interval, err := time.ParseDuration(os.Getenv("AUTOGRAPH_MONITOR_INTERVAL"))
+		if err != nil || interval <= 0 {
+			log.Fatalf("AUTOGRAPH_MONITOR_INTERVAL must be a positive duration, got %q", os.Getenv("AUTOGRAPH_MONITOR_INTERVAL"))
+		}
+		for {
+			err = Handler()
+			if err != nil {
+				log.Printf("error: %v", err)
+			}
+			time.Sleep(interval)
+		}
 	} else {
 		err := Handler()
 		if err != nil {
@@ -98,8 +151,8 @@ func main() {
 	}
 }
 
-// Handler is a wrapper around monitor() that performs garbage collection
-// before returning
+// Handler is a wrapper around monitor() that publishes its results and
+// performs garbage collection before returning
 func Handler() (err error) {
 	defer func() {
 		// force gc run
@@ -108,11 +161,25 @@ func Handler() (err error) {
 		runtime.GC()
 		log.Println("Garbage collected in", time.Now().Sub(t1))
 	}()
-	return monitor()
+	run := monitoringRun{Start: time.Now()}
+	run.Results, err = monitor()
+	run.Duration = time.Since(run.Start)
+	if err != nil {
+		run.Err = err
+	}
+	publishErr := publishResults(run)
+	if publishErr != nil {
+		log.Printf("%v", publishErr)
+		if err == nil {
+			err = publishErr
+		}
+	}
+	return err
 }
 
-// monitor contacts the autograph service and verifies all monitoring signatures
-func monitor() (err error) {
+// monitor contacts the autograph service and verifies all monitoring
+// signatures. It returns the result of each verification.
+func monitor() (results []signerResult, err error) {
 	log.Println("Retrieving monitoring data from", conf.url)
 	req, err := http.NewRequest("GET", conf.url+"__monitor__", nil)
 	if err != nil {
@@ -139,7 +206,7 @@ func monitor() (err error) {
 	}
 
 	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("Request failed with %s: %s", resp.Status, body)
+		return nil, fmt.Errorf("Request failed with %s: %s", resp.Status, body)
 	}
 
 	// verify that we got a proper signature response, with valid signatures
@@ -157,7 +224,7 @@ func monitor() (err error) {
 			err = verifyContentSignature(response)
 		case contentsignaturepki.Type:
 			log.Printf("Verifying content signature pki from signer %q", response.SignerID)
-			err = contentsignaturepki.Verify(response.X5U, response.Signature, []byte(inputdata))
+			err = verifyContentSignaturePKI(response)
 		case xpi.Type:
 			log.Printf("Verifying XPI signature from signer %q", response.SignerID)
 			err = verifyXPISignature(response.Signature)
@@ -178,6 +245,9 @@ func monitor() (err error) {
 		case rsapss.Type:
 			log.Printf("Verifying RSA-PSS signature from signer %q", response.SignerID)
 			err = verifyRsapssSignature(response.Signature, response.PublicKey)
+		case nullsigner.Type:
+			log.Printf("Verifying null signature from signer %q", response.SignerID)
+			err = nullsigner.VerifySignature(response.SignerID, []byte(inputdata), response.Signature)
 		case pgp.Type, gpg2.Type:
 			// we don't verify pgp signatures because that requires building a keyring
 			// using the public key which is hard to do using the current openpgp package
@@ -186,6 +256,7 @@ func monitor() (err error) {
 		default:
 			err = fmt.Errorf("unknown signature type %q", response.Type)
 		}
+		results = append(results, signerResult{SignerID: response.SignerID, Type: response.Type, Err: err})
 		if err != nil {
 			failed = true
 			log.Printf("Response %d from signer %q does not pass: %v", i, response.SignerID, err)
@@ -200,7 +271,7 @@ func monitor() (err error) {
 		for i, fail := range failures {
 			failure += fmt.Sprintf("\n%d. %s", i+1, fail.Error())
 		}
-		return fmt.Errorf(failure)
+		return results, fmt.Errorf(failure)
 	}
 	log.Println("All signature responses passed, monitoring OK")
 	return
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+// maxCloudWatchMetrics is the maximum number of metrics of a
+// PutMetricData call
+const maxCloudWatchMetrics = 20
+
+// signerResult is the outcome of the verification of the monitoring
+// signature of a signer
+type signerResult struct {
+	SignerID string
+	Type     string
+	Err      error
+}
+
+// monitoringRun is the outcome of a monitoring run: the results of
+// each signer whose signature was verified, and err when the run
+// failed before verifying the signatures
+type monitoringRun struct {
+	Results  []signerResult
+	Err      error
+	Start    time.Time
+	Duration time.Duration
+}
+
+// ok returns whether the run and all its verifications passed
+func (run monitoringRun) ok() bool {
+	if run.Err != nil {
+		return false
+	}
+	for _, result := range run.Results {
+		if result.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// publishResults sends the results of a monitoring run to the
+// Prometheus pushgateway at AUTOGRAPH_PUSHGATEWAY_URL and the
+// CloudWatch namespace AUTOGRAPH_CLOUDWATCH_NAMESPACE, when set
+func publishResults(run monitoringRun) (err error) {
+	if gateway := os.Getenv("AUTOGRAPH_PUSHGATEWAY_URL"); gateway != "" {
+		err = pushToGateway(http.DefaultClient, gateway, run)
+		if err != nil {
+			return fmt.Errorf("failed to push results to the pushgateway: %v", err)
+		}
+		log.Printf("Pushed monitoring results to the pushgateway at %s", gateway)
+	}
+	if namespace := os.Getenv("AUTOGRAPH_CLOUDWATCH_NAMESPACE"); namespace != "" {
+		err = putCloudWatchMetrics(cloudwatch.New(session.New()), namespace, run)
+		if err != nil {
+			return fmt.Errorf("failed to put results in cloudwatch: %v", err)
+		}
+		log.Printf("Put monitoring results in the cloudwatch namespace %s", namespace)
+	}
+	return nil
+}
+
+// escapeLabelValue escapes a Prometheus label value
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// prometheusMetrics returns the results of a run in the Prometheus
+// text exposition format
+func prometheusMetrics(run monitoringRun) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "# HELP autograph_monitor_success Whether the last monitoring run passed.")
+	fmt.Fprintln(&buf, "# TYPE autograph_monitor_success gauge")
+	fmt.Fprintf(&buf, "autograph_monitor_success %g\n", boolToFloat(run.ok()))
+	fmt.Fprintln(&buf, "# HELP autograph_monitor_last_run_timestamp_seconds When the last monitoring run started.")
+	fmt.Fprintln(&buf, "# TYPE autograph_monitor_last_run_timestamp_seconds gauge")
+	fmt.Fprintf(&buf, "autograph_monitor_last_run_timestamp_seconds %d\n", run.Start.Unix())
+	fmt.Fprintln(&buf, "# HELP autograph_monitor_duration_seconds How long the last monitoring run took.")
+	fmt.Fprintln(&buf, "# TYPE autograph_monitor_duration_seconds gauge")
+	fmt.Fprintf(&buf, "autograph_monitor_duration_seconds %g\n", run.Duration.Seconds())
+	fmt.Fprintln(&buf, "# HELP autograph_monitor_signer_success Whether the monitoring signature of a signer passed verification.")
+	fmt.Fprintln(&buf, "# TYPE autograph_monitor_signer_success gauge")
+	results := make([]signerResult, len(run.Results))
+	copy(results, run.Results)
+	sort.Slice(results, func(i, j int) bool { return results[i].SignerID < results[j].SignerID })
+	for _, result := range results {
+		fmt.Fprintf(&buf, "autograph_monitor_signer_success{signer=\"%s\",type=\"%s\"} %g\n",
+			escapeLabelValue(result.SignerID), escapeLabelValue(result.Type), boolToFloat(result.Err == nil))
+	}
+	return buf.Bytes()
+}
+
+// pushToGateway replaces the metrics of the autograph_monitor job in
+// a Prometheus pushgateway with the results of a run, so signers
+// removed from autograph disappear from the metrics
+func pushToGateway(client *http.Client, gateway string, run monitoringRun) error {
+	job := os.Getenv("AUTOGRAPH_PUSHGATEWAY_JOB")
+	if job == "" {
+		job = "autograph_monitor"
+	}
+	pushURL := strings.TrimSuffix(gateway, "/") + "/metrics/job/" + url.PathEscape(job)
+	if conf.env != "" {
+		pushURL += "/env/" + url.PathEscape(conf.env)
+	}
+	req, err := http.NewRequest(http.MethodPut, pushURL, bytes.NewReader(prometheusMetrics(run)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("pushgateway returned %s", resp.Status)
+	}
+	return nil
+}
+
+// putCloudWatchMetrics puts the results of a run in a CloudWatch
+// namespace, with the per signer results dimensioned by signer ID
+func putCloudWatchMetrics(svc cloudwatchiface.CloudWatchAPI, namespace string, run monitoringRun) error {
+	var dimensions []*cloudwatch.Dimension
+	if conf.env != "" {
+		dimensions = append(dimensions, &cloudwatch.Dimension{Name: aws.String("Environment"), Value: aws.String(conf.env)})
+	}
+	datum := func(name string, value float64, unit string, extra ...*cloudwatch.Dimension) *cloudwatch.MetricDatum {
+		return &cloudwatch.MetricDatum{
+			MetricName: aws.String(name),
+			Dimensions: append(append([]*cloudwatch.Dimension{}, dimensions...), extra...),
+			Timestamp:  aws.Time(run.Start),
+			Unit:       aws.String(unit),
+			Value:      aws.Float64(value),
+		}
+	}
+	data := []*cloudwatch.MetricDatum{
+		datum("MonitoringSuccess", boolToFloat(run.ok()), cloudwatch.StandardUnitCount),
+		datum("MonitoringDuration", run.Duration.Seconds(), cloudwatch.StandardUnitSeconds),
+	}
+	for _, result := range run.Results {
+		data = append(data, datum("SignerVerificationSuccess", boolToFloat(result.Err == nil), cloudwatch.StandardUnitCount,
+			&cloudwatch.Dimension{Name: aws.String("SignerID"), Value: aws.String(result.SignerID)}))
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxCloudWatchMetrics {
+			n = maxCloudWatchMetrics
+		}
+		_, err := svc.PutMetricData(&cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(namespace),
+			MetricData: data[:n],
+		})
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+var testRun = monitoringRun{
+	Results: []signerResult{
+		{SignerID: "webextensions-rsa", Type: "xpi"},
+		{SignerID: "appkey1", Type: "contentsignature", Err: errors.New("invalid signature")},
+	},
+	Start:    time.Unix(1600000000, 0),
+	Duration: 1500 * time.Millisecond,
+}
+
+func TestPushToGateway(t *testing.T) {
+	var (
+		method, path, body string
+	)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.Path, string(b)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	err := pushToGateway(gateway.Client(), gateway.URL+"/", testRun)
+	if err != nil {
+		t.Fatalf("failed to push results: %v", err)
+	}
+	if method != http.MethodPut || path != "/metrics/job/autograph_monitor" {
+		t.Fatalf("expected a PUT to the autograph_monitor job, got %s %s", method, path)
+	}
+	for _, metric := range []string{
+		"autograph_monitor_success 0\n",
+		"autograph_monitor_last_run_timestamp_seconds 1600000000\n",
+		"autograph_monitor_duration_seconds 1.5\n",
+		"autograph_monitor_signer_success{signer=\"appkey1\",type=\"contentsignature\"} 0\n" +
+			"autograph_monitor_signer_success{signer=\"webextensions-rsa\",type=\"xpi\"} 1\n",
+	} {
+		if !strings.Contains(body, metric) {
+			t.Fatalf("expected pushed metrics to contain %q, got:\n%s", metric, body)
+		}
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer failing.Close()
+	err = pushToGateway(failing.Client(), failing.URL, testRun)
+	if err == nil {
+		t.Fatal("expected a push rejected by the pushgateway to fail")
+	}
+}
+
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	inputs []*cloudwatch.PutMetricDataInput
+}
+
+func (f *fakeCloudWatch) PutMetricData(input *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+	f.inputs = append(f.inputs, input)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func TestPutCloudWatchMetrics(t *testing.T) {
+	run := testRun
+	for i := 0; i < 30; i++ {
+		run.Results = append(run.Results, signerResult{SignerID: fmt.Sprintf("signer%d", i), Type: "mar"})
+	}
+	svc := &fakeCloudWatch{}
+	err := putCloudWatchMetrics(svc, "Autograph/Monitor", run)
+	if err != nil {
+		t.Fatalf("failed to put metrics: %v", err)
+	}
+	// 2 run metrics and 32 signer metrics in batches of 20
+	if len(svc.inputs) != 2 || len(svc.inputs[0].MetricData) != 20 || len(svc.inputs[1].MetricData) != 14 {
+		t.Fatalf("expected 2 batches of 20 and 14 metrics, got %d batches", len(svc.inputs))
+	}
+	first := svc.inputs[0]
+	if *first.Namespace != "Autograph/Monitor" || *first.MetricData[0].MetricName != "MonitoringSuccess" || *first.MetricData[0].Value != 0 {
+		t.Fatalf("unexpected first metric %v", first.MetricData[0])
+	}
+	signer := first.MetricData[3]
+	if *signer.MetricName != "SignerVerificationSuccess" || *signer.Dimensions[0].Value != "appkey1" || *signer.Value != 0 {
+		t.Fatalf("unexpected signer metric %v", signer)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer/contentsignature"
+	"go.mozilla.org/autograph/signer/contentsignaturepki"
+)
+
+func main() {
+	var (
+		dataPath, responsePath, signature, x5u, publicKey, rootHash, host, at string
+		index                                                                 int
+		legacy                                                                bool
+		opts                                                                  verifyOptions
+		err                                                                   error
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `%s - verify a content signature the way Firefox does
+
+Usage: %s -d <data> -r <response.json> -roothash <hash> [-host <name>]
+       %s -d <data> -s <signature> -x <x5u> -roothash <hash> [-host <name>]
+       %s -d <data> -s 'x5u=<x5u>;p384ecdsa=<signature>' -roothash <hash>
+       %s -legacy -d <data> -r <response.json>
+       %s -legacy -d <data> -s <signature> -pubkey <key>
+
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.StringVar(&dataPath, "d", "", "path of the signed data, - for stdin")
+	flag.StringVar(&responsePath, "r", "", "path of a signature response of autograph, in JSON")
+	flag.IntVar(&index, "i", 0, "index of the signature to verify when the response has several")
+	flag.StringVar(&signature, "s", "", "raw p384ecdsa signature, or the value of a Content-Signature header")
+	flag.StringVar(&x5u, "x", "", "location of the certificate chain of a raw signature")
+	flag.StringVar(&publicKey, "pubkey", "", "base64 DER public key of a legacy signer, to verify a raw signature with -legacy")
+	flag.BoolVar(&legacy, "legacy", false, "verify legacy content signatures without an x5u with the public key of their signer")
+	flag.StringVar(&rootHash, "roothash", "", "SHA256 fingerprint of the trusted root, as in the security.content.signature.root_hash pref of Firefox")
+	flag.StringVar(&host, "host", "", "name the end-entity must be valid for, like remote-settings.content-signature.mozilla.org")
+	flag.StringVar(&at, "time", "", "RFC3339 time the chain must be valid at, now by default")
+	flag.Parse()
+
+	if dataPath == "" || (rootHash == "" && !legacy) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	opts.RootHash = rootHash
+	opts.Host = host
+	if at != "" {
+		opts.Time, err = time.Parse(time.RFC3339, at)
+		if err != nil {
+			log.Fatalf("invalid time %q: %v", at, err)
+		}
+	}
+	var data []byte
+	if dataPath == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(dataPath)
+	}
+	if err != nil {
+		log.Fatalf("failed to read data: %v", err)
+	}
+	cs, err := getContentSignature(responsePath, index, signature, x5u, publicKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch {
+	case cs.X5U != "":
+		err = verifyContentSignature(os.Stdout, data, cs, opts)
+	case legacy:
+		err = verifyLegacyContentSignature(os.Stdout, data, cs)
+	default:
+		log.Fatal("signature has no x5u, Firefox only verifies signatures with a chain. Use -legacy to verify a legacy content signature with the public key of its signer.")
+	}
+	if err != nil {
+		fmt.Printf("FAIL: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("PASS: content signature is valid")
+}
+
+// getContentSignature returns the signature to verify from a signature
+// response file, or from a raw signature and its x5u or the public key
+// of its legacy signer
+func getContentSignature(responsePath string, index int, signature, x5u, publicKey string) (cs contentSignature, err error) {
+	switch {
+	case responsePath != "":
+		return readSignatureResponse(responsePath, index)
+	case strings.Contains(signature, contentsignaturepki.P384ECDSA+"="):
+		return parseContentSignatureHeader(signature)
+	case signature != "" && x5u != "":
+		return contentSignature{X5U: x5u, Signature: signature}, nil
+	case signature != "" && publicKey != "":
+		return contentSignature{Signature: signature, PublicKey: publicKey}, nil
+	default:
+		return cs, errors.New("a signature response, or a signature and its x5u or public key are required")
+	}
+}
+
+// readSignatureResponse reads a content signature from a file with a
+// signature response, or a list of them as returned by /sign/data
+func readSignatureResponse(path string, index int) (cs contentSignature, err error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cs, errors.Wrap(err, "failed to read signature response")
+	}
+	var responses []formats.SignatureResponse
+	err = json.Unmarshal(raw, &responses)
+	if err != nil {
+		var response formats.SignatureResponse
+		err = json.Unmarshal(raw, &response)
+		if err != nil {
+			return cs, errors.Wrap(err, "failed to parse signature response")
+		}
+		responses = append(responses, response)
+	}
+	if index < 0 || index >= len(responses) {
+		return cs, errors.Errorf("response has %d signatures, no signature %d", len(responses), index)
+	}
+	resp := responses[index]
+	if resp.Type != contentsignaturepki.Type && resp.Type != contentsignature.Type {
+		return cs, errors.Errorf("response is a %q signature, not a content signature", resp.Type)
+	}
+	if resp.X5U == "" && resp.PublicKey == "" {
+		return cs, errors.Errorf("response of signer %q has no x5u or public key", resp.SignerID)
+	}
+	return contentSignature{X5U: resp.X5U, Signature: resp.Signature, PublicKey: resp.PublicKey}, nil
+}
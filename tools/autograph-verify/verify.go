@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"go.mozilla.org/autograph/signer/contentsignature"
+	"go.mozilla.org/autograph/signer/contentsignaturepki"
+)
+
+// contentSignature is a content signature to verify, as autograph
+// returns it in a signature response or as servers send it to
+// Firefox in a Content-Signature header
+type contentSignature struct {
+	X5U       string
+	Signature string
+
+	// PublicKey is the public key of the signer of legacy content
+	// signatures, which have no x5u
+	PublicKey string
+}
+
+// parseContentSignatureHeader parses the value of a Content-Signature
+// header, like `x5u=https://example.net/chain.pem;p384ecdsa=abc...`
+func parseContentSignatureHeader(header string) (cs contentSignature, err error) {
+	for _, param := range strings.Split(header, ";") {
+		param = strings.TrimSpace(param)
+		if param == "" {
+			continue
+		}
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return cs, errors.Errorf("invalid Content-Signature parameter %q", param)
+		}
+		switch kv[0] {
+		case "x5u":
+			cs.X5U = kv[1]
+		case contentsignaturepki.P384ECDSA:
+			cs.Signature = kv[1]
+		default:
+			return cs, errors.Errorf("unsupported Content-Signature parameter %q, Firefox only accepts x5u and %s", kv[0], contentsignaturepki.P384ECDSA)
+		}
+	}
+	if cs.X5U == "" || cs.Signature == "" {
+		return cs, errors.New("Content-Signature header must have x5u and p384ecdsa parameters")
+	}
+	return cs, nil
+}
+
+// fetchChain downloads the PEM certificate chain at x5u, which can be
+// an https, http, file or s3 URL, or a local path
+func fetchChain(x5u string) ([]byte, error) {
+	u, err := url.Parse(x5u)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse x5u")
+	}
+	if u.Scheme == "" {
+		return ioutil.ReadFile(u.Path)
+	}
+	return contentsignaturepki.ReadX5U(context.Background(), x5u)
+}
+
+// parseChain parses a PEM chain of certificates, end-entity first
+func parseChain(data []byte) (certs []*x509.Certificate, err error) {
+	for i := 0; ; i++ {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, errors.Errorf("PEM block %d is a %q, not a certificate", i, block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse certificate %d", i)
+		}
+		certs = append(certs, cert)
+	}
+	if len(bytes.TrimSpace(data)) != 0 {
+		return nil, errors.New("trailing data after the last certificate of the chain")
+	}
+	if len(certs) < 2 {
+		return nil, errors.Errorf("found %d certificates in the chain, expected an end-entity and its issuers", len(certs))
+	}
+	return certs, nil
+}
+
+// fingerprint returns the SHA256 fingerprint of a certificate in the
+// format of the security.content.signature.root_hash pref of Firefox
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hexBytes := make([]string, len(sum))
+	for i, b := range sum {
+		hexBytes[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hexBytes, ":")
+}
+
+// normalizeHash returns an uppercase hash without colons
+func normalizeHash(h string) string {
+	return strings.ToUpper(strings.Replace(h, ":", "", -1))
+}
+
+// printChain writes the details of the certificates of a chain
+func printChain(w io.Writer, certs []*x509.Certificate) {
+	for i, cert := range certs {
+		role := "intermediate"
+		switch i {
+		case 0:
+			role = "end-entity"
+		case len(certs) - 1:
+			role = "root"
+		}
+		fmt.Fprintf(w, "certificate %d (%s)\n", i, role)
+		fmt.Fprintf(w, "\tsubject:     %s\n", cert.Subject)
+		fmt.Fprintf(w, "\tissuer:      %s\n", cert.Issuer)
+		fmt.Fprintf(w, "\tserial:      %s\n", cert.SerialNumber)
+		fmt.Fprintf(w, "\tnot before:  %s\n", cert.NotBefore.UTC())
+		fmt.Fprintf(w, "\tnot after:   %s\n", cert.NotAfter.UTC())
+		fmt.Fprintf(w, "\tsha256:      %s\n", fingerprint(cert))
+		if len(cert.DNSNames) > 0 {
+			fmt.Fprintf(w, "\tdns names:   %s\n", strings.Join(cert.DNSNames, ", "))
+		}
+		fmt.Fprintf(w, "\tca:          %t\n", cert.IsCA)
+	}
+}
+
+// verifyOptions are the trust settings of Firefox a content signature
+// is verified against
+type verifyOptions struct {
+	// RootHash is the SHA256 fingerprint of the trusted root, as
+	// set in the security.content.signature.root_hash pref
+	RootHash string
+
+	// Host is the name the end-entity must have, like
+	// remote-settings.content-signature.mozilla.org. It is not
+	// checked when empty.
+	Host string
+
+	// Time is when the chain must be valid, now when zero
+	Time time.Time
+}
+
+// verifyContentSignature verifies a content signature of data the way
+// Firefox does, writing the chain details and the result of each check
+// to w
+func verifyContentSignature(w io.Writer, data []byte, cs contentSignature, opts verifyOptions) error {
+	if opts.RootHash == "" {
+		return errors.New("a root hash is required, Firefox only trusts chains to its pinned root")
+	}
+	fmt.Fprintf(w, "x5u: %s\n", cs.X5U)
+	chainData, err := fetchChain(cs.X5U)
+	if err != nil {
+		return err
+	}
+	certs, err := parseChain(chainData)
+	if err != nil {
+		return err
+	}
+	printChain(w, certs)
+
+	ee, root := certs[0], certs[len(certs)-1]
+	if normalizeHash(fingerprint(root)) != normalizeHash(opts.RootHash) {
+		return errors.Errorf("root %q has fingerprint %s, expected %s", root.Subject.CommonName, fingerprint(root), opts.RootHash)
+	}
+	fmt.Fprintln(w, "ok: root matches the root hash")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	inters := x509.NewCertPool()
+	for _, cert := range certs[1 : len(certs)-1] {
+		inters.AddCert(cert)
+	}
+	verifyTime := opts.Time
+	if verifyTime.IsZero() {
+		verifyTime = time.Now()
+	}
+	_, err = ee.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: inters,
+		CurrentTime:   verifyTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return errors.Wrap(err, "certificate chain verification failed")
+	}
+	fmt.Fprintf(w, "ok: chain is valid for code signing at %s\n", verifyTime.UTC())
+
+	if opts.Host != "" {
+		err = ee.VerifyHostname(opts.Host)
+		if err != nil {
+			return errors.Wrap(err, "end-entity does not match the host")
+		}
+		fmt.Fprintf(w, "ok: end-entity is valid for %s\n", opts.Host)
+	} else {
+		fmt.Fprintln(w, "warning: no host given, the name of the end-entity was not checked")
+	}
+
+	pubKey, ok := ee.PublicKey.(*ecdsa.PublicKey)
+	if !ok || pubKey.Params().Name != "P-384" {
+		return errors.Errorf("end-entity has a %T key, Firefox only accepts P-384 ECDSA keys", ee.PublicKey)
+	}
+	sig, err := contentsignaturepki.Unmarshal(cs.Signature)
+	if err != nil {
+		return err
+	}
+	if sig.Mode != contentsignaturepki.P384ECDSA {
+		return errors.Errorf("signature is a %s signature, Firefox only accepts %s", sig.Mode, contentsignaturepki.P384ECDSA)
+	}
+	if !sig.VerifyData(data, pubKey) {
+		return errors.New("signature verification failed")
+	}
+	fmt.Fprintf(w, "ok: %s signature of %d bytes is valid\n", sig.Mode, len(data))
+	return nil
+}
+
+// verifyLegacyContentSignature verifies a content signature of the
+// legacy contentsignature signer with the public key of the signer.
+// Firefox rejects these signatures, so this only helps the consumers
+// that pin the public key migrate to the contentsignaturepki signer.
+func verifyLegacyContentSignature(w io.Writer, data []byte, cs contentSignature) error {
+	if cs.PublicKey == "" {
+		return errors.New("a public key is required to verify a legacy content signature")
+	}
+	fmt.Fprintln(w, "warning: legacy content signature without an x5u, Firefox does not accept it")
+	fmt.Fprintf(w, "public key: %s\n", cs.PublicKey)
+	sig, err := contentsignature.Unmarshal(cs.Signature)
+	if err != nil {
+		return err
+	}
+	err = contentsignature.Verify(cs.PublicKey, cs.Signature, data)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "ok: %s signature of %d bytes is valid\n", sig.Mode, len(data))
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer/contentsignature"
+	"go.mozilla.org/autograph/signer/contentsignaturepki"
+)
+
+const testHost = "remote-settings.content-signature.mozilla.org"
+
+// makeTestChain writes a root, intermediate and end-entity chain to a
+// file, and returns its path, the root and the end-entity key
+func makeTestChain(t *testing.T, dir string) (string, *x509.Certificate, *ecdsa.PrivateKey) {
+	makeCert := func(tpl, parent *x509.Certificate, pub *ecdsa.PublicKey, priv *ecdsa.PrivateKey) *x509.Certificate {
+		der, err := x509.CreateCertificate(rand.Reader, tpl, parent, pub, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	now := time.Now()
+	rootKey, interKey, eeKey := newKey(), newKey(), newKey()
+	caTpl := func(serial int64, cn string) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: cn},
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.Add(24 * time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		}
+	}
+	root := makeCert(caTpl(1, "test root"), caTpl(1, "test root"), &rootKey.PublicKey, rootKey)
+	inter := makeCert(caTpl(2, "test intermediate"), root, &interKey.PublicKey, rootKey)
+	ee := makeCert(&x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: testHost},
+		DNSNames:     []string{testHost},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(12 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}, inter, &eeKey.PublicKey, interKey)
+
+	var chain []byte
+	for _, cert := range []*x509.Certificate{ee, inter, root} {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	path := filepath.Join(dir, "chain.pem")
+	err := ioutil.WriteFile(path, chain, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, root, eeKey
+}
+
+func signContent(t *testing.T, key *ecdsa.PrivateKey, data []byte) string {
+	_, hash := contentsignaturepki.MakeTemplatedHash(data, contentsignaturepki.P384ECDSA)
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := &contentsignaturepki.ContentSignature{
+		R:        r,
+		S:        s,
+		Mode:     contentsignaturepki.P384ECDSA,
+		Len:      contentsignaturepki.P384ECDSABYTESIZE,
+		Finished: true,
+	}
+	encoded, err := sig.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func TestVerifyContentSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autograph-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chainPath, root, eeKey := makeTestChain(t, dir)
+	data := []byte(`{"data":[]}`)
+	cs, err := parseContentSignatureHeader("x5u=file://" + chainPath + ";p384ecdsa=" + signContent(t, eeKey, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := verifyOptions{RootHash: fingerprint(root), Host: testHost}
+
+	for i, testcase := range []struct {
+		data  []byte
+		opts  verifyOptions
+		valid bool
+	}{
+		{data, valid, true},
+		{data, verifyOptions{RootHash: normalizeHash(fingerprint(root))}, true},
+		{[]byte(`{"data":["tampered"]}`), valid, false},
+		{data, verifyOptions{RootHash: "00:11", Host: testHost}, false},
+		{data, verifyOptions{RootHash: valid.RootHash, Host: "normandy.content-signature.mozilla.org"}, false},
+		{data, verifyOptions{RootHash: valid.RootHash, Host: testHost, Time: time.Now().Add(48 * time.Hour)}, false},
+		{data, verifyOptions{}, false},
+	} {
+		err = verifyContentSignature(ioutil.Discard, testcase.data, cs, testcase.opts)
+		if testcase.valid && err != nil {
+			t.Fatalf("testcase %d: expected the signature to be valid, got %v", i, err)
+		}
+		if !testcase.valid && err == nil {
+			t.Fatalf("testcase %d: expected verification to fail", i)
+		}
+	}
+}
+
+func TestVerifyLegacyContentSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autograph-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(`{"data":[]}`)
+	_, hash := contentsignaturepki.MakeTemplatedHash(data, contentsignature.P256ECDSA)
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := (&contentsignature.ContentSignature{
+		R:        r,
+		S:        s,
+		Mode:     contentsignature.P256ECDSA,
+		Len:      contentsignature.P256ECDSABYTESIZE,
+		Finished: true,
+	}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := json.Marshal(formats.SignatureResponse{
+		Type:      contentsignature.Type,
+		SignerID:  "legacy",
+		Signature: sig,
+		PublicKey: base64.StdEncoding.EncodeToString(keyDER),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	respPath := filepath.Join(dir, "response.json")
+	err = ioutil.WriteFile(respPath, resp, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := getContentSignature(respPath, 0, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.X5U != "" || cs.PublicKey != base64.StdEncoding.EncodeToString(keyDER) {
+		t.Fatalf("unexpected legacy content signature %+v", cs)
+	}
+	err = verifyLegacyContentSignature(ioutil.Discard, data, cs)
+	if err != nil {
+		t.Fatalf("expected the legacy signature to be valid, got %v", err)
+	}
+	err = verifyLegacyContentSignature(ioutil.Discard, []byte(`{"data":["tampered"]}`), cs)
+	if err == nil {
+		t.Fatal("expected the legacy signature of tampered data to fail")
+	}
+	err = verifyLegacyContentSignature(ioutil.Discard, data, contentSignature{Signature: sig})
+	if err == nil {
+		t.Fatal("expected a legacy signature without a public key to fail")
+	}
+}
+
+func TestParseContentSignatureHeader(t *testing.T) {
+	for i, testcase := range []struct {
+		header string
+		valid  bool
+	}{
+		{"x5u=https://example.net/chain.pem;p384ecdsa=abc", true},
+		{" x5u=https://example.net/chain.pem ; p384ecdsa=abc ", true},
+		{"p384ecdsa=abc", false},
+		{"x5u=https://example.net/chain.pem;p256ecdsa=abc", false},
+		{"x5u", false},
+	} {
+		_, err := parseContentSignatureHeader(testcase.header)
+		if testcase.valid && err != nil {
+			t.Fatalf("testcase %d: unexpected error %v", i, err)
+		}
+		if !testcase.valid && err == nil {
+			t.Fatalf("testcase %d: expected an error", i)
+		}
+	}
+}
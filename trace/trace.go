@@ -0,0 +1,112 @@
+// Package trace carries the request ID and W3C trace context of a
+// signing request to the outbound requests it makes, such as chain
+// uploads to S3 and database queries, so the traces of other systems
+// can be stitched to autograph requests.
+package trace // import "go.mozilla.org/autograph/trace"
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+)
+
+const (
+	// HeaderRequestID is the header of request IDs
+	HeaderRequestID = "X-Request-Id"
+
+	// HeaderTraceparent is the header of the W3C trace context
+	HeaderTraceparent = "traceparent"
+
+	// maxRequestIDLength is the maximum length of the request IDs
+	// accepted from clients
+	maxRequestIDLength = 64
+)
+
+var (
+	requestIDRegexp   = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+	traceparentRegexp = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}$`)
+)
+
+// Trace identifies the request an operation is made for
+type Trace struct {
+	// RequestID is the ID of the autograph request
+	RequestID string
+
+	// Traceparent is the W3C traceparent header of the request,
+	// empty when the client did not send a valid one
+	Traceparent string
+}
+
+// ValidRequestID returns whether a request ID received from a client
+// is safe to log and propagate
+func ValidRequestID(id string) bool {
+	return len(id) <= maxRequestIDLength && requestIDRegexp.MatchString(id)
+}
+
+// ValidTraceparent returns whether a traceparent header is well formed
+func ValidTraceparent(traceparent string) bool {
+	m := traceparentRegexp.FindStringSubmatch(traceparent)
+	// the version ff and the all zero trace ID are invalid
+	return m != nil && traceparent[:2] != "ff" && m[1] != "00000000000000000000000000000000"
+}
+
+// TraceID returns the trace ID of the traceparent, or an empty string
+func (t Trace) TraceID() string {
+	m := traceparentRegexp.FindStringSubmatch(t.Traceparent)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// SetHeaders sets the request ID and traceparent headers of an
+// outbound request
+func (t Trace) SetHeaders(h http.Header) {
+	if t.RequestID != "" {
+		h.Set(HeaderRequestID, t.RequestID)
+	}
+	if t.Traceparent != "" {
+		h.Set(HeaderTraceparent, t.Traceparent)
+	}
+}
+
+// Metadata returns the trace as object metadata, like the
+// x-amz-meta-* headers of S3 objects
+func (t Trace) Metadata() map[string]string {
+	metadata := make(map[string]string)
+	if t.RequestID != "" {
+		metadata["autograph-request-id"] = t.RequestID
+	}
+	if t.Traceparent != "" {
+		metadata["traceparent"] = t.Traceparent
+	}
+	return metadata
+}
+
+// ApplicationName returns the name a database session of the request
+// reports, like "autograph:<request id>:<trace id>". Postgres
+// truncates it to 63 bytes.
+func (t Trace) ApplicationName(prefix string) string {
+	name := prefix
+	if t.RequestID != "" {
+		name += ":" + t.RequestID
+	}
+	if traceID := t.TraceID(); traceID != "" {
+		name += ":" + traceID
+	}
+	return name
+}
+
+type traceContextKey struct{}
+
+// NewContext returns a context that carries a trace
+func NewContext(ctx context.Context, t Trace) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, t)
+}
+
+// FromContext returns the trace of a context, and false when it has
+// none
+func FromContext(ctx context.Context) (Trace, bool) {
+	t, ok := ctx.Value(traceContextKey{}).(Trace)
+	return t, ok
+}
@@ -0,0 +1,88 @@
+package trace
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestValidRequestID(t *testing.T) {
+	for _, testcase := range []struct {
+		id    string
+		valid bool
+	}{
+		{"abcDEF123", true},
+		{"req-1.2_3", true},
+		{"", false},
+		{"has space", false},
+		{"line\nbreak", false},
+		{strings.Repeat("a", maxRequestIDLength), true},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+	} {
+		if ValidRequestID(testcase.id) != testcase.valid {
+			t.Fatalf("expected request id %q validity to be %t", testcase.id, testcase.valid)
+		}
+	}
+}
+
+func TestValidTraceparent(t *testing.T) {
+	for _, testcase := range []struct {
+		traceparent string
+		valid       bool
+	}{
+		{testTraceparent, true},
+		{"", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+	} {
+		if ValidTraceparent(testcase.traceparent) != testcase.valid {
+			t.Fatalf("expected traceparent %q validity to be %t", testcase.traceparent, testcase.valid)
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+	tr := Trace{RequestID: "abc123", Traceparent: testTraceparent}
+	if tr.TraceID() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("unexpected trace id %q", tr.TraceID())
+	}
+	if name := tr.ApplicationName("autograph"); name != "autograph:abc123:4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("unexpected application name %q", name)
+	}
+	metadata := tr.Metadata()
+	if len(metadata) != 2 || metadata["autograph-request-id"] != "abc123" || metadata["traceparent"] != testTraceparent {
+		t.Fatalf("unexpected metadata %+v", metadata)
+	}
+	h := make(http.Header)
+	tr.SetHeaders(h)
+	if h.Get(HeaderRequestID) != "abc123" || h.Get(HeaderTraceparent) != testTraceparent {
+		t.Fatalf("unexpected headers %+v", h)
+	}
+
+	// a trace without traceparent only carries the request id
+	tr = Trace{RequestID: "abc123"}
+	if tr.TraceID() != "" || tr.ApplicationName("autograph") != "autograph:abc123" || len(tr.Metadata()) != 1 {
+		t.Fatalf("unexpected trace without traceparent %+v", tr)
+	}
+	h = make(http.Header)
+	tr.SetHeaders(h)
+	if _, ok := h[HeaderTraceparent]; ok {
+		t.Fatalf("expected no traceparent header, got %+v", h)
+	}
+}
+
+func TestContext(t *testing.T) {
+	if _, ok := FromContext(context.Background()); ok {
+		t.Fatal("expected no trace in the background context")
+	}
+	ctx := NewContext(context.Background(), Trace{RequestID: "abc123"})
+	tr, ok := FromContext(ctx)
+	if !ok || tr.RequestID != "abc123" {
+		t.Fatalf("unexpected trace %+v in context", tr)
+	}
+}
@@ -0,0 +1,292 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/formats"
+)
+
+const (
+	// defaultUsageFlushInterval is how often usage counts are
+	// written to the database when the configuration does not set
+	// an interval
+	defaultUsageFlushInterval = time.Minute
+
+	// usageExportInterval is how often the leader checks whether
+	// the usage of the previous day was exported
+	usageExportInterval = time.Hour
+
+	// usageDayFormat is the format of days in usage reports
+	usageDayFormat = "2006-01-02"
+
+	// maxUsageReportDays is the longest period of a usage report
+	maxUsageReportDays = 366
+)
+
+// usageConfig enables the daily usage counts of signers by user
+type usageConfig struct {
+	Enabled bool
+
+	// FlushInterval is how often the usage counts of an instance
+	// are added to the database. Defaults to 1m.
+	FlushInterval time.Duration
+
+	// Export sends the usage of the previous day to the event
+	// exporters once a day
+	Export bool
+}
+
+// usageStore stores the daily usage counts. It is implemented by the
+// database handler.
+type usageStore interface {
+	AddUsage(ctx context.Context, usage []database.Usage) error
+	ListUsage(ctx context.Context, from, to time.Time, signerID, userID string) ([]database.Usage, error)
+}
+
+// usageKey identifies the usage of a signer by a user on a day
+type usageKey struct {
+	day      time.Time
+	signerID string
+	userID   string
+}
+
+// usageRecorder counts signing operations in memory and adds them to
+// the store periodically, so signing doesn't wait on the database
+type usageRecorder struct {
+	sync.Mutex
+	store  usageStore
+	counts map[usageKey]*database.Usage
+	now    func() time.Time
+
+	// lastExport is the last day whose usage was exported
+	lastExport time.Time
+}
+
+func newUsageRecorder(store usageStore) *usageRecorder {
+	return &usageRecorder{
+		store:  store,
+		counts: make(map[usageKey]*database.Usage),
+		now:    time.Now,
+	}
+}
+
+// utcDay returns midnight UTC of the day of t
+func utcDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// record counts a signing operation and the size of its input
+func (u *usageRecorder) record(signerID, userID string, inputSize int, failed bool) {
+	u.Lock()
+	defer u.Unlock()
+	key := usageKey{day: utcDay(u.now()), signerID: signerID, userID: userID}
+	usage, ok := u.counts[key]
+	if !ok {
+		usage = &database.Usage{Day: key.day, SignerID: signerID, UserID: userID}
+		u.counts[key] = usage
+	}
+	if failed {
+		usage.Errors++
+		return
+	}
+	usage.Signatures++
+	usage.BytesSigned += int64(inputSize)
+}
+
+// flush adds the counts to the store. They are kept in memory for
+// the next flush when the store fails.
+func (u *usageRecorder) flush(ctx context.Context) error {
+	u.Lock()
+	counts := u.counts
+	u.counts = make(map[usageKey]*database.Usage)
+	u.Unlock()
+	if len(counts) == 0 {
+		return nil
+	}
+	var usage []database.Usage
+	for _, c := range counts {
+		usage = append(usage, *c)
+	}
+	err := u.store.AddUsage(ctx, usage)
+	if err == nil {
+		return nil
+	}
+	u.Lock()
+	defer u.Unlock()
+	for key, c := range counts {
+		if existing, ok := u.counts[key]; ok {
+			existing.Signatures += c.Signatures
+			existing.Errors += c.Errors
+			existing.BytesSigned += c.BytesSigned
+		} else {
+			u.counts[key] = c
+		}
+	}
+	return err
+}
+
+// flushEvery adds the counts to the store at an interval, forever
+func (u *usageRecorder) flushEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := u.flush(ctx)
+		cancel()
+		if err != nil {
+			log.Errorf("failed to flush usage counts: %v", err)
+		}
+	}
+}
+
+// enableUsage counts signing operations in the database, when the
+// configuration enables it
+func (a *autographer) enableUsage(conf usageConfig) error {
+	if !conf.Enabled {
+		return nil
+	}
+	if a.db == nil {
+		return errors.New("usage reporting requires a database")
+	}
+	a.initUsage(a.db, conf)
+	return nil
+}
+
+// initUsage counts signing operations by signer, user and day
+func (a *autographer) initUsage(store usageStore, conf usageConfig) {
+	a.usage = newUsageRecorder(store)
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = defaultUsageFlushInterval
+	}
+	go a.usage.flushEvery(conf.FlushInterval)
+	if conf.Export {
+		a.startBackgroundJob("usage export", usageExportInterval, a.exportUsage)
+	}
+}
+
+// recordUsage counts a signing operation when usage is enabled
+func (a *autographer) recordUsage(signerID, userID string, inputSize int, failed bool) {
+	if a.usage == nil {
+		return
+	}
+	a.usage.record(signerID, userID, inputSize, failed)
+}
+
+// usageReport returns the admin API form of usage counts
+func usageReport(u database.Usage) formats.UsageReport {
+	report := formats.UsageReport{
+		Day:         u.Day.UTC().Format(usageDayFormat),
+		SignerID:    u.SignerID,
+		UserID:      u.UserID,
+		Signatures:  u.Signatures,
+		Errors:      u.Errors,
+		BytesSigned: u.BytesSigned,
+	}
+	if total := u.Signatures + u.Errors; total > 0 {
+		report.ErrorRate = float64(u.Errors) / float64(total)
+	}
+	return report
+}
+
+// exportUsage exports the usage of the previous day once, and flushes
+// the counts of the instance first so they are included
+func (a *autographer) exportUsage(ctx context.Context) error {
+	yesterday := utcDay(a.usage.now()).AddDate(0, 0, -1)
+	a.usage.Lock()
+	exported := !a.usage.lastExport.Before(yesterday)
+	a.usage.Unlock()
+	if exported {
+		return nil
+	}
+	err := a.usage.flush(ctx)
+	if err != nil {
+		return err
+	}
+	usage, err := a.usage.store.ListUsage(ctx, yesterday, yesterday.AddDate(0, 0, 1), "", "")
+	if err != nil {
+		return err
+	}
+	for _, u := range usage {
+		report := usageReport(u)
+		a.exportEvent(formats.ExportedEvent{
+			Type:     formats.EventTypeUsage,
+			UserID:   u.UserID,
+			SignerID: u.SignerID,
+			Usage:    &report,
+		})
+	}
+	a.usage.Lock()
+	a.usage.lastExport = yesterday
+	a.usage.Unlock()
+	log.Infof("exported %d usage reports of %s", len(usage), yesterday.Format(usageDayFormat))
+	return nil
+}
+
+// parseUsagePeriod returns the days of a usage report request: from
+// the from parameter, 30 days ago by default, until the day before the
+// to parameter, tomorrow by default
+func parseUsagePeriod(r *http.Request, now time.Time) (from, to time.Time, err error) {
+	to = utcDay(now).AddDate(0, 0, 1)
+	if param := r.URL.Query().Get("to"); param != "" {
+		to, err = time.Parse(usageDayFormat, param)
+		if err != nil {
+			return from, to, errors.Errorf("invalid to day %q, must be formatted as %s", param, usageDayFormat)
+		}
+	}
+	from = to.AddDate(0, 0, -30)
+	if param := r.URL.Query().Get("from"); param != "" {
+		from, err = time.Parse(usageDayFormat, param)
+		if err != nil {
+			return from, to, errors.Errorf("invalid from day %q, must be formatted as %s", param, usageDayFormat)
+		}
+	}
+	if !from.Before(to) {
+		return from, to, errors.New("from day must be before to day")
+	}
+	if to.Sub(from) > maxUsageReportDays*24*time.Hour {
+		return from, to, errors.Errorf("usage reports cover at most %d days", maxUsageReportDays)
+	}
+	return from, to, nil
+}
+
+// handleUsage returns the daily usage of signers by users
+func (a *autographer) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := a.authorizeAdmin(w, r); !ok {
+		return
+	}
+	if a.usage == nil {
+		httpError(w, r, http.StatusNotFound, formats.ErrorCodeNotFound, "usage reporting is not enabled")
+		return
+	}
+	from, to, err := parseUsagePeriod(r, a.usage.now())
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "%v", err)
+		return
+	}
+	// include the operations of this instance that weren't
+	// flushed yet
+	err = a.usage.flush(r.Context())
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	usage, err := a.usage.store.ListUsage(r.Context(), from, to, r.URL.Query().Get("signer"), r.URL.Query().Get("user"))
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "%v", err)
+		return
+	}
+	resp := []formats.UsageReport{}
+	for _, u := range usage {
+		resp = append(resp, usageReport(u))
+	}
+	writeAdminJSON(w, r, resp)
+}
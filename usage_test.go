@@ -0,0 +1,174 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/database"
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+// memoryUsageStore is a usageStore that keeps usage counts in memory
+type memoryUsageStore struct {
+	sync.Mutex
+	usage []database.Usage
+}
+
+func (m *memoryUsageStore) AddUsage(ctx context.Context, usage []database.Usage) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, u := range usage {
+		added := false
+		for i := range m.usage {
+			if m.usage[i].Day.Equal(u.Day) && m.usage[i].SignerID == u.SignerID && m.usage[i].UserID == u.UserID {
+				m.usage[i].Signatures += u.Signatures
+				m.usage[i].Errors += u.Errors
+				m.usage[i].BytesSigned += u.BytesSigned
+				added = true
+			}
+		}
+		if !added {
+			m.usage = append(m.usage, u)
+		}
+	}
+	return nil
+}
+
+func (m *memoryUsageStore) ListUsage(ctx context.Context, from, to time.Time, signerID, userID string) ([]database.Usage, error) {
+	m.Lock()
+	defer m.Unlock()
+	var usage []database.Usage
+	for _, u := range m.usage {
+		if u.Day.Before(from) || !u.Day.Before(to) ||
+			(signerID != "" && u.SignerID != signerID) ||
+			(userID != "" && u.UserID != userID) {
+			continue
+		}
+		usage = append(usage, u)
+	}
+	return usage, nil
+}
+
+func TestUsageReporting(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(100)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	err := tmpag.addSigners([]signer.Configuration{conf.Signers[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := authorization{ID: "billeduser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: []string{conf.Signers[0].ID}}
+	admin := authorization{ID: "usageadmin", Key: "a4ex0ztpcu9msw5h5flc7qfhsc7btg2tzb2s3hgf1gtx5vqhnh", Admin: true}
+	err = tmpag.addAuthorizations([]authorization{user, admin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRequest := func(method, url string, auth authorization, body []byte) *http.Request {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+		return req
+	}
+	report := func(query string) (int, []formats.UsageReport) {
+		w := httptest.NewRecorder()
+		tmpag.handleUsage(w, newRequest("GET", "http://foo.bar/admin/usage"+query, admin, nil))
+		var reports []formats.UsageReport
+		if w.Code == http.StatusOK {
+			err := json.Unmarshal(w.Body.Bytes(), &reports)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, reports
+	}
+
+	if code, _ := report(""); code != http.StatusNotFound {
+		t.Fatalf("expected usage reporting to be disabled, got %d", code)
+	}
+	store := new(memoryUsageStore)
+	tmpag.usage = newUsageRecorder(store)
+	now := time.Date(2019, 6, 3, 12, 0, 0, 0, time.UTC)
+	tmpag.usage.now = func() time.Time { return now }
+
+	body, err := json.Marshal([]formats.SignatureRequest{
+		{Input: "Y2FyaWJvdW1hdXJpY2UK"},
+		{Input: "Y2FyaWJvdW1hdXJpY2UK"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	tmpag.handleSignature(w, newRequest("POST", "http://foo.bar/sign/data", user, body))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("signing failed with %d: %s", w.Code, w.Body.String())
+	}
+	tmpag.recordUsage(conf.Signers[0].ID, user.ID, 5, true)
+
+	code, reports := report("?user=" + user.ID)
+	if code != http.StatusOK {
+		t.Fatalf("usage report failed with %d", code)
+	}
+	expected := formats.UsageReport{
+		Day:         "2019-06-03",
+		SignerID:    conf.Signers[0].ID,
+		UserID:      user.ID,
+		Signatures:  2,
+		Errors:      1,
+		BytesSigned: 30,
+		ErrorRate:   1.0 / 3,
+	}
+	if len(reports) != 1 || reports[0] != expected {
+		t.Fatalf("expected usage report %+v, got %+v", expected, reports)
+	}
+	if _, reports = report("?signer=nosuchsigner"); len(reports) != 0 {
+		t.Fatalf("expected no usage of an unknown signer, got %+v", reports)
+	}
+	if _, reports = report("?from=2019-06-04&to=2019-06-10"); len(reports) != 0 {
+		t.Fatalf("expected no usage after the day, got %+v", reports)
+	}
+	for _, query := range []string{"?from=June", "?from=2019-06-04&to=2019-06-04", "?from=2017-01-01&to=2019-01-01"} {
+		if code, _ := report(query); code != http.StatusBadRequest {
+			t.Fatalf("expected invalid period %q to be rejected, got %d", query, code)
+		}
+	}
+
+	// the usage of the previous day is exported once, the next day
+	sink := new(memorySink)
+	tmpag.addExporter(exporterConfig{Type: "memory", BatchSize: 100, FlushInterval: 10 * time.Millisecond}, sink)
+	now = now.AddDate(0, 0, 1)
+	for i := 0; i < 2; i++ {
+		err = tmpag.exportUsage(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var events []formats.ExportedEvent
+	for i := 0; len(events) == 0; i++ {
+		if i > 100 {
+			t.Fatal("timed out waiting for usage events")
+		}
+		time.Sleep(10 * time.Millisecond)
+		events = sink.received()
+	}
+	time.Sleep(50 * time.Millisecond)
+	events = sink.received()
+	if len(events) != 1 || events[0].Type != formats.EventTypeUsage || events[0].Usage == nil || *events[0].Usage != expected {
+		t.Fatalf("unexpected usage events %+v", events)
+	}
+}
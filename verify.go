@@ -0,0 +1,165 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/autograph/signer/apk2"
+)
+
+// summarizeCertificate returns the fields of a certificate shown to
+// clients verifying files
+func summarizeCertificate(cert *x509.Certificate) formats.CertificateSummary {
+	digest := sha256.Sum256(cert.Raw)
+	return formats.CertificateSummary{
+		Subject:      cert.Subject.String(),
+		Issuer:       cert.Issuer.String(),
+		SerialNumber: cert.SerialNumber.String(),
+		NotBefore:    cert.NotBefore.UTC(),
+		NotAfter:     cert.NotAfter.UTC(),
+		SHA256:       hex.EncodeToString(digest[:]),
+	}
+}
+
+// parseSignerCertificate returns the certificate of a signer
+// configuration, to check files were signed by it
+func parseSignerCertificate(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, errors.New("failed to parse PEM certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// handleVerify endpoint accepts a base64 encoded signed APK or AAB in
+// a HAWK authenticated POST request and returns the signature schemes
+// and signer certificates it is verified with. When the request has a
+// keyid, the file must also be signed by the certificate of that
+// signer. When the request names a root set, like "prod", a signer
+// certificate must be one of its roots or issued by one of them.
+// Invalid signatures are returned as a 200 with valid false,
+// so release QA can tell them from invalid requests.
+func (a *autographer) handleVerify(w http.ResponseWriter, r *http.Request) {
+	rid := getRequestID(r)
+	starttime := getRequestStartTime(r)
+	userid, body, ok := a.authorizeRequestBody(w, r)
+	if !ok {
+		return
+	}
+	release, ok := a.admitRequest(w, r, userid)
+	if !ok {
+		return
+	}
+	defer release()
+	var req formats.VerificationRequest
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "failed to parse request body: %v", err)
+		return
+	}
+	if req.Input == "" {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "missing input in verification request")
+		return
+	}
+	input, err := base64.StdEncoding.DecodeString(req.Input)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidInput, "%v", err)
+		return
+	}
+	var signerCert *x509.Certificate
+	if req.KeyID != "" {
+		requestedSigner, err := a.authBackend.getSignerForUser(userid, req.KeyID)
+		if err != nil {
+			a.authorizationDenied(w, r, http.StatusUnauthorized, formats.ErrorCodeSignerNotPermitted, userid, req.KeyID, err)
+			return
+		}
+		requestedSigner, err = resolveSigner(requestedSigner)
+		if err != nil {
+			httpError(w, r, http.StatusServiceUnavailable, formats.ErrorCodeSignerUnavailable, "%v", err)
+			return
+		}
+		certPEM := requestedSigner.Config().Certificate
+		if certPEM == "" {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeUnsupportedOperation, "signer %q has no certificate to verify files against", req.KeyID)
+			return
+		}
+		signerCert, err = parseSignerCertificate(certPEM)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "failed to parse certificate of signer %q: %v", req.KeyID, err)
+			return
+		}
+	}
+
+	var roots *signer.RootSet
+	if req.Roots != "" {
+		var found bool
+		roots, found = a.rootSets[req.Roots]
+		if !found {
+			httpError(w, r, http.StatusBadRequest, formats.ErrorCodeInvalidRequest, "unknown root set %q", req.Roots)
+			return
+		}
+	}
+
+	resp := formats.VerificationResponse{
+		Ref:      id(),
+		SignerID: req.KeyID,
+		Roots:    req.Roots,
+	}
+	verification, err := apk2.VerifySignedFile(input)
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Valid = true
+		resp.Schemes = verification.Schemes
+		signedBySigner, anchored := false, false
+		for _, cert := range verification.Certificates {
+			resp.Certificates = append(resp.Certificates, summarizeCertificate(cert))
+			if signerCert != nil && bytes.Equal(cert.Raw, signerCert.Raw) {
+				signedBySigner = true
+			}
+			if roots != nil && roots.Anchors(cert) {
+				anchored = true
+			}
+		}
+		if signerCert != nil && !signedBySigner {
+			resp.Valid = false
+			resp.Error = "file is not signed by the certificate of signer " + req.KeyID
+		} else if roots != nil && !anchored {
+			resp.Valid = false
+			resp.Error = "file is not signed by a certificate anchored in root set " + req.Roots
+		}
+	}
+	respdata, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, formats.ErrorCodeInternal, "failed to marshal response: %v", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respdata)
+	log.WithFields(log.Fields{
+		"rid":        rid,
+		"ref":        resp.Ref,
+		"signer_id":  req.KeyID,
+		"user_id":    userid,
+		"input_hash": hashSHA256AsHex(input),
+		"roots":      req.Roots,
+		"valid":      resp.Valid,
+		"t":          int32(time.Since(starttime) / time.Millisecond), //  request processing time in ms
+	}).Info("verification request completed")
+}
@@ -0,0 +1,194 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+)
+
+func postVerify(t *testing.T, req formats.VerificationRequest) *httptest.ResponseRecorder {
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpReq, err := http.NewRequest("POST", "http://foo.bar/verify", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	auth, err := ag.getAuthByID(conf.Authorizations[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpReq.Header.Set("Authorization", getAuthHeader(httpReq, auth.ID, auth.Key, sha256.New, id(), "application/json", body))
+	w := httptest.NewRecorder()
+	ag.handleVerify(w, httpReq)
+	return w
+}
+
+func TestVerifyAPK(t *testing.T) {
+	t.Parallel()
+
+	unsignedAPK, err := ioutil.ReadFile("signer/apk/aligned-two-files.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apkSigner, ok := ag.getSignerByID("testapp-android-legacy")
+	if !ok {
+		t.Fatal("missing testapp-android-legacy signer")
+	}
+	signedAPK, err := apkSigner.(signer.FileSigner).SignFile(unsignedAPK, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.StdEncoding.EncodeToString(signedAPK)
+
+	for i, testcase := range []struct {
+		req   formats.VerificationRequest
+		valid bool
+	}{
+		{formats.VerificationRequest{Input: input}, true},
+		{formats.VerificationRequest{Input: input, KeyID: "testapp-android-legacy"}, true},
+		{formats.VerificationRequest{Input: input, KeyID: "apk_cert_with_dsa_sha1"}, false},
+		{formats.VerificationRequest{Input: base64.StdEncoding.EncodeToString(makeTestZip(t))}, false},
+	} {
+		w := postVerify(t, testcase.req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("testcase %d: failed with %d: %s", i, w.Code, w.Body.String())
+		}
+		var resp formats.VerificationResponse
+		err = json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Valid != testcase.valid {
+			t.Fatalf("testcase %d: expected valid %t, got %+v", i, testcase.valid, resp)
+		}
+		if resp.Valid && (len(resp.Schemes) != 1 || resp.Schemes[0] != "v1" || len(resp.Certificates) != 1) {
+			t.Fatalf("testcase %d: expected a v1 signature with one certificate, got %+v", i, resp)
+		}
+		if !resp.Valid && resp.Error == "" {
+			t.Fatalf("testcase %d: expected an error with the invalid result", i)
+		}
+	}
+}
+
+func TestVerifyBadRequests(t *testing.T) {
+	t.Parallel()
+
+	for i, testcase := range []struct {
+		req    formats.VerificationRequest
+		status int
+	}{
+		{formats.VerificationRequest{}, http.StatusBadRequest},
+		{formats.VerificationRequest{Input: "not base64!"}, http.StatusBadRequest},
+		// content signature signers have no certificate to check
+		{formats.VerificationRequest{Input: "Zm9v", KeyID: "appkey1"}, http.StatusBadRequest},
+		{formats.VerificationRequest{Input: "Zm9v", KeyID: "unknown-signer"}, http.StatusUnauthorized},
+	} {
+		w := postVerify(t, testcase.req)
+		if w.Code != testcase.status {
+			t.Fatalf("testcase %d: expected status %d, got %d: %s", i, testcase.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestVerifyAPKRootSets(t *testing.T) {
+	t.Parallel()
+
+	tmpag := newAutographer(1)
+	tmpag.hawkMaxTimestampSkew = time.Minute
+	var legacyConf, dsaConf signer.Configuration
+	for _, s := range conf.Signers {
+		switch s.ID {
+		case "testapp-android-legacy":
+			legacyConf = s
+		case "apk_cert_with_dsa_sha1":
+			dsaConf = s
+		}
+	}
+	err := tmpag.addSigners([]signer.Configuration{legacyConf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := authorization{ID: "rootsetuser", Key: "fs5wgcer9qj819kfptdlp8gm227ewxnzvsuj9ztycsx08hfhzu", Signers: []string{legacyConf.ID}}
+	err = tmpag.addAuthorizations([]authorization{user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.addRootSets([]rootSetConfig{
+		{Name: "autograph-dev", Certificates: legacyConf.Certificate},
+		{Name: "prod", Certificates: dsaConf.Certificate},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tmpag.addRootSets([]rootSetConfig{{Name: "prod", Certificates: "not a certificate"}})
+	if err == nil {
+		t.Fatal("expected root set without certificates to fail")
+	}
+
+	unsignedAPK, err := ioutil.ReadFile("signer/apk/aligned-two-files.apk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apkSigner, ok := tmpag.getSignerByID(legacyConf.ID)
+	if !ok {
+		t.Fatalf("missing %s signer", legacyConf.ID)
+	}
+	signedAPK, err := apkSigner.(signer.FileSigner).SignFile(unsignedAPK, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.StdEncoding.EncodeToString(signedAPK)
+
+	for i, testcase := range []struct {
+		roots  string
+		status int
+		valid  bool
+	}{
+		{"autograph-dev", http.StatusOK, true},
+		{"prod", http.StatusOK, false},
+		{"stage", http.StatusBadRequest, false},
+	} {
+		body, err := json.Marshal(formats.VerificationRequest{Input: input, Roots: testcase.roots})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://foo.bar/verify", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", getAuthHeader(req, user.ID, user.Key, sha256.New, id(), "application/json", body))
+		w := httptest.NewRecorder()
+		tmpag.handleVerify(w, req)
+		if w.Code != testcase.status {
+			t.Fatalf("testcase %d: expected status %d, got %d: %s", i, testcase.status, w.Code, w.Body.String())
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var resp formats.VerificationResponse
+		err = json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Valid != testcase.valid || resp.Roots != testcase.roots {
+			t.Fatalf("testcase %d: expected valid %t against root set %q, got %+v", i, testcase.valid, testcase.roots, resp)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"runtime"
+	"sort"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer/apk"
+	"go.mozilla.org/autograph/signer/apk2"
+	"go.mozilla.org/autograph/signer/contentsignature"
+	"go.mozilla.org/autograph/signer/contentsignaturepki"
+	"go.mozilla.org/autograph/signer/genericrsa"
+	"go.mozilla.org/autograph/signer/gpg2"
+	"go.mozilla.org/autograph/signer/macos"
+	"go.mozilla.org/autograph/signer/mar"
+	"go.mozilla.org/autograph/signer/nullsigner"
+	"go.mozilla.org/autograph/signer/pgp"
+	"go.mozilla.org/autograph/signer/plugin"
+	"go.mozilla.org/autograph/signer/rsapss"
+	"go.mozilla.org/autograph/signer/sigstore"
+	"go.mozilla.org/autograph/signer/threshold"
+	"go.mozilla.org/autograph/signer/xpi"
+)
+
+// signerSchemaVersions maps each signer type to the version of the
+// format of the signature or signed file it returns. Bump the version
+// when a signer changes its output in a way clients need to know about.
+var signerSchemaVersions = map[string]int{
+	apk.Type:                 1,
+	apk2.Type:                1,
+	contentsignature.Type:    1,
+	contentsignaturepki.Type: 1,
+	genericrsa.Type:          1,
+	gpg2.Type:                1,
+	macos.Type:               1,
+	mar.Type:                 1,
+	nullsigner.Type:          1,
+	pgp.Type:                 1,
+	plugin.Type:              1,
+	rsapss.Type:              1,
+	sigstore.Type:            1,
+	threshold.Type:           1,
+	xpi.Type:                 1,
+}
+
+// schemaVersions lists the data formats versions of the API and the
+// enabled signers
+type schemaVersions struct {
+	SignatureResponse int            `json:"signature_response"`
+	Signers           map[string]int `json:"signers"`
+}
+
+// runtimeVersion is the version info autograph adds to the
+// version.json file written at build time
+type runtimeVersion struct {
+	GoVersion      string         `json:"go_version"`
+	SignerTypes    []string       `json:"signer_types"`
+	SchemaVersions schemaVersions `json:"schema_versions"`
+	FIPS           fipsStatus     `json:"fips"`
+}
+
+// getRuntimeVersion returns the go version, the sorted list of the
+// types of enabled signers and their schema versions
+func (a *autographer) getRuntimeVersion() runtimeVersion {
+	v := runtimeVersion{
+		GoVersion:   runtime.Version(),
+		SignerTypes: []string{},
+		SchemaVersions: schemaVersions{
+			SignatureResponse: formats.SignatureResponseSchemaVersion,
+			Signers:           make(map[string]int),
+		},
+		FIPS: fipsStatus{
+			Enabled:         a.fips,
+			ValidatedModule: fipsBuild,
+		},
+	}
+	for _, s := range a.getSigners() {
+		signerType := s.Config().Type
+		if _, ok := v.SchemaVersions.Signers[signerType]; ok {
+			continue
+		}
+		v.SchemaVersions.Signers[signerType] = signerSchemaVersions[signerType]
+		v.SignerTypes = append(v.SignerTypes, signerType)
+	}
+	sort.Strings(v.SignerTypes)
+	return v
+}
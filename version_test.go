@@ -0,0 +1,90 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"testing"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer/contentsignature"
+	"go.mozilla.org/autograph/signer/xpi"
+)
+
+func TestGetRuntimeVersion(t *testing.T) {
+	t.Parallel()
+
+	v := ag.getRuntimeVersion()
+	if v.GoVersion == "" {
+		t.Fatalf("missing go version")
+	}
+	if !sort.StringsAreSorted(v.SignerTypes) {
+		t.Fatalf("signer types are not sorted: %v", v.SignerTypes)
+	}
+	if len(v.SignerTypes) != len(v.SchemaVersions.Signers) {
+		t.Fatalf("got %d signer types but %d schema versions", len(v.SignerTypes), len(v.SchemaVersions.Signers))
+	}
+	for _, signerType := range []string{contentsignature.Type, xpi.Type} {
+		if v.SchemaVersions.Signers[signerType] < 1 {
+			t.Fatalf("missing schema version for enabled signer type %q", signerType)
+		}
+	}
+	if v.SchemaVersions.SignatureResponse != formats.SignatureResponseSchemaVersion {
+		t.Fatalf("expected signature response schema version %d, got %d",
+			formats.SignatureResponseSchemaVersion, v.SchemaVersions.SignatureResponse)
+	}
+}
+
+// signerTypePackages returns the packages of the signer types that
+// are used as NAME.Type in the nodes of a source file
+func signerTypePackages(t *testing.T, filename string, inspect func(ast.Node) []ast.Expr) map[string]bool {
+	file, err := parser.ParseFile(token.NewFileSet(), filename, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packages := make(map[string]bool)
+	ast.Inspect(file, func(n ast.Node) bool {
+		for _, expr := range inspect(n) {
+			sel, ok := expr.(*ast.SelectorExpr)
+			if !ok || sel.Sel.Name != "Type" {
+				continue
+			}
+			if pkg, ok := sel.X.(*ast.Ident); ok {
+				packages[pkg.Name] = true
+			}
+		}
+		return true
+	})
+	return packages
+}
+
+func TestSignerSchemaVersionsCoverSignerTypes(t *testing.T) {
+	t.Parallel()
+
+	// the signer types newSigner initializes
+	initialized := signerTypePackages(t, "signerinit.go", func(n ast.Node) []ast.Expr {
+		if clause, ok := n.(*ast.CaseClause); ok {
+			return clause.List
+		}
+		return nil
+	})
+	versioned := signerTypePackages(t, "version.go", func(n ast.Node) []ast.Expr {
+		if kv, ok := n.(*ast.KeyValueExpr); ok {
+			return []ast.Expr{kv.Key}
+		}
+		return nil
+	})
+	if len(initialized) == 0 {
+		t.Fatal("found no signer types in newSigner")
+	}
+	for pkg := range initialized {
+		if !versioned[pkg] {
+			t.Errorf("signer type %s.Type has no schema version in signerSchemaVersions", pkg)
+		}
+	}
+}
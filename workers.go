@@ -0,0 +1,425 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/formats"
+	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/autograph/signer/mar"
+	"go.mozilla.org/autograph/signer/xpi"
+	"go.mozilla.org/autograph/trace"
+)
+
+// workerError is returned by remote signers when a worker failed to
+// sign, with the status and error code of the worker response
+type workerError struct {
+	status int
+	resp   formats.ErrorResponse
+}
+
+func (e *workerError) Error() string {
+	return "worker: " + e.resp.Message
+}
+
+// workerPool sends the signing operations of a frontend to workers
+type workerPool struct {
+	urls   []string
+	client *http.Client
+	next   uint32
+}
+
+// newWorkerPool returns a pool of the workers of a split deployment
+// configuration, with a client presenting the frontend certificate
+func newWorkerPool(conf splitRoleConfig) (*workerPool, error) {
+	if len(conf.Workers) == 0 {
+		return nil, errors.New("frontends require at least one worker")
+	}
+	if conf.CACert == "" || conf.ClientCert == "" || conf.ClientKey == "" {
+		return nil, errors.New("frontends require a CA certificate and a client certificate and key")
+	}
+	pool, err := loadCertPool(conf.CACert)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(conf.ClientCert, conf.ClientKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load frontend client certificate")
+	}
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = defaultWorkerTimeout
+	}
+	p := &workerPool{
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs:      pool,
+					Certificates: []tls.Certificate{cert},
+				},
+			},
+		},
+	}
+	for _, u := range conf.Workers {
+		p.urls = append(p.urls, strings.TrimRight(u, "/"))
+	}
+	return p, nil
+}
+
+// do sends a request to the workers, starting with the next one in
+// turn, until one answers without a retriable server error
+func (p *workerPool) do(ctx context.Context, method, path string, body []byte) (resp *http.Response, err error) {
+	start := int(atomic.AddUint32(&p.next, 1))
+	for i := range p.urls {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		url := p.urls[(start+i)%len(p.urls)]
+		var req *http.Request
+		req, err = http.NewRequest(method, url+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		if t, ok := trace.FromContext(ctx); ok {
+			t.SetHeaders(req.Header)
+		}
+		resp, err = p.client.Do(req)
+		if err != nil {
+			log.Warnf("worker %s is unavailable: %v", url, err)
+			continue
+		}
+		if resp.StatusCode < http.StatusInternalServerError {
+			return resp, nil
+		}
+		err = readWorkerError(resp)
+		if werr, ok := err.(*workerError); ok && !werr.resp.Retriable {
+			return nil, err
+		}
+		log.Warnf("worker %s failed: %v", url, err)
+	}
+	return nil, errors.Wrap(err, "no worker available")
+}
+
+// readWorkerError returns the error of a worker response and closes
+// its body
+func readWorkerError(resp *http.Response) error {
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	werr := &workerError{status: resp.StatusCode}
+	err := json.Unmarshal(data, &werr.resp)
+	if err != nil || werr.resp.Code == "" {
+		return errors.Errorf("worker returned status %d: %s", resp.StatusCode, data)
+	}
+	return werr
+}
+
+// available returns the number of workers answering their load
+// balancer heartbeat
+func (p *workerPool) available(ctx context.Context) int {
+	var (
+		wg sync.WaitGroup
+		n  int32
+	)
+	for _, url := range p.urls {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodGet, url+"/__lbheartbeat__", nil)
+			if err != nil {
+				return
+			}
+			resp, err := p.client.Do(req.WithContext(ctx))
+			if err != nil {
+				log.Errorf("worker %s heartbeat failed: %v", url, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				atomic.AddInt32(&n, 1)
+			}
+		}(url)
+	}
+	wg.Wait()
+	return int(n)
+}
+
+// signers returns the signers of the workers
+func (p *workerPool) signers(ctx context.Context) ([]formats.WorkerSigner, error) {
+	resp, err := p.do(ctx, http.MethodGet, "/internal/signers", nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, readWorkerError(resp)
+	}
+	defer resp.Body.Close()
+	var descs []formats.WorkerSigner
+	err = json.NewDecoder(resp.Body).Decode(&descs)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse worker signers")
+	}
+	return descs, nil
+}
+
+// sign sends a signing operation to the workers
+func (p *workerPool) sign(ctx context.Context, req formats.WorkerSignRequest) (*formats.WorkerSignResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.do(ctx, http.MethodPost, "/internal/sign", body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, readWorkerError(resp)
+	}
+	defer resp.Body.Close()
+	var signResp formats.WorkerSignResponse
+	err = json.NewDecoder(resp.Body).Decode(&signResp)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse worker response")
+	}
+	return &signResp, nil
+}
+
+// addWorkerSigners adds remote signers for the signers of the workers
+// of a frontend
+func (a *autographer) addWorkerSigners(ctx context.Context, conf splitRoleConfig) error {
+	pool, err := newWorkerPool(conf)
+	if err != nil {
+		return err
+	}
+	descs, err := pool.signers(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to fetch the signers of workers")
+	}
+	for _, desc := range descs {
+		a.addSigner(newRemoteSigner(desc, pool))
+	}
+	a.workers = pool
+	log.Infof("forwarding signing operations of %d signers to %d workers", len(descs), len(pool.urls))
+	return nil
+}
+
+// remoteSignerOpts holds the JSON signer options of a worker signer so
+// responses return them like the worker would
+type remoteSignerOpts json.RawMessage
+
+// HashFunc is not used by remote signers
+func (o remoteSignerOpts) HashFunc() crypto.Hash { return 0 }
+
+// MarshalJSON returns the signer options of the worker
+func (o remoteSignerOpts) MarshalJSON() ([]byte, error) { return []byte(o), nil }
+
+// remoteDefaultOptions asks the worker to sign with the default
+// options of its signer
+type remoteDefaultOptions struct{}
+
+// remoteSignature is a signature marshaled by a worker
+type remoteSignature string
+
+// Marshal returns the signature marshaled by the worker
+func (s remoteSignature) Marshal() (string, error) { return string(s), nil }
+
+// remoteSigner stands in for a signer of the workers on a frontend.
+// It implements the signing interfaces of the worker signer through
+// the remote* types it is embedded in.
+type remoteSigner struct {
+	sync.Mutex
+	conf     signer.Configuration
+	testFile []byte
+	pool     *workerPool
+}
+
+// newRemoteSigner returns a remote signer with the signing interfaces
+// of a worker signer
+func newRemoteSigner(desc formats.WorkerSigner, pool *workerPool) signer.Signer {
+	r := &remoteSigner{
+		conf: signer.Configuration{
+			ID:        desc.ID,
+			Type:      desc.Type,
+			Mode:      desc.Mode,
+			Hash:      desc.Hash,
+			PublicKey: desc.PublicKey,
+			X5U:       desc.X5U,
+		},
+		testFile: desc.TestFile,
+		pool:     pool,
+	}
+	if len(desc.SignerOpts) > 0 && string(desc.SignerOpts) != "null" {
+		r.conf.SignerOpts = remoteSignerOpts(desc.SignerOpts)
+	}
+	switch {
+	case desc.HashSigning && desc.DataSigning && desc.FileSigning:
+		return &remoteHashDataFileSigner{r, remoteHash{r}, remoteData{r}, remoteFile{r}}
+	case desc.HashSigning && desc.DataSigning:
+		return &remoteHashDataSigner{r, remoteHash{r}, remoteData{r}}
+	case desc.DataSigning && desc.FileSigning:
+		return &remoteDataFileSigner{r, remoteData{r}, remoteFile{r}}
+	case desc.DataSigning:
+		return &remoteDataSigner{r, remoteData{r}}
+	case desc.FileSigning:
+		return &remoteFileSigner{r, remoteFile{r}}
+	}
+	return r
+}
+
+// Config returns the configuration of the worker signer
+func (r *remoteSigner) Config() signer.Configuration {
+	r.Lock()
+	defer r.Unlock()
+	return r.conf
+}
+
+// GetDefaultOptions returns options that sign with the default
+// options of the worker signer
+func (r *remoteSigner) GetDefaultOptions() interface{} {
+	return remoteDefaultOptions{}
+}
+
+// sign sends a signing operation to the workers and keeps the X5U of
+// the signer up to date
+func (r *remoteSigner) sign(ctx context.Context, operation string, input []byte, options interface{}) (*formats.WorkerSignResponse, error) {
+	req := formats.WorkerSignRequest{
+		RequestID:       requestIDFromContext(ctx),
+		SignerID:        r.conf.ID,
+		Operation:       operation,
+		Input:           input,
+		AllowedAddOnIDs: xpi.AllowedIDsFromContext(ctx),
+		AllowedChannels: mar.AllowedChannelsFromContext(ctx),
+	}
+	if _, ok := options.(remoteDefaultOptions); ok {
+		req.DefaultOptions = true
+	} else if options != nil {
+		var err error
+		req.Options, err = json.Marshal(options)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal signing options")
+		}
+	}
+	resp, err := r.pool.sign(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.X5U != "" {
+		r.Lock()
+		r.conf.X5U = resp.X5U
+		r.Unlock()
+	}
+	return resp, nil
+}
+
+// remoteHash signs hashes with a remote signer
+type remoteHash struct{ r *remoteSigner }
+
+func (h remoteHash) SignHash(digest []byte, options interface{}) (signer.Signature, error) {
+	return h.SignHashContext(context.Background(), digest, options)
+}
+
+func (h remoteHash) SignHashContext(ctx context.Context, digest []byte, options interface{}) (signer.Signature, error) {
+	resp, err := h.r.sign(ctx, formats.WorkerOperationHash, digest, options)
+	if err != nil {
+		return nil, err
+	}
+	return remoteSignature(resp.Signature), nil
+}
+
+// remoteData signs data with a remote signer
+type remoteData struct{ r *remoteSigner }
+
+func (d remoteData) SignData(data []byte, options interface{}) (signer.Signature, error) {
+	return d.SignDataContext(context.Background(), data, options)
+}
+
+func (d remoteData) SignDataContext(ctx context.Context, data []byte, options interface{}) (signer.Signature, error) {
+	resp, err := d.r.sign(ctx, formats.WorkerOperationData, data, options)
+	if err != nil {
+		return nil, err
+	}
+	return remoteSignature(resp.Signature), nil
+}
+
+// remoteFile signs files with a remote signer
+type remoteFile struct{ r *remoteSigner }
+
+func (f remoteFile) SignFile(file []byte, options interface{}) (signer.SignedFile, error) {
+	return f.SignFileContext(context.Background(), file, options)
+}
+
+func (f remoteFile) SignFileContext(ctx context.Context, file []byte, options interface{}) (signer.SignedFile, error) {
+	signedfile, _, err := f.SignFileArtifacts(ctx, file, options)
+	return signedfile, err
+}
+
+func (f remoteFile) SignFileArtifacts(ctx context.Context, file []byte, options interface{}) (signer.SignedFile, []signer.Artifact, error) {
+	resp, err := f.r.sign(ctx, formats.WorkerOperationFile, file, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	var artifacts []signer.Artifact
+	for _, artifact := range resp.Artifacts {
+		data, err := base64.StdEncoding.DecodeString(artifact.Data)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to decode artifact %q", artifact.Name)
+		}
+		artifacts = append(artifacts, signer.Artifact{
+			Name:        artifact.Name,
+			ContentType: artifact.ContentType,
+			Data:        data,
+		})
+	}
+	return resp.SignedFile, artifacts, nil
+}
+
+func (f remoteFile) GetTestFile() []byte {
+	return f.r.testFile
+}
+
+// remote signers with the signing interfaces of each worker signer type
+type (
+	remoteHashDataFileSigner struct {
+		*remoteSigner
+		remoteHash
+		remoteData
+		remoteFile
+	}
+	remoteHashDataSigner struct {
+		*remoteSigner
+		remoteHash
+		remoteData
+	}
+	remoteDataFileSigner struct {
+		*remoteSigner
+		remoteData
+		remoteFile
+	}
+	remoteDataSigner struct {
+		*remoteSigner
+		remoteData
+	}
+	remoteFileSigner struct {
+		*remoteSigner
+		remoteFile
+	}
+)
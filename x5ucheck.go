@@ -0,0 +1,100 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"go.mozilla.org/autograph/signer"
+)
+
+// x5uChecks keeps the results of the last checks of the chains signers
+// publish at their x5u, which the heartbeat reports
+type x5uChecks struct {
+	sync.RWMutex
+	// invalid maps the IDs of signers whose x5u failed its last
+	// check to the error of the check
+	invalid map[string]string
+}
+
+// x5uCheckers returns the initialized signers that publish an x5u
+func (a *autographer) x5uCheckers() (checkers []signer.X5UChecker) {
+	for _, s := range a.getSigners() {
+		if d, ok := s.(deferredSigner); ok {
+			// don't initialize lazy signers to check them
+			s = d.initialized()
+		}
+		if c, ok := s.(signer.X5UChecker); ok {
+			checkers = append(checkers, c)
+		}
+	}
+	return checkers
+}
+
+// checkX5Us downloads the x5u of each signer that publishes one, and
+// records the signers whose chain isn't valid anymore
+func (a *autographer) checkX5Us(ctx context.Context) {
+	invalid := make(map[string]string)
+	for _, c := range a.x5uCheckers() {
+		id := c.(signer.Signer).Config().ID
+		err := c.CheckX5U(ctx)
+		result := "valid"
+		if err != nil {
+			log.WithFields(log.Fields{"signer_id": id}).Errorf("x5u check failed: %v", err)
+			invalid[id] = err.Error()
+			result = "invalid"
+		}
+		if a.stats != nil {
+			sendStatsErr := a.stats.Incr("x5u_check", []string{"signer:" + id, "result:" + result}, 1.0)
+			if sendStatsErr != nil {
+				log.Warnf("Error sending x5u_check: %s", sendStatsErr)
+			}
+		}
+	}
+	a.x5uChecks.Lock()
+	a.x5uChecks.invalid = invalid
+	a.x5uChecks.Unlock()
+}
+
+// checkX5UsEvery checks the x5u of signers at an interval, forever
+func (a *autographer) checkX5UsEvery(interval time.Duration) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		a.checkX5Us(ctx)
+		cancel()
+		time.Sleep(interval)
+	}
+}
+
+// enableX5UChecks checks the x5u of signers in the background, so the
+// heartbeat reports chains that were overwritten or corrupted after
+// they were uploaded. The checks are disabled when interval is zero.
+func (a *autographer) enableX5UChecks(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	log.Infof("checking the x5u of signers every %s", interval)
+	a.x5uChecks = &x5uChecks{invalid: make(map[string]string)}
+	go a.checkX5UsEvery(interval)
+}
+
+// getInvalidX5Us returns the signers whose x5u failed its last check
+// with the error of the check
+func (a *autographer) getInvalidX5Us() map[string]string {
+	if a.x5uChecks == nil {
+		return nil
+	}
+	a.x5uChecks.RLock()
+	defer a.x5uChecks.RUnlock()
+	invalid := make(map[string]string, len(a.x5uChecks.invalid))
+	for id, err := range a.x5uChecks.invalid {
+		invalid[id] = err
+	}
+	return invalid
+}
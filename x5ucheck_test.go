@@ -0,0 +1,84 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"go.mozilla.org/autograph/signer"
+)
+
+func TestHeartbeatReportsInvalidX5U(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "x5ucheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var signerConfs []signer.Configuration
+	for _, s := range conf.Signers {
+		if s.ID == "normandy" || s.ID == "appkey1" {
+			if s.ID == "normandy" {
+				s.ChainUploadLocation = "file://" + dir + "/"
+				s.X5U = s.ChainUploadLocation
+			}
+			signerConfs = append(signerConfs, s)
+		}
+	}
+	tmpag := newAutographer(1)
+	tmpag.heartbeatConf = &heartbeatConfig{}
+	err = tmpag.addSigners(signerConfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.x5uChecks = &x5uChecks{}
+	if len(tmpag.x5uCheckers()) != 1 {
+		t.Fatalf("expected only normandy to publish an x5u, got %d signers", len(tmpag.x5uCheckers()))
+	}
+
+	heartbeat := func() map[string]string {
+		req, err := http.NewRequest("GET", "http://foo.bar/__heartbeat__", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		tmpag.handleHeartbeat(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected heartbeat to pass, got %d: %s", w.Code, w.Body.String())
+		}
+		var result struct {
+			InvalidX5Us map[string]string `json:"invalidX5Us"`
+		}
+		err = json.Unmarshal(w.Body.Bytes(), &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.InvalidX5Us
+	}
+
+	tmpag.checkX5Us(context.Background())
+	if invalid := heartbeat(); len(invalid) != 0 {
+		t.Fatalf("expected no invalid x5u, got %v", invalid)
+	}
+
+	s, _ := tmpag.getSignerByID("normandy")
+	err = ioutil.WriteFile(strings.TrimPrefix(s.Config().X5U, "file://"), []byte("overwritten"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpag.checkX5Us(context.Background())
+	invalid := heartbeat()
+	if len(invalid) != 1 || !strings.Contains(invalid["normandy"], "failed to find ee certificate") {
+		t.Fatalf("expected heartbeat to report the x5u of normandy, got %v", invalid)
+	}
+}